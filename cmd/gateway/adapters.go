@@ -0,0 +1,208 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/gateway"
+	"github.com/JacoJooste/iot-edge/v7/internal/storage"
+	"github.com/JacoJooste/iot-edge/v7/pkg/extension"
+	"github.com/JacoJooste/iot-edge/v7/pkg/southbound"
+)
+
+// Southbound adapters are added to the gateway by importing their packages for their side effects in the import block
+// above, for example:
+//
+//    _ "example.com/iot/zigbee"
+//
+// The imported packages register their adapters with southbound.Register, after which they can be enabled with the
+// --adapter option. Adapters, request filters and event sinks can also be registered by Go plugins that are loaded
+// with the --plugin option, see the extension package.
+
+// parseExtension parses an adapter, filter or sink option of the form 'name' or 'name:key=value,key=value'
+func parseExtension(option string) (name string, options map[string]string, err error) {
+	options = make(map[string]string)
+	i := strings.Index(option, ":")
+	if i < 0 {
+		return option, options, nil
+	}
+	name = option[:i]
+	for _, pair := range strings.Split(option[i+1:], ",") {
+		j := strings.Index(pair, "=")
+		if j < 1 {
+			return "", nil, fmt.Errorf("invalid extension option `%s`, must be of the form 'key=value'", pair)
+		}
+		options[pair[:j]] = pair[j+1:]
+	}
+	return name, options, nil
+}
+
+// enableAdapters enables the southbound adapters given on the command line
+func enableAdapters(thingGateway *gateway.ThingGateway, opts commandlineOpts) error {
+	if len(opts.Adapters) == 0 {
+		return nil
+	}
+	config := gateway.ProxyConfig{
+		Audience:         opts.Audience,
+		Interval:         opts.AdapterInterval,
+		ForwardTokens:    opts.AdapterTokens,
+		Scopes:           opts.AdapterScopes,
+		RequestAsGateway: opts.AdapterChildTokens,
+	}
+	var err error
+	switch {
+	case opts.AdapterKeyStore != "":
+		if config.KeyStore, err = openKeyStore(opts); err != nil {
+			return err
+		}
+	case opts.AdapterKeyFile != "":
+		if config.MasterKey, err = ioutil.ReadFile(opts.AdapterKeyFile); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("a master key file or a key store is required to enable adapters")
+	}
+	for _, option := range opts.Adapters {
+		name, options, err := parseExtension(option)
+		if err != nil {
+			return err
+		}
+		adapter, err := southbound.New(name, options)
+		if err != nil {
+			return fmt.Errorf("%w, registered adapters: %v", err, southbound.Registered())
+		}
+		if err = thingGateway.EnableAdapter(adapter, config); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadPlugins loads the Go plugins given on the command line, which register their extensions
+func loadPlugins(opts commandlineOpts) error {
+	for _, file := range opts.Plugins {
+		if err := gateway.LoadPlugin(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enableFilters adds the request filters given on the command line
+func enableFilters(thingGateway *gateway.ThingGateway, opts commandlineOpts) error {
+	for _, option := range opts.Filters {
+		name, options, err := parseExtension(option)
+		if err != nil {
+			return err
+		}
+		filter, err := extension.NewFilter(name, options)
+		if err != nil {
+			return fmt.Errorf("%w, registered filters: %v", err, extension.RegisteredFilters())
+		}
+		if err = thingGateway.AddRequestFilter(filter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sinkPublishers creates the publishers for the event sinks given on the command line
+func sinkPublishers(opts commandlineOpts) ([]gateway.EventPublisher, error) {
+	var publishers []gateway.EventPublisher
+	for _, option := range opts.Sinks {
+		name, options, err := parseExtension(option)
+		if err != nil {
+			return nil, err
+		}
+		sink, err := extension.NewSink(name, options)
+		if err != nil {
+			return nil, fmt.Errorf("%w, registered sinks: %v", err, extension.RegisteredSinks())
+		}
+		publishers = append(publishers, gateway.SinkPublisher(sink))
+	}
+	return publishers, nil
+}
+
+// openKeyStore opens the key store of proxied things with the key encryption key given on the command line
+func openKeyStore(opts commandlineOpts) (*gateway.ProxyKeyStore, error) {
+	var kek gateway.KeyEncryptionKey
+	switch {
+	case opts.AdapterKEKFile != "":
+		secret, err := ioutil.ReadFile(opts.AdapterKEKFile)
+		if err != nil {
+			return nil, err
+		}
+		if kek, err = gateway.NewKeyEncryptionKey(secret); err != nil {
+			return nil, err
+		}
+	case opts.AdapterKEKKeyring != "":
+		var err error
+		if kek, err = gateway.KeyringKeyEncryptionKey(opts.AdapterKEKKeyring); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("a key encryption key file or keyring key is required for the key store")
+	}
+	return gateway.OpenProxyKeyStore(opts.AdapterKeyStore, kek)
+}
+
+// transferKeys exports the keys of proxied things from the key store or imports them into the key store if requested
+// on the command line. Returns true if the keys were transferred, after which the gateway exits.
+func transferKeys(opts commandlineOpts) (bool, error) {
+	if opts.AdapterKeyExport == "" && opts.AdapterKeyImport == "" {
+		return false, nil
+	}
+	if opts.AdapterKeyExport != "" && opts.AdapterKeyImport != "" {
+		return true, fmt.Errorf("keys can not be exported and imported at the same time")
+	}
+	if opts.AdapterKeyStore == "" || opts.AdapterKeyPassphrase == "" {
+		return true, fmt.Errorf("a key store and a passphrase file are required to transfer keys")
+	}
+	store, err := openKeyStore(opts)
+	if err != nil {
+		return true, err
+	}
+	passphrase, err := ioutil.ReadFile(opts.AdapterKeyPassphrase)
+	if err != nil {
+		return true, err
+	}
+	passphrase = bytes.TrimRight(passphrase, "\r\n")
+	if opts.AdapterKeyExport != "" {
+		b, err := store.Export(passphrase)
+		if err != nil {
+			return true, err
+		}
+		if err = storage.WritePrivateFile(opts.AdapterKeyExport, b); err != nil {
+			return true, err
+		}
+		fmt.Printf("Exported the keys of proxied things to %s.\n", opts.AdapterKeyExport)
+		return true, nil
+	}
+	b, err := ioutil.ReadFile(opts.AdapterKeyImport)
+	if err != nil {
+		return true, err
+	}
+	n, err := store.Import(b, passphrase)
+	if err != nil {
+		return true, err
+	}
+	fmt.Printf("Imported the keys of %d proxied things from %s.\n", n, opts.AdapterKeyImport)
+	return true, nil
+}
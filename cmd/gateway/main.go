@@ -21,17 +21,23 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/url"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/JacoJooste/iot-edge/v7/internal/gateway"
+	"github.com/JacoJooste/iot-edge/v7/internal/storage"
 	"github.com/JacoJooste/iot-edge/v7/pkg/callback"
 	"github.com/JacoJooste/iot-edge/v7/pkg/thing"
 	"github.com/jessevdk/go-flags"
@@ -63,19 +69,395 @@ func loadCertificates(filename string) ([]*x509.Certificate, error) {
 	return x509.ParseCertificates(block.Bytes)
 }
 
+// loadCertificateBundle loads all the certificates in a PEM file
+func loadCertificateBundle(filename string) ([]*x509.Certificate, error) {
+	certBytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(certBytes); block != nil; block, rest = pem.Decode(rest) {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found in %s", filename)
+	}
+	return certs, nil
+}
+
+// certificatePolicy creates the policy for the certificates of registering things from the command line options
+func certificatePolicy(opts commandlineOpts) (policy gateway.CertificatePolicy, err error) {
+	roots, err := loadCertificateBundle(opts.TrustedCAFile)
+	if err != nil {
+		return policy, err
+	}
+	policy.Roots = x509.NewCertPool()
+	for _, cert := range roots {
+		policy.Roots.AddCert(cert)
+	}
+	if opts.IntermediateCAFile != "" {
+		if policy.Intermediates, err = loadCertificateBundle(opts.IntermediateCAFile); err != nil {
+			return policy, err
+		}
+	}
+	if opts.PinnedCAFile != "" {
+		pinned, err := loadCertificateBundle(opts.PinnedCAFile)
+		if err != nil {
+			return policy, err
+		}
+		for _, cert := range pinned {
+			policy.PinnedIntermediates = append(policy.PinnedIntermediates, gateway.CertificateFingerprint(cert))
+		}
+	}
+	policy.RequireFullChain = opts.RequireFullChain
+	return policy, nil
+}
+
+// gatewayOAuth2Client returns the ID of the gateway's OAuth 2.0 client. The client is registered dynamically with AM
+// the first time the gateway starts and its information is stored in the given file.
+func gatewayOAuth2Client(opts commandlineOpts) (string, error) {
+	var info thing.OAuth2ClientInformation
+	b, err := ioutil.ReadFile(opts.OAuth2ClientFile)
+	if err == nil {
+		if err = json.Unmarshal(b, &info); err != nil {
+			return "", err
+		}
+		return info.ClientID, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	u, err := url.Parse(opts.URL)
+	if err != nil {
+		return "", err
+	}
+	info, err = thing.RegisterOAuth2Client(u, opts.Realm, opts.Timeout, opts.InitialAccessToken,
+		thing.OAuth2ClientMetadata{
+			ClientName: opts.Name,
+			GrantTypes: []string{"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		})
+	if err != nil {
+		return "", err
+	}
+	if b, err = json.Marshal(info); err != nil {
+		return "", err
+	}
+	return info.ClientID, storage.WritePrivateFile(opts.OAuth2ClientFile, b)
+}
+
+// parseHeader parses a header given in the form "Name: Value"
+func parseHeader(header string) (name, value string, err error) {
+	i := strings.Index(header, ":")
+	if i < 1 {
+		return "", "", fmt.Errorf("invalid header `%s`, must be of the form 'Name: Value'", header)
+	}
+	return strings.TrimSpace(header[:i]), strings.TrimSpace(header[i+1:]), nil
+}
+
+// parseCacheTTL parses a response cache option of the form 'route=duration'
+func parseCacheTTL(option string) (route string, ttl time.Duration, err error) {
+	i := strings.Index(option, "=")
+	if i < 1 {
+		return "", 0, fmt.Errorf("invalid cache TTL `%s`, must be of the form 'route=duration'", option)
+	}
+	ttl, err = time.ParseDuration(option[i+1:])
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid cache TTL `%s`: %w", option, err)
+	}
+	return option[:i], ttl, nil
+}
+
+// parseMaintenanceWindow parses a maintenance window of the form 'HH:MM/duration', the start being in UTC
+func parseMaintenanceWindow(option string) (window gateway.MaintenanceWindow, err error) {
+	i := strings.Index(option, "/")
+	if i < 1 {
+		return window, fmt.Errorf("invalid maintenance window `%s`, must be of the form 'HH:MM/duration'", option)
+	}
+	start, err := time.Parse("15:04", option[:i])
+	if err != nil {
+		return window, fmt.Errorf("invalid maintenance window `%s`: %w", option, err)
+	}
+	window.Start = time.Duration(start.Hour())*time.Hour + time.Duration(start.Minute())*time.Minute
+	if window.Length, err = time.ParseDuration(option[i+1:]); err != nil {
+		return window, fmt.Errorf("invalid maintenance window `%s`: %w", option, err)
+	}
+	return window, nil
+}
+
+// localIssuerConfig returns the configuration of the local token issuer, signing with the key of the gateway.
+// Claims are mapped in the form 'claim=source', where source is a claim of the JWT with which a thing authenticated.
+func localIssuerConfig(opts commandlineOpts, key crypto.Signer, audit gateway.AuditFunc) (gateway.LocalIssuerConfig, error) {
+	config := gateway.LocalIssuerConfig{
+		Key:       key,
+		KeyID:     opts.KeyID,
+		Issuer:    opts.Name,
+		Audiences: opts.LocalAudiences,
+		Scopes:    opts.LocalScopes,
+		Lifetime:  opts.LocalTokenLifetime,
+		Claims:    make(map[string]string),
+		Audit:     audit,
+	}
+	for _, option := range opts.LocalClaims {
+		i := strings.Index(option, "=")
+		if i < 1 || i == len(option)-1 {
+			return config, fmt.Errorf("invalid local claim `%s`, must be of the form 'claim=source'", option)
+		}
+		config.Claims[option[:i]] = option[i+1:]
+	}
+	return config, nil
+}
+
+// warmThings loads the keys of the things that the gateway warms up, given in the form 'thingID=keyfile'
+func warmThings(opts commandlineOpts) ([]gateway.WarmThing, error) {
+	var things []gateway.WarmThing
+	for _, option := range opts.WarmThings {
+		i := strings.Index(option, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("invalid warm thing `%s`, must be of the form 'thingID=keyfile'", option)
+		}
+		key, err := loadKey(option[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		things = append(things, gateway.WarmThing{ThingID: option[:i], Audience: opts.Audience, Key: key})
+	}
+	return things, nil
+}
+
+// serverIdentity configures the certificate presented by the CoAP server, which is loaded from PEM files or issued
+// by an internal CA or an ACME server. A self-signed certificate is presented if none is configured.
+func serverIdentity(thingGateway *gateway.ThingGateway, opts commandlineOpts) error {
+	switch {
+	case opts.ServerCertFile != "":
+		cert, err := gateway.LoadServerCertificate(opts.ServerCertFile, opts.ServerKeyFile)
+		if err != nil {
+			return err
+		}
+		return thingGateway.SetServerCertificate(cert)
+	case opts.ServerCACertFile != "":
+		cas, err := loadCertificates(opts.ServerCACertFile)
+		if err != nil {
+			return err
+		}
+		caKey, err := loadKey(opts.ServerCAKeyFile)
+		if err != nil {
+			return err
+		}
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		return thingGateway.EnableCertificateRenewal(gateway.CertificateRenewal{
+			Issuer:     gateway.CAIssuer{Certificate: cas[0], Key: caKey, Validity: opts.ServerCertValidity},
+			Key:        key,
+			CommonName: opts.Name,
+			DNSNames:   opts.ServerNames,
+		})
+	case opts.ACMEDirectory != "":
+		accountKey, err := loadKey(opts.ACMEAccountKeyFile)
+		if err != nil {
+			return err
+		}
+		issuer, err := gateway.NewACMEIssuer(gateway.ACMEConfig{
+			DirectoryURL:     opts.ACMEDirectory,
+			AccountKey:       accountKey,
+			Contact:          opts.ACMEContacts,
+			ChallengeAddress: opts.ACMEChallengeAddr,
+		})
+		if err != nil {
+			return err
+		}
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		return thingGateway.EnableCertificateRenewal(gateway.CertificateRenewal{
+			Issuer:     issuer,
+			Key:        key,
+			CommonName: opts.Name,
+			DNSNames:   opts.ServerNames,
+		})
+	}
+	return nil
+}
+
+// debugLevels maps the debug level options to the debug levels
+var debugLevels = map[string]thing.DebugLevel{
+	"error": thing.DebugError,
+	"info":  thing.DebugInfo,
+	"trace": thing.DebugTrace,
+}
+
 type commandlineOpts struct {
-	URL      string `long:"url" required:"true" description:"AM URL"`
+	URL      string `long:"url" required:"true" description:"AM URL, or the CoAP URL of an upstream gateway"`
 	Realm    string `long:"realm" description:"AM Realm"`
 	Audience string `long:"audience" required:"true" description:"JWT Audience"`
 	Tree     string `long:"tree" required:"true" description:"Authentication tree"`
 	Name     string `long:"name" required:"true" description:"Gateway name"`
 	Address  string `long:"address" required:"true" description:"CoAP Address of Gateway"`
-	KeyFile  string `long:"key" required:"true" description:"The file containing the Gateway's signing key"`
+	KeyFile  string `long:"key" description:"The file containing the Gateway's signing key"`
 	KeyID    string `long:"kid" description:"The Gateway's signing key ID"`
 	CertFile string `long:"cert" description:"The file containing the Gateway's certificate"`
 	// see time.ParseDuration for valid timeout strings
 	Timeout time.Duration `long:"timeout" default:"5s" description:"Timeout for AM communications"`
-	Debug   bool          `short:"d" long:"debug" description:"Switch on debug"`
+	// offline authentication is disabled if the grace period is zero
+	OfflineGrace time.Duration `long:"offline-grace" description:"Period after an AM authentication in which a thing can be authenticated offline"`
+	AuditFile    string        `long:"audit" description:"The file to which gateway audit events are appended, defaults to standard out"`
+	BlockSize    int           `long:"block-size" default:"1024" description:"Block size in bytes for CoAP block-wise transfers"`
+	Transport    string        `long:"transport" default:"udp-dtls" choice:"udp-dtls" choice:"tcp-tls" choice:"tcp" description:"Transport over which CoAP requests are received"`
+	// requests are only acknowledged separately from their responses if the delay is set
+	SeparateResponseDelay time.Duration `long:"separate-response-delay" description:"Delay after which a request waiting for AM is acknowledged and its response is sent separately"`
+	// registration and access token requests are only deduplicated by idempotency key if the lifetime is set
+	IdempotencyKeyLifetime time.Duration `long:"idempotency-key-lifetime" description:"Period for which the response to a request carrying an idempotency key is replayed to repeated attempts"`
+	// plain JSON requests are trusted over OSCORE or when client certificates are required
+	ContentPolicy string `long:"content-policy" default:"any" choice:"any" choice:"signed-untrusted" choice:"signed" description:"Formats in which thing requests are accepted"`
+	// the server presents a self-signed certificate unless a certificate or an issuing CA is provided
+	ServerCertFile     string        `long:"server-cert" description:"The file containing the certificate chain of the CoAP server"`
+	ServerKeyFile      string        `long:"server-key" description:"The file containing the private key of the CoAP server certificate"`
+	ServerCACertFile   string        `long:"server-ca-cert" description:"The file containing the CA certificate that issues and renews the CoAP server certificate"`
+	ServerCAKeyFile    string        `long:"server-ca-key" description:"The file containing the key of the CA that issues the CoAP server certificate"`
+	ServerCertValidity time.Duration `long:"server-cert-validity" default:"720h" description:"Validity of the CoAP server certificates issued by the CA"`
+	ServerNames        []string      `long:"server-name" description:"DNS name of the CoAP server added to issued certificates, may be repeated"`
+	ACMEDirectory      string        `long:"acme-directory" description:"The directory URL of the ACME server that issues and renews the CoAP server certificate"`
+	ACMEAccountKeyFile string        `long:"acme-account-key" description:"The file containing the PKCS8 key of the Gateway's ACME account"`
+	ACMEContacts       []string      `long:"acme-contact" description:"Contact URL of the Gateway's ACME account, for example mailto:admin@example.com, may be repeated"`
+	ACMEChallengeAddr  string        `long:"acme-challenge-address" default:":80" description:"Address on which the ACME http-01 challenges are answered while a certificate is obtained"`
+	// the handshakes with things are only restricted if a profile option is set
+	CipherSuites  []string `long:"cipher-suite" description:"Cipher suite that may be negotiated with things, may be repeated"`
+	Curves        []string `long:"curve" description:"Curve that may be used for key exchange with things over TLS, may be repeated"`
+	MinTLSVersion string   `long:"min-tls-version" description:"Minimum DTLS or TLS version negotiated with things"`
+	// the gateway listens on IPv4 and IPv6 if the address has no host or the unspecified IPv6 host
+	IPv6Only bool `long:"ipv6-only" description:"Only listen on IPv6 addresses"`
+	// connection limits are not applied if zero
+	MaxSessions   int           `long:"max-sessions" description:"Maximum number of concurrent CoAP sessions"`
+	IdleTimeout   time.Duration `long:"idle-timeout" description:"Period after which an idle CoAP session is closed"`
+	HandshakeRate float64       `long:"handshake-rate" description:"Maximum number of handshakes started per second"`
+	// payload sizes default to 1 MiB if zero
+	MaxRequestSize  int `long:"max-request-size" description:"Maximum size in bytes of the payload of a request from a thing"`
+	MaxResponseSize int `long:"max-response-size" description:"Maximum size in bytes of a response read from AM"`
+	// resource guards are not applied if zero
+	MaxMemory          uint64        `long:"max-memory" description:"Memory in bytes held by the gateway above which new handshakes are shed"`
+	MaxFileDescriptors int           `long:"max-file-descriptors" description:"Number of open file descriptors above which new handshakes are shed"`
+	ShedRetryAfter     time.Duration `long:"shed-retry-after" description:"Delay after which shed things should try again, defaults to 30s"`
+	// proactive work is done as soon as it is due if no maintenance window or jitter is provided
+	MaintenanceWindows []string      `long:"maintenance-window" description:"Daily window, in the form 'HH:MM/duration' in UTC, in which token refreshes and certificate renewals are done, may be repeated"`
+	MaintenanceJitter  time.Duration `long:"maintenance-jitter" description:"Maximum random delay of the warm-up of each thing when the gateway starts"`
+	// requests to AM are not limited if zero
+	MaxAMRequests      int           `long:"max-am-requests" description:"Maximum number of requests sent to AM at the same time"`
+	ReservedAMRequests int           `long:"reserved-am-requests" description:"Number of the concurrent AM requests reserved for authentication, session and token requests"`
+	AMQueueTimeout     time.Duration `long:"am-queue-timeout" description:"Maximum time that a request waits to be sent to AM, defaults to the timeout"`
+	// the gateway connects to AM unless a scenario is replayed
+	RecordAM string `long:"record-am" description:"The file in which the interactions with AM are recorded"`
+	ReplayAM string `long:"replay-am" description:"The file with recorded interactions that are served instead of connecting to AM"`
+	// the certificates of registering things are only validated by the gateway if trusted CAs are provided
+	TrustedCAFile      string `long:"trusted-ca" description:"The file containing the manufacturer CAs trusted to issue thing certificates"`
+	IntermediateCAFile string `long:"intermediate-ca" description:"The file containing intermediate CAs used to complete thing certificate chains"`
+	PinnedCAFile       string `long:"pinned-ca" description:"The file containing intermediate CAs of which one must be in a thing certificate chain"`
+	RequireFullChain   bool   `long:"require-full-chain" description:"Require things to supply their full certificate chain"`
+	// things may present any certificate during the handshake unless client CAs are provided
+	ClientCAFile string `long:"client-ca" description:"The file containing the CAs trusted to issue the client certificates of things"`
+	// the peers forwarded by downstream gateways are ignored unless the gateways are trusted
+	TrustedProxies []string `long:"trusted-proxy" description:"Common name of the client certificate of a downstream gateway that is trusted to forward the peers of its things, may be repeated"`
+	// the certificate of an upstream gateway is verified against the system roots unless upstream CAs are provided
+	UpstreamCAFile         string `long:"upstream-ca" description:"The file containing the CAs trusted to issue the certificate of an upstream gateway"`
+	UpstreamInsecureVerify bool   `long:"upstream-insecure-skip-verify" description:"Accept any certificate presented by an upstream gateway, only use for testing"`
+	// all things are proxied unless an access list is provided
+	AccessListFile string `long:"access-list" description:"The JSON file containing the thing IDs and certificate issuers that are allowed or denied"`
+	// anomalies in the request patterns of things are only detected if a window is provided
+	AnomalyWindow time.Duration `long:"anomaly-window" description:"The window over which the requests of things are counted to detect anomalies, which are written to the audit file"`
+	Quarantine    time.Duration `long:"quarantine" description:"The period for which a thing is quarantined after an anomaly, anomalies are only reported if zero"`
+	// events are only published if a sink, a webhook, an MQTT broker or a Kafka broker is provided
+	EventWebhooks  []string `long:"event-webhook" description:"URL to which gateway and thing events are posted, may be repeated"`
+	EventMQTT      string   `long:"event-mqtt" description:"Address host:port of the MQTT broker to which gateway and thing events are published"`
+	EventMQTTTopic string   `long:"event-mqtt-topic" default:"iot-gateway/events" description:"MQTT topic to which events are published"`
+	EventMQTTTLS   bool     `long:"event-mqtt-tls" description:"Connect to the MQTT broker over TLS"`
+	// the password is read from the environment so that it is not visible in the process list
+	EventMQTTUser     string `long:"event-mqtt-user" description:"User name with which the gateway connects to the MQTT broker"`
+	EventMQTTPassword string `long:"event-mqtt-password" env:"GATEWAY_EVENT_MQTT_PASSWORD" description:"Password with which the gateway connects to the MQTT broker"`
+	// events are produced to a single partition as the gateway does not discover the leaders of partitions
+	EventKafka          string `long:"event-kafka" description:"Address host:port of a Kafka broker, from which the leader of the partition to which gateway and thing events are produced is looked up"`
+	EventKafkaTopic     string `long:"event-kafka-topic" default:"iot-gateway-events" description:"Kafka topic to which events are produced"`
+	EventKafkaPartition int32  `long:"event-kafka-partition" description:"Partition of the Kafka topic to which events are produced"`
+	EventKafkaTLS       bool   `long:"event-kafka-tls" description:"Connect to the Kafka broker over TLS"`
+	EventKafkaUser      string `long:"event-kafka-user" description:"SASL user name with which the gateway authenticates with the Kafka broker"`
+	EventKafkaPassword  string `long:"event-kafka-password" env:"GATEWAY_EVENT_KAFKA_PASSWORD" description:"SASL password with which the gateway authenticates with the Kafka broker"`
+	EventKafkaMechanism string `long:"event-kafka-mechanism" default:"PLAIN" choice:"PLAIN" choice:"SCRAM-SHA-256" choice:"SCRAM-SHA-512" description:"SASL mechanism with which the gateway authenticates with the Kafka broker"`
+
+	DataDir string `long:"data-dir" optional:"yes" optional-value:"-" description:"The directory against which relative file names are resolved, the platform's configuration directory if no value is given"`
+
+	// the gateway's OAuth 2.0 client is registered dynamically if the client file does not exist
+	OAuth2ClientFile   string `long:"oauth2-client" description:"The file containing the Gateway's dynamically registered OAuth 2.0 client"`
+	InitialAccessToken string `long:"initial-access-token" description:"The initial access token for dynamic OAuth 2.0 client registration"`
+	AdminAddress       string `long:"admin-address" description:"Loopback address or 'unix:path' socket of the admin API, the API is disabled if not set"`
+	AdminTokenFile     string `long:"admin-token-file" description:"File containing the bearer token required by the admin API, required on a loopback address"`
+	UsageStatistics    bool   `long:"usage-statistics" description:"Count the authentications, tokens, requests and bytes of every thing, listed and exported as metrics by the admin API"`
+	AMCompatAddress    string `long:"am-compat-address" description:"Loopback address or 'unix:path' socket at which the AM REST endpoints used by things are served over HTTP, for clients written against AM"`
+	Debug              bool   `short:"d" long:"debug" description:"Switch on debug"`
+	DebugLevel         string `long:"debug-level" default:"trace" choice:"error" choice:"info" choice:"trace" description:"Level of detail of the debug output"`
+	// the report of a dry run is written to standard out as JSON and the gateway exits with an error if a check failed
+	DryRun bool `long:"dry-run" description:"Check the configuration, AM, the authentication tree, the keys and the CoAP address, then exit without serving"`
+	// tokens are redacted from the debug output unless redaction is switched off
+	NoRedaction bool `long:"no-redaction" description:"Write session and access tokens to the debug output"`
+	// see sidecar.go for running the gateway in a Kubernetes pod
+	Sidecar       bool          `long:"sidecar" description:"Run as a sidecar that can only be reached from its pod"`
+	IdentityDir   string        `long:"identity-dir" description:"The directory containing the Gateway's key and certificate in tls.key and tls.crt, for example a mounted TLS secret"`
+	ProbeAddress  string        `long:"probe-address" description:"Address of the /healthz and /readyz probes, the probes are disabled if not set"`
+	ShutdownGrace time.Duration `long:"shutdown-grace" description:"Maximum time for which requests in progress are completed after SIGTERM"`
+	// the gateway starts without waiting for a condition if its wait is zero
+	WaitForClock time.Duration `long:"wait-for-clock" description:"Maximum time to wait for the system clock to be synchronised before starting"`
+	WaitForKey   time.Duration `long:"wait-for-key" description:"Maximum time to wait for the Gateway's signing key to be readable and usable before starting"`
+	WaitForAM    time.Duration `long:"wait-for-am" description:"Maximum time to wait for AM to be reachable before starting"`
+
+	// session revocation is disabled if the interval is zero
+	RevocationInterval time.Duration `long:"revocation-interval" description:"Interval at which the sessions of things are validated with AM to detect revocation"`
+	// attribute subscriptions are disabled if the interval is zero
+	AttributePollInterval time.Duration `long:"attribute-poll-interval" description:"Interval at which AM is polled for the attributes that things have subscribed to"`
+	// the session token is sent in the session cookie unless a session header is provided
+	SessionCookie string `long:"session-cookie" description:"Name of the AM session cookie, overrides the name discovered from AM"`
+	SessionHeader string `long:"session-header" description:"Header in which session tokens are sent to AM instead of the session cookie"`
+	UserAgent     string `long:"user-agent" description:"User-Agent sent with requests to AM"`
+	// the information discovered from AM is not cached if the file is not set
+	AMInfoCache    string        `long:"aminfo-cache" description:"The file in which the information discovered from AM is cached between restarts"`
+	AMInfoCacheTTL time.Duration `long:"aminfo-cache-ttl" default:"1h" description:"Time after which the cached AM information is revalidated with AM"`
+	// headers are given in the form 'Name: Value'
+	Headers []string `long:"header" description:"Static header added to requests to AM, may be repeated"`
+	// cache TTLs are given in the form 'route=duration', e.g. '/aminfo=10m'
+	CacheTTLs []string `long:"cache-ttl" description:"Time for which responses to a route are cached by the gateway, may be repeated"`
+	// warm things are given in the form 'thingID=keyfile'
+	WarmThings   []string      `long:"warm-thing" description:"Thing that is authenticated with AM when the gateway starts, may be repeated"`
+	WarmUpMaxAge time.Duration `long:"warm-max-age" default:"5m" description:"Period after which an unused warm session is discarded"`
+	// adapters are given in the form 'name' or 'name:key=value,key=value'
+	Adapters        []string      `long:"adapter" description:"Southbound adapter whose devices are proxied as things, may be repeated"`
+	AdapterKeyFile  string        `long:"adapter-key" description:"The file containing the master key from which the keys of proxied things are derived"`
+	AdapterInterval time.Duration `long:"adapter-interval" default:"1m" description:"Interval at which the adapters discover devices"`
+	AdapterTokens   bool          `long:"adapter-tokens" description:"Forward access tokens to proxied devices"`
+	AdapterScopes   []string      `long:"adapter-scope" description:"Scope of the access tokens forwarded to proxied devices, may be repeated"`
+	// the keys of proxied things are derived from the master key unless a key store is provided
+	AdapterKeyStore      string `long:"adapter-key-store" description:"The file in which the encrypted keys of proxied things are stored"`
+	AdapterKEKFile       string `long:"adapter-kek" description:"The file containing the 32 byte key that encrypts the keys in the key store"`
+	AdapterKEKKeyring    string `long:"adapter-kek-keyring" description:"Description of the user key in the kernel keyring that encrypts the keys in the key store"`
+	AdapterKeyExport     string `long:"adapter-key-export" description:"Export the keys in the key store to the file, then exit"`
+	AdapterKeyImport     string `long:"adapter-key-import" description:"Import the keys in the file into the key store, then exit"`
+	AdapterKeyPassphrase string `long:"adapter-key-passphrase" description:"The file containing the passphrase that protects exported keys"`
+	// forwarded tokens are requested with the sessions of the proxied things unless requested by the gateway
+	AdapterChildTokens bool `long:"adapter-child-tokens" description:"Request the tokens forwarded to proxied devices with the gateway session"`
+	// filters and sinks are given in the same form as adapters and are registered by plugins
+	Plugins []string `long:"plugin" description:"Go plugin that registers request filters, event sinks or adapters, may be repeated"`
+	Filters []string `long:"filter" description:"Request filter registered by a plugin, may be repeated"`
+	Sinks   []string `long:"sink" description:"Event sink registered by a plugin, to which gateway and thing events are published, may be repeated"`
+	// the state of a gateway is transferred to replacement hardware in a bundle that is encrypted with the passphrase
+	StateExport     string `long:"state-export" description:"Export the gateway state files and the keys of proxied things to the bundle file, then exit"`
+	StateImport     string `long:"state-import" description:"Import the gateway state files and the keys of proxied things from the bundle file, then exit"`
+	StatePassphrase string `long:"state-passphrase" description:"The file containing the passphrase that protects the state bundle"`
+	// local tokens are not issued unless an audience is provided
+	LocalAudiences     []string      `long:"local-audience" description:"Site-local service for which the gateway issues tokens to things, may be repeated"`
+	LocalScopes        []string      `long:"local-scope" description:"Scope that things may request in local tokens, may be repeated"`
+	LocalTokenLifetime time.Duration `long:"local-token-lifetime" default:"5m" description:"Lifetime of the tokens issued by the gateway"`
+	// claims are mapped in the form 'claim=source'
+	LocalClaims []string `long:"local-claim" description:"Claim of local tokens copied from a claim of the thing's authentication JWT, may be repeated"`
 }
 
 func (o commandlineOpts) String() string {
@@ -90,8 +472,191 @@ func (o commandlineOpts) String() string {
 	kid: %s
 	certificate: %s
 	timeout %v
-	debug: %v`,
-		o.URL, o.Realm, o.Tree, o.Name, o.Address, o.KeyFile, o.KeyID, o.CertFile, o.Timeout, o.Debug)
+	offline grace: %v
+	revocation interval: %v
+	attribute poll interval: %v
+	audit: %s
+	block size: %d
+	transport: %s
+	separate response delay: %v
+	idempotency key lifetime: %v
+	cipher suites: %v
+	curves: %v
+	min TLS version: %s
+	content policy: %s
+	server certificate: %s
+	server key: %s
+	server CA certificate: %s
+	server CA key: %s
+	server certificate validity: %v
+	server names: %v
+	ACME directory: %s
+	ACME account key: %s
+	ACME contacts: %v
+	ACME challenge address: %s
+	ipv6 only: %v
+	max sessions: %d
+	idle timeout: %v
+	handshake rate: %v
+	max request size: %d
+	max response size: %d
+	max memory: %d
+	max file descriptors: %d
+	shed retry after: %v
+	maintenance windows: %v
+	maintenance jitter: %v
+	max AM requests: %d
+	reserved AM requests: %d
+	AM queue timeout: %v
+	record AM: %s
+	replay AM: %s
+	trusted CAs: %s
+	intermediate CAs: %s
+	pinned CAs: %s
+	require full chain: %v
+	client CAs: %s
+	trusted proxies: %v
+	upstream CAs: %s
+	upstream insecure skip verify: %v
+	access list: %s
+	anomaly window: %v
+	quarantine: %v
+	event webhooks: %v
+	event MQTT broker: %s
+	event MQTT topic: %s
+	event MQTT TLS: %v
+	event MQTT user: %s
+	event Kafka broker: %s
+	event Kafka topic: %s
+	event Kafka partition: %d
+	event Kafka TLS: %v
+	event Kafka user: %s
+	event Kafka mechanism: %s
+	data dir: %s
+	oauth2 client: %s
+	admin address: %s
+	admin token file: %s
+	usage statistics: %v
+	AM compat address: %s
+	session cookie: %s
+	session header: %s
+	user agent: %s
+	AM info cache: %s
+	AM info cache TTL: %v
+	headers: %v
+	cache TTLs: %v
+	warm things: %v
+	warm max age: %v
+	adapters: %v
+	adapter key: %s
+	adapter interval: %v
+	adapter tokens: %v
+	adapter scopes: %v
+	adapter key store: %s
+	adapter kek: %s
+	adapter kek keyring: %s
+	adapter key export: %s
+	adapter key import: %s
+	adapter key passphrase: %s
+	adapter child tokens: %v
+	plugins: %v
+	filters: %v
+	sinks: %v
+	state export: %s
+	state import: %s
+	state passphrase: %s
+	local audiences: %v
+	local scopes: %v
+	local token lifetime: %v
+	local claims: %v
+	debug: %v
+	dry run: %v
+	debug level: %s
+	no redaction: %v
+	sidecar: %v
+	identity dir: %s
+	probe address: %s
+	shutdown grace: %v
+	wait for clock: %v
+	wait for key: %v
+	wait for AM: %v`,
+		o.URL, o.Realm, o.Tree, o.Name, o.Address, o.KeyFile, o.KeyID, o.CertFile, o.Timeout, o.OfflineGrace,
+		o.RevocationInterval, o.AttributePollInterval, o.AuditFile, o.BlockSize, o.Transport, o.SeparateResponseDelay,
+		o.IdempotencyKeyLifetime, o.CipherSuites, o.Curves, o.MinTLSVersion, o.ContentPolicy,
+		o.ServerCertFile, o.ServerKeyFile, o.ServerCACertFile, o.ServerCAKeyFile, o.ServerCertValidity, o.ServerNames,
+		o.ACMEDirectory, o.ACMEAccountKeyFile, o.ACMEContacts, o.ACMEChallengeAddr,
+		o.IPv6Only, o.MaxSessions, o.IdleTimeout, o.HandshakeRate, o.MaxRequestSize, o.MaxResponseSize,
+		o.MaxMemory, o.MaxFileDescriptors, o.ShedRetryAfter, o.MaintenanceWindows, o.MaintenanceJitter,
+		o.MaxAMRequests, o.ReservedAMRequests, o.AMQueueTimeout, o.RecordAM, o.ReplayAM,
+		o.TrustedCAFile, o.IntermediateCAFile, o.PinnedCAFile,
+		o.RequireFullChain, o.ClientCAFile, o.TrustedProxies, o.UpstreamCAFile,
+		o.UpstreamInsecureVerify, o.AccessListFile, o.AnomalyWindow, o.Quarantine,
+		o.EventWebhooks, o.EventMQTT, o.EventMQTTTopic, o.EventMQTTTLS, o.EventMQTTUser,
+		o.EventKafka, o.EventKafkaTopic, o.EventKafkaPartition, o.EventKafkaTLS, o.EventKafkaUser, o.EventKafkaMechanism,
+		o.DataDir, o.OAuth2ClientFile, o.AdminAddress, o.AdminTokenFile, o.UsageStatistics, o.AMCompatAddress, o.SessionCookie, o.SessionHeader, o.UserAgent,
+		o.AMInfoCache, o.AMInfoCacheTTL, o.Headers, o.CacheTTLs, o.WarmThings, o.WarmUpMaxAge, o.Adapters, o.AdapterKeyFile, o.AdapterInterval,
+		o.AdapterTokens, o.AdapterScopes, o.AdapterKeyStore, o.AdapterKEKFile, o.AdapterKEKKeyring, o.AdapterKeyExport,
+		o.AdapterKeyImport, o.AdapterKeyPassphrase, o.AdapterChildTokens, o.Plugins, o.Filters,
+		o.Sinks, o.StateExport, o.StateImport, o.StatePassphrase, o.LocalAudiences, o.LocalScopes,
+		o.LocalTokenLifetime, o.LocalClaims, o.Debug, o.DryRun, o.DebugLevel, o.NoRedaction,
+		o.Sidecar, o.IdentityDir, o.ProbeAddress, o.ShutdownGrace, o.WaitForClock, o.WaitForKey, o.WaitForAM)
+}
+
+// enableEvents publishes gateway and thing events to the sinks, webhooks, MQTT broker and Kafka broker of the options
+func enableEvents(thingGateway *gateway.ThingGateway, opts commandlineOpts) error {
+	publishers, err := sinkPublishers(opts)
+	if err != nil {
+		return err
+	}
+	for _, webhook := range opts.EventWebhooks {
+		publishers = append(publishers, gateway.WebhookPublisher{URL: webhook})
+	}
+	if opts.EventMQTT != "" {
+		publisher := &gateway.MQTTPublisher{Address: opts.EventMQTT, Topic: opts.EventMQTTTopic, ClientID: opts.Name,
+			Username: opts.EventMQTTUser, Password: opts.EventMQTTPassword}
+		if opts.EventMQTTTLS {
+			publisher.TLS = &tls.Config{}
+		}
+		publishers = append(publishers, publisher)
+	}
+	if opts.EventKafka != "" {
+		publisher := &gateway.KafkaPublisher{Address: opts.EventKafka, Topic: opts.EventKafkaTopic,
+			Partition: opts.EventKafkaPartition, ClientID: opts.Name, Username: opts.EventKafkaUser,
+			Password: opts.EventKafkaPassword, Mechanism: opts.EventKafkaMechanism}
+		if opts.EventKafkaTLS {
+			publisher.TLS = &tls.Config{}
+		}
+		publishers = append(publishers, publisher)
+	}
+	if len(publishers) == 0 {
+		return nil
+	}
+	return thingGateway.EnableEvents(gateway.EventConfig{Source: opts.Name, Publishers: publishers})
+}
+
+// addStartupGates adds the gates for which the gateway waits before it is initialised, AM is only contacted once the
+// clock is synchronised and the keys are usable
+func addStartupGates(thingGateway *gateway.ThingGateway, opts commandlineOpts) error {
+	var gates []gateway.StartupGate
+	if opts.WaitForClock > 0 {
+		gate, err := gateway.ClockSynchronisedGate(opts.WaitForClock)
+		if err != nil {
+			return err
+		}
+		gates = append(gates, gate)
+	}
+	if opts.WaitForKey > 0 {
+		gates = append(gates, thingGateway.KeysGate(opts.WaitForKey))
+	}
+	if opts.WaitForAM > 0 {
+		gates = append(gates, thingGateway.AMReachableGate(opts.WaitForAM))
+	}
+	for _, gate := range gates {
+		if err := thingGateway.AddStartupGate(gate); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // runGateway initialises and runs a Thing Gateway
@@ -104,13 +669,47 @@ func runGateway() error {
 	if err != nil {
 		return err
 	}
-	fmt.Printf("%v\n", opts)
+	if err = resolveDataDir(&opts); err != nil {
+		return err
+	}
+	if !opts.DryRun {
+		fmt.Printf("%v\n", opts)
+	}
+	if err = resolveIdentity(&opts); err != nil {
+		return err
+	}
+	if err = checkSidecar(opts); err != nil {
+		return err
+	}
+	if transferred, err := transferKeys(opts); transferred || err != nil {
+		return err
+	}
+	if transferred, err := transferState(opts); transferred || err != nil {
+		return err
+	}
 
 	if opts.Debug {
 		// pipe debug to standard out
 		thing.SetDebugLogger(log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lmicroseconds|log.Llongfile))
+		thing.SetDebugLevel(debugLevels[opts.DebugLevel])
+		thing.SetDebugRedaction(!opts.NoRedaction)
+	}
+
+	// plugins register the extensions that are enabled by the other options
+	if err = loadPlugins(opts); err != nil {
+		return err
 	}
 
+	// the key must be readable before the gateway can be created, so its gate is waited for first
+	if opts.WaitForKey > 0 {
+		gate := gateway.StartupGate{Name: "key file", Timeout: opts.WaitForKey, Check: func() error {
+			_, err := loadKey(opts.KeyFile)
+			return err
+		}}
+		if err = gate.Wait(); err != nil {
+			return err
+		}
+	}
 	amKey, err := loadKey(opts.KeyFile)
 	if err != nil {
 		return err
@@ -130,11 +729,17 @@ func runGateway() error {
 			KeyID:    opts.KeyID,
 			Key:      amKey,
 		}}
+	var certs []*x509.Certificate
 	if opts.CertFile != "" {
-		certs, err := loadCertificates(opts.CertFile)
-		if err != nil {
+		if certs, err = loadCertificates(opts.CertFile); err != nil {
 			return err
 		}
+		var clientID string
+		if opts.OAuth2ClientFile != "" {
+			if clientID, err = gatewayOAuth2Client(opts); err != nil {
+				return err
+			}
+		}
 		callbacks = append(callbacks, callback.RegisterHandler{
 			Audience:     opts.Audience,
 			ThingID:      opts.Name,
@@ -142,27 +747,297 @@ func runGateway() error {
 			KeyID:        opts.KeyID,
 			Key:          amKey,
 			Certificates: certs,
+			OAuth2Client: clientID,
 		})
 
 	}
 	thingGateway := gateway.NewThingGateway(opts.URL, opts.Realm, opts.Tree, opts.Timeout, callbacks)
+	// the gateway identifies itself with its own key if it is chained through an upstream gateway
+	thingGateway.SetUpstreamIdentity(amKey, certs)
+	upstreamTrust := thing.GatewayTrust{InsecureSkipVerify: opts.UpstreamInsecureVerify}
+	if opts.UpstreamCAFile != "" {
+		cas, err := loadCertificateBundle(opts.UpstreamCAFile)
+		if err != nil {
+			return err
+		}
+		upstreamTrust.RootCAs = x509.NewCertPool()
+		for _, cert := range cas {
+			upstreamTrust.RootCAs.AddCert(cert)
+		}
+	}
+	thingGateway.SetUpstreamTrust(upstreamTrust)
 
-	err = thingGateway.Initialise()
-	if err != nil {
+	auditLogger := log.New(os.Stdout, "", 0)
+	if opts.AuditFile != "" {
+		auditFile, err := storage.OpenPrivateFile(opts.AuditFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND)
+		if err != nil {
+			return err
+		}
+		defer auditFile.Close()
+		auditLogger.SetOutput(auditFile)
+	}
+	audit := func(event gateway.AuditEvent) {
+		auditLogger.Println(event)
+	}
+
+	if opts.OfflineGrace > 0 {
+		thingGateway.EnableOfflineAuthentication(opts.OfflineGrace, audit)
+	}
+
+	if len(opts.LocalAudiences) > 0 {
+		config, err := localIssuerConfig(opts, amKey, audit)
+		if err != nil {
+			return err
+		}
+		if err = thingGateway.EnableLocalIssuer(config); err != nil {
+			return err
+		}
+	}
+
+	if opts.RevocationInterval > 0 {
+		thingGateway.EnableSessionRevocation(opts.RevocationInterval)
+	}
+
+	if opts.AttributePollInterval > 0 {
+		thingGateway.EnableAttributeSubscriptions(opts.AttributePollInterval)
+	}
+
+	if opts.TrustedCAFile != "" {
+		policy, err := certificatePolicy(opts)
+		if err != nil {
+			return err
+		}
+		thingGateway.SetCertificatePolicy(opts.Audience, policy)
+	}
+
+	if opts.ClientCAFile != "" {
+		cas, err := loadCertificateBundle(opts.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		roots := x509.NewCertPool()
+		for _, cert := range cas {
+			roots.AddCert(cert)
+		}
+		thingGateway.RequireClientCertificates(roots)
+	}
+	if err = thingGateway.SetTrustedProxies(opts.TrustedProxies); err != nil {
+		return err
+	}
+	if opts.AccessListFile != "" {
+		list, err := gateway.LoadAccessList(opts.AccessListFile)
+		if err != nil {
+			return err
+		}
+		if err = thingGateway.SetAccessList(list); err != nil {
+			return err
+		}
+	}
+	if opts.AnomalyWindow > 0 {
+		err = thingGateway.EnableAnomalyDetection(gateway.AnomalyConfig{
+			Window:     opts.AnomalyWindow,
+			Quarantine: opts.Quarantine,
+			Hook: func(event gateway.AnomalyEvent) gateway.AnomalyAction {
+				auditLogger.Println(event)
+				if opts.Quarantine > 0 {
+					return gateway.AnomalyQuarantine
+				}
+				return gateway.AnomalyIgnore
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if opts.UsageStatistics {
+		thingGateway.EnableUsageStatistics()
+	}
+	if err = enableFilters(thingGateway, opts); err != nil {
+		return err
+	}
+	if err = enableEvents(thingGateway, opts); err != nil {
 		return err
 	}
 
+	if err = thingGateway.SetBlockSize(opts.BlockSize); err != nil {
+		return err
+	}
+	if err = thingGateway.SetTransport(gateway.Transport(opts.Transport)); err != nil {
+		return err
+	}
+	if opts.SeparateResponseDelay > 0 {
+		if err = thingGateway.EnableSeparateResponses(opts.SeparateResponseDelay); err != nil {
+			return err
+		}
+	}
+	if opts.IdempotencyKeyLifetime > 0 {
+		if err = thingGateway.EnableIdempotencyKeys(opts.IdempotencyKeyLifetime); err != nil {
+			return err
+		}
+	}
+	thingGateway.SetTLSProfile(thing.TLSProfile{
+		CipherSuites: opts.CipherSuites,
+		Curves:       opts.Curves,
+		MinVersion:   opts.MinTLSVersion,
+	})
+	if err = thingGateway.SetContentPolicy(gateway.ContentPolicy(opts.ContentPolicy)); err != nil {
+		return err
+	}
+	thingGateway.SetIPv6Only(opts.IPv6Only)
+	if err = serverIdentity(thingGateway, opts); err != nil {
+		return err
+	}
+	if err = thingGateway.SetConnectionLimits(gateway.ConnectionLimits{
+		MaxSessions:   opts.MaxSessions,
+		IdleTimeout:   opts.IdleTimeout,
+		HandshakeRate: opts.HandshakeRate,
+	}); err != nil {
+		return err
+	}
+	if err = thingGateway.SetPayloadLimits(gateway.PayloadLimits{
+		MaxRequestSize:  opts.MaxRequestSize,
+		MaxResponseSize: opts.MaxResponseSize,
+	}); err != nil {
+		return err
+	}
+	if err = thingGateway.SetResourceGuards(gateway.ResourceGuards{
+		MaxMemory:          opts.MaxMemory,
+		MaxFileDescriptors: opts.MaxFileDescriptors,
+		RetryAfter:         opts.ShedRetryAfter,
+	}); err != nil {
+		return err
+	}
+
+	if err = thingGateway.SetRequestPriorities(gateway.RequestPriorities{
+		MaxConcurrent: opts.MaxAMRequests,
+		Reserved:      opts.ReservedAMRequests,
+		QueueTimeout:  opts.AMQueueTimeout,
+	}); err != nil {
+		return err
+	}
+
+	if err = addStartupGates(thingGateway, opts); err != nil {
+		return err
+	}
+	thingGateway.SetSessionCookieName(opts.SessionCookie)
+	thingGateway.SetSessionTokenHeader(opts.SessionHeader)
+	thingGateway.SetUserAgent(opts.UserAgent)
+	if opts.AMInfoCache != "" {
+		thingGateway.SetAMInfoCache(opts.AMInfoCache, opts.AMInfoCacheTTL)
+	}
+	for _, header := range opts.Headers {
+		name, value, err := parseHeader(header)
+		if err != nil {
+			return err
+		}
+		thingGateway.AddHeader(name, value)
+	}
+	switch {
+	case opts.RecordAM != "" && opts.ReplayAM != "":
+		return errors.New("AM can not be recorded and replayed at the same time")
+	case opts.RecordAM != "":
+		if err = thingGateway.RecordAM(opts.RecordAM); err != nil {
+			return err
+		}
+	case opts.ReplayAM != "":
+		scenario, err := gateway.LoadScenario(opts.ReplayAM)
+		if err != nil {
+			return err
+		}
+		if err = thingGateway.ReplayAM(scenario); err != nil {
+			return err
+		}
+	}
+	if len(opts.MaintenanceWindows) > 0 || opts.MaintenanceJitter > 0 {
+		schedule := gateway.MaintenanceSchedule{Jitter: opts.MaintenanceJitter}
+		for _, option := range opts.MaintenanceWindows {
+			window, err := parseMaintenanceWindow(option)
+			if err != nil {
+				return err
+			}
+			schedule.Windows = append(schedule.Windows, window)
+		}
+		if err = thingGateway.SetMaintenanceSchedule(schedule); err != nil {
+			return err
+		}
+	}
+	if len(opts.CacheTTLs) > 0 {
+		ttls := make(map[string]time.Duration)
+		for _, option := range opts.CacheTTLs {
+			route, ttl, err := parseCacheTTL(option)
+			if err != nil {
+				return err
+			}
+			ttls[route] = ttl
+		}
+		if err = thingGateway.EnableResponseCache(ttls); err != nil {
+			return err
+		}
+	}
 	serverKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		return err
 	}
+	if opts.DryRun {
+		report := thingGateway.Diagnose(opts.Address, serverKey)
+		fmt.Println(report)
+		if !report.OK {
+			return errors.New("diagnostic checks failed")
+		}
+		return nil
+	}
+	err = thingGateway.Initialise()
+	if err != nil {
+		return err
+	}
+	if len(opts.WarmThings) > 0 {
+		things, err := warmThings(opts)
+		if err != nil {
+			return err
+		}
+		if err = thingGateway.EnableWarmUp(things, opts.WarmUpMaxAge); err != nil {
+			return err
+		}
+	}
+	if err = enableAdapters(thingGateway, opts); err != nil {
+		return err
+	}
+
+	// the probes report that the gateway is not ready until the CoAP server has started and while it drains
+	if opts.ProbeAddress != "" {
+		if err = thingGateway.StartProbeServer(opts.ProbeAddress); err != nil {
+			return err
+		}
+		defer thingGateway.ShutdownProbeServer()
+	}
 	err = thingGateway.StartCOAPServer(opts.Address, serverKey)
 	if err != nil {
 		return err
 	}
-	defer thingGateway.ShutdownCOAPServer()
+	defer thingGateway.DrainCOAPServer(opts.ShutdownGrace)
+
+	if opts.AdminAddress != "" {
+		if opts.AdminTokenFile != "" {
+			token, err := ioutil.ReadFile(opts.AdminTokenFile)
+			if err != nil {
+				return err
+			}
+			thingGateway.SetAdminToken(strings.TrimSpace(string(token)))
+		}
+		if err = thingGateway.StartAdminServer(opts.AdminAddress); err != nil {
+			return err
+		}
+		defer thingGateway.ShutdownAdminServer()
+	}
+
+	if opts.AMCompatAddress != "" {
+		if err = thingGateway.StartAMCompatServer(opts.AMCompatAddress); err != nil {
+			return err
+		}
+		defer thingGateway.ShutdownAMCompatServer()
+	}
 
-	fmt.Println("Thing Gateway server started.")
+	fmt.Printf("Thing Gateway server started at %s.\n", thingGateway.URL())
 	<-signals
 	fmt.Println("Thing Gateway server shutting down.")
 	return nil
@@ -0,0 +1,88 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Running as a sidecar
+// In a Kubernetes pod the gateway runs as a sidecar container next to the application containers that host the things.
+// The things reach the gateway on the loopback interface of the pod, so the --sidecar option rejects addresses that
+// would expose the CoAP server or the admin API beyond the pod. The identity of the gateway is read from a mounted TLS
+// secret, the kubelet checks the gateway with the probes served on --probe-address and the gateway drains its requests
+// for up to --shutdown-grace after it receives SIGTERM.
+
+const (
+	// identityKeyFile and identityCertFile are the names of the files in a mounted Kubernetes TLS secret
+	identityKeyFile  = "tls.key"
+	identityCertFile = "tls.crt"
+)
+
+// resolveIdentity sets the key and certificate files of the gateway from the identity directory unless they have been
+// given explicitly. The certificate is optional.
+func resolveIdentity(opts *commandlineOpts) error {
+	if opts.IdentityDir != "" {
+		if opts.KeyFile == "" {
+			opts.KeyFile = filepath.Join(opts.IdentityDir, identityKeyFile)
+		}
+		if cert := filepath.Join(opts.IdentityDir, identityCertFile); opts.CertFile == "" && fileExists(cert) {
+			opts.CertFile = cert
+		}
+	}
+	if opts.KeyFile == "" {
+		return fmt.Errorf("the gateway key must be provided with --key or --identity-dir")
+	}
+	return nil
+}
+
+// fileExists returns true if the file exists
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+// isLocalAddress returns true if the address is on the loopback interface
+func isLocalAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// checkSidecar checks that the CoAP server and the admin API of a sidecar gateway can only be reached from the pod
+func checkSidecar(opts commandlineOpts) error {
+	if !opts.Sidecar {
+		return nil
+	}
+	if !isLocalAddress(opts.Address) {
+		return fmt.Errorf("a sidecar gateway must listen on a loopback address, got %s", opts.Address)
+	}
+	if opts.AdminAddress != "" && !strings.HasPrefix(opts.AdminAddress, "unix:") && !isLocalAddress(opts.AdminAddress) {
+		return fmt.Errorf("a sidecar gateway must serve the admin API on a loopback address or a Unix socket, got %s",
+			opts.AdminAddress)
+	}
+	return nil
+}
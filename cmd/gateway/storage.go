@@ -0,0 +1,120 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/gateway"
+	"github.com/JacoJooste/iot-edge/v7/internal/storage"
+)
+
+// Data directory
+// The --data-dir option lets the files of the gateway be given relative to one directory, which is useful on Windows
+// and macOS where the gateway is not installed below /etc. If the option is given without a value then the per-user
+// configuration directory of the platform is used, see storage.DefaultDir. Files that the gateway writes, such as the
+// registered OAuth 2.0 client and the audit file, are only accessible to the user running the gateway.
+
+// dataDirDefault is the optional value of --data-dir that selects the platform's default directory
+const dataDirDefault = "-"
+
+// resolveDataDir resolves the relative names of the files given on the command line against the data directory
+func resolveDataDir(opts *commandlineOpts) (err error) {
+	if opts.DataDir == "" {
+		return nil
+	}
+	if opts.DataDir == dataDirDefault {
+		if opts.DataDir, err = storage.DefaultDir("gateway"); err != nil {
+			return err
+		}
+	}
+	for _, name := range []*string{
+		&opts.KeyFile, &opts.CertFile, &opts.IdentityDir, &opts.AuditFile,
+		&opts.ServerCertFile, &opts.ServerKeyFile, &opts.ServerCACertFile, &opts.ServerCAKeyFile,
+		&opts.TrustedCAFile, &opts.IntermediateCAFile, &opts.PinnedCAFile, &opts.ClientCAFile,
+		&opts.AccessListFile, &opts.OAuth2ClientFile, &opts.AdapterKeyFile, &opts.AMInfoCache,
+		&opts.AdapterKeyStore, &opts.AdapterKEKFile, &opts.AdapterKeyExport, &opts.AdapterKeyImport, &opts.AdapterKeyPassphrase,
+		&opts.StateExport, &opts.StateImport, &opts.StatePassphrase, &opts.AdminTokenFile,
+	} {
+		*name = storage.Resolve(opts.DataDir, *name)
+	}
+	return nil
+}
+
+// stateFiles returns the state files of the gateway by their role in a state bundle
+func stateFiles(opts commandlineOpts) map[string]string {
+	return map[string]string{
+		"key":                   opts.KeyFile,
+		"certificate":           opts.CertFile,
+		"server-certificate":    opts.ServerCertFile,
+		"server-key":            opts.ServerKeyFile,
+		"server-ca-certificate": opts.ServerCACertFile,
+		"server-ca-key":         opts.ServerCAKeyFile,
+		"oauth2-client":         opts.OAuth2ClientFile,
+		"access-list":           opts.AccessListFile,
+		"aminfo-cache":          opts.AMInfoCache,
+		"adapter-key":           opts.AdapterKeyFile,
+	}
+}
+
+// transferState exports the state of the gateway to a bundle or imports it from a bundle if requested on the command
+// line. Returns true if the state was transferred, after which the gateway exits.
+func transferState(opts commandlineOpts) (bool, error) {
+	if opts.StateExport == "" && opts.StateImport == "" {
+		return false, nil
+	}
+	if opts.StateExport != "" && opts.StateImport != "" {
+		return true, fmt.Errorf("state can not be exported and imported at the same time")
+	}
+	if opts.StatePassphrase == "" {
+		return true, fmt.Errorf("a passphrase file is required to transfer state")
+	}
+	passphrase, err := ioutil.ReadFile(opts.StatePassphrase)
+	if err != nil {
+		return true, err
+	}
+	passphrase = bytes.TrimRight(passphrase, "\r\n")
+	var store *gateway.ProxyKeyStore
+	if opts.AdapterKeyStore != "" {
+		if store, err = openKeyStore(opts); err != nil {
+			return true, err
+		}
+	}
+	if opts.StateExport != "" {
+		b, err := gateway.ExportState(stateFiles(opts), store, passphrase)
+		if err != nil {
+			return true, err
+		}
+		if err = storage.WritePrivateFile(opts.StateExport, b); err != nil {
+			return true, err
+		}
+		fmt.Printf("Exported the gateway state to %s.\n", opts.StateExport)
+		return true, nil
+	}
+	b, err := ioutil.ReadFile(opts.StateImport)
+	if err != nil {
+		return true, err
+	}
+	roles, err := gateway.ImportState(b, passphrase, stateFiles(opts), store)
+	if err != nil {
+		return true, err
+	}
+	fmt.Printf("Imported the gateway state (%s) from %s.\n", strings.Join(roles, ", "), opts.StateImport)
+	return true, nil
+}
@@ -0,0 +1,207 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+// libthings exports the Thing SDK as a C shared library so that existing C and C++ firmware can authenticate things
+// with AM, or the Thing Gateway, without a separate process. Build the library and its header with
+//     go build -buildmode=c-shared -o libthings.so ./cmd/libthings
+// Things are referred to by handles since Go pointers may not be held by C. Every function returns 0 on success and
+// -1 on failure. The JSON result, or the error message on failure, is returned in out and must be released with
+// things_free.
+
+/*
+#include <stdlib.h>
+
+typedef long long things_handle;
+*/
+import "C"
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/JacoJooste/iot-edge/v7/pkg/builder"
+	"github.com/JacoJooste/iot-edge/v7/pkg/thing"
+)
+
+// things holds the things that have been created by the C application, keyed by their handle
+var things = struct {
+	sync.Mutex
+	next   C.things_handle
+	byID   map[C.things_handle]thing.Thing
+	realms map[C.things_handle]string
+}{
+	byID:   make(map[C.things_handle]thing.Thing),
+	realms: make(map[C.things_handle]string),
+}
+
+func lookup(handle C.things_handle) (thing.Thing, string, error) {
+	things.Lock()
+	defer things.Unlock()
+	device, ok := things.byID[handle]
+	if !ok {
+		return nil, "", fmt.Errorf("unknown thing handle %d", handle)
+	}
+	return device, things.realms[handle], nil
+}
+
+// result returns the value to C as JSON, or the error message if err is not nil
+func result(out **C.char, v interface{}, err error) C.int {
+	if err == nil {
+		var b []byte
+		if b, err = json.Marshal(v); err == nil {
+			*out = C.CString(string(b))
+			return 0
+		}
+	}
+	*out = C.CString(err.Error())
+	return -1
+}
+
+func loadKey(keyPEM string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, fmt.Errorf("unable to decode key")
+	}
+	privateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", privateKey)
+	}
+	return signer, nil
+}
+
+// splitList splits a space separated list, such as OAuth 2.0 scopes, into its items
+func splitList(list *C.char) []string {
+	if list == nil {
+		return nil
+	}
+	return strings.Fields(C.GoString(list))
+}
+
+// things_authenticate creates a thing that connects to the URL and authenticates with the tree in the realm using the
+// PKCS8 signing key in PEM format. The key ID is derived from the key. The handle of the thing is returned in handle
+// and its ID in out.
+//export things_authenticate
+func things_authenticate(urlString, realm, tree, thingID, audience, keyPEM *C.char, handle *C.things_handle,
+	out **C.char) C.int {
+	u, err := url.Parse(C.GoString(urlString))
+	if err != nil {
+		return result(out, nil, err)
+	}
+	key, err := loadKey(C.GoString(keyPEM))
+	if err != nil {
+		return result(out, nil, err)
+	}
+	keyID, err := thing.JWKThumbprint(key)
+	if err != nil {
+		return result(out, nil, err)
+	}
+	device, err := builder.Thing().
+		ConnectTo(u).
+		InRealm(C.GoString(realm)).
+		WithTree(C.GoString(tree)).
+		AuthenticateThing(C.GoString(thingID), C.GoString(audience), keyID, key, nil).
+		Create()
+	if err != nil {
+		return result(out, nil, err)
+	}
+	things.Lock()
+	things.next++
+	*handle = things.next
+	things.byID[things.next] = device
+	things.realms[things.next] = C.GoString(realm)
+	things.Unlock()
+	return result(out, map[string]string{"id": C.GoString(thingID)}, nil)
+}
+
+// things_access_token requests an OAuth 2.0 access token with the space separated scopes, which may be NULL. The
+// token response is returned in out.
+//export things_access_token
+func things_access_token(handle C.things_handle, scopes *C.char, out **C.char) C.int {
+	device, _, err := lookup(handle)
+	if err != nil {
+		return result(out, nil, err)
+	}
+	response, err := device.RequestAccessToken(splitList(scopes)...)
+	return result(out, response.Content, err)
+}
+
+// things_get_attributes requests the space separated attributes, or all the allowed attributes if names is NULL. The
+// attributes are returned in out.
+//export things_get_attributes
+func things_get_attributes(handle C.things_handle, names *C.char, out **C.char) C.int {
+	device, _, err := lookup(handle)
+	if err != nil {
+		return result(out, nil, err)
+	}
+	response, err := device.RequestAttributes(splitList(names)...)
+	return result(out, response.Content, err)
+}
+
+// things_set_attributes writes the attributes in the JSON object with a signed update request to the things endpoint,
+// which AM must allow for the thing. The response of AM is returned in out.
+//export things_set_attributes
+func things_set_attributes(handle C.things_handle, attributes *C.char, out **C.char) C.int {
+	device, realm, err := lookup(handle)
+	if err != nil {
+		return result(out, nil, err)
+	}
+	// the body must be a JSON object map to be sent as claims of a signed request
+	var update map[string]interface{}
+	if err = json.Unmarshal([]byte(C.GoString(attributes)), &update); err != nil {
+		return result(out, nil, fmt.Errorf("attributes must be a JSON object: %w", err))
+	}
+	reply, err := thing.UpdateAttributes(device, realm, update)
+	if err != nil {
+		return result(out, nil, err)
+	}
+	return result(out, json.RawMessage(reply), nil)
+}
+
+// things_close logs the thing out of its session and releases its handle
+//export things_close
+func things_close(handle C.things_handle) C.int {
+	things.Lock()
+	device, ok := things.byID[handle]
+	delete(things.byID, handle)
+	delete(things.realms, handle)
+	things.Unlock()
+	if !ok || device.Logout() != nil {
+		return -1
+	}
+	return 0
+}
+
+// things_free releases a string returned by the library
+//export things_free
+func things_free(s *C.char) {
+	C.free(unsafe.Pointer(s))
+}
+
+// main is required to build a shared library but is never called
+func main() {}
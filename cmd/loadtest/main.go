@@ -0,0 +1,459 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/pkg/builder"
+	"github.com/JacoJooste/iot-edge/v7/pkg/thing"
+	"github.com/jessevdk/go-flags"
+)
+
+// The load test simulates a fleet of virtual things that authenticate with AM, either directly or via a Thing Gateway,
+// and then make requests at a fixed interval until the test ends. The things are started evenly over the ramp period
+// so that the authentication load can be controlled separately from the steady state request load. Each request made
+// by a thing is chosen at random from the request mix, which weights the operations, for example
+//     --mix access-token=3,attributes=1
+// makes three access token requests for every attribute request on average. The latency of every operation is
+// recorded and a report with latency percentiles and error rates is printed when the test ends or is interrupted.
+
+// operation is a request that a virtual thing can make
+type operation string
+
+const (
+	opAuthenticate operation = "authenticate"
+	opAccessToken  operation = "access-token"
+	opAttributes   operation = "attributes"
+	opIntrospect   operation = "introspect"
+	opReconnect    operation = "reconnect"
+	opLogout       operation = "logout"
+)
+
+// mixOperations are the operations that can be included in the request mix
+var mixOperations = []operation{opAccessToken, opAttributes, opIntrospect, opReconnect}
+
+// weightedOperation is an operation in the request mix
+type weightedOperation struct {
+	op     operation
+	weight int
+}
+
+// requestMix chooses operations at random according to their weights
+type requestMix []weightedOperation
+
+// parseMix parses a request mix given in the form "op=weight,op=weight"
+func parseMix(mix string) (requestMix, error) {
+	var parsed requestMix
+	for _, entry := range strings.Split(mix, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		weight := 1
+		if len(parts) == 2 {
+			var err error
+			if weight, err = strconv.Atoi(parts[1]); err != nil || weight < 0 {
+				return nil, fmt.Errorf("invalid weight in `%s`", entry)
+			}
+		}
+		op := operation(parts[0])
+		known := false
+		for _, o := range mixOperations {
+			known = known || o == op
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown operation `%s`, must be one of %v", parts[0], mixOperations)
+		}
+		if weight > 0 {
+			parsed = append(parsed, weightedOperation{op: op, weight: weight})
+		}
+	}
+	if len(parsed) == 0 {
+		return nil, fmt.Errorf("request mix `%s` contains no operations", mix)
+	}
+	return parsed, nil
+}
+
+// choose returns a random operation from the mix
+func (m requestMix) choose(r *rand.Rand) operation {
+	total := 0
+	for _, o := range m {
+		total += o.weight
+	}
+	n := r.Intn(total)
+	for _, o := range m {
+		if n < o.weight {
+			return o.op
+		}
+		n -= o.weight
+	}
+	return m[len(m)-1].op
+}
+
+// result contains the outcomes of an operation
+type result struct {
+	latencies []time.Duration
+	errors    map[string]int
+}
+
+// recorder records the outcomes of the operations made by all the virtual things
+type recorder struct {
+	sync.Mutex
+	results map[operation]*result
+}
+
+func newRecorder() *recorder {
+	return &recorder{results: make(map[operation]*result)}
+}
+
+// time runs the operation and records its latency or error
+func (r *recorder) time(op operation, f func() error) error {
+	start := time.Now()
+	err := f()
+	latency := time.Since(start)
+
+	r.Lock()
+	defer r.Unlock()
+	res, ok := r.results[op]
+	if !ok {
+		res = &result{errors: make(map[string]int)}
+		r.results[op] = res
+	}
+	if err != nil {
+		res.errors[errorKey(err)]++
+	} else {
+		res.latencies = append(res.latencies, latency)
+	}
+	return err
+}
+
+// errorKey returns the message of the error without the parts that are unique to the request, so that errors of the
+// same kind are counted together
+func errorKey(err error) string {
+	msg := err.Error()
+	if i := strings.Index(msg, " (transaction ID:"); i >= 0 {
+		msg = msg[:i]
+	}
+	return msg
+}
+
+// percentile returns the p-th percentile of the sorted latencies using the nearest rank method
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(p/100*float64(len(sorted))+0.999999) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+// report prints the latency percentiles and error rates of every operation
+func (r *recorder) report(elapsed time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+	fmt.Printf("\nload test ran for %v\n", elapsed.Round(time.Millisecond))
+	fmt.Printf("%-14s %8s %8s %8s %10s %10s %10s %10s %10s\n",
+		"operation", "count", "errors", "rate/s", "p50", "p90", "p95", "p99", "max")
+	var ops []operation
+	ops = append(ops, opAuthenticate)
+	ops = append(ops, mixOperations...)
+	ops = append(ops, opLogout)
+	for _, op := range ops {
+		res, ok := r.results[op]
+		if !ok {
+			continue
+		}
+		sorted := append([]time.Duration(nil), res.latencies...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		failed := 0
+		for _, n := range res.errors {
+			failed += n
+		}
+		count := len(sorted) + failed
+		fmt.Printf("%-14s %8d %7.2f%% %8.1f %10v %10v %10v %10v %10v\n",
+			op, count, 100*float64(failed)/float64(count), float64(count)/elapsed.Seconds(),
+			percentile(sorted, 50).Round(time.Microsecond), percentile(sorted, 90).Round(time.Microsecond),
+			percentile(sorted, 95).Round(time.Microsecond), percentile(sorted, 99).Round(time.Microsecond),
+			percentile(sorted, 100).Round(time.Microsecond))
+	}
+	for _, op := range ops {
+		res, ok := r.results[op]
+		if !ok || len(res.errors) == 0 {
+			continue
+		}
+		fmt.Printf("\n%s errors:\n", op)
+		for msg, n := range res.errors {
+			fmt.Printf("%8d  %s\n", n, msg)
+		}
+	}
+}
+
+// virtualThing is a simulated thing that makes requests until the load test ends
+type virtualThing struct {
+	id       string
+	opts     commandlineOpts
+	url      *url.URL
+	mix      requestMix
+	recorder *recorder
+	random   *rand.Rand
+	key      crypto.Signer
+	keyID    string
+	thing    thing.Thing
+	token    string
+}
+
+// connect creates the thing, which authenticates it and, if enabled, registers it. The key of the thing is generated
+// on the first connection and reused when the thing reconnects.
+func (v *virtualThing) connect() error {
+	if v.key == nil {
+		key, err := thing.GenerateConfirmationKey(v.opts.KeyAlgorithm)
+		if err != nil {
+			return err
+		}
+		if v.keyID, err = thing.JWKThumbprint(key); err != nil {
+			return err
+		}
+		v.key = key
+	}
+	return v.recorder.time(opAuthenticate, func() error {
+		var err error
+		b := builder.Thing().
+			ConnectTo(v.url).
+			InRealm(v.opts.Realm).
+			WithTree(v.opts.Tree).
+			AuthenticateThing(v.id, v.opts.Audience, v.keyID, v.key, nil).
+			TimeoutRequestAfter(v.opts.Timeout)
+		if v.opts.Register {
+			b = b.RegisterThing(nil, nil)
+		}
+		v.thing, err = b.Create()
+		return err
+	})
+}
+
+// do makes a request of the given kind
+func (v *virtualThing) do(op operation) error {
+	switch op {
+	case opAccessToken:
+		return v.recorder.time(op, v.requestAccessToken)
+	case opAttributes:
+		return v.recorder.time(op, func() error {
+			_, err := v.thing.RequestAttributes(v.opts.Attributes...)
+			return err
+		})
+	case opIntrospect:
+		if v.token == "" {
+			if err := v.recorder.time(opAccessToken, v.requestAccessToken); err != nil {
+				return err
+			}
+		}
+		return v.recorder.time(op, func() error {
+			_, err := v.thing.IntrospectAccessToken(v.token)
+			return err
+		})
+	case opReconnect:
+		_ = v.thing.Logout()
+		v.token = ""
+		return v.connect()
+	}
+	return fmt.Errorf("unknown operation %s", op)
+}
+
+func (v *virtualThing) requestAccessToken() error {
+	response, err := v.thing.RequestAccessToken(v.opts.Scopes...)
+	if err != nil {
+		return err
+	}
+	v.token, err = response.AccessToken()
+	return err
+}
+
+// run connects the thing after the start delay and then makes requests at the configured interval until the stop
+// channel is closed
+func (v *virtualThing) run(delay time.Duration, stop <-chan struct{}) {
+	wait := func(d time.Duration) bool {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-stop:
+			return false
+		case <-timer.C:
+			return true
+		}
+	}
+	if !wait(delay) {
+		return
+	}
+	// keep trying to connect since the failures are part of the results
+	for v.connect() != nil {
+		if !wait(v.opts.Interval) {
+			return
+		}
+	}
+	for {
+		// jitter the interval by up to 10% so that the requests of things started together spread out
+		jitter := time.Duration(v.random.Int63n(int64(v.opts.Interval)/5+1)) - v.opts.Interval/10
+		if !wait(v.opts.Interval + jitter) {
+			break
+		}
+		if err := v.do(v.mix.choose(v.random)); err != nil && v.thing == nil {
+			// the thing failed to reconnect
+			for v.connect() != nil {
+				if !wait(v.opts.Interval) {
+					return
+				}
+			}
+		}
+	}
+	if v.opts.Logout && v.thing != nil {
+		_ = v.recorder.time(opLogout, v.thing.Logout)
+	}
+}
+
+type commandlineOpts struct {
+	URL      string `long:"url" required:"true" description:"AM URL, or Thing Gateway URL when the scheme is coap(s)"`
+	Realm    string `long:"realm" description:"AM Realm"`
+	Audience string `long:"audience" description:"JWT Audience"`
+	Tree     string `long:"tree" required:"true" description:"Authentication tree"`
+	Register bool   `long:"register" description:"Register the things during authentication"`
+	// the things are named <prefix><number> so that they can be identified and removed from AM after the test
+	Prefix       string `long:"prefix" default:"load-thing-" description:"Prefix of the IDs of the virtual things"`
+	Things       int    `long:"things" default:"100" description:"Number of virtual things"`
+	KeyAlgorithm string `long:"key-alg" default:"ES256" description:"Algorithm of the confirmation keys of the things"`
+	// see time.ParseDuration for valid duration strings
+	Ramp     time.Duration `long:"ramp" default:"1m" description:"Period over which the things are started"`
+	Duration time.Duration `long:"duration" default:"5m" description:"Duration of the test, including the ramp period"`
+	Interval time.Duration `long:"interval" default:"10s" description:"Interval between the requests made by each thing"`
+	Timeout  time.Duration `long:"timeout" default:"10s" description:"Timeout for requests made by the things"`
+	Mix      string        `long:"mix" default:"access-token=1,attributes=1" description:"Weighted request mix, op=weight separated by commas, with op one of access-token, attributes, introspect and reconnect"`
+	// attributes and scopes may be repeated
+	Attributes []string `long:"attribute" description:"Attribute requested by the things, all attributes are requested if not set"`
+	Scopes     []string `long:"scope" default:"publish" description:"Scope requested in access token requests"`
+	Logout     bool     `long:"logout" description:"Log the things out at the end of the test"`
+	Seed       int64    `long:"seed" description:"Seed for the random choice of requests, the current time is used if not set"`
+}
+
+func (o commandlineOpts) String() string {
+	return fmt.Sprintf(
+		`commandline options
+	url: %s
+	realm: %s
+	audience: %s
+	tree: %s
+	register: %v
+	prefix: %s
+	things: %d
+	key algorithm: %s
+	ramp: %v
+	duration: %v
+	interval: %v
+	timeout: %v
+	mix: %s
+	attributes: %v
+	scopes: %v
+	logout: %v
+	seed: %d`,
+		o.URL, o.Realm, o.Audience, o.Tree, o.Register, o.Prefix, o.Things, o.KeyAlgorithm, o.Ramp, o.Duration,
+		o.Interval, o.Timeout, o.Mix, o.Attributes, o.Scopes, o.Logout, o.Seed)
+}
+
+// runLoadTest runs the virtual things until the test duration has passed or the test is interrupted
+func runLoadTest() error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	var opts commandlineOpts
+	_, err := flags.Parse(&opts)
+	if err != nil {
+		return err
+	}
+	if opts.Seed == 0 {
+		opts.Seed = time.Now().UnixNano()
+	}
+	fmt.Printf("%v\n", opts)
+
+	if opts.Things < 1 {
+		return fmt.Errorf("number of things must be positive")
+	}
+	if opts.Interval <= 0 {
+		return fmt.Errorf("request interval must be positive")
+	}
+	u, err := url.Parse(opts.URL)
+	if err != nil {
+		return err
+	}
+	mix, err := parseMix(opts.Mix)
+	if err != nil {
+		return err
+	}
+	if _, err = thing.GenerateConfirmationKey(opts.KeyAlgorithm); err != nil {
+		return err
+	}
+
+	rec := newRecorder()
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < opts.Things; i++ {
+		v := &virtualThing{
+			id:       fmt.Sprintf("%s%d", opts.Prefix, i),
+			opts:     opts,
+			url:      u,
+			mix:      mix,
+			recorder: rec,
+			random:   rand.New(rand.NewSource(opts.Seed + int64(i))),
+		}
+		delay := opts.Ramp * time.Duration(i) / time.Duration(opts.Things)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v.run(delay, stop)
+		}()
+	}
+	fmt.Printf("Started %d virtual things.\n", opts.Things)
+
+	select {
+	case <-signals:
+		fmt.Println("Load test interrupted.")
+	case <-time.After(opts.Duration):
+	}
+	close(stop)
+	wg.Wait()
+	rec.report(time.Since(start))
+	return nil
+}
+
+func main() {
+	if err := runLoadTest(); err != nil {
+		log.Fatal(err)
+	}
+}
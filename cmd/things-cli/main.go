@@ -0,0 +1,374 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/storage"
+	"github.com/JacoJooste/iot-edge/v7/pkg/builder"
+	"github.com/JacoJooste/iot-edge/v7/pkg/thing"
+	"github.com/jessevdk/go-flags"
+)
+
+// The things CLI wraps the SDK so that field engineers can commission and troubleshoot things without writing code.
+// Every command, apart from generate-key, creates a thing from the global options, which authenticates it with AM or
+// the Thing Gateway, before making its request. The global options can be read from an INI file with --config, for
+// example
+//     [Application Options]
+//     url = https://am.example.com:8443/am
+//     tree = reg-tree
+//     id = thing-1
+//     key = thing-1.pem
+// Options given on the command line after --config override the values in the file. Responses are written to
+// standard out as JSON so that they can be processed by other tools.
+
+// globalOpts are the options shared by all the commands
+type globalOpts struct {
+	// the config file is parsed when the option is encountered, see configFile
+	Config   func(string) error `long:"config" description:"INI file containing the options"`
+	URL      string             `long:"url" description:"AM URL, or Thing Gateway URL when the scheme is coap(s)"`
+	Realm    string             `long:"realm" description:"AM Realm"`
+	Tree     string             `long:"tree" description:"Authentication tree"`
+	Audience string             `long:"audience" description:"JWT Audience"`
+	ThingID  string             `long:"id" description:"ID of the thing"`
+	KeyFile  string             `long:"key" description:"The file containing the thing's PKCS8 signing key"`
+	KeyID    string             `long:"kid" description:"The thing's signing key ID, derived from the key if not set"`
+	CertFile string             `long:"cert" description:"The file containing the thing's certificate chain, used for registration"`
+	// see time.ParseDuration for valid timeout strings
+	Timeout time.Duration `long:"timeout" default:"10s" description:"Timeout for requests"`
+	Debug   bool          `short:"d" long:"debug" description:"Write the SDK debug output to standard error"`
+	// the handshake with the Thing Gateway is only restricted if a profile option is set
+	CipherSuites  []string `long:"cipher-suite" description:"Cipher suite that may be negotiated with the Thing Gateway, may be repeated"`
+	Curves        []string `long:"curve" description:"Curve that may be used for key exchange with the Thing Gateway over TLS, may be repeated"`
+	MinTLSVersion string   `long:"min-tls-version" description:"Minimum DTLS or TLS version negotiated with the Thing Gateway"`
+	// the certificate of the Thing Gateway is verified against the system roots over TLS unless gateway CAs are provided
+	GatewayCAFile      string `long:"gateway-ca" description:"The file containing the CAs trusted to issue the certificate of the Thing Gateway"`
+	InsecureSkipVerify bool   `long:"insecure-skip-verify" description:"Accept any certificate presented by the Thing Gateway, only use for testing"`
+}
+
+var opts globalOpts
+
+var parser = flags.NewParser(&opts, flags.Default)
+
+// configFile reads the options in the INI file
+func configFile(filename string) error {
+	return flags.NewIniParser(parser).ParseFile(filename)
+}
+
+func loadKey(filename string) (crypto.Signer, error) {
+	keyBytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(keyBytes)
+	if block == nil {
+		return nil, fmt.Errorf("unable to decode key")
+	}
+	privateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", privateKey)
+	}
+	return signer, nil
+}
+
+// loadCertificates loads all the certificates in a PEM file
+func loadCertificates(filename string) ([]*x509.Certificate, error) {
+	certBytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(certBytes); block != nil; block, rest = pem.Decode(rest) {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found in %s", filename)
+	}
+	return certs, nil
+}
+
+// createThing creates the thing described by the global options. The thing is registered if register is true.
+func createThing(register bool) (thing.Thing, error) {
+	switch {
+	case opts.URL == "":
+		return nil, fmt.Errorf("the URL must be set with --url")
+	case opts.Tree == "":
+		return nil, fmt.Errorf("the authentication tree must be set with --tree")
+	case opts.ThingID == "":
+		return nil, fmt.Errorf("the thing ID must be set with --id")
+	case opts.KeyFile == "":
+		return nil, fmt.Errorf("the key file must be set with --key")
+	}
+	if opts.Debug {
+		thing.SetDebugLogger(log.New(os.Stderr, "", log.Ldate|log.Ltime|log.Lmicroseconds))
+	}
+	u, err := url.Parse(opts.URL)
+	if err != nil {
+		return nil, err
+	}
+	key, err := loadKey(opts.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	keyID := opts.KeyID
+	if keyID == "" {
+		if keyID, err = thing.JWKThumbprint(key); err != nil {
+			return nil, err
+		}
+	}
+	trust := thing.GatewayTrust{InsecureSkipVerify: opts.InsecureSkipVerify}
+	if opts.GatewayCAFile != "" {
+		cas, err := loadCertificates(opts.GatewayCAFile)
+		if err != nil {
+			return nil, err
+		}
+		trust.RootCAs = x509.NewCertPool()
+		for _, cert := range cas {
+			trust.RootCAs.AddCert(cert)
+		}
+	}
+	b := builder.Thing().
+		ConnectTo(u).
+		InRealm(opts.Realm).
+		WithTree(opts.Tree).
+		AuthenticateThing(opts.ThingID, opts.Audience, keyID, key, nil).
+		TimeoutRequestAfter(opts.Timeout).
+		WithTLSProfile(thing.TLSProfile{
+			CipherSuites: opts.CipherSuites,
+			Curves:       opts.Curves,
+			MinVersion:   opts.MinTLSVersion,
+		}).
+		WithGatewayTrust(trust)
+	if register {
+		var certs []*x509.Certificate
+		if opts.CertFile != "" {
+			if certs, err = loadCertificates(opts.CertFile); err != nil {
+				return nil, err
+			}
+		}
+		b = b.RegisterThing(certs, nil)
+	}
+	return b.Create()
+}
+
+// printJSON writes the value to standard out as indented JSON
+func printJSON(v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+// registerCommand registers the thing, or authenticates it if it is already registered
+type registerCommand struct{}
+
+func (c *registerCommand) Execute(args []string) error {
+	device, err := createThing(true)
+	if err != nil {
+		return err
+	}
+	defer device.Logout()
+	return printJSON(map[string]string{"id": opts.ThingID, "result": "registered"})
+}
+
+// authenticateCommand authenticates the registered thing
+type authenticateCommand struct {
+	// the session is kept so that the token can be used to troubleshoot other tools
+	KeepSession bool `long:"keep-session" description:"Do not log out after authenticating"`
+}
+
+func (c *authenticateCommand) Execute(args []string) error {
+	device, err := createThing(false)
+	if err != nil {
+		return err
+	}
+	if !c.KeepSession {
+		defer device.Logout()
+	}
+	return printJSON(map[string]string{"id": opts.ThingID, "result": "authenticated"})
+}
+
+// tokenCommand requests an access token for the thing
+type tokenCommand struct {
+	Scopes []string `long:"scope" description:"Scope requested for the token, may be repeated"`
+}
+
+func (c *tokenCommand) Execute(args []string) error {
+	device, err := createThing(false)
+	if err != nil {
+		return err
+	}
+	defer device.Logout()
+	response, err := device.RequestAccessToken(c.Scopes...)
+	if err != nil {
+		return err
+	}
+	return printJSON(response.Content)
+}
+
+// introspectCommand introspects an access token issued to the thing
+type introspectCommand struct {
+	Args struct {
+		Token string `positional-arg-name:"token" description:"The access token, read from standard in if not given"`
+	} `positional-args:"yes"`
+}
+
+func (c *introspectCommand) Execute(args []string) error {
+	token := c.Args.Token
+	if token == "" {
+		b, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	device, err := createThing(false)
+	if err != nil {
+		return err
+	}
+	defer device.Logout()
+	introspection, err := device.IntrospectAccessToken(token)
+	if err != nil {
+		return err
+	}
+	return printJSON(introspection.Content)
+}
+
+// attributesCommand reads or writes the attributes of the thing
+type attributesCommand struct {
+	Names []string `long:"name" description:"Attribute to read, may be repeated, all allowed attributes are read if not set"`
+	// attributes are written with a signed update request to the things endpoint, which AM must allow for the thing
+	Set []string `long:"set" description:"Attribute to write in the form name=value, may be repeated"`
+}
+
+func (c *attributesCommand) Execute(args []string) error {
+	values := make(map[string][]string)
+	for _, s := range c.Set {
+		i := strings.Index(s, "=")
+		if i < 1 {
+			return fmt.Errorf("invalid attribute `%s`, must be of the form name=value", s)
+		}
+		values[s[:i]] = append(values[s[:i]], s[i+1:])
+	}
+	// the body must be a JSON object map to be sent as claims of a signed request
+	update := make(map[string]interface{}, len(values))
+	for name, v := range values {
+		update[name] = v
+	}
+	device, err := createThing(false)
+	if err != nil {
+		return err
+	}
+	defer device.Logout()
+	if len(update) == 0 {
+		response, err := device.RequestAttributes(c.Names...)
+		if err != nil {
+			return err
+		}
+		return printJSON(response.Content)
+	}
+	reply, err := thing.UpdateAttributes(device, opts.Realm, update)
+	if err != nil {
+		return err
+	}
+	var content interface{}
+	if err = json.Unmarshal(reply, &content); err != nil {
+		return err
+	}
+	return printJSON(content)
+}
+
+// generateKeyCommand generates a signing key for a thing that is being commissioned
+type generateKeyCommand struct {
+	Algorithm string `long:"alg" default:"ES256" choice:"ES256" choice:"ES384" choice:"ES512" choice:"EdDSA" description:"Algorithm of the key"`
+	Out       string `long:"out" required:"true" description:"The file to which the PKCS8 key is written"`
+}
+
+func (c *generateKeyCommand) Execute(args []string) error {
+	key, err := thing.GenerateConfirmationKey(c.Algorithm)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	keyID, err := thing.JWKThumbprint(key)
+	if err != nil {
+		return err
+	}
+	err = storage.WritePrivateFile(c.Out, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		return err
+	}
+	return printJSON(map[string]string{"kid": keyID, "key": c.Out})
+}
+
+func main() {
+	opts.Config = configFile
+	commands := []struct {
+		name, short, long string
+		data              interface{}
+	}{
+		{"register", "Register the thing",
+			"Registers the thing with its key and certificates, or authenticates it if it is already registered",
+			&registerCommand{}},
+		{"authenticate", "Authenticate the thing", "Authenticates the thing with its registered key",
+			&authenticateCommand{}},
+		{"token", "Request an access token", "Requests an OAuth 2.0 access token for the thing", &tokenCommand{}},
+		{"introspect", "Introspect an access token", "Introspects an OAuth 2.0 access token issued to the thing",
+			&introspectCommand{}},
+		{"attributes", "Read or write attributes", "Reads or writes the attributes of the thing's identity",
+			&attributesCommand{}},
+		{"generate-key", "Generate a signing key", "Generates a signing key for a thing and prints its key ID",
+			&generateKeyCommand{}},
+	}
+	for _, c := range commands {
+		if _, err := parser.AddCommand(c.name, c.short, c.long, c.data); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if _, err := parser.Parse(); err != nil {
+		// go-flags has already printed the error or help message
+		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
+			return
+		}
+		os.Exit(1)
+	}
+}
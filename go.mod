@@ -3,13 +3,15 @@ module github.com/JacoJooste/iot-edge/v7
 go 1.13
 
 require (
+	github.com/cloudflare/circl v1.3.7
 	github.com/dchest/uniuri v0.0.0-20200228104902-7aecb25e1fe5
+	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.0.1
 	github.com/go-ocf/go-coap v0.0.0-20200325133359-298a26e4e9c8
 	github.com/jessevdk/go-flags v1.4.0
 	github.com/patrickmn/go-cache v2.1.0+incompatible
 	github.com/pion/dtls/v2 v2.0.0-rc.7
-	golang.org/x/crypto v0.0.0-20200317142112-1b76d66859c6 // indirect
-	golang.org/x/net v0.0.0-20200505041828-1ed23360d12c // indirect
-	golang.org/x/sync v0.0.0-20200317015054-43a5402ce75a
+	golang.org/x/crypto v0.17.0
+	golang.org/x/sync v0.1.0
+	golang.org/x/sys v0.15.0
 	gopkg.in/square/go-jose.v2 v2.4.1
 )
@@ -0,0 +1,101 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package cbor implements the subset of CBOR (RFC 8949) used by the SDK: the data items of the COSE structures
+// required by OSCORE and the encoding of structured payloads in the JSON data model.
+package cbor
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Major types of CBOR data items
+const (
+	majorUnsigned = 0
+	majorNegative = 1
+	majorBytes    = 2
+	majorText     = 3
+	majorArray    = 4
+	majorMap      = 5
+	majorSimple   = 7
+)
+
+// Additional information of the simple values and floating-point numbers
+const (
+	simpleFalse   = 20
+	simpleTrue    = 21
+	simpleNull    = 22
+	simpleFloat16 = 25
+	simpleFloat32 = 26
+	simpleFloat64 = 27
+)
+
+// maxDepth limits the nesting of encoded and decoded arrays and maps
+const maxDepth = 64
+
+// ErrMalformed indicates that the data is not well-formed CBOR or contains items outside the JSON data model
+var ErrMalformed = errors.New("malformed CBOR")
+
+// appendHeader appends the header of a data item with the major type and argument
+func appendHeader(b []byte, major byte, n uint64) []byte {
+	major <<= 5
+	switch {
+	case n < 24:
+		return append(b, major|byte(n))
+	case n <= math.MaxUint8:
+		return append(b, major|24, byte(n))
+	case n <= math.MaxUint16:
+		return appendBigEndian(append(b, major|25), n, 2)
+	case n <= math.MaxUint32:
+		return appendBigEndian(append(b, major|26), n, 4)
+	default:
+		return appendBigEndian(append(b, major|27), n, 8)
+	}
+}
+
+// appendBigEndian appends the low size bytes of n in network byte order
+func appendBigEndian(b []byte, n uint64, size int) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], n)
+	return append(b, buf[8-size:]...)
+}
+
+// AppendUint appends an unsigned integer
+func AppendUint(b []byte, n uint64) []byte {
+	return appendHeader(b, majorUnsigned, n)
+}
+
+// AppendBytes appends a byte string
+func AppendBytes(b []byte, v []byte) []byte {
+	return append(appendHeader(b, majorBytes, uint64(len(v))), v...)
+}
+
+// AppendText appends a text string
+func AppendText(b []byte, v string) []byte {
+	return append(appendHeader(b, majorText, uint64(len(v))), v...)
+}
+
+// AppendArray appends the header of an array, which must be followed by length data items
+func AppendArray(b []byte, length int) []byte {
+	return appendHeader(b, majorArray, uint64(length))
+}
+
+// AppendNull appends the null simple value
+func AppendNull(b []byte) []byte {
+	return append(b, majorSimple<<5|simpleNull)
+}
@@ -0,0 +1,228 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cbor
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMarshal(t *testing.T) {
+	// expected encodings from Appendix A of RFC 8949
+	tests := []struct {
+		name  string
+		value interface{}
+		cbor  string
+	}{
+		{name: "zero", value: 0, cbor: "00"},
+		{name: "small", value: 23, cbor: "17"},
+		{name: "uint8", value: 100, cbor: "1864"},
+		{name: "uint16", value: 1000, cbor: "1903e8"},
+		{name: "uint32", value: 1000000, cbor: "1a000f4240"},
+		{name: "uint64", value: uint64(18446744073709551615), cbor: "1bffffffffffffffff"},
+		{name: "negative", value: -1000, cbor: "3903e7"},
+		{name: "float", value: 1.1, cbor: "fb3ff199999999999a"},
+		{name: "bool", value: true, cbor: "f5"},
+		{name: "null", value: nil, cbor: "f6"},
+		{name: "text", value: "IETF", cbor: "6449455446"},
+		{name: "array", value: []int{1, 2, 3}, cbor: "83010203"},
+		{name: "map", value: map[string]interface{}{"b": []int{2, 3}, "a": 1}, cbor: "a26161016162820203"},
+		{name: "struct", value: struct {
+			Name string `json:"n"`
+			Skip string `json:"s,omitempty"`
+		}{Name: "x"}, cbor: "a1616e6178"},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			b, err := Marshal(subtest.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hex.EncodeToString(b) != subtest.cbor {
+				t.Errorf("expected %s; got %x", subtest.cbor, b)
+			}
+		})
+	}
+}
+
+type testEmbedded struct {
+	ID     string `json:"id"`
+	Hidden string `json:"name"`
+}
+
+type testTextKey int
+
+func (k testTextKey) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("key-%d", int(k))), nil
+}
+
+type testPointerMarshaler struct {
+	Value string
+}
+
+func (m *testPointerMarshaler) MarshalJSON() ([]byte, error) {
+	return json.Marshal("pointer:" + m.Value)
+}
+
+func TestMarshal_JSONDataModel(t *testing.T) {
+	flag := true
+	type payload struct {
+		testEmbedded
+		*Skipped
+		Name       string `json:"name"`
+		Untagged   int
+		Omitted    []string               `json:"omitted,omitempty"`
+		Ignored    string                 `json:"-"`
+		Quoted     int64                  `json:"quoted,string"`
+		Bytes      []byte                 `json:"bytes"`
+		Raw        json.RawMessage        `json:"raw"`
+		Number     json.Number            `json:"number"`
+		Float32    float32                `json:"float32"`
+		Integral   float64                `json:"integral"`
+		Flag       *bool                  `json:"flag"`
+		Nil        *bool                  `json:"nil"`
+		Time       time.Time              `json:"time"`
+		TextKeys   map[testTextKey]string `json:"textKeys"`
+		IntKeys    map[int]bool           `json:"intKeys"`
+		Marshaler  testPointerMarshaler   `json:"marshaler"`
+		Any        interface{}            `json:"any"`
+		unexported string
+	}
+	value := &payload{
+		testEmbedded: testEmbedded{ID: "id", Hidden: "hidden"},
+		Name:         "name",
+		Untagged:     -7,
+		Ignored:      "ignored",
+		Quoted:       42,
+		Bytes:        []byte{1, 2, 3},
+		Raw:          json.RawMessage(`{"b":[1.5,null],"a":"x"}`),
+		Number:       "12.5",
+		Float32:      0.1,
+		Integral:     3,
+		Flag:         &flag,
+		Time:         time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		TextKeys:     map[testTextKey]string{1: "one", 2: "two"},
+		IntKeys:      map[int]bool{10: true, -1: false},
+		Marshaler:    testPointerMarshaler{Value: "v"},
+		Any:          []interface{}{"a", 1},
+		unexported:   "unexported",
+	}
+	// a pointer is marshalled so that the pointer method of the addressable field is used
+	b, err := Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actual interface{}
+	if err = Unmarshal(b, &actual); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(value)
+	var expected interface{}
+	if err = json.Unmarshal(data, &expected); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v; got %v", expected, actual)
+	}
+}
+
+// Skipped is embedded as a nil pointer, so its fields are not encoded
+type Skipped struct {
+	Skipped string `json:"skipped"`
+}
+
+func TestMarshal_Unsupported(t *testing.T) {
+	for _, value := range []interface{}{math.NaN(), math.Inf(1), make(chan int), map[float64]int{1: 1}} {
+		if _, err := Marshal(value); err == nil {
+			t.Errorf("expected an error for %T", value)
+		}
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	type payload struct {
+		Name   string    `json:"name"`
+		Count  int64     `json:"count"`
+		Values []float64 `json:"values"`
+		Flag   *bool     `json:"flag"`
+	}
+	expected := payload{Name: "thing", Count: -500, Values: []float64{1.5, 0.25, 100000}}
+	b, err := Marshal(expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actual payload
+	if err = Unmarshal(b, &actual); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %+v; got %+v", expected, actual)
+	}
+
+	// half and single precision floats are produced by other encoders
+	var values []float64
+	if err = Unmarshal(mustDecodeHex(t, "83f93e00fa47c35000f98001"), &values); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(values, []float64{1.5, 100000, -0.0000000596046447753906250}) {
+		t.Errorf("unexpected values %v", values)
+	}
+}
+
+func TestUnmarshal_Malformed(t *testing.T) {
+	nested := bytes.Repeat([]byte{0x81}, maxDepth+2)
+	tests := []struct {
+		name string
+		cbor []byte
+	}{
+		{name: "empty", cbor: []byte{}},
+		{name: "truncated", cbor: mustDecodeHex(t, "1903")},
+		{name: "trailing", cbor: mustDecodeHex(t, "0000")},
+		{name: "bytes", cbor: mustDecodeHex(t, "4401020304")},
+		{name: "tag", cbor: mustDecodeHex(t, "c11a514b67b0")},
+		{name: "indefinite", cbor: mustDecodeHex(t, "9f01ff")},
+		{name: "integer-key", cbor: mustDecodeHex(t, "a10102")},
+		{name: "invalid-utf8", cbor: mustDecodeHex(t, "61ff")},
+		{name: "infinity", cbor: mustDecodeHex(t, "f97c00")},
+		{name: "undefined", cbor: mustDecodeHex(t, "f7")},
+		{name: "huge-array", cbor: mustDecodeHex(t, "9bffffffffffffffff")},
+		{name: "nested", cbor: append(nested, 0x00)},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			var v interface{}
+			if err := Unmarshal(subtest.cbor, &v); !errors.Is(err, ErrMalformed) {
+				t.Errorf("expected malformed CBOR error; got %v", err)
+			}
+		})
+	}
+}
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
@@ -0,0 +1,191 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cbor
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"unicode/utf8"
+)
+
+// Unmarshal decodes the CBOR data item into the JSON data model and then into the value with encoding/json, so that
+// payloads are decoded with the same rules, and UnmarshalJSON methods, as their JSON form. Items outside the JSON
+// data model, such as byte strings, tags and indefinite lengths, are rejected with ErrMalformed.
+func Unmarshal(data []byte, v interface{}) error {
+	d := decoder{data: data}
+	value, err := d.item(0)
+	if err != nil {
+		return err
+	}
+	if len(d.data) > 0 {
+		return fmt.Errorf("%w: %d bytes after the data item", ErrMalformed, len(d.data))
+	}
+	data, err = json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// decoder decodes CBOR data items into the JSON data model
+type decoder struct {
+	data []byte
+}
+
+// take removes the next n bytes from the data
+func (d *decoder) take(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)) {
+		return nil, fmt.Errorf("%w: unexpected end of data", ErrMalformed)
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b, nil
+}
+
+// header decodes the header of the next data item, returning its major type, additional information and argument
+func (d *decoder) header() (major, info byte, n uint64, err error) {
+	b, err := d.take(1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	major, info = b[0]>>5, b[0]&0x1f
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info > 27:
+		return 0, 0, 0, fmt.Errorf("%w: unsupported additional information %d", ErrMalformed, info)
+	}
+	if b, err = d.take(1 << (info - 24)); err != nil {
+		return 0, 0, 0, err
+	}
+	for _, x := range b {
+		n = n<<8 | uint64(x)
+	}
+	return major, info, n, nil
+}
+
+// item decodes the next data item at the given depth of nesting
+func (d *decoder) item(depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("%w: nested deeper than %d", ErrMalformed, maxDepth)
+	}
+	major, info, n, err := d.header()
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case majorUnsigned:
+		return json.Number(strconv.FormatUint(n, 10)), nil
+	case majorNegative:
+		i := new(big.Int).SetUint64(n)
+		return json.Number(i.Neg(i.Add(i, big.NewInt(1))).String()), nil
+	case majorText:
+		b, err := d.take(n)
+		if err != nil {
+			return nil, err
+		}
+		if !utf8.Valid(b) {
+			return nil, fmt.Errorf("%w: text string is not valid UTF-8", ErrMalformed)
+		}
+		return string(b), nil
+	case majorArray:
+		// every item takes at least one byte, which bounds the allocation by the size of the data
+		if n > uint64(len(d.data)) {
+			return nil, fmt.Errorf("%w: unexpected end of data", ErrMalformed)
+		}
+		array := make([]interface{}, n)
+		for i := range array {
+			if array[i], err = d.item(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return array, nil
+	case majorMap:
+		if n > uint64(len(d.data)) {
+			return nil, fmt.Errorf("%w: unexpected end of data", ErrMalformed)
+		}
+		object := make(map[string]interface{}, n)
+		for i := uint64(0); i < n; i++ {
+			key, err := d.item(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("%w: map key is not a text string", ErrMalformed)
+			}
+			if object[name], err = d.item(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return object, nil
+	case majorSimple:
+		return simpleValue(info, n)
+	default:
+		return nil, fmt.Errorf("%w: unsupported major type %d", ErrMalformed, major)
+	}
+}
+
+// simpleValue returns the value of a simple value or floating-point number
+func simpleValue(info byte, n uint64) (interface{}, error) {
+	var f float64
+	switch info {
+	case simpleFalse:
+		return false, nil
+	case simpleTrue:
+		return true, nil
+	case simpleNull:
+		return nil, nil
+	case simpleFloat16:
+		f = float16ToFloat64(uint16(n))
+	case simpleFloat32:
+		f = float64(math.Float32frombits(uint32(n)))
+	case simpleFloat64:
+		f = math.Float64frombits(n)
+	default:
+		return nil, fmt.Errorf("%w: unsupported simple value %d", ErrMalformed, n)
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, fmt.Errorf("%w: %v can not be represented in JSON", ErrMalformed, f)
+	}
+	return json.Number(strconv.FormatFloat(f, 'g', -1, 64)), nil
+}
+
+// float16ToFloat64 converts an IEEE 754 half-precision number
+func float16ToFloat64(h uint16) float64 {
+	exponent, mantissa := int(h>>10)&0x1f, float64(h&0x3ff)
+	var f float64
+	switch exponent {
+	case 0:
+		f = math.Ldexp(mantissa, -24)
+	case 0x1f:
+		if mantissa == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mantissa+0x400, exponent-25)
+	}
+	if h&0x8000 != 0 {
+		f = -f
+	}
+	return f
+}
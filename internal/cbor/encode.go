@@ -0,0 +1,430 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cbor
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Encoding of structured payloads
+// Marshal encodes a value in the JSON data model as if it had been marshalled to JSON first: objects are encoded as
+// maps with text keys, along with arrays, text strings, integers, floating-point numbers, booleans and null. The value
+// is encoded directly with the rules of encoding/json, honouring the json tags of structs, so that a payload has the
+// same content in either format. Only values that implement json.Marshaler, such as json.RawMessage, are marshalled
+// to JSON and decoded again, since their JSON encoding is their definition.
+
+var (
+	marshalerType     = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	numberType        = reflect.TypeOf(json.Number(""))
+)
+
+// Marshal returns the CBOR encoding of the value in the JSON data model
+func Marshal(v interface{}) ([]byte, error) {
+	return appendValue(nil, reflect.ValueOf(v), 0)
+}
+
+// appendValue appends the value at the given depth of nesting
+func appendValue(b []byte, v reflect.Value, depth int) (_ []byte, err error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("unable to encode values nested deeper than %d as CBOR", maxDepth)
+	}
+	if !v.IsValid() {
+		return AppendNull(b), nil
+	}
+	t := v.Type()
+	if t == numberType {
+		return appendNumber(b, json.Number(v.String()))
+	}
+	if t.Implements(marshalerType) || t.Implements(textMarshalerType) {
+		if (t.Kind() == reflect.Ptr || t.Kind() == reflect.Interface) && v.IsNil() {
+			return AppendNull(b), nil
+		}
+		return appendMarshaler(b, v, depth)
+	}
+	if v.CanAddr() && (reflect.PtrTo(t).Implements(marshalerType) || reflect.PtrTo(t).Implements(textMarshalerType)) {
+		// as with encoding/json, methods with a pointer receiver are only used for addressable values
+		return appendMarshaler(b, v.Addr(), depth)
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return append(b, majorSimple<<5|simpleTrue), nil
+		}
+		return append(b, majorSimple<<5|simpleFalse), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return appendInt(b, v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return AppendUint(b, v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return appendFloat(b, v.Float(), t.Bits())
+	case reflect.String:
+		return AppendText(b, v.String()), nil
+	case reflect.Interface, reflect.Ptr:
+		if v.IsNil() {
+			return AppendNull(b), nil
+		}
+		return appendValue(b, v.Elem(), depth+1)
+	case reflect.Slice:
+		if v.IsNil() {
+			return AppendNull(b), nil
+		}
+		if t.Elem().Kind() == reflect.Uint8 && !reflect.PtrTo(t.Elem()).Implements(marshalerType) &&
+			!reflect.PtrTo(t.Elem()).Implements(textMarshalerType) {
+			// byte slices are base64 encoded text in the JSON data model
+			return AppendText(b, base64.StdEncoding.EncodeToString(v.Bytes())), nil
+		}
+		return appendArray(b, v, depth)
+	case reflect.Array:
+		return appendArray(b, v, depth)
+	case reflect.Map:
+		return appendMap(b, v, depth)
+	case reflect.Struct:
+		return appendStruct(b, v, depth)
+	default:
+		return nil, fmt.Errorf("unable to encode %s as CBOR", t)
+	}
+}
+
+// appendMarshaler appends a value that implements json.Marshaler or encoding.TextMarshaler
+func appendMarshaler(b []byte, v reflect.Value, depth int) ([]byte, error) {
+	if m, ok := v.Interface().(json.Marshaler); ok {
+		data, err := m.MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		var value interface{}
+		if err = decoder.Decode(&value); err != nil {
+			return nil, err
+		}
+		return appendValue(b, reflect.ValueOf(value), depth)
+	}
+	text, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	return AppendText(b, string(text)), nil
+}
+
+func appendInt(b []byte, i int64) []byte {
+	if i < 0 {
+		return appendHeader(b, majorNegative, uint64(-1-i))
+	}
+	return appendHeader(b, majorUnsigned, uint64(i))
+}
+
+// appendFloat appends a floating-point number as an integer if it is integral and fits, as it would be after a JSON
+// round trip. A float32 is encoded with the shortest decimal form that represents it, as in JSON.
+func appendFloat(b []byte, f float64, bits int) ([]byte, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, fmt.Errorf("unable to encode %v as CBOR", f)
+	}
+	return appendNumber(b, json.Number(strconv.FormatFloat(f, 'g', -1, bits)))
+}
+
+// appendNumber appends a JSON number as an integer if it is integral and fits, otherwise as a float
+func appendNumber(b []byte, n json.Number) ([]byte, error) {
+	if n == "" {
+		n = "0"
+	}
+	if i, err := n.Int64(); err == nil {
+		return appendInt(b, i), nil
+	}
+	if u, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+		return AppendUint(b, u), nil
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return nil, err
+	}
+	if f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 {
+		return appendInt(b, int64(f)), nil
+	}
+	if f == math.Trunc(f) && f > 0 && f < math.MaxUint64 {
+		return AppendUint(b, uint64(f)), nil
+	}
+	return appendBigEndian(append(b, majorSimple<<5|simpleFloat64), math.Float64bits(f), 8), nil
+}
+
+func appendArray(b []byte, v reflect.Value, depth int) (_ []byte, err error) {
+	b = appendHeader(b, majorArray, uint64(v.Len()))
+	for i := 0; i < v.Len(); i++ {
+		if b, err = appendValue(b, v.Index(i), depth+1); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// appendMap appends a map with text keys, which are sorted so that the encoding is deterministic
+func appendMap(b []byte, v reflect.Value, depth int) (_ []byte, err error) {
+	if v.IsNil() {
+		return AppendNull(b), nil
+	}
+	type entry struct {
+		key   string
+		value reflect.Value
+	}
+	entries := make([]entry, 0, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		key, err := mapKey(iter.Key())
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry{key: key, value: iter.Value()})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+	b = appendHeader(b, majorMap, uint64(len(entries)))
+	for _, e := range entries {
+		b = AppendText(b, e.key)
+		if b, err = appendValue(b, e.value, depth+1); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// mapKey returns the text of a map key with the rules of encoding/json
+func mapKey(k reflect.Value) (string, error) {
+	if k.Kind() == reflect.String {
+		return k.String(), nil
+	}
+	if m, ok := k.Interface().(encoding.TextMarshaler); ok {
+		if k.Kind() == reflect.Ptr && k.IsNil() {
+			return "", nil
+		}
+		text, err := m.MarshalText()
+		return string(text), err
+	}
+	switch k.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(k.Uint(), 10), nil
+	}
+	return "", fmt.Errorf("unable to encode map key of type %s as CBOR", k.Type())
+}
+
+func appendStruct(b []byte, v reflect.Value, depth int) (_ []byte, err error) {
+	fields := cachedFields(v.Type())
+	values := make([]reflect.Value, len(fields))
+	n := 0
+	for i, f := range fields {
+		fv, ok := fieldByIndex(v, f.index)
+		if !ok || f.omitEmpty && isEmpty(fv) {
+			continue
+		}
+		values[i] = fv
+		n++
+	}
+	b = appendHeader(b, majorMap, uint64(n))
+	for i, f := range fields {
+		if !values[i].IsValid() {
+			continue
+		}
+		b = AppendText(b, f.name)
+		if f.quoted {
+			b, err = appendQuoted(b, values[i])
+		} else {
+			b, err = appendValue(b, values[i], depth+1)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// appendQuoted appends a field with the string option, which encoding/json encodes as a string containing its JSON
+func appendQuoted(b []byte, v reflect.Value) ([]byte, error) {
+	if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+		return AppendNull(b), nil
+	}
+	data, err := json.Marshal(v.Interface())
+	if err != nil {
+		return nil, err
+	}
+	return AppendText(b, string(data)), nil
+}
+
+// fieldByIndex returns the field with the index, returning false if it is in an embedded struct that is a nil pointer
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// field is a struct field that is encoded as a map entry
+type field struct {
+	name      string
+	index     []int
+	tagged    bool
+	omitEmpty bool
+	quoted    bool
+}
+
+var fieldCache sync.Map
+
+// cachedFields returns the encoded fields of the struct type
+func cachedFields(t reflect.Type) []field {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.([]field)
+	}
+	f, _ := fieldCache.LoadOrStore(t, typeFields(t))
+	return f.([]field)
+}
+
+// typeFields returns the fields that encoding/json encodes for the struct type, including the fields promoted from
+// embedded structs, in the order of their index
+func typeFields(t reflect.Type) []field {
+	type embedded struct {
+		t     reflect.Type
+		index []int
+	}
+	var fields []field
+	visited := map[reflect.Type]bool{}
+	next := []embedded{{t: t}}
+	for len(next) > 0 {
+		current := next
+		next = nil
+		for _, e := range current {
+			if visited[e.t] {
+				continue
+			}
+			visited[e.t] = true
+			for i := 0; i < e.t.NumField(); i++ {
+				sf := e.t.Field(i)
+				ft := sf.Type
+				if ft.Name() == "" && ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				if sf.Anonymous {
+					if sf.PkgPath != "" && ft.Kind() != reflect.Struct {
+						continue
+					}
+				} else if sf.PkgPath != "" {
+					continue
+				}
+				tag := sf.Tag.Get("json")
+				if tag == "-" {
+					continue
+				}
+				name, opts := tag, ""
+				if i := strings.Index(tag, ","); i >= 0 {
+					name, opts = tag[:i], tag[i:]
+				}
+				index := append(append([]int{}, e.index...), i)
+				if name == "" && sf.Anonymous && ft.Kind() == reflect.Struct {
+					next = append(next, embedded{t: ft, index: index})
+					continue
+				}
+				f := field{
+					name:      name,
+					index:     index,
+					tagged:    name != "",
+					omitEmpty: strings.Contains(opts, ",omitempty"),
+				}
+				if f.name == "" {
+					f.name = sf.Name
+				}
+				if strings.Contains(opts, ",string") {
+					switch ft.Kind() {
+					case reflect.Bool, reflect.String, reflect.Float32, reflect.Float64,
+						reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+						reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+						f.quoted = true
+					}
+				}
+				fields = append(fields, f)
+			}
+		}
+	}
+
+	// a field hides the fields of the same name that are nested deeper, while fields of the same name at the same
+	// depth hide each other unless exactly one of them is tagged
+	sort.SliceStable(fields, func(i, j int) bool {
+		if fields[i].name != fields[j].name {
+			return fields[i].name < fields[j].name
+		}
+		if len(fields[i].index) != len(fields[j].index) {
+			return len(fields[i].index) < len(fields[j].index)
+		}
+		return fields[i].tagged && !fields[j].tagged
+	})
+	dominant := fields[:0]
+	for i := 0; i < len(fields); {
+		j := i + 1
+		for j < len(fields) && fields[j].name == fields[i].name {
+			j++
+		}
+		first := fields[i]
+		if j == i+1 || len(fields[i+1].index) > len(first.index) || first.tagged && !fields[i+1].tagged {
+			dominant = append(dominant, first)
+		}
+		i = j
+	}
+	sort.Slice(dominant, func(i, j int) bool {
+		a, b := dominant[i].index, dominant[j].index
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return len(a) < len(b)
+	})
+	return dominant
+}
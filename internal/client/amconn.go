@@ -1,4 +1,5 @@
-// +build !coap,!http http
+//go:build (!coap && !http && !tiny) || http
+// +build !coap,!http,!tiny http
 
 /*
  * Copyright 2020 ForgeRock AS
@@ -21,11 +22,17 @@ package client
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/JacoJooste/iot-edge/v7/internal/clock"
 	"github.com/JacoJooste/iot-edge/v7/internal/debug"
 	"github.com/JacoJooste/iot-edge/v7/internal/introspect"
 	"gopkg.in/square/go-jose.v2"
@@ -35,9 +42,10 @@ const (
 	acceptAPIVersion          = "Accept-API-Version"
 	serverInfoEndpointVersion = "resource=1.1"
 	authNEndpointVersion      = "protocol=1.0,resource=2.1"
-	thingsEndpointVersion     = "protocol=2.0,resource=1.0"
 	sessionEndpointVersion    = "resource=4.0"
+	policiesEndpointVersion   = "protocol=1.0,resource=2.1"
 	httpContentType           = "Content-Type"
+	httpRetryAfter            = "Retry-After"
 	// Query keys
 	fieldQueryKey         = "_fields"
 	realmQueryKey         = "realm"
@@ -45,6 +53,85 @@ const (
 	authTreeQueryKey      = "authIndexValue"
 )
 
+// Things endpoint version negotiation
+// AM releases support different versions of the things endpoint. The connection requests the most preferred version
+// that the SDK supports and, if AM rejects it, falls back to the next one for all further requests. Requests with a
+// JSON payload are repeated with the new version, while signed requests are returned with ErrUnsupportedVersion
+// since the version is part of the signed JWT and the request must be signed again by the caller.
+
+// thingsEndpointVersions are the versions of the things endpoint that the SDK supports, in order of preference.
+// The last version is the minimum version that AM must support.
+var thingsEndpointVersions = []string{
+	"protocol=2.0,resource=1.0",
+	"protocol=1.0,resource=1.0",
+}
+
+// httpBuilt is true when the connection to AM is included in the build
+const httpBuilt = true
+
+// APIVersions returns the versions of the AM endpoints that the SDK supports, by endpoint. The versions of the things
+// endpoint are in order of preference.
+func APIVersions() map[string][]string {
+	return map[string][]string{
+		"serverinfo":   {serverInfoEndpointVersion},
+		"authenticate": {authNEndpointVersion},
+		"sessions":     {sessionEndpointVersion},
+		"policies":     {policiesEndpointVersion},
+		"things":       append([]string(nil), thingsEndpointVersions...),
+	}
+}
+
+// thingsEndpointVersion returns the negotiated version of the things endpoint
+func (c *amConnection) thingsEndpointVersion() string {
+	if c.state == nil {
+		return thingsEndpointVersions[0]
+	}
+	c.state.mutex.Lock()
+	defer c.state.mutex.Unlock()
+	return thingsEndpointVersions[c.state.thingsVersion]
+}
+
+// downgradeThingsVersion falls back to the version of the things endpoint that follows the rejected version.
+// Returns false if there is no version to fall back to.
+func (c *amConnection) downgradeThingsVersion(rejected string) bool {
+	if c.state == nil {
+		return false
+	}
+	c.state.mutex.Lock()
+	defer c.state.mutex.Unlock()
+	if thingsEndpointVersions[c.state.thingsVersion] != rejected {
+		// another request has already negotiated a different version
+		return true
+	}
+	if c.state.thingsVersion == len(thingsEndpointVersions)-1 {
+		return false
+	}
+	c.state.thingsVersion++
+	debug.Infof("AM does not support things endpoint version %s, using %s", rejected,
+		thingsEndpointVersions[c.state.thingsVersion])
+	return true
+}
+
+// accessTokenKeys returns the keys with the given ID that AM uses to sign access tokens
+func (c *amConnection) accessTokenKeys(kid string) []jose.JSONWebKey {
+	if c.state == nil {
+		return nil
+	}
+	c.state.mutex.Lock()
+	defer c.state.mutex.Unlock()
+	return c.state.accessTokenJWKS.Key(kid)
+}
+
+// signingAlgorithms returns the JWS algorithms that AM accepts, or nil if AM did not advertise them
+func (c *amConnection) signingAlgorithms() []string {
+	if c.state == nil {
+		return nil
+	}
+	c.state.mutex.Lock()
+	defer c.state.mutex.Unlock()
+	return c.state.signingAlgorithms
+}
+
 // newSessionRequest returns a new session request
 func (c *amConnection) newSessionRequest(tokenID string, action string) (request *http.Request, err error) {
 	request, err = http.NewRequest(
@@ -57,27 +144,74 @@ func (c *amConnection) newSessionRequest(tokenID string, action string) (request
 
 	request.Header.Add(acceptAPIVersion, sessionEndpointVersion)
 	request.Header.Add(httpContentType, string(ApplicationJSON))
-	request.AddCookie(&http.Cookie{Name: c.cookieName, Value: tokenID})
+	c.setSessionToken(request, tokenID)
 	return request, nil
 }
 
+// Do sends the request to AM with a transaction ID and the configured User-Agent and static headers. The request waits
+// for its turn if the connection limits the number of concurrent requests.
+func (c *amConnection) Do(request *http.Request) (*http.Response, error) {
+	id := c.transactionID
+	if id == "" {
+		id = NewTransactionID()
+	}
+	request.Header.Set(TransactionIDHeader, id)
+	if c.clientCertificate != nil {
+		request.Header.Set(ClientCertificateHeader, clientCertificateValue(c.clientCertificate))
+	}
+	c.peer.setHeaders(request)
+	if c.userAgent != "" {
+		request.Header.Set("User-Agent", c.userAgent)
+	}
+	for name, values := range c.headers {
+		if _, ok := request.Header[name]; ok {
+			continue
+		}
+		for _, value := range values {
+			request.Header.Add(name, value)
+		}
+	}
+	if err := c.scheduler.acquire(classifyRequest(request)); err != nil {
+		return nil, err
+	}
+	response, err := c.Client.Do(request)
+	c.scheduler.release()
+	if err != nil {
+		c.liveness.record(transportError{err})
+		return response, err
+	}
+	c.liveness.recordResponse(errorClass(response.StatusCode), response.Status)
+	limitBody(response, maxPayloadSize(c.maxPayload))
+	return response, err
+}
+
+// setSessionToken adds the session token to the request, either in the session token header, if one has been
+// configured, or in the session cookie
+func (c *amConnection) setSessionToken(request *http.Request, tokenID string) {
+	if c.sessionHeader != "" {
+		request.Header.Set(c.sessionHeader, tokenID)
+		return
+	}
+	request.AddCookie(&http.Cookie{Name: c.cookieName, Value: tokenID})
+}
+
 // logoutSession represented by the given token
 func (c *amConnection) LogoutSession(tokenID string) (err error) {
 	request, err := c.newSessionRequest(tokenID, "logout")
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, nil))
+		debug.Trace(debug.DumpHTTPRoundTrip(request, nil))
 		return err
 	}
 
 	response, err := c.Do(request)
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
-		return err
+		debug.Trace(debug.DumpHTTPRoundTrip(request, response))
+		return transportError{err}
 	}
 	defer response.Body.Close()
 	if response.StatusCode != http.StatusOK {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
-		return fmt.Errorf("session logout failed")
+		debug.Trace(debug.DumpHTTPRoundTrip(request, response))
+		return responseError(response)
 	}
 	return nil
 }
@@ -86,14 +220,14 @@ func (c *amConnection) LogoutSession(tokenID string) (err error) {
 func (c *amConnection) ValidateSession(tokenID string) (ok bool, err error) {
 	request, err := c.newSessionRequest(tokenID, "validate")
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, nil))
+		debug.Trace(debug.DumpHTTPRoundTrip(request, nil))
 		return false, err
 	}
 
 	response, err := c.Do(request)
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
-		return false, err
+		debug.Trace(debug.DumpHTTPRoundTrip(request, response))
+		return false, transportError{err}
 	}
 	defer response.Body.Close()
 
@@ -102,58 +236,162 @@ func (c *amConnection) ValidateSession(tokenID string) (ok bool, err error) {
 	case http.StatusUnauthorized:
 		return false, nil
 	default:
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
-		return false, fmt.Errorf("session validation failed")
+		debug.Trace(debug.DumpHTTPRoundTrip(request, response))
+		return false, responseError(response)
 	}
 
 	responseBody, err := ioutil.ReadAll(response.Body)
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
+		debug.Trace(debug.DumpHTTPRoundTrip(request, response))
 		return false, err
 	}
 	info := struct {
 		Valid bool `json:"valid"`
 	}{}
 	if err = json.Unmarshal(responseBody, &info); err != nil {
-		return false, err
+		return false, invalidPayload(err)
 	}
 	return info.Valid, nil
 
 }
 
-// amError is used to unmarshal an AM error response
-type amError struct {
-	Code    int    `json:"code"`
-	Reason  string `json:"reason"`
-	Message string `json:"message"`
+// SessionInfo requests the information held by AM about the session represented by the given token
+func (c *amConnection) SessionInfo(tokenID string) (reply []byte, err error) {
+	request, err := c.newSessionRequest(tokenID, "getSessionInfo")
+	if err != nil {
+		debug.Trace(debug.DumpHTTPRoundTrip(request, nil))
+		return nil, err
+	}
+
+	response, err := c.Do(request)
+	if err != nil {
+		debug.Trace(debug.DumpHTTPRoundTrip(request, response))
+		return nil, transportError{err}
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		debug.Trace(debug.DumpHTTPRoundTrip(request, response))
+		return nil, responseError(response)
+	}
+	reply, err = ioutil.ReadAll(response.Body)
+	if err != nil {
+		debug.Trace(debug.DumpHTTPRoundTrip(request, response))
+		return nil, transportError{err}
+	}
+	return reply, nil
+}
+
+// responseError reads the body of a failed response and returns the error that it describes
+func responseError(response *http.Response) error {
+	responseBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return transportError{err}
+	}
+	return httpError(response, responseBody)
 }
 
-func (e amError) Error() string {
-	return fmt.Sprintf("%s: %s", e.Reason, e.Message)
+// httpError returns the error described by the body and headers of a failed response
+func httpError(response *http.Response, responseBody []byte) error {
+	err := parseAMError(responseBody, response.StatusCode)
+	if amError, ok := err.(AMError); ok {
+		amError.RetryAfter = parseRetryAfter(response.Header.Get(httpRetryAfter))
+		amError.Locale = response.Header.Get(ContentLanguageHeader)
+		if response.Request != nil {
+			amError.TransactionID = response.Request.Header.Get(TransactionIDHeader)
+		}
+		return amError
+	}
+	return err
 }
 
-func parseAMError(response []byte, status int) error {
-	var amError amError
-	if err := json.Unmarshal(response, &amError); err != nil {
-		return fmt.Errorf("request failed with status code %d", status)
+// parseRetryAfter returns the delay specified by a Retry-After header value
+// The value can either be a number of seconds or a HTTP date, see https://tools.ietf.org/html/rfc7231#section-7.1.3
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
 	}
-	if amError.Code == http.StatusUnauthorized {
-		return ErrUnauthorised
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0
+	}
+	if delay := date.Sub(clock.Clock()); delay > 0 {
+		return delay
 	}
-	return amError
+	return 0
 }
 
 // initialise checks that the server can be reached and prepares the client for further communication
 func (c *amConnection) Initialise() error {
-	info, err := c.getServerInfo()
-	if err != nil {
+	if c.state == nil {
+		c.state = &amState{}
+	}
+	if c.amInfo != nil {
+		c.useAMInfo(*c.amInfo)
+		return nil
+	}
+	// cached information is used until it expires and is then revalidated with the ETag of the server information
+	source := c.baseURL + "?" + realmQueryKey + "=" + c.realm
+	var cached cachedAMInfo
+	if c.amInfoCache != nil {
+		var ok bool
+		if cached, ok = c.amInfoCache.load(source); ok && cached.fresh() {
+			c.useAMInfo(cached.AMInfo)
+			return nil
+		}
+	}
+	info, etag, err := c.getServerInfo(cached.ETag)
+	if err == ErrNotModified {
+		debug.Info("cached AM info revalidated")
+		c.useAMInfo(cached.AMInfo)
+		c.amInfoCache.store(cached)
+		return nil
+	} else if err != nil {
 		return err
 	}
-	c.cookieName = info.CookieName
+	// the discovered cookie name is not used if it has been overridden
+	if c.cookieName == "" {
+		c.cookieName = info.CookieName
+	}
+	// requests are made to the fully qualified realm path so that the realm is the same for all endpoints
+	if info.Realm != "" && info.Realm != c.realm {
+		debug.Infof("realm `%s` resolved to `%s`", c.realm, info.Realm)
+		c.realm = info.Realm
+	}
 	_ = c.updateJSONWebKeySet()
+	if c.amInfoCache != nil {
+		discovered, err := DiscoverAMInfo(c)
+		if err != nil {
+			return err
+		}
+		c.amInfoCache.store(cachedAMInfo{AMInfo: discovered, Source: source, ETag: etag})
+	}
 	return nil
 }
 
+// useAMInfo initialises the connection with information about AM that was provided in advance instead of discovering it
+func (c *amConnection) useAMInfo(info AMInfo) {
+	if c.cookieName == "" {
+		c.cookieName = info.CookieName
+	}
+	if info.Realm != "" {
+		c.realm = info.Realm
+	}
+	c.state.mutex.Lock()
+	defer c.state.mutex.Unlock()
+	c.state.signingAlgorithms = info.SigningAlgorithms
+	for i, version := range thingsEndpointVersions {
+		if version == info.ThingsVersion {
+			c.state.thingsVersion = i
+		}
+	}
+}
+
 // authenticate with the AM authTree using the given payload
 // This is a single round trip
 func (c *amConnection) Authenticate(payload AuthenticatePayload) (reply AuthenticatePayload, err error) {
@@ -163,7 +401,7 @@ func (c *amConnection) Authenticate(payload AuthenticatePayload) (reply Authenti
 	}
 	request, err := http.NewRequest(http.MethodPost, c.baseURL+"/json/authenticate", bytes.NewBuffer(requestBody))
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, nil))
+		debug.Trace(debug.DumpHTTPRoundTrip(request, nil))
 		return reply, err
 	}
 
@@ -178,24 +416,25 @@ func (c *amConnection) Authenticate(payload AuthenticatePayload) (reply Authenti
 
 	request.Header.Add(acceptAPIVersion, authNEndpointVersion)
 	request.Header.Add(httpContentType, string(ApplicationJSON))
+	c.authContext.setHeaders(request)
 	response, err := c.Do(request)
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
-		return reply, err
+		debug.Trace(debug.DumpHTTPRoundTrip(request, response))
+		return reply, transportError{err}
 	}
 	defer response.Body.Close()
 	if response.StatusCode != http.StatusOK {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
-		return reply, ErrUnauthorised
+		debug.Trace(debug.DumpHTTPRoundTrip(request, response))
+		return reply, responseError(response)
 	}
 	responseBody, err := ioutil.ReadAll(response.Body)
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
+		debug.Trace(debug.DumpHTTPRoundTrip(request, response))
 		return reply, err
 	}
 	if err = json.Unmarshal(responseBody, &reply); err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
-		return reply, err
+		debug.Trace(debug.DumpHTTPRoundTrip(request, response))
+		return reply, invalidPayload(err)
 	}
 	return reply, err
 }
@@ -203,114 +442,157 @@ func (c *amConnection) Authenticate(payload AuthenticatePayload) (reply Authenti
 // serverInfo contains information gathered from a server information request to AM
 type serverInfo struct {
 	CookieName string `json:"cookieName"`
+	// Realm is the fully qualified path of the realm, resolved by AM from the realm alias or the DNS alias of the URL
+	Realm string `json:"realm"`
 }
 
-// getServerInfo makes a server information request to AM
-func (c *amConnection) getServerInfo() (info serverInfo, err error) {
+// getServerInfo makes a server information request to AM. If an ETag of cached information is given then the request
+// is conditional and ErrNotModified is returned if the information has not changed.
+func (c *amConnection) getServerInfo(cachedETag string) (info serverInfo, etag string, err error) {
 	request, err := http.NewRequest(http.MethodGet, c.baseURL+"/json/serverinfo/*", nil)
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, nil))
-		return info, err
+		debug.Trace(debug.DumpHTTPRoundTrip(request, nil))
+		return info, etag, err
+	}
+	if cachedETag != "" {
+		request.Header.Set("If-None-Match", cachedETag)
 	}
 
 	q := request.URL.Query()
-	q.Set(fieldQueryKey, "cookieName")
+	q.Set(fieldQueryKey, "cookieName,realm")
+	if c.realm != "" {
+		q.Set(realmQueryKey, c.realm)
+	}
 	request.URL.RawQuery = q.Encode()
 
 	request.Header.Add(acceptAPIVersion, serverInfoEndpointVersion)
 	request.Header.Add(httpContentType, string(ApplicationJSON))
 	response, err := c.Do(request)
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
-		return info, err
+		debug.Trace(debug.DumpHTTPRoundTrip(request, response))
+		return info, etag, transportError{err}
 	}
 	defer response.Body.Close()
 	responseBody, err := ioutil.ReadAll(response.Body)
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
-		return info, err
+		debug.Trace(debug.DumpHTTPRoundTrip(request, response))
+		return info, etag, err
+	}
+	if cachedETag != "" && response.StatusCode == http.StatusNotModified {
+		return info, cachedETag, ErrNotModified
 	}
 	if response.StatusCode != http.StatusOK {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
-		return info, fmt.Errorf("server info request failed")
+		debug.Trace(debug.DumpHTTPRoundTrip(request, response))
+		return info, etag, httpError(response, responseBody)
 	}
 	if err = json.Unmarshal(responseBody, &info); err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
-		return info, err
+		debug.Trace(debug.DumpHTTPRoundTrip(request, response))
+		return info, etag, invalidPayload(err)
 	}
-	return info, err
+	return info, response.Header.Get("ETag"), err
 }
 
-// getJWKSURI gets the OAuth 2.0 JSON Web Key set URI from AM
-func (c *amConnection) getJWKSURI() (uri string, err error) {
+// ServerTime returns the time of AM from the Date header of a server information request, which has a resolution of one
+// second. The status of the response is ignored since AM sets the header on all responses.
+func (c *amConnection) ServerTime() (server time.Time, resolution time.Duration, err error) {
+	request, err := http.NewRequest(http.MethodGet, c.baseURL+"/json/serverinfo/*", nil)
+	if err != nil {
+		return server, resolution, err
+	}
+	request.Header.Add(acceptAPIVersion, serverInfoEndpointVersion)
+	response, err := c.Do(request)
+	if err != nil {
+		return server, resolution, transportError{err}
+	}
+	response.Body.Close()
+	server, err = http.ParseTime(response.Header.Get("Date"))
+	if err != nil {
+		return server, resolution, invalidPayload(fmt.Errorf("invalid Date header; %w", err))
+	}
+	return server, time.Second, nil
+}
+
+// openIDConfiguration contains the parts of AM's OpenID Provider configuration that are used by the SDK
+type openIDConfiguration struct {
+	JWKSURI string `json:"jwks_uri"`
+	// SigningAlgorithms are the JWS algorithms that AM accepts for signed request objects
+	SigningAlgorithms []string `json:"request_object_signing_alg_values_supported"`
+}
+
+// getOpenIDConfiguration gets the OpenID Provider configuration from AM
+func (c *amConnection) getOpenIDConfiguration() (config openIDConfiguration, err error) {
 	u := c.baseURL + "/oauth2/.well-known/openid-configuration"
 	if c.realm != "" {
 		u = u + "?realm=" + c.realm
 	}
 	request, err := http.NewRequest(http.MethodGet, u, nil)
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, nil))
-		return uri, err
+		debug.Trace(debug.DumpHTTPRoundTrip(request, nil))
+		return config, err
 	}
 
 	request.Header.Add(httpContentType, string(ApplicationJSON))
 	response, err := c.Do(request)
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
-		return uri, err
+		debug.Trace(debug.DumpHTTPRoundTrip(request, response))
+		return config, transportError{err}
 	}
 	defer response.Body.Close()
 	responseBody, err := ioutil.ReadAll(response.Body)
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
-		return uri, err
+		debug.Trace(debug.DumpHTTPRoundTrip(request, response))
+		return config, err
 	}
 	if response.StatusCode != http.StatusOK {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
-		return uri, fmt.Errorf("openid-configuration request failed")
-	}
-	var config struct {
-		URI string `json:"jwks_uri"`
+		debug.Trace(debug.DumpHTTPRoundTrip(request, response))
+		return config, httpError(response, responseBody)
 	}
 	if err = json.Unmarshal(responseBody, &config); err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
-		return uri, err
+		debug.Trace(debug.DumpHTTPRoundTrip(request, response))
+		return config, invalidPayload(err)
 	}
-	return config.URI, err
+	return config, err
 }
 
 // updateJSONWebKeySet updates the local JWK Set by retrieving the current key set from AM
 func (c *amConnection) updateJSONWebKeySet() (err error) {
-	uri, err := c.getJWKSURI()
+	config, err := c.getOpenIDConfiguration()
 	if err != nil {
 		return err
 	}
-	request, err := http.NewRequest(http.MethodGet, uri, nil)
+	c.state.mutex.Lock()
+	c.state.signingAlgorithms = config.SigningAlgorithms
+	c.state.mutex.Unlock()
+	request, err := http.NewRequest(http.MethodGet, config.JWKSURI, nil)
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, nil))
+		debug.Trace(debug.DumpHTTPRoundTrip(request, nil))
 		return err
 	}
 
 	request.Header.Add(httpContentType, string(ApplicationJSON))
 	response, err := c.Do(request)
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
-		return err
+		debug.Trace(debug.DumpHTTPRoundTrip(request, response))
+		return transportError{err}
 	}
 	defer response.Body.Close()
 	responseBody, err := ioutil.ReadAll(response.Body)
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
+		debug.Trace(debug.DumpHTTPRoundTrip(request, response))
 		return err
 	}
 	if response.StatusCode != http.StatusOK {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
-		return fmt.Errorf("OAuth 2.0 JSON Web Key set request failed")
+		debug.Trace(debug.DumpHTTPRoundTrip(request, response))
+		return httpError(response, responseBody)
 	}
-	if err = json.Unmarshal(responseBody, &c.accessTokenJWKS); err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
-		return err
+	var jwks jose.JSONWebKeySet
+	if err = json.Unmarshal(responseBody, &jwks); err != nil {
+		debug.Trace(debug.DumpHTTPRoundTrip(request, response))
+		return invalidPayload(err)
 	}
+	c.state.mutex.Lock()
+	defer c.state.mutex.Unlock()
+	c.state.accessTokenJWKS = jwks
 	return nil
 }
 
@@ -338,13 +620,24 @@ func (c *amConnection) attributesURL(names []string) string {
 	return u + "?" + strings.Join(q, "&")
 }
 
+func (c *amConnection) policyURL() string {
+	q := "_action=evaluate"
+	if c.realm != "" {
+		q += "&" + realmQueryKey + "=" + url.QueryEscape(c.realm)
+	}
+	return c.baseURL + "/json/policies?" + q
+}
+
 // amInfo returns AM related information to the client
 func (c *amConnection) AMInfo() (info AMInfoResponse, err error) {
 	return AMInfoResponse{
-		Realm:          c.realm,
-		AccessTokenURL: c.accessTokenURL(),
-		AttributesURL:  c.attributesURL(nil),
-		ThingsVersion:  thingsEndpointVersion,
+		BaseURL:           c.baseURL,
+		Realm:             c.realm,
+		AccessTokenURL:    c.accessTokenURL(),
+		AttributesURL:     c.attributesURL(nil),
+		PolicyURL:         c.policyURL(),
+		ThingsVersion:     c.thingsEndpointVersion(),
+		SigningAlgorithms: c.signingAlgorithms(),
 	}, nil
 }
 
@@ -352,7 +645,7 @@ func (c *amConnection) AMInfo() (info AMInfoResponse, err error) {
 func (c *amConnection) AccessToken(tokenID string, content ContentType, payload string) ([]byte, error) {
 	request, err := http.NewRequest(http.MethodPost, c.accessTokenURL(), strings.NewReader(payload))
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, nil))
+		debug.Trace(debug.DumpHTTPRoundTrip(request, nil))
 		return nil, err
 	}
 	return c.makeCommandRequest(tokenID, content, request)
@@ -378,19 +671,19 @@ func (c *amConnection) IntrospectAccessToken(token string) (introspection []byte
 	if header.KeyID == "" {
 		return introspection, fmt.Errorf("no kid")
 	}
-	keys := c.accessTokenJWKS.Key(header.KeyID)
+	keys := c.accessTokenKeys(header.KeyID)
 
 	// if keys is empty then we don't have the token key locally, get updated JWK set
 	if len(keys) == 0 {
-		debug.Logger.Println("updating JSON web key set")
+		debug.Info("updating JSON web key set")
 		err = c.updateJSONWebKeySet()
 		if err != nil {
 			return introspection, err
 		}
-		keys = c.accessTokenJWKS.Key(header.KeyID)
+		keys = c.accessTokenKeys(header.KeyID)
 		if len(keys) == 0 {
 			// unknown key, return inactive introspection
-			debug.Logger.Printf("unknown access token key: %s", header.KeyID)
+			debug.Infof("unknown access token key: %s", header.KeyID)
 			return introspect.InactiveIntrospectionBytes, nil
 		}
 	}
@@ -413,32 +706,176 @@ func (c *amConnection) IntrospectAccessToken(token string) (introspection []byte
 func (c *amConnection) Attributes(tokenID string, content ContentType, payload string, names []string) (reply []byte, err error) {
 	request, err := http.NewRequest(http.MethodGet, c.attributesURL(names), strings.NewReader(payload))
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, nil))
+		debug.Trace(debug.DumpHTTPRoundTrip(request, nil))
 		return nil, err
 	}
 	return c.makeCommandRequest(tokenID, content, request)
 }
 
+// ConditionalAttributes makes a thing attributes request with the If-None-Match header set to the revision, which is
+// the ETag of the attributes resource
+func (c *amConnection) ConditionalAttributes(tokenID string, content ContentType, payload string, names []string,
+	revision string) (reply []byte, next string, err error) {
+	request, err := http.NewRequest(http.MethodGet, c.attributesURL(names), strings.NewReader(payload))
+	if err != nil {
+		debug.Trace(debug.DumpHTTPRoundTrip(request, nil))
+		return nil, revision, err
+	}
+	if revision != "" {
+		request.Header.Set("If-None-Match", revision)
+	}
+	reply, header, err := c.commandExchange(tokenID, content, request)
+	if err != nil {
+		return reply, revision, err
+	}
+	if next = header.Get("ETag"); next == "" {
+		// AM did not tag the attributes so the revision is derived from their content
+		next = contentRevision(reply)
+		if revision != "" && next == revision {
+			return nil, revision, ErrNotModified
+		}
+	}
+	return reply, next, nil
+}
+
+// PolicyDecision makes a policy evaluation request with the given session token and payload
+func (c *amConnection) PolicyDecision(tokenID string, content ContentType, payload string) (reply []byte, err error) {
+	request, err := http.NewRequest(http.MethodPost, c.policyURL(), strings.NewReader(payload))
+	if err != nil {
+		debug.Trace(debug.DumpHTTPRoundTrip(request, nil))
+		return nil, err
+	}
+	request.Header.Set(acceptAPIVersion, policiesEndpointVersion)
+	return c.makeRequest(tokenID, content, request)
+}
+
+// RegisterOAuth2Client registers an OAuth 2.0 client dynamically with AM as defined by rfc7591. The initial access
+// token is only required if AM is configured to protect the registration endpoint.
+func RegisterOAuth2Client(connection Connection, initialAccessToken string, metadata OAuth2ClientMetadata) (info OAuth2ClientInformation, err error) {
+	c, ok := connection.(*amConnection)
+	if !ok {
+		return info, errors.New("dynamic client registration requires a connection to AM")
+	}
+	requestBody, err := json.Marshal(metadata)
+	if err != nil {
+		return info, err
+	}
+	u := c.baseURL + "/oauth2/register"
+	if c.realm != "" {
+		u += "?" + realmQueryKey + "=" + c.realm
+	}
+	request, err := http.NewRequest(http.MethodPost, u, bytes.NewBuffer(requestBody))
+	if err != nil {
+		debug.Trace(debug.DumpHTTPRoundTrip(request, nil))
+		return info, err
+	}
+	request.Header.Set(httpContentType, string(ApplicationJSON))
+	if initialAccessToken != "" {
+		request.Header.Set("Authorization", "Bearer "+initialAccessToken)
+	}
+	response, err := c.Do(request)
+	if err != nil {
+		debug.Trace(debug.DumpHTTPRoundTrip(request, response))
+		return info, transportError{err}
+	}
+	defer response.Body.Close()
+	responseBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		debug.Trace(debug.DumpHTTPRoundTrip(request, response))
+		return info, err
+	}
+	if response.StatusCode != http.StatusCreated && response.StatusCode != http.StatusOK {
+		debug.Trace(debug.DumpHTTPRoundTrip(request, response))
+		return info, httpError(response, responseBody)
+	}
+	if err = json.Unmarshal(responseBody, &info); err != nil {
+		debug.Trace(debug.DumpHTTPRoundTrip(request, response))
+		return info, invalidPayload(err)
+	}
+	if info.ClientID == "" {
+		return info, invalidPayload(errors.New("no client ID in registration response"))
+	}
+	return info, nil
+}
+
+// makeCommandRequest makes a request to the things endpoint, negotiating the endpoint version with AM
 func (c *amConnection) makeCommandRequest(tokenID string, content ContentType, request *http.Request) (reply []byte, err error) {
-	request.Header.Set(acceptAPIVersion, thingsEndpointVersion)
+	reply, _, err = c.commandExchange(tokenID, content, request)
+	return reply, err
+}
+
+// commandExchange makes a request to the things endpoint, negotiating the endpoint version with AM, and returns the
+// header of the response together with its body
+func (c *amConnection) commandExchange(tokenID string, content ContentType, request *http.Request) (reply []byte,
+	header http.Header, err error) {
+	for {
+		version := c.thingsEndpointVersion()
+		request.Header.Set(acceptAPIVersion, version)
+		reply, header, err = c.exchange(tokenID, content, request)
+		if !errors.Is(err, ErrUnsupportedVersion) {
+			return reply, header, err
+		}
+		if !c.downgradeThingsVersion(version) {
+			return reply, header, fmt.Errorf("%w: AM does not support any of the things endpoint versions %s", err,
+				strings.Join(thingsEndpointVersions, "; "))
+		}
+		if content == ApplicationJOSE || request.GetBody == nil {
+			return reply, header, err
+		}
+		if request.Body, err = request.GetBody(); err != nil {
+			return nil, header, err
+		}
+		// the session cookie is added again by exchange
+		request.Header.Del("Cookie")
+	}
+}
+
+// makeRequest makes an authorised request with the given session token, the API version must be set by the caller
+func (c *amConnection) makeRequest(tokenID string, content ContentType, request *http.Request) (reply []byte, err error) {
+	reply, _, err = c.exchange(tokenID, content, request)
+	return reply, err
+}
+
+// exchange makes an authorised request with the given session token and returns the header of the response together
+// with its body. ErrNotModified is returned if the request is conditional and the resource has not changed.
+func (c *amConnection) exchange(tokenID string, content ContentType, request *http.Request) (reply []byte,
+	header http.Header, err error) {
 	request.Header.Set(httpContentType, string(content))
-	request.AddCookie(&http.Cookie{Name: c.cookieName, Value: tokenID})
+	c.setSessionToken(request, tokenID)
 	response, err := c.Do(request)
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
-		return nil, err
+		debug.Trace(debug.DumpHTTPRoundTrip(request, response))
+		return nil, nil, transportError{err}
 	}
 	defer response.Body.Close()
 	responseBody, err := ioutil.ReadAll(response.Body)
 	if err != nil {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
-		return nil, err
+		debug.Trace(debug.DumpHTTPRoundTrip(request, response))
+		return nil, response.Header, err
 	}
-	if response.StatusCode != http.StatusOK {
-		debug.Logger.Println(debug.DumpHTTPRoundTrip(request, response))
-		return responseBody, parseAMError(responseBody, response.StatusCode)
+	if response.StatusCode == http.StatusNotModified && request.Header.Get("If-None-Match") != "" {
+		return nil, response.Header, ErrNotModified
+	}
+	if response.StatusCode < http.StatusOK || response.StatusCode >= http.StatusMultipleChoices {
+		debug.Trace(debug.DumpHTTPRoundTrip(request, response))
+		return responseBody, response.Header, httpError(response, responseBody)
+	}
+	return responseBody, response.Header, err
+}
+
+// SignedRequest makes a request to the AM endpoint at the path, relative to the AM base URL, with the given session
+// token and payload. The API version of the endpoint is not set so that AM selects the latest version.
+func (c *amConnection) SignedRequest(tokenID string, method string, path string, content ContentType, payload string) (reply []byte, err error) {
+	var body io.Reader
+	if payload != "" {
+		body = strings.NewReader(payload)
+	}
+	request, err := http.NewRequest(method, c.baseURL+path, body)
+	if err != nil {
+		debug.Trace(debug.DumpHTTPRoundTrip(request, nil))
+		return nil, err
 	}
-	return responseBody, err
+	return c.makeRequest(tokenID, content, request)
 }
 
 // SetAuthenticationTree changes the authentication tree that the connection was created with.
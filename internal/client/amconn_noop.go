@@ -1,4 +1,4 @@
-// +build coap,!http
+// +build coap,!http tiny,!http
 
 /*
  * Copyright 2020 ForgeRock AS
@@ -22,6 +22,13 @@ import "errors"
 
 var errHTTPNotBuilt = errors.New("http(s) scheme is unsupported")
 
+const httpBuilt = false
+
+// APIVersions returns nil since the connection to AM is excluded from the build
+func APIVersions() map[string][]string {
+	return nil
+}
+
 func (c amConnection) Initialise() error {
 	return errHTTPNotBuilt
 }
@@ -42,6 +49,10 @@ func (c amConnection) LogoutSession(tokenID string) (err error) {
 	return errHTTPNotBuilt
 }
 
+func (c amConnection) SessionInfo(tokenID string) (reply []byte, err error) {
+	return reply, errHTTPNotBuilt
+}
+
 func (c amConnection) AccessToken(tokenID string, content ContentType, payload string) (reply []byte, err error) {
 	return reply, errHTTPNotBuilt
 }
@@ -53,3 +64,15 @@ func (c *amConnection) IntrospectAccessToken(token string) (introspection []byte
 func (c amConnection) Attributes(tokenID string, content ContentType, payload string, names []string) (reply []byte, err error) {
 	return reply, errHTTPNotBuilt
 }
+
+func (c amConnection) PolicyDecision(tokenID string, content ContentType, payload string) (reply []byte, err error) {
+	return reply, errHTTPNotBuilt
+}
+
+func (c amConnection) SignedRequest(tokenID string, method string, path string, content ContentType, payload string) (reply []byte, err error) {
+	return reply, errHTTPNotBuilt
+}
+
+func RegisterOAuth2Client(connection Connection, initialAccessToken string, metadata OAuth2ClientMetadata) (info OAuth2ClientInformation, err error) {
+	return info, errHTTPNotBuilt
+}
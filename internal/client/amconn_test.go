@@ -18,12 +18,22 @@ package client
 
 import (
 	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/clock"
 )
 
 var (
@@ -202,7 +212,7 @@ func TestAMClient_AMInfo(t *testing.T) {
 	if info.Realm != testRealm {
 		t.Error("incorrect realm")
 	}
-	if info.ThingsVersion != thingsEndpointVersion {
+	if info.ThingsVersion != thingsEndpointVersions[0] {
 		t.Error("incorrect things endpoint version")
 	}
 	if info.AccessTokenURL != client.accessTokenURL() {
@@ -211,6 +221,9 @@ func TestAMClient_AMInfo(t *testing.T) {
 	if info.AttributesURL != client.attributesURL(nil) {
 		t.Error("incorrect attributes endpoint url")
 	}
+	if info.PolicyURL != client.policyURL() {
+		t.Error("incorrect policy endpoint url")
+	}
 }
 
 func testAccessTokenHTTPMux(code int, response []byte) (mux *http.ServeMux) {
@@ -322,7 +335,7 @@ func TestAMClient_Attributes(t *testing.T) {
 }
 
 func Test_parseAMError(t *testing.T) {
-	amErr := amError{
+	amErr := AMError{
 		Message: "Boom",
 		Reason:  "Bang",
 	}
@@ -339,6 +352,7 @@ func Test_parseAMError(t *testing.T) {
 	}{
 		{name: "validAMErrorMessage", code: http.StatusInternalServerError, response: b, expected: fmt.Sprintf("%s: %s", amErr.Reason, amErr.Message)},
 		{name: "invalidAMErrorMessage", code: http.StatusInternalServerError, response: []byte("aaaa"), expected: fmt.Sprintf("request failed with status code %d", http.StatusInternalServerError)},
+		{name: "detail", code: http.StatusUnauthorized, response: []byte(`{"code":401,"reason":"Unauthorized","message":"Login failure","detail":{"failureUrl":"/retry","errorCode":"110"}}`), expected: "Unauthorized: Login failure [errorCode=110, failureUrl=/retry]"},
 	}
 	for _, subtest := range tests {
 		t.Run(subtest.name, func(t *testing.T) {
@@ -349,3 +363,647 @@ func Test_parseAMError(t *testing.T) {
 		})
 	}
 }
+
+func Test_httpError_Localised(t *testing.T) {
+	request := httptest.NewRequest(http.MethodPost, "/json/authenticate", nil)
+	request.Header.Set(TransactionIDHeader, "transaction-1")
+	response := &http.Response{
+		StatusCode: http.StatusUnauthorized,
+		Header:     http.Header{ContentLanguageHeader: {"de-CH"}},
+		Request:    request,
+	}
+	err := httpError(response, []byte(`{"code":401,"reason":"Unauthorized","message":"Anmeldung fehlgeschlagen",`+
+		`"detail":{"failureUrl":"/retry"}}`))
+	var amErr AMError
+	if !errors.As(err, &amErr) {
+		t.Fatalf("expected an AM error; got %v", err)
+	}
+	if amErr.Locale != "de-CH" || amErr.Message != "Anmeldung fehlgeschlagen" || amErr.Detail["failureUrl"] != "/retry" {
+		t.Errorf("unexpected AM error %+v", amErr)
+	}
+	if amErr.TransactionID != "transaction-1" {
+		t.Errorf("expected the transaction ID; got %s", amErr.TransactionID)
+	}
+}
+
+func TestAMError_Class(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected error
+	}{
+		{name: "unauthorised", err: parseAMError([]byte(`{"code":401,"reason":"Unauthorized","message":"Access Denied"}`), http.StatusUnauthorized), expected: ErrUnauthorised},
+		{name: "forbidden", err: parseAMError([]byte(`{"code":403,"reason":"Forbidden","message":"No"}`), http.StatusForbidden), expected: ErrForbidden},
+		{name: "bad-request", err: parseAMError([]byte("aaaa"), http.StatusBadRequest), expected: ErrPayloadInvalid},
+		{name: "unsupported-version", err: parseAMError([]byte(`{"code":400,"reason":"Bad Request","message":"Unsupported major version: 2.0"}`), http.StatusBadRequest), expected: ErrUnsupportedVersion},
+		{name: "unavailable", err: parseAMError(nil, http.StatusServiceUnavailable), expected: ErrAMUnreachable},
+		{name: "transport", err: transportError{errors.New("connection refused")}, expected: ErrAMUnreachable},
+		{name: "payload", err: invalidPayload(errors.New("unexpected end of JSON input")), expected: ErrPayloadInvalid},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			if !errors.Is(subtest.err, subtest.expected) {
+				t.Errorf("expected %v to be %v", subtest.err, subtest.expected)
+			}
+		})
+	}
+}
+
+func TestAMError_Code(t *testing.T) {
+	var amErr AMError
+	err := fmt.Errorf("request failed: %w", parseAMError([]byte(`{"code":403,"reason":"Forbidden","message":"No"}`), http.StatusForbidden))
+	if !errors.As(err, &amErr) {
+		t.Fatal("expected an AM error")
+	}
+	if amErr.Code != http.StatusForbidden {
+		t.Errorf("expected code %d, got %d", http.StatusForbidden, amErr.Code)
+	}
+}
+
+func Test_parseRetryAfter(t *testing.T) {
+	now := time.Now()
+	clock.Clock = func() time.Time {
+		return now
+	}
+	defer func() {
+		clock.Clock = clock.DefaultClock()
+	}()
+
+	tests := []struct {
+		name     string
+		value    string
+		expected time.Duration
+	}{
+		{name: "empty", value: "", expected: 0},
+		{name: "seconds", value: "120", expected: 120 * time.Second},
+		{name: "negative-seconds", value: "-1", expected: 0},
+		{name: "http-date", value: now.Add(time.Minute).UTC().Format(http.TimeFormat), expected: time.Minute - time.Duration(now.Nanosecond())},
+		{name: "past-http-date", value: now.Add(-time.Minute).UTC().Format(http.TimeFormat), expected: 0},
+		{name: "invalid", value: "soon", expected: 0},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			if delay := parseRetryAfter(subtest.value); delay != subtest.expected {
+				t.Errorf("expected %v, got %v", subtest.expected, delay)
+			}
+		})
+	}
+}
+
+func TestAMClient_Throttled(t *testing.T) {
+	mux := testServerInfoHTTPMux(http.StatusOK, testServerInfo())
+	mux.HandleFunc(testHTTPAccessTokenEndpoint, func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Retry-After", "30")
+		http.Error(writer, `{"code":429,"reason":"Too Many Requests","message":"Rate limit exceeded"}`, http.StatusTooManyRequests)
+	})
+	err := testAMClientAccessToken(mux)
+	if !errors.Is(err, ErrThrottled) {
+		t.Fatalf("expected a throttled error, got %v", err)
+	}
+	delay, ok := RetryAfter(err)
+	if !ok || delay != 30*time.Second {
+		t.Errorf("expected a delay of 30s, got %v", delay)
+	}
+}
+
+// testVersionedAccessTokenHTTPMux returns a mux that only accepts access token requests with the given version
+func testVersionedAccessTokenHTTPMux(t *testing.T, version string) (mux *http.ServeMux) {
+	mux = testServerInfoHTTPMux(http.StatusOK, testServerInfo())
+	mux.HandleFunc(testHTTPAccessTokenEndpoint, func(writer http.ResponseWriter, request *http.Request) {
+		if len(request.Cookies()) != 1 {
+			t.Errorf("expected a single session cookie, got %v", request.Cookies())
+		}
+		if request.Header.Get(acceptAPIVersion) != version {
+			http.Error(writer, `{"code":400,"reason":"Bad Request","message":"Unsupported major version: 2.0"}`,
+				http.StatusBadRequest)
+			return
+		}
+		_, _ = writer.Write([]byte("{}"))
+	})
+	return mux
+}
+
+func TestAMClient_ThingsVersionNegotiation(t *testing.T) {
+	fallback := thingsEndpointVersions[len(thingsEndpointVersions)-1]
+	tests := []struct {
+		name    string
+		content ContentType
+		version string
+		// number of attempts before the request succeeds, zero if the request never succeeds
+		attempts int
+	}{
+		{name: "json", content: ApplicationJSON, version: fallback, attempts: 1},
+		{name: "jose", content: ApplicationJOSE, version: fallback, attempts: 2},
+		{name: "preferred", content: ApplicationJOSE, version: thingsEndpointVersions[0], attempts: 1},
+		{name: "unsupported", content: ApplicationJSON, version: "protocol=3.0,resource=1.0"},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			server := httptest.NewTLSServer(testVersionedAccessTokenHTTPMux(t, subtest.version))
+			defer server.Close()
+			c := &amConnection{baseURL: server.URL, realm: testRealm}
+			testSetRootCAs(c, server)
+			if err := c.Initialise(); err != nil {
+				t.Fatal(err)
+			}
+			for attempt := 1; attempt <= len(thingsEndpointVersions); attempt++ {
+				_, err := c.AccessToken("aToken", subtest.content, "{}")
+				if err == nil {
+					if attempt != subtest.attempts {
+						t.Errorf("expected success after %d attempts, got %d", subtest.attempts, attempt)
+					}
+					break
+				}
+				if !errors.Is(err, ErrUnsupportedVersion) {
+					t.Fatalf("expected an unsupported version error, got %v", err)
+				}
+				if attempt == len(thingsEndpointVersions) && subtest.attempts != 0 {
+					t.Errorf("request did not succeed; %v", err)
+				}
+			}
+			if info, _ := c.AMInfo(); subtest.attempts != 0 && info.ThingsVersion != subtest.version {
+				t.Errorf("expected version %s, got %s", subtest.version, info.ThingsVersion)
+			}
+		})
+	}
+}
+
+func TestAMClient_SessionTokenTransport(t *testing.T) {
+	tests := []struct {
+		name           string
+		cookieOverride string
+		cookie         string
+		header         string
+	}{
+		{name: "discovered-cookie", cookie: testCookieName},
+		{name: "cookie-override", cookieOverride: "proxyCookie", cookie: "proxyCookie"},
+		{name: "header", header: "X-Session-Token"},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			mux := testServerInfoHTTPMux(http.StatusOK, testServerInfo())
+			mux.HandleFunc(testHTTPAccessTokenEndpoint, func(writer http.ResponseWriter, request *http.Request) {
+				var token string
+				if subtest.header != "" {
+					token = request.Header.Get(subtest.header)
+					if len(request.Cookies()) != 0 {
+						t.Errorf("unexpected cookies %v", request.Cookies())
+					}
+				} else if cookie, err := request.Cookie(subtest.cookie); err == nil {
+					token = cookie.Value
+				}
+				if token != "aToken" {
+					http.Error(writer, `{"code":401,"reason":"Unauthorized","message":"Access Denied"}`,
+						http.StatusUnauthorized)
+					return
+				}
+				_, _ = writer.Write([]byte("{}"))
+			})
+			server := httptest.NewTLSServer(mux)
+			defer server.Close()
+			c := &amConnection{baseURL: server.URL, cookieName: subtest.cookieOverride, sessionHeader: subtest.header}
+			testSetRootCAs(c, server)
+			if err := c.Initialise(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := c.AccessToken("aToken", ApplicationJOSE, "aSignedWT"); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestAMClient_CustomHeaders(t *testing.T) {
+	checkHeaders := func(t *testing.T, request *http.Request) {
+		if ua := request.Header.Get("User-Agent"); ua != "acme-sensor/1.2" {
+			t.Errorf("unexpected User-Agent %s", ua)
+		}
+		if tenant := request.Header.Get("X-Tenant"); tenant != "tenant-1" {
+			t.Errorf("unexpected tenant %s", tenant)
+		}
+		if version := request.Header[http.CanonicalHeaderKey(acceptAPIVersion)]; len(version) != 1 || version[0] == "custom" {
+			t.Errorf("SDK header replaced %v", version)
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/json/serverinfo/*", func(writer http.ResponseWriter, request *http.Request) {
+		checkHeaders(t, request)
+		_, _ = writer.Write(testServerInfo())
+	})
+	mux.HandleFunc(testHTTPAccessTokenEndpoint, func(writer http.ResponseWriter, request *http.Request) {
+		checkHeaders(t, request)
+		_, _ = writer.Write([]byte("{}"))
+	})
+	server := httptest.NewTLSServer(mux)
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	builder := NewConnection().ConnectTo(u).
+		WithUserAgent("acme-sensor/1.2").
+		WithHeader("X-Tenant", "tenant-1").
+		WithHeader(acceptAPIVersion, "custom")
+	c := &amConnection{baseURL: server.URL, userAgent: builder.userAgent, headers: builder.headers}
+	testSetRootCAs(c, server)
+	if err := c.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.AccessToken("aToken", ApplicationJOSE, "aSignedWT"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAMClient_SigningAlgorithms(t *testing.T) {
+	mux := testServerInfoHTTPMux(http.StatusOK, testServerInfo())
+	var server *httptest.Server
+	mux.HandleFunc("/oauth2/.well-known/openid-configuration", func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = fmt.Fprintf(writer, `{"jwks_uri":"%s/oauth2/connect/jwk_uri",
+			"request_object_signing_alg_values_supported":["ES256","ES256K"]}`, server.URL)
+	})
+	mux.HandleFunc("/oauth2/connect/jwk_uri", func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = writer.Write([]byte(`{"keys":[]}`))
+	})
+	server = httptest.NewTLSServer(mux)
+	defer server.Close()
+	c := &amConnection{baseURL: server.URL}
+	testSetRootCAs(c, server)
+	if err := c.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	info, _ := c.AMInfo()
+	if !reflect.DeepEqual(info.SigningAlgorithms, []string{"ES256", "ES256K"}) {
+		t.Errorf("unexpected signing algorithms %v", info.SigningAlgorithms)
+	}
+}
+
+func TestAMClient_SignedRequest(t *testing.T) {
+	mux := testServerInfoHTTPMux(http.StatusOK, testServerInfo())
+	mux.HandleFunc("/json/things/custom", func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := ioutil.ReadAll(request.Body)
+		if request.Method != http.MethodPut || request.URL.Query().Get("_action") != "update" ||
+			string(body) != "aSignedWT" || request.Header.Get(httpContentType) != string(ApplicationJOSE) {
+			t.Errorf("unexpected request %s %s %s", request.Method, request.URL, body)
+		}
+		writer.WriteHeader(http.StatusCreated)
+		_, _ = writer.Write([]byte(`{"updated":true}`))
+	})
+	server := httptest.NewTLSServer(mux)
+	defer server.Close()
+	c := &amConnection{baseURL: server.URL}
+	testSetRootCAs(c, server)
+	if err := c.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := c.AMInfo(); info.BaseURL != server.URL {
+		t.Errorf("expected base URL %s, got %s", server.URL, info.BaseURL)
+	}
+	reply, err := c.SignedRequest("aToken", http.MethodPut, "/json/things/custom?_action=update", ApplicationJOSE, "aSignedWT")
+	if err != nil || string(reply) != `{"updated":true}` {
+		t.Errorf("unexpected reply %s; %v", reply, err)
+	}
+	var amError AMError
+	_, err = c.SignedRequest("aToken", http.MethodGet, "/json/things/unknown", ApplicationJSON, "")
+	if !errors.As(err, &amError) || amError.Code != http.StatusNotFound {
+		t.Errorf("expected not found error, got %v", err)
+	}
+}
+
+func TestAMClient_PolicyDecision(t *testing.T) {
+	const realm = "/iot&edge"
+	payload := PolicyDecisionPayload{
+		Resources: []string{"valve-x"},
+		Subject:   &PolicySubject{SSOToken: "aToken"},
+		Actions:   []string{"open"},
+	}
+	mux := testServerInfoHTTPMux(http.StatusOK, testServerInfo())
+	mux.HandleFunc("/json/policies", func(writer http.ResponseWriter, request *http.Request) {
+		var received PolicyDecisionPayload
+		if err := json.NewDecoder(request.Body).Decode(&received); err != nil {
+			t.Error(err)
+		}
+		if request.URL.Query().Get("_action") != "evaluate" || request.URL.Query().Get(realmQueryKey) != realm ||
+			request.Header.Get(httpContentType) != string(ApplicationJSON) ||
+			request.Header.Get(acceptAPIVersion) != policiesEndpointVersion {
+			t.Errorf("unexpected request %s %v", request.URL, request.Header)
+		}
+		if !reflect.DeepEqual(received, payload) {
+			t.Errorf("expected payload %v; got %v", payload, received)
+		}
+		_, _ = writer.Write([]byte(`[{"resource":"valve-x","actions":{"open":true}}]`))
+	})
+	server := httptest.NewTLSServer(mux)
+	defer server.Close()
+	c := &amConnection{baseURL: server.URL, realm: realm}
+	testSetRootCAs(c, server)
+	if err := c.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	body, _ := json.Marshal(payload)
+	reply, err := c.PolicyDecision("aToken", ApplicationJSON, string(body))
+	if err != nil || string(reply) != `[{"resource":"valve-x","actions":{"open":true}}]` {
+		t.Errorf("unexpected reply %s; %v", reply, err)
+	}
+}
+
+func TestAMClient_TransactionID(t *testing.T) {
+	var ids []string
+	mux := testServerInfoHTTPMux(http.StatusOK, testServerInfo())
+	mux.HandleFunc(testHTTPAccessTokenEndpoint, func(writer http.ResponseWriter, request *http.Request) {
+		ids = append(ids, request.Header.Get(TransactionIDHeader))
+		http.Error(writer, `{"code":403,"reason":"Forbidden","message":"No"}`, http.StatusForbidden)
+	})
+	server := httptest.NewTLSServer(mux)
+	defer server.Close()
+	c := &amConnection{baseURL: server.URL}
+	testSetRootCAs(c, server)
+	if err := c.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+
+	var amError AMError
+	for i := 0; i < 2; i++ {
+		_, err := c.AccessToken("aToken", ApplicationJOSE, "aSignedWT")
+		if !errors.As(err, &amError) || amError.TransactionID != ids[i] {
+			t.Errorf("expected error with transaction ID %s, got %v", ids[i], err)
+		}
+	}
+	if ids[0] == "" || ids[0] == ids[1] {
+		t.Errorf("expected a unique transaction ID per request, got %v", ids)
+	}
+
+	const forwarded = "thing-transaction"
+	_, err := WithTransactionID(c, forwarded).AccessToken("aToken", ApplicationJOSE, "aSignedWT")
+	if ids[2] != forwarded || !errors.As(err, &amError) || amError.TransactionID != forwarded {
+		t.Errorf("expected transaction ID %s, got %s; %v", forwarded, ids[2], err)
+	}
+}
+
+func testRegisterOAuth2ClientHTTPMux(code int, initialAccessToken string, response []byte) (mux *http.ServeMux) {
+	mux = testServerInfoHTTPMux(http.StatusOK, testServerInfo())
+	mux.HandleFunc("/oauth2/register", func(writer http.ResponseWriter, request *http.Request) {
+		var metadata OAuth2ClientMetadata
+		if err := json.NewDecoder(request.Body).Decode(&metadata); err != nil || metadata.ClientName != "gateway" {
+			http.Error(writer, `{"error":"invalid_client_metadata"}`, http.StatusBadRequest)
+			return
+		}
+		if request.URL.Query().Get(realmQueryKey) != testRealm ||
+			request.Header.Get("Authorization") != "Bearer "+initialAccessToken {
+			http.Error(writer, `{"error":"invalid_token"}`, http.StatusUnauthorized)
+			return
+		}
+		writer.WriteHeader(code)
+		_, _ = writer.Write(response)
+	})
+	return mux
+}
+
+func TestRegisterOAuth2Client(t *testing.T) {
+	tests := []struct {
+		name       string
+		successful bool
+		serverMux  *http.ServeMux
+	}{
+		{name: "success", successful: true,
+			serverMux: testRegisterOAuth2ClientHTTPMux(http.StatusCreated, "initial", []byte(`{"client_id":"12345","client_name":"gateway"}`))},
+		{name: "wrong-initial-token", serverMux: testRegisterOAuth2ClientHTTPMux(http.StatusCreated, "other", []byte(`{"client_id":"12345"}`))},
+		{name: "no-client-id", serverMux: testRegisterOAuth2ClientHTTPMux(http.StatusCreated, "initial", []byte(`{}`))},
+		{name: "invalid-response", serverMux: testRegisterOAuth2ClientHTTPMux(http.StatusCreated, "initial", []byte(`{`))},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			server := httptest.NewTLSServer(subtest.serverMux)
+			defer server.Close()
+
+			c := &amConnection{baseURL: server.URL, realm: testRealm}
+			testSetRootCAs(c, server)
+			if err := c.Initialise(); err != nil {
+				t.Fatal(err)
+			}
+			info, err := RegisterOAuth2Client(c, "initial", OAuth2ClientMetadata{ClientName: "gateway"})
+			if subtest.successful {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info.ClientID != "12345" || info.ClientName != "gateway" {
+					t.Errorf("unexpected client information %+v", info)
+				}
+				return
+			}
+			if err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
+
+func TestAMClient_ClientCertificate(t *testing.T) {
+	var headers []string
+	mux := testServerInfoHTTPMux(http.StatusOK, testServerInfo())
+	mux.HandleFunc(testHTTPAccessTokenEndpoint, func(writer http.ResponseWriter, request *http.Request) {
+		headers = append(headers, request.Header.Get(ClientCertificateHeader))
+		writer.Write([]byte("{}"))
+	})
+	server := httptest.NewTLSServer(mux)
+	defer server.Close()
+	c := &amConnection{baseURL: server.URL}
+	testSetRootCAs(c, server)
+	if err := c.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+
+	cert := server.Certificate()
+	if _, err := WithClientCertificate(c, cert).AccessToken("aToken", ApplicationJOSE, "aSignedWT"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.AccessToken("aToken", ApplicationJOSE, "aSignedWT"); err != nil {
+		t.Fatal(err)
+	}
+	if expected := ":" + base64.StdEncoding.EncodeToString(cert.Raw) + ":"; headers[0] != expected {
+		t.Errorf("expected client certificate header %s, got %s", expected, headers[0])
+	}
+	if headers[1] != "" {
+		t.Errorf("expected the client certificate not to be forwarded by the original connection, got %s", headers[1])
+	}
+}
+
+func TestAMClient_MaxPayloadSize(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		chunked  bool
+		tooLarge bool
+	}{
+		{name: "within-limit", size: 64},
+		{name: "at-limit", size: 128},
+		{name: "content-length-exceeds-limit", size: 129, tooLarge: true},
+		{name: "chunked-within-limit", size: 64, chunked: true},
+		{name: "chunked-exceeds-limit", size: 4096, chunked: true, tooLarge: true},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			mux := testServerInfoHTTPMux(http.StatusOK, testServerInfo())
+			mux.HandleFunc(testHTTPAccessTokenEndpoint, func(writer http.ResponseWriter, request *http.Request) {
+				body := []byte(`"` + strings.Repeat("a", subtest.size-2) + `"`)
+				if subtest.chunked {
+					// flushing before the body is complete prevents the server from setting the content length
+					for _, b := range body {
+						_, _ = writer.Write([]byte{b})
+						writer.(http.Flusher).Flush()
+					}
+					return
+				}
+				_, _ = writer.Write(body)
+			})
+			server := httptest.NewTLSServer(mux)
+			defer server.Close()
+
+			c := &amConnection{
+				baseURL:    server.URL,
+				realm:      testRealm,
+				authTree:   testTree,
+				maxPayload: 128,
+			}
+			testSetRootCAs(c, server)
+			if err := c.Initialise(); err != nil {
+				t.Fatal(err)
+			}
+			reply, err := c.AccessToken("aToken", ApplicationJOSE, "aSignedWT")
+			if subtest.tooLarge {
+				if !errors.Is(err, ErrPayloadTooLarge) || errors.Is(err, ErrAMUnreachable) {
+					t.Errorf("expected a payload too large error; got %v", err)
+				}
+				return
+			}
+			if err != nil || len(reply) != subtest.size {
+				t.Errorf("expected a reply of %d bytes; got %d, %v", subtest.size, len(reply), err)
+			}
+		})
+	}
+}
+
+func TestAMClient_Liveness(t *testing.T) {
+	status := http.StatusOK
+	mux := testServerInfoHTTPMux(http.StatusOK, testServerInfo())
+	mux.HandleFunc(testHTTPAccessTokenEndpoint, func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(status)
+		_, _ = writer.Write([]byte("{}"))
+	})
+	server := httptest.NewTLSServer(mux)
+	defer server.Close()
+
+	c := &amConnection{
+		baseURL:  server.URL,
+		realm:    testRealm,
+		authTree: testTree,
+		liveness: &livenessMonitor{},
+	}
+	testSetRootCAs(c, server)
+	if err := c.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.AccessToken("aToken", ApplicationJOSE, "aSignedWT"); err != nil {
+		t.Fatal(err)
+	}
+	liveness := ConnectionLiveness(c)
+	if liveness.LastContact.IsZero() || liveness.Failures != 0 {
+		t.Fatalf("expected contact without failures; got %+v", liveness)
+	}
+	lastContact := liveness.LastContact
+
+	// a client error still proves that AM is reachable
+	status = http.StatusBadRequest
+	_, _ = c.AccessToken("aToken", ApplicationJOSE, "aSignedWT")
+	if liveness = ConnectionLiveness(c); liveness.Failures != 0 || liveness.LastContact.Before(lastContact) {
+		t.Errorf("expected a client error to count as contact; got %+v", liveness)
+	}
+
+	status = http.StatusServiceUnavailable
+	for i := 0; i < 2; i++ {
+		_, _ = c.AccessToken("aToken", ApplicationJOSE, "aSignedWT")
+	}
+	liveness = ConnectionLiveness(c)
+	if liveness.Failures != 2 || liveness.ConsecutiveFailures != 2 || liveness.LastError == "" {
+		t.Errorf("expected two consecutive failures; got %+v", liveness)
+	}
+
+	status = http.StatusOK
+	_, _ = c.AccessToken("aToken", ApplicationJOSE, "aSignedWT")
+	liveness = ConnectionLiveness(c)
+	if liveness.Failures != 2 || liveness.ConsecutiveFailures != 0 {
+		t.Errorf("expected consecutive failures to be reset; got %+v", liveness)
+	}
+}
+
+// plainCodec is a codec with a content type that AM does not accept
+type plainCodec struct {
+	jsonCodec
+}
+
+func (plainCodec) ContentType() ContentType {
+	return "text/plain"
+}
+
+func TestAMClient_Codec(t *testing.T) {
+	u, _ := url.Parse("https://am.example.com/am")
+	if _, err := newAMConnection(&ConnectionBuilder{url: u, codec: plainCodec{}}); err == nil {
+		t.Error("expected AM connections to reject codecs other than JSON")
+	}
+	if _, err := newAMConnection(&ConnectionBuilder{url: u, codec: JSONCodec}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAMClient_Initialise_AMInfoCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aminfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache := &AMInfoCache{File: filepath.Join(dir, "aminfo.json"), TTL: time.Hour}
+
+	var requests, notModified int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/json/serverinfo/*", func(writer http.ResponseWriter, request *http.Request) {
+		requests++
+		if request.Header.Get("If-None-Match") == `"1"` {
+			notModified++
+			writer.WriteHeader(http.StatusNotModified)
+			return
+		}
+		writer.Header().Set("ETag", `"1"`)
+		_, _ = writer.Write(testServerInfo())
+	})
+	server := httptest.NewTLSServer(mux)
+	defer server.Close()
+
+	initialise := func() *amConnection {
+		c := &amConnection{baseURL: server.URL, realm: testRealm, authTree: testTree, amInfoCache: cache}
+		testSetRootCAs(c, server)
+		if err := c.Initialise(); err != nil {
+			t.Fatal(err)
+		}
+		if c.cookieName != testCookieName {
+			t.Errorf("expected cookie name %s; got %s", testCookieName, c.cookieName)
+		}
+		return c
+	}
+
+	// the information is discovered and cached
+	initialise()
+	// the cached information is used until it expires
+	initialise()
+	if requests != 1 {
+		t.Errorf("expected 1 server info request; got %d", requests)
+	}
+	// expired information is revalidated
+	now := time.Now()
+	clock.Clock = func() time.Time {
+		return now.Add(2 * time.Hour)
+	}
+	defer func() {
+		clock.Clock = clock.DefaultClock()
+	}()
+	initialise()
+	if requests != 2 || notModified != 1 {
+		t.Errorf("expected the information to be revalidated; got %d requests", requests)
+	}
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/clock"
+	"github.com/JacoJooste/iot-edge/v7/internal/debug"
+	"github.com/JacoJooste/iot-edge/v7/internal/storage"
+)
+
+// AMInfoCache stores the information discovered from AM in a file so that a connection that is created again, for
+// example when the Thing Gateway restarts, does not have to discover it. The information is used until the TTL
+// expires, after which it is revalidated with AM with the ETag of the server information.
+type AMInfoCache struct {
+	File string
+	TTL  time.Duration
+}
+
+// cachedAMInfo is the content of the cache file
+type cachedAMInfo struct {
+	AMInfo
+	// Source identifies the URL and realm with which the information was discovered
+	Source  string
+	ETag    string `json:",omitempty"`
+	Expires time.Time
+}
+
+// fresh returns true if the information has not expired
+func (c cachedAMInfo) fresh() bool {
+	return clock.Clock().Before(c.Expires)
+}
+
+// load returns the cached information if it was discovered from the source
+func (c *AMInfoCache) load(source string) (cached cachedAMInfo, ok bool) {
+	b, err := ioutil.ReadFile(c.File)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			debug.Errorf("unable to read AM info cache %s: %v", c.File, err)
+		}
+		return cached, false
+	}
+	if err = json.Unmarshal(b, &cached); err != nil {
+		debug.Errorf("unable to read AM info cache %s: %v", c.File, err)
+		return cached, false
+	}
+	if cached.Source != source {
+		return cachedAMInfo{}, false
+	}
+	return cached, true
+}
+
+// store writes the information to the cache file. Failures are not returned since the information can be discovered
+// again.
+func (c *AMInfoCache) store(cached cachedAMInfo) {
+	cached.Expires = clock.Clock().Add(c.TTL)
+	b, err := json.Marshal(cached)
+	if err == nil {
+		err = storage.WritePrivateFile(c.File, b)
+	}
+	if err != nil {
+		debug.Errorf("unable to write AM info cache %s: %v", c.File, err)
+	}
+}
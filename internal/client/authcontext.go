@@ -0,0 +1,176 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/go-ocf/go-coap"
+)
+
+// Authentication context
+// A thing can send its locale and named context values, such as its firmware channel or the type of its companion
+// app, with its authentication requests so that the nodes of the AM authentication tree can localise the messages in
+// their callbacks or branch on the context of the device. The locale is sent to AM in the Accept-Language header and
+// each context value in a header named with the AuthContextHeaderPrefix, so that a thing can not override the other
+// headers of the request. A thing connected to the Thing Gateway sends the same information in the LocaleOption and
+// AuthContextOption CoAP options, which the gateway forwards to AM. AM errors that are returned with a localised
+// message record the language of the message in AMError.Locale.
+
+const (
+	// AcceptLanguageHeader is the HTTP header in which the locale of a thing is sent to AM
+	AcceptLanguageHeader = "Accept-Language"
+	// ContentLanguageHeader is the HTTP header in which AM returns the language of a localised error message
+	ContentLanguageHeader = "Content-Language"
+	// AuthContextHeaderPrefix is the prefix of the HTTP headers in which the context values of a thing are sent to AM
+	AuthContextHeaderPrefix = "X-Thing-Context-"
+)
+
+// LocaleOption and AuthContextOption are the CoAP options in which a thing sends its locale and its context values,
+// in the form 'name=value', to the Thing Gateway with authentication requests. The option numbers are from the
+// experimental range and are elective. The context option may be repeated.
+const (
+	LocaleOption      coap.OptionID = 65020
+	AuthContextOption coap.OptionID = 65024
+)
+
+// AuthContext is the context that a thing sends with its authentication requests
+type AuthContext struct {
+	// Locale is a BCP 47 language tag, or an Accept-Language list, for example "de-CH"
+	Locale string
+	// Values are named context values, for example "channel": "beta"
+	Values map[string]string
+}
+
+// empty returns true if the context contains neither a locale nor values
+func (a AuthContext) empty() bool {
+	return a.Locale == "" && len(a.Values) == 0
+}
+
+// names returns the sorted names of the context values
+func (a AuthContext) names() []string {
+	names := make([]string, 0, len(a.Values))
+	for name := range a.Values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// setHeaders adds the context to the authentication request
+func (a AuthContext) setHeaders(request *http.Request) {
+	if a.Locale != "" {
+		request.Header.Set(AcceptLanguageHeader, a.Locale)
+	}
+	for name, value := range a.Values {
+		request.Header.Set(AuthContextHeaderPrefix+name, value)
+	}
+}
+
+// setOptions adds the context to the CoAP authentication request
+func (a AuthContext) setOptions(request coap.Message) {
+	if a.Locale != "" {
+		request.SetOption(LocaleOption, []byte(a.Locale))
+	}
+	for _, name := range a.names() {
+		request.AddOption(AuthContextOption, []byte(name+"="+a.Values[name]))
+	}
+}
+
+// ValidateAuthContext checks that the locale and the context values can be sent in HTTP headers. Context names may
+// only contain letters, digits and hyphens.
+func ValidateAuthContext(context AuthContext) error {
+	if strings.ContainsAny(context.Locale, "\r\n") {
+		return fmt.Errorf("invalid locale %q", context.Locale)
+	}
+	for _, name := range context.names() {
+		if !validContextName(name) {
+			return fmt.Errorf("invalid context name %q, only letters, digits and hyphens are allowed", name)
+		}
+		if strings.ContainsAny(context.Values[name], "\r\n") {
+			return fmt.Errorf("invalid value for context %s", name)
+		}
+	}
+	return nil
+}
+
+// validContextName returns true if the name is not empty and only contains letters, digits and hyphens
+func validContextName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// WithAuthContext returns a connection that sends the context with its authentication requests, to AM in HTTP
+// headers and to the Thing Gateway in CoAP options. The returned connection shares the state of the given connection.
+// Connections over registered transports are returned unchanged.
+func WithAuthContext(connection Connection, context AuthContext) Connection {
+	if context.empty() {
+		return connection
+	}
+	switch c := connection.(type) {
+	case *amConnection:
+		contextual := *c
+		contextual.authContext = context
+		return &contextual
+	case *gatewayConnection:
+		contextual := *c
+		contextual.authContext = context
+		// the session is closed when the connection that created it is freed, so it must outlive this connection
+		if contextual.owner == nil {
+			contextual.owner = c
+		}
+		return &contextual
+	}
+	return connection
+}
+
+// ForwardedAuthContext returns the context that a thing sent with the CoAP message. Malformed context values are
+// ignored.
+func ForwardedAuthContext(message coap.Message) AuthContext {
+	var context AuthContext
+	if locale, ok := message.Option(LocaleOption).([]byte); ok {
+		context.Locale = string(locale)
+	}
+	for _, option := range message.Options(AuthContextOption) {
+		value, ok := option.([]byte)
+		if !ok {
+			continue
+		}
+		i := strings.Index(string(value), "=")
+		if i < 1 {
+			continue
+		}
+		if context.Values == nil {
+			context.Values = make(map[string]string)
+		}
+		context.Values[string(value[:i])] = string(value[i+1:])
+	}
+	if ValidateAuthContext(context) != nil {
+		return AuthContext{}
+	}
+	return context
+}
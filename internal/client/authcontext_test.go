@@ -0,0 +1,92 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/go-ocf/go-coap"
+)
+
+func TestValidateAuthContext(t *testing.T) {
+	tests := []struct {
+		name    string
+		context AuthContext
+		valid   bool
+	}{
+		{name: "empty", valid: true},
+		{name: "locale-and-values", context: AuthContext{Locale: "de-CH, en;q=0.8",
+			Values: map[string]string{"Channel": "beta", "App-Type": "android"}}, valid: true},
+		{name: "locale-newline", context: AuthContext{Locale: "de\r\nCookie: x"}},
+		{name: "empty-name", context: AuthContext{Values: map[string]string{"": "beta"}}},
+		{name: "name-with-space", context: AuthContext{Values: map[string]string{"app type": "android"}}},
+		{name: "value-newline", context: AuthContext{Values: map[string]string{"Channel": "beta\nX: y"}}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			if err := ValidateAuthContext(subtest.context); (err == nil) != subtest.valid {
+				t.Errorf("expected valid %v; got %v", subtest.valid, err)
+			}
+		})
+	}
+}
+
+func TestAMClient_AuthContext(t *testing.T) {
+	var header http.Header
+	mux := testAuthHTTPMux(http.StatusOK, []byte(`{"tokenId":"12345"}`))
+	server := httptest.NewTLSServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		header = request.Header
+		mux.ServeHTTP(writer, request)
+	}))
+	defer server.Close()
+	c := &amConnection{baseURL: server.URL, realm: testRealm, authTree: testTree}
+	testSetRootCAs(c, server)
+	if err := c.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	context := AuthContext{Locale: "de-CH", Values: map[string]string{"Channel": "beta"}}
+	if _, err := WithAuthContext(c, context).Authenticate(AuthenticatePayload{}); err != nil {
+		t.Fatal(err)
+	}
+	if locale := header.Get(AcceptLanguageHeader); locale != "de-CH" {
+		t.Errorf("expected the locale of the thing; got %s", locale)
+	}
+	if channel := header.Get(AuthContextHeaderPrefix + "Channel"); channel != "beta" {
+		t.Errorf("expected the context of the thing; got %s", channel)
+	}
+	if WithAuthContext(c, AuthContext{}) != Connection(c) {
+		t.Error("expected the connection to be unchanged without a context")
+	}
+}
+
+func TestForwardedAuthContext(t *testing.T) {
+	context := AuthContext{Locale: "de-CH", Values: map[string]string{"Channel": "beta", "App-Type": "android"}}
+	request := coap.NewDgramMessage(coap.MessageParams{})
+	context.setOptions(request)
+	if forwarded := ForwardedAuthContext(request); !reflect.DeepEqual(forwarded, context) {
+		t.Errorf("expected %v; got %v", context, forwarded)
+	}
+
+	// a malformed context is not forwarded
+	request.AddOption(AuthContextOption, []byte("app type=android"))
+	if forwarded := ForwardedAuthContext(request); !reflect.DeepEqual(forwarded, AuthContext{}) {
+		t.Errorf("unexpected forwarded context %v", forwarded)
+	}
+}
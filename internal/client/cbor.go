@@ -0,0 +1,45 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import "github.com/JacoJooste/iot-edge/v7/internal/cbor"
+
+// CBOR codec
+// The CBOR codec (RFC 8949) encodes structured payloads more compactly than JSON for things on low-bandwidth links.
+// Payloads are encoded in the JSON data model with the json tags of the payload types, see package cbor, so that the
+// Thing Gateway can forward them to AM as JSON.
+
+type cborCodec struct{}
+
+func (cborCodec) ContentType() ContentType {
+	return ApplicationCBOR
+}
+
+func (cborCodec) ContentFormat() uint16 {
+	return coapFormatCBOR
+}
+
+func (cborCodec) Marshal(v interface{}) ([]byte, error) {
+	return cbor.Marshal(v)
+}
+
+func (cborCodec) Unmarshal(data []byte, v interface{}) error {
+	return cbor.Unmarshal(data, v)
+}
+
+// CBORCodec encodes payloads as CBOR, which is accepted by the Thing Gateway but not by AM
+var CBORCodec Codec = cborCodec{}
@@ -0,0 +1,48 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+)
+
+// Client certificates
+// A Thing Gateway that verifies the certificates of things during the handshake forwards the verified certificate to
+// AM in the Client-Cert header defined in RFC 9440, in the same way as a TLS terminating proxy. An authentication tree
+// can then use the certificate, for example with a node that collects the certificate from the header.
+
+// ClientCertificateHeader is the HTTP header in which a verified client certificate is forwarded to AM
+const ClientCertificateHeader = "Client-Cert"
+
+// clientCertificateValue encodes the certificate as a structured field byte sequence
+func clientCertificateValue(cert *x509.Certificate) string {
+	return ":" + base64.StdEncoding.EncodeToString(cert.Raw) + ":"
+}
+
+// WithClientCertificate returns a connection that forwards the verified client certificate of a thing to AM with all
+// its requests. The returned connection shares the state of the given connection. Connections to the Thing Gateway
+// are returned unchanged.
+func WithClientCertificate(connection Connection, cert *x509.Certificate) Connection {
+	c, ok := connection.(*amConnection)
+	if !ok || cert == nil {
+		return connection
+	}
+	forwarding := *c
+	forwarding.clientCertificate = cert
+	return &forwarding
+}
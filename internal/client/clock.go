@@ -0,0 +1,109 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/clock"
+)
+
+// Clock discipline
+// Devices without a battery backed real-time clock boot with their clock at the epoch and AM rejects the JWTs that
+// they sign until the clock is set, since the JWTs appear to have expired decades ago. A Clock estimates the offset of
+// the device clock from the clock of AM, or of the Thing Gateway, and applies it to the times with which the JWTs are
+// issued. The server is assumed to have read its clock halfway through the round trip of a time request. AM reports
+// its time in the Date header of its responses, which has a resolution of one second, and the Thing Gateway reports
+// its time in milliseconds at RouteTime.
+
+// RouteTime is the route at which the Thing Gateway reports its time
+const RouteTime = "/time"
+
+// TimePayload contains the time of the Thing Gateway, in milliseconds since the epoch
+type TimePayload struct {
+	Time int64 `json:"time"`
+}
+
+// errServerTimeUnsupported is returned when the time of the server can not be requested over the connection
+var errServerTimeUnsupported = errors.New("the connection does not report the time of the server")
+
+// serverTimer is implemented by connections that can request the time of the server. The server time is returned
+// together with its resolution.
+type serverTimer interface {
+	ServerTime() (server time.Time, resolution time.Duration, err error)
+}
+
+// Clock corrects the time of the device with the offset from the time of the server. A nil Clock reports the time of
+// the device.
+type Clock struct {
+	mutex        sync.RWMutex
+	offset       time.Duration
+	synchronised bool
+}
+
+// Now returns the time of the device corrected with the estimated offset
+func (c *Clock) Now() time.Time {
+	if c == nil {
+		return clock.Clock()
+	}
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return clock.Clock().Add(c.offset)
+}
+
+// Offset returns the estimated offset of the server clock from the device clock, false if the clock has not been
+// synchronised
+func (c *Clock) Offset() (time.Duration, bool) {
+	if c == nil {
+		return 0, false
+	}
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.offset, c.synchronised
+}
+
+// Synchronise estimates the offset of the device clock from the clock of the server at the end of the connection
+func (c *Clock) Synchronise(connection Connection) error {
+	timer, ok := connection.(serverTimer)
+	if !ok {
+		return errServerTimeUnsupported
+	}
+	sent := clock.Clock()
+	server, resolution, err := timer.ServerTime()
+	if err != nil {
+		return err
+	}
+	c.observe(server, resolution, sent, clock.Clock())
+	return nil
+}
+
+// observe updates the offset from the server time read during the round trip between sent and received. A server time
+// with a coarse resolution is truncated, so the middle of its resolution is taken as the time of the server. The offset
+// is only changed if it is out by more than the uncertainty of the estimate so that it does not jitter.
+func (c *Clock) observe(server time.Time, resolution time.Duration, sent, received time.Time) {
+	roundTrip := received.Sub(sent)
+	offset := server.Add(resolution / 2).Sub(sent.Add(roundTrip / 2))
+	uncertainty := resolution/2 + roundTrip/2
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if difference := offset - c.offset; !c.synchronised || difference > uncertainty || -difference > uncertainty {
+		c.offset = offset
+	}
+	c.synchronised = true
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/clock"
+)
+
+func TestClock_observe(t *testing.T) {
+	device := time.Unix(0, 0)
+	server := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	offset := server.Sub(device)
+	tests := []struct {
+		name       string
+		previous   time.Duration
+		server     time.Time
+		resolution time.Duration
+		roundTrip  time.Duration
+		expected   time.Duration
+	}{
+		{name: "first", server: server, expected: offset},
+		{name: "round-trip", server: server.Add(time.Second), roundTrip: 2 * time.Second, expected: offset},
+		{name: "resolution", server: server, resolution: time.Second, expected: offset + 500*time.Millisecond},
+		{name: "within-uncertainty", previous: offset + 400*time.Millisecond, server: server,
+			resolution: time.Second, expected: offset + 400*time.Millisecond},
+		{name: "outside-uncertainty", previous: offset + 2*time.Second, server: server, resolution: time.Second,
+			expected: offset + 500*time.Millisecond},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			c := &Clock{}
+			if subtest.previous != 0 {
+				c.offset, c.synchronised = subtest.previous, true
+			}
+			c.observe(subtest.server, subtest.resolution, device, device.Add(subtest.roundTrip))
+			if offset, ok := c.Offset(); !ok || offset != subtest.expected {
+				t.Errorf("expected offset %v; got %v %v", subtest.expected, offset, ok)
+			}
+		})
+	}
+}
+
+func TestClock_Now(t *testing.T) {
+	defer func() {
+		clock.Clock = clock.DefaultClock()
+	}()
+	device := time.Unix(100, 0)
+	clock.Clock = func() time.Time {
+		return device
+	}
+	var unset *Clock
+	if unset.Now() != device {
+		t.Errorf("expected a nil clock to report the device time; got %v", unset.Now())
+	}
+	c := &Clock{}
+	c.observe(device.Add(time.Hour), 0, device, device)
+	if c.Now() != device.Add(time.Hour) {
+		t.Errorf("expected the corrected time %v; got %v", device.Add(time.Hour), c.Now())
+	}
+}
+
+func TestClock_Synchronise(t *testing.T) {
+	server := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/json/serverinfo/*", func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Date", server.Format(http.TimeFormat))
+		writer.WriteHeader(http.StatusUnauthorized)
+	})
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	c := &Clock{}
+	if err := c.Synchronise(&amConnection{baseURL: httpServer.URL, Client: http.Client{}}); err != nil {
+		t.Fatal(err)
+	}
+	offset, ok := c.Offset()
+	if expected := 24 * time.Hour; !ok || offset < expected-2*time.Second || offset > expected+2*time.Second {
+		t.Errorf("expected an offset of about %v; got %v %v", expected, offset, ok)
+	}
+	if err := (&Clock{}).Synchronise(nil); err != errServerTimeUnsupported {
+		t.Errorf("expected %v; got %v", errServerTimeUnsupported, err)
+	}
+}
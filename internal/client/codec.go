@@ -0,0 +1,113 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Payload codecs
+// The structured payloads that a thing exchanges with the Thing Gateway, such as authentication payloads and the
+// wrapped payloads of thing endpoint requests, are encoded with a codec so that other encodings can be tried on the
+// link between things and the gateway without rewriting each request. A codec is identified by its content type and,
+// on CoAP links, by its Content-Format number. The gateway decodes a request with the codec registered for the
+// Content-Format of the request and encodes its reply with the same codec; requests without a Content-Format and
+// replies that the gateway forwards from AM unchanged, such as attributes, are JSON.
+// AM only accepts JSON, so connections to AM and the requests that the gateway makes to AM always use JSONCodec.
+
+// Codec encodes and decodes structured payloads
+type Codec interface {
+	// ContentType of the encoded payloads
+	ContentType() ContentType
+	// ContentFormat is the CoAP Content-Format number of the encoded payloads
+	ContentFormat() uint16
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// CoAP Content-Format numbers of JSON, CBOR and of signed JWTs, the latter two are reserved for signed thing endpoint
+// requests in compact serialisation and with a detached payload
+const (
+	coapFormatJSON         = 50
+	coapFormatCBOR         = 60
+	coapFormatJOSE         = 11650
+	coapFormatDetachedJOSE = 11651
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() ContentType {
+	return ApplicationJSON
+}
+
+func (jsonCodec) ContentFormat() uint16 {
+	return coapFormatJSON
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// JSONCodec encodes payloads as JSON. It is the default codec and the only codec accepted by AM.
+var JSONCodec Codec = jsonCodec{}
+
+var codecs = struct {
+	sync.RWMutex
+	byFormat map[uint16]Codec
+}{byFormat: map[uint16]Codec{coapFormatJSON: JSONCodec, coapFormatCBOR: CBORCodec}}
+
+// RegisterCodec makes the codec available to connections and the Thing Gateway. Only one codec can be registered for
+// each Content-Format.
+func RegisterCodec(codec Codec) error {
+	if format := codec.ContentFormat(); format == coapFormatJOSE || format == coapFormatDetachedJOSE {
+		return fmt.Errorf("content format %d is reserved for signed requests", format)
+	}
+	codecs.Lock()
+	defer codecs.Unlock()
+	if _, ok := codecs.byFormat[codec.ContentFormat()]; ok {
+		return fmt.Errorf("a codec is already registered for content format %d", codec.ContentFormat())
+	}
+	codecs.byFormat[codec.ContentFormat()] = codec
+	return nil
+}
+
+// ContentTypes returns the content types of the registered codecs
+func ContentTypes() []string {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	types := make([]string, 0, len(codecs.byFormat))
+	for _, codec := range codecs.byFormat {
+		types = append(types, string(codec.ContentType()))
+	}
+	sort.Strings(types)
+	return types
+}
+
+// CodecForFormat returns the codec registered for the CoAP Content-Format
+func CodecForFormat(format uint16) (Codec, bool) {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	codec, ok := codecs.byFormat[format]
+	return codec, ok
+}
@@ -0,0 +1,63 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+)
+
+// Conditional attribute reads
+// Things that poll their configuration mostly find that nothing has changed. A conditional attribute request carries
+// the revision of the attributes that the thing already has and the server replies without the attributes if they
+// have not changed. The revision of a connection to AM is the ETag of the attributes resource, sent in an
+// If-None-Match header, and the revision of a connection to the Thing Gateway is the ETag of its attributes response,
+// sent in a CoAP ETag option. Other connections compare a revision derived from the content of the attributes.
+
+// ErrNotModified is returned by a conditional request when the resource has not changed since the given revision
+var ErrNotModified = errors.New("not modified")
+
+// conditionalAttributer is implemented by connections that make conditional attribute requests
+type conditionalAttributer interface {
+	ConditionalAttributes(tokenID string, content ContentType, payload string, names []string,
+		revision string) (reply []byte, next string, err error)
+}
+
+// contentRevision returns a revision derived from the content of a reply
+func contentRevision(reply []byte) string {
+	sum := sha256.Sum256(reply)
+	return hex.EncodeToString(sum[:8])
+}
+
+// ConditionalAttributes makes a thing attributes request that returns ErrNotModified if the attributes have not
+// changed since the given revision. Otherwise, the reply is returned together with its revision. An empty revision
+// always returns the attributes.
+func ConditionalAttributes(connection Connection, tokenID string, content ContentType, payload string, names []string,
+	revision string) (reply []byte, next string, err error) {
+	if c, ok := connection.(conditionalAttributer); ok {
+		return c.ConditionalAttributes(tokenID, content, payload, names, revision)
+	}
+	if reply, err = connection.Attributes(tokenID, content, payload, names); err != nil {
+		return reply, revision, err
+	}
+	next = contentRevision(reply)
+	if revision != "" && next == revision {
+		return nil, revision, ErrNotModified
+	}
+	return reply, next, nil
+}
@@ -21,12 +21,20 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/JacoJooste/iot-edge/v7/internal/debug"
+	"github.com/JacoJooste/iot-edge/v7/internal/oscore"
+	"github.com/JacoJooste/iot-edge/v7/pkg/transport"
 	"github.com/go-ocf/go-coap"
 	"gopkg.in/square/go-jose.v2"
 )
@@ -36,9 +44,160 @@ type ContentType string
 const (
 	ApplicationJSON ContentType = "application/json"
 	ApplicationJOSE ContentType = "application/jose"
+	ApplicationCBOR ContentType = "application/cbor"
 )
 
-var ErrUnauthorised = errors.New("unauthorised")
+// Errors that describe the class of a failed request. Use errors.Is to test whether an error belongs to a class.
+var (
+	// ErrUnauthorised is returned when AM rejects the credentials or session of the thing
+	ErrUnauthorised = errors.New("unauthorised")
+	// ErrForbidden is returned when the thing is authenticated but not allowed to perform the request
+	ErrForbidden = errors.New("forbidden")
+	// ErrAMUnreachable is returned when AM, or the gateway acting on behalf of AM, can not be reached
+	ErrAMUnreachable = errors.New("AM unreachable")
+	// ErrPayloadInvalid is returned when a request or response payload is malformed
+	ErrPayloadInvalid = errors.New("invalid payload")
+	// ErrThrottled is returned when AM rejects the request because too many requests have been made
+	ErrThrottled = errors.New("throttled")
+	// ErrUnsupportedVersion is returned when AM does not support the requested version of an endpoint
+	ErrUnsupportedVersion = errors.New("unsupported API version")
+	// ErrUnsupportedContent is returned when the gateway does not accept the format of the request or can not respond
+	// in an acceptable format
+	ErrUnsupportedContent = errors.New("unsupported content format")
+	// ErrPayloadTooLarge is returned when a payload exceeds the size limit of the connection or of the gateway
+	ErrPayloadTooLarge = errors.New("payload too large")
+)
+
+// AMError contains the error information returned by AM for a failed request
+type AMError struct {
+	Code    int    `json:"code"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+	// Detail contains additional information about the error, if AM provided any, for example the failure URL of an
+	// authentication tree or the errors of a policy evaluation
+	Detail map[string]interface{} `json:"detail,omitempty"`
+	// Locale is the language of the message, if AM localised it for the locale of the thing, see AuthContext
+	Locale string `json:"locale,omitempty"`
+	// RetryAfter is the delay requested by AM before the request may be repeated
+	RetryAfter time.Duration `json:"retryAfter,omitempty"`
+	// TransactionID identifies the failed request in the AM audit logs
+	TransactionID string `json:"transactionId,omitempty"`
+}
+
+func (e AMError) Error() string {
+	msg := e.Message
+	if e.Reason != "" {
+		msg = fmt.Sprintf("%s: %s", e.Reason, e.Message)
+	}
+	if len(e.Detail) > 0 {
+		names := make([]string, 0, len(e.Detail))
+		for name := range e.Detail {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		details := make([]string, 0, len(names))
+		for _, name := range names {
+			details = append(details, fmt.Sprintf("%s=%v", name, e.Detail[name]))
+		}
+		msg += fmt.Sprintf(" [%s]", strings.Join(details, ", "))
+	}
+	if e.TransactionID != "" {
+		msg += fmt.Sprintf(" (transaction ID: %s)", e.TransactionID)
+	}
+	return msg
+}
+
+// Unwrap returns the class of the error as determined by the error code
+func (e AMError) Unwrap() error {
+	if e.unsupportedVersion() {
+		return ErrUnsupportedVersion
+	}
+	return errorClass(e.Code)
+}
+
+// unsupportedVersion returns true if AM rejected the request because it does not support the requested API version
+func (e AMError) unsupportedVersion() bool {
+	return (e.Code == http.StatusBadRequest || e.Code == http.StatusNotFound) &&
+		strings.Contains(strings.ToLower(e.Message), "version")
+}
+
+// errorClass returns the class of error that corresponds to the HTTP status code
+func errorClass(status int) error {
+	switch status {
+	case http.StatusUnauthorized:
+		return ErrUnauthorised
+	case http.StatusForbidden:
+		return ErrForbidden
+	case http.StatusBadRequest:
+		return ErrPayloadInvalid
+	case http.StatusTooManyRequests:
+		return ErrThrottled
+	case http.StatusRequestEntityTooLarge:
+		return ErrPayloadTooLarge
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return ErrAMUnreachable
+	}
+	return nil
+}
+
+// parseAMError returns an AMError from the response body of a failed request
+// If the body does not contain an AM error then the error is constructed from the status code
+func parseAMError(response []byte, status int) error {
+	var amError AMError
+	if err := json.Unmarshal(response, &amError); err != nil || (amError.Reason == "" && amError.Message == "") {
+		return AMError{Code: status, Message: fmt.Sprintf("request failed with status code %d", status)}
+	}
+	if amError.Code == 0 {
+		amError.Code = status
+	}
+	return amError
+}
+
+// RetryAfter returns the delay requested by AM before a throttled request may be repeated
+// Returns false if the error is not the result of throttling or if AM did not request a delay.
+func RetryAfter(err error) (time.Duration, bool) {
+	var amError AMError
+	if !errors.As(err, &amError) || amError.RetryAfter <= 0 {
+		return 0, false
+	}
+	if amError.Code != http.StatusTooManyRequests && amError.Code != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	return amError.RetryAfter, true
+}
+
+var errOSCOREUnsupported = errors.New("OSCORE is only supported by connections to the Thing Gateway")
+
+// ErrAttributePagesUnsupported is returned when attributes are requested in pages over a connection that can only
+// return all the attributes at once
+var ErrAttributePagesUnsupported = errors.New("attribute pages are only supported by connections to the Thing Gateway")
+
+var errLocalTokenUnsupported = errors.New("local tokens are only issued by the Thing Gateway")
+
+var errSubscriptionUnsupported = errors.New("attribute subscriptions are only supported by connections to the Thing Gateway without OSCORE")
+
+// transportError wraps an error that occurred while communicating with AM or the gateway
+type transportError struct {
+	err error
+}
+
+func (e transportError) Error() string {
+	return e.err.Error()
+}
+
+func (e transportError) Is(target error) bool {
+	// a response that exceeds the payload limit was received so AM is reachable
+	return target == ErrAMUnreachable && !errors.Is(e.err, ErrPayloadTooLarge)
+}
+
+func (e transportError) Unwrap() error {
+	return e.err
+}
+
+// invalidPayload wraps an error that occurred while decoding a payload
+func invalidPayload(err error) error {
+	return fmt.Errorf("%w: %s", ErrPayloadInvalid, err)
+}
 
 // connection to the ForgeRock platform
 type Connection interface {
@@ -57,6 +216,9 @@ type Connection interface {
 	// logoutSession makes a request to logout the session
 	LogoutSession(tokenID string) (err error)
 
+	// SessionInfo makes a request for the information held by AM about the session, such as its expiry times
+	SessionInfo(tokenID string) (reply []byte, err error)
+
 	// accessToken makes an access token request with the given session token and payload
 	AccessToken(tokenID string, content ContentType, payload string) (reply []byte, err error)
 
@@ -65,14 +227,81 @@ type Connection interface {
 
 	// attributes makes a thing attributes request with the given session token and payload
 	Attributes(tokenID string, content ContentType, payload string, names []string) (reply []byte, err error)
+
+	// policyDecision makes a policy evaluation request with the given session token and payload
+	PolicyDecision(tokenID string, content ContentType, payload string) (reply []byte, err error)
+
+	// SignedRequest makes a request to the AM endpoint at the path, relative to the AM base URL, with the given
+	// session token and payload
+	SignedRequest(tokenID string, method string, path string, content ContentType, payload string) (reply []byte, err error)
+}
+
+// DefaultBlockSize is the size in bytes of the blocks used to transfer large CoAP payloads, see RFC 7959
+const DefaultBlockSize = 1024
+
+// BlockWiseSzx returns the CoAP block size exponent (SZX) for the given block size in bytes.
+// The size must be a power of two between 16 and 1024.
+func BlockWiseSzx(size int) (coap.BlockWiseSzx, error) {
+	for szx := coap.BlockWiseSzx16; szx <= coap.BlockWiseSzx1024; szx++ {
+		if size == 1<<(szx+4) {
+			return szx, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid block size %d, must be a power of two between 16 and 1024", size)
+}
+
+// coapNetwork returns the CoAP network for the URL scheme
+// CoAP over TCP and TLS are defined in RFC 8323, otherwise CoAP over DTLS is used
+func coapNetwork(scheme string) string {
+	switch scheme {
+	case "coaps+tcp":
+		return "tcp-tls"
+	case "coap+tcp":
+		return "tcp"
+	default:
+		return "udp-dtls"
+	}
 }
 
 type ConnectionBuilder struct {
-	url     *url.URL
-	realm   string
-	tree    string
-	key     crypto.Signer
-	timeout time.Duration
+	url       *url.URL
+	realm     string
+	tree      string
+	key       crypto.Signer
+	timeout   time.Duration
+	blockSize int
+	keepAlive time.Duration
+	// minBackoff and maxBackoff bound the delay between attempts to reconnect to the Thing Gateway
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	// maxPayload is the maximum size of a payload read by the connection
+	maxPayload int
+	// codec of the structured payloads sent to the Thing Gateway
+	codec Codec
+	// certificates presented to the Thing Gateway during the handshake
+	certificates []*x509.Certificate
+	// session token transport
+	sessionCookie string
+	sessionHeader string
+	// identification and static headers added to AM requests
+	userAgent string
+	headers   http.Header
+	// priorities of concurrent requests to AM
+	priorities RequestPriorities
+	// linkMetadata provides the metadata about the link sent to the Thing Gateway
+	linkMetadata func() string
+	// amInfo replaces the information that is otherwise discovered from AM or the Thing Gateway
+	amInfo *AMInfo
+	// amInfoCache stores the information discovered from AM between connections
+	amInfoCache *AMInfoCache
+	// tlsProfile restricts the security parameters of the transport to the Thing Gateway
+	tlsProfile TLSProfile
+	// trust decides which certificates of the Thing Gateway are trusted
+	trust GatewayTrust
+	// roundTripper makes the HTTP requests to AM, the default transport is used if nil
+	roundTripper http.RoundTripper
+	// detachedPayload sends signed requests to the Thing Gateway with a detached payload
+	detachedPayload bool
 }
 
 func NewConnection() *ConnectionBuilder {
@@ -104,44 +333,330 @@ func (b *ConnectionBuilder) TimeoutRequestAfter(timeout time.Duration) *Connecti
 	return b
 }
 
+// WithBlockSize sets the block size used for block-wise transfers with the Thing Gateway
+func (b *ConnectionBuilder) WithBlockSize(size int) *ConnectionBuilder {
+	b.blockSize = size
+	return b
+}
+
+// WithMaxPayloadSize sets the maximum size in bytes of a payload read by the connection, DefaultMaxPayloadSize is used
+// if the size is zero
+func (b *ConnectionBuilder) WithMaxPayloadSize(size int) *ConnectionBuilder {
+	b.maxPayload = size
+	return b
+}
+
+// WithCodec sets the codec with which structured payloads are exchanged with the Thing Gateway, JSONCodec is used by
+// default. Connections to AM only accept JSONCodec.
+func (b *ConnectionBuilder) WithCodec(codec Codec) *ConnectionBuilder {
+	b.codec = codec
+	return b
+}
+
+// WithKeepAlive sets the interval at which the connection with the Thing Gateway is checked with a CoAP ping. The
+// connection is re-established in the background if the gateway does not respond.
+func (b *ConnectionBuilder) WithKeepAlive(interval time.Duration) *ConnectionBuilder {
+	b.keepAlive = interval
+	return b
+}
+
+// WithReconnectBackoff bounds the delay between the attempts to re-establish the connection with the Thing Gateway when
+// keep-alive is enabled. The delay starts at min and doubles after every failed attempt up to max. The defaults are
+// used for bounds that are zero.
+func (b *ConnectionBuilder) WithReconnectBackoff(min, max time.Duration) *ConnectionBuilder {
+	b.minBackoff = min
+	b.maxBackoff = max
+	return b
+}
+
+// WithCertificate presents the certificate chain to the Thing Gateway during the handshake instead of a self-signed
+// certificate. The first certificate must contain the public key of the connection key.
+func (b *ConnectionBuilder) WithCertificate(certificates []*x509.Certificate) *ConnectionBuilder {
+	b.certificates = certificates
+	return b
+}
+
+// WithSessionCookieName overrides the name of the session cookie that is discovered from AM, for deployments where a
+// proxy in front of AM renames the cookie
+func (b *ConnectionBuilder) WithSessionCookieName(name string) *ConnectionBuilder {
+	b.sessionCookie = name
+	return b
+}
+
+// WithSessionTokenHeader sends the session token to AM in the given header instead of the session cookie, for
+// deployments where a proxy in front of AM rewrites cookies
+func (b *ConnectionBuilder) WithSessionTokenHeader(header string) *ConnectionBuilder {
+	b.sessionHeader = header
+	return b
+}
+
+// WithUserAgent sets the User-Agent header sent with all requests to AM
+func (b *ConnectionBuilder) WithUserAgent(userAgent string) *ConnectionBuilder {
+	b.userAgent = userAgent
+	return b
+}
+
+// WithHeader adds a static header to all requests to AM. Headers set by the SDK, such as the API version, are not
+// replaced.
+func (b *ConnectionBuilder) WithHeader(name, value string) *ConnectionBuilder {
+	if b.headers == nil {
+		b.headers = make(http.Header)
+	}
+	b.headers.Add(name, value)
+	return b
+}
+
+// WithRequestPriorities limits the number of requests made to AM at the same time and sends the requests that have to
+// wait in order of priority. Only applies to connections to AM.
+func (b *ConnectionBuilder) WithRequestPriorities(priorities RequestPriorities) *ConnectionBuilder {
+	b.priorities = priorities
+	return b
+}
+
+// WithLinkMetadata sets the function that provides metadata about the link of the thing, such as its signal strength,
+// which is sent with every request to the Thing Gateway. Only applies to connections to the Thing Gateway.
+func (b *ConnectionBuilder) WithLinkMetadata(metadata func() string) *ConnectionBuilder {
+	b.linkMetadata = metadata
+	return b
+}
+
+// WithAMInfo provides the information about AM in advance so that the connection does not have to discover it. Connections
+// to AM only use the realm, cookie name, things endpoint version and signing algorithms of the information.
+func (b *ConnectionBuilder) WithAMInfo(info AMInfo) *ConnectionBuilder {
+	b.amInfo = &info
+	return b
+}
+
+// WithAMInfoCache stores the information discovered from AM in the cache so that connections created later, for example
+// after a restart, use it instead of discovering it again. Only applies to connections to AM.
+func (b *ConnectionBuilder) WithAMInfoCache(cache AMInfoCache) *ConnectionBuilder {
+	b.amInfoCache = &cache
+	return b
+}
+
+// WithTLSProfile restricts the cipher suites, curves and protocol version negotiated with the Thing Gateway. Only
+// applies to secure connections to the Thing Gateway.
+func (b *ConnectionBuilder) WithTLSProfile(profile TLSProfile) *ConnectionBuilder {
+	b.tlsProfile = profile
+	return b
+}
+
+// WithGatewayTrust decides which certificates presented by the Thing Gateway are trusted, see GatewayTrust. Only
+// applies to secure connections to the Thing Gateway.
+func (b *ConnectionBuilder) WithGatewayTrust(trust GatewayTrust) *ConnectionBuilder {
+	b.trust = trust
+	return b
+}
+
+// WithDetachedPayload sends signed requests with a detached payload, see jws.DetachPayload, so that the payload is not
+// base64url encoded on the link. The Thing Gateway attaches the payload again before forwarding the request to AM.
+// Only applies to connections to the Thing Gateway.
+func (b *ConnectionBuilder) WithDetachedPayload() *ConnectionBuilder {
+	b.detachedPayload = true
+	return b
+}
+
+// WithRoundTripper makes the HTTP requests to AM with the round tripper instead of the default transport, for example
+// to record or replay the interactions with AM. Only applies to connections to AM.
+func (b *ConnectionBuilder) WithRoundTripper(roundTripper http.RoundTripper) *ConnectionBuilder {
+	b.roundTripper = roundTripper
+	return b
+}
+
 // amConnection contains information for connecting directly to AM
 type amConnection struct {
 	http.Client
-	baseURL         string
-	realm           string
-	authTree        string
-	cookieName      string
+	baseURL       string
+	realm         string
+	authTree      string
+	cookieName    string
+	sessionHeader string
+	userAgent     string
+	headers       http.Header
+	maxPayload    int
+	state         *amState
+	liveness      *livenessMonitor
+	scheduler     *requestScheduler
+	// transactionID identifies all requests made with the connection, a new ID is generated per request if empty
+	transactionID string
+	// clientCertificate is forwarded to AM with all requests made with the connection if it is set
+	clientCertificate *x509.Certificate
+	// peer of the thing on whose behalf the requests are made
+	peer PeerInfo
+	// authContext is sent with authentication requests, see WithAuthContext
+	authContext AuthContext
+	// amInfo is used instead of discovering the information from AM, if it is set
+	amInfo *AMInfo
+	// amInfoCache stores the discovered information, if it is set
+	amInfoCache *AMInfoCache
+}
+
+// amState contains the information learnt from AM. The state is shared with the connections derived from a connection
+// with WithTransactionID.
+type amState struct {
+	mutex           sync.Mutex
 	accessTokenJWKS jose.JSONWebKeySet
+	// signingAlgorithms are the JWS algorithms advertised by AM
+	signingAlgorithms []string
+	// thingsVersion is the index of the negotiated things endpoint version
+	thingsVersion int
 }
 
 // gatewayConnection contains information for connecting to the Thing Gateway via COAP
 type gatewayConnection struct {
+	address    string
+	timeout    time.Duration
+	key        crypto.Signer
+	blockSize  int
+	network    string
+	keepAlive  time.Duration
+	maxPayload int
+	liveness   *livenessMonitor
+	// minBackoff and maxBackoff bound the delay between attempts to reconnect, see WithReconnectBackoff
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	codec      Codec
+	session    *coapSession
+	// linkMetadata provides the metadata about the link sent with every request
+	linkMetadata func() string
+	// certificates presented during the handshake, a self-signed certificate is presented if empty
+	certificates []*x509.Certificate
+	// oscore is the security context used to protect requests once established
+	oscore *oscore.Context
+	// owner is the connection that created the session, if the session is shared with it
+	owner *gatewayConnection
+	// peer of the thing on whose behalf a downstream gateway makes the requests
+	peer PeerInfo
+	// amInfo is returned instead of requesting the information from the gateway, if it is set
+	amInfo *AMInfo
+	// tlsProfile restricts the security parameters of the handshake
+	tlsProfile TLSProfile
+	// trust decides which certificates presented by the gateway in the handshake are trusted
+	trust GatewayTrust
+	// idempotencyKey identifies the attempts of a request to the gateway, see WithIdempotencyKey
+	idempotencyKey string
+	// authContext is sent with authentication requests, see WithAuthContext
+	authContext AuthContext
+	// detachedPayload sends signed requests with a detached payload
+	detachedPayload bool
+}
+
+// coapSession holds the CoAP connection with the Thing Gateway, which is replaced when the connection is lost
+type coapSession struct {
+	client  *coap.Client
 	address string
 	timeout time.Duration
-	key     crypto.Signer
-	client  *coap.Client
+	mutex   sync.Mutex
 	conn    *coap.ClientConn
+	closed  bool
+	stop    chan struct{}
+	// minBackoff and maxBackoff bound the delay between attempts to reconnect
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	// separate receives the responses that the gateway sends separately from the acknowledgement of the request
+	separate *separateResponses
 }
 
-func (b *ConnectionBuilder) Create() (Connection, error) {
-	var connection Connection
-	switch b.url.Scheme {
-	case "http", "https":
-		connection = &amConnection{baseURL: b.url.String(), realm: b.realm, authTree: b.tree, Client: http.Client{
-			Timeout: b.timeout,
-		}}
-	case "coap", "coaps":
-		var err error
-		if b.key == nil {
-			b.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+// DiscoverAMInfo returns the information about AM that was discovered by the connection
+func DiscoverAMInfo(connection Connection) (info AMInfo, err error) {
+	if info.AMInfoResponse, err = connection.AMInfo(); err != nil {
+		return info, err
+	}
+	if c, ok := connection.(*amConnection); ok {
+		info.CookieName = c.cookieName
+	}
+	return info, nil
+}
+
+// connectionFactory creates a connection with the configuration of the builder
+type connectionFactory func(b *ConnectionBuilder) (Connection, error)
+
+// newAMConnection creates a connection directly to AM
+func newAMConnection(b *ConnectionBuilder) (Connection, error) {
+	if b.codec != nil && b.codec.ContentType() != ApplicationJSON {
+		return nil, fmt.Errorf("AM does not accept payloads of type %s", b.codec.ContentType())
+	}
+	if err := b.priorities.Validate(); err != nil {
+		return nil, err
+	}
+	if b.sessionHeader != "" {
+		debug.RedactHeader(b.sessionHeader)
+	}
+	return &amConnection{baseURL: b.url.String(), realm: b.realm, authTree: b.tree, Client: http.Client{
+		Timeout:   b.timeout,
+		Transport: b.roundTripper,
+	}, cookieName: b.sessionCookie, sessionHeader: b.sessionHeader, userAgent: b.userAgent, headers: b.headers,
+		maxPayload: maxPayloadSize(b.maxPayload), state: &amState{}, liveness: &livenessMonitor{},
+		scheduler: newRequestScheduler(b.priorities, b.timeout), amInfo: b.amInfo,
+		amInfoCache: b.amInfoCache}, nil
+}
+
+// newGatewayConnection creates a connection to the Thing Gateway
+func newGatewayConnection(b *ConnectionBuilder) (Connection, error) {
+	var err error
+	if b.key == nil {
+		b.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &gatewayConnection{address: b.url.Host, key: b.key, timeout: b.timeout, blockSize: b.blockSize,
+		network: coapNetwork(b.url.Scheme), keepAlive: b.keepAlive, maxPayload: maxPayloadSize(b.maxPayload),
+		liveness: &livenessMonitor{}, codec: b.codec, certificates: b.certificates,
+		linkMetadata: b.linkMetadata, amInfo: b.amInfo, tlsProfile: b.tlsProfile, trust: b.trust,
+		detachedPayload: b.detachedPayload, minBackoff: b.minBackoff, maxBackoff: b.maxBackoff}, nil
+}
+
+// connectionFactories contains the factories of the built-in connections by URL scheme. Connections for other schemes
+// are created over the transports registered with package transport.
+var connectionFactories = map[string]connectionFactory{
+	"http":      newAMConnection,
+	"https":     newAMConnection,
+	"coap":      newGatewayConnection,
+	"coaps":     newGatewayConnection,
+	"coap+tcp":  newGatewayConnection,
+	"coaps+tcp": newGatewayConnection,
+}
+
+// Schemes returns the URL schemes of the connections that are included in the build and of the registered transports
+func Schemes() []string {
+	var schemes []string
+	for scheme := range connectionFactories {
+		if (scheme == "http" || scheme == "https") && !httpBuilt {
+			continue
 		}
-		if err != nil {
-			return nil, err
+		if strings.HasPrefix(scheme, "coap") && !coapBuilt {
+			continue
 		}
-		connection = &gatewayConnection{address: b.url.Host, key: b.key, timeout: b.timeout}
-	default:
-		return nil, fmt.Errorf("unsupported scheme `%s`, must be one of http(s) or coap(s)", b.url.Scheme)
+		schemes = append(schemes, scheme)
 	}
-	err := connection.Initialise()
+	schemes = append(schemes, transport.Registered()...)
+	sort.Strings(schemes)
+	return schemes
+}
+
+func (b *ConnectionBuilder) Create() (Connection, error) {
+	factory, ok := connectionFactories[b.url.Scheme]
+	if !ok {
+		if !registeredTransport(b.url.Scheme) {
+			return nil, unsupportedScheme(b.url.Scheme)
+		}
+		factory = newTransportConnection
+	}
+	connection, err := factory(b)
+	if err != nil {
+		return nil, err
+	}
+	err = connection.Initialise()
 	return connection, err
 }
+
+// registeredTransport returns true if a transport is registered for the scheme
+func registeredTransport(scheme string) bool {
+	for _, s := range transport.Registered() {
+		if s == scheme {
+			return true
+		}
+	}
+	return false
+}
@@ -21,25 +21,54 @@ package client
 import (
 	"bytes"
 	"context"
+	"crypto"
+	"crypto/ecdsa"
 	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	frcrypto "github.com/JacoJooste/iot-edge/v7/internal/crypto"
+	"github.com/JacoJooste/iot-edge/v7/internal/debug"
+	"github.com/JacoJooste/iot-edge/v7/internal/jws"
+	"github.com/JacoJooste/iot-edge/v7/internal/oscore"
 	"github.com/go-ocf/go-coap"
 	"github.com/go-ocf/go-coap/codes"
 	"github.com/pion/dtls/v2"
 )
 
+// coapBuilt is true when the connection to the Thing Gateway is included in the build
+const coapBuilt = true
+
 // CoAP Content-Formats registry does not contain a JOSE value, using an unassigned value
-const AppJOSE coap.MediaType = 11650
+const AppJOSE coap.MediaType = coapFormatJOSE
+
+// AppDetachedJOSE is the unassigned Content-Format of signed requests sent with a detached payload, see
+// jws.DetachPayload
+const AppDetachedJOSE coap.MediaType = coapFormatDetachedJOSE
+
+// Prefixes of the URI queries that carry the method and path of a signed request to the Thing Gateway
+const (
+	SignedRequestMethodQuery = "method="
+	SignedRequestPathQuery   = "path="
+)
+
+// Prefixes of the URI queries that carry the continuation token and the size of a page of attributes
+const (
+	AttributesPageQuery     = "page="
+	AttributesPageSizeQuery = "size="
+)
 
 type errCoAPStatusCode struct {
-	code    codes.Code
-	payload []byte
+	code          codes.Code
+	payload       []byte
+	transactionID string
 }
 
 func (e errCoAPStatusCode) Error() string {
@@ -47,18 +76,230 @@ func (e errCoAPStatusCode) Error() string {
 	if e.payload != nil {
 		msg += fmt.Sprintf(", payload: %s", string(e.payload))
 	}
+	if e.transactionID != "" {
+		msg += fmt.Sprintf(", transaction ID: %s", e.transactionID)
+	}
 	return msg
 }
 
-// dial returns an existing connection or creates a new one
+// Unwrap returns the class of the error as determined by the CoAP status code
+func (e errCoAPStatusCode) Unwrap() error {
+	switch e.code {
+	case codes.Unauthorized:
+		return ErrUnauthorised
+	case codes.Forbidden:
+		return ErrForbidden
+	case codes.BadRequest:
+		return ErrPayloadInvalid
+	case codes.BadGateway, codes.ServiceUnavailable, codes.GatewayTimeout:
+		return ErrAMUnreachable
+	case codes.UnsupportedMediaType, codes.NotAcceptable:
+		return ErrUnsupportedContent
+	case codes.RequestEntityTooLarge:
+		return ErrPayloadTooLarge
+	}
+	return nil
+}
+
+// coapError returns the error described by an unsuccessful CoAP response to the request
+// The gateway forwards AM errors in the response payload, otherwise the error is constructed from the status code
+func coapError(request, response coap.Message) error {
+	id := TransactionID(request)
+	var amError AMError
+	if err := json.Unmarshal(response.Payload(), &amError); err == nil && amError.Code != 0 {
+		if amError.TransactionID == "" {
+			amError.TransactionID = id
+		}
+		return amError
+	}
+	return errCoAPStatusCode{response.Code(), response.Payload(), id}
+}
+
+// identify sets a new transaction ID on the request
+func identify(request coap.Message) {
+	request.SetOption(TransactionIDOption, []byte(NewTransactionID()))
+}
+
+// describeLink sets the link metadata provided by the thing, or the peer forwarded by a gateway, on the request
+func (c *gatewayConnection) describeLink(request coap.Message) {
+	c.peer.setOptions(request)
+	if c.linkMetadata == nil {
+		return
+	}
+	if metadata := c.linkMetadata(); metadata != "" {
+		request.SetOption(LinkMetadataOption, []byte(metadata))
+	}
+}
+
+// idempotent sets the idempotency key of the connection on the request
+func (c *gatewayConnection) idempotent(request coap.Message) {
+	if c.idempotencyKey != "" {
+		request.SetOption(IdempotencyKeyOption, []byte(c.idempotencyKey))
+	}
+}
+
+// Keep-alive and reconnection
+// Network changes, such as a new address on the thing or a restart of the gateway, silently break the DTLS association
+// with the gateway. A connection that fails with a transport error is dropped so that the next request creates a new
+// one. When keep-alive is enabled, the connection is also checked periodically with a CoAP ping and replaced in the
+// background, retrying with exponential backoff, so that the failure is detected before the next application request.
+// The OSCORE security context is end-to-end and is kept when the connection is replaced.
+
+const (
+	minReconnectBackoff = 100 * time.Millisecond
+	maxReconnectBackoff = 30 * time.Second
+)
+
+var errSessionClosed = errors.New("connection with the gateway has been closed")
+
+// dial returns the current connection or creates a new one
+func (s *coapSession) dial() (*coap.ClientConn, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil, transportError{errSessionClosed}
+	}
+	if s.conn != nil {
+		return s.conn, nil
+	}
+	s.client.DialTimeout = s.timeout
+	conn, err := s.client.Dial(s.address)
+	if err != nil {
+		return nil, transportError{err}
+	}
+	s.conn = conn
+	return conn, nil
+}
+
+// drop closes the connection, if it is still the current connection, so that the next request creates a new one
+func (s *coapSession) drop(conn *coap.ClientConn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if conn == nil || s.conn != conn {
+		return
+	}
+	s.conn = nil
+	_ = conn.Close()
+}
+
+// reconnect creates a new connection, retrying with exponential backoff until it succeeds or the session is closed
+func (s *coapSession) reconnect(stop <-chan struct{}) bool {
+	backoff, maxBackoff := s.minBackoff, s.maxBackoff
+	if backoff == 0 {
+		backoff = minReconnectBackoff
+	}
+	if maxBackoff == 0 {
+		maxBackoff = maxReconnectBackoff
+	}
+	for {
+		_, err := s.dial()
+		if err == nil {
+			return true
+		}
+		debug.Errorf("Unable to reconnect to the gateway, retrying in %v; %s", backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-stop:
+			return false
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// keepAlive pings the gateway at the given interval and replaces the connection if the gateway does not respond
+func (s *coapSession) keepAlive(interval time.Duration) {
+	timeout := s.timeout
+	if timeout == 0 || timeout > interval {
+		timeout = interval
+	}
+	s.stop = make(chan struct{})
+	go func(stop <-chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+			conn, err := s.dial()
+			if err == nil {
+				if err = conn.Ping(timeout); err == nil {
+					continue
+				}
+				s.drop(conn)
+			}
+			debug.Errorf("Lost connection to the gateway, reconnecting; %s", err)
+			if !s.reconnect(stop) {
+				return
+			}
+		}
+	}(s.stop)
+}
+
+// close stops the keep-alive and closes the connection
+func (s *coapSession) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	if s.stop != nil {
+		close(s.stop)
+	}
+	if s.conn != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// dial returns the connection with the gateway
 func (c *gatewayConnection) dial() (*coap.ClientConn, error) {
-	if c.conn != nil {
-		return c.conn, nil
+	if c.session == nil {
+		return nil, transportError{errSessionClosed}
 	}
+	return c.session.dial()
+}
+
+// exchange sends the request to the gateway and returns the response
+// If an OSCORE security context has been established then the request is protected with OSCORE and the response
+// must be protected by the gateway.
+func (c *gatewayConnection) exchange(ctx context.Context, conn *coap.ClientConn, request coap.Message) (coap.Message, error) {
+	identify(request)
+	c.describeLink(request)
+	c.idempotent(request)
+	var exchange oscore.Exchange
 	var err error
-	c.client.DialTimeout = c.timeout
-	c.conn, err = c.client.Dial(c.address)
-	return c.conn, err
+	if c.oscore != nil {
+		if exchange, err = c.oscore.ProtectRequest(request); err != nil {
+			return nil, err
+		}
+	}
+	response, err := c.session.separate.exchange(ctx, conn, request)
+	if err != nil {
+		debug.Errorf("Request with transaction ID %s failed; %s", TransactionID(request), err)
+		c.session.drop(conn)
+		c.liveness.record(transportError{err})
+		return nil, transportError{err}
+	}
+	c.liveness.recordResponse(errCoAPStatusCode{code: response.Code()}.Unwrap(), response.Code())
+	if err = CheckPayloadSize(response.Payload(), maxPayloadSize(c.maxPayload)); err != nil {
+		return nil, err
+	}
+	if c.oscore == nil {
+		return response, nil
+	}
+	if !oscore.IsProtected(response) {
+		// the gateway was unable to verify the request
+		return nil, coapError(request, response)
+	}
+	if err = c.oscore.UnprotectResponse(exchange, response); err != nil {
+		return nil, err
+	}
+	return response, nil
 }
 
 // context returns a context to be used with CoAP requests
@@ -73,28 +314,89 @@ func dtlsClientConfig(cert ...tls.Certificate) *dtls.Config {
 	return &dtls.Config{
 		Certificates:         cert,
 		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
-		InsecureSkipVerify:   true,
 	}
 }
 
+func tlsClientConfig(cert ...tls.Certificate) *tls.Config {
+	return &tls.Config{
+		Certificates: cert,
+	}
+}
+
+// certificate returns the certificate presented to the gateway during the handshake
+func (c *gatewayConnection) certificate() (tls.Certificate, error) {
+	if len(c.certificates) == 0 {
+		return frcrypto.PublicKeyCertificate(c.key)
+	}
+	cert := tls.Certificate{PrivateKey: c.key, Leaf: c.certificates[0]}
+	for _, certificate := range c.certificates {
+		cert.Certificate = append(cert.Certificate, certificate.Raw)
+	}
+	return cert, nil
+}
+
 // Initialise checks that the server can be reached and prepares the client for further communication
 func (c *gatewayConnection) Initialise() (err error) {
 	// create certificate
-	cert, err := frcrypto.PublicKeyCertificate(c.key)
+	cert, err := c.certificate()
 	if err != nil {
 		return err
 	}
-	c.client = &coap.Client{
-		Net:        "udp-dtls",
-		DTLSConfig: dtlsClientConfig(cert),
+	// use block-wise transfer so that payloads larger than a single datagram, such as registration JWTs
+	// containing certificate chains, can be exchanged with the gateway
+	blockWise := true
+	if c.blockSize == 0 {
+		c.blockSize = DefaultBlockSize
 	}
+	szx, err := BlockWiseSzx(c.blockSize)
+	if err != nil {
+		return err
+	}
+	client := &coap.Client{
+		Net:                  c.network,
+		BlockWiseTransfer:    &blockWise,
+		BlockWiseTransferSzx: &szx,
+		MaxMessageSize:       CoAPMaxMessageSize(maxPayloadSize(c.maxPayload)),
+	}
+	switch c.network {
+	case "tcp-tls":
+		client.TLSConfig = tlsClientConfig(cert)
+		if err = c.tlsProfile.ApplyTLS(client.TLSConfig); err == nil {
+			err = c.trust.ApplyTLS(client.TLSConfig)
+		}
+	case "tcp":
+		switch {
+		case !c.tlsProfile.IsZero():
+			err = errTLSProfileInsecure
+		case !c.trust.IsZero():
+			err = errGatewayTrustInsecure
+		}
+	default:
+		client.Net = "udp-dtls"
+		client.DTLSConfig = dtlsClientConfig(cert)
+		if err = c.tlsProfile.ApplyDTLS(client.DTLSConfig); err == nil {
+			err = c.trust.ApplyDTLS(client.DTLSConfig, c.address)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	separate := newSeparateResponses()
+	client.Handler = separate.handle
+	c.session = &coapSession{client: client, address: c.address, timeout: c.timeout, separate: separate,
+		minBackoff: c.minBackoff, maxBackoff: c.maxBackoff}
 
+	defer runtime.KeepAlive(c)
 	conn, err := c.dial()
 	if err != nil {
 		return err
 	}
+	// close the connection once the gateway connection is no longer referenced
+	// methods that exchange messages with the gateway must keep the gateway connection alive until the exchange,
+	// which can span several round trips when using block-wise transfer, is complete
+	// the keep-alive only references the session so that it does not prevent the gateway connection from being freed
 	runtime.SetFinalizer(c, func(c *gatewayConnection) {
-		c.conn.Close()
+		c.session.close()
 	})
 
 	timeout := c.timeout
@@ -102,45 +404,54 @@ func (c *gatewayConnection) Initialise() (err error) {
 		// default ping timeout to an hour
 		timeout = 3600 * time.Second
 	}
-	err = conn.Ping(timeout)
-	return err
+	if err = conn.Ping(timeout); err != nil {
+		return transportError{err}
+	}
+	if c.keepAlive > 0 {
+		c.session.keepAlive(c.keepAlive)
+	}
+	return nil
 }
 
 // Authenticate with the AM authTree using the given payload
 func (c *gatewayConnection) Authenticate(payload AuthenticatePayload) (reply AuthenticatePayload, err error) {
+	defer runtime.KeepAlive(c)
 	conn, err := c.dial()
 	if err != nil {
 		return reply, err
 	}
 
-	requestBody, err := json.Marshal(payload)
+	codec := c.payloadCodec()
+	requestBody, err := codec.Marshal(payload)
 	if err != nil {
 		return reply, err
 	}
 
-	msg, err := conn.NewPostRequest("/authenticate", coap.AppJSON, bytes.NewReader(requestBody))
+	msg, err := conn.NewPostRequest("/authenticate", coap.MediaType(codec.ContentFormat()), bytes.NewReader(requestBody))
 	if err != nil {
 		return reply, err
 	}
+	c.authContext.setOptions(msg)
 
 	ctx, cancel := c.context()
 	defer cancel()
 
-	response, err := conn.ExchangeWithContext(ctx, msg)
+	response, err := c.exchange(ctx, conn, msg)
 	if err != nil {
 		return reply, err
 	} else if response.Code() != codes.Valid {
-		return reply, ErrUnauthorised
+		return reply, coapError(msg, response)
 	}
 
-	if err = json.Unmarshal(response.Payload(), &reply); err != nil {
-		return reply, err
-	}
-	return reply, nil
+	return reply, decodePayload(response, &reply)
 }
 
 // AMInfo makes a request to the Thing Gateway for AM related information
 func (c *gatewayConnection) AMInfo() (info AMInfoResponse, err error) {
+	if c.amInfo != nil {
+		return c.amInfo.AMInfoResponse, nil
+	}
+	defer runtime.KeepAlive(c)
 	conn, err := c.dial()
 	if err != nil {
 		return info, err
@@ -149,22 +460,137 @@ func (c *gatewayConnection) AMInfo() (info AMInfoResponse, err error) {
 	ctx, cancel := c.context()
 	defer cancel()
 
-	response, err := conn.GetWithContext(ctx, "/aminfo")
+	request, err := conn.NewGetRequest("/aminfo")
 	if err != nil {
 		return info, err
+	}
+	response, err := c.exchange(ctx, conn, request)
+	if err != nil {
+		return info, err
+	} else if response.Code() != codes.Content {
+		return info, coapError(request, response)
+	}
+
+	return info, decodePayload(response, &info)
+}
+
+// ServerTime requests the time of the Thing Gateway, which has a resolution of one millisecond
+func (c *gatewayConnection) ServerTime() (server time.Time, resolution time.Duration, err error) {
+	defer runtime.KeepAlive(c)
+	conn, err := c.dial()
+	if err != nil {
+		return server, resolution, err
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+
+	request, err := conn.NewGetRequest(RouteTime)
+	if err != nil {
+		return server, resolution, err
+	}
+	response, err := c.exchange(ctx, conn, request)
+	if err != nil {
+		return server, resolution, err
 	} else if response.Code() != codes.Content {
-		return info, errCoAPStatusCode{response.Code(), response.Payload()}
+		return server, resolution, coapError(request, response)
+	}
+	var payload TimePayload
+	if err = decodePayload(response, &payload); err != nil {
+		return server, resolution, err
 	}
+	return time.Unix(0, payload.Time*int64(time.Millisecond)), time.Millisecond, nil
+}
+
+// ServerInfo requests information about the Thing Gateway, without authentication
+func (c *gatewayConnection) ServerInfo() (info ServerInfoPayload, err error) {
+	defer runtime.KeepAlive(c)
+	conn, err := c.dial()
+	if err != nil {
+		return info, err
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
 
-	if err = json.Unmarshal(response.Payload(), &info); err != nil {
+	request, err := conn.NewGetRequest(RouteServerInfo)
+	if err != nil {
+		return info, err
+	}
+	response, err := c.exchange(ctx, conn, request)
+	if err != nil {
 		return info, err
+	} else if response.Code() != codes.Content {
+		return info, coapError(request, response)
 	}
-	return info, nil
+	err = decodePayload(response, &info)
+	return info, err
 }
 
 // AccessToken makes an access token request with the given session token and payload
 // SSO token is extracted from signed JWT by Thing Gateway
 func (c *gatewayConnection) AccessToken(tokenID string, content ContentType, payload string) (reply []byte, err error) {
+	return c.postThingEndpointRequest("/accesstoken", nil, tokenID, content, payload)
+}
+
+// PolicyDecision makes a policy evaluation request with the given session token and payload
+// SSO token is extracted from signed JWT by Thing Gateway
+func (c *gatewayConnection) PolicyDecision(tokenID string, content ContentType, payload string) (reply []byte, err error) {
+	return c.postThingEndpointRequest("/policy", nil, tokenID, content, payload)
+}
+
+// SignedRequest makes a request to the AM endpoint at the path with the given session token and payload
+// The method and path are sent to the Thing Gateway as URI queries and the gateway forwards the request to AM
+func (c *gatewayConnection) SignedRequest(tokenID string, method string, path string, content ContentType, payload string) (reply []byte, err error) {
+	query := []string{SignedRequestMethodQuery + method, SignedRequestPathQuery + path}
+	return c.postThingEndpointRequest("/amrequest", query, tokenID, content, payload)
+}
+
+// payloadCodec returns the codec of the structured payloads sent to the Thing Gateway
+func (c *gatewayConnection) payloadCodec() Codec {
+	if c.codec == nil {
+		return JSONCodec
+	}
+	return c.codec
+}
+
+// decodePayload decodes the payload of a response from the Thing Gateway with the codec registered for its
+// Content-Format. Responses without a Content-Format are JSON.
+func decodePayload(response coap.Message, v interface{}) error {
+	var codec Codec = JSONCodec
+	if format, ok := response.Option(coap.ContentFormat).(coap.MediaType); ok {
+		if codec, ok = CodecForFormat(uint16(format)); !ok {
+			return invalidPayload(fmt.Errorf("unsupported content format %v", format))
+		}
+	}
+	if err := codec.Unmarshal(response.Payload(), v); err != nil {
+		return invalidPayload(err)
+	}
+	return nil
+}
+
+// thingEndpointPayload returns the CoAP content format and payload of a thing endpoint request, wrapping the payload
+// with the session token if the payload is not signed
+func (c *gatewayConnection) thingEndpointPayload(tokenID string, content ContentType, payload string) (coap.MediaType,
+	string, error) {
+	if content == ApplicationJOSE && c.detachedPayload {
+		detached, err := jws.DetachPayload(payload)
+		return AppDetachedJOSE, detached, err
+	} else if content == ApplicationJOSE {
+		return AppJOSE, payload, nil
+	}
+	codec := c.payloadCodec()
+	b, err := codec.Marshal(ThingEndpointPayload{
+		Token:   tokenID,
+		Payload: payload,
+	})
+	return coap.MediaType(codec.ContentFormat()), string(b), err
+}
+
+// postThingEndpointRequest posts the payload to the given path, wrapping the payload with the session token if the
+// payload is not signed
+func (c *gatewayConnection) postThingEndpointRequest(path string, query []string, tokenID string, content ContentType, payload string) (reply []byte, err error) {
+	defer runtime.KeepAlive(c)
 	conn, err := c.dial()
 	if err != nil {
 		return nil, err
@@ -173,24 +599,20 @@ func (c *gatewayConnection) AccessToken(tokenID string, content ContentType, pay
 	ctx, cancel := c.context()
 	defer cancel()
 
-	var coapFormat coap.MediaType
-	switch content {
-	case ApplicationJOSE:
-		coapFormat = AppJOSE
-	case ApplicationJSON:
-		wrappedPayload := ThingEndpointPayload{
-			Token:   tokenID,
-			Payload: payload,
-		}
-		b, err := json.Marshal(wrappedPayload)
-		if err != nil {
-			return nil, err
-		}
-		payload = string(b)
-		coapFormat = coap.AppJSON
+	coapFormat, payload, err := c.thingEndpointPayload(tokenID, content, payload)
+	if err != nil {
+		return nil, err
 	}
-
-	response, err := conn.PostWithContext(ctx, "/accesstoken", coapFormat, strings.NewReader(payload))
+	request, err := conn.NewPostRequest(path, coapFormat, strings.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	// the gateway only responds with JSON
+	request.SetOption(coap.Accept, coap.AppJSON)
+	if len(query) > 0 {
+		request.SetQuery(query)
+	}
+	response, err := c.exchange(ctx, conn, request)
 	if err != nil {
 		return nil, err
 	}
@@ -198,15 +620,14 @@ func (c *gatewayConnection) AccessToken(tokenID string, content ContentType, pay
 	switch response.Code() {
 	case codes.Changed:
 		return response.Payload(), nil
-	case codes.Unauthorized:
-		return nil, ErrUnauthorised
 	default:
-		return nil, errCoAPStatusCode{response.Code(), response.Payload()}
+		return nil, coapError(request, response)
 	}
 }
 
 // IntrospectAccessToken makes a request to the gateway to introspect an access token
 func (c *gatewayConnection) IntrospectAccessToken(token string) (introspection []byte, err error) {
+	defer runtime.KeepAlive(c)
 	conn, err := c.dial()
 	if err != nil {
 		return nil, err
@@ -215,17 +636,22 @@ func (c *gatewayConnection) IntrospectAccessToken(token string) (introspection [
 	ctx, cancel := c.context()
 	defer cancel()
 
-	payload, err := json.Marshal(IntrospectPayload{Token: token})
+	codec := c.payloadCodec()
+	payload, err := codec.Marshal(IntrospectPayload{Token: token})
 	if err != nil {
 		return nil, err
 	}
 
-	response, err := conn.PostWithContext(ctx, "/introspect", coap.AppJSON, bytes.NewReader(payload))
+	request, err := conn.NewPostRequest("/introspect", coap.MediaType(codec.ContentFormat()), bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	response, err := c.exchange(ctx, conn, request)
 	if err != nil {
 		return nil, err
 	}
 	if response.Code() != codes.Changed {
-		return nil, errCoAPStatusCode{response.Code(), response.Payload()}
+		return nil, coapError(request, response)
 	}
 	return response.Payload(), nil
 }
@@ -233,76 +659,88 @@ func (c *gatewayConnection) IntrospectAccessToken(token string) (introspection [
 // Attributes makes a thing attributes request with the given payload
 // SSO token is extracted from signed JWT by Thing Gateway
 func (c *gatewayConnection) Attributes(tokenID string, content ContentType, payload string, names []string) (reply []byte, err error) {
+	reply, _, err = c.ConditionalAttributes(tokenID, content, payload, names, "")
+	return reply, err
+}
+
+// ConditionalAttributes makes a thing attributes request with the ETag option set to the revision, which is the
+// hexadecimal ETag of a previous attributes response of the Thing Gateway
+func (c *gatewayConnection) ConditionalAttributes(tokenID string, content ContentType, payload string, names []string,
+	revision string) (reply []byte, next string, err error) {
+	defer runtime.KeepAlive(c)
 	conn, err := c.dial()
 	if err != nil {
-		return nil, err
+		return nil, revision, err
 	}
 	ctx, cancel := c.context()
 	defer cancel()
 
-	var coapFormat coap.MediaType
-	switch content {
-	case ApplicationJOSE:
-		coapFormat = AppJOSE
-	case ApplicationJSON:
-		coapFormat = coap.AppJSON
-		wrappedPayload := ThingEndpointPayload{
-			Token:   tokenID,
-			Payload: payload,
-		}
-		b, err := json.Marshal(wrappedPayload)
-		if err != nil {
-			return nil, err
-		}
-		payload = string(b)
+	coapFormat, payload, err := c.thingEndpointPayload(tokenID, content, payload)
+	if err != nil {
+		return nil, revision, err
 	}
-
 	request, err := conn.NewPostRequest("/attributes", coapFormat, strings.NewReader(payload))
 	if err != nil {
-		return nil, err
+		return nil, revision, err
 	}
+	// the gateway only responds with JSON
+	request.SetOption(coap.Accept, coap.AppJSON)
 	request.SetQuery(names)
-	response, err := conn.ExchangeWithContext(ctx, request)
+	if etag, err := hex.DecodeString(revision); err == nil && len(etag) > 0 {
+		request.SetOption(coap.ETag, etag)
+	}
+	response, err := c.exchange(ctx, conn, request)
 	if err != nil {
-		return nil, err
+		return nil, revision, err
 	}
 	switch response.Code() {
 	case codes.Changed:
-		return response.Payload(), nil
-	case codes.Unauthorized:
-		return nil, ErrUnauthorised
+		reply = response.Payload()
+		if etag, ok := response.Option(coap.ETag).([]byte); ok {
+			return reply, hex.EncodeToString(etag), nil
+		}
+		// responses protected with OSCORE are not tagged so the revision is derived from their content
+		if next = contentRevision(reply); revision != "" && next == revision {
+			return nil, revision, ErrNotModified
+		}
+		return reply, next, nil
+	case codes.Valid:
+		return nil, revision, ErrNotModified
 	default:
-		return nil, errCoAPStatusCode{response.Code(), response.Payload()}
+		return nil, revision, coapError(request, response)
 	}
 }
 
 // makeSessionRequest sends a request to the session endpoint with the given action
-func (c *gatewayConnection) makeSessionRequest(tokenID string, action string) (response coap.Message, err error) {
+func (c *gatewayConnection) makeSessionRequest(tokenID string, action string) (message, response coap.Message, err error) {
+	defer runtime.KeepAlive(c)
 	conn, err := c.dial()
 	if err != nil {
-		return response, err
+		return nil, nil, err
 	}
 
 	ctx, cancel := c.context()
 	defer cancel()
 
-	b, err := json.Marshal(SessionToken{TokenID: tokenID})
+	codec := c.payloadCodec()
+	b, err := codec.Marshal(SessionToken{TokenID: tokenID})
 	if err != nil {
-		return response, err
+		return nil, nil, err
 	}
 
-	message, err := conn.NewPostRequest("/session", coap.AppJSON, bytes.NewReader(b))
+	message, err = conn.NewPostRequest("/session", coap.MediaType(codec.ContentFormat()), bytes.NewReader(b))
 	if err != nil {
-		return response, err
+		return nil, nil, err
 	}
 
 	message.SetQueryString(fmt.Sprintf("_action=%s", action))
-	return conn.ExchangeWithContext(ctx, message)
+	response, err = c.exchange(ctx, conn, message)
+	return message, response, err
 }
 
 // ValidateSession represented by the given token
 func (c *gatewayConnection) ValidateSession(tokenID string) (ok bool, err error) {
-	response, err := c.makeSessionRequest(tokenID, "validate")
+	request, response, err := c.makeSessionRequest(tokenID, "validate")
 	if err != nil {
 		return false, err
 	}
@@ -313,13 +751,13 @@ func (c *gatewayConnection) ValidateSession(tokenID string) (ok bool, err error)
 	case codes.Unauthorized:
 		return false, nil
 	default:
-		return false, errCoAPStatusCode{response.Code(), response.Payload()}
+		return false, coapError(request, response)
 	}
 }
 
 // LogoutSession represented by the given token
 func (c *gatewayConnection) LogoutSession(tokenID string) (err error) {
-	response, err := c.makeSessionRequest(tokenID, "logout")
+	request, response, err := c.makeSessionRequest(tokenID, "logout")
 	if err != nil {
 		return err
 	}
@@ -328,6 +766,168 @@ func (c *gatewayConnection) LogoutSession(tokenID string) (err error) {
 	case codes.Changed:
 		return nil
 	default:
-		return errCoAPStatusCode{response.Code(), response.Payload()}
+		return coapError(request, response)
+	}
+}
+
+// SessionInfo requests the information held by AM about the session represented by the given token
+func (c *gatewayConnection) SessionInfo(tokenID string) (reply []byte, err error) {
+	request, response, err := c.makeSessionRequest(tokenID, "getSessionInfo")
+	if err != nil {
+		return nil, err
+	}
+
+	switch response.Code() {
+	case codes.Changed:
+		return response.Payload(), nil
+	default:
+		return nil, coapError(request, response)
+	}
+}
+
+// SubscribeAttributes subscribes to changes of the named attributes of the thing by observing (RFC 7641) the attributes
+// resource of the Thing Gateway with the given attributes request. The notify function is called with the current
+// values before the function returns and again whenever the values change. It is called on the goroutine that reads
+// from the connection and should therefore not block. The subscription ends when the returned function is called or
+// when the connection with the gateway is lost.
+func SubscribeAttributes(connection Connection, tokenID string, content ContentType, payload string, names []string,
+	notify func(reply []byte)) (cancel func() error, err error) {
+	c, ok := connection.(*gatewayConnection)
+	if !ok || c.oscore != nil {
+		return nil, errSubscriptionUnsupported
+	}
+	defer runtime.KeepAlive(c)
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	coapFormat, payload, err := c.thingEndpointPayload(tokenID, content, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancelCtx := c.context()
+	defer cancelCtx()
+
+	// the first response is the reply to the registration, the ones that follow are notifications
+	var mutex sync.Mutex
+	registered := false
+	registration := make(chan coap.Message, 1)
+	var request coap.Message
+	observation, err := conn.ObserveWithContext(ctx, "/attributes", func(r *coap.Request) {
+		mutex.Lock()
+		first := !registered
+		registered = true
+		mutex.Unlock()
+		if first {
+			registration <- r.Msg
+		} else if r.Msg.Code() == codes.Content {
+			notify(r.Msg.Payload())
+		}
+	}, func(message coap.Message) {
+		message.SetOption(coap.ContentFormat, coapFormat)
+		message.SetPayload([]byte(payload))
+		message.SetQuery(names)
+		identify(message)
+		request = message
+	})
+	if err != nil {
+		c.session.drop(conn)
+		return nil, transportError{err}
+	}
+	select {
+	case response := <-registration:
+		if response.Code() != codes.Content {
+			_ = observation.Cancel()
+			return nil, coapError(request, response)
+		}
+		notify(response.Payload())
+	case <-ctx.Done():
+		_ = observation.Cancel()
+		return nil, transportError{ctx.Err()}
+	}
+	return observation.Cancel, nil
+}
+
+// AttributesPage requests a page of the named attributes of the thing from the Thing Gateway so that a thing with a
+// large number of attributes does not have to hold all of them in memory at once. The first page is requested with an
+// empty continuation token and the reply contains an AttributesPagePayload with the token of the next page.
+func AttributesPage(connection Connection, tokenID string, content ContentType, payload string, names []string,
+	page string, size int) (reply []byte, err error) {
+	c, ok := connection.(*gatewayConnection)
+	if !ok {
+		return nil, ErrAttributePagesUnsupported
+	}
+	query := append([]string{AttributesPageSizeQuery + strconv.Itoa(size)}, names...)
+	if page != "" {
+		query = append(query, AttributesPageQuery+page)
+	}
+	return c.postThingEndpointRequest("/attributepage", query, tokenID, content, payload)
+}
+
+// LocalAccessToken requests an access token for a site-local service that is issued and signed by the Thing Gateway
+// instead of AM. The payload contains a LocalTokenPayload and the gateway only issues the token if it is configured
+// as a local issuer.
+func LocalAccessToken(connection Connection, tokenID string, content ContentType, payload string) (reply []byte, err error) {
+	c, ok := connection.(*gatewayConnection)
+	if !ok {
+		return nil, errLocalTokenUnsupported
+	}
+	return c.postThingEndpointRequest("/localtoken", nil, tokenID, content, payload)
+}
+
+// EstablishOSCORE establishes an OSCORE security context with the Thing Gateway and protects all subsequent requests
+// made over the connection with OSCORE (RFC 8613).
+// The request is a JWT containing OSCOREClaims that is signed with the confirmation key of the thing. The master
+// secret is agreed with ECDH using the ephemeral key and the context is bound to the confirmation key.
+func EstablishOSCORE(connection Connection, request string, ephemeralKey *ecdsa.PrivateKey, confirmationKey crypto.PublicKey) error {
+	c, ok := connection.(*gatewayConnection)
+	if !ok {
+		return errOSCOREUnsupported
+	}
+	defer runtime.KeepAlive(c)
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+
+	// the request is sent without OSCORE so that a new context can replace one that the gateway no longer recognises
+	message, err := conn.NewPostRequest("/oscore", AppJOSE, strings.NewReader(request))
+	if err != nil {
+		return err
+	}
+	identify(message)
+	response, err := c.session.separate.exchange(ctx, conn, message)
+	if err != nil {
+		c.session.drop(conn)
+		return transportError{err}
+	} else if response.Code() != codes.Changed {
+		return coapError(message, response)
+	}
+
+	var reply OSCOREPayload
+	if err = json.Unmarshal(response.Payload(), &reply); err != nil {
+		return invalidPayload(err)
+	}
+	public, ok := reply.EphemeralKey.Key.(*ecdsa.PublicKey)
+	if !ok {
+		return invalidPayload(fmt.Errorf("unexpected ephemeral key type %T", reply.EphemeralKey.Key))
+	}
+	secret, err := oscore.SharedSecret(ephemeralKey, public)
+	if err != nil {
+		return invalidPayload(err)
+	}
+	idContext, err := oscore.IDContext(confirmationKey)
+	if err != nil {
+		return err
+	}
+	securityContext, err := oscore.NewContext(secret, reply.Salt, reply.SenderID, reply.RecipientID, idContext)
+	if err != nil {
+		return err
 	}
+	c.oscore = securityContext
+	return nil
 }
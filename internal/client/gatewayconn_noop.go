@@ -18,10 +18,16 @@
 
 package client
 
-import "errors"
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"errors"
+)
 
 var errCOAPNotBuilt = errors.New("coap(s) scheme is unsupported")
 
+const coapBuilt = false
+
 func (c *gatewayConnection) Initialise() error {
 	return errCOAPNotBuilt
 }
@@ -42,6 +48,10 @@ func (c *gatewayConnection) LogoutSession(tokenID string) (err error) {
 	return errCOAPNotBuilt
 }
 
+func (c *gatewayConnection) SessionInfo(tokenID string) (reply []byte, err error) {
+	return reply, errCOAPNotBuilt
+}
+
 func (c *gatewayConnection) AccessToken(tokenID string, content ContentType, payload string) (reply []byte, err error) {
 	return reply, errCOAPNotBuilt
 }
@@ -53,3 +63,29 @@ func (c *gatewayConnection) IntrospectAccessToken(token string) (introspection [
 func (c *gatewayConnection) Attributes(tokenID string, content ContentType, payload string, names []string) (reply []byte, err error) {
 	return reply, errCOAPNotBuilt
 }
+
+func (c *gatewayConnection) PolicyDecision(tokenID string, content ContentType, payload string) (reply []byte, err error) {
+	return reply, errCOAPNotBuilt
+}
+
+func (c *gatewayConnection) SignedRequest(tokenID string, method string, path string, content ContentType, payload string) (reply []byte, err error) {
+	return reply, errCOAPNotBuilt
+}
+
+func SubscribeAttributes(connection Connection, tokenID string, content ContentType, payload string, names []string,
+	notify func(reply []byte)) (cancel func() error, err error) {
+	return nil, errCOAPNotBuilt
+}
+
+func AttributesPage(connection Connection, tokenID string, content ContentType, payload string, names []string,
+	page string, size int) (reply []byte, err error) {
+	return nil, errCOAPNotBuilt
+}
+
+func LocalAccessToken(connection Connection, tokenID string, content ContentType, payload string) (reply []byte, err error) {
+	return nil, errCOAPNotBuilt
+}
+
+func EstablishOSCORE(connection Connection, request string, ephemeralKey *ecdsa.PrivateKey, confirmationKey crypto.PublicKey) error {
+	return errCOAPNotBuilt
+}
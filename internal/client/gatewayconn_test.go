@@ -24,6 +24,9 @@ import (
 	"crypto/rand"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
+	stdnet "net"
+	"sync"
 	"testing"
 	"time"
 
@@ -91,8 +94,9 @@ func (s testCOAPServer) Start() (address string, cancel func(), err error) {
 	}
 	c := make(chan error, 1)
 	go func() {
-		c <- server.ActivateAndServe()
+		err := server.ActivateAndServe()
 		l.Close()
+		c <- err
 	}()
 	return l.Addr().String(), func() {
 		if err := server.Shutdown(); err != nil {
@@ -144,6 +148,148 @@ func TestGatewayClient_Initialise(t *testing.T) {
 	}
 }
 
+func TestGatewayClient_TransactionID(t *testing.T) {
+	ids := make(chan string, 1)
+	mux := coap.NewServeMux()
+	mux.HandleFunc("/accesstoken", func(w coap.ResponseWriter, r *coap.Request) {
+		ids <- TransactionID(r.Msg)
+		w.SetCode(codes.Forbidden)
+		_, _ = w.Write(nil)
+	})
+	cert, _ := frcrypto.PublicKeyCertificate(testGenerateSigner())
+	address, cancel, err := testCOAPServer{config: dtlsServerConfig(cert), mux: mux}.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	client := &gatewayConnection{address: address, key: testGenerateSigner()}
+	if err = client.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.AccessToken("aToken", ApplicationJOSE, "aSignedWT")
+	id := <-ids
+	var statusErr errCoAPStatusCode
+	if id == "" || !errors.As(err, &statusErr) || statusErr.transactionID != id {
+		t.Errorf("expected error with transaction ID %s, got %v", id, err)
+	}
+}
+
+// testUDPProxy forwards datagrams between a client and a server
+// Rebinding the proxy changes the address that the server receives datagrams from, as a NAT does after a network
+// change, so that the server no longer recognises the DTLS association with the client.
+type testUDPProxy struct {
+	listener *stdnet.UDPConn
+	server   *stdnet.UDPAddr
+	mutex    sync.Mutex
+	upstream *stdnet.UDPConn
+	client   stdnet.Addr
+}
+
+func testStartUDPProxy(server string) (*testUDPProxy, error) {
+	serverAddr, err := stdnet.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := stdnet.ListenUDP("udp", &stdnet.UDPAddr{IP: stdnet.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	p := &testUDPProxy{listener: listener, server: serverAddr}
+	if err = p.rebind(); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := listener.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			p.mutex.Lock()
+			p.client = addr
+			_, _ = p.upstream.Write(buf[:n])
+			p.mutex.Unlock()
+		}
+	}()
+	return p, nil
+}
+
+// rebind replaces the socket used to forward datagrams to the server
+func (p *testUDPProxy) rebind() error {
+	upstream, err := stdnet.DialUDP("udp", nil, p.server)
+	if err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	if p.upstream != nil {
+		p.upstream.Close()
+	}
+	p.upstream = upstream
+	p.mutex.Unlock()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, err := upstream.Read(buf)
+			if err != nil {
+				return
+			}
+			p.mutex.Lock()
+			client := p.client
+			p.mutex.Unlock()
+			_, _ = p.listener.WriteTo(buf[:n], client)
+		}
+	}()
+	return nil
+}
+
+func (p *testUDPProxy) Close() {
+	p.listener.Close()
+	p.mutex.Lock()
+	p.upstream.Close()
+	p.mutex.Unlock()
+}
+
+// checks that the client reconnects in the background when the gateway no longer recognises the DTLS association
+func TestGatewayClient_KeepAlive(t *testing.T) {
+	cert, _ := frcrypto.PublicKeyCertificate(testGenerateSigner())
+	info, _ := json.Marshal(AMInfoResponse{Realm: "testRealm"})
+	address, cancel, err := testCOAPServer{config: dtlsServerConfig(cert),
+		mux: testAMInfoCOAPMux(codes.Content, info)}.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	proxy, err := testStartUDPProxy(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	client := &gatewayConnection{address: proxy.listener.LocalAddr().String(), key: testGenerateSigner(),
+		timeout: 200 * time.Millisecond, keepAlive: 50 * time.Millisecond}
+	if err = client.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.session.close()
+	original, _ := client.dial()
+
+	if err = proxy.rebind(); err != nil {
+		t.Fatal(err)
+	}
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if conn, err := client.dial(); err == nil && conn != original {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("connection was not replaced")
+		}
+	}
+	if _, err = client.AMInfo(); err != nil {
+		t.Errorf("expected request to succeed after reconnecting; %s", err)
+	}
+}
+
 // checks that multiple Thing Gateway Clients can be initialised concurrently
 func TestGatewayClient_Initialise_Concurrent(t *testing.T) {
 	t.Skip("Concurrent DTLS handshakes fail")
@@ -0,0 +1,137 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/pion/dtls/v2"
+)
+
+// GatewayTrust decides which certificates presented by the Thing Gateway in the handshake are trusted.
+//
+// Over TLS, the zero value verifies the certificate chain of the gateway against the root CAs of the system and checks
+// that it was issued for the host of the gateway URL. Over DTLS, the certificate of the gateway is only verified if
+// root CAs or pinned keys are given, since the gateway presents a self-signed certificate by default.
+//
+// The key of the gateway can be pinned instead of verifying its certificate chain, which suits gateways that present
+// the default self-signed certificate for their key. A pin survives the renewal of a certificate for the same key.
+type GatewayTrust struct {
+	// RootCAs verify the certificate chain of the gateway instead of the root CAs of the system
+	RootCAs *x509.CertPool
+	// PinnedKeys restrict the gateway to presenting a leaf certificate for one of the public keys. The certificate
+	// chain is only verified as well if RootCAs are given.
+	PinnedKeys []crypto.PublicKey
+	// InsecureSkipVerify accepts any certificate presented by the gateway. Only use for testing, since it allows a man
+	// in the middle to impersonate the gateway.
+	InsecureSkipVerify bool
+}
+
+var errGatewayTrustInsecure = errors.New("gateway trust requires a secure transport")
+
+// IsZero returns true if the trust uses the defaults of the transports
+func (t GatewayTrust) IsZero() bool {
+	return t.RootCAs == nil && len(t.PinnedKeys) == 0 && !t.InsecureSkipVerify
+}
+
+// Validate checks that the trust settings are consistent
+func (t GatewayTrust) Validate() error {
+	if t.InsecureSkipVerify && (t.RootCAs != nil || len(t.PinnedKeys) > 0) {
+		return errors.New("skipping the verification of the gateway certificate can not be combined with root CAs " +
+			"or pinned keys")
+	}
+	for _, key := range t.PinnedKeys {
+		if _, err := x509.MarshalPKIXPublicKey(key); err != nil {
+			return fmt.Errorf("invalid pinned key; %w", err)
+		}
+	}
+	return nil
+}
+
+// ValidateScheme checks that the trust can be applied to connections to URLs with the scheme
+func (t GatewayTrust) ValidateScheme(scheme string) error {
+	if t.IsZero() {
+		return nil
+	}
+	if _, ok := connectionFactories[scheme]; !ok || IsAMScheme(scheme) {
+		return fmt.Errorf("gateway trust only applies to connections to the Thing Gateway, not `%s`", scheme)
+	}
+	if coapNetwork(scheme) == "tcp" {
+		return errGatewayTrustInsecure
+	}
+	return t.Validate()
+}
+
+// verifyPinned checks that the leaf certificate presented by the gateway is issued for one of the pinned keys
+func (t GatewayTrust) verifyPinned(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errors.New("gateway did not present a certificate")
+	}
+	leaf, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	for _, key := range t.PinnedKeys {
+		pinned, err := x509.MarshalPKIXPublicKey(key)
+		if err == nil && bytes.Equal(leaf.RawSubjectPublicKeyInfo, pinned) {
+			return nil
+		}
+	}
+	return errors.New("key of the gateway certificate is not pinned")
+}
+
+// ApplyTLS makes the TLS configuration verify the certificate of the gateway
+func (t GatewayTrust) ApplyTLS(config *tls.Config) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+	config.RootCAs = t.RootCAs
+	config.InsecureSkipVerify = t.InsecureSkipVerify
+	if len(t.PinnedKeys) > 0 {
+		config.VerifyPeerCertificate = t.verifyPinned
+		// the standard verification is skipped unless the chain is verified as well
+		config.InsecureSkipVerify = t.RootCAs == nil
+	}
+	return nil
+}
+
+// ApplyDTLS makes the DTLS configuration verify the certificate of the gateway, which is served from the address
+func (t GatewayTrust) ApplyDTLS(config *dtls.Config, address string) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+	config.RootCAs = t.RootCAs
+	config.InsecureSkipVerify = t.RootCAs == nil
+	if len(t.PinnedKeys) > 0 {
+		config.VerifyPeerCertificate = t.verifyPinned
+	}
+	if t.RootCAs != nil {
+		// unlike the TLS library, the DTLS library does not derive the server name from the address
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		config.ServerName = host
+	}
+	return nil
+}
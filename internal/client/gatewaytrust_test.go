@@ -0,0 +1,78 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"testing"
+
+	frcrypto "github.com/JacoJooste/iot-edge/v7/internal/crypto"
+)
+
+func TestGatewayTrust_ValidateScheme(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	pinned := GatewayTrust{PinnedKeys: []crypto.PublicKey{key.Public()}}
+	tests := []struct {
+		name   string
+		trust  GatewayTrust
+		scheme string
+		ok     bool
+	}{
+		{name: "zero-http", scheme: "https", ok: true},
+		{name: "zero-tcp", scheme: "coap+tcp", ok: true},
+		{name: "http", trust: pinned, scheme: "https"},
+		{name: "tcp", trust: GatewayTrust{InsecureSkipVerify: true}, scheme: "coap+tcp"},
+		{name: "dtls", trust: pinned, scheme: "coaps", ok: true},
+		{name: "tls", trust: GatewayTrust{RootCAs: x509.NewCertPool()}, scheme: "coaps+tcp", ok: true},
+		{name: "insecure-and-pinned", trust: GatewayTrust{InsecureSkipVerify: true, PinnedKeys: pinned.PinnedKeys},
+			scheme: "coaps+tcp"},
+		{name: "invalid-pin", trust: GatewayTrust{PinnedKeys: []crypto.PublicKey{"key"}}, scheme: "coaps+tcp"},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			if err := subtest.trust.ValidateScheme(subtest.scheme); (err == nil) != subtest.ok {
+				t.Errorf("expected valid %v; got %v", subtest.ok, err)
+			}
+		})
+	}
+}
+
+func TestGatewayTrust_VerifyPinned(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	cert, _ := frcrypto.PublicKeyCertificate(key)
+	trust := GatewayTrust{PinnedKeys: []crypto.PublicKey{other.Public(), key.Public()}}
+	if err := trust.verifyPinned(cert.Certificate, nil); err != nil {
+		t.Error(err)
+	}
+	// a certificate for the same key is still trusted after the certificate is renewed
+	renewed, _ := frcrypto.PublicKeyCertificate(key)
+	if err := trust.verifyPinned(renewed.Certificate, nil); err != nil {
+		t.Error(err)
+	}
+	trust.PinnedKeys = trust.PinnedKeys[:1]
+	if err := trust.verifyPinned(cert.Certificate, nil); err == nil {
+		t.Error("expected a certificate for a key that is not pinned to be rejected")
+	}
+	if err := trust.verifyPinned(nil, nil); err == nil {
+		t.Error("expected a missing certificate to be rejected")
+	}
+}
@@ -0,0 +1,67 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"github.com/go-ocf/go-coap"
+)
+
+// Idempotency keys
+// A thing that times out waiting for a registration or an access token does not know whether the request reached AM.
+// If the thing repeats the request it may register a second time or count twice against the rate limits of AM. To
+// avoid this, the thing identifies the attempts of a request with the same idempotency key, sent to the Thing Gateway
+// in the IdempotencyKeyOption CoAP option, and the gateway returns the response to the attempt that completed instead
+// of forwarding the request to AM again. The key must be unique to the request, see NewIdempotencyKey, and is not
+// sent to AM. The gateway rejects keys shorter than MinIdempotencyKeyLength since they can be guessed.
+
+// IdempotencyKeyOption is the CoAP option in which the idempotency key of a request is sent to the Thing Gateway.
+// The option number is from the experimental range and is elective so that it is ignored by gateways that do not
+// support it.
+const IdempotencyKeyOption coap.OptionID = 65016
+
+// MinIdempotencyKeyLength is the minimum length of an idempotency key, the length of the keys returned by
+// NewIdempotencyKey
+const MinIdempotencyKeyLength = 36
+
+// NewIdempotencyKey returns a new random idempotency key
+func NewIdempotencyKey() string {
+	return NewTransactionID()
+}
+
+// WithIdempotencyKey returns a connection that identifies all its requests with the given idempotency key. The
+// returned connection shares the state of the given connection. Connections to AM are returned unchanged.
+func WithIdempotencyKey(connection Connection, key string) Connection {
+	c, ok := connection.(*gatewayConnection)
+	if !ok || key == "" {
+		return connection
+	}
+	keyed := *c
+	keyed.idempotencyKey = key
+	// the session is closed when the connection that created it is freed, so it must outlive the keyed connection
+	if keyed.owner == nil {
+		keyed.owner = c
+	}
+	return &keyed
+}
+
+// IdempotencyKey returns the idempotency key of the CoAP message, if it has one
+func IdempotencyKey(message coap.Message) string {
+	if key, ok := message.Option(IdempotencyKeyOption).([]byte); ok {
+		return string(key)
+	}
+	return ""
+}
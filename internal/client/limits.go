@@ -0,0 +1,101 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Payload limits
+// A thing running on a device with a few megabytes of memory must not read an arbitrarily large payload into memory
+// because of a misconfigured server or a hostile peer. Every payload read by a connection is limited in size:
+//    - the bodies of HTTP responses from AM are read through a reader that fails as soon as the limit is exceeded, the
+//      declared content length is checked before anything is read
+//    - the payloads of CoAP responses from the Thing Gateway are checked once received. Over TCP the maximum message
+//      size is also advertised to the gateway so that larger messages are never sent.
+// A payload that exceeds the limit results in an error of class ErrPayloadTooLarge.
+
+// DefaultMaxPayloadSize is the maximum size in bytes of a payload read by a connection if no size has been configured
+const DefaultMaxPayloadSize = 1 << 20
+
+// coapMessageOverhead is the space allowed for the header, token and options of a CoAP message with a full payload
+const coapMessageOverhead = 1024
+
+// maxPayloadSize returns the configured size, or the default size if none has been configured
+func maxPayloadSize(size int) int {
+	if size <= 0 {
+		return DefaultMaxPayloadSize
+	}
+	return size
+}
+
+// payloadTooLarge returns an error describing a payload of the given size that exceeds the limit
+func payloadTooLarge(size int64, limit int) error {
+	if size < 0 {
+		return fmt.Errorf("%w: payload exceeds the limit of %d bytes", ErrPayloadTooLarge, limit)
+	}
+	return fmt.Errorf("%w: payload of %d bytes exceeds the limit of %d bytes", ErrPayloadTooLarge, size, limit)
+}
+
+// CheckPayloadSize returns an error of class ErrPayloadTooLarge if the payload is larger than the limit
+func CheckPayloadSize(payload []byte, limit int) error {
+	if len(payload) > limit {
+		return payloadTooLarge(int64(len(payload)), limit)
+	}
+	return nil
+}
+
+// CoAPMaxMessageSize returns the maximum size of a CoAP message that carries a payload of up to the given size
+func CoAPMaxMessageSize(payloadSize int) uint32 {
+	return uint32(payloadSize + coapMessageOverhead)
+}
+
+// limitedBody is the body of an HTTP response that fails once more than the limit has been read
+type limitedBody struct {
+	io.ReadCloser
+	limit     int
+	remaining int64
+	exceeded  error
+}
+
+func (b *limitedBody) Read(p []byte) (n int, err error) {
+	if b.exceeded != nil {
+		return 0, b.exceeded
+	}
+	// read one byte more than allowed to detect a body that exceeds the limit
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err = b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		b.exceeded = payloadTooLarge(-1, b.limit)
+		return n, b.exceeded
+	}
+	return n, err
+}
+
+// limitBody limits the size of the response body that can be read
+func limitBody(response *http.Response, limit int) {
+	body := &limitedBody{ReadCloser: response.Body, limit: limit, remaining: int64(limit)}
+	if response.ContentLength > int64(limit) {
+		body.exceeded = payloadTooLarge(response.ContentLength, limit)
+	}
+	response.Body = body
+}
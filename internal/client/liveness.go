@@ -0,0 +1,101 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/clock"
+)
+
+// Liveness reports the health of the contact of a connection with AM or the Thing Gateway, so that a watchdog can
+// decide when to reset the network stack or reboot the device
+type Liveness struct {
+	// LastContact is the time of the last response from AM or the Thing Gateway, zero if none has been received
+	LastContact time.Time `json:"lastContact,omitempty"`
+	// LastFailure is the time of the last request that failed because AM or the Thing Gateway could not be reached
+	LastFailure time.Time `json:"lastFailure,omitempty"`
+	// LastError describes the last failed request
+	LastError string `json:"lastError,omitempty"`
+	// Requests is the number of requests made with the connection
+	Requests uint64 `json:"requests"`
+	// Failures is the number of requests that failed because AM or the Thing Gateway could not be reached
+	Failures uint64 `json:"failures"`
+	// ConsecutiveFailures is the number of failures since the last contact
+	ConsecutiveFailures uint64 `json:"consecutiveFailures"`
+}
+
+// livenessMonitor records the outcome of the requests made with a connection
+type livenessMonitor struct {
+	mutex    sync.Mutex
+	liveness Liveness
+}
+
+// record the outcome of a request. A request that receives any response other than one reporting that AM can not be
+// reached counts as contact, even if the request was rejected.
+func (m *livenessMonitor) record(err error) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.liveness.Requests++
+	if err != nil && errors.Is(err, ErrAMUnreachable) {
+		m.liveness.LastFailure = clock.Clock()
+		m.liveness.LastError = err.Error()
+		m.liveness.Failures++
+		m.liveness.ConsecutiveFailures++
+		return
+	}
+	m.liveness.LastContact = clock.Clock()
+	m.liveness.ConsecutiveFailures = 0
+}
+
+// recordResponse records a response with the given status, which is a failure if the class of the status is
+// ErrAMUnreachable
+func (m *livenessMonitor) recordResponse(class error, status interface{}) {
+	if class == ErrAMUnreachable {
+		m.record(fmt.Errorf("%w: response status %v", class, status))
+		return
+	}
+	m.record(nil)
+}
+
+// snapshot returns the current liveness
+func (m *livenessMonitor) snapshot() Liveness {
+	if m == nil {
+		return Liveness{}
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.liveness
+}
+
+// ConnectionLiveness returns the liveness of the connection. Connections over transports registered with package
+// transport do not record their requests and report a zero liveness.
+func ConnectionLiveness(connection Connection) Liveness {
+	switch c := connection.(type) {
+	case *amConnection:
+		return c.liveness.snapshot()
+	case *gatewayConnection:
+		return c.liveness.snapshot()
+	}
+	return Liveness{}
+}
@@ -21,14 +21,28 @@ import (
 	"encoding/json"
 
 	"github.com/JacoJooste/iot-edge/v7/pkg/callback"
+	"gopkg.in/square/go-jose.v2"
 )
 
 // AMInfoResponse contains the information required to construct valid signed JWTs
 type AMInfoResponse struct {
+	// BaseURL is the URL of AM that the paths of signed requests are relative to
+	BaseURL        string
 	Realm          string
 	AccessTokenURL string
 	AttributesURL  string
+	PolicyURL      string
 	ThingsVersion  string
+	// SigningAlgorithms are the JWS algorithms that AM accepts for signed JWTs. Empty if AM did not advertise them.
+	SigningAlgorithms []string `json:",omitempty"`
+}
+
+// AMInfo contains the information about AM that a connection otherwise discovers, so that it can be stored and provided
+// when the connection is created, see ConnectionBuilder.WithAMInfo
+type AMInfo struct {
+	AMInfoResponse
+	// CookieName is the name of the AM session cookie. Empty for connections to the Thing Gateway.
+	CookieName string `json:",omitempty"`
 }
 
 // AuthenticatePayload represents the outbound and inbound data during an authentication request
@@ -41,6 +55,25 @@ type AuthenticatePayload struct {
 
 type GetAccessTokenPayload struct {
 	Scope []string `json:"scope,omitempty"`
+	// Group requests a token scoped to the AM group with the given ID, of which the thing must be a member
+	Group string `json:"group,omitempty"`
+	// SubjectToken asserts the identity of a child thing that is the subject of the requested token, see rfc8693
+	SubjectToken     string `json:"subject_token,omitempty"`
+	SubjectTokenType string `json:"subject_token_type,omitempty"`
+}
+
+// PolicyDecisionPayload contains a request for the evaluation of AM policies
+type PolicyDecisionPayload struct {
+	Resources   []string       `json:"resources"`
+	Application string         `json:"application,omitempty"`
+	Subject     *PolicySubject `json:"subject,omitempty"`
+	// Actions are the actions for which the decision is requested, AM evaluates all the actions of the application
+	Actions []string `json:"actions,omitempty"`
+}
+
+// PolicySubject identifies the subject of a policy evaluation by its session token
+type PolicySubject struct {
+	SSOToken string `json:"ssoToken"`
 }
 
 // SessionToken holds a session token
@@ -54,16 +87,93 @@ type ThingEndpointPayload struct {
 	Payload string `json:"payload,omitempty"`
 }
 
+// LocalTokenPayload contains a request for an access token issued by the Thing Gateway for a site-local service
+type LocalTokenPayload struct {
+	Audience string   `json:"audience,omitempty"`
+	Scope    []string `json:"scope,omitempty"`
+	// Confirmation contains the public key with which the request is signed, which the gateway checks against the key
+	// with which the thing authenticated
+	Confirmation *ConfirmationClaim `json:"cnf,omitempty"`
+	// IssuedAt and Expiry bound the time for which the signed request is valid and ID identifies the request, so that
+	// the gateway can reject a request that is replayed
+	IssuedAt int64  `json:"iat,omitempty"`
+	Expiry   int64  `json:"exp,omitempty"`
+	ID       string `json:"jti,omitempty"`
+}
+
+// ConfirmationClaim contains the public key with which a signed JWT is signed
+type ConfirmationClaim struct {
+	JWK jose.JSONWebKey `json:"jwk"`
+}
+
+// AttributesPagePayload contains a page of the attributes of a thing and the continuation token of the next page,
+// which is empty if the page is the last
+type AttributesPagePayload struct {
+	Attributes json.RawMessage `json:"attributes"`
+	Next       string          `json:"next,omitempty"`
+}
+
 // IntrospectPayload contains an introspection request as defined by rfc7662
 type IntrospectPayload struct {
 	Token         string `json:"token"`
 	TokenTypeHint string `json:"token_type_hint,omitempty"`
 }
 
+// OSCOREClaims contains the claims of the signed JWT with which a thing requests an OSCORE security context
+type OSCOREClaims struct {
+	// Confirmation contains the public key with which the JWT is signed
+	Confirmation struct {
+		JWK jose.JSONWebKey `json:"jwk"`
+	} `json:"cnf"`
+	// EphemeralKey is the public key contributed by the thing to the key agreement
+	EphemeralKey jose.JSONWebKey `json:"epk"`
+}
+
+// OSCOREPayload contains the parameters contributed by the Thing Gateway to an OSCORE security context
+type OSCOREPayload struct {
+	// EphemeralKey is the public key contributed by the gateway to the key agreement
+	EphemeralKey jose.JSONWebKey `json:"epk"`
+	Salt         []byte          `json:"salt"`
+	// SenderID is the ID assigned to the thing and RecipientID the ID used by the gateway
+	SenderID    []byte `json:"sid"`
+	RecipientID []byte `json:"rid"`
+}
+
+// OAuth2ClientMetadata contains the metadata of an OAuth 2.0 client that is registered dynamically, as defined by
+// rfc7591
+type OAuth2ClientMetadata struct {
+	ClientName              string              `json:"client_name,omitempty"`
+	RedirectURIs            []string            `json:"redirect_uris,omitempty"`
+	TokenEndpointAuthMethod string              `json:"token_endpoint_auth_method,omitempty"`
+	GrantTypes              []string            `json:"grant_types,omitempty"`
+	ResponseTypes           []string            `json:"response_types,omitempty"`
+	Scope                   string              `json:"scope,omitempty"`
+	JWKS                    *jose.JSONWebKeySet `json:"jwks,omitempty"`
+	JWKSURI                 string              `json:"jwks_uri,omitempty"`
+	SoftwareID              string              `json:"software_id,omitempty"`
+	SoftwareVersion         string              `json:"software_version,omitempty"`
+	SoftwareStatement       string              `json:"software_statement,omitempty"`
+}
+
+// OAuth2ClientInformation contains the credentials and metadata of a dynamically registered OAuth 2.0 client
+type OAuth2ClientInformation struct {
+	OAuth2ClientMetadata
+	ClientID                string `json:"client_id"`
+	ClientSecret            string `json:"client_secret,omitempty"`
+	ClientIDIssuedAt        int64  `json:"client_id_issued_at,omitempty"`
+	ClientSecretExpiresAt   int64  `json:"client_secret_expires_at,omitempty"`
+	RegistrationAccessToken string `json:"registration_access_token,omitempty"`
+	RegistrationClientURI   string `json:"registration_client_uri,omitempty"`
+}
+
 func (p GetAccessTokenPayload) String() string {
 	return payloadToString(p)
 }
 
+func (p PolicyDecisionPayload) String() string {
+	return payloadToString(p)
+}
+
 // HasSessionToken returns true if the payload contains a session token
 // Indicates that the authentication workflow has completed successfully
 func (p AuthenticatePayload) HasSessionToken() bool {
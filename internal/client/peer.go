@@ -0,0 +1,138 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"net/http"
+
+	"github.com/go-ocf/go-coap"
+)
+
+// Peer information
+// AM sees the Thing Gateway as the client of all the requests that the gateway makes on behalf of things. So that the
+// AM audit logs and authentication trees can identify the actual device, the gateway forwards information about the
+// transport peer of a thing with its authentication and access token requests:
+//    - the address of the thing in the X-Forwarded-For header, in the same way as a reverse proxy. AM must trust the
+//      gateway as a proxy for the address to be used as the client IP.
+//    - the subject of the client certificate that the thing presented during the handshake, if the gateway verifies
+//      client certificates, in the PeerIdentityHeader
+//    - metadata about the link of the thing, such as its signal strength, in the LinkMetadataHeader. The metadata is
+//      provided by the thing in the LinkMetadataOption CoAP option, the gateway forwards it without interpretation.
+// A gateway that is chained through an upstream gateway forwards the same information in the ForwardedForOption,
+// PeerIdentityOption and LinkMetadataOption CoAP options instead, see ForwardedPeer.
+
+const (
+	// ForwardedForHeader is the HTTP header in which the address of a thing is forwarded to AM
+	ForwardedForHeader = "X-Forwarded-For"
+	// PeerIdentityHeader is the HTTP header in which the verified transport identity of a thing is forwarded to AM
+	PeerIdentityHeader = "X-Peer-Identity"
+	// LinkMetadataHeader is the HTTP header in which the link metadata of a thing is forwarded to AM
+	LinkMetadataHeader = "X-Link-Metadata"
+)
+
+// LinkMetadataOption is the CoAP option in which a thing sends metadata about its link to the Thing Gateway.
+// The option number is from the experimental range and is elective so that it is ignored by gateways that do not
+// support it.
+const LinkMetadataOption coap.OptionID = 65004
+
+// ForwardedForOption and PeerIdentityOption are the CoAP options in which a Thing Gateway forwards the address and the
+// verified identity of a thing to an upstream gateway. Both option numbers are from the experimental range and are
+// elective.
+const (
+	ForwardedForOption coap.OptionID = 65008
+	PeerIdentityOption coap.OptionID = 65012
+)
+
+// PeerInfo describes the transport peer of a thing
+type PeerInfo struct {
+	// Address is the IP address of the thing
+	Address string
+	// Identity is the subject of the verified client certificate of the thing
+	Identity string
+	// LinkMetadata is the metadata provided by the thing about its link, for example "rssi=-71;snr=7"
+	LinkMetadata string
+}
+
+// setHeaders adds the peer information to the request
+func (p PeerInfo) setHeaders(request *http.Request) {
+	for header, value := range map[string]string{
+		ForwardedForHeader: p.Address,
+		PeerIdentityHeader: p.Identity,
+		LinkMetadataHeader: p.LinkMetadata,
+	} {
+		if value != "" {
+			request.Header.Set(header, value)
+		}
+	}
+}
+
+// setOptions adds the peer information to the CoAP request
+func (p PeerInfo) setOptions(request coap.Message) {
+	for option, value := range map[coap.OptionID]string{
+		ForwardedForOption: p.Address,
+		PeerIdentityOption: p.Identity,
+		LinkMetadataOption: p.LinkMetadata,
+	} {
+		if value != "" {
+			request.SetOption(option, []byte(value))
+		}
+	}
+}
+
+// WithPeer returns a connection that forwards the peer information of a thing with all its requests, to AM in HTTP
+// headers and to an upstream Thing Gateway in CoAP options. The returned connection shares the state of the given
+// connection. Connections over registered transports are returned unchanged.
+func WithPeer(connection Connection, peer PeerInfo) Connection {
+	if peer == (PeerInfo{}) {
+		return connection
+	}
+	switch c := connection.(type) {
+	case *amConnection:
+		forwarding := *c
+		forwarding.peer = peer
+		return &forwarding
+	case *gatewayConnection:
+		forwarding := *c
+		forwarding.peer = peer
+		return &forwarding
+	}
+	return connection
+}
+
+// ForwardedPeer returns the peer information that a Thing Gateway forwarded with the CoAP message. The information
+// must only be trusted if the sender is a trusted gateway.
+func ForwardedPeer(message coap.Message) PeerInfo {
+	option := func(id coap.OptionID) string {
+		if value, ok := message.Option(id).([]byte); ok {
+			return string(value)
+		}
+		return ""
+	}
+	return PeerInfo{
+		Address:      option(ForwardedForOption),
+		Identity:     option(PeerIdentityOption),
+		LinkMetadata: option(LinkMetadataOption),
+	}
+}
+
+// LinkMetadata returns the link metadata sent with the CoAP message, if it has any
+func LinkMetadata(message coap.Message) string {
+	if metadata, ok := message.Option(LinkMetadataOption).([]byte); ok {
+		return string(metadata)
+	}
+	return ""
+}
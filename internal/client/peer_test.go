@@ -0,0 +1,86 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-ocf/go-coap"
+)
+
+func TestAMClient_PeerInfo(t *testing.T) {
+	var headers []http.Header
+	mux := testServerInfoHTTPMux(http.StatusOK, testServerInfo())
+	mux.HandleFunc(testHTTPAccessTokenEndpoint, func(writer http.ResponseWriter, request *http.Request) {
+		headers = append(headers, request.Header)
+		_, _ = writer.Write([]byte("{}"))
+	})
+	server := httptest.NewTLSServer(mux)
+	defer server.Close()
+	c := &amConnection{baseURL: server.URL}
+	testSetRootCAs(c, server)
+	if err := c.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+
+	peer := PeerInfo{Address: "192.0.2.7", Identity: "CN=thing-1", LinkMetadata: "rssi=-71"}
+	if _, err := WithPeer(c, peer).AccessToken("aToken", ApplicationJOSE, "aSignedWT"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.AccessToken("aToken", ApplicationJOSE, "aSignedWT"); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		ForwardedForHeader: peer.Address,
+		PeerIdentityHeader: peer.Identity,
+		LinkMetadataHeader: peer.LinkMetadata,
+	}
+	for header, value := range expected {
+		if forwarded := headers[0].Get(header); forwarded != value {
+			t.Errorf("expected %s %s; got %s", header, value, forwarded)
+		}
+		// the original connection does not forward the peer
+		if forwarded := headers[1].Get(header); forwarded != "" {
+			t.Errorf("unexpected %s %s", header, forwarded)
+		}
+	}
+	if WithPeer(c, PeerInfo{}) != Connection(c) {
+		t.Error("expected the connection to be unchanged without peer information")
+	}
+}
+
+func TestGatewayConnection_PeerOptions(t *testing.T) {
+	c := &gatewayConnection{}
+	peer := PeerInfo{Address: "192.0.2.7", Identity: "CN=thing-1", LinkMetadata: "rssi=-71"}
+	forwarding, ok := WithPeer(c, peer).(*gatewayConnection)
+	if !ok || forwarding == c {
+		t.Fatal("expected a new connection to the gateway")
+	}
+	request := coap.NewDgramMessage(coap.MessageParams{})
+	forwarding.describeLink(request)
+	if forwarded := ForwardedPeer(request); forwarded != peer {
+		t.Errorf("expected %v; got %v", peer, forwarded)
+	}
+	// the original connection does not forward the peer
+	request = coap.NewDgramMessage(coap.MessageParams{})
+	c.describeLink(request)
+	if forwarded := ForwardedPeer(request); forwarded != (PeerInfo{}) {
+		t.Errorf("unexpected forwarded peer %v", forwarded)
+	}
+}
@@ -0,0 +1,193 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/debug"
+)
+
+// Request priorities
+// A connection to AM that is shared by many things, such as the connection of the Thing Gateway, can limit the number
+// of requests that it makes to AM at the same time. Requests in excess of the limit wait in a queue per class:
+//    - critical requests, authentication, session and access token requests, on which the things depend to stay
+//      connected
+//    - configuration requests, such as AM information, key sets, policy decisions and signed requests
+//    - bulk requests, the reads and writes of thing attributes
+// When a request completes, the oldest waiting request of the highest class is sent. A number of the concurrent
+// requests is reserved for critical requests so that a burst of bulk attribute syncs can never occupy all of them.
+// A request that waits longer than the queue timeout fails with ErrThrottled without being sent to AM.
+
+// RequestPriorities limit the requests that a connection makes to AM at the same time
+type RequestPriorities struct {
+	// MaxConcurrent is the maximum number of requests sent to AM at the same time, requests are not limited if zero
+	MaxConcurrent int
+	// Reserved is the number of the concurrent requests that only critical requests may use
+	Reserved int
+	// QueueTimeout is the maximum time that a request waits to be sent, defaults to the request timeout
+	QueueTimeout time.Duration
+}
+
+// Validate checks that the priorities are consistent
+func (p RequestPriorities) Validate() error {
+	if p.MaxConcurrent < 0 || p.Reserved < 0 || p.QueueTimeout < 0 {
+		return fmt.Errorf("request priorities must not be negative")
+	}
+	if p.MaxConcurrent > 0 && p.Reserved >= p.MaxConcurrent {
+		return fmt.Errorf("reserved requests must be fewer than the maximum number of concurrent requests")
+	}
+	return nil
+}
+
+// requestClass is the priority class of a request, lower values are sent first
+type requestClass int
+
+const (
+	classCritical requestClass = iota
+	classConfig
+	classBulk
+	classCount
+)
+
+func (c requestClass) String() string {
+	return [...]string{"critical", "config", "bulk"}[c]
+}
+
+// classifyRequest returns the priority class of a request to AM
+func classifyRequest(request *http.Request) requestClass {
+	path := request.URL.Path
+	switch {
+	case strings.HasSuffix(path, "/json/authenticate"), strings.HasSuffix(path, "/json/sessions"):
+		return classCritical
+	case strings.HasSuffix(path, "/json/things/*"):
+		if request.URL.Query().Get("_action") == "get_access_token" {
+			return classCritical
+		}
+		return classBulk
+	}
+	return classConfig
+}
+
+// requestScheduler admits requests to AM in order of their class
+type requestScheduler struct {
+	priorities RequestPriorities
+	mutex      sync.Mutex
+	active     int
+	// waiting requests per class, in the order in which they arrived
+	waiting [classCount][]chan struct{}
+}
+
+// newRequestScheduler returns a scheduler for the priorities, or nil if requests are not limited
+func newRequestScheduler(priorities RequestPriorities, timeout time.Duration) *requestScheduler {
+	if priorities.MaxConcurrent == 0 {
+		return nil
+	}
+	if priorities.QueueTimeout == 0 {
+		priorities.QueueTimeout = timeout
+	}
+	return &requestScheduler{priorities: priorities}
+}
+
+// admits returns true if a request of the class can be sent now, the caller must hold the lock
+func (s *requestScheduler) admits(class requestClass) bool {
+	limit := s.priorities.MaxConcurrent
+	if class != classCritical {
+		limit -= s.priorities.Reserved
+	}
+	return s.active < limit
+}
+
+// acquire waits until a request of the class may be sent
+func (s *requestScheduler) acquire(class requestClass) error {
+	if s == nil {
+		return nil
+	}
+	s.mutex.Lock()
+	if s.admits(class) && s.queued(class) == 0 {
+		s.active++
+		s.mutex.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	s.waiting[class] = append(s.waiting[class], ready)
+	s.mutex.Unlock()
+	debug.Tracef("Queued %s request to AM", class)
+
+	var expired <-chan time.Time
+	if s.priorities.QueueTimeout > 0 {
+		timer := time.NewTimer(s.priorities.QueueTimeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-ready:
+		return nil
+	case <-expired:
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.remove(class, ready) {
+		// admitted while the timer expired
+		return nil
+	}
+	return fmt.Errorf("%w: %s request queued for longer than %v", ErrThrottled, class, s.priorities.QueueTimeout)
+}
+
+// queued returns the number of waiting requests of the class or of a higher class, the caller must hold the lock
+func (s *requestScheduler) queued(class requestClass) (n int) {
+	for c := classCritical; c <= class; c++ {
+		n += len(s.waiting[c])
+	}
+	return n
+}
+
+// remove the waiting request, returns false if the request is no longer waiting. The caller must hold the lock.
+func (s *requestScheduler) remove(class requestClass, ready chan struct{}) bool {
+	for i, r := range s.waiting[class] {
+		if r == ready {
+			s.waiting[class] = append(s.waiting[class][:i], s.waiting[class][i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// release frees the place of a completed request and admits the waiting requests that fit
+func (s *requestScheduler) release() {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.active--
+	for class := classCritical; class < classCount; class++ {
+		for len(s.waiting[class]) > 0 && s.admits(class) {
+			s.active++
+			close(s.waiting[class][0])
+			s.waiting[class] = s.waiting[class][1:]
+		}
+		if len(s.waiting[class]) > 0 {
+			// lower classes wait until all requests of this class have been admitted
+			return
+		}
+	}
+}
@@ -0,0 +1,186 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClassifyRequest(t *testing.T) {
+	tests := []struct {
+		url   string
+		class requestClass
+	}{
+		{url: "https://am/json/authenticate?authIndexType=service", class: classCritical},
+		{url: "https://am/json/sessions?_action=validate", class: classCritical},
+		{url: "https://am/json/things/*?_action=get_access_token&realm=/", class: classCritical},
+		{url: "https://am/json/things/*?_fields=thingConfig", class: classBulk},
+		{url: "https://am/json/serverinfo/*", class: classConfig},
+		{url: "https://am/json/policies?_action=evaluate", class: classConfig},
+		{url: "https://am/oauth2/connect/jwk_uri", class: classConfig},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.url, func(t *testing.T) {
+			request, err := http.NewRequest(http.MethodPost, subtest.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if class := classifyRequest(request); class != subtest.class {
+				t.Errorf("expected %s; got %s", subtest.class, class)
+			}
+		})
+	}
+}
+
+func TestRequestPriorities_Validate(t *testing.T) {
+	tests := []struct {
+		name       string
+		priorities RequestPriorities
+		valid      bool
+	}{
+		{name: "unlimited", priorities: RequestPriorities{}, valid: true},
+		{name: "limited", priorities: RequestPriorities{MaxConcurrent: 4, Reserved: 1, QueueTimeout: time.Second}, valid: true},
+		{name: "negative", priorities: RequestPriorities{MaxConcurrent: -1}},
+		{name: "all-reserved", priorities: RequestPriorities{MaxConcurrent: 2, Reserved: 2}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			if err := subtest.priorities.Validate(); (err == nil) != subtest.valid {
+				t.Errorf("unexpected result %v", err)
+			}
+		})
+	}
+}
+
+// testQueue starts a request of the class that waits for its turn and returns a channel that reports when it is sent
+func testQueue(s *requestScheduler, class requestClass) chan error {
+	sent := make(chan error, 1)
+	before := s.queuedRequests()
+	go func() {
+		sent <- s.acquire(class)
+	}()
+	// wait until the request is queued so that the order of arrival is known
+	for s.queuedRequests() == before {
+		time.Sleep(time.Millisecond)
+	}
+	return sent
+}
+
+// queuedRequests returns the number of waiting requests
+func (s *requestScheduler) queuedRequests() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.queued(classBulk)
+}
+
+func testSent(t *testing.T, sent chan error, expected bool) {
+	select {
+	case err := <-sent:
+		if !expected {
+			t.Fatal("request sent before its turn")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(50 * time.Millisecond):
+		if expected {
+			t.Fatal("request not sent")
+		}
+	}
+}
+
+func TestRequestScheduler_Order(t *testing.T) {
+	s := newRequestScheduler(RequestPriorities{MaxConcurrent: 1}, time.Minute)
+	if err := s.acquire(classConfig); err != nil {
+		t.Fatal(err)
+	}
+	bulk := testQueue(s, classBulk)
+	config := testQueue(s, classConfig)
+	critical := testQueue(s, classCritical)
+
+	for _, next := range []chan error{critical, config, bulk} {
+		s.release()
+		testSent(t, next, true)
+	}
+	s.release()
+}
+
+func TestRequestScheduler_Reserved(t *testing.T) {
+	s := newRequestScheduler(RequestPriorities{MaxConcurrent: 2, Reserved: 1}, time.Minute)
+	if err := s.acquire(classBulk); err != nil {
+		t.Fatal(err)
+	}
+	bulk := testQueue(s, classBulk)
+	// the reserved request is available to critical requests only
+	if err := s.acquire(classCritical); err != nil {
+		t.Fatal(err)
+	}
+	s.release()
+	testSent(t, bulk, false)
+	s.release()
+	testSent(t, bulk, true)
+}
+
+func TestRequestScheduler_QueueTimeout(t *testing.T) {
+	s := newRequestScheduler(RequestPriorities{MaxConcurrent: 1, QueueTimeout: 10 * time.Millisecond}, time.Minute)
+	if err := s.acquire(classBulk); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.acquire(classCritical); !errors.Is(err, ErrThrottled) {
+		t.Errorf("expected %v; got %v", ErrThrottled, err)
+	}
+	if s.queuedRequests() != 0 {
+		t.Error("expired request still queued")
+	}
+}
+
+func TestAMClient_RequestPriorities(t *testing.T) {
+	blocked := make(chan struct{})
+	unblock := make(chan struct{})
+	mux := testServerInfoHTTPMux(http.StatusOK, testServerInfo())
+	mux.HandleFunc(testHTTPAttributesEndpoint, func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Query().Get("_action") != "get_access_token" {
+			blocked <- struct{}{}
+			<-unblock
+		}
+		_, _ = writer.Write([]byte("{}"))
+	})
+	server := httptest.NewTLSServer(mux)
+	defer server.Close()
+	defer close(unblock)
+
+	c := &amConnection{baseURL: server.URL, realm: testRealm, authTree: testTree,
+		scheduler: newRequestScheduler(RequestPriorities{MaxConcurrent: 2, Reserved: 1, QueueTimeout: 50 * time.Millisecond}, time.Minute)}
+	testSetRootCAs(c, server)
+	if err := c.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	go c.Attributes("aToken", ApplicationJOSE, "aSignedWT", nil)
+	<-blocked
+
+	// the attributes request occupies the only unreserved request
+	if _, err := c.Attributes("aToken", ApplicationJOSE, "aSignedWT", nil); !errors.Is(err, ErrThrottled) {
+		t.Errorf("expected %v; got %v", ErrThrottled, err)
+	}
+	if _, err := c.AccessToken("aToken", ApplicationJOSE, "aSignedWT"); err != nil {
+		t.Errorf("access token request not sent; %v", err)
+	}
+}
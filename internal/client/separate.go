@@ -0,0 +1,151 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"context"
+	"sync"
+
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+)
+
+// Separate responses
+// A gateway that is waiting for a slow AM operation can acknowledge a confirmable request with an empty
+// acknowledgement and send the response later in a message of its own (RFC 7252 section 5.2.2). The response carries
+// the token of the request but not its message ID, so it is matched to the request that is waiting for it by token.
+
+// separateResponses matches separate responses from the gateway to the requests that are waiting for them
+type separateResponses struct {
+	mutex   sync.Mutex
+	pending map[string]*separateResponse
+}
+
+// separateResponse is a request that is waiting for a response
+type separateResponse struct {
+	response chan coap.Message
+	cancel   context.CancelFunc
+}
+
+func newSeparateResponses() *separateResponses {
+	return &separateResponses{pending: make(map[string]*separateResponse)}
+}
+
+// exchange sends the request and waits for the piggybacked or the separate response, whichever arrives first
+func (s *separateResponses) exchange(ctx context.Context, conn *coap.ClientConn, request coap.Message) (coap.Message, error) {
+	exchangeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	token := string(request.Token())
+	pending := &separateResponse{response: make(chan coap.Message, 1), cancel: cancel}
+	s.mutex.Lock()
+	s.pending[token] = pending
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.pending, token)
+		s.mutex.Unlock()
+	}()
+
+	response, err := conn.ExchangeWithContext(exchangeCtx, request)
+	if err != nil {
+		select {
+		case response = <-pending.response:
+			return remainingBlocks(ctx, conn, request, response)
+		default:
+		}
+		return nil, err
+	}
+	return response, nil
+}
+
+// remainingBlocks requests the blocks that follow the first block of a separate response and returns the response
+// with the complete payload
+// Block-wise transfer of piggybacked responses is handled by go-coap but the blocks of a separate response must be
+// requested by the client, see RFC 7959 section 2.4.
+func remainingBlocks(ctx context.Context, conn *coap.ClientConn, request, response coap.Message) (coap.Message, error) {
+	block, ok := response.Option(coap.Block2).(uint32)
+	if !ok {
+		return response, nil
+	}
+	payload := append([]byte(nil), response.Payload()...)
+	for {
+		szx, num, more, err := coap.UnmarshalBlockOption(block)
+		if err != nil {
+			return nil, err
+		}
+		if !more {
+			break
+		}
+		next := conn.NewMessage(coap.MessageParams{
+			Type:      coap.Confirmable,
+			Code:      request.Code(),
+			MessageID: coap.GenerateMessageID(),
+			Token:     request.Token(),
+		})
+		for _, option := range request.AllOptions() {
+			switch option.ID {
+			case coap.ContentFormat, coap.Block1, coap.Block2, coap.Size1:
+			default:
+				next.AddOption(option.ID, option.Value)
+			}
+		}
+		if block, err = coap.MarshalBlockOption(szx, num+1, false); err != nil {
+			return nil, err
+		}
+		next.SetOption(coap.Block2, block)
+		if response, err = conn.ExchangeWithContext(ctx, next); err != nil {
+			return nil, err
+		}
+		if block, ok = response.Option(coap.Block2).(uint32); !ok {
+			return nil, coap.ErrInvalidOptionBlock2
+		}
+		payload = append(payload, response.Payload()...)
+	}
+	response.RemoveOption(coap.Block2)
+	response.RemoveOption(coap.Size2)
+	response.SetPayload(payload)
+	return response, nil
+}
+
+// handle receives the messages from the gateway that are not piggybacked responses
+func (s *separateResponses) handle(w coap.ResponseWriter, r *coap.Request) {
+	if r.Msg.Code() == codes.Empty {
+		// empty acknowledgement of a request whose response will follow
+		return
+	}
+	s.mutex.Lock()
+	pending, ok := s.pending[string(r.Msg.Token())]
+	s.mutex.Unlock()
+	if !ok {
+		coap.DefaultServeMux.ServeCOAP(w, r)
+		return
+	}
+	if r.Msg.Type() == coap.Confirmable {
+		ack := r.Client.NewMessage(coap.MessageParams{
+			Type:      coap.Acknowledgement,
+			Code:      codes.Empty,
+			MessageID: r.Msg.MessageID(),
+		})
+		_ = r.Client.WriteMsg(ack)
+	}
+	select {
+	case pending.response <- r.Msg:
+		pending.cancel()
+	default:
+		// duplicate of a response that has already been received
+	}
+}
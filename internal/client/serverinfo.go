@@ -0,0 +1,77 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"errors"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/clock"
+)
+
+// Server information
+// A thing can check its environment before it signs anything with a lightweight, unauthenticated request to the Thing
+// Gateway at RouteServerInfo. The gateway reports its time, the realm in which it authenticates things, the content
+// types that it accepts and the version of the protocol between things and the gateway, so that a thing can tell
+// whether its clock is too far out for its JWTs to be accepted, or whether it speaks a protocol that the gateway does
+// not, instead of failing authentication without knowing why.
+
+// RouteServerInfo is the route at which the Thing Gateway reports information about itself
+const RouteServerInfo = "/serverinfo"
+
+// GatewayProtocolVersion is the version of the protocol between things and the Thing Gateway. It is incremented when a
+// change is made that things of the previous version can not use.
+const GatewayProtocolVersion = 1
+
+// ServerInfoPayload contains the information that the Thing Gateway reports about itself
+type ServerInfoPayload struct {
+	// Time of the gateway, in milliseconds since the epoch
+	Time int64 `json:"time"`
+	// Realm in which the gateway authenticates things
+	Realm string `json:"realm"`
+	// ContentTypes are the content types of the payloads that the gateway accepts
+	ContentTypes []string `json:"contentTypes"`
+	// ProtocolVersion is the GatewayProtocolVersion of the gateway
+	ProtocolVersion int `json:"protocolVersion"`
+	// ThingsVersion is the version of the AM things endpoint that the gateway uses
+	ThingsVersion string `json:"thingsVersion,omitempty"`
+}
+
+// errServerInfoUnsupported is returned when the server information can not be requested over the connection
+var errServerInfoUnsupported = errors.New("the connection does not report server information")
+
+// serverInformer is implemented by connections that can request information about the server
+type serverInformer interface {
+	ServerInfo() (ServerInfoPayload, error)
+}
+
+// RequestServerInfo requests information about the server at the end of the connection and returns it together with
+// the estimated offset of the server clock from the device clock
+func RequestServerInfo(connection Connection) (info ServerInfoPayload, offset time.Duration, err error) {
+	informer, ok := connection.(serverInformer)
+	if !ok {
+		return info, offset, errServerInfoUnsupported
+	}
+	sent := clock.Clock()
+	if info, err = informer.ServerInfo(); err != nil {
+		return info, offset, err
+	}
+	var estimate Clock
+	estimate.observe(time.Unix(0, info.Time*int64(time.Millisecond)), time.Millisecond, sent, clock.Clock())
+	offset, _ = estimate.Offset()
+	return info, offset, nil
+}
@@ -0,0 +1,54 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+// Shared connections
+// A device that hosts several logical things, for example one thing per tenant application, can connect all of them
+// over the transport of a single connection. Each thing authenticates with its own key and keeps its own session, and
+// therefore its own requests, while the connections returned by ShareConnection send them over the same transport:
+//    - connections to AM share the HTTP client, and with it the pool of HTTP connections, the state learnt from AM and
+//      the request priorities
+//    - connections to the Thing Gateway share the DTLS or TLS session with the gateway and its keep-alive. An OSCORE
+//      security context is bound to the key of a thing and is therefore established per shared connection.
+// The liveness of the transport is shared by all the connections. The transport identity of the device, such as the
+// certificate presented to the Thing Gateway during the handshake, is that of the original connection.
+
+// ShareConnection returns a connection for another thing that sends its requests over the transport of the given
+// connection. Connections over registered transports are returned unchanged.
+func ShareConnection(connection Connection) Connection {
+	switch c := connection.(type) {
+	case *amConnection:
+		shared := *c
+		shared.transactionID = ""
+		shared.clientCertificate = nil
+		shared.peer = PeerInfo{}
+		shared.authContext = AuthContext{}
+		return &shared
+	case *gatewayConnection:
+		shared := *c
+		shared.oscore = nil
+		shared.peer = PeerInfo{}
+		shared.idempotencyKey = ""
+		shared.authContext = AuthContext{}
+		// the session is closed when the connection that created it is freed, so it must outlive the shared connection
+		if shared.owner == nil {
+			shared.owner = c
+		}
+		return &shared
+	}
+	return connection
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/oscore"
+)
+
+func TestShareConnection_AM(t *testing.T) {
+	var headers []http.Header
+	mux := testServerInfoHTTPMux(http.StatusOK, testServerInfo())
+	mux.HandleFunc(testHTTPAccessTokenEndpoint, func(writer http.ResponseWriter, request *http.Request) {
+		headers = append(headers, request.Header)
+		_, _ = writer.Write([]byte("{}"))
+	})
+	server := httptest.NewTLSServer(mux)
+	defer server.Close()
+	c := &amConnection{baseURL: server.URL}
+	testSetRootCAs(c, server)
+	if err := c.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	original := WithPeer(WithTransactionID(c, "aTransaction"), PeerInfo{Address: "192.0.2.7"})
+
+	shared, ok := ShareConnection(original).(*amConnection)
+	if !ok {
+		t.Fatal("expected a connection to AM")
+	}
+	if shared.state != c.state || shared.liveness != c.liveness {
+		t.Error("expected the shared connection to share the state of the transport")
+	}
+	if _, err := shared.AccessToken("aToken", ApplicationJOSE, "aSignedWT"); err != nil {
+		t.Fatal(err)
+	}
+	// the shared connection makes requests on behalf of another thing
+	if forwarded := headers[0].Get(ForwardedForHeader); forwarded != "" {
+		t.Errorf("unexpected %s %s", ForwardedForHeader, forwarded)
+	}
+	if shared.transactionID != "" {
+		t.Errorf("unexpected transaction ID %s", shared.transactionID)
+	}
+}
+
+func TestShareConnection_Gateway(t *testing.T) {
+	c := &gatewayConnection{
+		session:  &coapSession{},
+		liveness: &livenessMonitor{},
+		oscore:   &oscore.Context{},
+	}
+	shared, ok := ShareConnection(c).(*gatewayConnection)
+	if !ok {
+		t.Fatal("expected a connection to the gateway")
+	}
+	if shared == c || shared.session != c.session || shared.liveness != c.liveness {
+		t.Error("expected a new connection that shares the session")
+	}
+	if shared.oscore != nil {
+		t.Error("expected the OSCORE context not to be shared")
+	}
+	// the session remains owned by the connection that created it
+	for _, s := range []*gatewayConnection{shared, ShareConnection(shared).(*gatewayConnection)} {
+		if s.owner != c {
+			t.Errorf("expected the owner to be the original connection; got %p", s.owner)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pion/dtls/v2"
+)
+
+// TLSProfile restricts the security parameters negotiated by the CoAP transports between things and the Thing Gateway
+// so that deployments can meet a compliance profile, for example only ECDHE with AES-CCM on constrained links. The
+// zero value uses the defaults of the transports.
+//
+// DTLS supports the cipher suites TLS_ECDHE_ECDSA_WITH_AES_128_CCM, TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8,
+// TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA
+// and TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA and only version 1.2. The curves of DTLS can not be restricted. TLS supports
+// the cipher suites of the crypto/tls package, which only apply to version 1.2 since the suites of version 1.3 are not
+// configurable.
+type TLSProfile struct {
+	// CipherSuites are the IANA names of the cipher suites that may be negotiated
+	CipherSuites []string
+	// Curves are the elliptic curves that may be used for key exchange: P-256, P-384, P-521 or X25519
+	Curves []string
+	// MinVersion is the minimum protocol version: 1.2 or 1.3
+	MinVersion string
+}
+
+var errTLSProfileInsecure = errors.New("TLS profile requires a secure transport")
+
+// dtlsCipherSuites are the cipher suites supported by DTLS
+var dtlsCipherSuites = []struct {
+	name string
+	id   dtls.CipherSuiteID
+}{
+	{"TLS_ECDHE_ECDSA_WITH_AES_128_CCM", dtls.TLS_ECDHE_ECDSA_WITH_AES_128_CCM},
+	{"TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8", dtls.TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8},
+	{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", dtls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", dtls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+	{"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA", dtls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA},
+	{"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA", dtls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA},
+}
+
+// tlsCurves are the curves supported by TLS
+var tlsCurves = []struct {
+	name string
+	id   tls.CurveID
+}{
+	{"P-256", tls.CurveP256},
+	{"P-384", tls.CurveP384},
+	{"P-521", tls.CurveP521},
+	{"X25519", tls.X25519},
+}
+
+// dtlsCipherSuite returns the ID of the DTLS cipher suite with the name
+func dtlsCipherSuite(name string) (dtls.CipherSuiteID, error) {
+	names := make([]string, len(dtlsCipherSuites))
+	for i, s := range dtlsCipherSuites {
+		if s.name == name {
+			return s.id, nil
+		}
+		names[i] = s.name
+	}
+	return 0, fmt.Errorf("DTLS cipher suite `%s` is not supported, must be one of %s", name, strings.Join(names, ", "))
+}
+
+// tlsCurve returns the ID of the curve with the name
+func tlsCurve(name string) (tls.CurveID, error) {
+	names := make([]string, len(tlsCurves))
+	for i, c := range tlsCurves {
+		if c.name == name {
+			return c.id, nil
+		}
+		names[i] = c.name
+	}
+	return 0, fmt.Errorf("curve `%s` is not supported, must be one of %s", name, strings.Join(names, ", "))
+}
+
+// tlsCipherSuite returns the ID of the TLS cipher suite with the name.
+// Suites with known security issues are not accepted.
+func tlsCipherSuite(name string) (uint16, bool) {
+	for _, s := range tls.CipherSuites() {
+		if s.Name == name {
+			return s.ID, true
+		}
+	}
+	return 0, false
+}
+
+// IsZero returns true if the profile does not restrict the security parameters
+func (p TLSProfile) IsZero() bool {
+	return len(p.CipherSuites) == 0 && len(p.Curves) == 0 && p.MinVersion == ""
+}
+
+// ValidateScheme checks that the profile can be applied to connections to URLs with the scheme
+func (p TLSProfile) ValidateScheme(scheme string) error {
+	if p.IsZero() {
+		return nil
+	}
+	if _, ok := connectionFactories[scheme]; !ok || IsAMScheme(scheme) {
+		return fmt.Errorf("TLS profile only applies to connections to the Thing Gateway, not `%s`", scheme)
+	}
+	switch coapNetwork(scheme) {
+	case "tcp-tls":
+		return p.ValidateTLS()
+	case "tcp":
+		return errTLSProfileInsecure
+	default:
+		return p.ValidateDTLS()
+	}
+}
+
+// ValidateDTLS checks that the profile can be applied to DTLS
+func (p TLSProfile) ValidateDTLS() error {
+	return p.ApplyDTLS(&dtls.Config{})
+}
+
+// ValidateTLS checks that the profile can be applied to TLS
+func (p TLSProfile) ValidateTLS() error {
+	return p.ApplyTLS(&tls.Config{})
+}
+
+// ApplyDTLS restricts the DTLS configuration to the profile
+func (p TLSProfile) ApplyDTLS(config *dtls.Config) error {
+	if len(p.Curves) > 0 {
+		return fmt.Errorf("curves can not be restricted over DTLS")
+	}
+	if p.MinVersion != "" && p.MinVersion != "1.2" {
+		return fmt.Errorf("DTLS version %s is not supported, must be 1.2", p.MinVersion)
+	}
+	var suites []dtls.CipherSuiteID
+	for _, name := range p.CipherSuites {
+		id, err := dtlsCipherSuite(name)
+		if err != nil {
+			return err
+		}
+		suites = append(suites, id)
+	}
+	config.CipherSuites = suites
+	return nil
+}
+
+// ApplyTLS restricts the TLS configuration to the profile
+func (p TLSProfile) ApplyTLS(config *tls.Config) error {
+	switch p.MinVersion {
+	case "":
+	case "1.2":
+		config.MinVersion = tls.VersionTLS12
+	case "1.3":
+		config.MinVersion = tls.VersionTLS13
+	default:
+		return fmt.Errorf("TLS version %s is not supported, must be 1.2 or 1.3", p.MinVersion)
+	}
+	var suites []uint16
+	for _, name := range p.CipherSuites {
+		id, ok := tlsCipherSuite(name)
+		if !ok {
+			return fmt.Errorf("TLS cipher suite `%s` is not supported", name)
+		}
+		suites = append(suites, id)
+	}
+	config.CipherSuites = suites
+	var curves []tls.CurveID
+	for _, name := range p.Curves {
+		id, err := tlsCurve(name)
+		if err != nil {
+			return err
+		}
+		curves = append(curves, id)
+	}
+	config.CurvePreferences = curves
+	return nil
+}
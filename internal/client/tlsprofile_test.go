@@ -0,0 +1,83 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/pion/dtls/v2"
+)
+
+func TestTLSProfile_ValidateScheme(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile TLSProfile
+		scheme  string
+		ok      bool
+	}{
+		{name: "zero-http", scheme: "https", ok: true},
+		{name: "zero-tcp", scheme: "coap+tcp", ok: true},
+		{name: "http", profile: TLSProfile{MinVersion: "1.2"}, scheme: "https"},
+		{name: "tcp", profile: TLSProfile{MinVersion: "1.2"}, scheme: "coap+tcp"},
+		{name: "dtls-suite", profile: TLSProfile{CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_CCM"}},
+			scheme: "coaps", ok: true},
+		{name: "dtls-unknown-suite", profile: TLSProfile{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+			scheme: "coaps"},
+		{name: "dtls-curve", profile: TLSProfile{Curves: []string{"P-256"}}, scheme: "coaps"},
+		{name: "dtls-version", profile: TLSProfile{MinVersion: "1.3"}, scheme: "coaps"},
+		{name: "tls-suite", profile: TLSProfile{CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}},
+			scheme: "coaps+tcp", ok: true},
+		{name: "tls-ccm", profile: TLSProfile{CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_CCM"}},
+			scheme: "coaps+tcp"},
+		{name: "tls-insecure-suite", profile: TLSProfile{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+			scheme: "coaps+tcp"},
+		{name: "tls-cbc-sha256", profile: TLSProfile{CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256"}},
+			scheme: "coaps+tcp"},
+		{name: "tls-curve", profile: TLSProfile{Curves: []string{"X25519", "P-521"}}, scheme: "coaps+tcp", ok: true},
+		{name: "tls-unknown-curve", profile: TLSProfile{Curves: []string{"secp256k1"}}, scheme: "coaps+tcp"},
+		{name: "tls-version", profile: TLSProfile{MinVersion: "1.1"}, scheme: "coaps+tcp"},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			if err := subtest.profile.ValidateScheme(subtest.scheme); (err == nil) != subtest.ok {
+				t.Errorf("expected valid %v; got %v", subtest.ok, err)
+			}
+		})
+	}
+}
+
+func TestTLSProfile_Apply(t *testing.T) {
+	profile := TLSProfile{CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8"}}
+	dtlsConfig := &dtls.Config{}
+	if err := profile.ApplyDTLS(dtlsConfig); err != nil {
+		t.Fatal(err)
+	}
+	if len(dtlsConfig.CipherSuites) != 1 || dtlsConfig.CipherSuites[0] != dtls.TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8 {
+		t.Errorf("unexpected DTLS cipher suites %v", dtlsConfig.CipherSuites)
+	}
+
+	profile = TLSProfile{Curves: []string{"P-384"}, MinVersion: "1.3"}
+	tlsConfig := &tls.Config{}
+	if err := profile.ApplyTLS(tlsConfig); err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.MinVersion != tls.VersionTLS13 || len(tlsConfig.CurvePreferences) != 1 ||
+		tlsConfig.CurvePreferences[0] != tls.CurveP384 {
+		t.Errorf("unexpected TLS config %v %v", tlsConfig.MinVersion, tlsConfig.CurvePreferences)
+	}
+}
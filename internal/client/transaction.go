@@ -0,0 +1,71 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	"github.com/go-ocf/go-coap"
+)
+
+// Transaction IDs
+// Every request made to AM or the Thing Gateway is identified by a unique transaction ID so that a failure can be
+// correlated with the AM audit logs. AM receives the ID in the X-ForgeRock-TransactionId header and the gateway in the
+// TransactionIDOption CoAP option. The gateway forwards the ID of a thing's request to AM so that the thing, the
+// gateway and AM all log the same ID. The ID is returned in AMError.TransactionID when a request fails.
+
+// TransactionIDHeader is the HTTP header in which the transaction ID of a request is sent to AM
+const TransactionIDHeader = "X-ForgeRock-TransactionId"
+
+// TransactionIDOption is the CoAP option in which the transaction ID of a request is sent to the Thing Gateway.
+// The option number is from the experimental range and is elective so that it is ignored by gateways that do not
+// support it.
+const TransactionIDOption coap.OptionID = 65000
+
+// NewTransactionID returns a new random transaction ID in the form of a UUID
+func NewTransactionID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	// version 4, variant 1
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// WithTransactionID returns a connection that identifies all its requests with the given transaction ID, such as the
+// ID of a request received from a thing that is forwarded to AM. The returned connection shares the state of the
+// given connection. Connections to the Thing Gateway are returned unchanged.
+func WithTransactionID(connection Connection, id string) Connection {
+	c, ok := connection.(*amConnection)
+	if !ok || id == "" {
+		return connection
+	}
+	transaction := *c
+	transaction.transactionID = id
+	return &transaction
+}
+
+// TransactionID returns the transaction ID of the CoAP message, if it has one
+func TransactionID(message coap.Message) string {
+	if id, ok := message.Option(TransactionIDOption).([]byte); ok {
+		return string(id)
+	}
+	return ""
+}
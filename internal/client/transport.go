@@ -0,0 +1,156 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"encoding/json"
+
+	"github.com/JacoJooste/iot-edge/v7/pkg/transport"
+)
+
+// transportConnection makes the requests of a thing over a transport registered with package transport
+type transportConnection struct {
+	transport transport.Transport
+	// amInfo is returned instead of requesting the information over the transport, if it is set
+	amInfo *AMInfo
+}
+
+// newTransportConnection creates a connection over the transport registered for the scheme of the builder URL
+func newTransportConnection(b *ConnectionBuilder) (Connection, error) {
+	t, err := transport.New(transport.Config{
+		URL:     b.url,
+		Realm:   b.realm,
+		Tree:    b.tree,
+		Key:     b.key,
+		Timeout: b.timeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &transportConnection{transport: t, amInfo: b.amInfo}, nil
+}
+
+func (c *transportConnection) Initialise() error {
+	return c.transport.Initialise()
+}
+
+func (c *transportConnection) Authenticate(payload AuthenticatePayload) (reply AuthenticatePayload, err error) {
+	requestBody, err := json.Marshal(payload)
+	if err != nil {
+		return reply, err
+	}
+	response, err := c.transport.Request(transport.Request{
+		Operation:   transport.OperationAuthenticate,
+		ContentType: string(ApplicationJSON),
+		Payload:     requestBody,
+	})
+	if err != nil {
+		return reply, err
+	}
+	if err = json.Unmarshal(response, &reply); err != nil {
+		return reply, invalidPayload(err)
+	}
+	return reply, nil
+}
+
+func (c *transportConnection) AMInfo() (info AMInfoResponse, err error) {
+	if c.amInfo != nil {
+		return c.amInfo.AMInfoResponse, nil
+	}
+	response, err := c.transport.Request(transport.Request{Operation: transport.OperationAMInfo})
+	if err != nil {
+		return info, err
+	}
+	if err = json.Unmarshal(response, &info); err != nil {
+		return info, invalidPayload(err)
+	}
+	return info, nil
+}
+
+func (c *transportConnection) ValidateSession(tokenID string) (ok bool, err error) {
+	response, err := c.transport.Request(transport.Request{
+		Operation: transport.OperationValidateSession,
+		Token:     tokenID,
+	})
+	if err != nil {
+		return false, err
+	}
+	var validation struct {
+		Valid bool `json:"valid"`
+	}
+	if err = json.Unmarshal(response, &validation); err != nil {
+		return false, invalidPayload(err)
+	}
+	return validation.Valid, nil
+}
+
+func (c *transportConnection) LogoutSession(tokenID string) (err error) {
+	_, err = c.transport.Request(transport.Request{Operation: transport.OperationLogoutSession, Token: tokenID})
+	return err
+}
+
+func (c *transportConnection) SessionInfo(tokenID string) (reply []byte, err error) {
+	return c.transport.Request(transport.Request{Operation: transport.OperationSessionInfo, Token: tokenID})
+}
+
+func (c *transportConnection) AccessToken(tokenID string, content ContentType, payload string) (reply []byte,
+	err error) {
+	return c.thingEndpointRequest(transport.OperationAccessToken, tokenID, content, payload)
+}
+
+func (c *transportConnection) IntrospectAccessToken(token string) (introspection []byte, err error) {
+	return c.transport.Request(transport.Request{Operation: transport.OperationIntrospect, Token: token})
+}
+
+func (c *transportConnection) Attributes(tokenID string, content ContentType, payload string, names []string) (
+	reply []byte, err error) {
+	return c.transport.Request(transport.Request{
+		Operation:   transport.OperationAttributes,
+		Token:       tokenID,
+		ContentType: string(content),
+		Payload:     []byte(payload),
+		Names:       names,
+	})
+}
+
+func (c *transportConnection) PolicyDecision(tokenID string, content ContentType, payload string) (reply []byte,
+	err error) {
+	return c.thingEndpointRequest(transport.OperationPolicyDecision, tokenID, content, payload)
+}
+
+func (c *transportConnection) SignedRequest(tokenID string, method string, path string, content ContentType,
+	payload string) (reply []byte, err error) {
+	return c.transport.Request(transport.Request{
+		Operation:   transport.OperationSignedRequest,
+		Token:       tokenID,
+		ContentType: string(content),
+		Payload:     []byte(payload),
+		Method:      method,
+		Path:        path,
+	})
+}
+
+// thingEndpointRequest makes a request to the things endpoint with the session token and payload
+func (c *transportConnection) thingEndpointRequest(operation transport.Operation, tokenID string,
+	content ContentType, payload string) (reply []byte, err error) {
+	return c.transport.Request(transport.Request{
+		Operation:   operation,
+		Token:       tokenID,
+		ContentType: string(content),
+		Payload:     []byte(payload),
+	})
+}
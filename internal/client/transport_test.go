@@ -0,0 +1,103 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/JacoJooste/iot-edge/v7/pkg/transport"
+)
+
+// testLoRaWANTransport records the requests it receives and replies with the reply set for the operation
+type testLoRaWANTransport struct {
+	requests []transport.Request
+	replies  map[transport.Operation]string
+}
+
+func (t *testLoRaWANTransport) Initialise() error {
+	return nil
+}
+
+func (t *testLoRaWANTransport) Request(request transport.Request) ([]byte, error) {
+	t.requests = append(t.requests, request)
+	reply, ok := t.replies[request.Operation]
+	if !ok {
+		return nil, fmt.Errorf("%w: no reply", ErrUnauthorised)
+	}
+	return []byte(reply), nil
+}
+
+var testTransport = &testLoRaWANTransport{}
+
+func init() {
+	transport.Register("test-lorawan", func(config transport.Config) (transport.Transport, error) {
+		if config.Realm != "things" {
+			return nil, errors.New("unexpected realm")
+		}
+		return testTransport, nil
+	})
+}
+
+func TestTransportConnection(t *testing.T) {
+	u, _ := url.Parse("test-lorawan://app-server.example.com")
+	connection, err := NewConnection().ConnectTo(u).InRealm("things").Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testTransport.replies = map[transport.Operation]string{
+		transport.OperationAuthenticate:    `{"tokenId":"session"}`,
+		transport.OperationAMInfo:          `{"Realm":"things","ThingsVersion":"2"}`,
+		transport.OperationValidateSession: `{"valid":true}`,
+		transport.OperationAttributes:      `{"colour":["blue"]}`,
+	}
+
+	reply, err := connection.Authenticate(AuthenticatePayload{})
+	if err != nil || reply.TokenID != "session" {
+		t.Errorf("unexpected authentication reply %v; %v", reply, err)
+	}
+	info, err := connection.AMInfo()
+	if err != nil || info.Realm != "things" || info.ThingsVersion != "2" {
+		t.Errorf("unexpected AM info %v; %v", info, err)
+	}
+	if ok, err := connection.ValidateSession("session"); err != nil || !ok {
+		t.Errorf("expected a valid session; %v", err)
+	}
+	attributes, err := connection.Attributes("session", ApplicationJSON, "", []string{"colour"})
+	if err != nil || string(attributes) != `{"colour":["blue"]}` {
+		t.Errorf("unexpected attributes %s; %v", attributes, err)
+	}
+	request := testTransport.requests[len(testTransport.requests)-1]
+	expected := transport.Request{Operation: transport.OperationAttributes, Token: "session",
+		ContentType: string(ApplicationJSON), Payload: []byte{}, Names: []string{"colour"}}
+	if !reflect.DeepEqual(request, expected) {
+		t.Errorf("expected request %v; got %v", expected, request)
+	}
+	if _, err = connection.AccessToken("session", ApplicationJSON, "{}"); !errors.Is(err, ErrUnauthorised) {
+		t.Errorf("expected the error class of the transport; got %v", err)
+	}
+}
+
+func TestConnectionBuilder_Create_UnsupportedScheme(t *testing.T) {
+	u, _ := url.Parse("test-nbiot://scef.example.com")
+	if _, err := NewConnection().ConnectTo(u).Create(); err == nil {
+		t.Error("expected an error for a scheme without a transport")
+	}
+}
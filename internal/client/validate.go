@@ -0,0 +1,142 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode"
+
+	"github.com/JacoJooste/iot-edge/v7/pkg/transport"
+)
+
+// ConfigError contains all the problems found in the configuration of a thing or of the Thing Gateway so that they
+// can be corrected at once, instead of one at a time as the connection fails
+type ConfigError struct {
+	Problems []error
+}
+
+func (e ConfigError) Error() string {
+	msgs := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		msgs[i] = p.Error()
+	}
+	return "invalid configuration: " + strings.Join(msgs, "; ")
+}
+
+// Is returns true if any of the problems matches the target
+func (e ConfigError) Is(target error) bool {
+	for _, p := range e.Problems {
+		if errors.Is(p, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first problem that matches the target
+func (e ConfigError) As(target interface{}) bool {
+	for _, p := range e.Problems {
+		if errors.As(p, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewConfigError returns a ConfigError containing the problems that are not nil, or nil if there are none
+func NewConfigError(problems ...error) error {
+	var e ConfigError
+	for _, p := range problems {
+		if p != nil {
+			e.Problems = append(e.Problems, p)
+		}
+	}
+	if len(e.Problems) == 0 {
+		return nil
+	}
+	return e
+}
+
+// unsupportedScheme returns the error for a URL scheme without a connection
+func unsupportedScheme(scheme string) error {
+	return fmt.Errorf("unsupported scheme `%s`, must be one of http(s), coap(s), coap(s)+tcp or a "+
+		"registered transport %v", scheme, transport.Registered())
+}
+
+// IsAMScheme returns true if URLs with the scheme connect directly to AM
+func IsAMScheme(scheme string) bool {
+	return scheme == "http" || scheme == "https"
+}
+
+// ValidateURL checks that a connection can be made to the URL
+func ValidateURL(u *url.URL) error {
+	if _, ok := connectionFactories[u.Scheme]; !ok {
+		if registeredTransport(u.Scheme) {
+			return nil
+		}
+		return unsupportedScheme(u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("URL `%s` has no host", u)
+	}
+	return nil
+}
+
+// hasInvalidRune returns true if the name contains white space, control characters or characters that are reserved
+// in URL queries
+func hasInvalidRune(name string) bool {
+	return strings.IndexFunc(name, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r) || strings.ContainsRune("?#&=%", r)
+	}) >= 0
+}
+
+// ValidateRealm checks that the realm is a path of realm names, such as /alfheim. The empty realm selects the realm
+// of the AM DNS alias.
+func ValidateRealm(realm string) error {
+	if realm == "" || realm == "/" {
+		return nil
+	}
+	if hasInvalidRune(realm) || strings.Contains(strings.Trim(realm, "/"), "//") || strings.HasSuffix(realm, "//") {
+		return fmt.Errorf("realm `%s` is invalid, must be a path of realm names such as /alfheim", realm)
+	}
+	return nil
+}
+
+// ValidateTree checks that the authentication tree name can be sent to AM
+func ValidateTree(tree string) error {
+	if hasInvalidRune(tree) || strings.Contains(tree, "/") {
+		return fmt.Errorf("authentication tree `%s` is invalid, must not contain white space or any of /?#&=%%", tree)
+	}
+	return nil
+}
+
+// ValidateCertificateKey checks that the key belongs to the leaf certificate
+func ValidateCertificateKey(certificates []*x509.Certificate, key crypto.Signer) error {
+	if len(certificates) == 0 || key == nil {
+		return nil
+	}
+	public, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if ok && !public.Equal(certificates[0].PublicKey) {
+		return fmt.Errorf("certificate `%s` is not issued for the key", certificates[0].Subject)
+	}
+	return nil
+}
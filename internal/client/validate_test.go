@@ -0,0 +1,119 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"net/url"
+	"testing"
+)
+
+func TestValidateURL(t *testing.T) {
+	tests := []struct {
+		url   string
+		valid bool
+	}{
+		{url: "https://am.example.com/am", valid: true},
+		{url: "coaps+tcp://gateway:5688", valid: true},
+		{url: "ftp://am.example.com/am"},
+		{url: "am.example.com/am"},
+		{url: "https:///am"},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.url, func(t *testing.T) {
+			u, err := url.Parse(subtest.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = ValidateURL(u); (err == nil) != subtest.valid {
+				t.Errorf("expected valid %v; got %v", subtest.valid, err)
+			}
+		})
+	}
+}
+
+func TestValidateRealm(t *testing.T) {
+	tests := []struct {
+		realm string
+		valid bool
+	}{
+		{realm: "", valid: true},
+		{realm: "/", valid: true},
+		{realm: "/alfheim", valid: true},
+		{realm: "alfheim/sub/", valid: true},
+		{realm: "/alfheim//sub"},
+		{realm: "/alf heim"},
+		{realm: "/alfheim?x=1"},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.realm, func(t *testing.T) {
+			if err := ValidateRealm(subtest.realm); (err == nil) != subtest.valid {
+				t.Errorf("expected valid %v; got %v", subtest.valid, err)
+			}
+		})
+	}
+}
+
+func TestValidateTree(t *testing.T) {
+	tests := []struct {
+		tree  string
+		valid bool
+	}{
+		{tree: "", valid: true},
+		{tree: "reg-tree_1", valid: true},
+		{tree: "reg tree"},
+		{tree: "reg/tree"},
+		{tree: "reg&tree"},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.tree, func(t *testing.T) {
+			if err := ValidateTree(subtest.tree); (err == nil) != subtest.valid {
+				t.Errorf("expected valid %v; got %v", subtest.valid, err)
+			}
+		})
+	}
+}
+
+func TestValidateCertificateKey(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	certificates := []*x509.Certificate{{PublicKey: key.Public()}}
+	if err := ValidateCertificateKey(certificates, key); err != nil {
+		t.Errorf("expected the key to match; got %v", err)
+	}
+	if err := ValidateCertificateKey(certificates, other); err == nil {
+		t.Error("expected the key not to match")
+	}
+}
+
+func TestNewConfigError(t *testing.T) {
+	if err := NewConfigError(nil, nil); err != nil {
+		t.Fatalf("expected no error; got %v", err)
+	}
+	err := NewConfigError(nil, ErrPayloadInvalid, errors.New("second"))
+	var configErr ConfigError
+	if !errors.As(err, &configErr) || len(configErr.Problems) != 2 {
+		t.Fatalf("expected a config error with 2 problems; got %v", err)
+	}
+	if !errors.Is(err, ErrPayloadInvalid) {
+		t.Errorf("expected the error to match %v", ErrPayloadInvalid)
+	}
+}
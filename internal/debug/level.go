@@ -0,0 +1,220 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package debug
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Levels and redaction
+// Debug information is written at one of three levels so that the amount of output can be reduced in production. The
+// information may contain session tokens, access tokens and signed JWTs, which grant access to AM on behalf of the
+// thing, so these values are redacted before the information is written unless redaction is switched off.
+// The level and redaction set on the package are the defaults. A Log overrides them for the information written by an
+// instance, such as a thing or a gateway, so that several instances in one process can be debugged separately.
+
+// Level of detail of the debug information
+type Level int32
+
+const (
+	// LevelError only writes failures
+	LevelError Level = iota + 1
+	// LevelInfo writes failures and changes in state
+	LevelInfo
+	// LevelTrace writes all debug information, including the messages exchanged with AM and the Thing Gateway
+	LevelTrace
+)
+
+// redacted replaces sensitive values in the debug information
+const redacted = "<redacted>"
+
+var (
+	level      = int32(LevelTrace)
+	unredacted int32
+
+	// compact serialised JWTs, the header is kept since it identifies the key
+	jwtPattern = regexp.MustCompile(`(eyJ[A-Za-z0-9_-]*)\.[A-Za-z0-9_-]*\.[A-Za-z0-9_-]*`)
+	// JSON fields that contain tokens
+	tokenFieldPattern = regexp.MustCompile(
+		`"(tokenId|token|csrf|authId|access_token|refresh_token|id_token)"(\s*:\s*)"[^"]*"`)
+
+	headerMutex sync.Mutex
+	// headers that contain session tokens or credentials
+	sensitiveHeaders = []string{"Authorization", "Cookie", "Set-Cookie"}
+	headerPattern    = compileHeaderPattern(sensitiveHeaders)
+)
+
+func compileHeaderPattern(headers []string) *regexp.Regexp {
+	quoted := make([]string, len(headers))
+	for i, h := range headers {
+		quoted[i] = regexp.QuoteMeta(h)
+	}
+	return regexp.MustCompile(`(?im)^(` + strings.Join(quoted, "|") + `):[^\r\n]*`)
+}
+
+// SetLevel sets the level of detail of the debug information
+func SetLevel(l Level) {
+	atomic.StoreInt32(&level, int32(l))
+}
+
+// SetRedaction switches the redaction of sensitive values on or off
+func SetRedaction(enabled bool) {
+	var value int32
+	if !enabled {
+		value = 1
+	}
+	atomic.StoreInt32(&unredacted, value)
+}
+
+// RedactHeader adds a header, such as a custom session token header, to the headers whose values are redacted
+func RedactHeader(name string) {
+	headerMutex.Lock()
+	defer headerMutex.Unlock()
+	for _, h := range sensitiveHeaders {
+		if strings.EqualFold(h, name) {
+			return
+		}
+	}
+	sensitiveHeaders = append(sensitiveHeaders, name)
+	headerPattern = compileHeaderPattern(sensitiveHeaders)
+}
+
+// Redact replaces the session tokens, access tokens and signed JWT payloads in the message
+func Redact(message string) string {
+	headerMutex.Lock()
+	pattern := headerPattern
+	headerMutex.Unlock()
+	message = pattern.ReplaceAllString(message, "$1: "+redacted)
+	message = tokenFieldPattern.ReplaceAllString(message, `"$1"$2"`+redacted+`"`)
+	return jwtPattern.ReplaceAllString(message, "$1."+redacted)
+}
+
+// output writes the message to the Logger if the level is enabled
+func output(l Level, message string) {
+	write(l, Level(atomic.LoadInt32(&level)), atomic.LoadInt32(&unredacted) == 0, message)
+}
+
+// write writes the message to the Logger if its level is within the enabled level
+func write(l Level, enabled Level, redact bool, message string) {
+	if l > enabled {
+		return
+	}
+	if redact {
+		message = Redact(message)
+	}
+	_ = Logger.Output(4, message)
+}
+
+// Log writes the debug information of an instance. The zero value writes at the level and with the redaction set on
+// the package, which are overridden with SetLevel and SetRedaction. A nil Log uses the package settings.
+type Log struct {
+	level Level
+	// redaction is zero to use the package redaction, 1 to redact and 2 to not redact
+	redaction int32
+}
+
+// SetLevel sets the level of detail of the debug information written by the log
+func (l *Log) SetLevel(level Level) {
+	atomic.StoreInt32((*int32)(&l.level), int32(level))
+}
+
+// SetRedaction switches the redaction of sensitive values written by the log on or off
+func (l *Log) SetRedaction(enabled bool) {
+	value := int32(2)
+	if enabled {
+		value = 1
+	}
+	atomic.StoreInt32(&l.redaction, value)
+}
+
+// output writes the message to the Logger if the level is enabled for the log
+func (l *Log) output(lvl Level, message string) {
+	enabled, redact := Level(atomic.LoadInt32(&level)), atomic.LoadInt32(&unredacted) == 0
+	if l != nil {
+		if own := Level(atomic.LoadInt32((*int32)(&l.level))); own != 0 {
+			enabled = own
+		}
+		if own := atomic.LoadInt32(&l.redaction); own != 0 {
+			redact = own == 1
+		}
+	}
+	write(lvl, enabled, redact, message)
+}
+
+// Error writes a failure in the manner of fmt.Println
+func (l *Log) Error(v ...interface{}) {
+	l.output(LevelError, fmt.Sprintln(v...))
+}
+
+// Errorf writes a failure in the manner of fmt.Printf
+func (l *Log) Errorf(format string, v ...interface{}) {
+	l.output(LevelError, fmt.Sprintf(format, v...))
+}
+
+// Info writes a change in state in the manner of fmt.Println
+func (l *Log) Info(v ...interface{}) {
+	l.output(LevelInfo, fmt.Sprintln(v...))
+}
+
+// Infof writes a change in state in the manner of fmt.Printf
+func (l *Log) Infof(format string, v ...interface{}) {
+	l.output(LevelInfo, fmt.Sprintf(format, v...))
+}
+
+// Trace writes detailed information in the manner of fmt.Println
+func (l *Log) Trace(v ...interface{}) {
+	l.output(LevelTrace, fmt.Sprintln(v...))
+}
+
+// Tracef writes detailed information in the manner of fmt.Printf
+func (l *Log) Tracef(format string, v ...interface{}) {
+	l.output(LevelTrace, fmt.Sprintf(format, v...))
+}
+
+// Error writes a failure in the manner of fmt.Println
+func Error(v ...interface{}) {
+	output(LevelError, fmt.Sprintln(v...))
+}
+
+// Errorf writes a failure in the manner of fmt.Printf
+func Errorf(format string, v ...interface{}) {
+	output(LevelError, fmt.Sprintf(format, v...))
+}
+
+// Info writes a change in state in the manner of fmt.Println
+func Info(v ...interface{}) {
+	output(LevelInfo, fmt.Sprintln(v...))
+}
+
+// Infof writes a change in state in the manner of fmt.Printf
+func Infof(format string, v ...interface{}) {
+	output(LevelInfo, fmt.Sprintf(format, v...))
+}
+
+// Trace writes detailed information in the manner of fmt.Println
+func Trace(v ...interface{}) {
+	output(LevelTrace, fmt.Sprintln(v...))
+}
+
+// Tracef writes detailed information in the manner of fmt.Printf
+func Tracef(format string, v ...interface{}) {
+	output(LevelTrace, fmt.Sprintf(format, v...))
+}
@@ -0,0 +1,242 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/JacoJooste/iot-edge/v7/internal/debug"
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+	"github.com/patrickmn/go-cache"
+)
+
+// Thing access control
+// The gateway can restrict the things that it proxies with an access list of thing IDs and of the issuers of client
+// certificates. Denied entries take precedence over allowed entries and, if any allowed entries are given, only
+// matching things are proxied. Entries may contain the wildcards of path.Match, for example `pump-*`. Issuer entries
+// are matched against both the common name and the distinguished name of the issuer.
+// Access is checked at the CoAP layer so that the requests of a denied thing are rejected with 4.03 Forbidden before
+// they are forwarded to AM:
+//    - when client certificates are required, every request is checked against the issuer of the verified client
+//      certificate and against its common name as the thing ID
+//    - authentication requests are checked against the subject of the JWT PoP sent by the thing
+//    - thing endpoint requests are checked against the thing for which the gateway created the session, so that a
+//      thing that is denied after it has authenticated is rejected as well
+// The first request of an authentication flow does not identify the thing, so it is only rejected when the client
+// certificate of the thing is denied. The access list can be replaced through the admin API while the gateway runs.
+// Once an access list with entries is set, access fails closed: requests made with a session that the gateway did not
+// create, or has forgotten, and requests whose client certificate can not be read are rejected. Things that use the
+// gateway must then authenticate through it. The gateway remembers the thing of a session for as long as the session
+// is in use.
+
+// accessSessionLife is the time for which the gateway remembers the thing of a session that it created after the
+// session was last used
+const accessSessionLife = 24 * time.Hour
+
+var errAccessDenied = fmt.Errorf("%w: thing is not allowed to use the gateway", client.ErrForbidden)
+
+// AccessList determines which things the gateway proxies
+type AccessList struct {
+	AllowThings  []string `json:"allowThings,omitempty"`
+	DenyThings   []string `json:"denyThings,omitempty"`
+	AllowIssuers []string `json:"allowIssuers,omitempty"`
+	DenyIssuers  []string `json:"denyIssuers,omitempty"`
+}
+
+// LoadAccessList reads an access list from a JSON file
+func LoadAccessList(file string) (list AccessList, err error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return list, err
+	}
+	if err = json.Unmarshal(b, &list); err != nil {
+		return list, fmt.Errorf("invalid access list %s; %w", file, err)
+	}
+	return list, list.validate()
+}
+
+// validate the patterns of the access list
+func (l AccessList) validate() error {
+	for _, patterns := range [][]string{l.AllowThings, l.DenyThings, l.AllowIssuers, l.DenyIssuers} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid access list entry `%s`; %w", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// matchAny returns true if any of the values matches any of the patterns
+func matchAny(patterns []string, values ...string) bool {
+	for _, pattern := range patterns {
+		for _, value := range values {
+			if ok, _ := path.Match(pattern, value); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// allows returns true if the values are not denied and, if there are allowed entries, are allowed
+func allows(allow, deny []string, values ...string) bool {
+	if matchAny(deny, values...) {
+		return false
+	}
+	return len(allow) == 0 || matchAny(allow, values...)
+}
+
+// restricts returns true if the access list has any entries
+func (l AccessList) restricts() bool {
+	return len(l.AllowThings) > 0 || len(l.DenyThings) > 0 || len(l.AllowIssuers) > 0 || len(l.DenyIssuers) > 0
+}
+
+// allowsThing returns true if the thing is allowed
+func (l AccessList) allowsThing(thingID string) bool {
+	return allows(l.AllowThings, l.DenyThings, thingID)
+}
+
+// allowsCertificate returns true if the issuer of the certificate and the thing to which it was issued are allowed
+func (l AccessList) allowsCertificate(cert *x509.Certificate) bool {
+	return allows(l.AllowIssuers, l.DenyIssuers, cert.Issuer.CommonName, cert.Issuer.String()) &&
+		l.allowsThing(cert.Subject.CommonName)
+}
+
+// accessControl applies the access list to the requests of things
+type accessControl struct {
+	mutex sync.RWMutex
+	list  AccessList
+	// thing ID by session token of the sessions created through the gateway
+	sessions *cache.Cache
+	// quarantined things with the time at which the quarantine expires, see anomaly.go
+	quarantined *cache.Cache
+}
+
+func newAccessControl() *accessControl {
+	return &accessControl{
+		sessions:    cache.New(accessSessionLife, time.Hour),
+		quarantined: cache.New(cache.NoExpiration, time.Minute),
+	}
+}
+
+// accessList returns the current access list
+func (a *accessControl) accessList() AccessList {
+	if a == nil {
+		return AccessList{}
+	}
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return a.list
+}
+
+// checkThing returns an error if the thing is not allowed. Unidentified things are checked by other means.
+func (a *accessControl) checkThing(thingID string) error {
+	if a.isQuarantined(thingID) {
+		debug.Infof("Request of quarantined thing %s denied", thingID)
+		return errQuarantined
+	}
+	if thingID == "" || a.accessList().allowsThing(thingID) {
+		return nil
+	}
+	debug.Infof("Request of thing %s denied by the access list", thingID)
+	return errAccessDenied
+}
+
+// checkSession returns an error if the thing for which the session was created is not allowed. A session that the
+// gateway does not know is rejected if the access list restricts access.
+func (a *accessControl) checkSession(token string) error {
+	if a == nil {
+		return nil
+	}
+	thingID := a.thingOf(token)
+	if thingID == "" {
+		if a.accessList().restricts() {
+			debug.Info("Request with a session unknown to the gateway denied by the access list")
+			return errAccessDenied
+		}
+		return nil
+	}
+	if err := a.checkThing(thingID); err != nil {
+		return err
+	}
+	// remember the thing for as long as the session is in use
+	a.sessions.SetDefault(token, thingID)
+	return nil
+}
+
+// track the thing of the session
+func (a *accessControl) track(token, thingID string) {
+	if a == nil || thingID == "" {
+		return
+	}
+	a.sessions.SetDefault(token, thingID)
+}
+
+// forget the thing of the session
+func (a *accessControl) forget(token string) {
+	if a == nil {
+		return
+	}
+	a.sessions.Delete(token)
+}
+
+// restrictAccess rejects the requests sent over connections with a client certificate that is denied by the access
+// list. The certificate is only trusted if it has been verified during the handshake.
+func (c *ThingGateway) restrictAccess(next coap.Handler) coap.HandlerFunc {
+	return func(w coap.ResponseWriter, r *coap.Request) {
+		if list := c.access.accessList(); c.clientCAs != nil && list.restricts() {
+			cert, err := c.clientCertificate(r)
+			if err != nil || !list.allowsCertificate(cert) {
+				if err != nil {
+					c.log.Infof("Request denied by the access list, unable to read the client certificate; %s", err)
+				} else {
+					c.log.Infof("Request with client certificate %s denied by the access list", cert.Subject)
+				}
+				w.SetCode(codes.Forbidden)
+				writeResponse(w, []byte(errAccessDenied.Error()))
+				return
+			}
+		}
+		next.ServeCOAP(w, r)
+	}
+}
+
+// SetAccessList restricts the things that the Thing Gateway proxies to those allowed by the access list. The access
+// list can be replaced while the CoAP server is running.
+func (c *ThingGateway) SetAccessList(list AccessList) error {
+	if err := list.validate(); err != nil {
+		return err
+	}
+	c.access.mutex.Lock()
+	defer c.access.mutex.Unlock()
+	c.access.list = list
+	return nil
+}
+
+// AccessList returns the access list of the Thing Gateway
+func (c *ThingGateway) AccessList() AccessList {
+	return c.access.accessList()
+}
@@ -0,0 +1,247 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+)
+
+func TestAccessList_allowsThing(t *testing.T) {
+	tests := []struct {
+		name    string
+		list    AccessList
+		thingID string
+		allowed bool
+	}{
+		{name: "empty", thingID: "pump-1", allowed: true},
+		{name: "allowed", list: AccessList{AllowThings: []string{"pump-1"}}, thingID: "pump-1", allowed: true},
+		{name: "not-allowed", list: AccessList{AllowThings: []string{"pump-1"}}, thingID: "pump-2"},
+		{name: "allowed-wildcard", list: AccessList{AllowThings: []string{"pump-*"}}, thingID: "pump-2", allowed: true},
+		{name: "denied", list: AccessList{DenyThings: []string{"pump-1"}}, thingID: "pump-1"},
+		{name: "not-denied", list: AccessList{DenyThings: []string{"pump-1"}}, thingID: "pump-2", allowed: true},
+		{name: "deny-precedes-allow", list: AccessList{AllowThings: []string{"pump-*"}, DenyThings: []string{"pump-1"}},
+			thingID: "pump-1"},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			if allowed := subtest.list.allowsThing(subtest.thingID); allowed != subtest.allowed {
+				t.Errorf("expected allowed %v; got %v", subtest.allowed, allowed)
+			}
+		})
+	}
+}
+
+func TestAccessList_allowsCertificate(t *testing.T) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca := testIssueCertificate(t, "Manufacturer CA", caKey.Public(), nil, caKey)
+	thingKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	cert := testIssueCertificate(t, "pump-1", thingKey.Public(), ca, caKey)
+
+	tests := []struct {
+		name    string
+		list    AccessList
+		allowed bool
+	}{
+		{name: "empty", allowed: true},
+		{name: "allowed-issuer", list: AccessList{AllowIssuers: []string{"Manufacturer CA"}}, allowed: true},
+		{name: "allowed-issuer-dn", list: AccessList{AllowIssuers: []string{"CN=Manufacturer CA"}}, allowed: true},
+		{name: "not-allowed-issuer", list: AccessList{AllowIssuers: []string{"Other CA"}}},
+		{name: "denied-issuer", list: AccessList{DenyIssuers: []string{"Manufacturer *"}}},
+		{name: "denied-thing", list: AccessList{DenyThings: []string{"pump-1"}}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			if allowed := subtest.list.allowsCertificate(cert); allowed != subtest.allowed {
+				t.Errorf("expected allowed %v; got %v", subtest.allowed, allowed)
+			}
+		})
+	}
+}
+
+func TestLoadAccessList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "access")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		content string
+		list    AccessList
+		valid   bool
+	}{
+		{name: "valid", content: `{"allowThings":["pump-*"],"denyIssuers":["Old CA"]}`,
+			list: AccessList{AllowThings: []string{"pump-*"}, DenyIssuers: []string{"Old CA"}}, valid: true},
+		{name: "malformed", content: `{"allowThings":`},
+		{name: "invalid-pattern", content: `{"denyThings":["pump-["]}`},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			file := filepath.Join(dir, subtest.name+".json")
+			if err := ioutil.WriteFile(file, []byte(subtest.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			list, err := LoadAccessList(file)
+			if !subtest.valid {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if list.AllowThings[0] != subtest.list.AllowThings[0] || list.DenyIssuers[0] != subtest.list.DenyIssuers[0] {
+				t.Errorf("expected %+v; got %+v", subtest.list, list)
+			}
+		})
+	}
+}
+
+func TestAccessControl_checkSession(t *testing.T) {
+	tests := []struct {
+		name    string
+		list    AccessList
+		token   string
+		allowed bool
+	}{
+		{name: "no-list-known", token: "session-1", allowed: true},
+		{name: "no-list-unknown", token: "session-2", allowed: true},
+		{name: "allowed-known", list: AccessList{AllowThings: []string{"pump-*"}}, token: "session-1", allowed: true},
+		{name: "allowed-unknown", list: AccessList{AllowThings: []string{"pump-*"}}, token: "session-2"},
+		{name: "denied-known", list: AccessList{DenyThings: []string{"pump-1"}}, token: "session-1"},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			access := newAccessControl()
+			access.list = subtest.list
+			access.track("session-1", "pump-1")
+			if err := access.checkSession(subtest.token); (err == nil) != subtest.allowed {
+				t.Errorf("expected allowed %v; got %v", subtest.allowed, err)
+			}
+		})
+	}
+}
+
+func TestGatewayServer_AccessList(t *testing.T) {
+	var authentications, forwarded int32
+	gateway := testGateway(&mockClient{
+		AuthenticateFunc: func(client.AuthenticatePayload) (reply client.AuthenticatePayload, err error) {
+			atomic.AddInt32(&authentications, 1)
+			reply.TokenID = "session-1"
+			return reply, nil
+		},
+		accessTokenFunc: func(string, string) ([]byte, error) {
+			atomic.AddInt32(&forwarded, 1)
+			return []byte("{}"), nil
+		},
+	})
+	if err := gateway.SetAccessList(AccessList{AllowThings: []string{"thing*"}}); err != nil {
+		t.Fatal(err)
+	}
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err := gateway.StartCOAPServer(":0", serverKey); err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.ShutdownCOAPServer()
+	connection := gatewayConnection(t, gateway)
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	registration := testRegistration(t, "/", key, nil)
+	reply, err := connection.Authenticate(registration)
+	if err != nil || atomic.LoadInt32(&authentications) != 1 {
+		t.Fatalf("expected the allowed thing to be authenticated; got %v", err)
+	}
+	if _, err = connection.AccessToken(reply.TokenID, client.ApplicationJSON, "{}"); err != nil || atomic.LoadInt32(&forwarded) != 1 {
+		t.Fatalf("expected the request of the allowed thing to be forwarded; got %v", err)
+	}
+
+	// deny the thing after it has authenticated
+	if err := gateway.SetAccessList(AccessList{DenyThings: []string{"thingOne"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = connection.AccessToken(reply.TokenID, client.ApplicationJSON, "{}"); !errors.Is(err, client.ErrForbidden) {
+		t.Errorf("expected %v; got %v", client.ErrForbidden, err)
+	}
+	if _, err = connection.Authenticate(registration); !errors.Is(err, client.ErrForbidden) {
+		t.Errorf("expected %v; got %v", client.ErrForbidden, err)
+	}
+	// a session that was not created through the gateway can not be attributed to a thing
+	if _, err = connection.AccessToken("session-2", client.ApplicationJSON, "{}"); !errors.Is(err, client.ErrForbidden) {
+		t.Errorf("expected %v; got %v", client.ErrForbidden, err)
+	}
+	if atomic.LoadInt32(&authentications) != 1 || atomic.LoadInt32(&forwarded) != 1 {
+		t.Errorf("expected the requests of the denied thing not to be forwarded to AM")
+	}
+}
+
+func TestGatewayServer_AccessList_ClientCertificate(t *testing.T) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca := testIssueCertificate(t, "Old CA", caKey.Public(), nil, caKey)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	thingKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	thingCert := testIssueCertificate(t, "thing-1", thingKey.Public(), ca, caKey)
+
+	var authentications int32
+	gateway := testGateway(&mockClient{
+		AuthenticateFunc: func(client.AuthenticatePayload) (reply client.AuthenticatePayload, err error) {
+			atomic.AddInt32(&authentications, 1)
+			return reply, nil
+		}})
+	gateway.RequireClientCertificates(roots)
+	if err := gateway.SetAccessList(AccessList{DenyIssuers: []string{"Old CA"}}); err != nil {
+		t.Fatal(err)
+	}
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err := gateway.StartCOAPServer("127.0.0.1:0", serverKey); err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.ShutdownCOAPServer()
+
+	gwURL, _ := url.Parse("coaps://" + gateway.Address())
+	connection, err := client.NewConnection().
+		ConnectTo(gwURL).
+		WithKey(thingKey).
+		WithCertificate([]*x509.Certificate{thingCert}).
+		TimeoutRequestAfter(time.Second).
+		Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first request of the authentication flow is rejected since the thing is identified by its certificate
+	if _, err = connection.Authenticate(client.AuthenticatePayload{}); !errors.Is(err, client.ErrForbidden) {
+		t.Errorf("expected %v; got %v", client.ErrForbidden, err)
+	}
+	if atomic.LoadInt32(&authentications) != 0 {
+		t.Error("expected the request of the denied thing not to be forwarded to AM")
+	}
+}
@@ -0,0 +1,242 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/debug"
+	"golang.org/x/crypto/acme"
+)
+
+// ACME
+// The certificate of the CoAP server can be obtained from a CA that implements ACME (RFC 8555), such as Let's Encrypt
+// or an internal ACME CA, by using an ACMEIssuer as the issuer of the certificate renewal. The gateway proves that it
+// controls the DNS names and IP addresses of its certificate requests with the http-01 challenge, so the ACME server
+// must be able to reach the challenge responses of the issuer over HTTP on port 80 of every name. The issuer either
+// listens on the challenge address while it obtains a certificate or is served as an http.Handler by the caller.
+
+// acmeChallengePath is the path prefix of the http-01 challenge responses
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// defaultACMETimeout is the default time within which a certificate must be obtained from the ACME server
+const defaultACMETimeout = time.Minute
+
+// ACMEConfig configures the ACME account with which the gateway obtains its certificates
+type ACMEConfig struct {
+	// DirectoryURL of the ACME server
+	DirectoryURL string
+	// AccountKey identifies the ACME account of the gateway, which is registered when the first certificate is issued
+	AccountKey crypto.Signer
+	// Contact URLs of the account, for example "mailto:admin@example.com"
+	Contact []string
+	// ChallengeAddress on which the issuer serves the http-01 challenge responses while it obtains a certificate, for
+	// example ":80". The issuer must be served as an http.Handler by the caller if no address is given.
+	ChallengeAddress string
+	// HTTPClient makes the requests to the ACME server, the default client is used if nil
+	HTTPClient *http.Client
+	// Timeout within which a certificate must be obtained. Defaults to a minute.
+	Timeout time.Duration
+}
+
+// ACMEIssuer issues certificates for the gateway by ordering them from an ACME server
+type ACMEIssuer struct {
+	config ACMEConfig
+	client *acme.Client
+	// mutex serialises the orders and guards the registration of the account
+	mutex      sync.Mutex
+	registered bool
+	// responses to the pending http-01 challenges by token
+	responsesMutex sync.RWMutex
+	responses      map[string]string
+}
+
+// NewACMEIssuer creates an issuer that orders certificates from the ACME server with the account
+func NewACMEIssuer(config ACMEConfig) (*ACMEIssuer, error) {
+	if config.DirectoryURL == "" {
+		return nil, errors.New("an ACME directory URL is required")
+	}
+	if config.AccountKey == nil {
+		return nil, errors.New("an ACME account key is required")
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultACMETimeout
+	}
+	return &ACMEIssuer{
+		config: config,
+		client: &acme.Client{
+			Key:          config.AccountKey,
+			DirectoryURL: config.DirectoryURL,
+			HTTPClient:   config.HTTPClient,
+			UserAgent:    "iot-edge-gateway",
+		},
+		responses: make(map[string]string),
+	}, nil
+}
+
+// Issue orders a certificate for the request from the ACME server, which is returned with its chain
+func (i *ACMEIssuer) Issue(csr []byte) ([]*x509.Certificate, error) {
+	request, err := x509.ParseCertificateRequest(csr)
+	if err != nil {
+		return nil, err
+	}
+	ids := acme.DomainIDs(request.DNSNames...)
+	for _, ip := range request.IPAddresses {
+		ids = append(ids, acme.IPIDs(ip.String())...)
+	}
+	if len(ids) == 0 {
+		return nil, errors.New("certificate request has no DNS names or IP addresses to validate")
+	}
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), i.config.Timeout)
+	defer cancel()
+	if err = i.register(ctx); err != nil {
+		return nil, err
+	}
+	order, err := i.client.AuthorizeOrder(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	if i.config.ChallengeAddress != "" {
+		stop, err := i.serveChallenges()
+		if err != nil {
+			return nil, err
+		}
+		defer stop()
+	}
+	for _, u := range order.AuthzURLs {
+		if err = i.authorize(ctx, u); err != nil {
+			return nil, err
+		}
+	}
+	if order, err = i.client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, err
+	}
+	chain, _, err := i.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+	certificates := make([]*x509.Certificate, 0, len(chain))
+	for _, der := range chain {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, cert)
+	}
+	return certificates, nil
+}
+
+// register the account of the gateway with the ACME server, unless it has been registered already
+func (i *ACMEIssuer) register(ctx context.Context) error {
+	if i.registered {
+		return nil
+	}
+	_, err := i.client.Register(ctx, &acme.Account{Contact: i.config.Contact}, acme.AcceptTOS)
+	if err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return fmt.Errorf("unable to register the ACME account; %w", err)
+	}
+	i.registered = true
+	return nil
+}
+
+// authorize the account to obtain certificates for the identifier of the authorization by responding to its http-01
+// challenge
+func (i *ACMEIssuer) authorize(ctx context.Context, url string) error {
+	authz, err := i.client.GetAuthorization(ctx, url)
+	if err != nil {
+		return err
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "http-01" {
+			challenge = c
+			break
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("ACME server offers no http-01 challenge for %s", authz.Identifier.Value)
+	}
+	response, err := i.client.HTTP01ChallengeResponse(challenge.Token)
+	if err != nil {
+		return err
+	}
+	i.responsesMutex.Lock()
+	i.responses[challenge.Token] = response
+	i.responsesMutex.Unlock()
+	defer func() {
+		i.responsesMutex.Lock()
+		delete(i.responses, challenge.Token)
+		i.responsesMutex.Unlock()
+	}()
+	if _, err = i.client.Accept(ctx, challenge); err != nil {
+		return err
+	}
+	_, err = i.client.WaitAuthorization(ctx, authz.URI)
+	return err
+}
+
+// serveChallenges listens on the challenge address until the returned function is called
+func (i *ACMEIssuer) serveChallenges() (stop func(), err error) {
+	l, err := net.Listen("tcp", i.config.ChallengeAddress)
+	if err != nil {
+		return nil, fmt.Errorf("unable to serve the ACME challenges; %w", err)
+	}
+	server := &http.Server{Handler: i, ReadHeaderTimeout: 10 * time.Second}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := server.Serve(l); err != http.ErrServerClosed {
+			debug.Errorf("ACME challenge server stopped; %s", err)
+		}
+	}()
+	return func() {
+		_ = server.Close()
+		<-done
+	}, nil
+}
+
+// ServeHTTP serves the responses to the pending http-01 challenges
+func (i *ACMEIssuer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet || !strings.HasPrefix(r.URL.Path, acmeChallengePath) {
+		http.NotFound(w, r)
+		return
+	}
+	i.responsesMutex.RLock()
+	response, ok := i.responses[strings.TrimPrefix(r.URL.Path, acmeChallengePath)]
+	i.responsesMutex.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write([]byte(response))
+}
@@ -0,0 +1,375 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// testACMEServer is a minimal ACME server (RFC 8555) that validates http-01 challenges at the challenge URL and issues
+// certificates with a CA
+type testACMEServer struct {
+	*httptest.Server
+	issuer CAIssuer
+	// challengeURL is the base URL at which the challenge responses are fetched
+	challengeURL string
+
+	mutex         sync.Mutex
+	accountKey    *jose.JSONWebKey
+	registrations int
+	identifiers   []map[string]string
+	authorised    []string
+	chain         []byte
+}
+
+func newTestACMEServer(t *testing.T, issuer CAIssuer) *testACMEServer {
+	s := &testACMEServer{issuer: issuer}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", strconv.FormatInt(time.Now().UnixNano(), 10))
+		if r.URL.Path == "/directory" {
+			_ = json.NewEncoder(w).Encode(map[string]string{
+				"newNonce":   s.URL + "/nonce",
+				"newAccount": s.URL + "/account",
+				"newOrder":   s.URL + "/order",
+			})
+			return
+		}
+		if r.Method == http.MethodHead {
+			return
+		}
+		payload, err := s.verify(r)
+		if err != nil {
+			t.Error(err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.handle(w, r.URL.Path, payload)
+	}))
+	return s
+}
+
+// verify the JWS of the request with the key of the account and return its payload
+func (s *testACMEServer) verify(r *http.Request) ([]byte, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	object, err := jose.ParseSigned(string(body))
+	if err != nil {
+		return nil, err
+	}
+	header := object.Signatures[0].Protected
+	if header.ExtraHeaders["url"] != s.URL+r.URL.Path {
+		return nil, fmt.Errorf("unexpected url header %v", header.ExtraHeaders["url"])
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if r.URL.Path == "/account" {
+		s.accountKey = header.JSONWebKey
+	} else if s.accountKey == nil || header.KeyID != s.URL+"/account/1" {
+		return nil, fmt.Errorf("unexpected key ID %s", header.KeyID)
+	}
+	return object.Verify(s.accountKey)
+}
+
+func (s *testACMEServer) handle(w http.ResponseWriter, path string, payload []byte) {
+	switch {
+	case path == "/account":
+		w.Header().Set("Location", s.URL+"/account/1")
+		s.registrations++
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"status":"valid"}`))
+	case path == "/order":
+		var request struct {
+			Identifiers []map[string]string `json:"identifiers"`
+		}
+		_ = json.Unmarshal(payload, &request)
+		s.identifiers, s.authorised, s.chain = request.Identifiers, make([]string, len(request.Identifiers)), nil
+		w.Header().Set("Location", s.URL+"/order/1")
+		w.WriteHeader(http.StatusCreated)
+		s.writeOrder(w)
+	case path == "/order/1":
+		s.writeOrder(w)
+	case strings.HasPrefix(path, "/authz/"):
+		s.writeAuthorization(w, path[len("/authz/"):])
+	case strings.HasPrefix(path, "/challenge/"):
+		i, _ := strconv.Atoi(path[len("/challenge/"):])
+		s.validate(i)
+		s.writeAuthorization(w, path[len("/challenge/"):])
+	case path == "/finalize":
+		var request struct {
+			CSR string `json:"csr"`
+		}
+		_ = json.Unmarshal(payload, &request)
+		csr, _ := base64.RawURLEncoding.DecodeString(request.CSR)
+		chain, err := s.issuer.Issue(csr)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for _, cert := range chain {
+			s.chain = append(s.chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+		}
+		w.Header().Set("Location", s.URL+"/order/1")
+		s.writeOrder(w)
+	case path == "/cert":
+		_, _ = w.Write(s.chain)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// validate the challenge of the identifier by fetching the key authorization from the challenge URL
+func (s *testACMEServer) validate(i int) {
+	s.authorised[i] = "invalid"
+	response, err := http.Get(s.challengeURL + acmeChallengePath + s.token(i))
+	if err != nil {
+		return
+	}
+	defer response.Body.Close()
+	body, _ := ioutil.ReadAll(response.Body)
+	thumbprint, _ := s.accountKey.Thumbprint(crypto.SHA256)
+	if string(body) == s.token(i)+"."+base64.RawURLEncoding.EncodeToString(thumbprint) {
+		s.authorised[i] = "valid"
+	}
+}
+
+func (s *testACMEServer) token(i int) string {
+	return "token-" + strconv.Itoa(i)
+}
+
+func (s *testACMEServer) writeAuthorization(w http.ResponseWriter, index string) {
+	i, _ := strconv.Atoi(index)
+	status := s.authorised[i]
+	if status == "" {
+		status = "pending"
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"identifier": s.identifiers[i],
+		"status":     status,
+		"challenges": []map[string]string{
+			{"type": "dns-01", "url": s.URL + "/unsupported", "token": "dns"},
+			{"type": "http-01", "url": s.URL + "/challenge/" + index, "token": s.token(i)},
+		},
+	})
+}
+
+func (s *testACMEServer) writeOrder(w http.ResponseWriter) {
+	order := map[string]interface{}{
+		"identifiers": s.identifiers,
+		"finalize":    s.URL + "/finalize",
+		"status":      "ready",
+	}
+	var authorizations []string
+	for i, status := range s.authorised {
+		authorizations = append(authorizations, s.URL+"/authz/"+strconv.Itoa(i))
+		switch status {
+		case "invalid":
+			order["status"] = "invalid"
+		case "":
+			order["status"] = "pending"
+		}
+	}
+	order["authorizations"] = authorizations
+	if s.chain != nil {
+		order["status"], order["certificate"] = "valid", s.URL+"/cert"
+	}
+	_ = json.NewEncoder(w).Encode(order)
+}
+
+// testACMEIssuer returns an issuer with a new account at the ACME server
+func testACMEIssuer(t *testing.T, server *testACMEServer, challengeAddress string) *ACMEIssuer {
+	accountKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	issuer, err := NewACMEIssuer(ACMEConfig{
+		DirectoryURL:     server.URL + "/directory",
+		AccountKey:       accountKey,
+		Contact:          []string{"mailto:admin@example.com"},
+		ChallengeAddress: challengeAddress,
+		Timeout:          5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return issuer
+}
+
+func TestACMEIssuer_Issue(t *testing.T) {
+	server := newTestACMEServer(t, testCAIssuer(t, time.Hour))
+	defer server.Close()
+	issuer := testACMEIssuer(t, server, "")
+	challenges := httptest.NewServer(issuer)
+	defer challenges.Close()
+	server.challengeURL = challenges.URL
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	renewal := CertificateRenewal{
+		Issuer:      issuer,
+		Key:         key,
+		CommonName:  "gateway.example.com",
+		DNSNames:    []string{"gateway.example.com"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	for i := 0; i < 2; i++ {
+		cert, err := renewal.issue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cert.Certificate) != 2 {
+			t.Fatalf("expected the certificate with the CA; got %d certificates", len(cert.Certificate))
+		}
+		if err = cert.Leaf.CheckSignatureFrom(server.issuer.Certificate); err != nil {
+			t.Error(err)
+		}
+		if len(cert.Leaf.DNSNames) != 1 || len(cert.Leaf.IPAddresses) != 1 {
+			t.Errorf("unexpected names %v %v", cert.Leaf.DNSNames, cert.Leaf.IPAddresses)
+		}
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.registrations != 1 {
+		t.Errorf("expected the account to be registered once; got %d", server.registrations)
+	}
+	if len(server.identifiers) != 2 || server.identifiers[1]["type"] != "ip" {
+		t.Errorf("unexpected identifiers %v", server.identifiers)
+	}
+}
+
+// check that the issuer serves the challenge responses on the challenge address while it obtains a certificate
+func TestACMEIssuer_Issue_ChallengeAddress(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	server := newTestACMEServer(t, testCAIssuer(t, time.Hour))
+	defer server.Close()
+	server.challengeURL = "http://" + address
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	renewal := CertificateRenewal{Issuer: testACMEIssuer(t, server, address), Key: key, DNSNames: []string{"gateway"}}
+	if _, err = renewal.issue(); err != nil {
+		t.Fatal(err)
+	}
+	// the challenge address is only served while a certificate is obtained
+	if conn, err := net.Dial("tcp", address); err == nil {
+		conn.Close()
+		t.Error("expected the challenge address to be closed")
+	}
+}
+
+// check that a certificate is not issued if the challenge can not be validated
+func TestACMEIssuer_Issue_InvalidChallenge(t *testing.T) {
+	server := newTestACMEServer(t, testCAIssuer(t, time.Hour))
+	defer server.Close()
+	challenges := httptest.NewServer(http.NotFoundHandler())
+	defer challenges.Close()
+	server.challengeURL = challenges.URL
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	renewal := CertificateRenewal{Issuer: testACMEIssuer(t, server, ""), Key: key, DNSNames: []string{"gateway"}}
+	if _, err := renewal.issue(); err == nil {
+		t.Fatal("expected an error")
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.chain != nil {
+		t.Error("expected no certificate to be issued")
+	}
+}
+
+func TestACMEIssuer_Invalid(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if _, err := NewACMEIssuer(ACMEConfig{AccountKey: key}); err == nil {
+		t.Error("expected an error without a directory URL")
+	}
+	if _, err := NewACMEIssuer(ACMEConfig{DirectoryURL: "https://acme.example.com/directory"}); err == nil {
+		t.Error("expected an error without an account key")
+	}
+	issuer, err := NewACMEIssuer(ACMEConfig{DirectoryURL: "https://acme.example.com/directory", AccountKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	renewal := CertificateRenewal{Issuer: issuer, Key: key, CommonName: "gateway"}
+	if _, err = renewal.issue(); err == nil {
+		t.Error("expected an error for a request without names")
+	}
+}
+
+// check that things that trust the CA of the ACME server connect to a gateway that obtains its certificate with ACME
+func TestGatewayServer_ACMECertificate(t *testing.T) {
+	server := newTestACMEServer(t, testCAIssuer(t, time.Hour))
+	defer server.Close()
+	issuer := testACMEIssuer(t, server, "")
+	challenges := httptest.NewServer(issuer)
+	defer challenges.Close()
+	server.challengeURL = challenges.URL
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	gateway := testGateway(&mockClient{})
+	if err := gateway.SetTransport(TransportTLS); err != nil {
+		t.Fatal(err)
+	}
+	err := gateway.EnableCertificateRenewal(CertificateRenewal{
+		Issuer:      issuer,
+		Key:         key,
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = gateway.StartCOAPServer("127.0.0.1:0", nil); err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.ShutdownCOAPServer()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.issuer.Certificate)
+	gwURL, _ := url.Parse("coaps+tcp://" + gateway.Address())
+	_, err = client.NewConnection().
+		ConnectTo(gwURL).
+		WithKey(clientKey).
+		WithGatewayTrust(client.GatewayTrust{RootCAs: roots}).
+		TimeoutRequestAfter(time.Second).
+		Create()
+	if err != nil {
+		t.Error(err)
+	}
+}
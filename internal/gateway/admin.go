@@ -0,0 +1,391 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Admin API design
+// The admin API allows an operator to inspect the state that the gateway holds for things and to force things to
+// re-authenticate, for example after a key compromise. The API is served over HTTP and only accepts connections from
+// the local host, either on a loopback address or on a Unix socket given as `unix:{path}`. Any local process can
+// connect to a loopback address, so requests on a loopback address must carry the admin token as a bearer token and
+// name a loopback host in their Host header, which rejects requests sent by a browser on behalf of a website that
+// rebinds its domain to the loopback address. The socket file is only accessible to the user and group of the gateway
+// and the admin token is also required on the socket if one is set. The keys of authentication flows in progress are
+// redacted since they would allow the holder to continue the flow:
+//    GET    /sessions         lists the cached authentication flows and things
+//    DELETE /sessions         flushes all cached state
+//    DELETE /things/{id}      evicts the cached state of a thing
+//    GET    /liveness         reports the health of the gateway, see Liveness
+//    GET    /access           returns the access list of the gateway
+//    PUT    /access           replaces the access list of the gateway, see AccessList
+//    GET    /quarantine       lists the things quarantined after an anomaly, see AnomalyConfig
+//    DELETE /quarantine/{id}  releases a quarantined thing
+//    GET    /usage            lists the usage statistics of things, see ThingUsage
+//    GET    /metrics          exports the usage statistics of things in the Prometheus text format
+
+// ErrAdminServerAlreadyStarted indicates that the admin server has already been started by the Thing Gateway
+var ErrAdminServerAlreadyStarted = errors.New("admin server has already been started")
+
+// ErrAdminTokenRequired indicates that the admin server can not listen on a loopback address without an admin token
+var ErrAdminTokenRequired = errors.New("admin token is required on a loopback address")
+
+// CachedAuthentication describes an authentication flow in progress
+type CachedAuthentication struct {
+	// Key identifies the flow by the redacted key of the flow, see redactAuthKey
+	Key     string    `json:"key"`
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// CachedThing describes the state that the gateway holds for a thing
+type CachedThing struct {
+	ID string `json:"id"`
+	// LastAuthenticated and KeyIDs are learnt from AM authentications when offline authentication is enabled
+	LastAuthenticated time.Time `json:"lastAuthenticated,omitempty"`
+	KeyIDs            []string  `json:"keyIds,omitempty"`
+	OfflineSessions   int       `json:"offlineSessions"`
+	OSCOREContexts    int       `json:"oscoreContexts"`
+}
+
+// CachedSessions contains the state that the gateway holds for things
+type CachedSessions struct {
+	Authentications []CachedAuthentication `json:"authentications"`
+	Things          []CachedThing          `json:"things"`
+}
+
+// cachedThing returns the thing with the given ID, adding it if necessary
+func cachedThing(things map[string]*CachedThing, id string) *CachedThing {
+	thing, ok := things[id]
+	if !ok {
+		thing = &CachedThing{ID: id}
+		things[id] = thing
+	}
+	return thing
+}
+
+// redactAuthKey returns a short hash of the key of an authentication flow that identifies the flow without revealing
+// the key
+func redactAuthKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:6])
+}
+
+// CachedSessions returns the authentication flows and thing state cached by the gateway
+func (c *ThingGateway) CachedSessions() CachedSessions {
+	sessions := CachedSessions{
+		Authentications: []CachedAuthentication{},
+		Things:          []CachedThing{},
+	}
+	for key, expires := range c.authCache.Keys() {
+		sessions.Authentications = append(sessions.Authentications,
+			CachedAuthentication{Key: redactAuthKey(key), Expires: expires})
+	}
+	sort.Slice(sessions.Authentications, func(i, j int) bool {
+		return sessions.Authentications[i].Key < sessions.Authentications[j].Key
+	})
+
+	things := make(map[string]*CachedThing)
+	if c.offline != nil {
+		c.offline.describe(things)
+	}
+	c.oscore.describe(things)
+	for _, thing := range things {
+		sort.Strings(thing.KeyIDs)
+		sessions.Things = append(sessions.Things, *thing)
+	}
+	sort.Slice(sessions.Things, func(i, j int) bool {
+		return sessions.Things[i].ID < sessions.Things[j].ID
+	})
+	return sessions
+}
+
+// EvictThing removes the cached state of the thing so that the thing must authenticate with AM again.
+// Returns false if the gateway did not hold any state for the thing.
+func (c *ThingGateway) EvictThing(thingID string) bool {
+	found := c.oscore.evict(thingID)
+	if c.offline != nil && c.offline.evict(thingID) {
+		found = true
+	}
+	if c.subscriptions != nil && c.subscriptions.evict(thingID) {
+		found = true
+	}
+	return found
+}
+
+// FlushCache removes all cached state so that all things must authenticate with AM again
+func (c *ThingGateway) FlushCache() {
+	c.authCache.Flush()
+	c.oscore.flush()
+	if c.offline != nil {
+		c.offline.flush()
+	}
+}
+
+// isLoopback returns true if the host is a loopback address or the local host name
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// hasBearerToken returns true if the request carries the token in its Authorization header
+func hasBearerToken(r *http.Request, token string) bool {
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(header[len(prefix):]), []byte(token)) == 1
+}
+
+// hostIsLoopback returns true if the Host header of the request names a loopback host
+func hostIsLoopback(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	return isLoopback(strings.Trim(host, "[]"))
+}
+
+// adminHandler returns the handler of the admin API that is listening on the given address
+func (c *ThingGateway) adminHandler(address net.Addr) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(c.CachedSessions()); err != nil {
+				c.log.Error(err)
+			}
+		case http.MethodDelete:
+			c.FlushCache()
+			c.log.Info("admin: flushed cache")
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/liveness", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(c.Liveness()); err != nil {
+			c.log.Error(err)
+		}
+	})
+	mux.HandleFunc("/access", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(c.AccessList()); err != nil {
+				c.log.Error(err)
+			}
+		case http.MethodPut:
+			var list AccessList
+			if err := json.NewDecoder(r.Body).Decode(&list); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := c.SetAccessList(list); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			c.log.Info("admin: replaced access list")
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/quarantine", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(c.QuarantinedThings()); err != nil {
+			c.log.Error(err)
+		}
+	})
+	mux.HandleFunc("/quarantine/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			w.Header().Set("Allow", "DELETE")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		id := strings.TrimPrefix(r.URL.Path, "/quarantine/")
+		if id == "" || !c.ReleaseThing(id) {
+			http.NotFound(w, r)
+			return
+		}
+		c.log.Infof("admin: released thing %s", id)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/usage", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(c.Usage()); err != nil {
+			c.log.Error(err)
+		}
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := c.WriteUsageMetrics(w); err != nil {
+			c.log.Error(err)
+		}
+	})
+	mux.HandleFunc("/things/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			w.Header().Set("Allow", "DELETE")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		id := strings.TrimPrefix(r.URL.Path, "/things/")
+		if id == "" || !c.EvictThing(id) {
+			http.NotFound(w, r)
+			return
+		}
+		c.log.Infof("admin: evicted thing %s", id)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	local := address.Network() == "unix"
+	token := c.adminToken
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !local {
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil || !isLoopback(host) || !hostIsLoopback(r) {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		if (!local || token != "") && !hasBearerToken(r, token) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// listenAdmin creates the listener of the admin server on a loopback address or on a Unix socket
+func listenAdmin(address string) (net.Listener, error) {
+	if strings.HasPrefix(address, "unix:") {
+		path := strings.TrimPrefix(address, "unix:")
+		// a socket left behind by a gateway that did not shut down cleanly, for example in a restarted container
+		if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if err = os.Remove(path); err != nil {
+				return nil, err
+			}
+		}
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		if err = os.Chmod(path, 0660); err != nil {
+			l.Close()
+			return nil, err
+		}
+		return l, nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if !isLoopback(host) {
+		return nil, fmt.Errorf("admin server address %s is not a loopback address", address)
+	}
+	return net.Listen("tcp", address)
+}
+
+// SetAdminToken sets the bearer token that requests to the admin API must carry. The token is required on a loopback
+// address and, if set, on a Unix socket.
+// Must be called before the admin server is started.
+func (c *ThingGateway) SetAdminToken(token string) {
+	c.adminToken = token
+}
+
+// StartAdminServer starts the admin API on the given address, which must be a loopback address or a Unix socket
+// given as `unix:{path}`. An admin token must be set to listen on a loopback address.
+func (c *ThingGateway) StartAdminServer(address string) error {
+	if c.adminServer != nil {
+		return ErrAdminServerAlreadyStarted
+	}
+	if !strings.HasPrefix(address, "unix:") && c.adminToken == "" {
+		return ErrAdminTokenRequired
+	}
+	l, err := listenAdmin(address)
+	if err != nil {
+		return err
+	}
+	c.adminServer = &http.Server{Handler: c.adminHandler(l.Addr())}
+	c.adminAddress = l.Addr()
+	go func(server *http.Server) {
+		if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+			c.log.Error(err)
+		}
+	}(c.adminServer)
+	return nil
+}
+
+// ShutdownAdminServer shuts the admin server down
+func (c *ThingGateway) ShutdownAdminServer() {
+	if c.adminServer == nil {
+		return
+	}
+	if err := c.adminServer.Close(); err != nil {
+		c.log.Error(err)
+	}
+	c.adminServer = nil
+	c.adminAddress = nil
+}
+
+// AdminAddress returns in string form the address that the admin server is listening on
+func (c *ThingGateway) AdminAddress() string {
+	if c.adminAddress == nil {
+		return ""
+	}
+	return c.adminAddress.String()
+}
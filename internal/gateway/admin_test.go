@@ -0,0 +1,306 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/pkg/callback"
+	"github.com/go-ocf/go-coap/codes"
+)
+
+// testAdminGateway returns a gateway that holds offline and OSCORE state for thingOne and OSCORE state for thingTwo
+func testAdminGateway(t *testing.T) *ThingGateway {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	var events []AuditEvent
+	gateway, _ := testOfflineGateway(t, callback.AuthenticateHandler{
+		Audience: "/",
+		ThingID:  "thingOne",
+		KeyID:    "pop.cnf",
+		Key:      key,
+	}, &events)
+	gateway.authCache.Add("authIdKey", "authId")
+	for _, name := range []string{"thingOne", "thingTwo"} {
+		if _, err := gateway.oscore.add([]byte("secret"), []byte("salt"), []byte(name), name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return gateway
+}
+
+const testAdminToken = "admin-token"
+
+var testAdminAddress = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8090}
+
+// testAdminServe serves the request with the admin handler of the gateway listening on a loopback address
+func testAdminServe(gateway *ThingGateway, request *http.Request) *httptest.ResponseRecorder {
+	gateway.SetAdminToken(testAdminToken)
+	request.Host = testAdminAddress.String()
+	request.RemoteAddr = "127.0.0.1:50000"
+	request.Header.Set("Authorization", "Bearer "+testAdminToken)
+	recorder := httptest.NewRecorder()
+	gateway.adminHandler(testAdminAddress).ServeHTTP(recorder, request)
+	return recorder
+}
+
+func testAdminRequest(gateway *ThingGateway, method, path string) *httptest.ResponseRecorder {
+	return testAdminServe(gateway, httptest.NewRequest(method, path, nil))
+}
+
+func testCachedSessions(t *testing.T, gateway *ThingGateway) CachedSessions {
+	response := testAdminRequest(gateway, http.MethodGet, "/sessions")
+	if response.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", response.Code)
+	}
+	var sessions CachedSessions
+	if err := json.Unmarshal(response.Body.Bytes(), &sessions); err != nil {
+		t.Fatal(err)
+	}
+	return sessions
+}
+
+func TestThingGateway_Admin_ListSessions(t *testing.T) {
+	sessions := testCachedSessions(t, testAdminGateway(t))
+	if len(sessions.Authentications) != 1 || sessions.Authentications[0].Key != redactAuthKey("authIdKey") {
+		t.Errorf("unexpected authentications %v", sessions.Authentications)
+	}
+	if len(sessions.Things) != 2 {
+		t.Fatalf("unexpected things %v", sessions.Things)
+	}
+	thingOne, thingTwo := sessions.Things[0], sessions.Things[1]
+	if thingOne.ID != "thingOne" || thingOne.OSCOREContexts != 1 || len(thingOne.KeyIDs) != 1 ||
+		thingOne.LastAuthenticated.IsZero() {
+		t.Errorf("unexpected thing %v", thingOne)
+	}
+	if thingTwo.ID != "thingTwo" || thingTwo.OSCOREContexts != 1 || len(thingTwo.KeyIDs) != 0 {
+		t.Errorf("unexpected thing %v", thingTwo)
+	}
+}
+
+func TestThingGateway_Admin_EvictThing(t *testing.T) {
+	gateway := testAdminGateway(t)
+	if response := testAdminRequest(gateway, http.MethodDelete, "/things/thingOne"); response.Code != http.StatusNoContent {
+		t.Fatalf("unexpected status %d", response.Code)
+	}
+	sessions := testCachedSessions(t, gateway)
+	if len(sessions.Things) != 1 || sessions.Things[0].ID != "thingTwo" {
+		t.Errorf("thing not evicted %v", sessions.Things)
+	}
+	if response := testAdminRequest(gateway, http.MethodDelete, "/things/thingOne"); response.Code != http.StatusNotFound {
+		t.Errorf("expected %d, got %d", http.StatusNotFound, response.Code)
+	}
+}
+
+func TestThingGateway_Admin_Flush(t *testing.T) {
+	gateway := testAdminGateway(t)
+	if response := testAdminRequest(gateway, http.MethodDelete, "/sessions"); response.Code != http.StatusNoContent {
+		t.Fatalf("unexpected status %d", response.Code)
+	}
+	sessions := testCachedSessions(t, gateway)
+	if len(sessions.Authentications) != 0 || len(sessions.Things) != 0 {
+		t.Errorf("cache not flushed %v", sessions)
+	}
+}
+
+func TestThingGateway_Admin_RemoteForbidden(t *testing.T) {
+	gateway := testAdminGateway(t)
+	request := httptest.NewRequest(http.MethodDelete, "/sessions", nil)
+	request.RemoteAddr = "192.0.2.1:50000"
+	request.Header.Set("Authorization", "Bearer "+testAdminToken)
+	gateway.SetAdminToken(testAdminToken)
+	recorder := httptest.NewRecorder()
+	gateway.adminHandler(testAdminAddress).ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("expected %d, got %d", http.StatusForbidden, recorder.Code)
+	}
+	if len(gateway.CachedSessions().Things) == 0 {
+		t.Error("remote request flushed the cache")
+	}
+}
+
+func TestThingGateway_Admin_Unauthorised(t *testing.T) {
+	gateway := testAdminGateway(t)
+	gateway.SetAdminToken(testAdminToken)
+	tests := []struct {
+		name          string
+		host          string
+		authorization string
+		code          int
+	}{
+		{name: "authorised", host: "127.0.0.1:8090", authorization: "Bearer " + testAdminToken, code: http.StatusOK},
+		{name: "localhost", host: "localhost:8090", authorization: "bearer " + testAdminToken, code: http.StatusOK},
+		{name: "no-token", host: "127.0.0.1:8090", code: http.StatusUnauthorized},
+		{name: "wrong-token", host: "127.0.0.1:8090", authorization: "Bearer other", code: http.StatusUnauthorized},
+		{name: "basic", host: "127.0.0.1:8090", authorization: "Basic " + testAdminToken, code: http.StatusUnauthorized},
+		{name: "rebound-host", host: "attacker.example.com:8090", authorization: "Bearer " + testAdminToken,
+			code: http.StatusForbidden},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/sessions", nil)
+			request.Host = subtest.host
+			request.RemoteAddr = "127.0.0.1:50000"
+			if subtest.authorization != "" {
+				request.Header.Set("Authorization", subtest.authorization)
+			}
+			recorder := httptest.NewRecorder()
+			gateway.adminHandler(testAdminAddress).ServeHTTP(recorder, request)
+			if recorder.Code != subtest.code {
+				t.Errorf("expected %d, got %d", subtest.code, recorder.Code)
+			}
+		})
+	}
+}
+
+func TestThingGateway_StartAdminServer(t *testing.T) {
+	gateway := testGateway(&mockClient{})
+	if err := gateway.StartAdminServer("127.0.0.1:0"); err != ErrAdminTokenRequired {
+		gateway.ShutdownAdminServer()
+		t.Fatalf("expected %v; got %v", ErrAdminTokenRequired, err)
+	}
+	gateway.SetAdminToken(testAdminToken)
+	if err := gateway.StartAdminServer("0.0.0.0:0"); err == nil {
+		gateway.ShutdownAdminServer()
+		t.Fatal("expected non-loopback address to be rejected")
+	}
+	if err := gateway.StartAdminServer("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.ShutdownAdminServer()
+	request, _ := http.NewRequest(http.MethodGet, "http://"+gateway.AdminAddress()+"/sessions", nil)
+	request.Header.Set("Authorization", "Bearer "+testAdminToken)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("unexpected status %d", response.StatusCode)
+	}
+}
+
+func TestThingGateway_StartAdminServer_UnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "admin.sock")
+	// a socket left behind by a previous gateway
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	gateway := testGateway(&mockClient{})
+	if err = gateway.StartAdminServer("unix:" + socket); err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.ShutdownAdminServer()
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm&0007 != 0 {
+		t.Errorf("expected the socket to be inaccessible to other users; got %v", perm)
+	}
+	httpClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	response, err := httpClient.Get("http://gateway/sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("unexpected status %d", response.StatusCode)
+	}
+}
+
+func TestThingGateway_Admin_Liveness(t *testing.T) {
+	gateway := testAdminGateway(t)
+	if err := gateway.EnableResponseCache(map[string]time.Duration{RouteAMInfo: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	gateway.cache.get(RouteAMInfo)
+	gateway.cache.set(RouteAMInfo, RouteAMInfo, cacheable(codes.Content, []byte("{}")))
+	gateway.cache.get(RouteAMInfo)
+
+	response := testAdminRequest(gateway, http.MethodGet, "/liveness")
+	if response.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", response.Code)
+	}
+	var liveness Liveness
+	if err := json.Unmarshal(response.Body.Bytes(), &liveness); err != nil {
+		t.Fatal(err)
+	}
+	expected := Liveness{CachedAuthentications: 1, CachedResponses: 1, CacheHits: 1, CacheMisses: 1}
+	if liveness != expected {
+		t.Errorf("expected %+v; got %+v", expected, liveness)
+	}
+	if response := testAdminRequest(gateway, http.MethodPost, "/liveness"); response.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected %d, got %d", http.StatusMethodNotAllowed, response.Code)
+	}
+}
+
+func TestThingGateway_Admin_AccessList(t *testing.T) {
+	gateway := testAdminGateway(t)
+	tests := []struct {
+		name string
+		body string
+		code int
+	}{
+		{name: "replace", body: `{"denyThings":["pump-1"]}`, code: http.StatusNoContent},
+		{name: "malformed", body: `{"denyThings":`, code: http.StatusBadRequest},
+		{name: "invalid-pattern", body: `{"denyThings":["["]}`, code: http.StatusBadRequest},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPut, "/access", strings.NewReader(subtest.body))
+			response := testAdminServe(gateway, request)
+			if response.Code != subtest.code {
+				t.Errorf("expected %d, got %d", subtest.code, response.Code)
+			}
+		})
+	}
+
+	response := testAdminRequest(gateway, http.MethodGet, "/access")
+	var list AccessList
+	if err := json.Unmarshal(response.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.DenyThings) != 1 || list.DenyThings[0] != "pump-1" {
+		t.Errorf("expected the replaced access list; got %+v", list)
+	}
+}
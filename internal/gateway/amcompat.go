@@ -0,0 +1,383 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/JacoJooste/iot-edge/v7/internal/debug"
+)
+
+// AM compatibility API
+// Clients that were written against the REST API of AM, such as older versions of the SDK or third-party clients, can
+// be pointed at the gateway without changes. The gateway serves the AM endpoints that are used by things over HTTP and
+// forwards the requests to AM with its own connection, subject to the access list of the gateway:
+//    GET  /json/serverinfo/*                                      reports the session cookie name and realm
+//    POST /json/authenticate                                      authenticates with the tree of the gateway
+//    POST /json/sessions?_action={validate|logout|getSessionInfo}  validates, logs out or describes the session
+//    GET  /json/things/*?_fields={names}                          reads the attributes of the thing
+//    POST /json/things/*?_action=get_access_token                 requests an access token for the thing
+//    POST /json/policies?_action=evaluate                         requests a policy decision
+// The paths may also contain the realm, for example /json/realms/root/realms/edge/things/*, but the requests are always
+// made in the realm of the gateway. The authentication ID of a flow in progress is replaced by a shorter key, as it is
+// for things that use CoAP. Requests signed for proof of possession are forwarded as they are and are only accepted by
+// AM if the client signed them for the URL of AM. Request bodies are limited to the maximum request size of the
+// gateway. Like the admin API, the API only accepts connections from the local
+// host, either on a loopback address or on a Unix socket given as `unix:{path}`.
+
+// ErrAMCompatServerAlreadyStarted indicates that the AM compatibility server has already been started
+var ErrAMCompatServerAlreadyStarted = errors.New("AM compatibility server has already been started")
+
+// defaultCompatCookieName is the session cookie name reported to clients if the gateway has not been configured with
+// the cookie name of AM, it is the default cookie name of AM
+const defaultCompatCookieName = "iPlanetDirectoryPro"
+
+// compatRealmPath matches the realm path of an AM endpoint, for example /json/realms/root/realms/edge/
+var compatRealmPath = regexp.MustCompile(`^/json(/realms/[^/]+)+/`)
+
+var errNoSessionToken = errors.New("no session token")
+
+// compatEndpoint returns the path of the AM endpoint without the realm
+func compatEndpoint(path string) string {
+	return compatRealmPath.ReplaceAllString(path, "/json/")
+}
+
+// compatCookieName returns the name of the session cookie that clients of the compatibility API use
+func (c *ThingGateway) compatCookieName() string {
+	if c.sessionCookie != "" {
+		return c.sessionCookie
+	}
+	return defaultCompatCookieName
+}
+
+// compatSessionToken returns the session token of the request, which is sent in the session token header, if one has
+// been configured, or in the session cookie
+func (c *ThingGateway) compatSessionToken(r *http.Request) (string, error) {
+	if c.sessionHeader != "" {
+		if token := r.Header.Get(c.sessionHeader); token != "" {
+			return token, nil
+		}
+	}
+	if cookie, err := r.Cookie(c.compatCookieName()); err == nil && cookie.Value != "" {
+		return cookie.Value, nil
+	}
+	return "", errNoSessionToken
+}
+
+// compatConnection returns the connection with which the request is forwarded to AM, with the transaction ID set by the
+// client so that it can be correlated with the AM audit logs
+func (c *ThingGateway) compatConnection(r *http.Request) client.Connection {
+	if id := r.Header.Get(client.TransactionIDHeader); id != "" {
+		return client.WithTransactionID(c.amConnection, id)
+	}
+	return c.amConnection
+}
+
+// writeHTTPError writes an error response with a status that matches the class of the error. AM errors are forwarded
+// with their original status and payload.
+func writeHTTPError(w http.ResponseWriter, err error) {
+	var amError client.AMError
+	if errors.As(err, &amError) && amError.Code >= http.StatusBadRequest {
+		w.Header().Set("Content-Type", string(client.ApplicationJSON))
+		w.WriteHeader(amError.Code)
+		if e := json.NewEncoder(w).Encode(amError); e != nil {
+			debug.Error(e)
+		}
+		return
+	}
+	status := http.StatusBadGateway
+	switch {
+	case errors.Is(err, client.ErrUnauthorised), errors.Is(err, errNoSessionToken):
+		status = http.StatusUnauthorized
+	case errors.Is(err, client.ErrForbidden), errors.Is(err, errAccessDenied):
+		status = http.StatusForbidden
+	case errors.Is(err, client.ErrPayloadInvalid), errors.Is(err, errUnsupportedContentFormat):
+		status = http.StatusBadRequest
+	case errors.Is(err, client.ErrPayloadTooLarge):
+		status = http.StatusRequestEntityTooLarge
+	case errors.Is(err, client.ErrThrottled):
+		status = http.StatusTooManyRequests
+	case errors.Is(err, client.ErrAMUnreachable):
+		status = http.StatusGatewayTimeout
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// writeJSON writes a successful response with a JSON payload
+func writeJSON(w http.ResponseWriter, payload []byte) {
+	w.Header().Set("Content-Type", string(client.ApplicationJSON))
+	if _, err := w.Write(payload); err != nil {
+		debug.Error(err)
+	}
+}
+
+// compatRequest reads the session token, content type and payload of a request to the things or policies endpoints
+// and checks that the gateway serves the thing of the session and that the content type is accepted by the policy
+func (c *ThingGateway) compatRequest(r *http.Request, policy ContentPolicy) (token string, content client.ContentType,
+	payload string, err error) {
+	if token, err = c.compatSessionToken(r); err != nil {
+		return
+	}
+	content = client.ApplicationJSON
+	if strings.HasPrefix(r.Header.Get("Content-Type"), string(client.ApplicationJOSE)) {
+		content = client.ApplicationJOSE
+	} else if policy == ContentSigned {
+		return token, content, payload, errUnsupportedContentFormat
+	}
+	b, err := c.compatBody(r)
+	if err != nil {
+		return
+	}
+	if err = c.access.checkSession(token); err != nil {
+		return
+	}
+	return token, content, string(b), nil
+}
+
+// compatBody reads the body of a request, which the handler has limited to the maximum request size
+func (c *ThingGateway) compatBody(r *http.Request) ([]byte, error) {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil && len(b) >= c.maxRequestSize() {
+		return nil, fmt.Errorf("%w: request body exceeds the limit of %d bytes", client.ErrPayloadTooLarge,
+			c.maxRequestSize())
+	}
+	return b, err
+}
+
+// compatAuthenticate handles authentication requests
+func (c *ThingGateway) compatAuthenticate(w http.ResponseWriter, r *http.Request) {
+	body, err := c.compatBody(r)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	var auth client.AuthenticatePayload
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &auth); err != nil {
+			writeHTTPError(w, client.ErrPayloadInvalid)
+			return
+		}
+	}
+	// the client returns the key of a flow in progress as the authentication ID
+	auth.AuthIDKey, auth.AuthId = auth.AuthId, ""
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	c.detectAuthenticationStorm(thingID(auth.Callbacks), host)
+	if err := c.access.checkThing(thingID(auth.Callbacks)); err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	connection := client.WithAuthContext(c.compatConnection(r),
+		client.AuthContext{Locale: r.Header.Get(client.AcceptLanguageHeader)})
+	reply, err := c.authenticate(connection, auth)
+	if err != nil {
+		c.log.Errorf("Error connecting to AM; %s", err)
+		writeHTTPError(w, err)
+		return
+	}
+	reply.AuthId, reply.AuthIDKey = reply.AuthIDKey, ""
+	b, err := json.Marshal(reply)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	writeJSON(w, b)
+}
+
+// compatSession handles session requests
+func (c *ThingGateway) compatSession(w http.ResponseWriter, r *http.Request) {
+	token, err := c.compatSessionToken(r)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	connection := c.compatConnection(r)
+	switch r.URL.Query().Get("_action") {
+	case "validate":
+		valid, err := c.validateSession(connection, token)
+		if err != nil {
+			writeHTTPError(w, err)
+			return
+		}
+		b, _ := json.Marshal(struct {
+			Valid bool `json:"valid"`
+		}{valid})
+		writeJSON(w, b)
+	case "logout":
+		if err := c.logoutSession(connection, token); err != nil {
+			writeHTTPError(w, err)
+			return
+		}
+		writeJSON(w, []byte(`{"result":"Successfully logged out"}`))
+	case "getSessionInfo":
+		reply, err := connection.SessionInfo(token)
+		if err != nil {
+			writeHTTPError(w, err)
+			return
+		}
+		writeJSON(w, reply)
+	default:
+		http.Error(w, "unknown/missing action", http.StatusBadRequest)
+	}
+}
+
+// compatThings handles attributes and access token requests
+func (c *ThingGateway) compatThings(w http.ResponseWriter, r *http.Request) {
+	token, content, payload, err := c.compatRequest(r, c.contentPolicy)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	var reply []byte
+	switch action := r.URL.Query().Get("_action"); {
+	case r.Method == http.MethodGet && action == "":
+		var names []string
+		if fields := r.URL.Query().Get("_fields"); fields != "" {
+			names = strings.Split(fields, ",")
+		}
+		reply, err = c.compatConnection(r).Attributes(token, content, payload, names)
+	case r.Method == http.MethodPost && action == "get_access_token":
+		if reply, err = c.compatConnection(r).AccessToken(token, content, payload); err == nil {
+			c.usage.tokenIssued(c.access.thingOf(token))
+			c.events.publish(Event{Type: EventTokenIssued, ThingID: c.access.thingOf(token)})
+		}
+	default:
+		http.Error(w, "unsupported action", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	writeJSON(w, reply)
+}
+
+// compatPolicies handles policy decision requests
+func (c *ThingGateway) compatPolicies(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("_action") != "evaluate" {
+		http.Error(w, "unsupported action", http.StatusBadRequest)
+		return
+	}
+	// the AM policies endpoint only accepts JSON so the content policy does not apply
+	token, content, payload, err := c.compatRequest(r, ContentAny)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	reply, err := c.compatConnection(r).PolicyDecision(token, content, payload)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	writeJSON(w, reply)
+}
+
+// compatHandler returns the handler of the AM compatibility API that is listening on the given address
+func (c *ThingGateway) compatHandler(address net.Addr) http.Handler {
+	serve := func(w http.ResponseWriter, r *http.Request) {
+		endpoint, method := compatEndpoint(r.URL.Path), http.MethodPost
+		switch endpoint {
+		case "/json/serverinfo/*":
+			method = http.MethodGet
+		case "/json/things/*":
+			method = r.Method
+		}
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		switch endpoint {
+		case "/json/serverinfo/*":
+			b, _ := json.Marshal(struct {
+				CookieName string `json:"cookieName"`
+				Realm      string `json:"realm"`
+			}{c.compatCookieName(), c.realm})
+			writeJSON(w, b)
+		case "/json/authenticate":
+			c.compatAuthenticate(w, r)
+		case "/json/sessions":
+			c.compatSession(w, r)
+		case "/json/things/*":
+			c.compatThings(w, r)
+		case "/json/policies":
+			c.compatPolicies(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	}
+	local := address.Network() == "unix"
+	limit := int64(c.maxRequestSize())
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !local {
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil || !isLoopback(host) {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		serve(w, r)
+	})
+}
+
+// StartAMCompatServer starts the AM compatibility API on the given address, which must be a loopback address or a Unix
+// socket given as `unix:{path}`. Must be called after the gateway has been initialised.
+func (c *ThingGateway) StartAMCompatServer(address string) error {
+	if c.compatServer != nil {
+		return ErrAMCompatServerAlreadyStarted
+	}
+	l, err := listenAdmin(address)
+	if err != nil {
+		return err
+	}
+	c.compatServer = &http.Server{Handler: c.compatHandler(l.Addr())}
+	c.compatAddress = l.Addr()
+	go func(server *http.Server) {
+		if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+			c.log.Error(err)
+		}
+	}(c.compatServer)
+	return nil
+}
+
+// ShutdownAMCompatServer shuts the AM compatibility server down
+func (c *ThingGateway) ShutdownAMCompatServer() {
+	if c.compatServer == nil {
+		return
+	}
+	if err := c.compatServer.Close(); err != nil {
+		c.log.Error(err)
+	}
+	c.compatServer = nil
+	c.compatAddress = nil
+}
+
+// AMCompatAddress returns in string form the address that the AM compatibility server is listening on
+func (c *ThingGateway) AMCompatAddress() string {
+	if c.compatAddress == nil {
+		return ""
+	}
+	return c.compatAddress.String()
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/pkg/amtest"
+	"github.com/JacoJooste/iot-edge/v7/pkg/builder"
+	"github.com/JacoJooste/iot-edge/v7/pkg/callback"
+	"gopkg.in/square/go-jose.v2"
+)
+
+func TestCompatEndpoint(t *testing.T) {
+	tests := []struct {
+		path     string
+		endpoint string
+	}{
+		{path: "/json/things/*", endpoint: "/json/things/*"},
+		{path: "/json/realms/root/things/*", endpoint: "/json/things/*"},
+		{path: "/json/realms/root/realms/edge/authenticate", endpoint: "/json/authenticate"},
+		{path: "/json/realms/root", endpoint: "/json/realms/root"},
+	}
+	for _, subtest := range tests {
+		if endpoint := compatEndpoint(subtest.path); endpoint != subtest.endpoint {
+			t.Errorf("expected %s for %s; got %s", subtest.endpoint, subtest.path, endpoint)
+		}
+	}
+}
+
+func TestThingGateway_AMCompatServer(t *testing.T) {
+	server := &amtest.Server{
+		Realm: "/edge",
+		Trees: map[string]amtest.Tree{"auth-tree": {amtest.AuthenticateThing{}}},
+	}
+	server.Start()
+	defer server.Close()
+	jwk := func(key *ecdsa.PrivateKey) jose.JSONWebKeySet {
+		return jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: key.Public(), KeyID: "pop.cnf", Algorithm: string(jose.ES256), Use: "sig"}}}
+	}
+	gatewayKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	server.AddThing(amtest.Thing{ID: "gateway-1", Type: string(callback.TypeGateway), Keys: jwk(gatewayKey)})
+	thingKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	server.AddThing(amtest.Thing{ID: "thing-1", Type: string(callback.TypeDevice), Keys: jwk(thingKey),
+		Attributes: map[string][]string{"thingConfig": {"on"}}})
+	deniedKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	server.AddThing(amtest.Thing{ID: "denied-1", Type: string(callback.TypeDevice), Keys: jwk(deniedKey)})
+
+	gateway := NewThingGateway(server.URL().String(), "/edge", "auth-tree", 5*time.Second, []callback.Handler{
+		callback.AuthenticateHandler{Audience: "/edge", ThingID: "gateway-1", KeyID: "pop.cnf", Key: gatewayKey}})
+	if err := gateway.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gateway.SetAccessList(AccessList{DenyThings: []string{"denied-*"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := gateway.StartAMCompatServer("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.ShutdownAMCompatServer()
+	if err := gateway.StartAMCompatServer("127.0.0.1:0"); err != ErrAMCompatServerAlreadyStarted {
+		t.Errorf("expected %v; got %v", ErrAMCompatServerAlreadyStarted, err)
+	}
+	u, _ := url.Parse("http://" + gateway.AMCompatAddress())
+
+	// the thing connects to the gateway as if it were AM
+	device, err := builder.Thing().
+		ConnectTo(u).
+		InRealm("/edge").
+		WithTree("any-tree").
+		AuthenticateThing("thing-1", "/edge", "pop.cnf", thingKey, nil).
+		Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	attributes, err := device.RequestAttributes("thingConfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config, _ := attributes.GetFirst("thingConfig"); config != "on" {
+		t.Errorf("expected the attributes of the thing; got %s", attributes.Content)
+	}
+	if _, err = device.RequestAccessToken("publish"); err != nil {
+		t.Fatal(err)
+	}
+	if err = device.Logout(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = builder.Thing().
+		ConnectTo(u).
+		InRealm("/edge").
+		WithTree("any-tree").
+		AuthenticateThing("denied-1", "/edge", "pop.cnf", deniedKey, nil).
+		Create()
+	if err == nil {
+		t.Error("expected a thing denied by the access list to be rejected")
+	}
+
+	response, err := http.Get(u.String() + "/json/policies")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected %d; got %d", http.StatusMethodNotAllowed, response.StatusCode)
+	}
+}
+
+func TestThingGateway_AMCompatServer_RequestSize(t *testing.T) {
+	gateway := NewThingGateway("http://127.0.0.1:8080/am", "/edge", "auth-tree", time.Second, nil)
+	if err := gateway.SetPayloadLimits(PayloadLimits{MaxRequestSize: 64}); err != nil {
+		t.Fatal(err)
+	}
+	if err := gateway.StartAMCompatServer("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.ShutdownAMCompatServer()
+	endpoint := "http://" + gateway.AMCompatAddress() + "/json/authenticate"
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{name: "too-large", body: `{"authId":"` + strings.Repeat("a", 64) + `"}`, status: http.StatusRequestEntityTooLarge},
+		{name: "invalid", body: `{"authId":`, status: http.StatusBadRequest},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			response, err := http.Post(endpoint, "application/json", strings.NewReader(subtest.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+			if response.StatusCode != subtest.status {
+				t.Errorf("expected %d; got %d", subtest.status, response.StatusCode)
+			}
+		})
+	}
+}
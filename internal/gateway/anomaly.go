@@ -0,0 +1,376 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/JacoJooste/iot-edge/v7/internal/debug"
+	"github.com/JacoJooste/iot-edge/v7/internal/jws"
+	"github.com/patrickmn/go-cache"
+)
+
+// Anomaly detection
+// The gateway watches the request pattern of every thing and reports sudden changes to an anomaly hook so that
+// operators can plug in their own anomaly detection or quarantine policy:
+//    - an authentication storm is reported when a thing authenticates more often within a window than both the
+//      minimum and the given multiple of its average rate over the previous windows
+//    - a scope escalation attempt is reported when the access token requests of a thing for scopes that AM does not
+//      grant, either by rejecting the request or by granting fewer scopes, reach the threshold within a window
+// Things are identified by the subject of their JWT PoP and by the thing for which the gateway created their session.
+// Authentication requests that do not identify the thing are counted per peer address. An anomaly is reported at most
+// once per window for each thing or address.
+// The hook decides on the action. AnomalyQuarantine denies all requests of the thing with 4.03 Forbidden for the
+// quarantine period, as if the thing had been denied by the access list. Anomalies of peer addresses can not be
+// quarantined by the gateway and are left to the hook, for example to update a firewall. Quarantined things can be
+// listed and released through the admin API.
+
+// anomalyBaselineWeight is the weight of the latest window in the average rate of a thing
+const anomalyBaselineWeight = 0.25
+
+var errQuarantined = fmt.Errorf("%w: thing is quarantined", errAccessDenied)
+
+// AnomalyType is the type of anomaly detected in the request pattern of a thing
+type AnomalyType string
+
+const (
+	// AnomalyAuthenticationStorm is a sudden increase in the authentication requests of a thing
+	AnomalyAuthenticationStorm AnomalyType = "authentication-storm"
+	// AnomalyScopeEscalation is a repeated request for scopes that AM does not grant to the thing
+	AnomalyScopeEscalation AnomalyType = "scope-escalation"
+)
+
+// AnomalyEvent describes an anomaly detected in the request pattern of a thing
+type AnomalyEvent struct {
+	Time    time.Time   `json:"time"`
+	Type    AnomalyType `json:"type"`
+	ThingID string      `json:"thingId,omitempty"`
+	// Address of the peer that sent requests which did not identify the thing
+	Address string `json:"address,omitempty"`
+	// Count of the requests within the current window
+	Count int `json:"count"`
+	// Baseline is the average count of the requests per window before the current window
+	Baseline float64 `json:"baseline"`
+	Detail   string  `json:"detail,omitempty"`
+}
+
+func (e AnomalyEvent) String() string {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// AnomalyAction is the action taken by the Thing Gateway after an anomaly has been reported
+type AnomalyAction int
+
+const (
+	// AnomalyIgnore continues to proxy the requests of the thing
+	AnomalyIgnore AnomalyAction = iota
+	// AnomalyQuarantine denies the requests of the thing for the quarantine period
+	AnomalyQuarantine
+)
+
+// AnomalyFunc receives the anomalies detected by the Thing Gateway and returns the action to take
+type AnomalyFunc func(event AnomalyEvent) AnomalyAction
+
+// AnomalyConfig configures the detection of anomalies in the request patterns of things
+type AnomalyConfig struct {
+	// Window over which requests are counted, defaults to one minute
+	Window time.Duration
+	// MinAuthentications within a window before an authentication storm is reported, defaults to 10
+	MinAuthentications int
+	// StormFactor is the multiple of the average rate of a thing above which an authentication storm is reported,
+	// defaults to 5
+	StormFactor float64
+	// ScopeEscalations within a window before a scope escalation attempt is reported, defaults to 3
+	ScopeEscalations int
+	// Quarantine is the period for which the requests of a quarantined thing are denied, defaults to 15 minutes
+	Quarantine time.Duration
+	// Hook receives the anomalies, if no hook is provided then the anomalies are written to the debug logger
+	Hook AnomalyFunc
+}
+
+// validate the configuration and apply the defaults
+func (a *AnomalyConfig) validate() error {
+	if a.Window < 0 || a.MinAuthentications < 0 || a.StormFactor < 0 || a.ScopeEscalations < 0 || a.Quarantine < 0 {
+		return errors.New("anomaly detection settings must not be negative")
+	}
+	if a.Window == 0 {
+		a.Window = time.Minute
+	}
+	if a.MinAuthentications == 0 {
+		a.MinAuthentications = 10
+	}
+	if a.StormFactor == 0 {
+		a.StormFactor = 5
+	}
+	if a.ScopeEscalations == 0 {
+		a.ScopeEscalations = 3
+	}
+	if a.Quarantine == 0 {
+		a.Quarantine = 15 * time.Minute
+	}
+	if a.Hook == nil {
+		a.Hook = func(event AnomalyEvent) AnomalyAction {
+			debug.Info("anomaly:", event)
+			return AnomalyIgnore
+		}
+	}
+	return nil
+}
+
+// QuarantinedThing describes a thing whose requests are denied after an anomaly
+type QuarantinedThing struct {
+	ID      string    `json:"id"`
+	Expires time.Time `json:"expires"`
+}
+
+// rateCounter counts the requests of a thing within the current window
+type rateCounter struct {
+	windowStart time.Time
+	count       int
+	baseline    float64
+	reported    bool
+}
+
+// observe a request and return true if the count of the window exceeds the threshold for the first time
+func (r *rateCounter) observe(now time.Time, window time.Duration, exceeds func(count int, baseline float64) bool) bool {
+	if elapsed := now.Sub(r.windowStart); elapsed >= window {
+		r.baseline += anomalyBaselineWeight * (float64(r.count) - r.baseline)
+		// windows without requests decay the average rate
+		for i := 1; i < int(elapsed/window) && r.baseline > 0; i++ {
+			r.baseline *= 1 - anomalyBaselineWeight
+		}
+		r.windowStart = now
+		r.count = 0
+		r.reported = false
+	}
+	r.count++
+	if r.reported || !exceeds(r.count, r.baseline) {
+		return false
+	}
+	r.reported = true
+	return true
+}
+
+// anomalyDetector counts the requests of things and reports anomalies to the hook
+type anomalyDetector struct {
+	config AnomalyConfig
+	mutex  sync.Mutex
+	// rate counters by anomaly type and subject
+	counters *cache.Cache
+}
+
+func newAnomalyDetector(config AnomalyConfig) *anomalyDetector {
+	return &anomalyDetector{
+		config:   config,
+		counters: cache.New(10*config.Window, 10*config.Window),
+	}
+}
+
+// observe a request of the subject and return the event if it is anomalous
+func (d *anomalyDetector) observe(anomaly AnomalyType, subject string,
+	exceeds func(count int, baseline float64) bool) (event AnomalyEvent, ok bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	key := string(anomaly) + "/" + subject
+	counter := &rateCounter{windowStart: time.Now()}
+	if cached, found := d.counters.Get(key); found {
+		counter = cached.(*rateCounter)
+	}
+	ok = counter.observe(time.Now(), d.config.Window, exceeds)
+	d.counters.SetDefault(key, counter)
+	return AnomalyEvent{Time: time.Now(), Type: anomaly, Count: counter.count, Baseline: counter.baseline}, ok
+}
+
+// report the anomaly to the hook and apply the returned action
+func (c *ThingGateway) reportAnomaly(event AnomalyEvent) {
+	action := c.anomalies.config.Hook(event)
+	if action == AnomalyQuarantine && event.ThingID != "" {
+		c.access.quarantine(event.ThingID, c.anomalies.config.Quarantine)
+		c.log.Infof("Thing %s quarantined after %s", event.ThingID, event.Type)
+		c.events.publish(Event{Type: EventThingQuarantined, ThingID: event.ThingID, Detail: event.Detail})
+	}
+}
+
+// detectAuthenticationStorm counts the authentication request of the thing, or of the peer address if the request
+// does not identify the thing
+func (c *ThingGateway) detectAuthenticationStorm(thingID, address string) {
+	if c.anomalies == nil {
+		return
+	}
+	subject := thingID
+	if subject == "" {
+		subject = address
+	}
+	config := c.anomalies.config
+	event, ok := c.anomalies.observe(AnomalyAuthenticationStorm, subject, func(count int, baseline float64) bool {
+		return count >= config.MinAuthentications && float64(count) > config.StormFactor*baseline
+	})
+	if !ok {
+		return
+	}
+	if thingID != "" {
+		event.ThingID = thingID
+	} else {
+		event.Address = address
+	}
+	event.Detail = fmt.Sprintf("%d authentication requests within %s", event.Count, config.Window)
+	c.reportAnomaly(event)
+}
+
+// requestedScopes returns the scopes requested in the payload of an access token request
+func requestedScopes(content client.ContentType, payload string) []string {
+	var request client.GetAccessTokenPayload
+	var err error
+	if content == client.ApplicationJOSE {
+		err = jws.ExtractClaims(payload, &request)
+	} else {
+		err = json.Unmarshal([]byte(payload), &request)
+	}
+	if err != nil {
+		return nil
+	}
+	return request.Scope
+}
+
+// refusedScopes returns the requested scopes that AM did not grant with the reply to an access token request
+func refusedScopes(requested []string, reply []byte, err error) []string {
+	if err != nil {
+		// the thing is not allowed the scopes or AM rejected them as invalid
+		if errors.Is(err, client.ErrForbidden) || (errors.Is(err, client.ErrPayloadInvalid) && errors.As(err, &client.AMError{})) {
+			return requested
+		}
+		return nil
+	}
+	var response struct {
+		Scope string `json:"scope"`
+	}
+	if json.Unmarshal(reply, &response) != nil {
+		return nil
+	}
+	granted := make(map[string]bool)
+	for _, scope := range strings.Fields(response.Scope) {
+		granted[scope] = true
+	}
+	var refused []string
+	for _, scope := range requested {
+		if !granted[scope] {
+			refused = append(refused, scope)
+		}
+	}
+	return refused
+}
+
+// detectScopeEscalation counts the access token request of the session if AM did not grant the requested scopes
+func (c *ThingGateway) detectScopeEscalation(token string, content client.ContentType, payload string, reply []byte,
+	err error) {
+	if c.anomalies == nil {
+		return
+	}
+	thingID := c.access.thingOf(token)
+	if thingID == "" {
+		return
+	}
+	refused := refusedScopes(requestedScopes(content, payload), reply, err)
+	if len(refused) == 0 {
+		return
+	}
+	config := c.anomalies.config
+	event, ok := c.anomalies.observe(AnomalyScopeEscalation, thingID, func(count int, _ float64) bool {
+		return count >= config.ScopeEscalations
+	})
+	if !ok {
+		return
+	}
+	event.ThingID = thingID
+	event.Detail = fmt.Sprintf("scopes %s not granted", strings.Join(refused, " "))
+	c.reportAnomaly(event)
+}
+
+// thingOf returns the thing for which the session was created, if known
+func (a *accessControl) thingOf(token string) string {
+	if a == nil {
+		return ""
+	}
+	if thingID, ok := a.sessions.Get(token); ok {
+		return thingID.(string)
+	}
+	return ""
+}
+
+// quarantine the thing for the given period
+func (a *accessControl) quarantine(thingID string, d time.Duration) {
+	a.quarantined.Set(thingID, time.Now().Add(d), d)
+}
+
+// quarantinedThings returns the things that are quarantined, sorted by ID
+func (a *accessControl) quarantinedThings() []QuarantinedThing {
+	things := []QuarantinedThing{}
+	if a == nil {
+		return things
+	}
+	for id, item := range a.quarantined.Items() {
+		things = append(things, QuarantinedThing{ID: id, Expires: item.Object.(time.Time)})
+	}
+	sort.Slice(things, func(i, j int) bool {
+		return things[i].ID < things[j].ID
+	})
+	return things
+}
+
+// isQuarantined returns true if the thing is quarantined
+func (a *accessControl) isQuarantined(thingID string) bool {
+	if a == nil {
+		return false
+	}
+	_, ok := a.quarantined.Get(thingID)
+	return ok
+}
+
+// EnableAnomalyDetection reports anomalies in the request patterns of things to the hook of the configuration.
+// Must be called before the CoAP server is started.
+func (c *ThingGateway) EnableAnomalyDetection(config AnomalyConfig) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+	c.anomalies = newAnomalyDetector(config)
+	return nil
+}
+
+// QuarantinedThings returns the things whose requests are denied after an anomaly
+func (c *ThingGateway) QuarantinedThings() []QuarantinedThing {
+	return c.access.quarantinedThings()
+}
+
+// ReleaseThing lifts the quarantine of the thing. Returns false if the thing is not quarantined.
+func (c *ThingGateway) ReleaseThing(thingID string) bool {
+	if !c.access.isQuarantined(thingID) {
+		return false
+	}
+	c.access.quarantined.Delete(thingID)
+	return true
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+)
+
+func TestRateCounter_observe(t *testing.T) {
+	start := time.Now()
+	storm := func(count int, baseline float64) bool {
+		return count >= 3 && float64(count) > 2*baseline
+	}
+	tests := []struct {
+		name     string
+		requests []int // requests per window
+		reported bool  // anomaly reported in the last window
+	}{
+		{name: "quiet", requests: []int{2}},
+		{name: "storm", requests: []int{3}, reported: true},
+		{name: "steady", requests: []int{4, 4, 4, 4, 4, 4, 4, 4}},
+		{name: "sudden-increase", requests: []int{4, 4, 4, 4, 4, 4, 4, 20}, reported: true},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			counter := &rateCounter{windowStart: start}
+			var reports int
+			for window, count := range subtest.requests {
+				reports = 0
+				for i := 0; i < count; i++ {
+					if counter.observe(start.Add(time.Duration(window)*time.Minute), time.Minute, storm) {
+						reports++
+					}
+				}
+			}
+			if reports > 1 {
+				t.Errorf("expected at most one report per window; got %d", reports)
+			}
+			if reported := reports == 1; reported != subtest.reported {
+				t.Errorf("expected reported %v; got %v", subtest.reported, reported)
+			}
+		})
+	}
+}
+
+func TestRefusedScopes(t *testing.T) {
+	requested := []string{"read", "write"}
+	tests := []struct {
+		name    string
+		reply   string
+		err     error
+		refused int
+	}{
+		{name: "granted", reply: `{"scope":"write read"}`},
+		{name: "downgraded", reply: `{"scope":"read"}`, refused: 1},
+		{name: "forbidden", err: client.AMError{Code: 403}, refused: 2},
+		{name: "invalid-scope", err: client.AMError{Code: 400}, refused: 2},
+		{name: "unreachable", err: client.ErrAMUnreachable},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			if refused := refusedScopes(requested, []byte(subtest.reply), subtest.err); len(refused) != subtest.refused {
+				t.Errorf("expected %d refused scopes; got %v", subtest.refused, refused)
+			}
+		})
+	}
+}
+
+func TestThingGateway_AnomalyQuarantine(t *testing.T) {
+	gateway := testGateway(&mockClient{})
+	var events []AnomalyEvent
+	err := gateway.EnableAnomalyDetection(AnomalyConfig{
+		MinAuthentications: 2,
+		ScopeEscalations:   1,
+		Hook: func(event AnomalyEvent) AnomalyAction {
+			events = append(events, event)
+			if event.Type == AnomalyScopeEscalation {
+				return AnomalyQuarantine
+			}
+			return AnomalyIgnore
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		gateway.detectAuthenticationStorm("", "192.0.2.7")
+	}
+	if len(events) != 1 || events[0].Type != AnomalyAuthenticationStorm || events[0].Address != "192.0.2.7" {
+		t.Fatalf("expected one authentication storm of the address; got %v", events)
+	}
+
+	gateway.access.track("aToken", "pump-1")
+	gateway.detectScopeEscalation("aToken", client.ApplicationJSON, `{"scope":["admin"]}`, nil,
+		fmt.Errorf("%w", client.AMError{Code: 403}))
+	if len(events) != 2 || events[1].ThingID != "pump-1" {
+		t.Fatalf("expected a scope escalation of the thing; got %v", events)
+	}
+	if err = gateway.access.checkSession("aToken"); !errors.Is(err, errQuarantined) {
+		t.Errorf("expected %v; got %v", errQuarantined, err)
+	}
+	if quarantined := gateway.QuarantinedThings(); len(quarantined) != 1 || quarantined[0].ID != "pump-1" {
+		t.Errorf("expected pump-1 to be quarantined; got %v", quarantined)
+	}
+	if !gateway.ReleaseThing("pump-1") || gateway.ReleaseThing("pump-1") {
+		t.Error("expected the thing to be released once")
+	}
+	if err = gateway.access.checkThing("pump-1"); err != nil {
+		t.Errorf("expected the released thing to be allowed; got %v", err)
+	}
+}
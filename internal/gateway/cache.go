@@ -0,0 +1,196 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package gateway
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+	"github.com/patrickmn/go-cache"
+)
+
+// Response caching
+// When thousands of identical things boot at the same time they all read the AM information and their attributes,
+// which puts a burst of reads on AM. The gateway can cache these idempotent responses for a configurable time per
+// route. Attribute reads are cached per session and only for requests that are not signed, since the gateway can not
+// verify the signature of a proof of possession request and must leave that to AM. The cached attributes of a thing
+// expire no later than its session, see session lifetimes, and are removed when the gateway finds that its session is
+// no longer valid.
+// The gateway also supports ETag validation (RFC 7252 section 5.10.6) of cacheable responses: every cacheable response
+// carries an ETag derived from its payload and a thing that sends a request with the ETag of its stored response gets
+// a 2.03 Valid response without a payload if the response has not changed. Validation does not require the cache, so
+// that things polling their attributes save bandwidth even if the gateway must read the attributes from AM.
+
+// Cacheable routes
+const (
+	RouteAMInfo     = "/aminfo"
+	RouteAttributes = "/attributes"
+)
+
+// etagSize is the size in bytes of the ETags of cached responses
+const etagSize = 8
+
+// cachedResponse is a response held in the response cache
+type cachedResponse struct {
+	code    codes.Code
+	payload []byte
+	etag    []byte
+}
+
+// responseCache holds the responses of cacheable routes
+type responseCache struct {
+	// hits and misses count the lookups of the cache, first for 64-bit alignment on 32-bit platforms
+	hits   uint64
+	misses uint64
+	ttls   map[string]time.Duration
+	store  *cache.Cache
+}
+
+// responseETag returns the ETag of the payload
+func responseETag(payload []byte) []byte {
+	sum := sha256.Sum256(payload)
+	return sum[:etagSize]
+}
+
+// cacheKey returns the key of a response of the route
+func cacheKey(route string, parts ...string) string {
+	return route + "|" + strings.Join(parts, "|")
+}
+
+// attributesCacheKey returns the key of the attributes response for the session and attribute names
+func attributesCacheKey(token string, names []string) string {
+	sorted := append([]string(nil), names...)
+	sort.Strings(sorted)
+	return cacheKey(RouteAttributes, token, strings.Join(sorted, ","))
+}
+
+// get returns the cached response with the key
+func (c *responseCache) get(key string) (cachedResponse, bool) {
+	if c == nil {
+		return cachedResponse{}, false
+	}
+	value, ok := c.store.Get(key)
+	if !ok {
+		atomic.AddUint64(&c.misses, 1)
+		return cachedResponse{}, false
+	}
+	atomic.AddUint64(&c.hits, 1)
+	return value.(cachedResponse), true
+}
+
+// set caches the response of the route with the key if caching is enabled for the route
+func (c *responseCache) set(route, key string, response cachedResponse) {
+	if c == nil {
+		return
+	}
+	if ttl, ok := c.ttls[route]; ok {
+		c.store.Set(key, response, ttl)
+	}
+}
+
+// cacheSessionResponse caches the response of the route that belongs to the session if caching is enabled for the
+// route. The response expires no later than the session.
+func (c *ThingGateway) cacheSessionResponse(connection client.Connection, route, token, key string,
+	response cachedResponse) {
+	if c.cache == nil {
+		return
+	}
+	ttl, ok := c.cache.ttls[route]
+	if !ok {
+		return
+	}
+	if ttl = c.boundedTTL(connection, token, ttl); ttl > 0 {
+		c.cache.store.Set(key, response, ttl)
+	}
+}
+
+// evictSession removes the cached responses of the session
+func (c *responseCache) evictSession(token string) {
+	if c == nil {
+		return
+	}
+	prefix := cacheKey(RouteAttributes, token) + "|"
+	for key := range c.store.Items() {
+		if strings.HasPrefix(key, prefix) {
+			c.store.Delete(key)
+		}
+	}
+}
+
+// writeCacheable writes a cacheable response. If the request contains the ETag of the response, then a 2.03 Valid
+// response without a payload is written instead. ETags are not supported for OSCORE protected responses since OSCORE
+// protects the payload only.
+func (c *ThingGateway) writeCacheable(w coap.ResponseWriter, r *coap.Request, response cachedResponse) {
+	if _, protected := w.(*protectedResponseWriter); protected {
+		w.SetCode(response.code)
+		writeResponse(w, response.payload)
+		return
+	}
+	msg := w.NewResponse(response.code)
+	for _, etag := range r.Msg.Options(coap.ETag) {
+		if b, ok := etag.([]byte); ok && bytes.Equal(b, response.etag) {
+			msg.SetCode(codes.Valid)
+			msg.SetOption(coap.ETag, response.etag)
+			if err := w.WriteMsg(msg); err != nil {
+				c.log.Error(err)
+			}
+			return
+		}
+	}
+	msg.SetOption(coap.ETag, response.etag)
+	msg.SetOption(coap.ContentFormat, coap.AppJSON)
+	msg.SetPayload(response.payload)
+	if err := w.WriteMsg(msg); err != nil {
+		c.log.Error(err)
+	}
+}
+
+// cacheable creates a response that can be cached and written with writeCacheable
+func cacheable(code codes.Code, payload []byte) cachedResponse {
+	return cachedResponse{code: code, payload: payload, etag: responseETag(payload)}
+}
+
+// cacheableRequest returns true if the response to the request may be cached. Signed requests must be verified by AM.
+func cacheableRequest(content client.ContentType) bool {
+	return content != client.ApplicationJOSE
+}
+
+// EnableResponseCache makes the Thing Gateway cache the responses of the given routes for the given time to live,
+// reducing the number of reads from AM. The cacheable routes are RouteAMInfo and RouteAttributes.
+// Must be called before the CoAP server is started.
+func (c *ThingGateway) EnableResponseCache(ttls map[string]time.Duration) error {
+	for route, ttl := range ttls {
+		if route != RouteAMInfo && route != RouteAttributes {
+			return fmt.Errorf("route %s can not be cached", route)
+		}
+		if ttl <= 0 {
+			return fmt.Errorf("time to live of route %s must be positive", route)
+		}
+	}
+	c.cache = &responseCache{
+		ttls:  ttls,
+		store: cache.New(cache.NoExpiration, time.Minute),
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	frcrypto "github.com/JacoJooste/iot-edge/v7/internal/crypto"
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+)
+
+// testCacheGateway starts a gateway with response caching for the given routes
+func testCacheGateway(t *testing.T, m *mockClient, ttls map[string]time.Duration) *ThingGateway {
+	gateway := testGateway(m)
+	if err := gateway.EnableResponseCache(ttls); err != nil {
+		t.Fatal(err)
+	}
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err := gateway.StartCOAPServer(":0", serverKey); err != nil {
+		t.Fatal(err)
+	}
+	return gateway
+}
+
+func TestGatewayServer_ResponseCache_AMInfo(t *testing.T) {
+	var calls int32
+	m := &mockClient{amInfoFunc: func() (client.AMInfoResponse, error) {
+		atomic.AddInt32(&calls, 1)
+		return client.AMInfoResponse{Realm: "/things", ThingsVersion: "1"}, nil
+	}}
+	gateway := testCacheGateway(t, m, map[string]time.Duration{RouteAMInfo: time.Minute})
+	defer gateway.ShutdownCOAPServer()
+
+	cert, _ := frcrypto.PublicKeyCertificate(clientKey)
+	conn, err := (&coap.Client{Net: "udp-dtls", DTLSConfig: dtlsClientConfig(cert)}).Dial(gateway.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	request, _ := conn.NewGetRequest(RouteAMInfo)
+	first, err := conn.Exchange(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	etag, ok := first.Option(coap.ETag).([]byte)
+	if first.Code() != codes.Content || !ok {
+		t.Fatalf("expected content with an ETag; got %v", first)
+	}
+
+	// a request with the ETag of the cached response is validated without a payload
+	request, _ = conn.NewGetRequest(RouteAMInfo)
+	request.SetOption(coap.ETag, etag)
+	second, err := conn.Exchange(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Code() != codes.Valid || len(second.Payload()) != 0 {
+		t.Errorf("expected a valid response without a payload; got %v", second)
+	}
+
+	// a request with an old ETag receives the cached response
+	request, _ = conn.NewGetRequest(RouteAMInfo)
+	request.SetOption(coap.ETag, []byte("old-etag"))
+	third, err := conn.Exchange(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.Code() != codes.Content || string(third.Payload()) != string(first.Payload()) {
+		t.Errorf("expected the cached response; got %v", third)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("expected AM to be called once; got %d", n)
+	}
+}
+
+func TestGatewayServer_ResponseCache_Attributes(t *testing.T) {
+	var calls int32
+	m := &mockClient{attributesFunc: func(string, string, []string) ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		return []byte(`{"_id":"thing-1","colour":["blue"]}`), nil
+	}}
+	gateway := testCacheGateway(t, m, map[string]time.Duration{RouteAttributes: time.Minute})
+	defer gateway.ShutdownCOAPServer()
+
+	connection := gatewayConnection(t, gateway)
+	tests := []struct {
+		name    string
+		token   string
+		content client.ContentType
+		payload string
+		names   []string
+		calls   int32
+	}{
+		{name: "first-read", token: "session-1", content: client.ApplicationJSON, names: []string{"colour", "size"},
+			calls: 1},
+		{name: "cached", token: "session-1", content: client.ApplicationJSON, names: []string{"size", "colour"},
+			calls: 1},
+		{name: "other-session", token: "session-2", content: client.ApplicationJSON,
+			names: []string{"colour", "size"}, calls: 2},
+		{name: "signed", content: client.ApplicationJOSE, payload: ".eyJjc3JmIjoic2Vzc2lvbi0xIn0.",
+			names: []string{"colour", "size"}, calls: 3},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			if _, err := connection.Attributes(subtest.token, subtest.content, subtest.payload,
+				subtest.names); err != nil {
+				t.Fatal(err)
+			}
+			if n := atomic.LoadInt32(&calls); n != subtest.calls {
+				t.Errorf("expected %d calls to AM; got %d", subtest.calls, n)
+			}
+		})
+	}
+
+	// the cached responses of a session are removed when the session is no longer valid
+	gateway.sessionInvalid("session-1")
+	if _, err := connection.Attributes("session-1", client.ApplicationJSON, "", []string{"colour"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 4 {
+		t.Errorf("expected AM to be called after the session was invalidated; got %d calls", n)
+	}
+}
+
+func TestThingGateway_EnableResponseCache_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		ttls map[string]time.Duration
+	}{
+		{name: "not-cacheable", ttls: map[string]time.Duration{"/accesstoken": time.Minute}},
+		{name: "zero-ttl", ttls: map[string]time.Duration{RouteAMInfo: 0}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			if err := testGateway(&mockClient{}).EnableResponseCache(subtest.ttls); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestGatewayServer_ConditionalAttributes(t *testing.T) {
+	blue, red := `{"_id":"thing-1","colour":["blue"]}`, `{"_id":"thing-1","colour":["red"]}`
+	// the attributes are read by the handlers of the gateway
+	var attributes atomic.Value
+	attributes.Store(blue)
+	m := &mockClient{attributesFunc: func(string, string, []string) ([]byte, error) {
+		return []byte(attributes.Load().(string)), nil
+	}}
+	// ETags are validated without the response cache
+	gateway := testGateway(m)
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err := gateway.StartCOAPServer(":0", serverKey); err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.ShutdownCOAPServer()
+
+	connection := gatewayConnection(t, gateway)
+	reply, revision, err := client.ConditionalAttributes(connection, "session-1", client.ApplicationJSON, "", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != blue || revision == "" {
+		t.Fatalf("expected the attributes with a revision; got %s, %q", reply, revision)
+	}
+	reply, next, err := client.ConditionalAttributes(connection, "session-1", client.ApplicationJSON, "", nil, revision)
+	if !errors.Is(err, client.ErrNotModified) || len(reply) != 0 || next != revision {
+		t.Errorf("expected unchanged attributes to be not modified; got %s, %q, %v", reply, next, err)
+	}
+	attributes.Store(red)
+	reply, next, err = client.ConditionalAttributes(connection, "session-1", client.ApplicationJSON, "", nil, revision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != red || next == revision {
+		t.Errorf("expected the changed attributes with a new revision; got %s, %q", reply, next)
+	}
+}
@@ -0,0 +1,190 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/JacoJooste/iot-edge/v7/internal/jws"
+	"github.com/JacoJooste/iot-edge/v7/pkg/callback"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// Certificate chain validation
+// AM verifies that the certificate in a registration JWT is signed by a trusted CA, but it does not know which
+// manufacturers are allowed to register things in a realm. Before a registration is forwarded to AM, the gateway
+// validates the certificate chain in the JWK of the registration JWT against the policy of the realm in the JWT
+// audience. Registrations for realms without a policy are forwarded unchanged.
+
+var errCertificateRejected = fmt.Errorf("%w: certificate chain rejected", client.ErrForbidden)
+
+// CertificatePolicy determines which certificate chains are accepted when a thing registers with certificates
+type CertificatePolicy struct {
+	// Roots contains the manufacturer CAs that are trusted to issue thing certificates
+	Roots *x509.CertPool
+	// Intermediates contains intermediate certificates that are used to build chains in addition to the ones supplied
+	// by the thing. Ignored if RequireFullChain is set.
+	Intermediates []*x509.Certificate
+	// RequireFullChain requires the thing to supply all the certificates between its own certificate and the root
+	RequireFullChain bool
+	// PinnedIntermediates contains the SHA-256 fingerprints of intermediate certificates. If not empty, the verified
+	// chain must contain at least one of the pinned certificates.
+	PinnedIntermediates [][]byte
+	// Verify is called with the verified chains and may reject the registration by returning an error
+	Verify func(chains [][]*x509.Certificate) error
+}
+
+// CertificateFingerprint returns the SHA-256 fingerprint of the certificate, as used for intermediate pinning
+func CertificateFingerprint(cert *x509.Certificate) []byte {
+	d := sha256.Sum256(cert.Raw)
+	return d[:]
+}
+
+// registrationClaims contains the claims of a registration JWT that are of interest to the certificate policy
+type registrationClaims struct {
+	Aud string `json:"aud"`
+	CNF struct {
+		JWK *jose.JSONWebKey `json:"jwk,omitempty"`
+	} `json:"cnf"`
+}
+
+// validate the certificate chain against the policy
+func (p CertificatePolicy) validate(certificates []*x509.Certificate) error {
+	if len(certificates) == 0 {
+		return errors.New("no certificates")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         p.Roots,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	// if a full chain is required, only the certificates supplied by the thing are used to build the chain
+	if !p.RequireFullChain {
+		for _, cert := range p.Intermediates {
+			opts.Intermediates.AddCert(cert)
+		}
+	}
+	for _, cert := range certificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	chains, err := certificates[0].Verify(opts)
+	if err != nil {
+		return err
+	}
+	if len(p.PinnedIntermediates) > 0 {
+		chains = filterChains(chains, p.pinned)
+		if len(chains) == 0 {
+			return errors.New("no pinned intermediate certificate in chain")
+		}
+	}
+	if p.Verify != nil {
+		return p.Verify(chains)
+	}
+	return nil
+}
+
+// pinned returns true if the chain contains one of the pinned intermediate certificates
+func (p CertificatePolicy) pinned(chain []*x509.Certificate) bool {
+	if len(chain) < 3 {
+		return false
+	}
+	for _, cert := range chain[1 : len(chain)-1] {
+		fingerprint := CertificateFingerprint(cert)
+		for _, pin := range p.PinnedIntermediates {
+			if bytes.Equal(fingerprint, pin) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func filterChains(chains [][]*x509.Certificate, keep func([]*x509.Certificate) bool) [][]*x509.Certificate {
+	var filtered [][]*x509.Certificate
+	for _, chain := range chains {
+		if keep(chain) {
+			filtered = append(filtered, chain)
+		}
+	}
+	return filtered
+}
+
+// matchesKey checks that the first certificate contains the public key of the JWK
+func matchesKey(certificates []*x509.Certificate, jwk *jose.JSONWebKey) error {
+	if len(certificates) == 0 {
+		return nil
+	}
+	expected, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return err
+	}
+	actual, err := (&jose.JSONWebKey{Key: certificates[0].PublicKey}).Thumbprint(crypto.SHA256)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(expected, actual) {
+		return errors.New("certificate does not match the JWK")
+	}
+	return nil
+}
+
+// checkCertificatePolicy validates the certificates of any registration JWT in the callbacks against the policy of
+// the realm that the thing is registering in
+func (c *ThingGateway) checkCertificatePolicy(callbacks []callback.Callback) error {
+	if len(c.certPolicies) == 0 {
+		return nil
+	}
+	token, ok := popResponses(callbacks)[registrationCBID]
+	if !ok {
+		return nil
+	}
+	var claims registrationClaims
+	if err := jws.ExtractClaims(token, &claims); err != nil {
+		return fmt.Errorf("%w: %s", client.ErrPayloadInvalid, err)
+	}
+	policy, ok := c.certPolicies[claims.Aud]
+	if !ok {
+		return nil
+	}
+	if claims.CNF.JWK == nil {
+		return fmt.Errorf("%w; no JWK", errCertificateRejected)
+	}
+	certificates := claims.CNF.JWK.Certificates
+	if err := matchesKey(certificates, claims.CNF.JWK); err != nil {
+		return fmt.Errorf("%w; %s", errCertificateRejected, err)
+	}
+	if err := policy.validate(certificates); err != nil {
+		return fmt.Errorf("%w; %s", errCertificateRejected, err)
+	}
+	return nil
+}
+
+// SetCertificatePolicy sets the policy that is applied to the certificates of things that register in the realm.
+// The realm must match the audience of the registration JWT.
+// Must be called before the CoAP server is started.
+func (c *ThingGateway) SetCertificatePolicy(realm string, policy CertificatePolicy) {
+	if c.certPolicies == nil {
+		c.certPolicies = make(map[string]CertificatePolicy)
+	}
+	c.certPolicies[realm] = policy
+}
@@ -0,0 +1,161 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/JacoJooste/iot-edge/v7/pkg/callback"
+)
+
+var testSerial int64
+
+// testCertificate creates a certificate for the key, signed by the issuer or self-signed if the issuer is nil
+func testCertificate(t *testing.T, name string, key crypto.Signer, isCA bool, issuer *x509.Certificate, issuerKey crypto.Signer) *x509.Certificate {
+	testSerial++
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(testSerial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	if issuer == nil {
+		issuer, issuerKey = template, key
+	}
+	b, err := x509.CreateCertificate(rand.Reader, template, issuer, key.Public(), issuerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// testRegistration returns an authentication payload containing a registration JWT with the given certificates
+func testRegistration(t *testing.T, realm string, key crypto.Signer, certificates []*x509.Certificate) client.AuthenticatePayload {
+	cb := callback.Callback{
+		Type:   callback.TypeHiddenValueCallback,
+		Output: []callback.Entry{{Name: "id", Value: registrationCBID}, {Name: "value", Value: "1"}},
+		Input:  make([]callback.Entry, 1),
+	}
+	_, err := callback.RegisterHandler{
+		Audience:     realm,
+		ThingID:      "thingOne",
+		ThingType:    callback.TypeDevice,
+		KeyID:        "pop.cnf",
+		Key:          key,
+		Certificates: certificates,
+	}.Handle(cb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client.AuthenticatePayload{Callbacks: []callback.Callback{cb}}
+}
+
+func TestThingGateway_CertificatePolicy(t *testing.T) {
+	rootKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	root := testCertificate(t, "root", rootKey, true, nil, nil)
+	intermediateKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	intermediate := testCertificate(t, "intermediate", intermediateKey, true, root, rootKey)
+	otherIntermediateKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherIntermediate := testCertificate(t, "other intermediate", otherIntermediateKey, true, root, rootKey)
+	thingKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	thingCert := testCertificate(t, "thingOne", thingKey, false, intermediate, intermediateKey)
+	otherThingCert := testCertificate(t, "thingOne", thingKey, false, otherIntermediate, otherIntermediateKey)
+	wrongKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	untrustedKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	untrusted := testCertificate(t, "thingOne", thingKey, false, nil, untrustedKey)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	errRejected := errors.New("rejected by operator")
+
+	tests := []struct {
+		name         string
+		realm        string
+		policy       CertificatePolicy
+		key          crypto.Signer
+		certificates []*x509.Certificate
+		successful   bool
+	}{
+		{name: "full-chain", policy: CertificatePolicy{Roots: roots}, key: thingKey,
+			certificates: []*x509.Certificate{thingCert, intermediate}, successful: true},
+		{name: "configured-intermediate", policy: CertificatePolicy{Roots: roots, Intermediates: []*x509.Certificate{intermediate}},
+			key: thingKey, certificates: []*x509.Certificate{thingCert}, successful: true},
+		{name: "missing-intermediate", policy: CertificatePolicy{Roots: roots}, key: thingKey,
+			certificates: []*x509.Certificate{thingCert}},
+		{name: "full-chain-required", policy: CertificatePolicy{Roots: roots, Intermediates: []*x509.Certificate{intermediate}, RequireFullChain: true},
+			key: thingKey, certificates: []*x509.Certificate{thingCert}},
+		{name: "no-certificates", policy: CertificatePolicy{Roots: roots}, key: thingKey},
+		{name: "untrusted-root", policy: CertificatePolicy{Roots: roots}, key: thingKey,
+			certificates: []*x509.Certificate{untrusted}},
+		{name: "certificate-key-mismatch", policy: CertificatePolicy{Roots: roots}, key: wrongKey,
+			certificates: []*x509.Certificate{thingCert, intermediate}},
+		{name: "pinned-intermediate", policy: CertificatePolicy{Roots: roots, PinnedIntermediates: [][]byte{CertificateFingerprint(intermediate)}},
+			key: thingKey, certificates: []*x509.Certificate{thingCert, intermediate}, successful: true},
+		{name: "unpinned-intermediate", policy: CertificatePolicy{Roots: roots, PinnedIntermediates: [][]byte{CertificateFingerprint(intermediate)}},
+			key: thingKey, certificates: []*x509.Certificate{otherThingCert, otherIntermediate}},
+		{name: "verify-callback", policy: CertificatePolicy{Roots: roots, Verify: func([][]*x509.Certificate) error {
+			return errRejected
+		}}, key: thingKey, certificates: []*x509.Certificate{thingCert, intermediate}},
+		{name: "other-realm", realm: "/other", policy: CertificatePolicy{Roots: roots}, key: thingKey, successful: true},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			forwarded := false
+			gateway := testGateway(&mockClient{
+				AuthenticateFunc: func(payload client.AuthenticatePayload) (reply client.AuthenticatePayload, err error) {
+					forwarded = true
+					reply.TokenID = "12345"
+					return reply, nil
+				}})
+			gateway.SetCertificatePolicy("/", subtest.policy)
+			realm := subtest.realm
+			if realm == "" {
+				realm = "/"
+			}
+			_, err := gateway.authenticate(gateway.amConnection, testRegistration(t, realm, subtest.key, subtest.certificates))
+			if subtest.successful {
+				if err != nil {
+					t.Error(err)
+				}
+				return
+			}
+			if !errors.Is(err, client.ErrForbidden) {
+				t.Errorf("expected %v, got %v", client.ErrForbidden, err)
+			}
+			if forwarded {
+				t.Error("rejected registration forwarded to AM")
+			}
+		})
+	}
+}
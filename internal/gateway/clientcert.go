@@ -0,0 +1,112 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/go-ocf/go-coap"
+	"github.com/pion/dtls/v2"
+)
+
+// Client certificate authentication
+// By default the gateway accepts any client certificate during the handshake since things are authenticated with JWT
+// PoP. When client certificates are required, the certificate chain presented by a thing must be issued by one of the
+// trusted CAs, giving transport level mutual authentication in addition to JWT PoP. The verified identity of the
+// thing is bound to its authentication:
+//    - the common name of the client certificate must match the subject of the JWT PoP sent by the thing
+//    - the client certificate is forwarded to AM with the authentication request, see client.ClientCertificateHeader
+// The CoAP server does not expose the connection of a request to its handlers, so the gateway manages the sessions
+// itself, as it does for connection limits, in order to find the certificate of the thing that sent a request.
+
+// errClientCertificate indicates that the client certificate of a thing is missing or does not match its identity
+var errClientCertificate = errors.New("client certificate does not match the thing")
+
+// RequireClientCertificates makes the CoAP server require client certificates that are issued by one of the given
+// CAs. The transport must be either DTLS or TLS.
+// Must be called before the CoAP server is started.
+func (c *ThingGateway) RequireClientCertificates(roots *x509.CertPool) {
+	c.clientCAs = roots
+}
+
+// requireDTLSClientCertificates configures the DTLS server to verify client certificates
+func (c *ThingGateway) requireDTLSClientCertificates(config *dtls.Config) {
+	if c.clientCAs == nil {
+		return
+	}
+	config.ClientAuth = dtls.RequireAndVerifyClientCert
+	config.ClientCAs = c.clientCAs
+}
+
+// requireTLSClientCertificates configures the TLS server to verify client certificates
+func (c *ThingGateway) requireTLSClientCertificates(config *tls.Config) {
+	if c.clientCAs == nil {
+		return
+	}
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	config.ClientCAs = c.clientCAs
+}
+
+// clientCertificate returns the verified client certificate of the thing that sent the request
+func (c *ThingGateway) clientCertificate(r *coap.Request) (*x509.Certificate, error) {
+	address := r.Client.RemoteAddr()
+	sessions := c.managedSessions()
+	if sessions == nil {
+		return nil, fmt.Errorf("no session with %s", address)
+	}
+	session, ok := sessions.session(address)
+	if !ok {
+		return nil, fmt.Errorf("no session with %s", address)
+	}
+	var raw []byte
+	switch conn := session.conn.(type) {
+	case *dtls.Conn:
+		if certs := conn.RemoteCertificate(); len(certs) > 0 {
+			raw = certs[0]
+		}
+	case *tls.Conn:
+		if certs := conn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			raw = certs[0].Raw
+		}
+	}
+	if raw == nil {
+		return nil, fmt.Errorf("no client certificate presented by %s", address)
+	}
+	return x509.ParseCertificate(raw)
+}
+
+// bindClientCertificate checks that the authentication is made by the thing to which the client certificate was issued
+// and returns a connection that forwards the certificate to AM
+func (c *ThingGateway) bindClientCertificate(connection client.Connection, r *coap.Request,
+	auth client.AuthenticatePayload) (client.Connection, error) {
+	if c.clientCAs == nil {
+		return connection, nil
+	}
+	cert, err := c.clientCertificate(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", client.ErrUnauthorised, err)
+	}
+	// the first request of an authentication flow does not contain a JWT PoP
+	if id := thingID(auth.Callbacks); id != "" && id != cert.Subject.CommonName {
+		return nil, fmt.Errorf("%w: %s", client.ErrUnauthorised, errClientCertificate)
+	}
+	return client.WithClientCertificate(connection, cert), nil
+}
@@ -0,0 +1,160 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/JacoJooste/iot-edge/v7/pkg/callback"
+)
+
+// testIssueCertificate issues a certificate for the public key, the certificate is self-signed if the parent is nil
+func testIssueCertificate(t *testing.T, name string, public crypto.PublicKey, parent *x509.Certificate,
+	signer crypto.Signer) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	if parent == nil {
+		parent = template
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, parent, public, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestGatewayServer_ClientCertificates(t *testing.T) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca := testIssueCertificate(t, "Manufacturer CA", caKey.Public(), nil, caKey)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	thingKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	thingCert := testIssueCertificate(t, "thing-1", thingKey.Public(), ca, caKey)
+	untrustedCert := testIssueCertificate(t, "thing-1", thingKey.Public(), nil, thingKey)
+
+	tests := []struct {
+		name         string
+		transport    Transport
+		certificates []*x509.Certificate
+		thingID      string
+		connects     bool
+		authorised   bool
+	}{
+		{name: "dtls", transport: TransportDTLS, certificates: []*x509.Certificate{thingCert}, thingID: "thing-1",
+			connects: true, authorised: true},
+		{name: "tls", transport: TransportTLS, certificates: []*x509.Certificate{thingCert}, thingID: "thing-1",
+			connects: true, authorised: true},
+		{name: "different-thing", transport: TransportDTLS, certificates: []*x509.Certificate{thingCert},
+			thingID: "thing-2", connects: true},
+		{name: "untrusted", transport: TransportDTLS, certificates: []*x509.Certificate{untrustedCert}},
+		{name: "self-signed-key", transport: TransportDTLS},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			gateway := testGateway(&mockClient{
+				AuthenticateFunc: func(client.AuthenticatePayload) (reply client.AuthenticatePayload, err error) {
+					reply.TokenID = "12345"
+					return reply, nil
+				}})
+			if err := gateway.SetTransport(subtest.transport); err != nil {
+				t.Fatal(err)
+			}
+			gateway.RequireClientCertificates(roots)
+			serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			if err := gateway.StartCOAPServer("127.0.0.1:0", serverKey); err != nil {
+				t.Fatal(err)
+			}
+			defer gateway.ShutdownCOAPServer()
+
+			scheme := "coaps"
+			if subtest.transport == TransportTLS {
+				scheme = "coaps+tcp"
+			}
+			gwURL, _ := url.Parse(scheme + "://" + gateway.Address())
+			connection, err := client.NewConnection().
+				ConnectTo(gwURL).
+				WithKey(thingKey).
+				WithCertificate(subtest.certificates).
+				WithGatewayTrust(client.GatewayTrust{PinnedKeys: []crypto.PublicKey{serverKey.Public()}}).
+				TimeoutRequestAfter(time.Second).
+				Create()
+			if !subtest.connects {
+				if err == nil {
+					t.Error("expected the connection to be rejected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cb := callback.Callback{
+				Type:   callback.TypeHiddenValueCallback,
+				Output: []callback.Entry{{Name: "id", Value: authenticationCBID}, {Name: "value", Value: "1"}},
+				Input:  make([]callback.Entry, 1),
+			}
+			handler := callback.AuthenticateHandler{Audience: "/", ThingID: subtest.thingID, KeyID: "pop.cnf",
+				Key: thingKey}
+			if _, err := handler.Handle(cb); err != nil {
+				t.Fatal(err)
+			}
+			_, err = connection.Authenticate(client.AuthenticatePayload{Callbacks: []callback.Callback{cb}})
+			if subtest.authorised && err != nil {
+				t.Error(err)
+			}
+			if !subtest.authorised && !errors.Is(err, client.ErrUnauthorised) {
+				t.Errorf("expected %v, got %v", client.ErrUnauthorised, err)
+			}
+		})
+	}
+}
+
+func TestGateway_RequireClientCertificates_TCP(t *testing.T) {
+	gateway := testGateway(&mockClient{})
+	if err := gateway.SetTransport(TransportTCP); err != nil {
+		t.Fatal(err)
+	}
+	gateway.RequireClientCertificates(x509.NewCertPool())
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err := gateway.StartCOAPServer("127.0.0.1:0", serverKey); err == nil {
+		gateway.ShutdownCOAPServer()
+		t.Error("expected client certificates to be rejected for an insecure transport")
+	}
+}
@@ -0,0 +1,42 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// errClockUnsynchronised indicates that the kernel reports that the system clock is not synchronised
+var errClockUnsynchronised = errors.New("system clock is not synchronised")
+
+// ClockSynchronisedGate returns a gate that is passed once the kernel reports that the system clock is synchronised,
+// for example by an NTP daemon or systemd-timesyncd
+func ClockSynchronisedGate(timeout time.Duration) (StartupGate, error) {
+	return StartupGate{Name: "clock", Timeout: timeout, Check: func() error {
+		state, err := unix.Adjtimex(&unix.Timex{})
+		if err != nil {
+			return err
+		}
+		if state == unix.TIME_ERROR {
+			return errClockUnsynchronised
+		}
+		return nil
+	}}, nil
+}
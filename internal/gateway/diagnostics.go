@@ -0,0 +1,210 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/jws"
+	"github.com/JacoJooste/iot-edge/v7/pkg/callback"
+)
+
+// Diagnostics
+// Commissioning scripts need to know whether a gateway will work before it is put into service. Diagnose runs the
+// steps of starting the gateway without serving traffic and reports the outcome of each step. A step is skipped if a
+// step that it depends on has failed, for example the authentication tree can not be checked if AM is unreachable.
+// Note that the gateway authenticates, or registers, with AM to check the tree and its keys.
+
+// DiagnosticStatus is the outcome of a diagnostic check
+type DiagnosticStatus string
+
+// The outcomes of a diagnostic check
+const (
+	DiagnosticPass DiagnosticStatus = "pass"
+	DiagnosticFail DiagnosticStatus = "fail"
+	DiagnosticSkip DiagnosticStatus = "skip"
+)
+
+// The diagnostic checks in the order in which they are run
+const (
+	// CheckConfiguration validates the configuration without connecting to AM
+	CheckConfiguration = "configuration"
+	// CheckKeys signs with the keys of the gateway
+	CheckKeys = "keys"
+	// CheckAM connects to AM and discovers its information in the realm, which fails if the realm does not exist
+	CheckAM = "am"
+	// CheckAuthentication authenticates the gateway with the authentication tree
+	CheckAuthentication = "authentication"
+	// CheckCoAP binds the CoAP server to its address
+	CheckCoAP = "coap"
+)
+
+// DiagnosticCheck is the result of a single diagnostic check
+type DiagnosticCheck struct {
+	Name     string           `json:"name"`
+	Status   DiagnosticStatus `json:"status"`
+	Detail   string           `json:"detail,omitempty"`
+	Duration time.Duration    `json:"duration"`
+}
+
+// DiagnosticReport contains the results of the diagnostic checks of the Thing Gateway
+type DiagnosticReport struct {
+	OK     bool              `json:"ok"`
+	Checks []DiagnosticCheck `json:"checks"`
+}
+
+func (r DiagnosticReport) String() string {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// Check returns the result of the named check
+func (r DiagnosticReport) Check(name string) (DiagnosticCheck, bool) {
+	for _, c := range r.Checks {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return DiagnosticCheck{}, false
+}
+
+// run the check unless one of the checks that it depends on did not pass
+func (r *DiagnosticReport) run(name string, check func() (string, error), dependencies ...string) {
+	result := DiagnosticCheck{Name: name, Status: DiagnosticPass}
+	for _, d := range dependencies {
+		if c, _ := r.Check(d); c.Status != DiagnosticPass {
+			result.Status = DiagnosticSkip
+			result.Detail = fmt.Sprintf("%s check did not pass", d)
+			r.Checks = append(r.Checks, result)
+			r.OK = false
+			return
+		}
+	}
+	start := time.Now()
+	detail, err := check()
+	result.Duration = time.Since(start)
+	result.Detail = detail
+	if err != nil {
+		result.Status = DiagnosticFail
+		result.Detail = err.Error()
+		r.OK = false
+	}
+	r.Checks = append(r.Checks, result)
+}
+
+// checkKeys signs a payload with each key of the gateway
+func (c *ThingGateway) checkKeys() (string, error) {
+	keys := 0
+	for _, h := range c.callbackHandlers {
+		var key crypto.Signer
+		switch h := h.(type) {
+		case callback.AuthenticateHandler:
+			key = h.Key
+		case callback.RegisterHandler:
+			key = h.Key
+		default:
+			continue
+		}
+		signer, err := jws.NewSigner(key, nil)
+		if err == nil {
+			_, err = signer.Sign([]byte("diagnostic"))
+		}
+		if err != nil {
+			return "", fmt.Errorf("gateway key: %w", err)
+		}
+		keys++
+	}
+	if c.upstream.key != nil {
+		if _, err := jws.NewSigner(c.upstream.key, nil); err != nil {
+			return "", fmt.Errorf("upstream key: %w", err)
+		}
+		keys++
+	}
+	return fmt.Sprintf("%d keys usable", keys), nil
+}
+
+// checkCoAP binds the CoAP server to the address and releases it
+func (c *ThingGateway) checkCoAP(address string, key crypto.Signer) (string, error) {
+	if c.coapServer != nil || c.managedSessions() != nil {
+		return "", ErrCOAPServerAlreadyStarted
+	}
+	if key == nil && c.identity == nil {
+		return "", jws.ErrMissingSigner
+	}
+	cert, err := c.serverCertificate(key)
+	if err != nil {
+		return "", err
+	}
+	l, err := c.listen(address, cert)
+	if err != nil {
+		return "", err
+	}
+	bound := l.Addr().String()
+	if err = l.Close(); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s available over %s", bound, c.serverTransport()), nil
+}
+
+// serverTransport returns the transport over which the CoAP server receives requests
+func (c *ThingGateway) serverTransport() Transport {
+	if c.transport == "" {
+		return TransportDTLS
+	}
+	return c.transport
+}
+
+// Diagnose checks that the Thing Gateway can be started with its configuration and returns a report of the checks.
+// The checks connect to AM and authenticate the gateway, which initialises the gateway, but the CoAP server is not
+// started. The address and key are those that would be passed to StartCOAPServer.
+func (c *ThingGateway) Diagnose(address string, key crypto.Signer) DiagnosticReport {
+	report := DiagnosticReport{OK: true}
+	report.run(CheckConfiguration, func() (string, error) {
+		return "", c.Validate()
+	})
+	report.run(CheckKeys, c.checkKeys, CheckConfiguration)
+	report.run(CheckAM, func() (string, error) {
+		if err := c.connect(); err != nil {
+			return "", err
+		}
+		info, err := c.amConnection.AMInfo()
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("realm %s at %s", info.Realm, c.amURL), nil
+	}, CheckConfiguration)
+	report.run(CheckAuthentication, func() (string, error) {
+		if err := c.authenticateGateway(); err != nil {
+			return "", err
+		}
+		if c.gatewayThing == nil {
+			return "", errors.New("gateway was not authenticated")
+		}
+		return fmt.Sprintf("authenticated with tree %s", c.authTree), nil
+	}, CheckAM, CheckKeys)
+	report.run(CheckCoAP, func() (string, error) {
+		return c.checkCoAP(address, key)
+	}, CheckConfiguration)
+	return report
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/pkg/amtest"
+	"github.com/JacoJooste/iot-edge/v7/pkg/callback"
+	"gopkg.in/square/go-jose.v2"
+)
+
+func TestThingGateway_Diagnose(t *testing.T) {
+	server := &amtest.Server{
+		Realm: "/edge",
+		Trees: map[string]amtest.Tree{"auth-tree": {amtest.AuthenticateThing{}}},
+	}
+	server.Start()
+	defer server.Close()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	server.AddThing(amtest.Thing{ID: "gateway-1", Type: string(callback.TypeGateway), Keys: jose.JSONWebKeySet{
+		Keys: []jose.JSONWebKey{{Key: key.Public(), KeyID: "pop.cnf", Algorithm: string(jose.ES256), Use: "sig"}},
+	}})
+	handlers := []callback.Handler{callback.AuthenticateHandler{
+		Audience: "/edge",
+		ThingID:  "gateway-1",
+		KeyID:    "pop.cnf",
+		Key:      key,
+	}}
+
+	pass, fail, skip := DiagnosticPass, DiagnosticFail, DiagnosticSkip
+	tests := []struct {
+		name     string
+		realm    string
+		tree     string
+		address  string
+		statuses []DiagnosticStatus // configuration, keys, am, authentication, coap
+	}{
+		{name: "healthy", realm: "/edge", tree: "auth-tree", address: "127.0.0.1:0",
+			statuses: []DiagnosticStatus{pass, pass, pass, pass, pass}},
+		{name: "invalid-configuration", realm: "/edge", tree: "auth tree", address: "127.0.0.1:0",
+			statuses: []DiagnosticStatus{fail, skip, skip, skip, skip}},
+		{name: "unknown-realm", realm: "/nowhere", tree: "auth-tree", address: "127.0.0.1:0",
+			statuses: []DiagnosticStatus{pass, pass, fail, skip, pass}},
+		{name: "unknown-tree", realm: "/edge", tree: "no-tree", address: "127.0.0.1:0",
+			statuses: []DiagnosticStatus{pass, pass, pass, fail, pass}},
+		{name: "unbindable-address", realm: "/edge", tree: "auth-tree", address: "127.0.0.1",
+			statuses: []DiagnosticStatus{pass, pass, pass, pass, fail}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			gateway := NewThingGateway(server.URL().String(), subtest.realm, subtest.tree, 5*time.Second, handlers)
+			report := gateway.Diagnose(subtest.address, key)
+			if len(report.Checks) != len(subtest.statuses) {
+				t.Fatalf("expected %d checks; got %s", len(subtest.statuses), report)
+			}
+			ok := true
+			for i, status := range subtest.statuses {
+				if report.Checks[i].Status != status {
+					t.Errorf("expected %s check to %s; got %s", report.Checks[i].Name, status, report)
+				}
+				ok = ok && status == pass
+			}
+			if report.OK != ok {
+				t.Errorf("expected OK %v; got %v", ok, report.OK)
+			}
+		})
+	}
+}
@@ -0,0 +1,400 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/JacoJooste/iot-edge/v7/internal/debug"
+)
+
+// Event publishing
+// The gateway publishes events about its lifecycle and the activity of things to publishers, such as webhooks or an
+// MQTT broker, so that fleet management dashboards can mirror the state of the edge without polling the admin API.
+// Events are queued and delivered in order by a single goroutine so that a slow publisher does not delay the requests
+// of things. Events are dropped when the queue is full and a failed delivery is logged and not retried, the events
+// are a notification and the admin API remains the source of truth.
+
+// defaultEventQueueSize is the number of events that are queued for delivery if the configuration does not set a size
+const defaultEventQueueSize = 256
+
+// eventShutdownTimeout is the maximum time for which the gateway waits for queued events to be delivered on shut down
+const eventShutdownTimeout = 5 * time.Second
+
+// EventType is the type of event published by the Thing Gateway
+type EventType string
+
+const (
+	// EventGatewayStarted is published when the CoAP server has started
+	EventGatewayStarted EventType = "gateway-started"
+	// EventGatewayStopped is published when the CoAP server shuts down
+	EventGatewayStopped EventType = "gateway-stopped"
+	// EventThingRegistered is published when a thing has registered with AM through the gateway
+	EventThingRegistered EventType = "thing-registered"
+	// EventThingAuthenticated is published when a thing has authenticated, with AM or offline, through the gateway
+	EventThingAuthenticated EventType = "thing-authenticated"
+	// EventTokenIssued is published when AM has issued an access token to a thing through the gateway
+	EventTokenIssued EventType = "token-issued"
+	// EventThingQuarantined is published when a thing is quarantined after an anomaly
+	EventThingQuarantined EventType = "thing-quarantined"
+)
+
+// Event describes a change in the state of the Thing Gateway or of a thing
+type Event struct {
+	Time time.Time `json:"time"`
+	Type EventType `json:"type"`
+	// Source identifies the gateway that published the event
+	Source  string `json:"source,omitempty"`
+	ThingID string `json:"thingId,omitempty"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+func (e Event) String() string {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// EventPublisher delivers events to a system outside the gateway
+type EventPublisher interface {
+	// Publish the event, returning an error if it could not be delivered
+	Publish(event Event) error
+}
+
+// EventConfig configures the publishing of events
+type EventConfig struct {
+	// Source is added to every event to identify the gateway, for example its name
+	Source     string
+	Publishers []EventPublisher
+	// QueueSize is the number of events that can wait for delivery, defaults to 256
+	QueueSize int
+}
+
+// WebhookPublisher publishes events by posting them as JSON to a URL
+type WebhookPublisher struct {
+	URL string
+	// Headers are added to every request, for example to authorise the gateway
+	Headers http.Header
+	// Client sends the requests, defaults to a client with a 5 second timeout
+	Client *http.Client
+}
+
+// Publish posts the event to the webhook, any status other than 2xx is a failure
+func (p WebhookPublisher) Publish(event Event) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, p.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	for name, values := range p.Headers {
+		request.Header[name] = values
+	}
+	request.Header.Set("Content-Type", string(client.ApplicationJSON))
+	httpClient := p.Client
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 5 * time.Second}
+	}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("webhook %s responded with status %d", p.URL, response.StatusCode)
+	}
+	return nil
+}
+
+// MQTTPublisher publishes events as JSON messages to a topic of an MQTT 3.1.1 broker with QoS 0. The connection to the
+// broker is opened when the first event is published and reopened after a failure.
+type MQTTPublisher struct {
+	// Address of the broker in the form host:port
+	Address string
+	Topic   string
+	// ClientID identifies the gateway to the broker, the broker assigns an ID if empty
+	ClientID string
+	Username string
+	Password string
+	// TLS configures a secure connection to the broker, the connection is not secured if nil
+	TLS *tls.Config
+	// Timeout of the connection and of every write, defaults to 5 seconds
+	Timeout time.Duration
+
+	mutex sync.Mutex
+	conn  net.Conn
+}
+
+// mqttString encodes a string in the length prefixed form used by MQTT
+func mqttString(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+// mqttPacket encodes a control packet with the remaining length of the body
+func mqttPacket(header byte, body []byte) []byte {
+	packet := []byte{header}
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+func (p *MQTTPublisher) timeout() time.Duration {
+	if p.Timeout == 0 {
+		return 5 * time.Second
+	}
+	return p.Timeout
+}
+
+// connect to the broker and wait for it to accept the connection
+func (p *MQTTPublisher) connect() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: p.timeout()}
+	var conn net.Conn
+	var err error
+	if p.TLS != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", p.Address, p.TLS)
+	} else {
+		conn, err = dialer.Dial("tcp", p.Address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// protocol name and level 4, clean session and no keep alive
+	flags := byte(0x02)
+	body := append(mqttString("MQTT"), 4, 0, 0, 0)
+	payload := mqttString(p.ClientID)
+	if p.Username != "" {
+		flags |= 0x80
+		payload = append(payload, mqttString(p.Username)...)
+	}
+	if p.Password != "" {
+		flags |= 0x40
+		payload = append(payload, mqttString(p.Password)...)
+	}
+	body[7] = flags
+	_ = conn.SetDeadline(time.Now().Add(p.timeout()))
+	if _, err = conn.Write(mqttPacket(0x10, append(body, payload...))); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	connack := make([]byte, 4)
+	if _, err = io.ReadFull(conn, connack); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if connack[0] != 0x20 || connack[3] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("MQTT broker %s refused the connection with code %d", p.Address, connack[3])
+	}
+	return conn, nil
+}
+
+// Publish the event to the topic
+func (p *MQTTPublisher) Publish(event Event) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	packet := mqttPacket(0x30, append(mqttString(p.Topic), b...))
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	// retry once with a new connection in case the broker has closed the previous one
+	for attempt := 0; ; attempt++ {
+		if p.conn == nil {
+			if p.conn, err = p.connect(); err != nil {
+				return err
+			}
+		}
+		_ = p.conn.SetDeadline(time.Now().Add(p.timeout()))
+		if _, err = p.conn.Write(packet); err == nil || attempt > 0 {
+			if err != nil {
+				p.close()
+			}
+			return err
+		}
+		p.close()
+	}
+}
+
+// Close disconnects from the broker
+func (p *MQTTPublisher) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.conn == nil {
+		return nil
+	}
+	_, err := p.conn.Write(mqttPacket(0xE0, nil))
+	p.close()
+	return err
+}
+
+func (p *MQTTPublisher) close() {
+	p.conn.Close()
+	p.conn = nil
+}
+
+// eventBus queues events and delivers them to the publishers
+type eventBus struct {
+	source     string
+	publishers []EventPublisher
+	queue      chan Event
+	mutex      sync.Mutex
+	running    bool
+	done       chan struct{}
+}
+
+func newEventBus(config EventConfig) *eventBus {
+	return &eventBus{
+		source:     config.Source,
+		publishers: config.Publishers,
+		queue:      make(chan Event, config.QueueSize),
+	}
+}
+
+// start delivering events
+func (b *eventBus) start() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.running {
+		return
+	}
+	b.running = true
+	b.done = make(chan struct{})
+	go func(queue chan Event, done chan struct{}) {
+		defer close(done)
+		for event := range queue {
+			for _, p := range b.publishers {
+				if err := p.Publish(event); err != nil {
+					debug.Errorf("Unable to publish event %s; %s", event.Type, err)
+				}
+			}
+		}
+	}(b.queue, b.done)
+}
+
+// publish queues the event for delivery, the event is dropped if the queue is full or the bus is not running
+func (b *eventBus) publish(event Event) {
+	if b == nil {
+		return
+	}
+	event.Source = b.source
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !b.running {
+		return
+	}
+	select {
+	case b.queue <- event:
+	default:
+		debug.Errorf("Event queue is full, dropping event %s", event.Type)
+	}
+}
+
+// shutdown delivers the queued events and stops the bus, waiting at most until the context is done
+func (b *eventBus) shutdown(ctx context.Context) error {
+	b.mutex.Lock()
+	if !b.running {
+		b.mutex.Unlock()
+		return nil
+	}
+	b.running = false
+	close(b.queue)
+	done := b.done
+	b.queue = make(chan Event, cap(b.queue))
+	b.mutex.Unlock()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// authenticationEvent returns the event published when a thing has completed authentication with the callbacks
+func authenticationEvent(auth client.AuthenticatePayload) Event {
+	event := Event{Type: EventThingAuthenticated, ThingID: thingID(auth.Callbacks)}
+	if _, ok := popResponses(auth.Callbacks)[registrationCBID]; ok {
+		event.Type = EventThingRegistered
+	}
+	return event
+}
+
+// EnableEvents publishes the lifecycle events of the Thing Gateway and the activity of things to the publishers of
+// the configuration.
+// Must be called before the CoAP server is started.
+func (c *ThingGateway) EnableEvents(config EventConfig) error {
+	if len(config.Publishers) == 0 {
+		return errors.New("at least one event publisher must be provided")
+	}
+	if config.QueueSize < 0 {
+		return errors.New("event queue size must not be negative")
+	}
+	if config.QueueSize == 0 {
+		config.QueueSize = defaultEventQueueSize
+	}
+	c.events = newEventBus(config)
+	return nil
+}
+
+// startEvents starts the delivery of events and publishes that the gateway has started
+func (c *ThingGateway) startEvents() {
+	if c.events == nil {
+		return
+	}
+	c.events.start()
+	c.events.publish(Event{Type: EventGatewayStarted, Detail: c.URL()})
+}
+
+// shutdownEvents publishes that the gateway has stopped and waits a limited time for the queued events to be delivered
+func (c *ThingGateway) shutdownEvents() {
+	if c.events == nil {
+		return
+	}
+	c.events.publish(Event{Type: EventGatewayStopped})
+	ctx, cancel := context.WithTimeout(context.Background(), eventShutdownTimeout)
+	defer cancel()
+	if err := c.events.shutdown(ctx); err != nil {
+		c.log.Errorf("Unable to deliver all events before shut down; %s", err)
+	}
+}
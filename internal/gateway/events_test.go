@@ -0,0 +1,225 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+)
+
+// recordingPublisher sends the published events to a channel
+type recordingPublisher chan Event
+
+func (p recordingPublisher) Publish(event Event) error {
+	p <- event
+	return nil
+}
+
+func (p recordingPublisher) next(t *testing.T) Event {
+	select {
+	case event := <-p:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event")
+		return Event{}
+	}
+}
+
+func TestMQTTPacket(t *testing.T) {
+	tests := []struct {
+		length int
+		header []byte
+	}{
+		{length: 0, header: []byte{0x30, 0x00}},
+		{length: 127, header: []byte{0x30, 0x7F}},
+		{length: 128, header: []byte{0x30, 0x80, 0x01}},
+		{length: 16384, header: []byte{0x30, 0x80, 0x80, 0x01}},
+	}
+	for _, subtest := range tests {
+		packet := mqttPacket(0x30, make([]byte, subtest.length))
+		if !bytes.Equal(packet[:len(subtest.header)], subtest.header) {
+			t.Errorf("length %d: expected header %x; got %x", subtest.length, subtest.header,
+				packet[:len(subtest.header)])
+		}
+		if len(packet) != len(subtest.header)+subtest.length {
+			t.Errorf("length %d: unexpected packet length %d", subtest.length, len(packet))
+		}
+	}
+}
+
+func TestWebhookPublisher(t *testing.T) {
+	received := make(chan Event, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer dashboard" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var event Event
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- event
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	event := Event{Type: EventThingRegistered, ThingID: "pump-1", Time: time.Now().UTC().Truncate(time.Second)}
+	publisher := WebhookPublisher{URL: server.URL, Headers: http.Header{"Authorization": {"Bearer dashboard"}}}
+	if err := publisher.Publish(event); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-received; got != event {
+		t.Errorf("expected %v; got %v", event, got)
+	}
+	if err := (WebhookPublisher{URL: server.URL}).Publish(event); err == nil {
+		t.Error("expected an error for an unauthorised webhook")
+	}
+}
+
+// readMQTTPacket reads a control packet with a single byte remaining length from the connection
+func readMQTTPacket(conn net.Conn) (header byte, body []byte, err error) {
+	fixed := make([]byte, 2)
+	if _, err = io.ReadFull(conn, fixed); err != nil {
+		return 0, nil, err
+	}
+	body = make([]byte, fixed[1])
+	_, err = io.ReadFull(conn, body)
+	return fixed[0], body, err
+}
+
+func TestMQTTPublisher(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	messages := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if header, body, err := readMQTTPacket(conn); err != nil || header != 0x10 ||
+			!bytes.Contains(body, []byte("gateway-1")) || !bytes.Contains(body, []byte("secret")) {
+			return
+		}
+		_, _ = conn.Write([]byte{0x20, 0x02, 0x00, 0x00})
+		if header, body, err := readMQTTPacket(conn); err == nil && header == 0x30 {
+			messages <- body
+		}
+	}()
+
+	publisher := &MQTTPublisher{
+		Address:  listener.Addr().String(),
+		Topic:    "edge/events",
+		ClientID: "gateway-1",
+		Username: "gateway",
+		Password: "secret",
+	}
+	defer publisher.Close()
+	if err = publisher.Publish(Event{Type: EventGatewayStarted}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case body := <-messages:
+		topic := string(body[2 : 2+int(body[1])])
+		var event Event
+		if err = json.Unmarshal(body[2+len(topic):], &event); err != nil {
+			t.Fatal(err)
+		}
+		if topic != "edge/events" || event.Type != EventGatewayStarted {
+			t.Errorf("unexpected message %s %v", topic, event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the message")
+	}
+}
+
+func TestThingGateway_Events(t *testing.T) {
+	gateway := testGateway(&mockClient{
+		AuthenticateFunc: func(client.AuthenticatePayload) (client.AuthenticatePayload, error) {
+			return client.AuthenticatePayload{SessionToken: client.SessionToken{TokenID: "aToken"}}, nil
+		},
+	})
+	publisher := make(recordingPublisher, 10)
+	if err := gateway.EnableEvents(EventConfig{Source: "edge-1", Publishers: []EventPublisher{publisher}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := gateway.EnableAnomalyDetection(AnomalyConfig{
+		Hook: func(AnomalyEvent) AnomalyAction { return AnomalyQuarantine },
+	}); err != nil {
+		t.Fatal(err)
+	}
+	gateway.startEvents()
+
+	if event := publisher.next(t); event.Type != EventGatewayStarted || event.Source != "edge-1" {
+		t.Errorf("unexpected event %v", event)
+	}
+	if _, err := gateway.authenticate(gateway.amConnection, testRegistration(t, "/realm", testThingKey(), nil)); err != nil {
+		t.Fatal(err)
+	}
+	if event := publisher.next(t); event.Type != EventThingRegistered || event.ThingID != "thingOne" {
+		t.Errorf("unexpected event %v", event)
+	}
+	gateway.reportAnomaly(AnomalyEvent{Type: AnomalyScopeEscalation, ThingID: "thingOne"})
+	if event := publisher.next(t); event.Type != EventThingQuarantined || event.ThingID != "thingOne" {
+		t.Errorf("unexpected event %v", event)
+	}
+
+	gateway.shutdownEvents()
+	if event := publisher.next(t); event.Type != EventGatewayStopped {
+		t.Errorf("unexpected event %v", event)
+	}
+	// events are dropped once the bus has shut down
+	gateway.events.publish(Event{Type: EventTokenIssued})
+	select {
+	case event := <-publisher:
+		t.Errorf("unexpected event after shut down %v", event)
+	default:
+	}
+	if err := gateway.events.shutdown(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestThingGateway_EnableEvents(t *testing.T) {
+	gateway := testGateway(&mockClient{})
+	if err := gateway.EnableEvents(EventConfig{}); err == nil {
+		t.Error("expected an error without publishers")
+	}
+	publishers := []EventPublisher{make(recordingPublisher)}
+	if err := gateway.EnableEvents(EventConfig{Publishers: publishers, QueueSize: -1}); err == nil {
+		t.Error("expected an error for a negative queue size")
+	}
+	if err := gateway.EnableEvents(EventConfig{Publishers: publishers}); err != nil {
+		t.Fatal(err)
+	}
+	if cap(gateway.events.queue) != defaultEventQueueSize {
+		t.Errorf("expected the default queue size; got %d", cap(gateway.events.queue))
+	}
+}
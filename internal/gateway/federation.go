@@ -0,0 +1,92 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"path"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+)
+
+// Gateway federation
+// A downstream Thing Gateway, for example in a vehicle or at a remote site, can chain through an upstream gateway
+// instead of connecting to AM directly by using the CoAP URL of the upstream gateway as its AM URL. The downstream
+// gateway authenticates itself and proxies the requests of its things over its connection with the upstream gateway,
+// presenting its upstream identity during the handshake.
+// The downstream gateway forwards the peer information of its things in CoAP options, see client.ForwardedPeer. The
+// upstream gateway only uses the forwarded information if it trusts the downstream gateway as a proxy, which requires
+// the downstream gateway to present a client certificate that the upstream gateway verifies and whose common name
+// matches one of the trusted proxies. The address of the downstream gateway is then appended to the forwarded address,
+// in the same way as X-Forwarded-For, so that AM sees the whole chain. The forwarded information of other peers is
+// ignored.
+// Everything else is passed through unchanged, so that the access list and the anomaly detection of the upstream
+// gateway apply to the things of the downstream gateway as well. Note that the access list of the upstream gateway
+// must allow the common name of the downstream gateway when it checks client certificates.
+
+// upstreamIdentity is presented by the gateway to an upstream gateway during the handshake
+type upstreamIdentity struct {
+	key          crypto.Signer
+	certificates []*x509.Certificate
+	// trust decides which certificates presented by the upstream gateway are trusted
+	trust client.GatewayTrust
+}
+
+// forwardedBy returns the peer that was forwarded by a trusted gateway, recording the gateway in the address chain
+func forwardedBy(forwarded, gateway client.PeerInfo) client.PeerInfo {
+	if forwarded.Address == "" {
+		forwarded.Address = gateway.Address
+	} else if gateway.Address != "" {
+		forwarded.Address += ", " + gateway.Address
+	}
+	return forwarded
+}
+
+// SetUpstreamIdentity sets the key and certificate chain with which the Thing Gateway identifies itself to an
+// upstream gateway during the DTLS or TLS handshake. A self-signed certificate is presented if no chain is given. The
+// identity is only used if the AM URL of the Thing Gateway is the CoAP URL of an upstream gateway.
+// Must be called before the Thing Gateway is initialised.
+func (c *ThingGateway) SetUpstreamIdentity(key crypto.Signer, certificates []*x509.Certificate) {
+	c.upstream.key, c.upstream.certificates = key, certificates
+}
+
+// SetUpstreamTrust decides which certificates presented by an upstream gateway during the handshake are trusted. Over
+// TLS, the certificate chain of the upstream gateway is verified against the root CAs of the system by default.
+// Must be called before the Thing Gateway is initialised.
+func (c *ThingGateway) SetUpstreamTrust(trust client.GatewayTrust) {
+	c.upstream.trust = trust
+}
+
+// SetTrustedProxies trusts the downstream gateways whose verified client certificates have one of the given common
+// names to forward the peer information of their things. Names may contain the wildcards of path.Match. Client
+// certificates must be required with RequireClientCertificates.
+// Must be called before the CoAP server is started.
+func (c *ThingGateway) SetTrustedProxies(names []string) error {
+	for _, name := range names {
+		if _, err := path.Match(name, ""); err != nil {
+			return fmt.Errorf("invalid trusted proxy `%s`; %w", name, err)
+		}
+	}
+	if len(names) > 0 && c.clientCAs == nil {
+		return errors.New("trusted proxies require client certificates")
+	}
+	c.trustedProxies = names
+	return nil
+}
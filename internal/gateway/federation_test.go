@@ -0,0 +1,140 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+)
+
+func TestGatewayServer_Federation(t *testing.T) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca := testIssueCertificate(t, "Site CA", caKey.Public(), nil, caKey)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	siteKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	siteCert := testIssueCertificate(t, "site-1", siteKey.Public(), ca, caKey)
+
+	tests := []struct {
+		name     string
+		proxies  []string
+		address  string
+		identity string
+	}{
+		{name: "trusted", proxies: []string{"site-*"}, address: "127.0.0.1, 127.0.0.1"},
+		{name: "untrusted", address: "127.0.0.1", identity: "CN=site-1"},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			var mutex sync.Mutex
+			var forwarded http.Header
+			mux := http.NewServeMux()
+			mux.HandleFunc("/json/serverinfo/*", func(writer http.ResponseWriter, request *http.Request) {
+				_, _ = writer.Write([]byte(`{"cookieName":"iPlanetDirectoryPro"}`))
+			})
+			mux.HandleFunc("/json/things/*", func(writer http.ResponseWriter, request *http.Request) {
+				mutex.Lock()
+				forwarded = request.Header
+				mutex.Unlock()
+				_, _ = writer.Write([]byte(`{}`))
+			})
+			mux.HandleFunc("/json/authenticate", func(writer http.ResponseWriter, request *http.Request) {
+				_, _ = writer.Write([]byte(`{"tokenId":"12345"}`))
+			})
+			am := httptest.NewServer(mux)
+			defer am.Close()
+
+			amURL, _ := url.Parse(am.URL)
+			amConnection, err := client.NewConnection().ConnectTo(amURL).Create()
+			if err != nil {
+				t.Fatal(err)
+			}
+			upstream := testGateway(nil)
+			upstream.amConnection = amConnection
+			upstream.RequireClientCertificates(roots)
+			if err = upstream.SetTrustedProxies(subtest.proxies); err != nil {
+				t.Fatal(err)
+			}
+			serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			if err = upstream.StartCOAPServer("127.0.0.1:0", serverKey); err != nil {
+				t.Fatal(err)
+			}
+			defer upstream.ShutdownCOAPServer()
+
+			downstream := NewThingGateway("coaps://"+upstream.Address(), "", "", time.Second, nil)
+			downstream.SetUpstreamIdentity(siteKey, []*x509.Certificate{siteCert})
+			if err = downstream.Initialise(); err != nil {
+				t.Fatal(err)
+			}
+			if err = downstream.StartCOAPServer("127.0.0.1:0", serverKey); err != nil {
+				t.Fatal(err)
+			}
+			defer downstream.ShutdownCOAPServer()
+
+			gwURL, _ := url.Parse("coaps://" + downstream.Address())
+			connection, err := client.NewConnection().
+				ConnectTo(gwURL).
+				WithKey(clientKey).
+				WithLinkMetadata(func() string {
+					return "rssi=-71"
+				}).
+				Create()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = connection.AccessToken("12345", client.ApplicationJSON, "{}"); err != nil {
+				t.Fatal(err)
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if address := forwarded.Get(client.ForwardedForHeader); address != subtest.address {
+				t.Errorf("expected forwarded address %s; got %s", subtest.address, address)
+			}
+			if identity := forwarded.Get(client.PeerIdentityHeader); identity != subtest.identity {
+				t.Errorf("expected forwarded identity %s; got %s", subtest.identity, identity)
+			}
+			if metadata := forwarded.Get(client.LinkMetadataHeader); metadata != "rssi=-71" {
+				t.Errorf("expected the link metadata of the thing; got %s", metadata)
+			}
+		})
+	}
+}
+
+func TestThingGateway_SetTrustedProxies(t *testing.T) {
+	gateway := testGateway(nil)
+	if err := gateway.SetTrustedProxies([]string{"site-1"}); err == nil {
+		t.Error("expected an error without client certificates")
+	}
+	gateway.RequireClientCertificates(x509.NewCertPool())
+	if err := gateway.SetTrustedProxies([]string{"site-["}); err == nil {
+		t.Error("expected an error for an invalid pattern")
+	}
+	if err := gateway.SetTrustedProxies([]string{"site-*"}); err != nil {
+		t.Error(err)
+	}
+}
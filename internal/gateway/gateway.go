@@ -20,21 +20,26 @@ import (
 	"crypto"
 	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/JacoJooste/iot-edge/v7/internal/client"
-	frcrypto "github.com/JacoJooste/iot-edge/v7/internal/crypto"
+	"github.com/JacoJooste/iot-edge/v7/internal/clock"
 	"github.com/JacoJooste/iot-edge/v7/internal/debug"
 	"github.com/JacoJooste/iot-edge/v7/internal/jws"
 	ithing "github.com/JacoJooste/iot-edge/v7/internal/thing"
 	"github.com/JacoJooste/iot-edge/v7/internal/tokencache"
 	"github.com/JacoJooste/iot-edge/v7/pkg/callback"
+	"github.com/JacoJooste/iot-edge/v7/pkg/extension"
 	"github.com/JacoJooste/iot-edge/v7/pkg/thing"
 	"github.com/go-ocf/go-coap"
 	"github.com/go-ocf/go-coap/codes"
@@ -47,6 +52,18 @@ import (
 // The CoAP response status codes follow the CoAP-HTTP proxy guidance in the CoAP specification
 // https://tools.ietf.org/html/rfc7252#section-10.1
 
+// Transport is the transport protocol over which the Thing Gateway serves CoAP requests
+type Transport string
+
+const (
+	// TransportDTLS serves CoAP over DTLS as defined in RFC 7252. This is the default transport.
+	TransportDTLS Transport = "udp-dtls"
+	// TransportTLS serves CoAP over TLS as defined in RFC 8323, for networks that do not allow UDP traffic
+	TransportTLS Transport = "tcp-tls"
+	// TransportTCP serves CoAP over TCP as defined in RFC 8323, without transport layer security
+	TransportTCP Transport = "tcp"
+)
+
 // ErrCOAPServerAlreadyStarted indicates that a CoAP server has already been started by the Thing Gateway
 var ErrCOAPServerAlreadyStarted = errors.New("CoAP server has already been started")
 
@@ -55,16 +72,89 @@ type ThingGateway struct {
 	gatewayThing     thing.Thing
 	authCache        *tokencache.Cache
 	callbackHandlers []callback.Handler
+	offline          *offlineAuthenticator
+	certPolicies     map[string]CertificatePolicy
+	revocation       *sessionRevocation
+	subscriptions    *attributeSubscriptions
+	proxies          []*adapterProxy
+	cache            *responseCache
+	warm             *warmSessions
+	identity         *serverIdentity
+	contentPolicy    ContentPolicy
+	issuer           *localIssuer
+	pages            *attributePages
+	lifetimes        *sessionLifetimes
+	access           *accessControl
+	anomalies        *anomalyDetector
+	usage            *usageTracker
+	events           *eventBus
 	// coap server
 	coapServer *coap.Server
 	coapChan   chan error
 	address    net.Addr
+	blockSize  int
+	transport  Transport
+	ipv6Only   bool
+	// tlsProfile restricts the security parameters of the handshakes with things
+	tlsProfile client.TLSProfile
+	limits     ConnectionLimits
+	// payloadLimits apply to requests from things and responses from AM
+	payloadLimits PayloadLimits
+	// guard sheds new handshakes when the gateway is short of resources, see resources.go
+	guard *resourceGuard
+	// sessions are managed by the gateway if it applies limits or reads client certificates, they are guarded by
+	// sessionsMutex since the handlers of in-flight requests read them while the server shuts down
+	sessions      *sessionManager
+	sessionsMutex sync.RWMutex
+	// maintenance staggers the proactive work of the gateway, see maintenance.go
+	maintenance *maintenanceScheduler
+	oscore      oscoreContexts
+	// separate deduplicates requests and acknowledges those waiting for slow AM operations, see separate.go
+	separate *separateResponses
+	// idempotency holds the responses to requests with idempotency keys, see idempotency.go
+	idempotency *idempotentRequests
+	// client certificates are only verified if trusted CAs are set
+	clientCAs *x509.CertPool
+	// common names of the downstream gateways that are trusted to forward the peers of their things
+	trustedProxies []string
+	// admin server and the bearer token required by its API
+	adminServer  *http.Server
+	adminAddress net.Addr
+	adminToken   string
+	// AM compatibility server, see amcompat.go
+	compatServer  *http.Server
+	compatAddress net.Addr
+	// probe server and the state used to drain the CoAP server, see probe.go
+	probeServer  *http.Server
+	probeAddress net.Addr
+	requests     int32
+	draining     int32
 	// AM connection
 	amConnection client.Connection
 	amURL        string
 	realm        string
 	authTree     string
 	timeout      time.Duration
+	// priorities of the concurrent requests made to AM
+	priorities RequestPriorities
+	// session token transport
+	sessionCookie string
+	sessionHeader string
+	// identification and static headers added to AM requests
+	userAgent string
+	headers   http.Header
+	// identity presented to an upstream gateway
+	upstream upstreamIdentity
+	// amInfoCache stores the information discovered from AM between restarts
+	amInfoCache *client.AMInfoCache
+	// amTransport records or replays the interactions with AM, see replay.go
+	amTransport http.RoundTripper
+	// startupGates are waited for before the gateway is initialised
+	startupGates []StartupGate
+	// filters decide whether the requests of things are served, see AddRequestFilter
+	filters []extension.Filter
+	// log writes the debug information of the gateway, see SetDebugLevel
+	log debug.Log
 }
 
 // NewThingGateway creates a new Thing Gateway
@@ -76,27 +166,94 @@ func NewThingGateway(baseURL string, realm string, authTree string, timeout time
 		authTree:         authTree,
 		callbackHandlers: handlers,
 		timeout:          timeout,
+		access:           newAccessControl(),
 	}
 }
 
+// Validate checks the configuration of the Thing Gateway without connecting to AM. All the problems that are found are
+// returned in a client.ConfigError.
+func (c *ThingGateway) Validate() error {
+	var problems []error
+	amURL, err := url.Parse(c.amURL)
+	if err != nil {
+		problems = append(problems, err)
+	} else {
+		problems = append(problems, client.ValidateURL(amURL))
+		if client.IsAMScheme(amURL.Scheme) && c.authTree == "" {
+			problems = append(problems, errors.New("authentication tree must be provided"))
+		}
+		problems = append(problems, c.upstream.trust.ValidateScheme(amURL.Scheme))
+	}
+	problems = append(problems, client.ValidateRealm(c.realm), client.ValidateTree(c.authTree),
+		client.ValidateCertificateKey(c.upstream.certificates, c.upstream.key), c.validateTLSProfile())
+	for _, h := range c.callbackHandlers {
+		var key crypto.Signer
+		switch h := h.(type) {
+		case callback.AuthenticateHandler:
+			key = h.Key
+		case callback.RegisterHandler:
+			key = h.Key
+		default:
+			continue
+		}
+		if _, err := jws.JWAFromKey(key); err != nil {
+			problems = append(problems, fmt.Errorf("gateway key: %w", err))
+		}
+	}
+	return client.NewConfigError(problems...)
+}
+
 // Initialise the Thing Gateway
 func (c *ThingGateway) Initialise() error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	if err := c.waitForStartupGates(); err != nil {
+		return err
+	}
+	if err := c.connect(); err != nil {
+		return err
+	}
+	return c.authenticateGateway()
+}
+
+// connect creates the connection to AM with which thing requests are forwarded
+func (c *ThingGateway) connect() error {
 	amURL, err := url.Parse(c.amURL)
 	if err != nil {
 		return err
 	}
 	// create a connection to AM for forwarding thing requests
-	c.amConnection, err = client.NewConnection().
+	connectionBuilder := client.NewConnection().
 		ConnectTo(amURL).
 		InRealm(c.realm).
 		WithTree(c.authTree).
 		TimeoutRequestAfter(c.timeout).
-		Create()
-	if err != nil {
-		return err
+		WithMaxPayloadSize(c.payloadLimits.MaxResponseSize).
+		WithSessionCookieName(c.sessionCookie).
+		WithSessionTokenHeader(c.sessionHeader).
+		WithUserAgent(c.userAgent).
+		WithRequestPriorities(c.priorities).
+		WithKey(c.upstream.key).
+		WithCertificate(c.upstream.certificates).
+		WithGatewayTrust(c.upstream.trust).
+		WithRoundTripper(c.amTransport)
+	for name, values := range c.headers {
+		for _, value := range values {
+			connectionBuilder.WithHeader(name, value)
+		}
+	}
+	if c.amInfoCache != nil {
+		connectionBuilder.WithAMInfoCache(*c.amInfoCache)
 	}
-	// create (register/authenticate) a thing representing the gateway
+	c.amConnection, err = connectionBuilder.Create()
+	return err
+}
+
+// authenticateGateway registers or authenticates the thing representing the gateway
+func (c *ThingGateway) authenticateGateway() (err error) {
 	gatewayBuilder := &ithing.BaseBuilder{}
+	gatewayBuilder.UseLog(c.log)
 	c.gatewayThing, err = gatewayBuilder.
 		WithConnection(c.amConnection).
 		HandleCallbacksWith(c.callbackHandlers...).
@@ -104,26 +261,114 @@ func (c *ThingGateway) Initialise() error {
 	return err
 }
 
+// SetDebugLevel sets the level of detail of the debug information written by the gateway, overriding the level set
+// with debug.SetLevel.
+// Must be called before the Thing Gateway is initialised.
+func (c *ThingGateway) SetDebugLevel(level debug.Level) {
+	c.log.SetLevel(level)
+}
+
+// SetDebugRedaction switches the redaction of the debug information written by the gateway on or off, overriding the
+// redaction set with debug.SetRedaction.
+// Must be called before the Thing Gateway is initialised.
+func (c *ThingGateway) SetDebugRedaction(enabled bool) {
+	c.log.SetRedaction(enabled)
+}
+
+// SetSessionCookieName overrides the name of the session cookie that is discovered from AM, for deployments where a
+// proxy in front of AM renames cookies.
+// Must be called before the Thing Gateway is initialised.
+func (c *ThingGateway) SetSessionCookieName(name string) {
+	c.sessionCookie = name
+}
+
+// SetSessionTokenHeader makes the Thing Gateway send session tokens to AM in the given header instead of a cookie, for
+// deployments where a proxy in front of AM rewrites or strips cookies.
+// Must be called before the Thing Gateway is initialised.
+func (c *ThingGateway) SetSessionTokenHeader(header string) {
+	c.sessionHeader = header
+}
+
+// SetUserAgent sets the User-Agent header sent with all requests to AM.
+// Must be called before the Thing Gateway is initialised.
+func (c *ThingGateway) SetUserAgent(userAgent string) {
+	c.userAgent = userAgent
+}
+
+// AddHeader adds a static header, such as a tenant ID, to all requests to AM. Headers set by the gateway are not
+// replaced.
+// Must be called before the Thing Gateway is initialised.
+func (c *ThingGateway) AddHeader(name, value string) {
+	if c.headers == nil {
+		c.headers = make(http.Header)
+	}
+	c.headers.Add(name, value)
+}
+
+// SetAMInfoCache stores the information that the Thing Gateway discovers from AM, such as the session cookie name, in
+// the file so that it is not discovered again when the gateway restarts. The information is revalidated with AM once
+// the TTL has expired.
+// Must be called before the Thing Gateway is initialised.
+func (c *ThingGateway) SetAMInfoCache(file string, ttl time.Duration) {
+	c.amInfoCache = &client.AMInfoCache{File: file, TTL: ttl}
+}
+
 // SetAuthenticationTree changes the authentication tree that the gateway was created with.
 // This is a convenience function for functional testing.
 func SetAuthenticationTree(c *ThingGateway, tree string) {
 	client.SetAuthenticationTree(c.amConnection, tree)
 }
 
-// authenticate a Thing with AM using the given payload
-func (c *ThingGateway) authenticate(auth client.AuthenticatePayload) (reply client.AuthenticatePayload, err error) {
+// transaction returns the connection with which the request is forwarded to AM. The request is forwarded with the
+// transaction ID set by the thing so that it can be correlated with the AM audit logs.
+func (c *ThingGateway) transaction(r *coap.Request) client.Connection {
+	id := client.TransactionID(r.Msg)
+	if id == "" {
+		return c.amConnection
+	}
+	c.log.Tracef("Forwarding request %s with transaction ID %s", r.Msg.PathString(), id)
+	return client.WithTransactionID(c.amConnection, id)
+}
+
+// authenticate a Thing with AM using the given payload and connection
+func (c *ThingGateway) authenticate(connection client.Connection, auth client.AuthenticatePayload) (reply client.AuthenticatePayload, err error) {
+	if c.offline != nil && isOfflineKey(auth.AuthIDKey) {
+		if reply, err = c.offline.verify(auth); err == nil {
+			c.trackIdentity(nil, auth, reply)
+			c.access.track(reply.TokenID, thingID(auth.Callbacks))
+			c.usage.authenticated(thingID(auth.Callbacks))
+			c.events.publish(authenticationEvent(auth))
+		}
+		return reply, err
+	}
+	if err = c.checkCertificatePolicy(auth.Callbacks); err != nil {
+		return
+	}
 	if auth.AuthIDKey != "" {
 		auth.AuthId, _ = c.authCache.Get(auth.AuthIDKey)
 	}
 	auth.AuthIDKey = ""
 
-	reply, err = c.amConnection.Authenticate(auth)
+	reply, err = connection.Authenticate(auth)
 	if err != nil {
+		// AM is unreachable, start an offline authentication flow if it is enabled
+		if c.offline != nil && errors.Is(err, client.ErrAMUnreachable) {
+			c.log.Errorf("Unable to reach AM, starting offline authentication; %s", err)
+			return c.offline.challenge(), nil
+		}
 		return
 	}
 
 	// if reply has a token, authentication has successfully completed
 	if reply.HasSessionToken() {
+		if c.offline != nil {
+			c.offline.learn(auth.Callbacks)
+		}
+		c.trackSession(auth, reply)
+		c.trackIdentity(connection, auth, reply)
+		c.access.track(reply.TokenID, thingID(auth.Callbacks))
+		c.usage.authenticated(thingID(auth.Callbacks))
+		c.events.publish(authenticationEvent(auth))
 		return reply, nil
 	}
 
@@ -142,42 +387,100 @@ func (c *ThingGateway) authenticate(auth client.AuthenticatePayload) (reply clie
 	return
 }
 
+// writeError writes an error response with a code that matches the class of the error
+// AM errors are forwarded in the payload so that the thing receives the original AM error code.
+// The fallback code is used for errors that do not belong to a known class.
+func writeError(w coap.ResponseWriter, err error, fallback codes.Code) {
+	switch {
+	case errors.Is(err, client.ErrUnauthorised):
+		w.SetCode(codes.Unauthorized)
+	case errors.Is(err, client.ErrForbidden):
+		w.SetCode(codes.Forbidden)
+	case errors.Is(err, client.ErrPayloadInvalid), errors.Is(err, client.ErrUnsupportedVersion):
+		w.SetCode(codes.BadRequest)
+	case errors.Is(err, client.ErrThrottled):
+		// CoAP has no equivalent of 429, the delay requested by AM is forwarded in the AM error payload
+		w.SetCode(codes.ServiceUnavailable)
+	case errors.Is(err, client.ErrPayloadTooLarge):
+		// AM rejected the payload of the thing, otherwise the response from AM exceeded the limit of the gateway
+		if errors.As(err, &client.AMError{}) {
+			w.SetCode(codes.RequestEntityTooLarge)
+		} else {
+			w.SetCode(codes.BadGateway)
+		}
+	case errors.Is(err, client.ErrAMUnreachable):
+		w.SetCode(codes.GatewayTimeout)
+	default:
+		w.SetCode(fallback)
+	}
+	var amError client.AMError
+	if errors.As(err, &amError) {
+		if b, err := json.Marshal(amError); err == nil {
+			writeResponse(w, b)
+			return
+		}
+	}
+	writeResponse(w, []byte(err.Error()))
+}
+
 var heartBeat time.Duration = time.Millisecond * 100
 
 // authenticateHandler handles authentication requests
 func (c *ThingGateway) authenticateHandler(w coap.ResponseWriter, r *coap.Request) {
-	debug.Logger.Println("authenticateHandler")
+	c.log.Trace("authenticateHandler")
+	codec, err := requestCodec(r.Msg)
+	if err != nil {
+		w.SetCode(codes.UnsupportedMediaType)
+		writeResponse(w, []byte(err.Error()))
+		return
+	}
 	var auth client.AuthenticatePayload
-	if err := json.Unmarshal(r.Msg.Payload(), &auth); err != nil {
-		debug.Logger.Printf("Unable to unmarshall payload; %s", err)
+	if err := codec.Unmarshal(r.Msg.Payload(), &auth); err != nil {
+		c.log.Errorf("Unable to unmarshall payload; %s", err)
 		w.SetCode(codes.BadRequest)
 		writeResponse(w, []byte("Unable to unmarshal payload"))
 		return
 	}
-
-	reply, err := c.authenticate(auth)
-	if err != nil {
-		debug.Logger.Printf("Error connecting to AM; %s", err)
-		w.SetCode(codes.Unauthorized)
-		writeResponse(w, []byte(err.Error()))
+	// new authentication flows are shed while the gateway is short of resources, flows in progress are completed
+	if auth.AuthIDKey == "" && auth.AuthId == "" && c.guard.shedRequest(w) {
+		return
+	}
+	c.detectAuthenticationStorm(thingID(auth.Callbacks), c.peerInfo(r).Address)
+	if err := c.access.checkThing(thingID(auth.Callbacks)); err != nil {
+		writeError(w, err, codes.Forbidden)
 		return
 	}
 
-	b, err := json.Marshal(reply)
+	// the locale and context of the thing are forwarded so that the authentication tree can use them
+	forwarding := client.WithAuthContext(c.forwardPeer(r), client.ForwardedAuthContext(r.Msg))
+	connection, err := c.bindClientCertificate(forwarding, r, auth)
 	if err != nil {
-		debug.Logger.Printf("Error marshalling Auth Payload; %s", err)
-		w.SetCode(codes.BadGateway)
-		writeResponse(w, []byte(err.Error()))
+		c.log.Errorf("Client certificate rejected; %s", err)
+		writeError(w, err, codes.Unauthorized)
 		return
 	}
-	w.SetCode(codes.Valid)
-	writeResponse(w, b)
-	debug.Logger.Println("authenticateHandler: success")
+	reply, ok := c.warmSession(r, auth)
+	if !ok {
+		if reply, err = c.authenticate(connection, auth); err != nil {
+			c.log.Errorf("Error connecting to AM; %s", err)
+			writeError(w, err, codes.Unauthorized)
+			return
+		}
+	}
+
+	writeEncoded(w, codes.Valid, codec, reply)
+	c.log.Trace("authenticateHandler: success")
 }
 
 // amInfoHandler handles AM Info requests
 func (c *ThingGateway) amInfoHandler(w coap.ResponseWriter, r *coap.Request) {
-	debug.Logger.Println("amInfoHandler")
+	c.log.Trace("amInfoHandler")
+	key := cacheKey(RouteAMInfo)
+	if cached, ok := c.cache.get(key); ok {
+		c.writeCacheable(w, r, cached)
+		c.log.Trace("amInfoHandler: success from cache")
+		return
+	}
 	info, err := c.amConnection.AMInfo()
 	if err != nil {
 		w.SetCode(codes.GatewayTimeout)
@@ -186,114 +489,241 @@ func (c *ThingGateway) amInfoHandler(w coap.ResponseWriter, r *coap.Request) {
 	}
 	b, err := json.Marshal(info)
 	if err != nil {
-		debug.Logger.Printf("Error marshalling amInfo; %s", err)
+		c.log.Errorf("Error marshalling amInfo; %s", err)
 		w.SetCode(codes.BadGateway)
 		writeResponse(w, []byte(err.Error()))
 		return
 	}
+	response := cacheable(codes.Content, b)
+	c.cache.set(RouteAMInfo, key, response)
+	c.writeCacheable(w, r, response)
+	c.log.Trace("amInfoHandler: success")
+}
+
+// timeHandler handles requests for the time of the gateway, with which things discipline their clocks
+func (c *ThingGateway) timeHandler(w coap.ResponseWriter, r *coap.Request) {
+	c.log.Trace("timeHandler")
+	b, err := json.Marshal(client.TimePayload{Time: clock.Clock().UnixNano() / int64(time.Millisecond)})
+	if err != nil {
+		c.log.Errorf("Error marshalling time; %s", err)
+		w.SetCode(codes.InternalServerError)
+		writeResponse(w, []byte(err.Error()))
+		return
+	}
 	w.SetCode(codes.Content)
 	writeResponse(w, b)
-	debug.Logger.Println("amInfoHandler: success")
+	c.log.Trace("timeHandler: success")
 }
 
-func decodeThingEndpointRequest(msg coap.Message) (token string, content client.ContentType, payload string, err error) {
-	coapFormat, ok := msg.Option(coap.ContentFormat).(coap.MediaType)
-	if !ok {
-		return token, content, payload, fmt.Errorf("missing content format")
+// serverInfoHandler handles requests for information about the gateway, with which things check their environment
+// before they authenticate
+func (c *ThingGateway) serverInfoHandler(w coap.ResponseWriter, r *coap.Request) {
+	c.log.Trace("serverInfoHandler")
+	info := client.ServerInfoPayload{
+		Time:            clock.Clock().UnixNano() / int64(time.Millisecond),
+		Realm:           c.realm,
+		ContentTypes:    client.ContentTypes(),
+		ProtocolVersion: client.GatewayProtocolVersion,
 	}
-
-	switch coapFormat {
-	case coap.AppJSON:
-		var request client.ThingEndpointPayload
-		if err := json.Unmarshal(msg.Payload(), &request); err != nil {
-			return token, content, payload, err
+	// the realm resolved by AM is reported if it is known
+	if amInfo, err := c.amConnection.AMInfo(); err == nil {
+		if amInfo.Realm != "" {
+			info.Realm = amInfo.Realm
 		}
-		token = request.Token
-		content = client.ApplicationJSON
-		payload = request.Payload
-	case client.AppJOSE:
-		payload = string(msg.Payload())
-		// get SSO token from the CSRF claim in the JWT
-		var claims struct {
-			CSRF string `json:"csrf"`
-		}
-		if err := jws.ExtractClaims(payload, &claims); err != nil {
-			return token, content, payload, err
-		}
-		token = claims.CSRF
-		content = client.ApplicationJOSE
+		info.ThingsVersion = amInfo.ThingsVersion
 	}
-	return token, content, payload, nil
+	b, err := json.Marshal(info)
+	if err != nil {
+		c.log.Errorf("Error marshalling server info; %s", err)
+		w.SetCode(codes.InternalServerError)
+		writeResponse(w, []byte(err.Error()))
+		return
+	}
+	w.SetCode(codes.Content)
+	writeResponse(w, b)
+	c.log.Trace("serverInfoHandler: success")
 }
 
 // accessTokenHandler handles access token requests
 func (c *ThingGateway) accessTokenHandler(w coap.ResponseWriter, r *coap.Request) {
-	debug.Logger.Println("accessTokenHandler")
+	c.log.Trace("accessTokenHandler")
 
-	token, content, payload, err := decodeThingEndpointRequest(r.Msg)
+	token, content, payload, ok := c.negotiate(w, r)
+	if !ok {
+		return
+	}
+
+	b, err := c.forwardPeer(r).AccessToken(token, content, payload)
+	c.detectScopeEscalation(token, content, payload, b, err)
 	if err != nil {
-		w.SetCode(codes.BadRequest)
-		writeResponse(w, []byte(err.Error()))
+		writeError(w, err, codes.GatewayTimeout)
+		return
+	}
+	c.usage.tokenIssued(c.access.thingOf(token))
+	c.events.publish(Event{Type: EventTokenIssued, ThingID: c.access.thingOf(token)})
+	w.SetCode(codes.Changed)
+	writeResponse(w, b)
+	c.log.Trace("accessTokenHandler: success")
+}
+
+// policyHandler handles policy decision requests
+func (c *ThingGateway) policyHandler(w coap.ResponseWriter, r *coap.Request) {
+	c.log.Trace("policyHandler")
+
+	token, content, payload, ok := c.negotiateContent(w, r, func(coap.ResponseWriter, client.ContentType) bool {
+		return true
+	})
+	if !ok {
 		return
 	}
 
-	b, err := c.amConnection.AccessToken(token, content, payload)
+	b, err := c.transaction(r).PolicyDecision(token, content, payload)
 	if err != nil {
-		if errors.Is(err, client.ErrUnauthorised) {
-			w.SetCode(codes.Unauthorized)
-		} else {
-			w.SetCode(codes.GatewayTimeout)
-		}
-		writeResponse(w, []byte(err.Error()))
+		writeError(w, err, codes.GatewayTimeout)
 		return
 	}
 	w.SetCode(codes.Changed)
 	writeResponse(w, b)
-	debug.Logger.Println("accessTokenHandler: success")
+	c.log.Trace("policyHandler: success")
 }
 
 // attributesHandler handles a thing attributes requests
 func (c *ThingGateway) attributesHandler(w coap.ResponseWriter, r *coap.Request) {
-	debug.Logger.Println("attributesHandler")
+	c.log.Trace("attributesHandler")
+	if observe, ok := r.Msg.Option(coap.Observe).(uint32); ok && r.Msg.Code() == codes.GET && c.subscriptions != nil {
+		c.observeAttributes(w, r, observe)
+		return
+	}
 	names := r.Msg.Query()
 
-	token, format, payload, err := decodeThingEndpointRequest(r.Msg)
+	token, format, payload, ok := c.negotiate(w, r)
+	if !ok {
+		return
+	}
+	key := attributesCacheKey(token, names)
+	if cacheableRequest(format) {
+		if cached, ok := c.cache.get(key); ok {
+			c.writeCacheable(w, r, cached)
+			c.log.Trace("attributesHandler: success from cache")
+			return
+		}
+	}
+	connection := c.transaction(r)
+	b, err := connection.Attributes(token, format, payload, names)
+	if err != nil {
+		writeError(w, err, codes.GatewayTimeout)
+		return
+	}
+	response := cacheable(codes.Changed, b)
+	if cacheableRequest(format) {
+		c.cacheSessionResponse(connection, RouteAttributes, token, key, response)
+	}
+	c.writeCacheable(w, r, response)
+	c.log.Trace("attributesHandler: success")
+}
+
+// signedRequestTarget returns the method and path of the AM endpoint that a signed request is for
+func signedRequestTarget(msg coap.Message) (method, path string, err error) {
+	for _, q := range msg.Query() {
+		switch {
+		case strings.HasPrefix(q, client.SignedRequestMethodQuery):
+			method = strings.TrimPrefix(q, client.SignedRequestMethodQuery)
+		case strings.HasPrefix(q, client.SignedRequestPathQuery):
+			path = strings.TrimPrefix(q, client.SignedRequestPathQuery)
+		}
+	}
+	switch method {
+	case http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+	default:
+		return method, path, fmt.Errorf("unsupported method `%s`", method)
+	}
+	if !strings.HasPrefix(path, "/") {
+		return method, path, fmt.Errorf("path `%s` is not absolute", path)
+	}
+	return method, path, nil
+}
+
+// amRequestHandler handles signed requests to AM endpoints that are not wrapped by the SDK
+func (c *ThingGateway) amRequestHandler(w coap.ResponseWriter, r *coap.Request) {
+	c.log.Trace("amRequestHandler")
+
+	method, path, err := signedRequestTarget(r.Msg)
 	if err != nil {
 		w.SetCode(codes.BadRequest)
 		writeResponse(w, []byte(err.Error()))
 		return
 	}
-	b, err := c.amConnection.Attributes(token, format, payload, names)
+	token, content, payload, ok := c.negotiate(w, r)
+	if !ok {
+		return
+	}
+	b, err := c.transaction(r).SignedRequest(token, method, path, content, payload)
 	if err != nil {
-		if errors.Is(err, client.ErrUnauthorised) {
-			w.SetCode(codes.Unauthorized)
-		} else {
-			w.SetCode(codes.GatewayTimeout)
-		}
-		writeResponse(w, []byte(err.Error()))
+		writeError(w, err, codes.GatewayTimeout)
 		return
 	}
 	w.SetCode(codes.Changed)
 	writeResponse(w, b)
-	debug.Logger.Println("attributesHandler: success")
+	c.log.Trace("amRequestHandler: success")
+}
+
+// validateSession validates the session with AM, or offline if AM is unreachable, and removes the state held for the
+// thing if the session is no longer valid
+func (c *ThingGateway) validateSession(connection client.Connection, tokenID string) (bool, error) {
+	valid, err := connection.ValidateSession(tokenID)
+	if errors.Is(err, client.ErrAMUnreachable) && c.offline != nil && c.offline.validSession(tokenID) {
+		// AM is unreachable but the session was created offline and is still within the grace period
+		valid, err = true, nil
+	}
+	if err == nil && !valid {
+		c.sessionInvalid(tokenID)
+	}
+	return valid, err
+}
+
+// logoutSession logs the session out of AM, or out of the gateway if it was created offline, and removes the state
+// held for the session
+func (c *ThingGateway) logoutSession(connection client.Connection, tokenID string) error {
+	c.pages.forget(tokenID)
+	c.lifetimes.forget(tokenID)
+	c.access.forget(tokenID)
+	if c.issuer != nil {
+		c.issuer.forget(tokenID)
+	}
+	if c.offline != nil && isOfflineKey(tokenID) {
+		c.offline.logout(tokenID)
+		c.log.Tracef("offline log out")
+		return nil
+	}
+	if err := connection.LogoutSession(tokenID); err != nil {
+		return err
+	}
+	if c.revocation != nil {
+		c.revocation.untrack(tokenID)
+	}
+	c.cache.evictSession(tokenID)
+	return nil
 }
 
 // sessionHandler handles a session validation request
 func (c *ThingGateway) sessionHandler(w coap.ResponseWriter, r *coap.Request) {
-	debug.Logger.Println("sessionHandler")
+	c.log.Trace("sessionHandler")
 
 	var token client.SessionToken
-	if err := json.Unmarshal(r.Msg.Payload(), &token); err != nil {
+	codec, err := requestCodec(r.Msg)
+	if err == nil {
+		err = codec.Unmarshal(r.Msg.Payload(), &token)
+	}
+	if err != nil {
 		w.SetCode(codes.BadRequest)
 		writeResponse(w, []byte(err.Error()))
 		return
 	}
 	switch r.Msg.QueryString() {
 	case "_action=validate":
-		valid, err := c.amConnection.ValidateSession(token.TokenID)
+		valid, err := c.validateSession(c.transaction(r), token.TokenID)
 		if err != nil {
-			w.SetCode(codes.GatewayTimeout)
-			writeResponse(w, []byte(err.Error()))
+			writeError(w, err, codes.GatewayTimeout)
 			return
 		}
 		if valid {
@@ -302,17 +732,24 @@ func (c *ThingGateway) sessionHandler(w coap.ResponseWriter, r *coap.Request) {
 			w.SetCode(codes.Unauthorized)
 		}
 		writeResponse(w, nil)
-		debug.Logger.Printf("sessionHandler: success. validate %v", valid)
+		c.log.Tracef("sessionHandler: success. validate %v", valid)
 	case "_action=logout":
-		err := c.amConnection.LogoutSession(token.TokenID)
-		if err != nil {
-			w.SetCode(codes.GatewayTimeout)
-			writeResponse(w, []byte(err.Error()))
+		if err := c.logoutSession(c.transaction(r), token.TokenID); err != nil {
+			writeError(w, err, codes.GatewayTimeout)
 			return
 		}
 		w.SetCode(codes.Changed)
 		writeResponse(w, nil)
-		debug.Logger.Printf("sessionHandler: success. log out")
+		c.log.Tracef("sessionHandler: success. log out")
+	case "_action=getSessionInfo":
+		reply, err := c.transaction(r).SessionInfo(token.TokenID)
+		if err != nil {
+			writeError(w, err, codes.GatewayTimeout)
+			return
+		}
+		w.SetCode(codes.Changed)
+		writeResponse(w, reply)
+		c.log.Tracef("sessionHandler: success. session info")
 	default:
 		w.SetCode(codes.BadRequest)
 		writeResponse(w, []byte("unknown/missing query"))
@@ -322,32 +759,33 @@ func (c *ThingGateway) sessionHandler(w coap.ResponseWriter, r *coap.Request) {
 
 // introspectHandler handles an introspect OAuth2 access token request
 func (c *ThingGateway) introspectHandler(w coap.ResponseWriter, r *coap.Request) {
-	debug.Logger.Println("introspectHandler")
+	c.log.Trace("introspectHandler")
 
-	coapFormat, ok := r.Msg.Option(coap.ContentFormat).(coap.MediaType)
-	if !ok || coapFormat != coap.AppJSON {
+	if _, ok := r.Msg.Option(coap.ContentFormat).(coap.MediaType); !ok {
 		w.SetCode(codes.BadRequest)
 		writeResponse(w, []byte("missing/incorrect content format"))
 		return
 	}
 
 	var request client.IntrospectPayload
-	err := json.Unmarshal(r.Msg.Payload(), &request)
+	codec, err := requestCodec(r.Msg)
+	if err == nil {
+		err = codec.Unmarshal(r.Msg.Payload(), &request)
+	}
 	if err != nil {
 		w.SetCode(codes.BadRequest)
 		writeResponse(w, []byte(err.Error()))
 		return
 	}
 
-	introspection, err := c.amConnection.IntrospectAccessToken(request.Token)
+	introspection, err := c.transaction(r).IntrospectAccessToken(request.Token)
 	if err != nil {
-		w.SetCode(codes.GatewayTimeout)
-		writeResponse(w, []byte(err.Error()))
+		writeError(w, err, codes.GatewayTimeout)
 		return
 	}
 	w.SetCode(codes.Changed)
 	writeResponse(w, introspection)
-	debug.Logger.Println("introspectHandler: success")
+	c.log.Trace("introspectHandler: success")
 }
 
 func dtlsServerConfig(cert ...tls.Certificate) *dtls.Config {
@@ -358,28 +796,175 @@ func dtlsServerConfig(cert ...tls.Certificate) *dtls.Config {
 	}
 }
 
+// SetTransport sets the transport protocol over which the CoAP server receives requests from things.
+// Must be called before the CoAP server is started.
+func (c *ThingGateway) SetTransport(transport Transport) error {
+	switch transport {
+	case TransportDTLS, TransportTLS, TransportTCP:
+		c.transport = transport
+		return nil
+	default:
+		return fmt.Errorf("unsupported transport `%s`", transport)
+	}
+}
+
+// SetTLSProfile restricts the cipher suites, curves and protocol version negotiated in the handshakes with things so
+// that the CoAP server meets a compliance profile. The profile must be supported by the transport.
+// Must be called before the CoAP server is started.
+func (c *ThingGateway) SetTLSProfile(profile client.TLSProfile) {
+	c.tlsProfile = profile
+}
+
+// validateTLSProfile checks that the TLS profile can be applied to the transport
+func (c *ThingGateway) validateTLSProfile() error {
+	switch c.transport {
+	case TransportTLS:
+		return c.tlsProfile.ValidateTLS()
+	case TransportTCP:
+		if !c.tlsProfile.IsZero() {
+			return fmt.Errorf("TLS profile requires a secure transport")
+		}
+		return nil
+	default:
+		return c.tlsProfile.ValidateDTLS()
+	}
+}
+
+// listener is the network listener used by the CoAP server
+type listener interface {
+	coap.Listener
+	Addr() net.Addr
+}
+
+// listen creates a listener for the configured transport that applies the handshake rate limit
+func (c *ThingGateway) listen(address string, cert tls.Certificate) (listener, error) {
+	handshakes := newHandshakeLimiter(c.limits.HandshakeRate)
+	var l listener
+	base := "udp"
+	if c.transport == TransportTLS || c.transport == TransportTCP {
+		base = "tcp"
+	}
+	network, err := c.listenNetwork(base, address)
+	if err != nil {
+		return nil, err
+	}
+	// the profile is applied to the configuration of the transport once it is known to be supported
+	if err = c.validateTLSProfile(); err != nil {
+		return nil, err
+	}
+	switch c.transport {
+	case TransportTLS:
+		config := tlsServerConfig(cert)
+		_ = c.tlsProfile.ApplyTLS(config)
+		c.requireTLSClientCertificates(config)
+		// DTLS handshakes are not shed since the DTLS listener stops accepting connections after a failed handshake
+		if handshakes := handshakes.withGuard(c.guard); handshakes != nil {
+			config.GetConfigForClient = handshakes.tlsConfigForClient
+		}
+		if c.identity != nil {
+			c.identity.presentTLS(config)
+		}
+		l, err = coapnet.NewTLSListener(network, address, config, heartBeat)
+	case TransportTCP:
+		if c.clientCAs != nil {
+			return nil, fmt.Errorf("client certificates require a secure transport")
+		}
+		l, err = coapnet.NewTCPListener(network, address, heartBeat)
+	default:
+		config := dtlsServerConfig(cert)
+		_ = c.tlsProfile.ApplyDTLS(config)
+		c.requireDTLSClientCertificates(config)
+		if handshakes != nil {
+			config.ConnectContextMaker = handshakes.dtlsConnectContext
+		}
+		if err = checkDTLSKey(cert.PrivateKey); err != nil {
+			return nil, err
+		}
+		if c.identity != nil {
+			c.identity.presentDTLS(config)
+		}
+		l, err = coapnet.NewDTLSListener(network, address, config, heartBeat)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// SetBlockSize sets the size in bytes of the blocks used by the CoAP server to transfer payloads that do not fit into
+// a single message. The size must be a power of two between 16 and 1024 and defaults to 1024.
+// Must be called before the CoAP server is started.
+func (c *ThingGateway) SetBlockSize(size int) error {
+	if _, err := client.BlockWiseSzx(size); err != nil {
+		return err
+	}
+	c.blockSize = size
+	return nil
+}
+
+func tlsServerConfig(cert ...tls.Certificate) *tls.Config {
+	return &tls.Config{
+		Certificates: cert,
+		ClientAuth:   tls.RequireAnyClientCert,
+	}
+}
+
+// route is a resource served by the CoAP server
+type route struct {
+	path    string
+	handler func(w coap.ResponseWriter, r *coap.Request)
+}
+
+// routes returns the resources served by the CoAP server
+func (c *ThingGateway) routes() []route {
+	routes := []route{
+		{"/authenticate", c.idempotent(c.authenticateHandler, c.authenticatingThing, authenticated)},
+		{"/aminfo", c.amInfoHandler},
+		{"/accesstoken", c.idempotent(c.accessTokenHandler, requestingSession, issued)},
+		{"/introspect", c.introspectHandler},
+		{"/attributes", c.attributesHandler},
+		{RouteAttributePage, c.attributePageHandler},
+		{"/policy", c.policyHandler},
+		{"/amrequest", c.amRequestHandler},
+		{"/session", c.sessionHandler},
+		{"/oscore", c.oscoreHandler},
+		{client.RouteTime, c.timeHandler},
+		{client.RouteServerInfo, c.serverInfoHandler},
+	}
+	if c.issuer != nil {
+		routes = append(routes, route{RouteLocalToken, c.localTokenHandler})
+	}
+	return routes
+}
+
 // StartCOAPServer starts a COAP server within the Thing Gateway
+// The server presents a self-signed certificate for the key unless it has been given a certificate, see
+// SetServerCertificate and EnableCertificateRenewal, in which case the key may be nil.
 func (c *ThingGateway) StartCOAPServer(address string, key crypto.Signer) error {
-	if c.coapServer != nil {
+	if c.coapServer != nil || c.managedSessions() != nil {
 		return ErrCOAPServerAlreadyStarted
 	}
-	if key == nil {
+	if key == nil && c.identity == nil {
 		return jws.ErrMissingSigner
 	}
 	c.coapChan = make(chan error, 1)
+	if c.pages == nil {
+		c.pages = newAttributePages()
+	}
+	if c.lifetimes == nil {
+		c.lifetimes = newSessionLifetimes()
+	}
 	mux := coap.NewServeMux()
-	mux.HandleFunc("/authenticate", c.authenticateHandler)
-	mux.HandleFunc("/aminfo", c.amInfoHandler)
-	mux.HandleFunc("/accesstoken", c.accessTokenHandler)
-	mux.HandleFunc("/introspect", c.introspectHandler)
-	mux.HandleFunc("/attributes", c.attributesHandler)
-	mux.HandleFunc("/session", c.sessionHandler)
-
-	cert, err := frcrypto.PublicKeyCertificate(key)
+	for _, route := range c.routes() {
+		mux.HandleFunc(route.path, route.handler)
+	}
+	mux.HandleFunc(wellKnownCore, c.discoveryHandler)
+
+	cert, err := c.serverCertificate(key)
 	if err != nil {
 		return err
 	}
-	l, err := coapnet.NewDTLSListener("udp", address, dtlsServerConfig(cert), heartBeat)
+	l, err := c.listen(address, cert)
 	if err != nil {
 		return err
 	}
@@ -389,36 +974,118 @@ func (c *ThingGateway) StartCOAPServer(address string, key crypto.Signer) error
 	// since instructing the server to shutdown while it is still starting up can cause a hang
 	started := make(chan struct{})
 
-	c.coapServer = &coap.Server{
-		Listener: l,
-		Handler:  mux,
-		NotifyStartedFunc: func() {
-			close(started)
-		},
+	blockWise := true
+	if c.blockSize == 0 {
+		c.blockSize = client.DefaultBlockSize
 	}
-	go func() {
-		c.coapChan <- c.coapServer.ActivateAndServe()
+	szx, err := client.BlockWiseSzx(c.blockSize)
+	if err != nil {
 		l.Close()
-		c.coapServer = nil
-	}()
-	<-started
+		return err
+	}
+	maxMessageSize := client.CoAPMaxMessageSize(c.maxRequestSize())
+	handler := c.countRequests(c.separateSlowResponses(c.limitPayload(c.restrictAccess(c.unprotect(c.filterRequests(c.meterUsage(mux)))))))
+	// the gateway manages the sessions itself if it needs to apply limits or find the certificate of a session
+	// plain TCP connections have no handshake so the gateway sheds the connections itself
+	if c.limits != (ConnectionLimits{}) || c.clientCAs != nil || c.warm != nil ||
+		(c.guard != nil && c.transport == TransportTCP) {
+		sessions := newSessionManager(c.limits, c.transport == TransportTCP, c.guard, handler,
+			func(conn net.Conn, handler coap.Handler) *coap.Server {
+				return &coap.Server{
+					Conn:                 conn,
+					Handler:              handler,
+					BlockWiseTransfer:    &blockWise,
+					BlockWiseTransferSzx: &szx,
+					MaxMessageSize:       maxMessageSize,
+				}
+			})
+		c.sessionsMutex.Lock()
+		c.sessions = sessions
+		c.sessionsMutex.Unlock()
+		go func() {
+			c.coapChan <- sessions.serve(l)
+			l.Close()
+		}()
+	} else {
+		c.coapServer = &coap.Server{
+			Listener:             l,
+			Handler:              handler,
+			BlockWiseTransfer:    &blockWise,
+			BlockWiseTransferSzx: &szx,
+			MaxMessageSize:       maxMessageSize,
+			NotifyStartedFunc: func() {
+				close(started)
+			},
+		}
+		go func() {
+			c.coapChan <- c.coapServer.ActivateAndServe()
+			l.Close()
+			c.coapServer = nil
+		}()
+		<-started
+	}
+	c.startSessionValidation()
+	if c.subscriptions != nil {
+		c.subscriptions.start()
+	}
+	for _, p := range c.proxies {
+		p.start(c.maintenance)
+	}
+	if c.warm != nil {
+		c.warm.start(c.amConnection, c.maintenance)
+	}
+	if c.identity != nil {
+		c.identity.start(c.maintenance)
+	}
+	c.startEvents()
 	return nil
 }
 
 // ShutdownCOAPServer gracefully shuts the COAP server down
 func (c *ThingGateway) ShutdownCOAPServer() {
-	if c.coapServer == nil {
+	sessions := c.managedSessions()
+	if c.coapServer == nil && sessions == nil {
 		return
 	}
-	if err := c.coapServer.Shutdown(); err != nil {
-		debug.Logger.Println(err)
+	c.shutdownEvents()
+	c.stopSessionValidation()
+	if c.subscriptions != nil {
+		c.subscriptions.shutdown()
+	}
+	for _, p := range c.proxies {
+		p.shutdown()
+	}
+	if c.warm != nil {
+		c.warm.shutdown()
+	}
+	if c.identity != nil {
+		c.identity.shutdown()
+	}
+	if sessions != nil {
+		sessions.shutdown()
+	} else if err := c.coapServer.Shutdown(); err != nil {
+		c.log.Error(err)
 		return
 	}
 	// wait for shutdown to complete
 	<-c.coapChan
+	if sessions != nil {
+		// the listener has stopped so no new requests can look up a session
+		c.sessionsMutex.Lock()
+		c.sessions = nil
+		c.sessionsMutex.Unlock()
+	}
 	c.address = nil
 }
 
+// managedSessions returns the sessions managed by the gateway, nil if the server is not running or the CoAP server
+// manages its own sessions
+func (c *ThingGateway) managedSessions() *sessionManager {
+	c.sessionsMutex.RLock()
+	defer c.sessionsMutex.RUnlock()
+	return c.sessions
+}
+
 // Address returns in string form the address that it is listening on.
 func (c *ThingGateway) Address() string {
 	if c.address == nil {
@@ -429,6 +1096,6 @@ func (c *ThingGateway) Address() string {
 
 func writeResponse(w coap.ResponseWriter, response []byte) {
 	if _, err := w.Write(response); err != nil {
-		debug.Logger.Println(err)
+		debug.Error(err)
 	}
 }
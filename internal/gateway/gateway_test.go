@@ -22,10 +22,15 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"net/url"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -33,6 +38,7 @@ import (
 	frcrypto "github.com/JacoJooste/iot-edge/v7/internal/crypto"
 	"github.com/JacoJooste/iot-edge/v7/internal/introspect"
 	"github.com/JacoJooste/iot-edge/v7/internal/tokencache"
+	"github.com/JacoJooste/iot-edge/v7/pkg/callback"
 	"github.com/dchest/uniuri"
 	"github.com/go-ocf/go-coap"
 	"github.com/go-ocf/go-coap/net"
@@ -46,9 +52,71 @@ type mockClient struct {
 	amInfoSet        client.AMInfoResponse
 	accessTokenFunc  func(string, string) ([]byte, error)
 	attributesFunc   func(string, string, []string) ([]byte, error)
+	policyFunc       func(string, string) ([]byte, error)
+	signedFunc       func(string, string, string, string) ([]byte, error)
+	validateFunc     func(string) (bool, error)
+	sessionInfoFunc  func(string) ([]byte, error)
+	faults           faultScript
+	faultMutex       sync.Mutex
+}
+
+// fault describes a failure injected into a mockClient operation
+type fault struct {
+	// delay is added before the operation is processed or fails
+	delay time.Duration
+	// drop fails the operation as if the connection to AM was lost
+	drop bool
+	// malformed replaces the reply of the operation with invalid JSON
+	malformed bool
+}
+
+// faultScript contains the faults to inject into each mockClient operation, keyed by operation name. The faults of
+// an operation are consumed in order, one per call, so that for example a failure in the middle of a multi-step
+// authentication can be injected with {"authenticate": {{}, {drop: true}}}. No faults are injected once the script of
+// an operation has been consumed.
+type faultScript map[string][]fault
+
+// malformedJSON is returned by operations with a malformed fault
+var malformedJSON = []byte(`{"malformed":`)
+
+// inject applies the next fault for the operation. If the operation must fail, the error is returned. If the reply
+// must be malformed, malformed is true.
+func (m *mockClient) inject(op string) (malformed bool, err error) {
+	m.faultMutex.Lock()
+	faults := m.faults[op]
+	if len(faults) == 0 {
+		m.faultMutex.Unlock()
+		return false, nil
+	}
+	f := faults[0]
+	m.faults[op] = faults[1:]
+	m.faultMutex.Unlock()
+	time.Sleep(f.delay)
+	if f.drop {
+		return false, fmt.Errorf("%w: connection dropped by fault injection", client.ErrAMUnreachable)
+	}
+	return f.malformed, nil
+}
+
+// injectReply applies the next fault for an operation that replies with JSON
+func (m *mockClient) injectReply(op string, reply func() ([]byte, error)) ([]byte, error) {
+	malformed, err := m.inject(op)
+	if err != nil {
+		return nil, err
+	}
+	if malformed {
+		return malformedJSON, nil
+	}
+	return reply()
 }
 
 func (m *mockClient) ValidateSession(tokenID string) (ok bool, err error) {
+	if _, err = m.inject("validate"); err != nil {
+		return false, err
+	}
+	if m.validateFunc != nil {
+		return m.validateFunc(tokenID)
+	}
 	return true, nil
 }
 
@@ -56,6 +124,15 @@ func (m *mockClient) LogoutSession(tokenID string) (err error) {
 	return nil
 }
 
+func (m *mockClient) SessionInfo(tokenID string) (reply []byte, err error) {
+	return m.injectReply("sessionInfo", func() ([]byte, error) {
+		if m.sessionInfoFunc != nil {
+			return m.sessionInfoFunc(tokenID)
+		}
+		return []byte("{}"), nil
+	})
+}
+
 func (m *mockClient) Initialise() error {
 	m.amInfoSet = client.AMInfoResponse{
 		AccessTokenURL: "/things",
@@ -65,6 +142,14 @@ func (m *mockClient) Initialise() error {
 }
 
 func (m *mockClient) Authenticate(payload client.AuthenticatePayload) (reply client.AuthenticatePayload, err error) {
+	malformed, err := m.inject("authenticate")
+	if err != nil {
+		return reply, err
+	}
+	if malformed {
+		// the AM connection fails to unmarshal a malformed reply
+		return reply, json.Unmarshal(malformedJSON, &reply)
+	}
 	if m.AuthenticateFunc != nil {
 		return m.AuthenticateFunc(payload)
 	}
@@ -80,10 +165,12 @@ func (m *mockClient) AMInfo() (info client.AMInfoResponse, err error) {
 }
 
 func (m *mockClient) AccessToken(tokenID string, _ client.ContentType, payload string) (reply []byte, err error) {
-	if m.accessTokenFunc != nil {
-		return m.accessTokenFunc(tokenID, payload)
-	}
-	return []byte("{}"), nil
+	return m.injectReply("accessToken", func() ([]byte, error) {
+		if m.accessTokenFunc != nil {
+			return m.accessTokenFunc(tokenID, payload)
+		}
+		return []byte("{}"), nil
+	})
 }
 
 func (m *mockClient) IntrospectAccessToken(token string) (introspection []byte, err error) {
@@ -91,16 +178,37 @@ func (m *mockClient) IntrospectAccessToken(token string) (introspection []byte,
 }
 
 func (m *mockClient) Attributes(tokenID string, _ client.ContentType, payload string, names []string) (reply []byte, err error) {
-	if m.attributesFunc != nil {
-		return m.attributesFunc(tokenID, payload, names)
-	}
-	return []byte("{}"), nil
+	return m.injectReply("attributes", func() ([]byte, error) {
+		if m.attributesFunc != nil {
+			return m.attributesFunc(tokenID, payload, names)
+		}
+		return []byte("{}"), nil
+	})
+}
+
+func (m *mockClient) PolicyDecision(tokenID string, _ client.ContentType, payload string) (reply []byte, err error) {
+	return m.injectReply("policy", func() ([]byte, error) {
+		if m.policyFunc != nil {
+			return m.policyFunc(tokenID, payload)
+		}
+		return []byte("[]"), nil
+	})
+}
+
+func (m *mockClient) SignedRequest(tokenID string, method string, path string, _ client.ContentType, payload string) (reply []byte, err error) {
+	return m.injectReply("signed", func() ([]byte, error) {
+		if m.signedFunc != nil {
+			return m.signedFunc(tokenID, method, path, payload)
+		}
+		return []byte("{}"), nil
+	})
 }
 
 func testGateway(client *mockClient) *ThingGateway {
 	return &ThingGateway{
 		amConnection: client,
 		authCache:    tokencache.New(5*time.Minute, 10*time.Minute),
+		access:       newAccessControl(),
 	}
 
 }
@@ -118,11 +226,11 @@ func TestGateway_Authenticate_AuthIdKey_Is_Not_Sent(t *testing.T) {
 
 		}}
 	gateway := testGateway(mockClient)
-	reply, err := gateway.authenticate(client.AuthenticatePayload{})
+	reply, err := gateway.authenticate(gateway.amConnection, client.AuthenticatePayload{})
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = gateway.authenticate(reply)
+	_, err = gateway.authenticate(gateway.amConnection, reply)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -138,7 +246,7 @@ func TestGateway_Authenticate_AuthId_Is_Not_Returned(t *testing.T) {
 
 		}}
 	gateway := testGateway(mockClient)
-	reply, _ := gateway.authenticate(client.AuthenticatePayload{})
+	reply, _ := gateway.authenticate(gateway.amConnection, client.AuthenticatePayload{})
 	if reply.AuthId != "" {
 		t.Fatal("AuthId has been returned")
 	}
@@ -154,7 +262,7 @@ func TestGateway_Authenticate_AuthId_Is_Cached(t *testing.T) {
 
 		}}
 	gateway := testGateway(mockClient)
-	reply, _ := gateway.authenticate(client.AuthenticatePayload{})
+	reply, _ := gateway.authenticate(gateway.amConnection, client.AuthenticatePayload{})
 	id, ok := gateway.authCache.Get(reply.AuthIDKey)
 	if !ok {
 		t.Fatal("The authId has not been stored")
@@ -164,6 +272,62 @@ func TestGateway_Authenticate_AuthId_Is_Cached(t *testing.T) {
 	}
 }
 
+// check that a multi-step authentication interrupted by a fault can be resumed with the cached Auth Id
+func TestGateway_Authenticate_Faults(t *testing.T) {
+	const authId = "12345"
+	tests := []struct {
+		name   string
+		faults []fault
+		// errs contains the expected outcome of each authentication step, the last step completes the authentication
+		errs []error
+	}{
+		{name: "no-faults", errs: []error{nil, nil}},
+		{name: "drop-mid-handshake", faults: []fault{{}, {drop: true}}, errs: []error{nil, client.ErrAMUnreachable, nil}},
+		{name: "drop-first-step", faults: []fault{{drop: true}}, errs: []error{client.ErrAMUnreachable, nil, nil}},
+		{name: "malformed-reply", faults: []fault{{}, {malformed: true}}, errs: []error{nil, errMalformed, nil}},
+		{name: "delayed-reply", faults: []fault{{delay: 10 * time.Millisecond}, {delay: 10 * time.Millisecond}},
+			errs: []error{nil, nil}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			m := &mockClient{
+				faults: faultScript{"authenticate": subtest.faults},
+				AuthenticateFunc: func(payload client.AuthenticatePayload) (reply client.AuthenticatePayload, err error) {
+					switch payload.AuthId {
+					case "":
+						reply.AuthId = authId
+					case authId:
+						reply.TokenID = "session"
+					default:
+						return reply, client.ErrUnauthorised
+					}
+					return reply, nil
+				}}
+			gateway := testGateway(m)
+			var payload client.AuthenticatePayload
+			for i, expected := range subtest.errs {
+				reply, err := gateway.authenticate(gateway.amConnection, payload)
+				switch {
+				case expected == errMalformed && err != nil:
+					continue
+				case expected != nil && !errors.Is(err, expected):
+					t.Fatalf("step %d: expected error %v, got %v", i, expected, err)
+				case expected == nil && err != nil:
+					t.Fatalf("step %d: %v", i, err)
+				case err == nil:
+					payload = reply
+				}
+			}
+			if !payload.HasSessionToken() {
+				t.Errorf("expected the authentication to complete, got %v", payload)
+			}
+		})
+	}
+}
+
+// errMalformed marks a step that is expected to fail because of a malformed reply
+var errMalformed = errors.New("malformed")
+
 func testDial(coapClient *coap.Client) error {
 	gateway := testGateway(&mockClient{})
 	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
@@ -292,7 +456,7 @@ func TestGatewayServer_AMInfo(t *testing.T) {
 			if subtest.successful {
 				if err != nil {
 					t.Error(err)
-				} else if info != subtest.client.amInfoSet {
+				} else if !reflect.DeepEqual(info, subtest.client.amInfoSet) {
 					t.Errorf("Expected info %v, got %v", subtest.client.amInfoSet, info)
 				}
 				return
@@ -304,6 +468,24 @@ func TestGatewayServer_AMInfo(t *testing.T) {
 	}
 }
 
+func TestGatewayServer_Time(t *testing.T) {
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	gateway := testGateway(&mockClient{})
+	if err := gateway.StartCOAPServer(":0", serverKey); err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.ShutdownCOAPServer()
+
+	thingClock := &client.Clock{}
+	if err := thingClock.Synchronise(gatewayConnection(t, gateway)); err != nil {
+		t.Fatal(err)
+	}
+	// the thing and the gateway share the clock of the test
+	if offset, ok := thingClock.Offset(); !ok || offset < -time.Second || offset > time.Second {
+		t.Errorf("expected a small offset; got %v %v", offset, ok)
+	}
+}
+
 func testGatewayServerAccessToken(t *testing.T, m *mockClient, jws string) (reply []byte, err error) {
 	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	gateway := testGateway(m)
@@ -341,6 +523,84 @@ func TestGatewayServer_AccessToken(t *testing.T) {
 	}
 }
 
+func testGatewayServerPolicyDecision(t *testing.T, m *mockClient, jws string) (reply []byte, err error) {
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	gateway := testGateway(m)
+	if err := gateway.StartCOAPServer(":0", serverKey); err != nil {
+		panic(err)
+	}
+	defer gateway.ShutdownCOAPServer()
+
+	return gatewayConnection(t, gateway).PolicyDecision("", client.ApplicationJOSE, jws)
+}
+
+func TestGatewayServer_PolicyDecision(t *testing.T) {
+	tests := []struct {
+		name       string
+		successful bool
+		connection *mockClient
+		jws        string
+	}{
+		{name: "success", successful: true, connection: &mockClient{}, jws: ".eyJjc3JmIjoiMTIzNDUifQ."},
+		{name: "not-a-valid-jwt", connection: &mockClient{}, jws: "eyJjc3JmIjoiMTIzNDUifQ"},
+		{name: "am-client-returns-error", jws: ".eyJjc3JmIjoiMTIzNDUifQ.", connection: &mockClient{policyFunc: func(string, string) (bytes []byte, err error) {
+			return nil, errors.New("AM policy error")
+		}}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			_, err := testGatewayServerPolicyDecision(t, subtest.connection, subtest.jws)
+			if subtest.successful && err != nil {
+				t.Error(err)
+			}
+			if !subtest.successful && err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
+
+func TestGatewayServer_SignedRequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		successful bool
+		method     string
+		path       string
+		jws        string
+	}{
+		{name: "success", successful: true, method: http.MethodPut, path: "/json/things/*?_action=update", jws: ".eyJjc3JmIjoiMTIzNDUifQ."},
+		{name: "unsupported-method", method: "CONNECT", path: "/json/things/*", jws: ".eyJjc3JmIjoiMTIzNDUifQ."},
+		{name: "relative-path", method: http.MethodGet, path: "json/things/*", jws: ".eyJjc3JmIjoiMTIzNDUifQ."},
+		{name: "not-a-valid-jwt", method: http.MethodGet, path: "/json/things/*", jws: "eyJjc3JmIjoiMTIzNDUifQ"},
+	}
+	for _, subtest := range tests {
+		// the handlers of the gateway may still be running when the next subtest starts
+		subtest := subtest
+		t.Run(subtest.name, func(t *testing.T) {
+			m := &mockClient{signedFunc: func(token, method, path, payload string) ([]byte, error) {
+				if token != "12345" || method != subtest.method || path != subtest.path || payload != subtest.jws {
+					return nil, fmt.Errorf("unexpected request %s %s %s %s", token, method, path, payload)
+				}
+				return []byte("{}"), nil
+			}}
+			serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			gateway := testGateway(m)
+			if err := gateway.StartCOAPServer(":0", serverKey); err != nil {
+				t.Fatal(err)
+			}
+			defer gateway.ShutdownCOAPServer()
+
+			_, err := gatewayConnection(t, gateway).SignedRequest("", subtest.method, subtest.path, client.ApplicationJOSE, subtest.jws)
+			if subtest.successful && err != nil {
+				t.Error(err)
+			}
+			if !subtest.successful && err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
+
 func TestGatewayServer_Address(t *testing.T) {
 	gateway := testGateway(&mockClient{})
 	// before the server has started, the address is the empty string
@@ -467,3 +727,272 @@ func gatewayConnection(t *testing.T, gateway *ThingGateway) client.Connection {
 	}
 	return connection
 }
+
+func TestGatewayServer_ServerInfo(t *testing.T) {
+	tests := []struct {
+		name   string
+		amInfo func() (client.AMInfoResponse, error)
+		realm  string
+	}{
+		{name: "resolved-realm", realm: "/root/edge", amInfo: func() (client.AMInfoResponse, error) {
+			return client.AMInfoResponse{Realm: "/root/edge", ThingsVersion: "protocol=2.0,resource=1.0"}, nil
+		}},
+		{name: "am-unreachable", realm: "/edge", amInfo: func() (client.AMInfoResponse, error) {
+			return client.AMInfoResponse{}, client.ErrAMUnreachable
+		}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			gateway := testGateway(&mockClient{amInfoFunc: subtest.amInfo})
+			gateway.realm = "/edge"
+			if err := gateway.StartCOAPServer(":0", serverKey); err != nil {
+				t.Fatal(err)
+			}
+			defer gateway.ShutdownCOAPServer()
+
+			info, offset, err := client.RequestServerInfo(gatewayConnection(t, gateway))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Realm != subtest.realm || info.ProtocolVersion != client.GatewayProtocolVersion ||
+				len(info.ContentTypes) == 0 {
+				t.Errorf("unexpected server info %+v", info)
+			}
+			if offset > time.Second || offset < -time.Second {
+				t.Errorf("expected the clocks to be in sync; got offset %v", offset)
+			}
+		})
+	}
+}
+
+// check that payloads larger than a single CoAP message are transferred in blocks in both directions
+func TestGatewayServer_BlockWiseTransfer(t *testing.T) {
+	large := strings.Repeat("a", 2*client.DefaultBlockSize)
+	m := &mockClient{AuthenticateFunc: func(payload client.AuthenticatePayload) (reply client.AuthenticatePayload, err error) {
+		if len(payload.Callbacks) != 1 || payload.Callbacks[0].Input[0].Value != large {
+			return reply, errors.New("incomplete payload")
+		}
+		return client.AuthenticatePayload{AuthId: "12345", Callbacks: payload.Callbacks}, nil
+	}}
+	tests := []struct {
+		name      string
+		blockSize int
+	}{
+		{name: "default", blockSize: client.DefaultBlockSize},
+		{name: "small", blockSize: 256},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			gateway := testGateway(m)
+			if err := gateway.SetBlockSize(subtest.blockSize); err != nil {
+				t.Fatal(err)
+			}
+			if err := gateway.StartCOAPServer(":0", serverKey); err != nil {
+				t.Fatal(err)
+			}
+			defer gateway.ShutdownCOAPServer()
+
+			gwURL, _ := url.Parse("coap://" + gateway.Address())
+			connection, err := client.NewConnection().
+				ConnectTo(gwURL).
+				WithKey(clientKey).
+				WithBlockSize(subtest.blockSize).
+				Create()
+			if err != nil {
+				t.Fatal(err)
+			}
+			reply, err := connection.Authenticate(client.AuthenticatePayload{
+				Callbacks: []callback.Callback{{Input: []callback.Entry{{Name: "IDToken1", Value: large}}}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(reply.Callbacks) != 1 || reply.Callbacks[0].Input[0].Value != large {
+				t.Error("incomplete reply")
+			}
+		})
+	}
+}
+
+func TestGateway_SetBlockSize(t *testing.T) {
+	gateway := testGateway(&mockClient{})
+	for _, size := range []int{0, 8, 100, 2048} {
+		if err := gateway.SetBlockSize(size); err == nil {
+			t.Errorf("expected block size %d to be rejected", size)
+		}
+	}
+}
+
+func TestGatewayServer_Transport(t *testing.T) {
+	tests := []struct {
+		transport Transport
+		scheme    string
+	}{
+		{transport: TransportDTLS, scheme: "coaps"},
+		{transport: TransportTLS, scheme: "coaps+tcp"},
+		{transport: TransportTCP, scheme: "coap+tcp"},
+	}
+	for _, subtest := range tests {
+		t.Run(string(subtest.transport), func(t *testing.T) {
+			serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			gateway := testGateway(&mockClient{})
+			if err := gateway.SetTransport(subtest.transport); err != nil {
+				t.Fatal(err)
+			}
+			if err := gateway.StartCOAPServer(":0", serverKey); err != nil {
+				t.Fatal(err)
+			}
+			defer gateway.ShutdownCOAPServer()
+
+			gwURL, _ := url.Parse(subtest.scheme + "://" + gateway.Address())
+			var trust client.GatewayTrust
+			if subtest.transport != TransportTCP {
+				trust.PinnedKeys = []crypto.PublicKey{serverKey.Public()}
+			}
+			connection, err := client.NewConnection().
+				ConnectTo(gwURL).
+				WithKey(clientKey).
+				WithGatewayTrust(trust).
+				Create()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = connection.Authenticate(client.AuthenticatePayload{}); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestGateway_SetTransport(t *testing.T) {
+	gateway := testGateway(&mockClient{})
+	if err := gateway.SetTransport("sctp"); err == nil {
+		t.Error("expected an unsupported transport to be rejected")
+	}
+}
+
+func TestGatewayServer_TLSProfile(t *testing.T) {
+	ccm8 := client.TLSProfile{CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8"}}
+	gcm := client.TLSProfile{CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}}
+	tests := []struct {
+		name      string
+		transport Transport
+		scheme    string
+		server    client.TLSProfile
+		client    client.TLSProfile
+		ok        bool
+	}{
+		{name: "dtls-match", transport: TransportDTLS, scheme: "coaps", server: ccm8, client: ccm8, ok: true},
+		{name: "dtls-mismatch", transport: TransportDTLS, scheme: "coaps", server: ccm8, client: gcm},
+		{name: "tls-version", transport: TransportTLS, scheme: "coaps+tcp", server: client.TLSProfile{MinVersion: "1.3"},
+			ok: true},
+		{name: "tls-curve-match", transport: TransportTLS, scheme: "coaps+tcp",
+			server: client.TLSProfile{Curves: []string{"P-384"}}, client: client.TLSProfile{Curves: []string{"P-384"}},
+			ok: true},
+		{name: "tls-curve-mismatch", transport: TransportTLS, scheme: "coaps+tcp",
+			server: client.TLSProfile{Curves: []string{"P-384"}}, client: client.TLSProfile{Curves: []string{"X25519"}}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			gateway := testGateway(&mockClient{})
+			if err := gateway.SetTransport(subtest.transport); err != nil {
+				t.Fatal(err)
+			}
+			gateway.SetTLSProfile(subtest.server)
+			if err := gateway.StartCOAPServer(":0", serverKey); err != nil {
+				t.Fatal(err)
+			}
+			defer gateway.ShutdownCOAPServer()
+
+			gwURL, _ := url.Parse(subtest.scheme + "://" + gateway.Address())
+			_, err := client.NewConnection().
+				ConnectTo(gwURL).
+				WithKey(clientKey).
+				WithTLSProfile(subtest.client).
+				WithGatewayTrust(client.GatewayTrust{PinnedKeys: []crypto.PublicKey{serverKey.Public()}}).
+				TimeoutRequestAfter(time.Second).
+				Create()
+			if (err == nil) != subtest.ok {
+				t.Errorf("expected connection %v; got error %v", subtest.ok, err)
+			}
+		})
+	}
+}
+
+func TestGateway_SetTLSProfile(t *testing.T) {
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	gateway := testGateway(&mockClient{})
+	if err := gateway.SetTransport(TransportTCP); err != nil {
+		t.Fatal(err)
+	}
+	gateway.SetTLSProfile(client.TLSProfile{MinVersion: "1.2"})
+	if err := gateway.StartCOAPServer(":0", serverKey); err == nil {
+		gateway.ShutdownCOAPServer()
+		t.Error("expected a TLS profile to be rejected over an insecure transport")
+	}
+}
+
+// benchmark an access token request from a thing to AM via the gateway over each transport
+func BenchmarkGatewayServer_AccessToken(b *testing.B) {
+	transports := []struct {
+		transport Transport
+		scheme    string
+	}{
+		{transport: TransportDTLS, scheme: "coap"},
+		{transport: TransportTLS, scheme: "coaps+tcp"},
+		{transport: TransportTCP, scheme: "coap+tcp"},
+	}
+	for _, tr := range transports {
+		b.Run(string(tr.transport), func(b *testing.B) {
+			gateway := testGateway(&mockClient{})
+			if err := gateway.SetTransport(tr.transport); err != nil {
+				b.Fatal(err)
+			}
+			serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			if err := gateway.StartCOAPServer(":0", serverKey); err != nil {
+				b.Fatal(err)
+			}
+			defer gateway.ShutdownCOAPServer()
+			gwURL, _ := url.Parse(tr.scheme + "://" + gateway.Address())
+			var trust client.GatewayTrust
+			if tr.transport != TransportTCP {
+				trust.PinnedKeys = []crypto.PublicKey{serverKey.Public()}
+			}
+			connection, err := client.NewConnection().ConnectTo(gwURL).WithKey(clientKey).WithGatewayTrust(trust).Create()
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err = connection.AccessToken("12345", client.ApplicationJSON, "{}"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestThingGateway_Validate(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	handlers := []callback.Handler{callback.AuthenticateHandler{ThingID: "gateway", KeyID: "kid", Key: key}}
+	valid := NewThingGateway("https://am.example.com/am", "/", "reg-tree", time.Second, handlers)
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("expected a valid configuration; got %v", err)
+	}
+
+	unsupported, _ := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	handlers = []callback.Handler{callback.AuthenticateHandler{ThingID: "gateway", KeyID: "kid", Key: unsupported}}
+	invalid := NewThingGateway("https://am.example.com/am", "/alf heim", "", time.Second, handlers)
+	err := invalid.Initialise()
+	var configErr client.ConfigError
+	if !errors.As(err, &configErr) {
+		t.Fatalf("expected a config error; got %v", err)
+	}
+	if len(configErr.Problems) != 3 {
+		t.Errorf("expected 3 problems; got %v", configErr.Problems)
+	}
+}
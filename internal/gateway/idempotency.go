@@ -0,0 +1,233 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+	"github.com/patrickmn/go-cache"
+)
+
+// Idempotency keys
+// A thing that repeats a registration or an access token request after a timeout identifies the attempts with the
+// same idempotency key, see client.IdempotencyKeyOption. The gateway holds the response to the attempt that completed
+// for the lifetime of the key and returns it to the other attempts without forwarding them to AM. An attempt that
+// arrives while another attempt with the same key is in progress waits for its response.
+// Keys are bound to the route and to the thing: access token requests to the session token and authentication
+// requests to the ID of the thing in the JWT PoP. Since the gateway can not verify the JWT PoP of an authentication
+// request, the ID of the thing is not proof of the identity of the sender, so authentication requests are also bound
+// to the transport peer: the verified client certificate of the thing if it has one, otherwise the address of the
+// DTLS session. A repeated flow from another peer is forwarded to AM. Keys shorter than
+// client.MinIdempotencyKeyLength are rejected. The first step of an authentication flow does not identify the thing
+// so it is always forwarded to AM, and only the final step, which returns the session token, is returned to a
+// repeated flow. This lets the thing process the callbacks of the repeated flow, and so know the key to which its
+// session is bound, without registering again.
+
+var (
+	errIdempotencyKeyLifetime = errors.New("idempotency key lifetime must be positive")
+	errIdempotencyKeyLength   = errors.New("idempotency key is too short")
+)
+
+// idempotentRequests holds the requests with idempotency keys that are in progress or have completed
+type idempotentRequests struct {
+	lifetime time.Duration
+	store    *cache.Cache
+}
+
+// idempotentRequest is an attempt of a request with an idempotency key
+type idempotentRequest struct {
+	done chan struct{}
+	// response is set before done is closed if the attempt completed the request
+	response *idempotentResponse
+}
+
+// idempotentResponse is the response to a completed request
+type idempotentResponse struct {
+	code          codes.Code
+	contentFormat *coap.MediaType
+	payload       []byte
+}
+
+// EnableIdempotencyKeys returns the response to a completed registration or access token request to the repeated
+// attempts of the request with the same idempotency key for the lifetime of the key.
+// Must be called before the CoAP server is started.
+func (c *ThingGateway) EnableIdempotencyKeys(lifetime time.Duration) error {
+	if lifetime <= 0 {
+		return errIdempotencyKeyLifetime
+	}
+	c.idempotency = &idempotentRequests{
+		lifetime: lifetime,
+		store:    cache.New(lifetime, lifetime),
+	}
+	return nil
+}
+
+// write writes the response
+func (r idempotentResponse) write(w coap.ResponseWriter) {
+	w.SetCode(r.code)
+	if r.contentFormat != nil {
+		w.SetContentFormat(*r.contentFormat)
+	}
+	writeResponse(w, r.payload)
+}
+
+// recordingResponseWriter records the response written by a handler
+type recordingResponseWriter struct {
+	protectedResponseWriter
+	written bool
+}
+
+func (w *recordingResponseWriter) SetCode(code codes.Code) {
+	w.protectedResponseWriter.SetCode(code)
+	w.ResponseWriter.SetCode(code)
+}
+
+func (w *recordingResponseWriter) SetContentFormat(contentFormat coap.MediaType) {
+	w.protectedResponseWriter.SetContentFormat(contentFormat)
+	w.ResponseWriter.SetContentFormat(contentFormat)
+}
+
+func (w *recordingResponseWriter) Write(p []byte) (n int, err error) {
+	_, _ = w.protectedResponseWriter.Write(p)
+	w.written = true
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *recordingResponseWriter) WriteWithContext(_ context.Context, p []byte) (n int, err error) {
+	return w.Write(p)
+}
+
+// idempotent returns a handler that returns the response to a completed request with the same idempotency key
+// instead of calling the given handler. The scope returns the thing to which the key is bound, or an empty string if
+// the request can not be repeated, and complete returns true if the response completes the request.
+func (c *ThingGateway) idempotent(handler coap.HandlerFunc, scope func(r *coap.Request) string,
+	complete func(r *coap.Request, response idempotentResponse) bool) coap.HandlerFunc {
+	if c.idempotency == nil {
+		return handler
+	}
+	requests := c.idempotency
+	return func(w coap.ResponseWriter, r *coap.Request) {
+		key := client.IdempotencyKey(r.Msg)
+		if key == "" {
+			handler(w, r)
+			return
+		}
+		if len(key) < client.MinIdempotencyKeyLength {
+			w.SetCode(codes.BadRequest)
+			writeResponse(w, []byte(errIdempotencyKeyLength.Error()))
+			return
+		}
+		thing := scope(r)
+		if thing == "" {
+			handler(w, r)
+			return
+		}
+		key = cacheKey(r.Msg.PathString(), key, thing)
+		request := &idempotentRequest{done: make(chan struct{})}
+		for requests.store.Add(key, request, cache.DefaultExpiration) != nil {
+			existing, ok := requests.store.Get(key)
+			if !ok {
+				continue
+			}
+			<-existing.(*idempotentRequest).done
+			if response := existing.(*idempotentRequest).response; response != nil {
+				c.log.Tracef("Returning the response to the completed request with idempotency key %s", key)
+				response.write(w)
+				return
+			}
+			// the attempt in progress did not complete the request
+		}
+
+		writer := &recordingResponseWriter{protectedResponseWriter: protectedResponseWriter{ResponseWriter: w}}
+		handler(writer, r)
+		response := idempotentResponse{
+			code:          writer.responseCode(r.Msg.Code()),
+			contentFormat: writer.contentFormat,
+			payload:       writer.payload,
+		}
+		if writer.written && complete(r, response) {
+			request.response = &response
+		} else {
+			requests.store.Delete(key)
+		}
+		close(request.done)
+	}
+}
+
+// authenticatingThing returns the ID of the thing that makes the authentication request qualified by the transport
+// peer that sent it
+func (c *ThingGateway) authenticatingThing(r *coap.Request) string {
+	codec, err := requestCodec(r.Msg)
+	if err != nil {
+		return ""
+	}
+	var auth client.AuthenticatePayload
+	if err := codec.Unmarshal(r.Msg.Payload(), &auth); err != nil {
+		return ""
+	}
+	id := thingID(auth.Callbacks)
+	peer := c.transportPeer(r)
+	if id == "" || peer == "" {
+		return ""
+	}
+	return id + "@" + peer
+}
+
+// transportPeer identifies the transport peer that sent the request by the fingerprint of its verified client
+// certificate or, if it has none, by the address of its session
+func (c *ThingGateway) transportPeer(r *coap.Request) string {
+	if c.clientCAs != nil {
+		if cert, err := c.clientCertificate(r); err == nil {
+			return fmt.Sprintf("%x", sha256.Sum256(cert.Raw))
+		}
+	}
+	if address := r.Client.RemoteAddr(); address != nil {
+		return address.String()
+	}
+	return ""
+}
+
+// authenticated returns true if the response to the authentication request contains a session token
+func authenticated(r *coap.Request, response idempotentResponse) bool {
+	codec, err := requestCodec(r.Msg)
+	if response.code != codes.Valid || err != nil {
+		return false
+	}
+	var reply client.AuthenticatePayload
+	return codec.Unmarshal(response.payload, &reply) == nil && reply.HasSessionToken()
+}
+
+// requestingSession returns the session token with which the thing endpoint request is made
+func requestingSession(r *coap.Request) string {
+	token, _, _, err := decodeThingEndpointRequest(r.Msg)
+	if err != nil {
+		return ""
+	}
+	return token
+}
+
+// issued returns true if the response to the access token request is successful
+func issued(_ *coap.Request, response idempotentResponse) bool {
+	return response.code == codes.Changed
+}
@@ -0,0 +1,180 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+)
+
+func TestGatewayServer_IdempotencyKey(t *testing.T) {
+	const (
+		session      = ".eyJjc3JmIjoiMTIzNDUifQ."
+		otherSession = ".eyJjc3JmIjoiNjc4OTAifQ."
+	)
+	a, b := client.NewIdempotencyKey(), client.NewIdempotencyKey()
+	type attempt struct {
+		key     string
+		session string
+	}
+	tests := []struct {
+		name     string
+		attempts []attempt
+		fail     bool
+		calls    int32
+	}{
+		{name: "no-key", attempts: []attempt{{"", session}, {"", session}}, calls: 2},
+		{name: "same-key", attempts: []attempt{{a, session}, {a, session}}, calls: 1},
+		{name: "different-keys", attempts: []attempt{{a, session}, {b, session}}, calls: 2},
+		{name: "different-sessions", attempts: []attempt{{a, session}, {a, otherSession}}, calls: 2},
+		{name: "failed", attempts: []attempt{{a, session}, {a, session}}, fail: true, calls: 2},
+		{name: "short-key", attempts: []attempt{{"a", session}, {"a", session}}, fail: true, calls: 0},
+	}
+	for _, subtest := range tests {
+		// the handlers of the gateway may still be running when the next subtest starts
+		subtest := subtest
+		t.Run(subtest.name, func(t *testing.T) {
+			var calls int32
+			m := &mockClient{accessTokenFunc: func(string, string) ([]byte, error) {
+				n := atomic.AddInt32(&calls, 1)
+				if subtest.fail {
+					return nil, client.ErrAMUnreachable
+				}
+				return []byte(fmt.Sprintf(`{"access_token":"%d"}`, n)), nil
+			}}
+			serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			gateway := testGateway(m)
+			if err := gateway.EnableIdempotencyKeys(time.Minute); err != nil {
+				t.Fatal(err)
+			}
+			if err := gateway.StartCOAPServer(":0", serverKey); err != nil {
+				t.Fatal(err)
+			}
+			defer gateway.ShutdownCOAPServer()
+
+			connection := gatewayConnection(t, gateway)
+			var replies []string
+			for _, a := range subtest.attempts {
+				reply, err := client.WithIdempotencyKey(connection, a.key).AccessToken("", client.ApplicationJOSE, a.session)
+				if (err == nil) == subtest.fail {
+					t.Fatalf("unexpected error %v", err)
+				}
+				replies = append(replies, string(reply))
+			}
+			if n := atomic.LoadInt32(&calls); n != subtest.calls {
+				t.Errorf("expected %d requests to AM; got %d", subtest.calls, n)
+			}
+			if !subtest.fail && (replies[0] == replies[1]) != (subtest.calls == 1) {
+				t.Errorf("unexpected replies %v", replies)
+			}
+		})
+	}
+}
+
+// check that an attempt that arrives while another attempt is in progress receives the same response
+func TestGatewayServer_IdempotencyKey_Concurrent(t *testing.T) {
+	var calls int32
+	m := &mockClient{accessTokenFunc: func(string, string) ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(100 * time.Millisecond)
+		return []byte(`{"access_token":"12345"}`), nil
+	}}
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	gateway := testGateway(m)
+	if err := gateway.EnableIdempotencyKeys(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := gateway.StartCOAPServer(":0", serverKey); err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.ShutdownCOAPServer()
+
+	key := client.NewIdempotencyKey()
+	connections := make([]client.Connection, 3)
+	for i := range connections {
+		connections[i] = client.WithIdempotencyKey(gatewayConnection(t, gateway), key)
+	}
+	var wg sync.WaitGroup
+	for _, connection := range connections {
+		wg.Add(1)
+		go func(connection client.Connection) {
+			defer wg.Done()
+			if _, err := connection.AccessToken("", client.ApplicationJOSE, ".eyJjc3JmIjoiMTIzNDUifQ."); err != nil {
+				t.Error(err)
+			}
+		}(connection)
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("expected a single request to AM; got %d", n)
+	}
+}
+
+// check that a repeated authentication flow is only given the session of the completed flow if it is sent by the same
+// transport peer
+func TestGatewayServer_IdempotencyKey_Authenticate(t *testing.T) {
+	var calls int32
+	m := &mockClient{AuthenticateFunc: func(client.AuthenticatePayload) (reply client.AuthenticatePayload, err error) {
+		reply.TokenID = fmt.Sprintf("session-%d", atomic.AddInt32(&calls, 1))
+		return reply, nil
+	}}
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	thingKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	gateway := testGateway(m)
+	if err := gateway.EnableIdempotencyKeys(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := gateway.StartCOAPServer(":0", serverKey); err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.ShutdownCOAPServer()
+
+	key := client.NewIdempotencyKey()
+	authenticate := func(connection client.Connection) string {
+		reply, err := client.WithIdempotencyKey(connection, key).Authenticate(testAuthentication(t, thingKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reply.TokenID
+	}
+	connection := gatewayConnection(t, gateway)
+	first := authenticate(connection)
+	if repeated := authenticate(connection); repeated != first {
+		t.Errorf("expected the repeated flow to be given session %s; got %s", first, repeated)
+	}
+	if other := authenticate(gatewayConnection(t, gateway)); other == first {
+		t.Error("expected a flow from another peer to be forwarded to AM")
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("expected 2 requests to AM; got %d", n)
+	}
+}
+
+func TestGateway_EnableIdempotencyKeys(t *testing.T) {
+	gateway := testGateway(&mockClient{})
+	if err := gateway.EnableIdempotencyKeys(0); err == nil {
+		t.Error("expected a zero lifetime to be rejected")
+	}
+}
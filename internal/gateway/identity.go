@@ -0,0 +1,325 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	frcrypto "github.com/JacoJooste/iot-edge/v7/internal/crypto"
+	"github.com/JacoJooste/iot-edge/v7/internal/debug"
+	"github.com/pion/dtls/v2"
+)
+
+// Server identity
+// By default the CoAP server presents a self-signed certificate for the key given to StartCOAPServer. Instead, the
+// gateway can present a certificate chain, for example loaded from PEM files, or obtain its certificate from an issuer,
+// such as an internal CA, and renew it before it expires so that the identity of the gateway can be managed like that
+// of any other TLS endpoint. The private key of a certificate may be any crypto.Signer, such as a key held in a PKCS#11
+// token, when the TLS transport is used. The DTLS library can only sign with in-memory ECDSA, Ed25519 and RSA keys.
+// A renewed certificate is presented to new connections, existing connections keep the certificate of their handshake.
+
+// certificateRenewalRetry is the time after which a failed certificate renewal is retried
+var certificateRenewalRetry = time.Minute
+
+// CertificateIssuer issues certificates for the gateway
+type CertificateIssuer interface {
+	// Issue returns the certificate chain, leaf first, issued for the DER encoded certificate request
+	Issue(csr []byte) ([]*x509.Certificate, error)
+}
+
+// CertificateRenewal configures how the gateway obtains and renews its certificate
+type CertificateRenewal struct {
+	Issuer CertificateIssuer
+	// Key of the gateway for which the certificates are issued
+	Key crypto.Signer
+	// Subject of the certificates
+	CommonName  string
+	DNSNames    []string
+	IPAddresses []net.IP
+	// RenewBefore is the period before the expiry of a certificate in which it is renewed. Defaults to a third of the
+	// validity period of the certificate.
+	RenewBefore time.Duration
+}
+
+// request returns a DER encoded certificate request for the key
+func (r CertificateRenewal) request() ([]byte, error) {
+	return x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:     pkix.Name{CommonName: r.CommonName},
+		DNSNames:    r.DNSNames,
+		IPAddresses: r.IPAddresses,
+	}, r.Key)
+}
+
+// issue obtains a new certificate from the issuer
+func (r CertificateRenewal) issue() (cert tls.Certificate, err error) {
+	csr, err := r.request()
+	if err != nil {
+		return cert, err
+	}
+	chain, err := r.Issuer.Issue(csr)
+	if err != nil {
+		return cert, err
+	}
+	if len(chain) == 0 {
+		return cert, errors.New("issuer returned an empty certificate chain")
+	}
+	for _, c := range chain {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	cert.PrivateKey = r.Key
+	cert.Leaf = chain[0]
+	return cert, nil
+}
+
+// renewAt returns the time at which the certificate must be renewed
+func (r CertificateRenewal) renewAt(leaf *x509.Certificate) time.Time {
+	before := r.RenewBefore
+	if before <= 0 {
+		before = leaf.NotAfter.Sub(leaf.NotBefore) / 3
+	}
+	return leaf.NotAfter.Add(-before)
+}
+
+// serverIdentity holds the certificate presented by the CoAP server, which is replaced when it is renewed
+type serverIdentity struct {
+	mutex   sync.RWMutex
+	cert    tls.Certificate
+	renewal *CertificateRenewal
+	// schedule staggers the renewals of the certificate
+	schedule *maintenanceScheduler
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// certificate returns the current certificate
+func (s *serverIdentity) certificate() tls.Certificate {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.cert
+}
+
+// due returns the time at which the certificate is renewed, which the schedule may move into the first half of the
+// renewal period
+func (s *serverIdentity) due(leaf *x509.Certificate) time.Time {
+	renewAt := s.renewal.renewAt(leaf)
+	return s.schedule.plan(renewAt, renewAt, renewAt.Add(leaf.NotAfter.Sub(renewAt)/2))
+}
+
+// initialise obtains the first certificate if the certificate is renewed
+func (s *serverIdentity) initialise() error {
+	if s.renewal == nil || s.cert.Leaf != nil {
+		return nil
+	}
+	cert, err := s.renewal.issue()
+	if err != nil {
+		return fmt.Errorf("unable to obtain a server certificate; %w", err)
+	}
+	s.mutex.Lock()
+	s.cert = cert
+	s.mutex.Unlock()
+	return nil
+}
+
+// renew the certificate when it is due, retrying if the renewal fails
+func (s *serverIdentity) renew(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	due := s.due(s.certificate().Leaf)
+	for {
+		timer := time.NewTimer(time.Until(due))
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			return
+		}
+		cert, err := s.renewal.issue()
+		if err != nil {
+			debug.Errorf("Unable to renew the server certificate; %s", err)
+			due = time.Now().Add(certificateRenewalRetry)
+			continue
+		}
+		s.mutex.Lock()
+		s.cert = cert
+		s.mutex.Unlock()
+		debug.Infof("Renewed the server certificate, it expires at %s", cert.Leaf.NotAfter)
+		due = s.due(cert.Leaf)
+	}
+}
+
+// start renewing the certificate according to the schedule
+func (s *serverIdentity) start(schedule *maintenanceScheduler) {
+	if s.renewal == nil {
+		return
+	}
+	s.schedule = schedule
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.renew(s.stop, s.done)
+}
+
+// shutdown stops renewing the certificate
+func (s *serverIdentity) shutdown() {
+	if s.stop == nil {
+		return
+	}
+	close(s.stop)
+	<-s.done
+	s.stop = nil
+}
+
+// presentDTLS makes the DTLS server present the current certificate to every new connection. The DTLS library reads
+// the certificates from its configuration when it accepts a connection, in the same goroutine and right after it has
+// made the connect context, so the context maker replaces the certificates.
+func (s *serverIdentity) presentDTLS(config *dtls.Config) {
+	maker := config.ConnectContextMaker
+	config.ConnectContextMaker = func() (context.Context, func()) {
+		config.Certificates = []tls.Certificate{s.certificate()}
+		if maker == nil {
+			// the default handshake timeout of the DTLS library
+			return context.WithTimeout(context.Background(), 30*time.Second)
+		}
+		return maker()
+	}
+}
+
+// presentTLS makes the TLS server present the current certificate to every new connection
+func (s *serverIdentity) presentTLS(config *tls.Config) {
+	config.Certificates = nil
+	config.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert := s.certificate()
+		return &cert, nil
+	}
+}
+
+// checkDTLSKey checks that the DTLS library can sign with the key
+func checkDTLSKey(key crypto.PrivateKey) error {
+	switch key.(type) {
+	case *ecdsa.PrivateKey, ed25519.PrivateKey, *rsa.PrivateKey:
+		return nil
+	default:
+		return fmt.Errorf("DTLS does not support keys of type %T, use the TLS transport", key)
+	}
+}
+
+// serverCertificate returns the certificate that the CoAP server presents, which is a self-signed certificate for the
+// key unless the gateway has been given a certificate or obtains its certificate from an issuer
+func (c *ThingGateway) serverCertificate(key crypto.Signer) (tls.Certificate, error) {
+	if c.identity == nil {
+		return frcrypto.PublicKeyCertificate(key)
+	}
+	if err := c.identity.initialise(); err != nil {
+		return tls.Certificate{}, err
+	}
+	return c.identity.certificate(), nil
+}
+
+// SetServerCertificate makes the CoAP server present the certificate chain instead of a self-signed certificate. The
+// private key of the certificate must be a crypto.Signer.
+// Must be called before the CoAP server is started.
+func (c *ThingGateway) SetServerCertificate(cert tls.Certificate) error {
+	if len(cert.Certificate) == 0 {
+		return errors.New("server certificate chain is empty")
+	}
+	if _, ok := cert.PrivateKey.(crypto.Signer); !ok {
+		return fmt.Errorf("private key of type %T is not a signer", cert.PrivateKey)
+	}
+	if cert.Leaf == nil {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+		cert.Leaf = leaf
+	}
+	c.identity = &serverIdentity{cert: cert}
+	return nil
+}
+
+// LoadServerCertificate loads a certificate chain and its private key from PEM encoded files
+func LoadServerCertificate(certFile, keyFile string) (tls.Certificate, error) {
+	return tls.LoadX509KeyPair(certFile, keyFile)
+}
+
+// EnableCertificateRenewal makes the gateway obtain the certificate of the CoAP server from the issuer when the server
+// starts and renew the certificate before it expires.
+// Must be called before the CoAP server is started.
+func (c *ThingGateway) EnableCertificateRenewal(renewal CertificateRenewal) error {
+	if renewal.Issuer == nil {
+		return errors.New("a certificate issuer is required")
+	}
+	if renewal.Key == nil {
+		return errors.New("a key is required to request certificates")
+	}
+	c.identity = &serverIdentity{renewal: &renewal}
+	return nil
+}
+
+// CAIssuer issues certificates signed by a CA, such as an internal CA of the organisation that runs the gateway
+type CAIssuer struct {
+	Certificate *x509.Certificate
+	Key         crypto.Signer
+	// Validity of the issued certificates
+	Validity time.Duration
+}
+
+// Issue a certificate for the request, which is returned with the CA certificate
+func (i CAIssuer) Issue(csr []byte) ([]*x509.Certificate, error) {
+	request, err := x509.ParseCertificateRequest(csr)
+	if err != nil {
+		return nil, err
+	}
+	if err = request.CheckSignature(); err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      request.Subject,
+		DNSNames:     request.DNSNames,
+		IPAddresses:  request.IPAddresses,
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(i.Validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, i.Certificate, request.PublicKey, i.Key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		return nil, err
+	}
+	return []*x509.Certificate{cert, i.Certificate}, nil
+}
@@ -0,0 +1,301 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	frcrypto "github.com/JacoJooste/iot-edge/v7/internal/crypto"
+	"github.com/pion/dtls/v2"
+)
+
+// testCAIssuer returns an issuer with a self-signed CA
+func testCAIssuer(t *testing.T, validity time.Duration) CAIssuer {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Internal CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(raw)
+	return CAIssuer{Certificate: cert, Key: key, Validity: validity}
+}
+
+// testServerCertificate returns the certificate presented by the DTLS server of the gateway
+func testServerCertificate(t *testing.T, gateway *ThingGateway) *x509.Certificate {
+	cert, _ := frcrypto.PublicKeyCertificate(clientKey)
+	addr, _ := net.ResolveUDPAddr("udp", gateway.Address())
+	conn, err := dtls.Dial("udp", addr, dtlsClientConfig(cert))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	chain := conn.RemoteCertificate()
+	if len(chain) == 0 {
+		t.Fatal("no server certificate")
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf
+}
+
+func TestGatewayServer_CertificateRenewal(t *testing.T) {
+	issuer := testCAIssuer(t, 3*time.Second)
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	gateway := testGateway(&mockClient{})
+	err := gateway.EnableCertificateRenewal(CertificateRenewal{
+		Issuer:      issuer,
+		Key:         key,
+		CommonName:  "gateway.example.com",
+		DNSNames:    []string{"gateway.example.com"},
+		RenewBefore: 2500 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = gateway.StartCOAPServer("127.0.0.1:0", nil); err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.ShutdownCOAPServer()
+
+	first := testServerCertificate(t, gateway)
+	if err = first.CheckSignatureFrom(issuer.Certificate); err != nil {
+		t.Fatal(err)
+	}
+	if first.Subject.CommonName != "gateway.example.com" || len(first.DNSNames) != 1 {
+		t.Errorf("unexpected subject %v %v", first.Subject, first.DNSNames)
+	}
+
+	// the certificate is renewed half a second after it is issued
+	time.Sleep(time.Second)
+	renewed := testServerCertificate(t, gateway)
+	if renewed.SerialNumber.Cmp(first.SerialNumber) == 0 {
+		t.Error("expected a renewed certificate")
+	}
+}
+
+func TestGatewayServer_ServerCertificateFromFiles(t *testing.T) {
+	issuer := testCAIssuer(t, time.Hour)
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	csr, _ := CertificateRenewal{Key: key, CommonName: "gateway.example.com"}.request()
+	chain, err := issuer.Issue(csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "identity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "gateway.crt"), filepath.Join(dir, "gateway.key")
+	var certPEM []byte
+	for _, c := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err = ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := LoadServerCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gateway := testGateway(&mockClient{})
+	if err = gateway.SetServerCertificate(cert); err != nil {
+		t.Fatal(err)
+	}
+	if err = gateway.StartCOAPServer("127.0.0.1:0", nil); err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.ShutdownCOAPServer()
+
+	if leaf := testServerCertificate(t, gateway); leaf.SerialNumber.Cmp(chain[0].SerialNumber) != 0 {
+		t.Errorf("expected the certificate loaded from file")
+	}
+}
+
+// testHardwareSigner is a signer that, like a key held in a PKCS#11 token, does not expose its private key
+type testHardwareSigner struct {
+	key *ecdsa.PrivateKey
+}
+
+func (s testHardwareSigner) Public() crypto.PublicKey {
+	return s.key.Public()
+}
+
+func (s testHardwareSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return s.key.Sign(rand, digest, opts)
+}
+
+func TestGatewayServer_ServerCertificate_HardwareKey(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tests := []struct {
+		name       string
+		transport  Transport
+		successful bool
+	}{
+		{name: "tls", transport: TransportTLS, successful: true},
+		{name: "dtls", transport: TransportDTLS},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			cert, _ := frcrypto.PublicKeyCertificate(testHardwareSigner{key: key})
+			gateway := testGateway(&mockClient{})
+			if err := gateway.SetServerCertificate(cert); err != nil {
+				t.Fatal(err)
+			}
+			if err := gateway.SetTransport(subtest.transport); err != nil {
+				t.Fatal(err)
+			}
+			err := gateway.StartCOAPServer("127.0.0.1:0", nil)
+			if err != nil {
+				if subtest.successful {
+					t.Fatal(err)
+				}
+				return
+			}
+			defer gateway.ShutdownCOAPServer()
+			if !subtest.successful {
+				t.Fatal("expected an error")
+			}
+			conn, err := tls.Dial("tcp", gateway.Address(), &tls.Config{InsecureSkipVerify: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+		})
+	}
+}
+
+func TestGatewayServer_GatewayTrust(t *testing.T) {
+	issuer := testCAIssuer(t, time.Hour)
+	other := testCAIssuer(t, time.Hour)
+	roots, otherRoots := x509.NewCertPool(), x509.NewCertPool()
+	roots.AddCert(issuer.Certificate)
+	otherRoots.AddCert(other.Certificate)
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tests := []struct {
+		name      string
+		transport Transport
+		scheme    string
+		trust     client.GatewayTrust
+		ok        bool
+	}{
+		{name: "tls-system-roots", transport: TransportTLS, scheme: "coaps+tcp"},
+		{name: "tls-roots", transport: TransportTLS, scheme: "coaps+tcp", trust: client.GatewayTrust{RootCAs: roots},
+			ok: true},
+		{name: "tls-other-roots", transport: TransportTLS, scheme: "coaps+tcp",
+			trust: client.GatewayTrust{RootCAs: otherRoots}},
+		{name: "tls-pinned", transport: TransportTLS, scheme: "coaps+tcp",
+			trust: client.GatewayTrust{PinnedKeys: []crypto.PublicKey{key.Public()}}, ok: true},
+		{name: "tls-roots-and-wrong-pin", transport: TransportTLS, scheme: "coaps+tcp",
+			trust: client.GatewayTrust{RootCAs: roots, PinnedKeys: []crypto.PublicKey{otherKey.Public()}}},
+		{name: "tls-insecure", transport: TransportTLS, scheme: "coaps+tcp",
+			trust: client.GatewayTrust{InsecureSkipVerify: true}, ok: true},
+		{name: "tls-insecure-and-pinned", transport: TransportTLS, scheme: "coaps+tcp",
+			trust: client.GatewayTrust{InsecureSkipVerify: true, PinnedKeys: []crypto.PublicKey{key.Public()}}},
+		{name: "dtls-default", transport: TransportDTLS, scheme: "coaps", ok: true},
+		{name: "dtls-roots", transport: TransportDTLS, scheme: "coaps", trust: client.GatewayTrust{RootCAs: roots},
+			ok: true},
+		{name: "dtls-other-roots", transport: TransportDTLS, scheme: "coaps",
+			trust: client.GatewayTrust{RootCAs: otherRoots}},
+		{name: "dtls-wrong-pin", transport: TransportDTLS, scheme: "coaps",
+			trust: client.GatewayTrust{PinnedKeys: []crypto.PublicKey{otherKey.Public()}}},
+		{name: "tcp-insecure", transport: TransportTCP, scheme: "coap+tcp",
+			trust: client.GatewayTrust{InsecureSkipVerify: true}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			gateway := testGateway(&mockClient{})
+			if err := gateway.SetTransport(subtest.transport); err != nil {
+				t.Fatal(err)
+			}
+			err := gateway.EnableCertificateRenewal(CertificateRenewal{
+				Issuer:      issuer,
+				Key:         key,
+				CommonName:  "gateway",
+				IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = gateway.StartCOAPServer("127.0.0.1:0", nil); err != nil {
+				t.Fatal(err)
+			}
+			defer gateway.ShutdownCOAPServer()
+
+			gwURL, _ := url.Parse(subtest.scheme + "://" + gateway.Address())
+			_, err = client.NewConnection().
+				ConnectTo(gwURL).
+				WithKey(clientKey).
+				WithGatewayTrust(subtest.trust).
+				TimeoutRequestAfter(time.Second).
+				Create()
+			if (err == nil) != subtest.ok {
+				t.Errorf("expected connection %v; got error %v", subtest.ok, err)
+			}
+		})
+	}
+}
+
+func TestThingGateway_ServerIdentity_Invalid(t *testing.T) {
+	gateway := testGateway(&mockClient{})
+	if err := gateway.SetServerCertificate(tls.Certificate{}); err == nil {
+		t.Error("expected an error for an empty certificate chain")
+	}
+	if err := gateway.EnableCertificateRenewal(CertificateRenewal{}); err == nil {
+		t.Error("expected an error without an issuer")
+	}
+	if err := gateway.StartCOAPServer("127.0.0.1:0", nil); err == nil {
+		gateway.ShutdownCOAPServer()
+		t.Error("expected an error without a key or certificate")
+	}
+}
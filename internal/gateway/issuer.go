@@ -0,0 +1,409 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/JacoJooste/iot-edge/v7/internal/clock"
+	"github.com/JacoJooste/iot-edge/v7/internal/debug"
+	"github.com/JacoJooste/iot-edge/v7/internal/jws"
+	"github.com/JacoJooste/iot-edge/v7/pkg/callback"
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+	"github.com/patrickmn/go-cache"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// Local token issuance
+// Services on the same site as the things, such as a local MQTT broker, may need to authorise things while the WAN
+// link to AM is down. The gateway can issue short-lived JWTs, signed with its own key, to things whose identity has
+// been verified by AM, or by the gateway while offline authentication is enabled. The gateway records the thing ID,
+// the claims and the JWT with which the thing proved possession of its key for every session created through it, for
+// no longer than the session lives. A thing requests a token for one of the configured audiences with a request signed
+// with the key of its session. The gateway checks that the key also signed the recorded JWT, which AM or the offline
+// authenticator verified, pins the key for the session and maps the recorded claims into the token, so that a session
+// token alone can not be used to obtain tokens. The request must be short-lived and the gateway keeps its ID until it
+// expires, so that a captured request can not be replayed. Site-local services verify the tokens with the public key of the
+// gateway. Tokens are only valid within the site and never reach AM. Every issued or denied token is reported as an
+// audit event.
+
+const (
+	// RouteLocalToken is the route at which things request tokens issued by the gateway
+	RouteLocalToken = "/localtoken"
+
+	defaultLocalTokenLifetime = 5 * time.Minute
+	// localIdentityLife is the longest time for which the identity of a session is kept if the session is not
+	// invalidated, the identity is kept for less time if the session expires sooner
+	localIdentityLife = 24 * time.Hour
+	// localRequestSkew is the difference tolerated between the clocks of the gateway and of the thing when the
+	// lifetime of a token request is checked
+	localRequestSkew = time.Minute
+	// maxLocalRequestLifetime is the longest lifetime of a token request, which bounds the time for which its ID is kept
+	maxLocalRequestLifetime = 5 * time.Minute
+
+	// Audit event types
+	AuditLocalTokenIssued = "LOCAL_TOKEN_ISSUED"
+	AuditLocalTokenDenied = "LOCAL_TOKEN_DENIED"
+)
+
+// reservedLocalClaims are set by the gateway and can not be mapped from the claims of the thing
+var reservedLocalClaims = map[string]bool{
+	"iss": true, "sub": true, "aud": true, "exp": true, "nbf": true, "iat": true, "jti": true, "scope": true,
+}
+
+var errLocalToken = errors.New("local token denied")
+
+// LocalIssuerConfig configures the issuance of tokens by the gateway for site-local services
+type LocalIssuerConfig struct {
+	// Key signs the tokens and KeyID identifies the key to the services
+	Key   crypto.Signer
+	KeyID string
+	// Issuer is the iss claim of the tokens
+	Issuer string
+	// Audiences are the site-local services for which tokens may be requested
+	Audiences []string
+	// Scopes that may be requested, no scopes may be requested if empty
+	Scopes []string
+	// Lifetime of the tokens, defaults to five minutes
+	Lifetime time.Duration
+	// Claims maps the claims of the tokens to claims of the JWT with which the thing authenticated
+	Claims map[string]string
+	// Audit receives the issued and denied tokens, the events are written to the debug logger if nil
+	Audit AuditFunc
+}
+
+// localIdentity is the identity of the thing to which a session belongs
+type localIdentity struct {
+	thingID string
+	claims  map[string]interface{}
+	// proof is the JWT, verified by AM or the offline authenticator, with which the thing proved possession of its key
+	proof string
+	// key is the confirmation key of the session, nil until it is known
+	key *jose.JSONWebKey
+}
+
+// localIssuer issues tokens to things for site-local services
+type localIssuer struct {
+	config     LocalIssuerConfig
+	signer     jose.Signer
+	identities *cache.Cache
+	// requests contains the IDs of the token requests that have been received and have not expired
+	requests *cache.Cache
+	// mutex guards the confirmation keys of the identities
+	mutex sync.Mutex
+}
+
+func newLocalIssuer(config LocalIssuerConfig) (*localIssuer, error) {
+	if config.Key == nil {
+		return nil, errors.New("a key is required to issue local tokens")
+	}
+	if config.Issuer == "" {
+		return nil, errors.New("an issuer is required to issue local tokens")
+	}
+	if len(config.Audiences) == 0 {
+		return nil, errors.New("at least one audience is required to issue local tokens")
+	}
+	for claim := range config.Claims {
+		if reservedLocalClaims[claim] {
+			return nil, fmt.Errorf("claim `%s` is set by the gateway and can not be mapped", claim)
+		}
+	}
+	if config.Lifetime <= 0 {
+		config.Lifetime = defaultLocalTokenLifetime
+	}
+	if config.Audit == nil {
+		config.Audit = func(event AuditEvent) {
+			debug.Info("audit:", event)
+		}
+	}
+	opts := &jose.SignerOptions{}
+	opts.WithType("JWT")
+	if config.KeyID != "" {
+		opts.WithHeader("kid", config.KeyID)
+	}
+	signer, err := jws.NewSigner(config.Key, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &localIssuer{
+		config:     config,
+		signer:     signer,
+		identities: cache.New(localIdentityLife, time.Hour),
+		requests:   cache.New(maxLocalRequestLifetime, time.Minute),
+	}, nil
+}
+
+// track records the identity of the thing that authenticated with the callbacks for the given time to live
+func (l *localIssuer) track(token string, callbacks []callback.Callback, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	responses := popResponses(callbacks)
+	// the IDs of the callbacks are sorted so that the same identity is recorded for the same callbacks
+	ids := make([]string, 0, len(responses))
+	for id := range responses {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		response := responses[id]
+		claims := make(map[string]interface{})
+		if err := jws.ExtractClaims(response, &claims); err != nil {
+			continue
+		}
+		thingID, ok := claims["sub"].(string)
+		if !ok || thingID == "" {
+			continue
+		}
+		identity := &localIdentity{thingID: thingID, claims: claims, proof: response}
+		// a registration JWT confirms the key with which it is signed
+		var confirmation struct {
+			CNF struct {
+				JWK *jose.JSONWebKey `json:"jwk"`
+			} `json:"cnf"`
+		}
+		if jws.ExtractClaims(response, &confirmation) == nil && confirmation.CNF.JWK != nil &&
+			verifySignature(response, confirmation.CNF.JWK) == nil {
+			identity.key = confirmation.CNF.JWK
+		}
+		l.identities.Set(token, identity, ttl)
+		return
+	}
+}
+
+// verifySignature checks that the JWT is signed with the public key
+func verifySignature(token string, key *jose.JSONWebKey) error {
+	if key == nil || key.Key == nil || !key.IsPublic() {
+		return errors.New("missing public key")
+	}
+	object, err := jose.ParseSigned(token)
+	if err != nil {
+		return err
+	}
+	_, err = object.Verify(key.Key)
+	return err
+}
+
+// verifyRequest checks that the signed request was made with the confirmation key of the identity and returns the
+// request. The key is pinned for the session once it has been shown to have signed the proof of the identity.
+func (l *localIssuer) verifyRequest(identity *localIdentity, signed string) (request client.LocalTokenPayload,
+	err error) {
+	if err = jws.ExtractClaims(signed, &request); err != nil {
+		return request, fmt.Errorf("%w: %s", errLocalToken, err)
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	key := identity.key
+	if key == nil {
+		if request.Confirmation == nil {
+			return request, fmt.Errorf("%w: the request does not contain its confirmation key", errLocalToken)
+		}
+		key = &request.Confirmation.JWK
+		if err = verifySignature(identity.proof, key); err != nil {
+			return request, fmt.Errorf("%w: the key of the request did not authenticate the session", errLocalToken)
+		}
+	}
+	if err = verifySignature(signed, key); err != nil {
+		return request, fmt.Errorf("%w: the request is not signed with the key of the session", errLocalToken)
+	}
+	if err = l.fresh(request); err != nil {
+		return request, err
+	}
+	identity.key = key
+	return request, nil
+}
+
+// fresh checks that the request is within its lifetime and has not been received before. The ID of the request is
+// kept until the request expires so that it can not be replayed.
+func (l *localIssuer) fresh(request client.LocalTokenPayload) error {
+	if request.IssuedAt == 0 || request.Expiry == 0 || request.ID == "" {
+		return fmt.Errorf("%w: the request must contain the iat, exp and jti claims", errLocalToken)
+	}
+	now := clock.Clock()
+	issuedAt, expiry := time.Unix(request.IssuedAt, 0), time.Unix(request.Expiry, 0)
+	switch {
+	case issuedAt.After(now.Add(localRequestSkew)):
+		return fmt.Errorf("%w: the request was issued in the future", errLocalToken)
+	case !expiry.After(now.Add(-localRequestSkew)):
+		return fmt.Errorf("%w: the request has expired", errLocalToken)
+	case expiry.Before(issuedAt) || expiry.Sub(issuedAt) > maxLocalRequestLifetime:
+		return fmt.Errorf("%w: the lifetime of the request exceeds %v", errLocalToken, maxLocalRequestLifetime)
+	}
+	if err := l.requests.Add(request.ID, nil, expiry.Add(localRequestSkew).Sub(now)); err != nil {
+		return fmt.Errorf("%w: the request has already been received", errLocalToken)
+	}
+	return nil
+}
+
+// forget the identity of the session
+func (l *localIssuer) forget(token string) {
+	l.identities.Delete(token)
+}
+
+// permitted returns an error if the requested audience or any of the scopes may not be issued
+func (l *localIssuer) permitted(request client.LocalTokenPayload) (audience string, err error) {
+	audience = request.Audience
+	if audience == "" && len(l.config.Audiences) == 1 {
+		audience = l.config.Audiences[0]
+	}
+	if !contains(l.config.Audiences, audience) {
+		return audience, fmt.Errorf("%w: unknown audience `%s`", errLocalToken, audience)
+	}
+	for _, scope := range request.Scope {
+		if !contains(l.config.Scopes, scope) {
+			return audience, fmt.Errorf("%w: scope `%s` is not allowed", errLocalToken, scope)
+		}
+	}
+	return audience, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// issue a token to the thing that owns the session if the signed request was made with the key of the session
+func (l *localIssuer) issue(session string, signed string) (reply []byte, err error) {
+	event := AuditEvent{Time: clock.Clock(), Type: AuditLocalTokenDenied}
+	defer func() {
+		if err != nil {
+			event.Detail = err.Error()
+		}
+		l.config.Audit(event)
+	}()
+
+	item, ok := l.identities.Get(session)
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown session", errLocalToken)
+	}
+	identity := item.(*localIdentity)
+	event.ThingID = identity.thingID
+	request, err := l.verifyRequest(identity, signed)
+	if err != nil {
+		return nil, err
+	}
+	audience, err := l.permitted(request)
+	if err != nil {
+		return nil, err
+	}
+
+	now := clock.Clock()
+	id := client.NewTransactionID()
+	claims := map[string]interface{}{}
+	for claim, source := range l.config.Claims {
+		if value, ok := identity.claims[source]; ok {
+			claims[claim] = value
+		}
+	}
+	if len(request.Scope) > 0 {
+		claims["scope"] = strings.Join(request.Scope, " ")
+	}
+	token, err := jwt.Signed(l.signer).Claims(jwt.Claims{
+		Issuer:    l.config.Issuer,
+		Subject:   identity.thingID,
+		Audience:  jwt.Audience{audience},
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		Expiry:    jwt.NewNumericDate(now.Add(l.config.Lifetime)),
+		ID:        id,
+	}).Claims(claims).CompactSerialize()
+	if err != nil {
+		return nil, err
+	}
+	event.Type = AuditLocalTokenIssued
+	event.Detail = fmt.Sprintf("audience %s, token ID %s", audience, id)
+	return json.Marshal(struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+		Scope       string `json:"scope,omitempty"`
+	}{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(l.config.Lifetime / time.Second),
+		Scope:       strings.Join(request.Scope, " "),
+	})
+}
+
+// trackIdentity records the identity of the thing that created the session for the issuance of local tokens. The
+// identity is kept for no longer than the session, whose expiry is read from AM with the connection, or than the grace
+// period of offline authentication if the connection is nil.
+func (c *ThingGateway) trackIdentity(connection client.Connection, auth client.AuthenticatePayload,
+	reply client.AuthenticatePayload) {
+	if c.issuer == nil {
+		return
+	}
+	ttl := localIdentityLife
+	if connection != nil {
+		ttl = c.boundedTTL(connection, reply.TokenID, ttl)
+	} else if c.offline != nil && c.offline.gracePeriod < ttl {
+		ttl = c.offline.gracePeriod
+	}
+	c.issuer.track(reply.TokenID, auth.Callbacks, ttl)
+}
+
+// localTokenHandler handles requests for tokens issued by the gateway
+func (c *ThingGateway) localTokenHandler(w coap.ResponseWriter, r *coap.Request) {
+	c.log.Trace("localTokenHandler")
+	token, content, payload, ok := c.negotiate(w, r)
+	if !ok {
+		return
+	}
+	// the request must prove possession of the key of the session
+	if content != client.ApplicationJOSE {
+		w.SetCode(codes.BadRequest)
+		writeResponse(w, []byte("a signed JWT is required"))
+		return
+	}
+	b, err := c.issuer.issue(token, payload)
+	if err != nil {
+		c.log.Trace("localTokenHandler: ", err)
+		w.SetCode(codes.Forbidden)
+		writeResponse(w, []byte(err.Error()))
+		return
+	}
+	c.usage.tokenIssued(c.access.thingOf(token))
+	w.SetCode(codes.Changed)
+	writeResponse(w, b)
+	c.log.Trace("localTokenHandler: success")
+}
+
+// EnableLocalIssuer makes the Thing Gateway issue tokens for site-local services to things that have authenticated
+// through it, including while AM is unreachable.
+// Must be called before the CoAP server is started.
+func (c *ThingGateway) EnableLocalIssuer(config LocalIssuerConfig) error {
+	issuer, err := newLocalIssuer(config)
+	if err != nil {
+		return err
+	}
+	c.issuer = issuer
+	return nil
+}
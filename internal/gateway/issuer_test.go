@@ -0,0 +1,387 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/JacoJooste/iot-edge/v7/internal/jws"
+	"github.com/JacoJooste/iot-edge/v7/pkg/callback"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func testLocalIssuerConfig(events *[]AuditEvent) LocalIssuerConfig {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	return LocalIssuerConfig{
+		Key:       key,
+		KeyID:     "gateway-key",
+		Issuer:    "site-gateway",
+		Audiences: []string{"broker"},
+		Scopes:    []string{"publish", "subscribe"},
+		Claims:    map[string]string{"thing_type": "thingType"},
+		Audit: func(event AuditEvent) {
+			*events = append(*events, event)
+		},
+	}
+}
+
+func testThingKey() *ecdsa.PrivateKey {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	return key
+}
+
+// testAuthentication returns an authentication payload whose JWT only confirms the ID of the key of the thing
+func testAuthentication(t *testing.T, key crypto.Signer) client.AuthenticatePayload {
+	cb := callback.Callback{
+		Type:   callback.TypeHiddenValueCallback,
+		Output: []callback.Entry{{Name: "id", Value: authenticationCBID}, {Name: "value", Value: "1"}},
+		Input:  make([]callback.Entry, 1),
+	}
+	_, err := callback.AuthenticateHandler{Audience: "/realm", ThingID: "thingOne", KeyID: "pop.cnf", Key: key}.Handle(cb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client.AuthenticatePayload{Callbacks: []callback.Callback{cb}}
+}
+
+// testLocalTokenRequest signs a request for a local token with the key, including the key as confirmation if confirm
+// is true. A request without lifetime and ID is given a new ID and a lifetime of one minute.
+func testLocalTokenRequest(t *testing.T, key crypto.Signer, session string, request client.LocalTokenPayload,
+	confirm bool) string {
+	if request.IssuedAt == 0 && request.Expiry == 0 && request.ID == "" {
+		now := time.Now()
+		request.IssuedAt, request.Expiry = now.Unix(), now.Add(time.Minute).Unix()
+		request.ID = client.NewTransactionID()
+	}
+	if confirm {
+		request.Confirmation = &client.ConfirmationClaim{JWK: jose.JSONWebKey{Key: key.Public()}}
+	}
+	signer, err := jws.NewSigner(key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := jwt.Signed(signer).Claims(map[string]interface{}{"csrf": session}).Claims(request).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestNewLocalIssuer_Config(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(config *LocalIssuerConfig)
+	}{
+		{name: "no-key", modify: func(config *LocalIssuerConfig) { config.Key = nil }},
+		{name: "no-issuer", modify: func(config *LocalIssuerConfig) { config.Issuer = "" }},
+		{name: "no-audience", modify: func(config *LocalIssuerConfig) { config.Audiences = nil }},
+		{name: "reserved-claim", modify: func(config *LocalIssuerConfig) { config.Claims["sub"] = "thingType" }},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			var events []AuditEvent
+			config := testLocalIssuerConfig(&events)
+			subtest.modify(&config)
+			if _, err := newLocalIssuer(config); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestLocalIssuer_Issue(t *testing.T) {
+	const thingID = "thingOne"
+	thingKey := testThingKey()
+	tests := []struct {
+		name    string
+		session string
+		key     crypto.Signer
+		request client.LocalTokenPayload
+		denied  bool
+	}{
+		{name: "default-audience", session: "session-1", key: thingKey},
+		{name: "audience-and-scopes", session: "session-1", key: thingKey,
+			request: client.LocalTokenPayload{Audience: "broker", Scope: []string{"publish"}}},
+		{name: "unknown-audience", session: "session-1", key: thingKey,
+			request: client.LocalTokenPayload{Audience: "historian"}, denied: true},
+		{name: "scope-not-allowed", session: "session-1", key: thingKey,
+			request: client.LocalTokenPayload{Scope: []string{"admin"}}, denied: true},
+		{name: "unknown-session", session: "session-2", key: thingKey, denied: true},
+		{name: "other-key", session: "session-1", key: testThingKey(), denied: true},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			var events []AuditEvent
+			config := testLocalIssuerConfig(&events)
+			issuer, err := newLocalIssuer(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			issuer.track("session-1", testRegistration(t, "/realm", thingKey, nil).Callbacks, time.Hour)
+
+			signed := testLocalTokenRequest(t, subtest.key, subtest.session, subtest.request, true)
+			reply, err := issuer.issue(subtest.session, signed)
+			if len(events) != 1 {
+				t.Fatalf("expected one audit event; got %v", events)
+			}
+			if subtest.denied {
+				if err == nil {
+					t.Fatal("expected the token to be denied")
+				}
+				if events[0].Type != AuditLocalTokenDenied {
+					t.Errorf("expected audit event %s; got %s", AuditLocalTokenDenied, events[0].Type)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if events[0].Type != AuditLocalTokenIssued || events[0].ThingID != thingID {
+				t.Errorf("unexpected audit event %v", events[0])
+			}
+
+			var response struct {
+				AccessToken string `json:"access_token"`
+				ExpiresIn   int64  `json:"expires_in"`
+			}
+			if err = json.Unmarshal(reply, &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.ExpiresIn != int64(defaultLocalTokenLifetime/time.Second) {
+				t.Errorf("unexpected lifetime %d", response.ExpiresIn)
+			}
+			token, err := jwt.ParseSigned(response.AccessToken)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token.Headers[0].KeyID != config.KeyID {
+				t.Errorf("unexpected key ID %s", token.Headers[0].KeyID)
+			}
+			var claims jwt.Claims
+			custom := struct {
+				Scope     string `json:"scope"`
+				ThingType string `json:"thing_type"`
+			}{}
+			if err = token.Claims(config.Key.Public(), &claims, &custom); err != nil {
+				t.Fatal(err)
+			}
+			if err = claims.Validate(jwt.Expected{Issuer: config.Issuer, Subject: thingID,
+				Audience: jwt.Audience{"broker"}, Time: time.Now()}); err != nil {
+				t.Error(err)
+			}
+			if custom.ThingType != string(callback.TypeDevice) {
+				t.Errorf("expected the thing type to be mapped; got `%s`", custom.ThingType)
+			}
+			if len(subtest.request.Scope) > 0 && custom.Scope != subtest.request.Scope[0] {
+				t.Errorf("unexpected scope `%s`", custom.Scope)
+			}
+		})
+	}
+}
+
+func TestLocalIssuer_Forget(t *testing.T) {
+	var events []AuditEvent
+	config := testLocalIssuerConfig(&events)
+	issuer, err := newLocalIssuer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	thingKey := testThingKey()
+	issuer.track("session-1", testRegistration(t, "/realm", thingKey, nil).Callbacks, time.Hour)
+	issuer.forget("session-1")
+	signed := testLocalTokenRequest(t, thingKey, "session-1", client.LocalTokenPayload{}, true)
+	if _, err = issuer.issue("session-1", signed); err == nil {
+		t.Error("expected the token to be denied for a forgotten session")
+	}
+}
+
+func TestLocalIssuer_ConfirmationKey(t *testing.T) {
+	var events []AuditEvent
+	issuer, err := newLocalIssuer(testLocalIssuerConfig(&events))
+	if err != nil {
+		t.Fatal(err)
+	}
+	thingKey, otherKey := testThingKey(), testThingKey()
+	// the authentication JWT only confirms the key ID so the request must contain the key
+	issuer.track("session-1", testAuthentication(t, thingKey).Callbacks, time.Hour)
+	steps := []struct {
+		name    string
+		key     crypto.Signer
+		confirm bool
+		denied  bool
+	}{
+		{name: "unconfirmed", key: thingKey, denied: true},
+		{name: "other-key", key: otherKey, confirm: true, denied: true},
+		{name: "thing-key", key: thingKey, confirm: true},
+		// the key is pinned for the session once it has been verified
+		{name: "pinned", key: thingKey},
+		{name: "pinned-other-key", key: otherKey, confirm: true, denied: true},
+	}
+	for _, step := range steps {
+		signed := testLocalTokenRequest(t, step.key, "session-1", client.LocalTokenPayload{}, step.confirm)
+		if _, err := issuer.issue("session-1", signed); (err != nil) != step.denied {
+			t.Errorf("%s: expected denied %v; got %v", step.name, step.denied, err)
+		}
+	}
+}
+
+func TestLocalIssuer_RequestLifetime(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		request client.LocalTokenPayload
+	}{
+		{name: "no-lifetime", request: client.LocalTokenPayload{ID: "request-1"}},
+		{name: "no-id", request: client.LocalTokenPayload{IssuedAt: now.Unix(),
+			Expiry: now.Add(time.Minute).Unix()}},
+		{name: "future", request: client.LocalTokenPayload{IssuedAt: now.Add(2 * time.Minute).Unix(),
+			Expiry: now.Add(3 * time.Minute).Unix(), ID: "request-1"}},
+		{name: "expired", request: client.LocalTokenPayload{IssuedAt: now.Add(-3 * time.Minute).Unix(),
+			Expiry: now.Add(-2 * time.Minute).Unix(), ID: "request-1"}},
+		{name: "too-long", request: client.LocalTokenPayload{IssuedAt: now.Unix(),
+			Expiry: now.Add(time.Hour).Unix(), ID: "request-1"}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			var events []AuditEvent
+			issuer, err := newLocalIssuer(testLocalIssuerConfig(&events))
+			if err != nil {
+				t.Fatal(err)
+			}
+			thingKey := testThingKey()
+			issuer.track("session-1", testRegistration(t, "/realm", thingKey, nil).Callbacks, time.Hour)
+			signed := testLocalTokenRequest(t, thingKey, "session-1", subtest.request, true)
+			if _, err = issuer.issue("session-1", signed); !errors.Is(err, errLocalToken) {
+				t.Errorf("expected %v; got %v", errLocalToken, err)
+			}
+		})
+	}
+}
+
+func TestLocalIssuer_Replay(t *testing.T) {
+	var events []AuditEvent
+	issuer, err := newLocalIssuer(testLocalIssuerConfig(&events))
+	if err != nil {
+		t.Fatal(err)
+	}
+	thingKey := testThingKey()
+	issuer.track("session-1", testRegistration(t, "/realm", thingKey, nil).Callbacks, time.Hour)
+	signed := testLocalTokenRequest(t, thingKey, "session-1", client.LocalTokenPayload{}, true)
+	if _, err = issuer.issue("session-1", signed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = issuer.issue("session-1", signed); !errors.Is(err, errLocalToken) {
+		t.Errorf("expected the replayed request to be denied; got %v", err)
+	}
+	signed = testLocalTokenRequest(t, thingKey, "session-1", client.LocalTokenPayload{}, true)
+	if _, err = issuer.issue("session-1", signed); err != nil {
+		t.Errorf("expected a new request to be accepted; got %v", err)
+	}
+}
+
+func TestLocalIssuer_Track_Order(t *testing.T) {
+	var events []AuditEvent
+	issuer, err := newLocalIssuer(testLocalIssuerConfig(&events))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the thing authenticates and registers in the same flow, the authentication JWT is recorded
+	callbacks := append(testRegistration(t, "/realm", testThingKey(), nil).Callbacks,
+		testAuthentication(t, testThingKey()).Callbacks...)
+	for i := 0; i < 10; i++ {
+		issuer.track("session-1", callbacks, time.Hour)
+		item, ok := issuer.identities.Get("session-1")
+		if !ok {
+			t.Fatal("expected the identity to be tracked")
+		}
+		if identity := item.(*localIdentity); identity.proof != callbacks[1].Input[0].Value {
+			t.Fatal("expected the authentication JWT to be recorded")
+		}
+	}
+}
+
+func TestThingGateway_TrackIdentity_Lifetime(t *testing.T) {
+	expiry := time.Now().Add(10 * time.Minute)
+	gateway := testGateway(&mockClient{sessionInfoFunc: testSessionInfo(expiry, time.Time{})})
+	gateway.lifetimes = newSessionLifetimes()
+	var events []AuditEvent
+	if err := gateway.EnableLocalIssuer(testLocalIssuerConfig(&events)); err != nil {
+		t.Fatal(err)
+	}
+	gateway.trackIdentity(gateway.amConnection, testRegistration(t, "/realm", testThingKey(), nil),
+		client.AuthenticatePayload{SessionToken: client.SessionToken{TokenID: "session-1"}})
+	_, expiration, ok := gateway.issuer.identities.GetWithExpiration("session-1")
+	if !ok {
+		t.Fatal("expected the identity to be tracked")
+	}
+	if expiration.After(expiry) {
+		t.Errorf("expected the identity to expire with the session at %v; got %v", expiry, expiration)
+	}
+}
+
+func TestGatewayServer_LocalToken(t *testing.T) {
+	gateway := testGateway(&mockClient{
+		AuthenticateFunc: func(payload client.AuthenticatePayload) (reply client.AuthenticatePayload, err error) {
+			reply.TokenID = "session-1"
+			return reply, nil
+		}})
+	var events []AuditEvent
+	config := testLocalIssuerConfig(&events)
+	if err := gateway.EnableLocalIssuer(config); err != nil {
+		t.Fatal(err)
+	}
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err := gateway.StartCOAPServer(":0", serverKey); err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.ShutdownCOAPServer()
+
+	connection := gatewayConnection(t, gateway)
+	thingKey := testThingKey()
+	_, err := connection.Authenticate(testRegistration(t, "/realm", thingKey, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a session token alone does not prove the identity of the thing
+	request, _ := json.Marshal(client.LocalTokenPayload{Audience: "broker"})
+	if _, err = client.LocalAccessToken(connection, "session-1", client.ApplicationJSON, string(request)); err == nil {
+		t.Error("expected an unsigned request to be denied")
+	}
+	signed := testLocalTokenRequest(t, thingKey, "session-1", client.LocalTokenPayload{Audience: "broker"}, true)
+	reply, err := client.LocalAccessToken(connection, "session-1", client.ApplicationJOSE, signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response map[string]interface{}
+	if err = json.Unmarshal(reply, &response); err != nil || response["access_token"] == nil {
+		t.Errorf("expected an access token; got %s", reply)
+	}
+
+	signed = testLocalTokenRequest(t, thingKey, "session-1", client.LocalTokenPayload{Audience: "historian"}, true)
+	if _, err = client.LocalAccessToken(connection, "session-1", client.ApplicationJOSE, signed); err == nil {
+		t.Error("expected the token to be denied")
+	}
+}
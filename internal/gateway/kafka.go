@@ -0,0 +1,676 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Kafka publishing
+// The gateway produces events directly to a partition of a Kafka topic so that edge data lands in the streaming
+// platform without a bridge. Every event is a record with the ID of the thing as its key, so that the events of a
+// thing are kept in order by partitioners downstream, and with the thing ID and the source gateway as record headers.
+// The publisher speaks the subset of the Kafka protocol needed to produce: SASL authentication (PLAIN or SCRAM),
+// version 1 of the metadata request, with which the leader of the partition is looked up from any broker of the
+// cluster, and version 3 of the produce request with a single record batch. A produce request that fails with a
+// retriable error, for example because the leadership of the partition has moved, is repeated with the leader read
+// from fresh metadata. Events are acknowledged by all in-sync replicas unless the publisher is configured otherwise.
+
+// Kafka API keys and versions used by the publisher
+const (
+	kafkaProduce          = 0
+	kafkaMetadata         = 3
+	kafkaSASLHandshake    = 17
+	kafkaSASLAuthenticate = 36
+
+	kafkaProduceVersion   = 3
+	kafkaMetadataVersion  = 1
+	kafkaHandshakeVersion = 1
+)
+
+// Kafka error codes that the publisher handles
+const (
+	kafkaUnknownTopicOrPartition      = 3
+	kafkaLeaderNotAvailable           = 5
+	kafkaNotLeaderForPartition        = 6
+	kafkaRequestTimedOut              = 7
+	kafkaNetworkException             = 13
+	kafkaNotEnoughReplicas            = 19
+	kafkaNotEnoughReplicasAfterAppend = 20
+	kafkaStorageError                 = 56
+)
+
+// Attempts to produce an event and the delay before the first retry, which grows with every attempt
+const (
+	kafkaMaxAttempts  = 3
+	kafkaRetryBackoff = 100 * time.Millisecond
+)
+
+// SASL mechanisms supported by the Kafka publisher
+const (
+	SASLPlain       = "PLAIN"
+	SASLSCRAMSHA256 = "SCRAM-SHA-256"
+	SASLSCRAMSHA512 = "SCRAM-SHA-512"
+)
+
+// kafkaMaxResponse is the largest response that is read from the broker
+const kafkaMaxResponse = 1 << 20
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// KafkaPublisher produces events as JSON records to a partition of a Kafka topic. The connection to the broker is
+// opened when the first event is published and reopened after a failure.
+type KafkaPublisher struct {
+	// Address of a broker of the cluster in the form host:port, from which the leader of the partition is looked up
+	Address   string
+	Topic     string
+	Partition int32
+	// ClientID identifies the gateway in the logs and quotas of the broker
+	ClientID string
+	// Username and Password authenticate the gateway with SASL, the gateway does not authenticate if Username is empty
+	Username string
+	Password string
+	// Mechanism is the SASL mechanism, one of PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512, defaults to PLAIN
+	Mechanism string
+	// TLS configures a secure connection to the broker, the connection is not secured if nil
+	TLS *tls.Config
+	// LeaderOnly accepts the acknowledgement of an event by the leader of the partition alone instead of waiting for
+	// all in-sync replicas, which is faster but loses the event if the leader fails before it is replicated
+	LeaderOnly bool
+	// Timeout of the connection and of every request, defaults to 5 seconds
+	Timeout time.Duration
+
+	mutex       sync.Mutex
+	conn        net.Conn
+	correlation int32
+}
+
+// kafkaError is an error code returned by the broker
+type kafkaError int16
+
+func (e kafkaError) Error() string {
+	return "Kafka error code " + strconv.Itoa(int(e))
+}
+
+// retriable returns true if a request that failed with the error may succeed when repeated
+func (e kafkaError) retriable() bool {
+	switch e {
+	case kafkaUnknownTopicOrPartition, kafkaLeaderNotAvailable, kafkaNotLeaderForPartition, kafkaRequestTimedOut,
+		kafkaNetworkException, kafkaNotEnoughReplicas, kafkaNotEnoughReplicasAfterAppend, kafkaStorageError:
+		return true
+	}
+	return false
+}
+
+// kafkaWriter encodes the primitive types of the Kafka protocol
+type kafkaWriter []byte
+
+func (w *kafkaWriter) int8(v int8) {
+	*w = append(*w, byte(v))
+}
+
+func (w *kafkaWriter) int16(v int16) {
+	*w = append(*w, byte(v>>8), byte(v))
+}
+
+func (w *kafkaWriter) int32(v int32) {
+	*w = append(*w, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32((*w)[len(*w)-4:], uint32(v))
+}
+
+func (w *kafkaWriter) int64(v int64) {
+	*w = append(*w, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64((*w)[len(*w)-8:], uint64(v))
+}
+
+// varint writes a zigzag encoded variable length integer, as used in records
+func (w *kafkaWriter) varint(v int64) {
+	b := make([]byte, binary.MaxVarintLen64)
+	*w = append(*w, b[:binary.PutVarint(b, v)]...)
+}
+
+func (w *kafkaWriter) string(s string) {
+	w.int16(int16(len(s)))
+	*w = append(*w, s...)
+}
+
+func (w *kafkaWriter) bytes(b []byte) {
+	w.int32(int32(len(b)))
+	*w = append(*w, b...)
+}
+
+// varbytes writes bytes with a variable length, a nil slice is written as null
+func (w *kafkaWriter) varbytes(b []byte) {
+	if b == nil {
+		w.varint(-1)
+		return
+	}
+	w.varint(int64(len(b)))
+	*w = append(*w, b...)
+}
+
+// kafkaReader decodes the primitive types of the Kafka protocol, the first error is kept and reported by err
+type kafkaReader struct {
+	b   []byte
+	err error
+}
+
+func (r *kafkaReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.b) {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *kafkaReader) int8() int8 {
+	if b := r.next(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (r *kafkaReader) int16() int16 {
+	if b := r.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) int32() int32 {
+	if b := r.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) int64() int64 {
+	if b := r.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// string reads a nullable string, null is read as an empty string
+func (r *kafkaReader) string() string {
+	n := r.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(r.next(int(n)))
+}
+
+// bytes reads nullable bytes, null is read as an empty slice
+func (r *kafkaReader) bytes() []byte {
+	n := r.int32()
+	if n < 0 {
+		return nil
+	}
+	return r.next(int(n))
+}
+
+// kafkaRecordBatch encodes the value as a batch of one record with the key and headers
+func kafkaRecordBatch(key, value []byte, headers [][2]string, timestamp time.Time) []byte {
+	var record kafkaWriter
+	record.int8(0) // attributes
+	record.varint(0)
+	record.varint(0)
+	record.varbytes(key)
+	record.varbytes(value)
+	record.varint(int64(len(headers)))
+	for _, h := range headers {
+		record.varbytes([]byte(h[0]))
+		record.varbytes([]byte(h[1]))
+	}
+
+	// the part of the batch that is covered by the checksum
+	var body kafkaWriter
+	millis := timestamp.UnixNano() / int64(time.Millisecond)
+	body.int16(0) // attributes, no compression
+	body.int32(0) // last offset delta
+	body.int64(millis)
+	body.int64(millis)
+	body.int64(-1) // no producer ID, epoch or sequence
+	body.int16(-1)
+	body.int32(-1)
+	body.int32(1)
+	body.varint(int64(len(record)))
+	body = append(body, record...)
+
+	var batch kafkaWriter
+	batch.int64(0) // base offset
+	batch.int32(int32(4 + 1 + 4 + len(body)))
+	batch.int32(-1) // partition leader epoch
+	batch.int8(2)   // magic
+	batch.int32(int32(crc32.Checksum(body, crc32c)))
+	return append(batch, body...)
+}
+
+func (p *KafkaPublisher) timeout() time.Duration {
+	if p.Timeout == 0 {
+		return 5 * time.Second
+	}
+	return p.Timeout
+}
+
+// roundTrip sends a request to the broker and returns the body of the response
+func (p *KafkaPublisher) roundTrip(conn net.Conn, apiKey, version int16, body []byte) (*kafkaReader, error) {
+	p.correlation++
+	var request kafkaWriter
+	request.int32(0)
+	request.int16(apiKey)
+	request.int16(version)
+	request.int32(p.correlation)
+	request.string(p.ClientID)
+	request = append(request, body...)
+	binary.BigEndian.PutUint32(request, uint32(len(request)-4))
+	_ = conn.SetDeadline(time.Now().Add(p.timeout()))
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	size := int32(binary.BigEndian.Uint32(header)) - 4
+	if size < 0 || size > kafkaMaxResponse {
+		return nil, fmt.Errorf("invalid Kafka response size %d", size)
+	}
+	if correlation := int32(binary.BigEndian.Uint32(header[4:])); correlation != p.correlation {
+		return nil, fmt.Errorf("expected Kafka correlation ID %d; got %d", p.correlation, correlation)
+	}
+	response := make([]byte, size)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+	return &kafkaReader{b: response}, nil
+}
+
+// authenticate the gateway with the SASL mechanism of the publisher
+func (p *KafkaPublisher) authenticate(conn net.Conn) error {
+	mechanism := p.Mechanism
+	if mechanism == "" {
+		mechanism = SASLPlain
+	}
+	var scram *scramClient
+	var first []byte
+	switch mechanism {
+	case SASLPlain:
+		first = []byte("\x00" + p.Username + "\x00" + p.Password)
+	case SASLSCRAMSHA256:
+		scram = newSCRAMClient(sha256.New, p.Username, p.Password)
+		first = scram.first()
+	case SASLSCRAMSHA512:
+		scram = newSCRAMClient(sha512.New, p.Username, p.Password)
+		first = scram.first()
+	default:
+		return fmt.Errorf("unsupported SASL mechanism %s", mechanism)
+	}
+
+	var handshake kafkaWriter
+	handshake.string(mechanism)
+	r, err := p.roundTrip(conn, kafkaSASLHandshake, kafkaHandshakeVersion, handshake)
+	if err != nil {
+		return err
+	}
+	if code := r.int16(); code != 0 {
+		return fmt.Errorf("Kafka broker %s does not support SASL mechanism %s; %w", conn.RemoteAddr(), mechanism,
+			kafkaError(code))
+	}
+	challenge, err := p.saslAuthenticate(conn, first)
+	if err != nil || scram == nil {
+		return err
+	}
+	final, err := scram.final(challenge)
+	if err != nil {
+		return err
+	}
+	if challenge, err = p.saslAuthenticate(conn, final); err != nil {
+		return err
+	}
+	return scram.verify(challenge)
+}
+
+// saslAuthenticate sends the SASL message and returns the message of the broker
+func (p *KafkaPublisher) saslAuthenticate(conn net.Conn, message []byte) ([]byte, error) {
+	var body kafkaWriter
+	body.bytes(message)
+	r, err := p.roundTrip(conn, kafkaSASLAuthenticate, 0, body)
+	if err != nil {
+		return nil, err
+	}
+	code := r.int16()
+	detail := r.string()
+	reply := r.bytes()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if code != 0 {
+		return nil, fmt.Errorf("Kafka broker %s failed to authenticate the gateway: %s; %w", conn.RemoteAddr(), detail,
+			kafkaError(code))
+	}
+	return reply, nil
+}
+
+// connect to the broker at the address and authenticate if the publisher has a username
+func (p *KafkaPublisher) connect(address string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: p.timeout()}
+	var conn net.Conn
+	var err error
+	if p.TLS != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, p.TLS)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p.Username != "" {
+		if err = p.authenticate(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// leader returns the address of the broker that leads the partition, read from the metadata of the topic
+func (p *KafkaPublisher) leader(conn net.Conn) (string, error) {
+	var body kafkaWriter
+	body.int32(1)
+	body.string(p.Topic)
+	r, err := p.roundTrip(conn, kafkaMetadata, kafkaMetadataVersion, body)
+	if err != nil {
+		return "", err
+	}
+	brokers := make(map[int32]string)
+	for n := r.int32(); n > 0 && r.err == nil; n-- {
+		id := r.int32()
+		host := r.string()
+		port := r.int32()
+		r.string() // rack
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	r.int32() // controller
+	leader := int32(-1)
+	code := int16(kafkaUnknownTopicOrPartition)
+	for topics := r.int32(); topics > 0 && r.err == nil; topics-- {
+		topicCode := r.int16()
+		topic := r.string()
+		r.int8() // internal
+		for partitions := r.int32(); partitions > 0 && r.err == nil; partitions-- {
+			partitionCode := r.int16()
+			partition := r.int32()
+			partitionLeader := r.int32()
+			for replicas := r.int32(); replicas > 0 && r.err == nil; replicas-- {
+				r.int32()
+			}
+			for isr := r.int32(); isr > 0 && r.err == nil; isr-- {
+				r.int32()
+			}
+			if topic == p.Topic && partition == p.Partition {
+				code, leader = partitionCode, partitionLeader
+			}
+		}
+		if topic == p.Topic && topicCode != 0 {
+			code = topicCode
+		}
+	}
+	if r.err != nil {
+		return "", r.err
+	}
+	// the error of a partition that has a leader, such as an unavailable replica, does not prevent producing
+	if leader < 0 {
+		if code == 0 {
+			code = kafkaLeaderNotAvailable
+		}
+		return "", fmt.Errorf("no leader of %s/%d is known to Kafka broker %s; %w", p.Topic, p.Partition,
+			conn.RemoteAddr(), kafkaError(code))
+	}
+	address, ok := brokers[leader]
+	if !ok {
+		return "", fmt.Errorf("the leader of %s/%d is not a broker known to %s; %w", p.Topic, p.Partition,
+			conn.RemoteAddr(), kafkaError(kafkaLeaderNotAvailable))
+	}
+	return address, nil
+}
+
+// connectLeader looks up the leader of the partition with the broker at the address of the publisher and connects to
+// the leader, keeping the connection to the broker if it leads the partition
+func (p *KafkaPublisher) connectLeader() (net.Conn, error) {
+	conn, err := p.connect(p.Address)
+	if err != nil {
+		return nil, err
+	}
+	leader, err := p.leader(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if leader == p.Address {
+		return conn, nil
+	}
+	conn.Close()
+	return p.connect(leader)
+}
+
+// produce the batch to the partition and wait for it to be acknowledged
+func (p *KafkaPublisher) produce(conn net.Conn, batch []byte) error {
+	acks := int16(-1)
+	if p.LeaderOnly {
+		acks = 1
+	}
+	var body kafkaWriter
+	body.int16(-1) // no transactional ID
+	body.int16(acks)
+	body.int32(int32(p.timeout() / time.Millisecond))
+	body.int32(1)
+	body.string(p.Topic)
+	body.int32(1)
+	body.int32(p.Partition)
+	body.bytes(batch)
+	r, err := p.roundTrip(conn, kafkaProduce, kafkaProduceVersion, body)
+	if err != nil {
+		return err
+	}
+	code := int16(0)
+	for topics := r.int32(); topics > 0 && r.err == nil; topics-- {
+		r.string()
+		for partitions := r.int32(); partitions > 0 && r.err == nil; partitions-- {
+			r.int32()
+			if c := r.int16(); c != 0 {
+				code = c
+			}
+			r.int64()
+			r.int64()
+		}
+	}
+	if r.err != nil {
+		return r.err
+	}
+	if code != 0 {
+		return fmt.Errorf("Kafka broker %s rejected the event for %s/%d; %w", conn.RemoteAddr(), p.Topic,
+			p.Partition, kafkaError(code))
+	}
+	return nil
+}
+
+// Publish the event to the partition, keyed by the ID of the thing
+func (p *KafkaPublisher) Publish(event Event) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	var key []byte
+	var headers [][2]string
+	if event.ThingID != "" {
+		key = []byte(event.ThingID)
+		headers = append(headers, [2]string{"thing-id", event.ThingID})
+	}
+	if event.Source != "" {
+		headers = append(headers, [2]string{"source", event.Source})
+	}
+	batch := kafkaRecordBatch(key, b, headers, event.Time)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	// a failed attempt is repeated with a new connection to the leader, read from fresh metadata, unless the broker
+	// returned an error that will not go away
+	for attempt := 1; ; attempt++ {
+		if p.conn == nil {
+			p.conn, err = p.connectLeader()
+		}
+		if err == nil {
+			if err = p.produce(p.conn, batch); err == nil {
+				return nil
+			}
+		}
+		var code kafkaError
+		if errors.As(err, &code) && !code.retriable() {
+			return err
+		}
+		if p.conn != nil {
+			p.close()
+		}
+		if attempt >= kafkaMaxAttempts {
+			return err
+		}
+		time.Sleep(kafkaRetryBackoff * time.Duration(attempt))
+	}
+}
+
+// Close disconnects from the broker
+func (p *KafkaPublisher) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.conn == nil {
+		return nil
+	}
+	p.close()
+	return nil
+}
+
+func (p *KafkaPublisher) close() {
+	p.conn.Close()
+	p.conn = nil
+}
+
+// scramClient authenticates with the SCRAM SASL mechanism of RFC 5802
+type scramClient struct {
+	hash     func() hash.Hash
+	username string
+	password string
+	nonce    string
+	bare     string
+	auth     string
+	salted   []byte
+}
+
+func newSCRAMClient(h func() hash.Hash, username, password string) *scramClient {
+	nonce := make([]byte, 18)
+	_, _ = rand.Read(nonce)
+	return &scramClient{
+		hash:     h,
+		username: strings.NewReplacer("=", "=3D", ",", "=2C").Replace(username),
+		password: password,
+		nonce:    base64.RawStdEncoding.EncodeToString(nonce),
+	}
+}
+
+func (s *scramClient) hmac(key []byte, message string) []byte {
+	mac := hmac.New(s.hash, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+// first returns the client-first-message without a channel binding
+func (s *scramClient) first() []byte {
+	s.bare = "n=" + s.username + ",r=" + s.nonce
+	return []byte("n,," + s.bare)
+}
+
+// final returns the client-final-message with the proof for the server-first-message
+func (s *scramClient) final(challenge []byte) ([]byte, error) {
+	attributes := make(map[string]string)
+	for _, a := range strings.Split(string(challenge), ",") {
+		if len(a) > 2 && a[1] == '=' {
+			attributes[a[:1]] = a[2:]
+		}
+	}
+	nonce := attributes["r"]
+	salt, err := base64.StdEncoding.DecodeString(attributes["s"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid SCRAM salt; %w", err)
+	}
+	iterations, err := strconv.Atoi(attributes["i"])
+	if err != nil || iterations < 1 {
+		return nil, fmt.Errorf("invalid SCRAM iteration count %q", attributes["i"])
+	}
+	if !strings.HasPrefix(nonce, s.nonce) {
+		return nil, errors.New("SCRAM server nonce does not extend the client nonce")
+	}
+	withoutProof := "c=biws,r=" + nonce
+	s.auth = s.bare + "," + string(challenge) + "," + withoutProof
+	s.salted = pbkdf2.Key([]byte(s.password), salt, iterations, s.hash().Size(), s.hash)
+	clientKey := s.hmac(s.salted, "Client Key")
+	stored := s.hash()
+	stored.Write(clientKey)
+	signature := s.hmac(stored.Sum(nil), s.auth)
+	for i := range clientKey {
+		clientKey[i] ^= signature[i]
+	}
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(clientKey)), nil
+}
+
+// verify the signature of the server in the server-final-message
+func (s *scramClient) verify(challenge []byte) error {
+	message := string(challenge)
+	if strings.HasPrefix(message, "e=") {
+		return fmt.Errorf("SCRAM authentication failed: %s", message[2:])
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(message, "v="))
+	if err != nil || !strings.HasPrefix(message, "v=") {
+		return errors.New("invalid SCRAM server-final-message")
+	}
+	if !hmac.Equal(signature, s.hmac(s.hmac(s.salted, "Server Key"), s.auth)) {
+		return errors.New("SCRAM server signature is invalid")
+	}
+	return nil
+}
@@ -0,0 +1,388 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// kafkaRecord is a record decoded from a record batch
+type kafkaRecord struct {
+	key     string
+	value   []byte
+	headers map[string]string
+}
+
+// decodeKafkaBatch checks the checksum of a record batch and decodes its single record
+func decodeKafkaBatch(t *testing.T, batch []byte) kafkaRecord {
+	if len(batch) < 61 || batch[16] != 2 {
+		t.Fatalf("invalid record batch %x", batch)
+	}
+	if crc := binary.BigEndian.Uint32(batch[17:]); crc != crc32.Checksum(batch[21:], crc32c) {
+		t.Fatal("invalid record batch checksum")
+	}
+	b := batch[61:]
+	varint := func() int64 {
+		v, n := binary.Varint(b)
+		b = b[n:]
+		return v
+	}
+	varbytes := func() []byte {
+		n := varint()
+		if n < 0 {
+			return nil
+		}
+		v := b[:n]
+		b = b[n:]
+		return v
+	}
+	varint() // length
+	b = b[1:]
+	varint()
+	varint()
+	record := kafkaRecord{key: string(varbytes()), value: varbytes(), headers: make(map[string]string)}
+	for headers := varint(); headers > 0; headers-- {
+		record.headers[string(varbytes())] = string(varbytes())
+	}
+	return record
+}
+
+// kafkaProduced is a batch produced to the fake broker with the acknowledgement that was requested
+type kafkaProduced struct {
+	acks  int16
+	batch []byte
+}
+
+// fakeKafkaBroker answers SASL PLAIN, metadata and produce requests on any number of connections
+type fakeKafkaBroker struct {
+	listener net.Listener
+	password string
+	// leader is the address of the leader of the partition in metadata responses, the broker itself if empty
+	leader string
+	// codes are returned in turn to produce requests, after which produce requests succeed
+	codes    []int16
+	produced chan kafkaProduced
+	mutex    sync.Mutex
+}
+
+func newKafkaBroker(t *testing.T, password string, codes ...int16) *fakeKafkaBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := &fakeKafkaBroker{listener: listener, password: password, codes: codes,
+		produced: make(chan kafkaProduced, 10)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go broker.serve(conn)
+		}
+	}()
+	return broker
+}
+
+func (b *fakeKafkaBroker) address() string {
+	return b.listener.Addr().String()
+}
+
+// metadata writes the metadata of the topic with the leader as broker 1
+func (b *fakeKafkaBroker) metadata(response *kafkaWriter, topic string) {
+	leader := b.leader
+	if leader == "" {
+		leader = b.address()
+	}
+	host, port, _ := net.SplitHostPort(leader)
+	portNumber, _ := strconv.Atoi(port)
+	response.int32(1)
+	response.int32(1)
+	response.string(host)
+	response.int32(int32(portNumber))
+	response.int16(-1)
+	response.int32(1)
+	response.int32(1)
+	response.int16(0)
+	response.string(topic)
+	response.int8(0)
+	response.int32(1)
+	response.int16(0)
+	response.int32(0)
+	response.int32(1)
+	response.int32(1)
+	response.int32(1)
+	response.int32(1)
+	response.int32(1)
+}
+
+// code returns the error code of the next produce request
+func (b *fakeKafkaBroker) code() int16 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if len(b.codes) == 0 {
+		return 0
+	}
+	code := b.codes[0]
+	b.codes = b.codes[1:]
+	return code
+}
+
+func (b *fakeKafkaBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		size := make([]byte, 4)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return
+		}
+		request := make([]byte, binary.BigEndian.Uint32(size))
+		if _, err := io.ReadFull(conn, request); err != nil {
+			return
+		}
+		r := &kafkaReader{b: request}
+		apiKey := r.int16()
+		r.int16()
+		correlation := r.int32()
+		r.string()
+		var response kafkaWriter
+		response.int32(0)
+		response.int32(correlation)
+		switch apiKey {
+		case kafkaSASLHandshake:
+			response.int16(0)
+			response.int32(1)
+			response.string(SASLPlain)
+		case kafkaSASLAuthenticate:
+			if string(r.bytes()) != "\x00gateway\x00"+b.password {
+				response.int16(58)
+				response.string("invalid credentials")
+			} else {
+				response.int16(0)
+				response.int16(-1)
+			}
+			response.bytes(nil)
+		case kafkaMetadata:
+			r.int32()
+			b.metadata(&response, r.string())
+		case kafkaProduce:
+			r.string()
+			acks := r.int16()
+			r.int32()
+			r.int32()
+			topic := r.string()
+			r.int32()
+			partition := r.int32()
+			b.produced <- kafkaProduced{acks: acks, batch: r.bytes()}
+			response.int32(1)
+			response.string(topic)
+			response.int32(1)
+			response.int32(partition)
+			response.int16(b.code())
+			response.int64(0)
+			response.int64(-1)
+			response.int32(0)
+		}
+		binary.BigEndian.PutUint32(response, uint32(len(response)-4))
+		if _, err := conn.Write(response); err != nil {
+			return
+		}
+	}
+}
+
+// next returns the next batch produced to the broker
+func (b *fakeKafkaBroker) next(t *testing.T) kafkaProduced {
+	select {
+	case produced := <-b.produced:
+		return produced
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the record")
+	}
+	return kafkaProduced{}
+}
+
+func testKafkaPublisher(address string) *KafkaPublisher {
+	return &KafkaPublisher{
+		Address:  address,
+		Topic:    "edge-events",
+		ClientID: "gateway-1",
+		Username: "gateway",
+		Password: "secret",
+	}
+}
+
+func testKafkaEvent() Event {
+	return Event{Type: EventThingAuthenticated, Source: "gateway-1", ThingID: "thing-1", Time: time.Now()}
+}
+
+func TestKafkaPublisher(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		code     int16
+		produced bool
+	}{
+		{name: "produced", password: "secret", produced: true},
+		{name: "rejected", password: "secret", code: 2, produced: true},
+		{name: "unauthenticated", password: "wrong"},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			broker := newKafkaBroker(t, subtest.password, subtest.code)
+			defer broker.listener.Close()
+			publisher := testKafkaPublisher(broker.address())
+			defer publisher.Close()
+			err := publisher.Publish(testKafkaEvent())
+			var code kafkaError
+			if subtest.code == 0 && subtest.produced && err != nil {
+				t.Fatal(err)
+			} else if subtest.code != 0 && (!errors.As(err, &code) || int16(code) != subtest.code) {
+				t.Errorf("expected error code %d; got %v", subtest.code, err)
+			} else if !subtest.produced && err == nil {
+				t.Error("expected an authentication error")
+			}
+			if !subtest.produced {
+				return
+			}
+			produced := broker.next(t)
+			if produced.acks != -1 {
+				t.Errorf("expected the event to be acknowledged by all replicas; got acks %d", produced.acks)
+			}
+			record := decodeKafkaBatch(t, produced.batch)
+			var event Event
+			if err = json.Unmarshal(record.value, &event); err != nil {
+				t.Fatal(err)
+			}
+			if record.key != "thing-1" || record.headers["thing-id"] != "thing-1" ||
+				record.headers["source"] != "gateway-1" || event.Type != EventThingAuthenticated {
+				t.Errorf("unexpected record %v %v", record, event)
+			}
+		})
+	}
+}
+
+func TestKafkaPublisher_LeaderOnly(t *testing.T) {
+	broker := newKafkaBroker(t, "secret")
+	defer broker.listener.Close()
+	publisher := testKafkaPublisher(broker.address())
+	publisher.LeaderOnly = true
+	defer publisher.Close()
+	if err := publisher.Publish(testKafkaEvent()); err != nil {
+		t.Fatal(err)
+	}
+	if produced := broker.next(t); produced.acks != 1 {
+		t.Errorf("expected the event to be acknowledged by the leader; got acks %d", produced.acks)
+	}
+}
+
+// the publisher produces to the leader of the partition that it looks up from the bootstrap broker
+func TestKafkaPublisher_Leader(t *testing.T) {
+	leader := newKafkaBroker(t, "secret")
+	defer leader.listener.Close()
+	bootstrap := newKafkaBroker(t, "secret")
+	defer bootstrap.listener.Close()
+	bootstrap.leader = leader.address()
+
+	publisher := testKafkaPublisher(bootstrap.address())
+	defer publisher.Close()
+	if err := publisher.Publish(testKafkaEvent()); err != nil {
+		t.Fatal(err)
+	}
+	leader.next(t)
+	select {
+	case <-bootstrap.produced:
+		t.Error("expected the event to be produced to the leader only")
+	default:
+	}
+}
+
+func TestKafkaPublisher_Retry(t *testing.T) {
+	tests := []struct {
+		name     string
+		codes    []int16
+		attempts int
+		fail     bool
+	}{
+		{name: "leader-moved", codes: []int16{kafkaNotLeaderForPartition}, attempts: 2},
+		{name: "not-enough-replicas", codes: []int16{kafkaNotEnoughReplicas, kafkaNotEnoughReplicas}, attempts: 3},
+		{name: "exhausted", codes: []int16{kafkaNotLeaderForPartition, kafkaNotLeaderForPartition,
+			kafkaNotLeaderForPartition}, attempts: kafkaMaxAttempts, fail: true},
+		{name: "not-retriable", codes: []int16{2}, attempts: 1, fail: true},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			broker := newKafkaBroker(t, "secret", subtest.codes...)
+			defer broker.listener.Close()
+			publisher := testKafkaPublisher(broker.address())
+			defer publisher.Close()
+			if err := publisher.Publish(testKafkaEvent()); (err != nil) != subtest.fail {
+				t.Errorf("expected failure %v; got %v", subtest.fail, err)
+			}
+			for i := 0; i < subtest.attempts; i++ {
+				broker.next(t)
+			}
+			select {
+			case <-broker.produced:
+				t.Errorf("expected %d attempts", subtest.attempts)
+			default:
+			}
+		})
+	}
+}
+
+func TestKafkaRecordBatch_NoThing(t *testing.T) {
+	record := decodeKafkaBatch(t, kafkaRecordBatch(nil, []byte("{}"), nil, time.Now()))
+	if record.key != "" || string(record.value) != "{}" || len(record.headers) != 0 {
+		t.Errorf("unexpected record %v", record)
+	}
+}
+
+// TestSCRAMClient uses the example exchange of RFC 7677
+func TestSCRAMClient(t *testing.T) {
+	scram := newSCRAMClient(sha256.New, "user", "pencil")
+	scram.nonce = "rOprNGfwEbeRWgbNEkqO"
+	if first := string(scram.first()); first != "n,,n=user,r=rOprNGfwEbeRWgbNEkqO" {
+		t.Errorf("unexpected client-first-message %s", first)
+	}
+	final, err := scram.final([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0," +
+		"s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(final) != "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,"+
+		"p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=" {
+		t.Errorf("unexpected client-final-message %s", final)
+	}
+	if err = scram.verify([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")); err != nil {
+		t.Error(err)
+	}
+	if err = scram.verify([]byte("v=AAAA")); err == nil {
+		t.Error("expected an invalid server signature to fail")
+	}
+	if _, err = scram.final([]byte("r=other,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")); err == nil {
+		t.Error("expected a server nonce that does not extend the client nonce to fail")
+	}
+}
@@ -0,0 +1,42 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// KeyringKeyEncryptionKey returns a KEK that wraps keys with the 32 byte secret held by the user key with the
+// description in the kernel keyring of the user, for example a key added at boot with
+//    keyctl padd user iot-edge-kek @u < kek.bin
+func KeyringKeyEncryptionKey(description string) (KeyEncryptionKey, error) {
+	id, err := unix.KeyctlSearch(unix.KEY_SPEC_USER_KEYRING, "user", description, 0)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find key %s in the user keyring; %w", description, err)
+	}
+	secret := make([]byte, keyStoreKeySize+1)
+	n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, secret, 0)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read key %s from the user keyring; %w", description, err)
+	}
+	if n != keyStoreKeySize {
+		return nil, fmt.Errorf("key %s in the user keyring must be %d bytes", description, keyStoreKeySize)
+	}
+	return NewKeyEncryptionKey(secret[:n])
+}
@@ -0,0 +1,334 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/storage"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Proxied thing key store
+// Instead of deriving the keys of proxied things from a master key, the gateway can generate a random key for every
+// proxied thing and keep the keys in a key store file. The keys are protected with envelope encryption: every key is
+// encrypted with its own data encryption key (DEK), and the DEK is in turn encrypted (wrapped) with a key encryption
+// key (KEK) that is never written to the store. The KEK is provided by a KeyEncryptionKey, which can hold the KEK in
+// memory, read it from the kernel keyring or delegate wrapping to a TPM or hardware security module, so that a copy of
+// the store file alone does not reveal the keys.
+// When the gateway hardware is replaced, the keys are exported with a passphrase, which re-wraps every DEK with a key
+// derived from the passphrase, and imported on the new gateway, which re-wraps the DEKs with its own KEK. The keys
+// themselves are never decrypted during an export or import.
+// Every key is bound to its device by encrypting it with the adapter and device ID as additional authenticated data,
+// so that a key can not be moved to the entry of another device in the store file.
+
+// keyStoreKeySize is the size in bytes of the data and key encryption keys
+const keyStoreKeySize = 32
+
+// scrypt parameters of the key derived from an export passphrase
+const (
+	exportScryptN = 1 << 15
+	exportScryptR = 8
+	exportScryptP = 1
+)
+
+var errKeyStoreFormat = errors.New("unsupported key store format")
+
+// KeyEncryptionKey wraps and unwraps the data encryption keys of a proxied thing key store. Implementations may keep
+// the KEK in a TPM or hardware security module and perform the wrapping there.
+type KeyEncryptionKey interface {
+	// Wrap encrypts the data encryption key
+	Wrap(dek []byte) ([]byte, error)
+	// Unwrap decrypts a data encryption key encrypted with Wrap
+	Unwrap(wrapped []byte) ([]byte, error)
+}
+
+// aesKeyEncryptionKey is a KEK that is held in memory and wraps keys with AES-GCM
+type aesKeyEncryptionKey struct {
+	aead cipher.AEAD
+}
+
+// NewKeyEncryptionKey returns a KEK that wraps keys with AES-256-GCM using the 32 byte secret
+func NewKeyEncryptionKey(secret []byte) (KeyEncryptionKey, error) {
+	if len(secret) != keyStoreKeySize {
+		return nil, fmt.Errorf("key encryption key must be %d bytes", keyStoreKeySize)
+	}
+	aead, err := newAEAD(secret)
+	if err != nil {
+		return nil, err
+	}
+	return aesKeyEncryptionKey{aead: aead}, nil
+}
+
+func (k aesKeyEncryptionKey) Wrap(dek []byte) ([]byte, error) {
+	return seal(k.aead, dek, nil)
+}
+
+func (k aesKeyEncryptionKey) Unwrap(wrapped []byte) ([]byte, error) {
+	return open(k.aead, wrapped, nil)
+}
+
+// newAEAD returns an AES-GCM cipher with the key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts and authenticates the plaintext, and authenticates the additional data, with a random nonce that is
+// prepended to the ciphertext
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// open decrypts a ciphertext created with seal with the same additional data
+func open(aead cipher.AEAD, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+	return aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], additionalData)
+}
+
+// deviceName encodes the adapter and device ID unambiguously, with the length of the adapter as a prefix, so that no
+// other adapter and device ID have the same name
+func deviceName(adapter, deviceID string) string {
+	return strconv.Itoa(len(adapter)) + ":" + adapter + deviceID
+}
+
+// keyAdditionalData returns the additional data that binds the key of a proxied thing to its device
+func keyAdditionalData(adapter, deviceID string) []byte {
+	return []byte(deviceName(adapter, deviceID))
+}
+
+// storedKey is the key of a proxied thing encrypted with its wrapped DEK
+type storedKey struct {
+	Adapter  string `json:"adapter"`
+	DeviceID string `json:"device_id"`
+	DEK      []byte `json:"dek"`
+	Key      []byte `json:"key"`
+}
+
+// keyStoreFile is the content of the key store file and of an export
+type keyStoreFile struct {
+	Version int `json:"version"`
+	// Salt of the key derived from the passphrase of an export, empty in the store file
+	Salt []byte      `json:"salt,omitempty"`
+	Keys []storedKey `json:"keys"`
+}
+
+// ProxyKeyStore keeps the keys of proxied things in a file, encrypted with envelope encryption
+type ProxyKeyStore struct {
+	name  string
+	kek   KeyEncryptionKey
+	mutex sync.Mutex
+	// keys by adapter and device ID
+	keys map[string]storedKey
+}
+
+// OpenProxyKeyStore opens the key store in the named file, which is created when the first key is stored
+func OpenProxyKeyStore(name string, kek KeyEncryptionKey) (*ProxyKeyStore, error) {
+	if kek == nil {
+		return nil, errors.New("a key encryption key is required")
+	}
+	s := &ProxyKeyStore{name: name, kek: kek, keys: make(map[string]storedKey)}
+	b, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var f keyStoreFile
+	if err = json.Unmarshal(b, &f); err != nil {
+		return nil, err
+	}
+	if f.Version != 1 {
+		return nil, errKeyStoreFormat
+	}
+	for _, k := range f.Keys {
+		s.keys[storeIndex(k.Adapter, k.DeviceID)] = k
+	}
+	return s, nil
+}
+
+// storeIndex returns the index of the key of the device in the store
+func storeIndex(adapter, deviceID string) string {
+	return deviceName(adapter, deviceID)
+}
+
+// key returns the key of the thing of the device, generating and storing a key if the device has no key yet
+func (s *ProxyKeyStore) key(adapter, deviceID string) (ed25519.PrivateKey, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if k, ok := s.keys[storeIndex(adapter, deviceID)]; ok {
+		return s.decrypt(k)
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	dek := make([]byte, keyStoreKeySize)
+	if _, err = io.ReadFull(rand.Reader, dek); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := seal(aead, key.Seed(), keyAdditionalData(adapter, deviceID))
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := s.kek.Wrap(dek)
+	if err != nil {
+		return nil, err
+	}
+	s.keys[storeIndex(adapter, deviceID)] = storedKey{Adapter: adapter, DeviceID: deviceID, DEK: wrapped, Key: encrypted}
+	if err = s.save(); err != nil {
+		delete(s.keys, storeIndex(adapter, deviceID))
+		return nil, err
+	}
+	return key, nil
+}
+
+// decrypt the stored key
+func (s *ProxyKeyStore) decrypt(k storedKey) (ed25519.PrivateKey, error) {
+	dek, err := s.kek.Unwrap(k.DEK)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := open(aead, k.Key, keyAdditionalData(k.Adapter, k.DeviceID))
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, errKeyStoreFormat
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// save the keys to the store file, which only the current user can access
+func (s *ProxyKeyStore) save() error {
+	f := keyStoreFile{Version: 1, Keys: make([]storedKey, 0, len(s.keys))}
+	for _, k := range s.keys {
+		f.Keys = append(f.Keys, k)
+	}
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	return storage.WritePrivateFile(s.name, b)
+}
+
+// exportKeyEncryptionKey derives the KEK of an export from the passphrase
+func exportKeyEncryptionKey(passphrase, salt []byte) (KeyEncryptionKey, error) {
+	secret, err := scrypt.Key(passphrase, salt, exportScryptN, exportScryptR, exportScryptP, keyStoreKeySize)
+	if err != nil {
+		return nil, err
+	}
+	return NewKeyEncryptionKey(secret)
+}
+
+// Export the keys in the store so that they can be imported into the key store of another gateway. The data
+// encryption keys are re-wrapped with a key derived from the passphrase, which must be given to Import.
+func (s *ProxyKeyStore) Export(passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("an export passphrase is required")
+	}
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	exportKEK, err := exportKeyEncryptionKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	export := keyStoreFile{Version: 1, Salt: salt, Keys: make([]storedKey, 0, len(s.keys))}
+	for _, k := range s.keys {
+		if k.DEK, err = rewrap(k.DEK, s.kek, exportKEK); err != nil {
+			return nil, fmt.Errorf("unable to export key of %s device %s; %w", k.Adapter, k.DeviceID, err)
+		}
+		export.Keys = append(export.Keys, k)
+	}
+	return json.Marshal(export)
+}
+
+// Import the keys exported from the key store of another gateway with the passphrase given to Export. Imported keys
+// replace the keys of the same devices. Returns the number of imported keys.
+func (s *ProxyKeyStore) Import(data, passphrase []byte) (int, error) {
+	var export keyStoreFile
+	if err := json.Unmarshal(data, &export); err != nil {
+		return 0, err
+	}
+	if export.Version != 1 || len(export.Salt) == 0 {
+		return 0, errKeyStoreFormat
+	}
+	exportKEK, err := exportKeyEncryptionKey(passphrase, export.Salt)
+	if err != nil {
+		return 0, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	keys := make(map[string]storedKey, len(s.keys)+len(export.Keys))
+	for i, k := range s.keys {
+		keys[i] = k
+	}
+	for _, k := range export.Keys {
+		if k.DEK, err = rewrap(k.DEK, exportKEK, s.kek); err != nil {
+			return 0, fmt.Errorf("unable to import key of %s device %s; %w", k.Adapter, k.DeviceID, err)
+		}
+		keys[storeIndex(k.Adapter, k.DeviceID)] = k
+	}
+	previous := s.keys
+	s.keys = keys
+	if err = s.save(); err != nil {
+		s.keys = previous
+		return 0, err
+	}
+	return len(export.Keys), nil
+}
+
+// rewrap unwraps the DEK with one KEK and wraps it with another
+func rewrap(wrapped []byte, from, to KeyEncryptionKey) ([]byte, error) {
+	dek, err := from.Unwrap(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return to.Wrap(dek)
+}
@@ -0,0 +1,199 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testKeyEncryptionKey(t *testing.T, b byte) KeyEncryptionKey {
+	kek, err := NewKeyEncryptionKey(bytes.Repeat([]byte{b}, keyStoreKeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kek
+}
+
+func TestProxyKeyStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "proxied.keys")
+	store, err := OpenProxyKeyStore(name, testKeyEncryptionKey(t, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := store.key("ble", "C4:7C:8D:6A:2B:1F")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, key.Seed()) {
+		t.Error("the key is stored in plaintext")
+	}
+
+	tests := []struct {
+		name     string
+		kek      byte
+		adapter  string
+		deviceID string
+		same     bool
+		fail     bool
+	}{
+		{name: "same-device", kek: 1, adapter: "ble", deviceID: "C4:7C:8D:6A:2B:1F", same: true},
+		{name: "other-device", kek: 1, adapter: "ble", deviceID: "C4:7C:8D:6A:2B:20"},
+		{name: "other-adapter", kek: 1, adapter: "zigbee", deviceID: "C4:7C:8D:6A:2B:1F"},
+		{name: "other-kek", kek: 2, adapter: "ble", deviceID: "C4:7C:8D:6A:2B:1F", fail: true},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			reopened, err := OpenProxyKeyStore(name, testKeyEncryptionKey(t, subtest.kek))
+			if err != nil {
+				t.Fatal(err)
+			}
+			other, err := reopened.key(subtest.adapter, subtest.deviceID)
+			if (err != nil) != subtest.fail {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if !subtest.fail && bytes.Equal(key, other) != subtest.same {
+				t.Errorf("expected same key %v", subtest.same)
+			}
+		})
+	}
+}
+
+// check that a key that is moved to the entry of another device can not be decrypted
+func TestProxyKeyStore_MovedKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := OpenProxyKeyStore(filepath.Join(dir, "proxied.keys"), testKeyEncryptionKey(t, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.key("ble", "C4:7C:8D:6A:2B:1F"); err != nil {
+		t.Fatal(err)
+	}
+	moved := store.keys[storeIndex("ble", "C4:7C:8D:6A:2B:1F")]
+	moved.DeviceID = "C4:7C:8D:6A:2B:20"
+	store.keys[storeIndex(moved.Adapter, moved.DeviceID)] = moved
+	if _, err = store.key(moved.Adapter, moved.DeviceID); err == nil {
+		t.Error("expected the moved key to be rejected")
+	}
+}
+
+// check that adapters and device IDs that join to the same string have separate keys that can not be swapped
+func TestProxyKeyStore_Collision(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := OpenProxyKeyStore(filepath.Join(dir, "proxied.keys"), testKeyEncryptionKey(t, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices := [][2]string{{"ble", "a:b"}, {"ble:a", "b"}, {"ble", "a/b"}, {"ble/a", "b"}}
+	keys := make([][]byte, len(devices))
+	for i, device := range devices {
+		if keys[i], err = store.key(device[0], device[1]); err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < i; j++ {
+			if bytes.Equal(keys[i], keys[j]) {
+				t.Errorf("%v has the same key as %v", device, devices[j])
+			}
+		}
+	}
+	if len(store.keys) != len(devices) {
+		t.Fatalf("expected %d keys; got %d", len(devices), len(store.keys))
+	}
+	// the additional data of the key of one device does not authenticate the key of the other
+	moved := store.keys[storeIndex("ble", "a/b")]
+	moved.Adapter, moved.DeviceID = "ble/a", "b"
+	store.keys[storeIndex(moved.Adapter, moved.DeviceID)] = moved
+	if _, err = store.key(moved.Adapter, moved.DeviceID); err == nil {
+		t.Error("expected the moved key to be rejected")
+	}
+}
+
+func TestProxyKeyStore_ExportImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := OpenProxyKeyStore(filepath.Join(dir, "old.keys"), testKeyEncryptionKey(t, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := store.key("modbus", "7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	export, err := store.Export([]byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Export(nil); err == nil {
+		t.Error("expected an export without a passphrase to fail")
+	}
+
+	// the replacement gateway has a different KEK
+	replacement, err := OpenProxyKeyStore(filepath.Join(dir, "new.keys"), testKeyEncryptionKey(t, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = replacement.Import(export, []byte("battery staple")); err == nil {
+		t.Fatal("expected an import with the wrong passphrase to fail")
+	}
+	n, err := replacement.Import(export, []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 imported key; got %d", n)
+	}
+	reopened, err := OpenProxyKeyStore(filepath.Join(dir, "new.keys"), testKeyEncryptionKey(t, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err := reopened.key("modbus", "7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, imported) {
+		t.Error("expected the imported key to equal the exported key")
+	}
+}
+
+func TestNewKeyEncryptionKey_InvalidSize(t *testing.T) {
+	if _, err := NewKeyEncryptionKey(make([]byte, 16)); err == nil {
+		t.Error("expected an error")
+	}
+}
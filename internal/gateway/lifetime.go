@@ -0,0 +1,146 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/JacoJooste/iot-edge/v7/internal/debug"
+	"github.com/patrickmn/go-cache"
+)
+
+// Session lifetimes
+// AM ends a session once it has been idle for longer than its maximum idle time or once it reaches its maximum
+// lifetime. State that the gateway caches for a session with a fixed time to live can therefore outlive the session,
+// in which case the gateway serves a dead session, or expire long before the session does, in which case the thing is
+// sent back to AM for no reason. The gateway reads the lifetime of a session from AM when it first caches state for the
+// session and bounds the expiry of the state by the earlier of the idle and maximum expiry times of the session.
+// Reading the session information does not reset the idle time of the session, so the idle expiry is a conservative
+// bound: a session that is in use lives longer, in which case its lifetime is read again once the known expiry has
+// passed. The configured time to live is used for sessions whose lifetime can not be read, for example while AM is
+// unreachable, and for sessions that AM does not limit.
+
+// sessionLifetimeRetention is the time for which the lifetime of a session without an expiry is remembered
+const sessionLifetimeRetention = time.Hour
+
+// sessionLifetime contains the expiry times of a session as reported by AM
+type sessionLifetime struct {
+	maxIdle time.Time
+	maxLife time.Time
+}
+
+// expiry returns the time at which the session expires, the zero time if AM does not limit the session
+func (l sessionLifetime) expiry() time.Time {
+	switch {
+	case l.maxIdle.IsZero():
+		return l.maxLife
+	case l.maxLife.IsZero() || l.maxIdle.Before(l.maxLife):
+		return l.maxIdle
+	default:
+		return l.maxLife
+	}
+}
+
+// parseExpiry parses an expiry time of a session, returning the zero time if the value is empty
+func parseExpiry(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, fmt.Errorf("%w: %s", client.ErrPayloadInvalid, err)
+	}
+	return t, nil
+}
+
+// readSessionLifetime reads the lifetime of the session from AM
+func readSessionLifetime(connection client.Connection, token string) (lifetime sessionLifetime, err error) {
+	reply, err := connection.SessionInfo(token)
+	if err != nil {
+		return lifetime, err
+	}
+	var content struct {
+		MaxIdleExpirationTime    string `json:"maxIdleExpirationTime"`
+		MaxSessionExpirationTime string `json:"maxSessionExpirationTime"`
+	}
+	if err = json.Unmarshal(reply, &content); err != nil {
+		return lifetime, fmt.Errorf("%w: %s", client.ErrPayloadInvalid, err)
+	}
+	if lifetime.maxIdle, err = parseExpiry(content.MaxIdleExpirationTime); err != nil {
+		return lifetime, err
+	}
+	lifetime.maxLife, err = parseExpiry(content.MaxSessionExpirationTime)
+	return lifetime, err
+}
+
+// sessionLifetimes holds the expiry times of sessions, indexed by session token. Each entry expires along with its
+// session so that the lifetime of a session that is still in use is read again.
+type sessionLifetimes struct {
+	expiries *cache.Cache
+}
+
+func newSessionLifetimes() *sessionLifetimes {
+	return &sessionLifetimes{expiries: cache.New(sessionLifetimeRetention, time.Minute)}
+}
+
+// expiry returns the time at which the session expires, reading the lifetime of the session from AM if it is not
+// known. Returns false if the lifetime can not be read or if AM does not limit the session.
+func (l *sessionLifetimes) expiry(connection client.Connection, token string) (time.Time, bool) {
+	if l == nil {
+		return time.Time{}, false
+	}
+	if value, ok := l.expiries.Get(token); ok {
+		expiry := value.(time.Time)
+		return expiry, !expiry.IsZero()
+	}
+	lifetime, err := readSessionLifetime(connection, token)
+	if err != nil {
+		debug.Errorf("Unable to read the lifetime of the session; %s", err)
+		return time.Time{}, false
+	}
+	expiry := lifetime.expiry()
+	if expiry.IsZero() {
+		l.expiries.SetDefault(token, expiry)
+		return expiry, false
+	}
+	if remaining := time.Until(expiry); remaining > 0 {
+		l.expiries.Set(token, expiry, remaining)
+	}
+	return expiry, true
+}
+
+// forget the lifetime of the session
+func (l *sessionLifetimes) forget(token string) {
+	if l == nil {
+		return
+	}
+	l.expiries.Delete(token)
+}
+
+// boundedTTL returns the time to live of state held for the session, which is the given time to live unless the
+// session expires sooner
+func (c *ThingGateway) boundedTTL(connection client.Connection, token string, ttl time.Duration) time.Duration {
+	if expiry, ok := c.lifetimes.expiry(connection, token); ok {
+		if remaining := time.Until(expiry); remaining < ttl {
+			return remaining
+		}
+	}
+	return ttl
+}
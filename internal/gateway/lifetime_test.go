@@ -0,0 +1,169 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/go-ocf/go-coap/codes"
+)
+
+// testSessionInfo returns a session information reply with the given expiry times, omitting zero times
+func testSessionInfo(maxIdle, maxLife time.Time) func(string) ([]byte, error) {
+	return func(string) ([]byte, error) {
+		content := make(map[string]string)
+		if !maxIdle.IsZero() {
+			content["maxIdleExpirationTime"] = maxIdle.Format(time.RFC3339)
+		}
+		if !maxLife.IsZero() {
+			content["maxSessionExpirationTime"] = maxLife.Format(time.RFC3339)
+		}
+		return json.Marshal(content)
+	}
+}
+
+func Test_sessionLifetime_expiry(t *testing.T) {
+	early := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	late := early.Add(time.Hour)
+	tests := []struct {
+		name     string
+		lifetime sessionLifetime
+		expiry   time.Time
+	}{
+		{name: "unlimited"},
+		{name: "idle-only", lifetime: sessionLifetime{maxIdle: early}, expiry: early},
+		{name: "life-only", lifetime: sessionLifetime{maxLife: late}, expiry: late},
+		{name: "idle-first", lifetime: sessionLifetime{maxIdle: early, maxLife: late}, expiry: early},
+		{name: "life-first", lifetime: sessionLifetime{maxIdle: late, maxLife: early}, expiry: early},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			if expiry := subtest.lifetime.expiry(); !expiry.Equal(subtest.expiry) {
+				t.Errorf("expected %v; got %v", subtest.expiry, expiry)
+			}
+		})
+	}
+}
+
+func Test_readSessionLifetime(t *testing.T) {
+	expiry := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		connection *mockClient
+		lifetime   sessionLifetime
+		err        error
+	}{
+		{name: "lifetime", connection: &mockClient{sessionInfoFunc: testSessionInfo(expiry, expiry.Add(time.Hour))},
+			lifetime: sessionLifetime{maxIdle: expiry, maxLife: expiry.Add(time.Hour)}},
+		{name: "unlimited", connection: &mockClient{}},
+		{name: "malformed", connection: &mockClient{faults: faultScript{"sessionInfo": {{malformed: true}}}},
+			err: client.ErrPayloadInvalid},
+		{name: "invalid-time", connection: &mockClient{sessionInfoFunc: func(string) ([]byte, error) {
+			return []byte(`{"maxIdleExpirationTime":"soon"}`), nil
+		}}, err: client.ErrPayloadInvalid},
+		{name: "unreachable", connection: &mockClient{faults: faultScript{"sessionInfo": {{drop: true}}}},
+			err: client.ErrAMUnreachable},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			lifetime, err := readSessionLifetime(subtest.connection, "aToken")
+			if !errors.Is(err, subtest.err) {
+				t.Fatalf("expected error %v; got %v", subtest.err, err)
+			}
+			if err == nil && lifetime != subtest.lifetime {
+				t.Errorf("expected %+v; got %+v", subtest.lifetime, lifetime)
+			}
+		})
+	}
+}
+
+func TestThingGateway_cacheSessionResponse(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		info     func(string) ([]byte, error)
+		faults   faultScript
+		cached   bool
+		maxTTL   time.Duration
+		minTTL   time.Duration
+		requests int
+	}{
+		{name: "session-expires-first", info: testSessionInfo(now.Add(5*time.Minute), now.Add(time.Hour)),
+			cached: true, minTTL: 4 * time.Minute, maxTTL: 5 * time.Minute},
+		{name: "ttl-expires-first", info: testSessionInfo(now.Add(time.Hour), time.Time{}),
+			cached: true, minTTL: 10 * time.Minute, maxTTL: 10 * time.Minute},
+		{name: "unlimited-session", cached: true, minTTL: 10 * time.Minute, maxTTL: 10 * time.Minute},
+		{name: "unreachable", faults: faultScript{"sessionInfo": {{drop: true}}},
+			cached: true, minTTL: 10 * time.Minute, maxTTL: 10 * time.Minute},
+		{name: "session-expired", info: testSessionInfo(now.Add(-time.Minute), time.Time{})},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			requests := 0
+			m := &mockClient{faults: subtest.faults, sessionInfoFunc: func(token string) ([]byte, error) {
+				requests++
+				if subtest.info == nil {
+					return []byte("{}"), nil
+				}
+				return subtest.info(token)
+			}}
+			gateway := testGateway(m)
+			gateway.lifetimes = newSessionLifetimes()
+			if err := gateway.EnableResponseCache(map[string]time.Duration{RouteAttributes: 10 * time.Minute}); err != nil {
+				t.Fatal(err)
+			}
+			key := attributesCacheKey("aToken", nil)
+			for i := 0; i < 2; i++ {
+				gateway.cacheSessionResponse(m, RouteAttributes, "aToken", key, cacheable(codes.Changed, []byte("{}")))
+			}
+			item, ok := gateway.cache.store.Items()[key]
+			if ok != subtest.cached {
+				t.Fatalf("expected cached %v; got %v", subtest.cached, ok)
+			}
+			if ok {
+				ttl := time.Until(time.Unix(0, item.Expiration))
+				if ttl < subtest.minTTL-time.Second || ttl > subtest.maxTTL {
+					t.Errorf("expected a time to live between %v and %v; got %v", subtest.minTTL, subtest.maxTTL, ttl)
+				}
+			}
+			if subtest.cached && subtest.faults == nil && requests != 1 {
+				t.Errorf("expected the lifetime to be read once; got %d", requests)
+			}
+		})
+	}
+}
+
+func TestWarmSessions_take_SessionExpired(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	id, err := publicKeyID(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	warm := &warmSessions{maxAge: time.Hour, sessions: map[string]warmSession{
+		id: {thingID: "thing-1", token: "warm-token", created: time.Now(), expires: time.Now().Add(-time.Second)},
+	}}
+	if _, ok := warm.take(key.Public()); ok {
+		t.Error("expected the warm session to be discarded after the session expired")
+	}
+}
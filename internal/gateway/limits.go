@@ -0,0 +1,400 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/JacoJooste/iot-edge/v7/internal/debug"
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+	coapnet "github.com/go-ocf/go-coap/net"
+)
+
+// Connection limits
+// A gateway running on constrained hardware must degrade predictably when many things connect at the same time or when
+// it is under attack. Three limits are applied to the CoAP server:
+//    - the number of concurrent sessions, new connections are closed as soon as they are accepted when the limit is
+//      reached
+//    - the idle timeout, after which a session in which the thing has not sent any requests is closed
+//    - the handshake rate, handshakes in excess of the rate are aborted before any cryptographic work is done. Plain
+//      TCP connections have no handshake so the rate at which they are accepted is capped instead.
+// A limit is not applied if its value is zero.
+// The CoAP server only serves the listeners and connections of the CoAP library and can therefore not be given a
+// listener that applies the limits. Instead, when limits are set, the gateway accepts the connections itself and
+// serves each connection with its own CoAP server.
+
+// ConnectionLimits limit the resources that things can consume on the CoAP server
+type ConnectionLimits struct {
+	// MaxSessions is the maximum number of concurrent sessions
+	MaxSessions int
+	// IdleTimeout is the period after which a session without any traffic is closed
+	IdleTimeout time.Duration
+	// HandshakeRate is the maximum number of handshakes started per second
+	HandshakeRate float64
+}
+
+// SetConnectionLimits sets the limits applied to the sessions of the CoAP server.
+// Must be called before the CoAP server is started.
+func (c *ThingGateway) SetConnectionLimits(limits ConnectionLimits) error {
+	if limits.MaxSessions < 0 || limits.IdleTimeout < 0 || limits.HandshakeRate < 0 {
+		return fmt.Errorf("connection limits must not be negative")
+	}
+	c.limits = limits
+	return nil
+}
+
+// Payload limits
+// The payloads that the gateway holds in memory are limited in size so that a malformed or hostile request can not
+// exhaust the memory of the gateway:
+//    - requests from things with a payload larger than the maximum request size are answered with 4.13 Request Entity
+//      Too Large and a Size1 option containing the maximum size (RFC 7959 section 2.9.3). Over TCP the maximum message
+//      size is also advertised to things and larger messages end the session. The CoAP library reassembles block-wise
+//      transfers before the request reaches the gateway, the connection limits bound the number of transfers in
+//      progress.
+//    - the bodies of responses from AM are read up to the maximum response size, a larger response fails with 5.02 Bad
+//      Gateway.
+// Both sizes default to client.DefaultMaxPayloadSize.
+
+// PayloadLimits limit the size of the payloads held in memory by the gateway
+type PayloadLimits struct {
+	// MaxRequestSize is the maximum size in bytes of the payload of a request from a thing
+	MaxRequestSize int
+	// MaxResponseSize is the maximum size in bytes of the body of a response from AM
+	MaxResponseSize int
+}
+
+// SetPayloadLimits sets the limits applied to the payloads of requests from things and of responses from AM.
+// Must be called before the Thing Gateway is initialised and the CoAP server is started.
+func (c *ThingGateway) SetPayloadLimits(limits PayloadLimits) error {
+	if limits.MaxRequestSize < 0 || limits.MaxResponseSize < 0 {
+		return fmt.Errorf("payload limits must not be negative")
+	}
+	c.payloadLimits = limits
+	return nil
+}
+
+// maxRequestSize returns the maximum size of the payload of a request from a thing
+func (c *ThingGateway) maxRequestSize() int {
+	if c.payloadLimits.MaxRequestSize == 0 {
+		return client.DefaultMaxPayloadSize
+	}
+	return c.payloadLimits.MaxRequestSize
+}
+
+// limitPayload rejects requests with a payload larger than the maximum request size
+func (c *ThingGateway) limitPayload(next coap.Handler) coap.HandlerFunc {
+	limit := c.maxRequestSize()
+	return func(w coap.ResponseWriter, r *coap.Request) {
+		if err := client.CheckPayloadSize(r.Msg.Payload(), limit); err != nil {
+			c.log.Info("Request rejected; ", err)
+			response := w.NewResponse(codes.RequestEntityTooLarge)
+			response.SetOption(coap.Size1, uint32(limit))
+			if err := w.WriteMsg(response); err != nil {
+				c.log.Error(err)
+			}
+			return
+		}
+		next.ServeCOAP(w, r)
+	}
+}
+
+// RequestPriorities limit the requests that the gateway makes to AM at the same time, see client.RequestPriorities.
+// Authentication, session and access token requests are sent before other requests and can use the reserved requests
+// so that they are not starved by bulk attribute requests.
+type RequestPriorities = client.RequestPriorities
+
+// SetRequestPriorities limits the number of requests made to AM at the same time and sends waiting requests in order
+// of priority.
+// Must be called before the Thing Gateway is initialised.
+func (c *ThingGateway) SetRequestPriorities(priorities RequestPriorities) error {
+	if err := priorities.Validate(); err != nil {
+		return err
+	}
+	c.priorities = priorities
+	return nil
+}
+
+// handshakeLimiter caps the handshake rate with a token bucket and sheds handshakes when resources are exhausted
+type handshakeLimiter struct {
+	rate   float64
+	burst  float64
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time
+	// guard sheds handshakes while the gateway is short of resources, see resources.go
+	guard *resourceGuard
+}
+
+var (
+	errRateExceeded       = errors.New("rate exceeded")
+	errResourcesExhausted = errors.New("resources exhausted")
+)
+
+// newHandshakeLimiter returns a limiter for the given rate, or nil if the rate is unlimited
+func newHandshakeLimiter(rate float64) *handshakeLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	burst := math.Max(1, math.Ceil(rate))
+	return &handshakeLimiter{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// withGuard returns a limiter that also sheds handshakes when the guard requires it
+func (h *handshakeLimiter) withGuard(guard *resourceGuard) *handshakeLimiter {
+	if guard == nil {
+		return h
+	}
+	if h == nil {
+		h = &handshakeLimiter{}
+	}
+	h.guard = guard
+	return h
+}
+
+// admit returns an error describing why a handshake may not be started, or nil if it may be started
+func (h *handshakeLimiter) admit() error {
+	if h == nil {
+		return nil
+	}
+	if !h.guard.admitHandshake() {
+		return errResourcesExhausted
+	}
+	if h.rate > 0 && !h.allow() {
+		return errRateExceeded
+	}
+	return nil
+}
+
+// allow returns true if a handshake may be started
+func (h *handshakeLimiter) allow() bool {
+	if h == nil {
+		return true
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	now := time.Now()
+	h.tokens = math.Min(h.burst, h.tokens+now.Sub(h.last).Seconds()*h.rate)
+	h.last = now
+	if h.tokens < 1 {
+		return false
+	}
+	h.tokens--
+	return true
+}
+
+// dtlsConnectContext creates the context of a DTLS handshake, the context is cancelled if the handshake is not admitted
+func (h *handshakeLimiter) dtlsConnectContext() (context.Context, func()) {
+	if err := h.admit(); err != nil {
+		debug.Info("DTLS handshake rejected, ", err)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		return ctx, cancel
+	}
+	// the default handshake timeout of the DTLS library
+	return context.WithTimeout(context.Background(), 30*time.Second)
+}
+
+// tlsConfigForClient aborts the TLS handshake if the handshake is not admitted
+func (h *handshakeLimiter) tlsConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	if err := h.admit(); err != nil {
+		debug.Info("TLS handshake rejected, ", err)
+		return nil, fmt.Errorf("handshake %w", err)
+	}
+	// use the original configuration
+	return nil, nil
+}
+
+// managedSession is a connection served by its own CoAP server
+type managedSession struct {
+	conn       net.Conn
+	lastActive int64
+}
+
+// touch records activity in the session
+func (s *managedSession) touch() {
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
+
+// idle returns true if there has been no activity in the session for longer than the timeout
+func (s *managedSession) idle(timeout time.Duration) bool {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.lastActive))) > timeout
+}
+
+// sessionManager accepts connections and applies the connection limits to them
+type sessionManager struct {
+	limits ConnectionLimits
+	// limits the rate at which connections are accepted and sheds connections when resources are exhausted, only used
+	// for transports without a handshake
+	accepts   *handshakeLimiter
+	handler   coap.Handler
+	newServer func(conn net.Conn, handler coap.Handler) *coap.Server
+	mutex     sync.Mutex
+	// sessions by remote address
+	sessions map[string]*managedSession
+	wg       sync.WaitGroup
+	stop     chan struct{}
+}
+
+func newSessionManager(limits ConnectionLimits, capAccepts bool, guard *resourceGuard, handler coap.Handler,
+	newServer func(conn net.Conn, handler coap.Handler) *coap.Server) *sessionManager {
+	m := &sessionManager{
+		limits:    limits,
+		handler:   handler,
+		newServer: newServer,
+		sessions:  make(map[string]*managedSession),
+		stop:      make(chan struct{}),
+	}
+	if capAccepts {
+		m.accepts = newHandshakeLimiter(limits.HandshakeRate).withGuard(guard)
+	}
+	return m
+}
+
+// add the connection as a new session, returns false if the maximum number of sessions has been reached
+func (m *sessionManager) add(conn net.Conn) (*managedSession, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.limits.MaxSessions > 0 && len(m.sessions) >= m.limits.MaxSessions {
+		return nil, false
+	}
+	session := &managedSession{conn: conn}
+	session.touch()
+	m.sessions[conn.RemoteAddr().String()] = session
+	return session, true
+}
+
+// remove the session
+func (m *sessionManager) remove(session *managedSession) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	key := session.conn.RemoteAddr().String()
+	if m.sessions[key] == session {
+		delete(m.sessions, key)
+	}
+}
+
+// session returns the session with the given remote address
+func (m *sessionManager) session(address net.Addr) (*managedSession, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	session, ok := m.sessions[address.String()]
+	return session, ok
+}
+
+// closeAll closes the connections of all sessions for which the condition holds
+func (m *sessionManager) closeAll(condition func(*managedSession) bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, session := range m.sessions {
+		if condition(session) {
+			debug.Infof("Closing session with %s", session.conn.RemoteAddr())
+			session.conn.Close()
+		}
+	}
+}
+
+// closeIdle periodically closes the sessions that have been idle for longer than the idle timeout
+func (m *sessionManager) closeIdle() {
+	ticker := time.NewTicker(m.limits.IdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.closeAll(func(session *managedSession) bool {
+				return session.idle(m.limits.IdleTimeout)
+			})
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// handle serves the connection until it is closed
+func (m *sessionManager) handle(conn net.Conn) {
+	if err := m.accepts.admit(); err != nil {
+		debug.Infof("Connection from %s rejected, %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	session, ok := m.add(conn)
+	if !ok {
+		debug.Infof("Connection from %s rejected, maximum number of sessions reached", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		server := m.newServer(conn, coap.HandlerFunc(func(w coap.ResponseWriter, r *coap.Request) {
+			session.touch()
+			m.handler.ServeCOAP(w, r)
+		}))
+		err := server.ActivateAndServe()
+		debug.Tracef("Session with %s ended; %v", conn.RemoteAddr(), err)
+		m.remove(session)
+		conn.Close()
+	}()
+}
+
+// serve the connections accepted by the listener until the manager is shut down
+func (m *sessionManager) serve(l listener) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-m.stop
+		cancel()
+	}()
+	if m.limits.IdleTimeout > 0 {
+		go m.closeIdle()
+	}
+	for {
+		conn, err := l.AcceptWithContext(ctx)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, coapnet.ErrServerClosed) {
+				break
+			}
+			continue
+		}
+		m.handle(conn)
+	}
+	// closing the connections ends the CoAP servers
+	m.closeAll(func(*managedSession) bool {
+		return true
+	})
+	m.wg.Wait()
+	return coap.ErrServerClosed
+}
+
+// shutdown stops accepting connections and closes all sessions
+func (m *sessionManager) shutdown() {
+	close(m.stop)
+}
@@ -0,0 +1,239 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	frcrypto "github.com/JacoJooste/iot-edge/v7/internal/crypto"
+)
+
+func TestHandshakeLimiter_Allow(t *testing.T) {
+	limiter := newHandshakeLimiter(5)
+	for i := 0; i < 5; i++ {
+		if !limiter.allow() {
+			t.Fatalf("expected handshake %d to be allowed", i)
+		}
+	}
+	if limiter.allow() {
+		t.Error("expected handshake in excess of the rate to be rejected")
+	}
+	time.Sleep(250 * time.Millisecond)
+	if !limiter.allow() {
+		t.Error("expected handshake to be allowed after the bucket has been refilled")
+	}
+	var unlimited *handshakeLimiter
+	if !unlimited.allow() {
+		t.Error("expected unlimited limiter to allow handshakes")
+	}
+}
+
+func TestThingGateway_SetConnectionLimits(t *testing.T) {
+	gateway := testGateway(&mockClient{})
+	if err := gateway.SetConnectionLimits(ConnectionLimits{MaxSessions: -1}); err == nil {
+		t.Error("expected negative limits to be rejected")
+	}
+}
+
+func TestThingGateway_SetPayloadLimits(t *testing.T) {
+	gateway := testGateway(&mockClient{})
+	if err := gateway.SetPayloadLimits(PayloadLimits{MaxRequestSize: -1}); err == nil {
+		t.Error("expected negative limits to be rejected")
+	}
+}
+
+func TestGatewayServer_PayloadLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  int
+		amError  error
+		tooLarge bool
+	}{
+		{name: "within-limit", payload: 64},
+		{name: "exceeds-limit", payload: 4096, tooLarge: true},
+		{name: "rejected-by-am", payload: 64, amError: client.AMError{Code: http.StatusRequestEntityTooLarge},
+			tooLarge: true},
+	}
+	for _, subtest := range tests {
+		// the handlers of the gateway may still be running when the next subtest starts
+		subtest := subtest
+		t.Run(subtest.name, func(t *testing.T) {
+			var forwarded int32
+			gateway := testGateway(&mockClient{accessTokenFunc: func(string, string) ([]byte, error) {
+				atomic.StoreInt32(&forwarded, 1)
+				if subtest.amError != nil {
+					return nil, subtest.amError
+				}
+				return []byte("{}"), nil
+			}})
+			if err := gateway.SetPayloadLimits(PayloadLimits{MaxRequestSize: 256}); err != nil {
+				t.Fatal(err)
+			}
+			serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			if err := gateway.StartCOAPServer(":0", serverKey); err != nil {
+				t.Fatal(err)
+			}
+			defer gateway.ShutdownCOAPServer()
+
+			payload := strings.Repeat("a", subtest.payload)
+			_, err := gatewayConnection(t, gateway).AccessToken("session-1", client.ApplicationJSON, payload)
+			if !subtest.tooLarge {
+				if err != nil {
+					t.Error(err)
+				}
+				return
+			}
+			if !errors.Is(err, client.ErrPayloadTooLarge) {
+				t.Errorf("expected a payload too large error; got %v", err)
+			}
+			if forwarded := atomic.LoadInt32(&forwarded) == 1; forwarded != (subtest.amError != nil) {
+				t.Errorf("expected the request to be forwarded to AM: %v", !forwarded)
+			}
+		})
+	}
+}
+
+// testLimitedGateway starts a gateway that serves CoAP over the transport with the given connection limits
+func testLimitedGateway(t *testing.T, transport Transport, limits ConnectionLimits) *ThingGateway {
+	gateway := testGateway(&mockClient{})
+	if err := gateway.SetTransport(transport); err != nil {
+		t.Fatal(err)
+	}
+	if err := gateway.SetConnectionLimits(limits); err != nil {
+		t.Fatal(err)
+	}
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err := gateway.StartCOAPServer("127.0.0.1:0", serverKey); err != nil {
+		t.Fatal(err)
+	}
+	return gateway
+}
+
+// testClosedByServer returns true if the server closes the connection within the timeout
+func testClosedByServer(conn net.Conn, timeout time.Duration) bool {
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	buffer := make([]byte, 64)
+	for {
+		// discard the signalling messages sent by the server
+		_, err := conn.Read(buffer)
+		if err == nil {
+			continue
+		}
+		netErr, ok := err.(net.Error)
+		return !ok || !netErr.Timeout()
+	}
+}
+
+func TestGatewayServer_ConnectionLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits ConnectionLimits
+	}{
+		{name: "max-sessions", limits: ConnectionLimits{MaxSessions: 1}},
+		{name: "accept-rate", limits: ConnectionLimits{HandshakeRate: 0.1}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			gateway := testLimitedGateway(t, TransportTCP, subtest.limits)
+			defer gateway.ShutdownCOAPServer()
+
+			first, err := net.Dial("tcp", gateway.Address())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer first.Close()
+			second, err := net.Dial("tcp", gateway.Address())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer second.Close()
+			if !testClosedByServer(second, time.Second) {
+				t.Error("expected the connection in excess of the limit to be closed")
+			}
+			if testClosedByServer(first, 200*time.Millisecond) {
+				t.Error("expected the connection within the limit to remain open")
+			}
+		})
+	}
+}
+
+func TestGatewayServer_IdleTimeout(t *testing.T) {
+	gateway := testLimitedGateway(t, TransportTCP, ConnectionLimits{IdleTimeout: 200 * time.Millisecond})
+	defer gateway.ShutdownCOAPServer()
+
+	conn, err := net.Dial("tcp", gateway.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if !testClosedByServer(conn, 2*time.Second) {
+		t.Error("expected the idle connection to be closed")
+	}
+}
+
+func TestGatewayServer_TLSHandshakeRate(t *testing.T) {
+	gateway := testLimitedGateway(t, TransportTLS, ConnectionLimits{HandshakeRate: 0.1})
+	defer gateway.ShutdownCOAPServer()
+
+	cert, _ := frcrypto.PublicKeyCertificate(clientKey)
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, InsecureSkipVerify: true}
+	conn, err := tls.Dial("tcp", gateway.Address(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn, err := tls.Dial("tcp", gateway.Address(), config); err == nil {
+		conn.Close()
+		t.Error("expected the handshake in excess of the rate to be rejected")
+	}
+}
+
+func TestGatewayServer_DTLSMaxSessions(t *testing.T) {
+	gateway := testLimitedGateway(t, TransportDTLS, ConnectionLimits{MaxSessions: 1})
+	defer gateway.ShutdownCOAPServer()
+
+	gwURL, _ := url.Parse("coaps://" + gateway.Address())
+	connect := func() (client.Connection, error) {
+		return client.NewConnection().
+			ConnectTo(gwURL).
+			WithKey(clientKey).
+			TimeoutRequestAfter(500 * time.Millisecond).
+			Create()
+	}
+	connection, err := connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = connection.Authenticate(client.AuthenticatePayload{}); err != nil {
+		t.Error(err)
+	}
+	if _, err = connect(); err == nil {
+		t.Error("expected the session in excess of the limit to be rejected")
+	}
+}
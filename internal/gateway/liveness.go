@@ -0,0 +1,57 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"sync/atomic"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/JacoJooste/iot-edge/v7/pkg/thing"
+)
+
+// Liveness reports the health of the Thing Gateway, so that a watchdog can decide when to restart the gateway or reset
+// the network stack of the host
+type Liveness struct {
+	// AM reports the contact of the gateway with AM
+	AM thing.Liveness `json:"am"`
+	// Serving is true while the CoAP server is running
+	Serving bool `json:"serving"`
+	// CachedAuthentications is the number of authentication flows in progress that are held by the gateway
+	CachedAuthentications int `json:"cachedAuthentications"`
+	// CachedResponses is the number of responses in the response cache, CacheHits and CacheMisses count the lookups
+	CachedResponses int    `json:"cachedResponses"`
+	CacheHits       uint64 `json:"cacheHits"`
+	CacheMisses     uint64 `json:"cacheMisses"`
+	// Resources reports the resource usage of the gateway if resource guards are set, see SetResourceGuards
+	Resources *ResourceUsage `json:"resources,omitempty"`
+}
+
+// Liveness returns the health of the Thing Gateway without making any requests
+func (c *ThingGateway) Liveness() Liveness {
+	liveness := Liveness{
+		AM:                    client.ConnectionLiveness(c.amConnection),
+		Serving:               c.address != nil,
+		CachedAuthentications: len(c.authCache.Keys()),
+		Resources:             c.guard.report(),
+	}
+	if c.cache != nil {
+		liveness.CachedResponses = c.cache.store.ItemCount()
+		liveness.CacheHits = atomic.LoadUint64(&c.cache.hits)
+		liveness.CacheMisses = atomic.LoadUint64(&c.cache.misses)
+	}
+	return liveness
+}
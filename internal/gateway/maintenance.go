@@ -0,0 +1,147 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Maintenance windows
+// The gateway does proactive work with AM and its certificate issuer: it warms up the sessions of known things when
+// it starts, refreshes the access tokens of proxied devices before they expire and renews its server certificate.
+// Gateways of a fleet that are deployed, restarted or provisioned together would do this work at the same second and
+// hit AM with a storm of requests. A maintenance schedule staggers the work. The warm-up of every thing is delayed by
+// a random jitter, and work with a deadline is moved from the time it becomes due to a random time in the first
+// maintenance window that opens before the deadline. Work for which no window opens in time is done at a random time
+// before its deadline, so that the schedule never lets a token or certificate expire. Without a schedule, the work is
+// done as soon as it is due.
+
+// maxWindowDays is the maximum number of days that are searched for a maintenance window
+const maxWindowDays = 366
+
+// MaintenanceWindow is a daily period in UTC in which the gateway does proactive work
+type MaintenanceWindow struct {
+	// Start is the time after midnight UTC at which the window opens
+	Start time.Duration
+	// Length of the window, a window may extend into the next day
+	Length time.Duration
+}
+
+// MaintenanceSchedule configures when the gateway does proactive work
+type MaintenanceSchedule struct {
+	// Windows in which work is done, work is spread up to its deadline if empty
+	Windows []MaintenanceWindow
+	// Jitter is the maximum random delay of the warm-up of each thing when the gateway starts
+	Jitter time.Duration
+}
+
+// maintenanceScheduler plans proactive work according to the schedule, a nil scheduler does the work when it is due
+type maintenanceScheduler struct {
+	windows []MaintenanceWindow
+	jitter  time.Duration
+	mutex   sync.Mutex
+	random  *rand.Rand
+}
+
+func newMaintenanceScheduler(schedule MaintenanceSchedule) *maintenanceScheduler {
+	windows := append([]MaintenanceWindow(nil), schedule.Windows...)
+	sort.Slice(windows, func(i, j int) bool {
+		return windows[i].Start < windows[j].Start
+	})
+	return &maintenanceScheduler{
+		windows: windows,
+		jitter:  schedule.Jitter,
+		random:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// between returns a random time in [start, end)
+func (m *maintenanceScheduler) between(start, end time.Time) time.Time {
+	if !end.After(start) {
+		return start
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return start.Add(time.Duration(m.random.Int63n(int64(end.Sub(start)))))
+}
+
+// window returns the part of the first maintenance window that overlaps with [earliest, deadline)
+func (m *maintenanceScheduler) window(earliest, deadline time.Time) (start, end time.Time, ok bool) {
+	// start a day early for windows that extend past midnight
+	day := earliest.UTC().Truncate(24 * time.Hour).Add(-24 * time.Hour)
+	for i := 0; i < maxWindowDays && day.Before(deadline); i++ {
+		for _, w := range m.windows {
+			start, end = day.Add(w.Start), day.Add(w.Start+w.Length)
+			if start.Before(earliest) {
+				start = earliest
+			}
+			if end.After(deadline) {
+				end = deadline
+			}
+			if start.Before(end) {
+				return start, end, true
+			}
+		}
+		day = day.Add(24 * time.Hour)
+	}
+	return start, end, false
+}
+
+// plan returns the time at which work that is due, and may be done between the earliest time and the deadline, is
+// done. The work is done when it is due without a schedule.
+func (m *maintenanceScheduler) plan(due, earliest, deadline time.Time) time.Time {
+	if m == nil {
+		return due
+	}
+	if start, end, ok := m.window(earliest, deadline); ok {
+		return m.between(start, end)
+	}
+	return m.between(earliest, deadline)
+}
+
+// delay returns a random delay up to the jitter of the schedule, zero without a schedule
+func (m *maintenanceScheduler) delay() time.Duration {
+	if m == nil || m.jitter <= 0 {
+		return 0
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return time.Duration(m.random.Int63n(int64(m.jitter)))
+}
+
+// SetMaintenanceSchedule makes the Thing Gateway stagger its proactive work with AM and its certificate issuer
+// according to the schedule, so that a fleet of gateways does not hit AM at the same time.
+// Must be called before the CoAP server is started.
+func (c *ThingGateway) SetMaintenanceSchedule(schedule MaintenanceSchedule) error {
+	if schedule.Jitter < 0 {
+		return errors.New("maintenance jitter must not be negative")
+	}
+	for _, w := range schedule.Windows {
+		if w.Start < 0 || w.Start >= 24*time.Hour {
+			return errors.New("maintenance window must start within the day")
+		}
+		if w.Length <= 0 || w.Length > 24*time.Hour {
+			return errors.New("maintenance window length must be positive and at most a day")
+		}
+	}
+	c.maintenance = newMaintenanceScheduler(schedule)
+	return nil
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"testing"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/pkg/southbound"
+)
+
+func TestMaintenanceScheduler_Plan(t *testing.T) {
+	day := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) time.Time {
+		return day.Add(d)
+	}
+	tests := []struct {
+		name     string
+		schedule *maintenanceScheduler
+		earliest time.Time
+		deadline time.Time
+		due      time.Time
+		from, to time.Time
+	}{
+		{name: "no-schedule", earliest: at(time.Hour), deadline: at(10 * time.Hour), due: at(10 * time.Hour),
+			from: at(10 * time.Hour), to: at(10*time.Hour + 1)},
+		{name: "no-windows", schedule: newMaintenanceScheduler(MaintenanceSchedule{}), earliest: at(time.Hour),
+			deadline: at(10 * time.Hour), due: at(10 * time.Hour), from: at(time.Hour), to: at(10 * time.Hour)},
+		{name: "window", schedule: newMaintenanceScheduler(MaintenanceSchedule{Windows: []MaintenanceWindow{
+			{Start: 5 * time.Hour, Length: time.Hour}, {Start: 2 * time.Hour, Length: time.Hour}}}),
+			earliest: at(0), deadline: at(24 * time.Hour), due: at(23 * time.Hour),
+			from: at(2 * time.Hour), to: at(3 * time.Hour)},
+		{name: "past-midnight", schedule: newMaintenanceScheduler(MaintenanceSchedule{Windows: []MaintenanceWindow{
+			{Start: 23 * time.Hour, Length: 2 * time.Hour}}}),
+			earliest: at(30 * time.Minute), deadline: at(5 * time.Hour), due: at(5 * time.Hour),
+			from: at(30 * time.Minute), to: at(time.Hour)},
+		{name: "next-day", schedule: newMaintenanceScheduler(MaintenanceSchedule{Windows: []MaintenanceWindow{
+			{Start: 2 * time.Hour, Length: time.Hour}}}),
+			earliest: at(4 * time.Hour), deadline: at(36 * time.Hour), due: at(36 * time.Hour),
+			from: at(26 * time.Hour), to: at(27 * time.Hour)},
+		{name: "deadline-in-window", schedule: newMaintenanceScheduler(MaintenanceSchedule{
+			Windows: []MaintenanceWindow{{Start: 2 * time.Hour, Length: time.Hour}}}),
+			earliest: at(time.Hour), deadline: at(2*time.Hour + 30*time.Minute), due: at(2*time.Hour + 30*time.Minute),
+			from: at(2 * time.Hour), to: at(2*time.Hour + 30*time.Minute)},
+		{name: "no-window-in-time", schedule: newMaintenanceScheduler(MaintenanceSchedule{
+			Windows: []MaintenanceWindow{{Start: 2 * time.Hour, Length: time.Hour}}}),
+			earliest: at(4 * time.Hour), deadline: at(10 * time.Hour), due: at(10 * time.Hour),
+			from: at(4 * time.Hour), to: at(10 * time.Hour)},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			for i := 0; i < 50; i++ {
+				planned := subtest.schedule.plan(subtest.due, subtest.earliest, subtest.deadline)
+				if planned.Before(subtest.from) || !planned.Before(subtest.to) {
+					t.Fatalf("expected a time in [%s, %s); got %s", subtest.from, subtest.to, planned)
+				}
+			}
+		})
+	}
+}
+
+func TestMaintenanceScheduler_Delay(t *testing.T) {
+	var none *maintenanceScheduler
+	if none.delay() != 0 || newMaintenanceScheduler(MaintenanceSchedule{}).delay() != 0 {
+		t.Error("expected no delay without jitter")
+	}
+	scheduler := newMaintenanceScheduler(MaintenanceSchedule{Jitter: time.Second})
+	for i := 0; i < 50; i++ {
+		if delay := scheduler.delay(); delay < 0 || delay >= time.Second {
+			t.Fatalf("expected a delay less than the jitter; got %v", delay)
+		}
+	}
+}
+
+func TestThingGateway_SetMaintenanceSchedule(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule MaintenanceSchedule
+		valid    bool
+	}{
+		{name: "valid", valid: true, schedule: MaintenanceSchedule{Jitter: time.Minute,
+			Windows: []MaintenanceWindow{{Start: 22 * time.Hour, Length: 4 * time.Hour}}}},
+		{name: "negative-jitter", schedule: MaintenanceSchedule{Jitter: -time.Minute}},
+		{name: "late-start", schedule: MaintenanceSchedule{
+			Windows: []MaintenanceWindow{{Start: 24 * time.Hour, Length: time.Hour}}}},
+		{name: "empty-window", schedule: MaintenanceSchedule{
+			Windows: []MaintenanceWindow{{Start: time.Hour}}}},
+		{name: "long-window", schedule: MaintenanceSchedule{
+			Windows: []MaintenanceWindow{{Start: time.Hour, Length: 25 * time.Hour}}}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			err := (&ThingGateway{}).SetMaintenanceSchedule(subtest.schedule)
+			if subtest.valid && err != nil {
+				t.Error(err)
+			} else if !subtest.valid && err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestThingGateway_MaintenanceSchedule_ProxiedTokens(t *testing.T) {
+	gateway := testGateway(&mockClient{accessTokenFunc: func(string, string) ([]byte, error) {
+		return []byte(`{"access_token":"proxied-token","expires_in":3600}`), nil
+	}})
+	if err := gateway.SetMaintenanceSchedule(MaintenanceSchedule{}); err != nil {
+		t.Fatal(err)
+	}
+	adapter := &mockAdapter{name: "modbus", devices: []southbound.Device{{ID: "7"}},
+		forwarded: make(map[string][]string)}
+	if err := gateway.EnableAdapter(adapter, testProxyConfig()); err != nil {
+		t.Fatal(err)
+	}
+	proxy := gateway.proxies[0]
+	proxy.schedule = gateway.maintenance
+	proxy.proxy()
+	proxy.mutex.Lock()
+	due := proxy.devices["7"].tokenDue
+	proxy.mutex.Unlock()
+
+	// the refresh is planned in the second half of the lifetime of the token and before the refresh margin
+	if until := time.Until(due); until < 29*time.Minute || until > time.Hour-proxyTokenRefreshMargin {
+		t.Errorf("expected the token to be refreshed in the second half of its lifetime; due in %v", until)
+	}
+}
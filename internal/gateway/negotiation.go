@@ -0,0 +1,217 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/JacoJooste/iot-edge/v7/internal/debug"
+	"github.com/JacoJooste/iot-edge/v7/internal/jws"
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+)
+
+// Content negotiation design
+// A thing sends the payload of a thing endpoint request either wrapped with the session token, encoded as JSON or with
+// another registered codec, or as a JWT signed with its key that carries the session token in the csrf claim. Restricted (proof-of-possession) sessions
+// always require a signed JWT since AM verifies the signature against the key bound to the session and the gateway is
+// unable to sign on behalf of the thing. The Content-Format of the request is translated to the content type of the
+// AM request and the payload is forwarded unchanged.
+// The gateway can be configured to only accept plain JSON over trusted links, that is links that are bound to the
+// identity of the thing by OSCORE or by a verified client certificate. On other links the thing must sign its requests
+// so that they can't be altered on the way to AM. Requests in a format that is not accepted are answered with 4.15
+// Unsupported Content-Format. Policy decision requests are not subject to the policy since the AM policies endpoint
+// only accepts JSON.
+// Responses forwarded from AM are always JSON. A request with an Accept option for any other format is answered with
+// 4.06 Not Acceptable. The other structured payloads of requests, such as authentication payloads, are decoded with the
+// codec registered for their Content-Format and the gateway replies with the same codec.
+
+// ContentPolicy determines the formats in which the gateway accepts thing endpoint requests
+type ContentPolicy string
+
+const (
+	// ContentAny accepts JSON and signed JWT requests over any link. This is the default policy.
+	ContentAny ContentPolicy = "any"
+	// ContentSignedUntrusted accepts JSON requests over trusted links only, signed JWT requests over any link
+	ContentSignedUntrusted ContentPolicy = "signed-untrusted"
+	// ContentSigned only accepts signed JWT requests
+	ContentSigned ContentPolicy = "signed"
+)
+
+var (
+	errUnsupportedContentFormat = errors.New("unsupported content format")
+	errNotAcceptable            = errors.New("only JSON responses are supported")
+)
+
+// requestCodec returns the codec of the structured payload of the request. Requests without a Content-Format are JSON.
+func requestCodec(msg coap.Message) (client.Codec, error) {
+	coapFormat, ok := msg.Option(coap.ContentFormat).(coap.MediaType)
+	if !ok {
+		return client.JSONCodec, nil
+	}
+	codec, ok := client.CodecForFormat(uint16(coapFormat))
+	if !ok {
+		return nil, fmt.Errorf("%w `%v`", errUnsupportedContentFormat, coapFormat)
+	}
+	return codec, nil
+}
+
+// writeEncoded writes the reply encoded with the codec
+func writeEncoded(w coap.ResponseWriter, code codes.Code, codec client.Codec, reply interface{}) {
+	b, err := codec.Marshal(reply)
+	if err != nil {
+		debug.Errorf("Unable to encode reply; %s", err)
+		w.SetCode(codes.BadGateway)
+		writeResponse(w, []byte(err.Error()))
+		return
+	}
+	w.SetCode(code)
+	w.SetContentFormat(coap.MediaType(codec.ContentFormat()))
+	writeResponse(w, b)
+}
+
+// SetContentPolicy sets the formats in which thing endpoint requests are accepted.
+// Must be called before the CoAP server is started.
+func (c *ThingGateway) SetContentPolicy(policy ContentPolicy) error {
+	switch policy {
+	case ContentAny, ContentSignedUntrusted, ContentSigned:
+		c.contentPolicy = policy
+		return nil
+	default:
+		return fmt.Errorf("unsupported content policy `%s`", policy)
+	}
+}
+
+// trustedLink returns true if the request was received over a link that is bound to the identity of the thing
+func (c *ThingGateway) trustedLink(w coap.ResponseWriter) bool {
+	if _, protected := w.(*protectedResponseWriter); protected {
+		return true
+	}
+	// client certificates are verified during the handshake when trusted CAs are set
+	return c.clientCAs != nil && c.transport != TransportTCP
+}
+
+// accepts returns true if a request in the given content type is accepted by the content policy
+func (c *ThingGateway) accepts(w coap.ResponseWriter, content client.ContentType) bool {
+	if content == client.ApplicationJOSE {
+		return true
+	}
+	switch c.contentPolicy {
+	case ContentSigned:
+		return false
+	case ContentSignedUntrusted:
+		return c.trustedLink(w)
+	}
+	return true
+}
+
+// acceptable returns true if the Accept options of the request, if any, allow a JSON response
+func acceptable(msg coap.Message) bool {
+	accept := msg.Options(coap.Accept)
+	if len(accept) == 0 {
+		return true
+	}
+	for _, a := range accept {
+		if format, ok := a.(coap.MediaType); ok && format == coap.AppJSON {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeThingEndpointRequest returns the session token, the AM content type and the payload of a thing endpoint request
+func decodeThingEndpointRequest(msg coap.Message) (token string, content client.ContentType, payload string, err error) {
+	coapFormat, ok := msg.Option(coap.ContentFormat).(coap.MediaType)
+	if !ok {
+		return token, content, payload, fmt.Errorf("missing content format")
+	}
+
+	switch coapFormat {
+	case client.AppJOSE, client.AppDetachedJOSE:
+		content = client.ApplicationJOSE
+		payload = string(msg.Payload())
+		// AM only accepts signed requests in compact serialisation
+		if coapFormat == client.AppDetachedJOSE {
+			if payload, err = jws.AttachPayload(payload); err != nil {
+				return token, content, payload, err
+			}
+		}
+		// get SSO token from the CSRF claim in the JWT
+		var claims struct {
+			CSRF string `json:"csrf"`
+		}
+		if err := jws.ExtractClaims(payload, &claims); err != nil {
+			return token, content, payload, err
+		}
+		token = claims.CSRF
+	default:
+		// the wrapped payload is forwarded to AM as JSON whatever the codec of the wrapper
+		content = client.ApplicationJSON
+		codec, err := requestCodec(msg)
+		if err != nil {
+			return token, content, payload, err
+		}
+		var request client.ThingEndpointPayload
+		if err := codec.Unmarshal(msg.Payload(), &request); err != nil {
+			return token, content, payload, err
+		}
+		token = request.Token
+		payload = request.Payload
+	}
+	return token, content, payload, nil
+}
+
+// negotiate decodes a thing endpoint request and checks that both the request and the response formats are acceptable.
+// If not, an error response is written and false is returned.
+func (c *ThingGateway) negotiate(w coap.ResponseWriter, r *coap.Request) (token string, content client.ContentType,
+	payload string, ok bool) {
+	return c.negotiateContent(w, r, c.accepts)
+}
+
+// negotiateContent negotiates the request in the same way as negotiate but checks the content type of the request
+// with the given function instead of the content policy
+func (c *ThingGateway) negotiateContent(w coap.ResponseWriter, r *coap.Request,
+	accepts func(w coap.ResponseWriter, content client.ContentType) bool) (token string, content client.ContentType,
+	payload string, ok bool) {
+	if !acceptable(r.Msg) {
+		w.SetCode(codes.NotAcceptable)
+		writeResponse(w, []byte(errNotAcceptable.Error()))
+		return token, content, payload, false
+	}
+	token, content, payload, err := decodeThingEndpointRequest(r.Msg)
+	if err == nil && !accepts(w, content) {
+		err = fmt.Errorf("%w, the request must be signed", errUnsupportedContentFormat)
+	}
+	if err == nil {
+		err = c.access.checkSession(token)
+	}
+	switch {
+	case errors.Is(err, errUnsupportedContentFormat):
+		c.log.Trace("negotiate: ", err)
+		w.SetCode(codes.UnsupportedMediaType)
+	case errors.Is(err, errAccessDenied):
+		w.SetCode(codes.Forbidden)
+	case err != nil:
+		w.SetCode(codes.BadRequest)
+	default:
+		return token, content, payload, true
+	}
+	writeResponse(w, []byte(err.Error()))
+	return token, content, payload, false
+}
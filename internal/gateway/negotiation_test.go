@@ -0,0 +1,352 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	frcrypto "github.com/JacoJooste/iot-edge/v7/internal/crypto"
+	"github.com/JacoJooste/iot-edge/v7/internal/jws"
+	"github.com/JacoJooste/iot-edge/v7/pkg/amtest"
+	"github.com/JacoJooste/iot-edge/v7/pkg/builder"
+	"github.com/JacoJooste/iot-edge/v7/pkg/callback"
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+	"gopkg.in/square/go-jose.v2"
+)
+
+func TestGatewayServer_ContentPolicy(t *testing.T) {
+	const signed = ".eyJjc3JmIjoic2Vzc2lvbi0xIn0."
+	tests := []struct {
+		name     string
+		policy   ContentPolicy
+		content  client.ContentType
+		payload  string
+		rejected bool
+	}{
+		{name: "any-json", policy: ContentAny, content: client.ApplicationJSON},
+		{name: "any-jose", policy: ContentAny, content: client.ApplicationJOSE, payload: signed},
+		{name: "signed-untrusted-json", policy: ContentSignedUntrusted, content: client.ApplicationJSON,
+			rejected: true},
+		{name: "signed-untrusted-jose", policy: ContentSignedUntrusted, content: client.ApplicationJOSE,
+			payload: signed},
+		{name: "signed-json", policy: ContentSigned, content: client.ApplicationJSON, rejected: true},
+		{name: "signed-jose", policy: ContentSigned, content: client.ApplicationJOSE, payload: signed},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			var forwarded int32
+			gateway := testGateway(&mockClient{accessTokenFunc: func(string, string) ([]byte, error) {
+				atomic.StoreInt32(&forwarded, 1)
+				return []byte("{}"), nil
+			}})
+			if err := gateway.SetContentPolicy(subtest.policy); err != nil {
+				t.Fatal(err)
+			}
+			serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			if err := gateway.StartCOAPServer(":0", serverKey); err != nil {
+				t.Fatal(err)
+			}
+			defer gateway.ShutdownCOAPServer()
+
+			_, err := gatewayConnection(t, gateway).AccessToken("session-1", subtest.content, subtest.payload)
+			if subtest.rejected {
+				if !errors.Is(err, client.ErrUnsupportedContent) {
+					t.Errorf("expected unsupported content error; got %v", err)
+				}
+				if atomic.LoadInt32(&forwarded) == 1 {
+					t.Error("rejected request was forwarded to AM")
+				}
+				return
+			}
+			if err != nil || atomic.LoadInt32(&forwarded) != 1 {
+				t.Errorf("expected the request to be forwarded to AM; got %v", err)
+			}
+		})
+	}
+}
+
+// check that JSON policy decision requests are accepted by the signed policy since AM does not accept signed ones
+func TestGatewayServer_ContentPolicy_PolicyDecision(t *testing.T) {
+	var forwarded int32
+	gateway := testGateway(&mockClient{policyFunc: func(string, string) ([]byte, error) {
+		atomic.StoreInt32(&forwarded, 1)
+		return []byte("[]"), nil
+	}})
+	if err := gateway.SetContentPolicy(ContentSigned); err != nil {
+		t.Fatal(err)
+	}
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err := gateway.StartCOAPServer(":0", serverKey); err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.ShutdownCOAPServer()
+
+	_, err := gatewayConnection(t, gateway).PolicyDecision("session-1", client.ApplicationJSON, `{"resources":[]}`)
+	if err != nil || atomic.LoadInt32(&forwarded) != 1 {
+		t.Errorf("expected the request to be forwarded to AM; got %v", err)
+	}
+}
+
+func TestGatewayServer_ContentPolicy_Invalid(t *testing.T) {
+	if err := testGateway(&mockClient{}).SetContentPolicy("unsigned"); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestThingGateway_Accepts(t *testing.T) {
+	gateway := testGateway(&mockClient{})
+	if err := gateway.SetContentPolicy(ContentSignedUntrusted); err != nil {
+		t.Fatal(err)
+	}
+	// OSCORE binds the request to the thing so plain JSON is accepted
+	if !gateway.accepts(&protectedResponseWriter{}, client.ApplicationJSON) {
+		t.Error("expected JSON to be accepted over OSCORE")
+	}
+	if gateway.accepts(nil, client.ApplicationJSON) {
+		t.Error("expected JSON to be rejected over an untrusted link")
+	}
+}
+
+func TestGatewayServer_Negotiation(t *testing.T) {
+	gateway := testGateway(&mockClient{})
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err := gateway.StartCOAPServer(":0", serverKey); err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.ShutdownCOAPServer()
+
+	cert, _ := frcrypto.PublicKeyCertificate(clientKey)
+	conn, err := (&coap.Client{Net: "udp-dtls", DTLSConfig: dtlsClientConfig(cert)}).Dial(gateway.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	const payload = `{"token":"session-1"}`
+	tests := []struct {
+		name   string
+		format coap.MediaType
+		accept []coap.MediaType
+		code   codes.Code
+	}{
+		{name: "json", format: coap.AppJSON, code: codes.Changed},
+		{name: "accept-json", format: coap.AppJSON, accept: []coap.MediaType{coap.AppJSON}, code: codes.Changed},
+		{name: "accept-any-json", format: coap.AppJSON, accept: []coap.MediaType{coap.AppCBOR, coap.AppJSON},
+			code: codes.Changed},
+		{name: "accept-cbor", format: coap.AppJSON, accept: []coap.MediaType{coap.AppCBOR},
+			code: codes.NotAcceptable},
+		{name: "unsupported-format", format: coap.TextPlain, code: codes.UnsupportedMediaType},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			request, _ := conn.NewPostRequest("/accesstoken", subtest.format, strings.NewReader(payload))
+			for _, a := range subtest.accept {
+				request.AddOption(coap.Accept, a)
+			}
+			response, err := conn.Exchange(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.Code() != subtest.code {
+				t.Errorf("expected %v; got %v", subtest.code, response.Code())
+			}
+		})
+	}
+}
+
+// hexCodec encodes payloads as hex encoded JSON to test codecs other than JSON
+type hexCodec struct{}
+
+func (hexCodec) ContentType() client.ContentType {
+	return "application/x-hex-json"
+}
+
+func (hexCodec) ContentFormat() uint16 {
+	return 65001
+}
+
+func (hexCodec) Marshal(v interface{}) ([]byte, error) {
+	b, err := client.JSONCodec.Marshal(v)
+	return []byte(hex.EncodeToString(b)), err
+}
+
+func (hexCodec) Unmarshal(data []byte, v interface{}) error {
+	b, err := hex.DecodeString(string(data))
+	if err != nil {
+		return err
+	}
+	return client.JSONCodec.Unmarshal(b, v)
+}
+
+var registerHexCodec sync.Once
+
+func TestGatewayServer_Codec(t *testing.T) {
+	registerHexCodec.Do(func() {
+		if err := client.RegisterCodec(hexCodec{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	var mutex sync.Mutex
+	var forwarded string
+	gateway := testGateway(&mockClient{
+		AuthenticateFunc: func(auth client.AuthenticatePayload) (reply client.AuthenticatePayload, err error) {
+			reply.TokenID = "session-1"
+			return reply, nil
+		},
+		accessTokenFunc: func(token, payload string) ([]byte, error) {
+			mutex.Lock()
+			forwarded = token + " " + payload
+			mutex.Unlock()
+			return []byte(`{"access_token":"a"}`), nil
+		},
+	})
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err := gateway.StartCOAPServer(":0", serverKey); err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.ShutdownCOAPServer()
+
+	gwURL, _ := url.Parse("coap://" + gateway.Address())
+	connection, err := client.NewConnection().ConnectTo(gwURL).WithKey(clientKey).WithCodec(hexCodec{}).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := connection.Authenticate(client.AuthenticatePayload{})
+	if err != nil || reply.TokenID != "session-1" {
+		t.Fatalf("expected session-1; got %s, %v", reply.TokenID, err)
+	}
+	// the wrapped payload is forwarded to AM as JSON and the reply of AM is forwarded unchanged
+	token, err := connection.AccessToken(reply.TokenID, client.ApplicationJSON, `{"scope":["publish"]}`)
+	if err != nil || string(token) != `{"access_token":"a"}` {
+		t.Errorf("unexpected access token reply %s, %v", token, err)
+	}
+	mutex.Lock()
+	if forwarded != `session-1 {"scope":["publish"]}` {
+		t.Errorf("unexpected request forwarded to AM: %s", forwarded)
+	}
+	mutex.Unlock()
+	if valid, err := connection.ValidateSession(reply.TokenID); err != nil || !valid {
+		t.Errorf("expected a valid session; got %v, %v", valid, err)
+	}
+}
+
+func TestRegisterCodec_Invalid(t *testing.T) {
+	if err := client.RegisterCodec(client.JSONCodec); err == nil {
+		t.Error("expected an error when registering a second codec for JSON")
+	}
+}
+
+func TestGatewayServer_DetachedPayload(t *testing.T) {
+	signer, _ := jws.NewSigner(clientKey, nil)
+	object, _ := signer.Sign([]byte(`{"csrf":"session-1","scope":["publish"]}`))
+	signed, _ := object.CompactSerialize()
+	var mutex sync.Mutex
+	var forwarded, token string
+	gateway := testGateway(&mockClient{accessTokenFunc: func(tokenID string, payload string) ([]byte, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		token, forwarded = tokenID, payload
+		return []byte("{}"), nil
+	}})
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err := gateway.StartCOAPServer(":0", serverKey); err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.ShutdownCOAPServer()
+
+	gwURL, _ := url.Parse("coap://" + gateway.Address())
+	connection, err := client.NewConnection().
+		ConnectTo(gwURL).
+		WithKey(clientKey).
+		WithDetachedPayload().
+		Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = connection.AccessToken("session-1", client.ApplicationJOSE, signed); err != nil {
+		t.Fatal(err)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if forwarded != signed || token != "session-1" {
+		t.Errorf("expected the request to be forwarded to AM in compact serialisation; got %s", forwarded)
+	}
+}
+
+func TestThingGateway_ConstrainedThing(t *testing.T) {
+	server := &amtest.Server{
+		Realm: "/edge",
+		Trees: map[string]amtest.Tree{"auth-tree": {amtest.AuthenticateThing{}}},
+	}
+	server.Start()
+	defer server.Close()
+	jwk := func(key *ecdsa.PrivateKey) jose.JSONWebKeySet {
+		return jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: key.Public(), KeyID: "pop.cnf", Algorithm: string(jose.ES256), Use: "sig"}}}
+	}
+	gatewayKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	server.AddThing(amtest.Thing{ID: "gateway-1", Type: string(callback.TypeGateway), Keys: jwk(gatewayKey)})
+	thingKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	server.AddThing(amtest.Thing{ID: "thing-1", Type: string(callback.TypeDevice), Keys: jwk(thingKey),
+		Attributes: map[string][]string{"thingConfig": {"on"}}})
+
+	gateway := NewThingGateway(server.URL().String(), "/edge", "auth-tree", 5*time.Second, []callback.Handler{
+		callback.AuthenticateHandler{Audience: "/edge", ThingID: "gateway-1", KeyID: "pop.cnf", Key: gatewayKey}})
+	if err := gateway.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err := gateway.StartCOAPServer(":0", serverKey); err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.ShutdownCOAPServer()
+	u, _ := url.Parse("coap://" + gateway.Address())
+
+	// the thing exchanges CBOR and detached payloads with the gateway, which forwards JSON to AM
+	device, err := builder.Thing().
+		ConnectTo(u).
+		InRealm("/edge").
+		WithTree("auth-tree").
+		AuthenticateThing("thing-1", "/edge", "pop.cnf", thingKey, nil).
+		WithConstrainedMode().
+		Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	attributes, err := device.RequestAttributes("thingConfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config, _ := attributes.GetFirst("thingConfig"); config != "on" {
+		t.Errorf("expected the attributes of the thing; got %s", attributes.Content)
+	}
+	if _, err = device.RequestAccessToken("publish"); err != nil {
+		t.Fatal(err)
+	}
+}
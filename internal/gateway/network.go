@@ -0,0 +1,197 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+)
+
+// IPv6 and dual-stack
+// The network on which the CoAP server listens follows from the address given to StartCOAPServer:
+//    - an address without a host, such as ":5683", or the unspecified IPv6 address "[::]:5683" listens on all IPv4 and
+//      IPv6 addresses (dual-stack), unless the gateway is restricted to IPv6
+//    - the unspecified IPv4 address "0.0.0.0:5683" or any other IPv4 address listens on IPv4 only
+//    - any other IPv6 address listens on IPv6 only
+// Link-local IPv6 addresses are only unique on a link, so they must be scoped with the zone of their interface, for
+// example "[fe80::1%eth0]:5683". The unspecified address that a server listens on is not reachable by things, so
+// the gateway works out a reachable address from the addresses of its network interfaces. The reachable address is
+// returned by URL and used in the resource discovery response (RFC 6690) of the gateway.
+
+// wellKnownCore is the path of the CoAP resource discovery response
+const wellKnownCore = "/.well-known/core"
+
+// SetIPv6Only restricts the CoAP server to IPv6 addresses, which stops the server from listening on IPv4 addresses
+// when it listens on all addresses.
+// Must be called before the CoAP server is started.
+func (c *ThingGateway) SetIPv6Only(ipv6Only bool) {
+	c.ipv6Only = ipv6Only
+}
+
+// splitZone splits the zone from an IPv6 host
+func splitZone(host string) (ip, zone string) {
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		return host[:i], host[i+1:]
+	}
+	return host, ""
+}
+
+// listenNetwork returns the network, derived from the base network "udp" or "tcp", on which the server listens on the
+// address
+func (c *ThingGateway) listenNetwork(base, address string) (string, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	ipHost, zone := splitZone(host)
+	ip := net.ParseIP(ipHost)
+	switch {
+	case ip == nil && c.ipv6Only:
+		// an empty host or a host name
+		return base + "6", nil
+	case ip == nil:
+		return base, nil
+	case ip.To4() != nil && c.ipv6Only:
+		return "", fmt.Errorf("IPv4 address %s can not be used by a gateway restricted to IPv6", host)
+	case ip.To4() != nil:
+		return base + "4", nil
+	case ip.IsLinkLocalUnicast() && zone == "":
+		return "", fmt.Errorf("link-local address %s requires a zone, for example [%s%%eth0]", host, host)
+	case ip.IsUnspecified() && !c.ipv6Only:
+		return base, nil
+	default:
+		return base + "6", nil
+	}
+}
+
+// interfaceAddress is an address of a network interface
+type interfaceAddress struct {
+	ip   net.IP
+	zone string
+}
+
+// interfaceAddresses returns the addresses of the network interfaces that are up
+var interfaceAddresses = func() ([]interfaceAddress, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var addresses []interfaceAddress
+	for _, i := range interfaces {
+		if i.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := i.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok {
+				addresses = append(addresses, interfaceAddress{ip: n.IP, zone: i.Name})
+			}
+		}
+	}
+	return addresses, nil
+}
+
+// reachableHost returns a host, from the interface addresses, at which a server listening on the unspecified IP
+// address can be reached. Global IPv6 addresses are preferred, followed by IPv4 and then link-local IPv6 addresses.
+// The loopback address is returned if there is no other address.
+func reachableHost(unspecified net.IP, ipv6Only bool) (string, error) {
+	addresses, err := interfaceAddresses()
+	if err != nil {
+		return "", err
+	}
+	ipv4 := unspecified.To4() != nil
+	candidates := make([]string, 3)
+	for _, a := range addresses {
+		switch {
+		case a.ip.IsLoopback() || a.ip.IsMulticast() || a.ip.IsLinkLocalMulticast():
+		case a.ip.To4() != nil:
+			if !ipv6Only && candidates[1] == "" && !a.ip.IsLinkLocalUnicast() {
+				candidates[1] = a.ip.String()
+			}
+		case ipv4:
+		case a.ip.IsLinkLocalUnicast():
+			if candidates[2] == "" {
+				candidates[2] = a.ip.String() + "%" + a.zone
+			}
+		case candidates[0] == "":
+			candidates[0] = a.ip.String()
+		}
+	}
+	for _, host := range candidates {
+		if host != "" {
+			return host, nil
+		}
+	}
+	if ipv4 {
+		return net.IPv4(127, 0, 0, 1).String(), nil
+	}
+	return net.IPv6loopback.String(), nil
+}
+
+// coapScheme returns the URL scheme of the transport
+func coapScheme(transport Transport) string {
+	switch transport {
+	case TransportTLS:
+		return "coaps+tcp"
+	case TransportTCP:
+		return "coap+tcp"
+	default:
+		return "coaps"
+	}
+}
+
+// URL returns the URL at which things can reach the CoAP server, or an empty string if the server is not running.
+// If the server listens on all addresses then the URL contains an address of one of the network interfaces.
+func (c *ThingGateway) URL() string {
+	if c.address == nil {
+		return ""
+	}
+	host, port, err := net.SplitHostPort(c.address.String())
+	if err != nil {
+		return ""
+	}
+	ipHost, _ := splitZone(host)
+	if ip := net.ParseIP(ipHost); ip != nil && ip.IsUnspecified() {
+		if host, err = reachableHost(ip, c.ipv6Only); err != nil {
+			c.log.Errorf("Unable to find a reachable address; %s", err)
+			return ""
+		}
+	}
+	u := url.URL{Scheme: coapScheme(c.transport), Host: net.JoinHostPort(host, port)}
+	return u.String()
+}
+
+// discoveryHandler handles CoAP resource discovery requests, see RFC 6690
+func (c *ThingGateway) discoveryHandler(w coap.ResponseWriter, r *coap.Request) {
+	c.log.Trace("discoveryHandler")
+	base := c.URL()
+	links := make([]string, 0, len(c.routes()))
+	for _, route := range c.routes() {
+		links = append(links, "<"+base+route.path+">")
+	}
+	w.SetCode(codes.Content)
+	w.SetContentFormat(coap.AppLinkFormat)
+	writeResponse(w, []byte(strings.Join(links, ",")))
+}
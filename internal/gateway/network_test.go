@@ -0,0 +1,176 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+
+	frcrypto "github.com/JacoJooste/iot-edge/v7/internal/crypto"
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+)
+
+func TestThingGateway_listenNetwork(t *testing.T) {
+	tests := []struct {
+		name     string
+		address  string
+		ipv6Only bool
+		network  string
+	}{
+		{name: "no-host", address: ":5683", network: "udp"},
+		{name: "no-host-ipv6-only", address: ":5683", ipv6Only: true, network: "udp6"},
+		{name: "unspecified-ipv6", address: "[::]:5683", network: "udp"},
+		{name: "unspecified-ipv6-only", address: "[::]:5683", ipv6Only: true, network: "udp6"},
+		{name: "unspecified-ipv4", address: "0.0.0.0:5683", network: "udp4"},
+		{name: "ipv4", address: "192.0.2.1:5683", network: "udp4"},
+		{name: "ipv6", address: "[2001:db8::1]:5683", network: "udp6"},
+		{name: "link-local", address: "[fe80::1%eth0]:5683", network: "udp6"},
+		{name: "host-name", address: "localhost:5683", network: "udp"},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			gateway := testGateway(&mockClient{})
+			gateway.SetIPv6Only(subtest.ipv6Only)
+			network, err := gateway.listenNetwork("udp", subtest.address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if network != subtest.network {
+				t.Errorf("expected network %s; got %s", subtest.network, network)
+			}
+		})
+	}
+}
+
+func TestThingGateway_listenNetwork_Invalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		address  string
+		ipv6Only bool
+	}{
+		{name: "link-local-without-zone", address: "[fe80::1]:5683"},
+		{name: "ipv4-when-ipv6-only", address: "0.0.0.0:5683", ipv6Only: true},
+		{name: "no-port", address: "[::1]"},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			gateway := testGateway(&mockClient{})
+			gateway.SetIPv6Only(subtest.ipv6Only)
+			if _, err := gateway.listenNetwork("udp", subtest.address); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestReachableHost(t *testing.T) {
+	defer func(f func() ([]interfaceAddress, error)) {
+		interfaceAddresses = f
+	}(interfaceAddresses)
+	interfaceAddresses = func() ([]interfaceAddress, error) {
+		return []interfaceAddress{
+			{ip: net.IPv6loopback, zone: "lo"},
+			{ip: net.ParseIP("fe80::1"), zone: "eth0"},
+			{ip: net.ParseIP("192.0.2.1"), zone: "eth0"},
+			{ip: net.ParseIP("2001:db8::1"), zone: "eth1"},
+		}, nil
+	}
+	tests := []struct {
+		name        string
+		unspecified net.IP
+		ipv6Only    bool
+		host        string
+	}{
+		{name: "dual-stack", unspecified: net.IPv6unspecified, host: "2001:db8::1"},
+		{name: "ipv6-only", unspecified: net.IPv6unspecified, ipv6Only: true, host: "2001:db8::1"},
+		{name: "ipv4", unspecified: net.IPv4zero, host: "192.0.2.1"},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			host, err := reachableHost(subtest.unspecified, subtest.ipv6Only)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if host != subtest.host {
+				t.Errorf("expected host %s; got %s", subtest.host, host)
+			}
+		})
+	}
+
+	// a link-local address is only used when there is no other address and is scoped with its interface
+	interfaceAddresses = func() ([]interfaceAddress, error) {
+		return []interfaceAddress{{ip: net.ParseIP("fe80::1"), zone: "eth0"}}, nil
+	}
+	host, err := reachableHost(net.IPv6unspecified, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := url.URL{Scheme: "coaps", Host: net.JoinHostPort(host, "5683")}
+	if u.String() != "coaps://[fe80::1%25eth0]:5683" {
+		t.Errorf("unexpected URL %s", u.String())
+	}
+}
+
+func TestGatewayServer_IPv6(t *testing.T) {
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	gateway := testGateway(&mockClient{})
+	if err := gateway.StartCOAPServer("[::1]:0", serverKey); err != nil {
+		t.Skipf("IPv6 loopback is not available; %s", err)
+	}
+	defer gateway.ShutdownCOAPServer()
+
+	if !strings.HasPrefix(gateway.URL(), "coaps://[::1]:") {
+		t.Errorf("unexpected URL %s", gateway.URL())
+	}
+	if _, err := gatewayConnection(t, gateway).AMInfo(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGatewayServer_Discovery(t *testing.T) {
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	gateway := testGateway(&mockClient{})
+	if err := gateway.StartCOAPServer("127.0.0.1:0", serverKey); err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.ShutdownCOAPServer()
+
+	cert, _ := frcrypto.PublicKeyCertificate(clientKey)
+	conn, err := (&coap.Client{Net: "udp-dtls", DTLSConfig: dtlsClientConfig(cert)}).Dial(gateway.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	request, _ := conn.NewGetRequest(wellKnownCore)
+	response, err := conn.Exchange(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Code() != codes.Content || response.Option(coap.ContentFormat) != coap.AppLinkFormat {
+		t.Fatalf("unexpected response %v", response)
+	}
+	link := "<coaps://" + gateway.Address() + "/accesstoken>"
+	if !strings.Contains(string(response.Payload()), link) {
+		t.Errorf("expected link %s in %s", link, response.Payload())
+	}
+}
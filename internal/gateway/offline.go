@@ -0,0 +1,328 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/JacoJooste/iot-edge/v7/internal/clock"
+	"github.com/JacoJooste/iot-edge/v7/internal/debug"
+	"github.com/JacoJooste/iot-edge/v7/internal/jws"
+	"github.com/JacoJooste/iot-edge/v7/pkg/callback"
+	"github.com/dchest/uniuri"
+	"github.com/patrickmn/go-cache"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// Offline authentication
+// When AM is unreachable, the Thing Gateway can authenticate things that have recently been authenticated by AM.
+// The gateway learns the confirmation key of a thing from the JWK contained in the registration JWT of a successfully
+// completed authentication flow. While AM is unreachable, the gateway issues its own JWT PoP challenge and verifies
+// the signed response against the learnt key. Offline sessions are never forwarded to AM as valid sessions and every
+// offline decision is reported as an audit event so that it can be reconciled with AM once it is reachable again.
+
+const (
+	offlinePrefix        = "offline-"
+	authenticationCBID   = "jwt-pop-authentication"
+	registrationCBID     = "jwt-pop-registration"
+	offlineChallengeLife = 5 * time.Minute
+
+	// Audit event types
+	AuditOfflineAuthSuccess = "OFFLINE_AUTHENTICATION_SUCCESS"
+	AuditOfflineAuthFailure = "OFFLINE_AUTHENTICATION_FAILURE"
+)
+
+var errOfflineAuthentication = errors.New("offline authentication failed")
+
+// AuditEvent describes a decision made by the Thing Gateway without consulting AM
+type AuditEvent struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	ThingID string    `json:"thingId,omitempty"`
+	KeyID   string    `json:"kid,omitempty"`
+	Detail  string    `json:"detail,omitempty"`
+}
+
+func (e AuditEvent) String() string {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// AuditFunc receives audit events emitted by the Thing Gateway
+type AuditFunc func(event AuditEvent)
+
+// knownThing holds what the gateway has learnt about a thing from successful AM authentications
+type knownThing struct {
+	keys              map[string]jose.JSONWebKey
+	lastAuthenticated time.Time
+}
+
+// offlineAuthenticator authenticates things on behalf of AM while AM is unreachable
+type offlineAuthenticator struct {
+	gracePeriod time.Duration
+	audit       AuditFunc
+	challenges  *cache.Cache
+	sessions    *cache.Cache
+	mutex       sync.Mutex
+	things      map[string]*knownThing
+}
+
+func newOfflineAuthenticator(gracePeriod time.Duration, audit AuditFunc) *offlineAuthenticator {
+	if audit == nil {
+		audit = func(event AuditEvent) {
+			debug.Info("audit:", event)
+		}
+	}
+	return &offlineAuthenticator{
+		gracePeriod: gracePeriod,
+		audit:       audit,
+		challenges:  cache.New(offlineChallengeLife, 2*offlineChallengeLife),
+		sessions:    cache.New(gracePeriod, 2*gracePeriod),
+		things:      make(map[string]*knownThing),
+	}
+}
+
+// popClaims contains the claims of a JWT PoP callback response that are of interest to the gateway
+type popClaims struct {
+	Sub   string `json:"sub"`
+	Nonce string `json:"nonce"`
+	Exp   int64  `json:"exp"`
+	CNF   struct {
+		KID  string              `json:"kid,omitempty"`
+		JWK  *jose.JSONWebKey    `json:"jwk,omitempty"`
+		JWKS *jose.JSONWebKeySet `json:"jwks,omitempty"`
+	} `json:"cnf"`
+}
+
+// popResponses returns the signed JWTs found in the JWT PoP callbacks, indexed by callback ID
+func popResponses(callbacks []callback.Callback) map[string]string {
+	responses := make(map[string]string)
+	for _, cb := range callbacks {
+		id := cb.ID()
+		if (id != authenticationCBID && id != registrationCBID) || len(cb.Input) == 0 || cb.Input[0].Value == "" {
+			continue
+		}
+		responses[id] = cb.Input[0].Value
+	}
+	return responses
+}
+
+// learn records the confirmation keys and authentication time of things whose authentication flow has been
+// completed successfully by AM
+func (o *offlineAuthenticator) learn(callbacks []callback.Callback) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	for _, token := range popResponses(callbacks) {
+		var claims popClaims
+		if err := jws.ExtractClaims(token, &claims); err != nil || claims.Sub == "" {
+			continue
+		}
+		known, ok := o.things[claims.Sub]
+		if !ok {
+			known = &knownThing{keys: make(map[string]jose.JSONWebKey)}
+			o.things[claims.Sub] = known
+		}
+		known.lastAuthenticated = clock.Clock()
+		if claims.CNF.JWK != nil && claims.CNF.JWK.Valid() {
+			known.keys[claims.CNF.JWK.KeyID] = *claims.CNF.JWK
+		}
+		// AM has registered the additional keys of the thing together with the signing key
+		if claims.CNF.JWKS != nil {
+			for _, key := range claims.CNF.JWKS.Keys {
+				if key.Valid() && key.IsPublic() {
+					known.keys[key.KeyID] = key
+				}
+			}
+		}
+	}
+}
+
+// challenge returns an authentication payload containing a JWT PoP challenge issued by the gateway
+func (o *offlineAuthenticator) challenge() client.AuthenticatePayload {
+	nonce := uniuri.NewLen(32)
+	d := sha256.Sum256([]byte(nonce))
+	key := offlinePrefix + base64.StdEncoding.EncodeToString(d[:])
+	o.challenges.SetDefault(key, nonce)
+	return client.AuthenticatePayload{
+		AuthIDKey: key,
+		Callbacks: []callback.Callback{{
+			Type: callback.TypeHiddenValueCallback,
+			Output: []callback.Entry{
+				{Name: "value", Value: nonce},
+				{Name: "id", Value: authenticationCBID},
+			},
+			Input: []callback.Entry{{Name: "IDToken1", Value: ""}},
+		}},
+	}
+}
+
+// isOfflineKey returns true if the Auth ID key was issued by the offline authenticator
+func isOfflineKey(key string) bool {
+	return strings.HasPrefix(key, offlinePrefix)
+}
+
+// verify checks the thing's response to an offline challenge and, if successful, returns an offline session token
+func (o *offlineAuthenticator) verify(auth client.AuthenticatePayload) (reply client.AuthenticatePayload, err error) {
+	event := AuditEvent{Time: clock.Clock(), Type: AuditOfflineAuthFailure}
+	defer func() {
+		if err != nil {
+			event.Detail = err.Error()
+		}
+		o.audit(event)
+	}()
+
+	nonce, ok := o.challenges.Get(auth.AuthIDKey)
+	if !ok {
+		return reply, fmt.Errorf("%w: unknown or expired challenge", errOfflineAuthentication)
+	}
+	o.challenges.Delete(auth.AuthIDKey)
+
+	token, ok := popResponses(auth.Callbacks)[authenticationCBID]
+	if !ok {
+		return reply, fmt.Errorf("%w: missing challenge response", errOfflineAuthentication)
+	}
+	var claims popClaims
+	if err = jws.ExtractClaims(token, &claims); err != nil {
+		return reply, fmt.Errorf("%w: %s", errOfflineAuthentication, err)
+	}
+	event.ThingID, event.KeyID = claims.Sub, claims.CNF.KID
+
+	o.mutex.Lock()
+	known, ok := o.things[claims.Sub]
+	var key jose.JSONWebKey
+	var lastAuthenticated time.Time
+	if ok {
+		key, ok = known.keys[claims.CNF.KID]
+		lastAuthenticated = known.lastAuthenticated
+	}
+	o.mutex.Unlock()
+	if !ok {
+		return reply, fmt.Errorf("%w: no cached confirmation key", errOfflineAuthentication)
+	}
+
+	now := clock.Clock()
+	if now.Sub(lastAuthenticated) > o.gracePeriod {
+		return reply, fmt.Errorf("%w: grace period has expired", errOfflineAuthentication)
+	}
+	object, err := jose.ParseSigned(token)
+	if err != nil {
+		return reply, fmt.Errorf("%w: %s", errOfflineAuthentication, err)
+	}
+	if _, err = object.Verify(key.Public().Key); err != nil {
+		return reply, fmt.Errorf("%w: %s", errOfflineAuthentication, err)
+	}
+	if claims.Nonce != nonce {
+		return reply, fmt.Errorf("%w: incorrect nonce", errOfflineAuthentication)
+	}
+	if claims.Exp != 0 && now.Unix() >= claims.Exp {
+		return reply, fmt.Errorf("%w: expired JWT", errOfflineAuthentication)
+	}
+
+	reply.TokenID = offlinePrefix + uniuri.NewLen(32)
+	o.sessions.Set(reply.TokenID, claims.Sub, o.gracePeriod-now.Sub(lastAuthenticated))
+	event.Type = AuditOfflineAuthSuccess
+	return reply, nil
+}
+
+// validSession returns true if the token belongs to an unexpired offline session
+func (o *offlineAuthenticator) validSession(token string) bool {
+	_, ok := o.sessions.Get(token)
+	return ok
+}
+
+// logout removes the offline session
+func (o *offlineAuthenticator) logout(token string) {
+	o.sessions.Delete(token)
+}
+
+// describe adds what the authenticator has learnt about things to the cached things
+func (o *offlineAuthenticator) describe(things map[string]*CachedThing) {
+	o.mutex.Lock()
+	for id, known := range o.things {
+		thing := cachedThing(things, id)
+		thing.LastAuthenticated = known.lastAuthenticated
+		for kid := range known.keys {
+			thing.KeyIDs = append(thing.KeyIDs, kid)
+		}
+	}
+	o.mutex.Unlock()
+	for _, item := range o.sessions.Items() {
+		if id, ok := item.Object.(string); ok {
+			cachedThing(things, id).OfflineSessions++
+		}
+	}
+}
+
+// evict forgets the thing and ends its offline sessions. Returns false if the thing was not known.
+func (o *offlineAuthenticator) evict(thingID string) bool {
+	o.mutex.Lock()
+	_, found := o.things[thingID]
+	delete(o.things, thingID)
+	o.mutex.Unlock()
+	for token, item := range o.sessions.Items() {
+		if id, ok := item.Object.(string); ok && id == thingID {
+			o.sessions.Delete(token)
+			found = true
+		}
+	}
+	return found
+}
+
+// revoke ends the offline sessions of the thing and prevents it from being authenticated offline until it has been
+// authenticated by AM again
+func (o *offlineAuthenticator) revoke(thingID string) {
+	o.mutex.Lock()
+	if known, ok := o.things[thingID]; ok {
+		known.lastAuthenticated = time.Time{}
+	}
+	o.mutex.Unlock()
+	for token, item := range o.sessions.Items() {
+		if id, ok := item.Object.(string); ok && id == thingID {
+			o.sessions.Delete(token)
+		}
+	}
+}
+
+// flush forgets all things and ends all offline sessions and challenges
+func (o *offlineAuthenticator) flush() {
+	o.mutex.Lock()
+	o.things = make(map[string]*knownThing)
+	o.mutex.Unlock()
+	o.sessions.Flush()
+	o.challenges.Flush()
+}
+
+// EnableOfflineAuthentication allows the Thing Gateway to authenticate things while AM is unreachable.
+// Only things that have completed an authentication flow with AM, and whose confirmation key has been seen by the
+// gateway during registration, will be authenticated. The thing must have been authenticated by AM within the grace
+// period. All offline authentication decisions are passed to the audit function for later reconciliation, if no
+// function is provided then the events are written to the debug logger.
+// Must be called before the CoAP server is started.
+func (c *ThingGateway) EnableOfflineAuthentication(gracePeriod time.Duration, audit AuditFunc) {
+	c.offline = newOfflineAuthenticator(gracePeriod, audit)
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/JacoJooste/iot-edge/v7/internal/clock"
+	"github.com/JacoJooste/iot-edge/v7/pkg/callback"
+)
+
+var errTestAMUnreachable = fmt.Errorf("%w: connection refused", client.ErrAMUnreachable)
+
+// testOfflineGateway returns a gateway that has learnt the confirmation key of the thing through a registration and
+// a pointer to a flag that controls whether AM is reachable
+func testOfflineGateway(t *testing.T, handler callback.AuthenticateHandler, events *[]AuditEvent) (*ThingGateway, *bool) {
+	reachable := true
+	m := &mockClient{
+		AuthenticateFunc: func(payload client.AuthenticatePayload) (reply client.AuthenticatePayload, err error) {
+			if !reachable {
+				return reply, errTestAMUnreachable
+			}
+			reply.TokenID = "12345"
+			return reply, nil
+		}}
+	gateway := testGateway(m)
+	gateway.EnableOfflineAuthentication(time.Hour, func(event AuditEvent) {
+		*events = append(*events, event)
+	})
+
+	regCB := callback.Callback{
+		Type:   callback.TypeHiddenValueCallback,
+		Output: []callback.Entry{{Name: "id", Value: registrationCBID}, {Name: "value", Value: "1"}},
+		Input:  make([]callback.Entry, 1),
+	}
+	_, err := callback.RegisterHandler{
+		Audience:  handler.Audience,
+		ThingID:   handler.ThingID,
+		ThingType: callback.TypeDevice,
+		KeyID:     handler.KeyID,
+		Key:       handler.Key,
+	}.Handle(regCB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := gateway.authenticate(gateway.amConnection, client.AuthenticatePayload{Callbacks: []callback.Callback{regCB}})
+	if err != nil || !reply.HasSessionToken() {
+		t.Fatal("online registration failed", err)
+	}
+	return gateway, &reachable
+}
+
+func testOfflineAuthenticate(gateway *ThingGateway, handler callback.Handler) (client.AuthenticatePayload, error) {
+	reply, err := gateway.authenticate(gateway.amConnection, client.AuthenticatePayload{})
+	if err != nil {
+		return reply, err
+	}
+	for _, cb := range reply.Callbacks {
+		if _, err := handler.Handle(cb); err != nil {
+			return reply, err
+		}
+	}
+	return gateway.authenticate(gateway.amConnection, reply)
+}
+
+func TestGateway_OfflineAuthentication(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	handler := callback.AuthenticateHandler{Audience: "/", ThingID: "Bob", KeyID: "pop.cnf", Key: key}
+	defer func() {
+		clock.Clock = clock.DefaultClock()
+	}()
+
+	tests := []struct {
+		name       string
+		successful bool
+		handler    callback.AuthenticateHandler
+		elapsed    time.Duration
+	}{
+		{name: "success", successful: true, handler: handler},
+		{name: "grace-period-expired", handler: handler, elapsed: 2 * time.Hour},
+		{name: "unknown-thing", handler: callback.AuthenticateHandler{Audience: "/", ThingID: "Alice", KeyID: "pop.cnf", Key: key}},
+		{name: "unknown-key-id", handler: callback.AuthenticateHandler{Audience: "/", ThingID: "Bob", KeyID: "other", Key: key}},
+		{name: "wrong-key", handler: callback.AuthenticateHandler{Audience: "/", ThingID: "Bob", KeyID: "pop.cnf", Key: otherKey}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			clock.Clock = clock.DefaultClock()
+			var events []AuditEvent
+			gateway, reachable := testOfflineGateway(t, handler, &events)
+			*reachable = false
+			clock.Clock = func() time.Time {
+				return time.Now().Add(subtest.elapsed)
+			}
+			reply, err := testOfflineAuthenticate(gateway, subtest.handler)
+			if len(events) != 1 {
+				t.Fatalf("Expected a single audit event, got %v", events)
+			}
+			if !subtest.successful {
+				if err == nil {
+					t.Error("Expected an error")
+				}
+				if events[0].Type != AuditOfflineAuthFailure {
+					t.Errorf("Expected audit event type %s, got %s", AuditOfflineAuthFailure, events[0].Type)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reply.HasSessionToken() || !gateway.offline.validSession(reply.TokenID) {
+				t.Error("Expected a valid offline session")
+			}
+			if events[0].Type != AuditOfflineAuthSuccess || events[0].ThingID != handler.ThingID {
+				t.Errorf("Unexpected audit event %v", events[0])
+			}
+		})
+	}
+}
+
+// check that AM rejecting a thing does not trigger offline authentication
+func TestGateway_OfflineAuthentication_NotWhenAMRejects(t *testing.T) {
+	m := &mockClient{
+		AuthenticateFunc: func(payload client.AuthenticatePayload) (reply client.AuthenticatePayload, err error) {
+			return reply, client.ErrUnauthorised
+		}}
+	gateway := testGateway(m)
+	gateway.EnableOfflineAuthentication(time.Hour, nil)
+	reply, err := gateway.authenticate(gateway.amConnection, client.AuthenticatePayload{})
+	if err == nil {
+		t.Errorf("Expected an error, got reply %v", reply)
+	}
+}
@@ -0,0 +1,321 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/JacoJooste/iot-edge/v7/internal/oscore"
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// OSCORE design
+// A thing requests a security context by posting a JWT signed with its confirmation key that contains an ephemeral
+// public key. The gateway verifies the signature with the confirmation key in the JWT and forwards the JWT to AM as an
+// attributes request, which AM only accepts if the key is registered for the thing. The master secret is agreed with
+// ECDH and the context is bound to the confirmation key by using its JWK thumbprint as the ID context.
+
+const oscoreSaltLength = 8
+
+// oscoreContexts holds the OSCORE security contexts established with things
+type oscoreContexts struct {
+	mu sync.Mutex
+	// contexts by the ID of the thing
+	contexts map[string]*oscore.Context
+	// ID of the thing by ID context, so that a thing that re-establishes a context replaces its previous context
+	ids map[string]string
+	// name of the thing's identity by the ID of the thing
+	names  map[string]string
+	nextID uint32
+}
+
+// add creates a security context for the named thing bound to the given ID context
+func (s *oscoreContexts) add(secret, salt, idContext []byte, name string) (*oscore.Context, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.contexts == nil {
+		s.contexts = make(map[string]*oscore.Context)
+		s.ids = make(map[string]string)
+		s.names = make(map[string]string)
+	}
+	if id, ok := s.ids[string(idContext)]; ok {
+		delete(s.contexts, id)
+		delete(s.names, id)
+	}
+	s.nextID++
+	var thingID []byte
+	for n := s.nextID; n > 0; n >>= 8 {
+		thingID = append([]byte{byte(n)}, thingID...)
+	}
+	// the gateway uses the empty sender ID for all contexts as responses are bound to requests
+	securityContext, err := oscore.NewContext(secret, salt, []byte{}, thingID, idContext)
+	if err != nil {
+		return nil, err
+	}
+	s.contexts[string(thingID)] = securityContext
+	s.ids[string(idContext)] = string(thingID)
+	if name != "" {
+		s.names[string(thingID)] = name
+	}
+	return securityContext, nil
+}
+
+// describe adds the number of security contexts of each named thing to the cached things
+func (s *oscoreContexts) describe(things map[string]*CachedThing) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range s.names {
+		cachedThing(things, name).OSCOREContexts++
+	}
+}
+
+// evict removes the security contexts of the named thing. Returns false if the thing has no contexts.
+func (s *oscoreContexts) evict(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	found := false
+	for idContext, id := range s.ids {
+		if s.names[id] == name {
+			delete(s.contexts, id)
+			delete(s.names, id)
+			delete(s.ids, idContext)
+			found = true
+		}
+	}
+	return found
+}
+
+// flush removes all security contexts
+func (s *oscoreContexts) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.contexts = nil
+	s.ids = nil
+	s.names = nil
+}
+
+// get returns the security context for the thing with the given ID
+func (s *oscoreContexts) get(thingID []byte) (*oscore.Context, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	securityContext, ok := s.contexts[string(thingID)]
+	return securityContext, ok
+}
+
+// verifyOSCOREClaims verifies that the request is signed with the confirmation key contained in its claims
+func verifyOSCOREClaims(request string) (claims client.OSCOREClaims, err error) {
+	token, err := jwt.ParseSigned(request)
+	if err != nil {
+		return claims, err
+	}
+	if err = token.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		return claims, err
+	}
+	if claims.Confirmation.JWK.Key == nil || !claims.Confirmation.JWK.IsPublic() {
+		return claims, errors.New("missing confirmation key")
+	}
+	if err = token.Claims(claims.Confirmation.JWK.Key, &claims); err != nil {
+		return claims, err
+	}
+	return claims, nil
+}
+
+// oscoreHandler handles requests for OSCORE security contexts
+func (c *ThingGateway) oscoreHandler(w coap.ResponseWriter, r *coap.Request) {
+	c.log.Trace("oscoreHandler")
+
+	token, content, payload, err := decodeThingEndpointRequest(r.Msg)
+	if err == nil && content != client.ApplicationJOSE {
+		err = fmt.Errorf("a signed JWT is required")
+	}
+	if err != nil {
+		w.SetCode(codes.BadRequest)
+		writeResponse(w, []byte(err.Error()))
+		return
+	}
+	claims, err := verifyOSCOREClaims(payload)
+	if err != nil {
+		c.log.Errorf("Unable to verify OSCORE request; %s", err)
+		w.SetCode(codes.BadRequest)
+		writeResponse(w, []byte(err.Error()))
+		return
+	}
+	thingKey, ok := claims.EphemeralKey.Key.(*ecdsa.PublicKey)
+	if !ok {
+		w.SetCode(codes.BadRequest)
+		writeResponse(w, []byte("unsupported ephemeral key"))
+		return
+	}
+	// AM verifies the signature with the key registered for the thing
+	attributes, err := c.transaction(r).Attributes(token, content, payload, nil)
+	if err != nil {
+		writeError(w, err, codes.Unauthorized)
+		return
+	}
+	// the name of the thing's identity is recorded so that its contexts can be evicted by the administrator
+	var identity struct {
+		ID string `json:"_id"`
+	}
+	_ = json.Unmarshal(attributes, &identity)
+
+	reply, err := c.establishOSCORE(claims, thingKey, identity.ID)
+	if err != nil {
+		c.log.Errorf("Unable to establish OSCORE context; %s", err)
+		w.SetCode(codes.BadRequest)
+		writeResponse(w, []byte(err.Error()))
+		return
+	}
+	b, err := json.Marshal(reply)
+	if err != nil {
+		w.SetCode(codes.InternalServerError)
+		writeResponse(w, []byte(err.Error()))
+		return
+	}
+	w.SetCode(codes.Changed)
+	writeResponse(w, b)
+	c.log.Trace("oscoreHandler: success")
+}
+
+// establishOSCORE agrees the master secret with the ephemeral key of the thing and creates a security context
+func (c *ThingGateway) establishOSCORE(claims client.OSCOREClaims, thingKey *ecdsa.PublicKey, name string) (reply client.OSCOREPayload, err error) {
+	if thingKey.Curve != elliptic.P256() {
+		return reply, errors.New("ephemeral key must use the P-256 curve")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return reply, err
+	}
+	secret, err := oscore.SharedSecret(key, thingKey)
+	if err != nil {
+		return reply, err
+	}
+	idContext, err := oscore.IDContext(claims.Confirmation.JWK.Key)
+	if err != nil {
+		return reply, err
+	}
+	salt := make([]byte, oscoreSaltLength)
+	if _, err = rand.Read(salt); err != nil {
+		return reply, err
+	}
+	securityContext, err := c.oscore.add(secret, salt, idContext, name)
+	if err != nil {
+		return reply, err
+	}
+	reply.EphemeralKey.Key = key.Public()
+	reply.Salt = salt
+	reply.SenderID = securityContext.RecipientID()
+	reply.RecipientID = securityContext.SenderID()
+	return reply, nil
+}
+
+// protectedResponseWriter collects the response written by a handler so that it can be protected with OSCORE
+type protectedResponseWriter struct {
+	coap.ResponseWriter
+	code          *codes.Code
+	contentFormat *coap.MediaType
+	payload       []byte
+}
+
+func (w *protectedResponseWriter) SetCode(code codes.Code) {
+	w.code = &code
+}
+
+func (w *protectedResponseWriter) SetContentFormat(contentFormat coap.MediaType) {
+	w.contentFormat = &contentFormat
+}
+
+func (w *protectedResponseWriter) Write(p []byte) (n int, err error) {
+	w.payload = append(w.payload, p...)
+	return len(p), nil
+}
+
+func (w *protectedResponseWriter) WriteWithContext(_ context.Context, p []byte) (n int, err error) {
+	return w.Write(p)
+}
+
+// responseCode returns the code set by the handler or the default code for the request
+func (w *protectedResponseWriter) responseCode(request codes.Code) codes.Code {
+	if w.code != nil {
+		return *w.code
+	}
+	switch request {
+	case codes.POST:
+		return codes.Changed
+	case codes.PUT:
+		return codes.Created
+	case codes.DELETE:
+		return codes.Deleted
+	}
+	return codes.Content
+}
+
+// unprotect returns a handler that verifies and decrypts OSCORE protected requests before passing them to the given
+// handler and protects the response. Requests without the OSCORE option are passed on unchanged.
+func (c *ThingGateway) unprotect(next coap.Handler) coap.HandlerFunc {
+	return func(w coap.ResponseWriter, r *coap.Request) {
+		if !oscore.IsProtected(r.Msg) {
+			next.ServeCOAP(w, r)
+			return
+		}
+		thingID, _ := oscore.KeyID(r.Msg)
+		securityContext, ok := c.oscore.get(thingID)
+		if !ok {
+			w.SetCode(codes.Unauthorized)
+			writeResponse(w, []byte(oscore.ErrContextNotFound.Error()))
+			return
+		}
+		exchange, err := securityContext.UnprotectRequest(r.Msg)
+		if err != nil {
+			c.log.Errorf("Unable to unprotect OSCORE request; %s", err)
+			if errors.Is(err, oscore.ErrReplay) {
+				w.SetCode(codes.Unauthorized)
+			} else {
+				w.SetCode(codes.BadRequest)
+			}
+			writeResponse(w, []byte(err.Error()))
+			return
+		}
+
+		writer := &protectedResponseWriter{ResponseWriter: w}
+		next.ServeCOAP(writer, r)
+
+		response := w.NewResponse(writer.responseCode(r.Msg.Code()))
+		if writer.contentFormat != nil {
+			response.SetOption(coap.ContentFormat, *writer.contentFormat)
+		}
+		response.SetPayload(writer.payload)
+		if err = securityContext.ProtectResponse(exchange, response); err != nil {
+			c.log.Errorf("Unable to protect OSCORE response; %s", err)
+			w.SetCode(codes.InternalServerError)
+			writeResponse(w, nil)
+			return
+		}
+		if err = w.WriteMsg(response); err != nil {
+			c.log.Error(err)
+		}
+	}
+}
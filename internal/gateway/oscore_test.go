@@ -0,0 +1,151 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/JacoJooste/iot-edge/v7/internal/jws"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// testOSCORERequest creates a request for an OSCORE security context signed with the confirmation key
+func testOSCORERequest(t *testing.T, signer crypto.Signer, confirmation crypto.PublicKey, ephemeral *ecdsa.PrivateKey) string {
+	sig, err := jws.NewSigner(signer, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims client.OSCOREClaims
+	claims.Confirmation.JWK = jose.JSONWebKey{Key: confirmation}
+	claims.EphemeralKey = jose.JSONWebKey{Key: ephemeral.Public()}
+	request, err := jwt.Signed(sig).Claims(claims).Claims(struct {
+		CSRF string `json:"csrf"`
+	}{CSRF: "token"}).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return request
+}
+
+func TestGatewayServer_OSCORE(t *testing.T) {
+	thingKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	large := strings.Repeat("a", 2*client.DefaultBlockSize)
+	tests := []struct {
+		name         string
+		signer       crypto.Signer
+		registered   bool
+		successful   bool
+		confirmation crypto.PublicKey
+	}{
+		{name: "success", signer: thingKey, confirmation: thingKey.Public(), registered: true, successful: true},
+		{name: "unregistered-key", signer: thingKey, confirmation: thingKey.Public()},
+		{name: "wrong-confirmation-key", signer: thingKey, confirmation: otherKey.Public(), registered: true},
+	}
+	for _, subtest := range tests {
+		// the handlers of the gateway may still be running when the next subtest starts
+		subtest := subtest
+		t.Run(subtest.name, func(t *testing.T) {
+			var mutex sync.Mutex
+			var payloads []string
+			m := &mockClient{
+				attributesFunc: func(token string, payload string, names []string) ([]byte, error) {
+					mutex.Lock()
+					payloads = append(payloads, payload)
+					mutex.Unlock()
+					if !subtest.registered {
+						return nil, client.AMError{Code: 401, Reason: "Unauthorized", Message: "invalid signature"}
+					}
+					return []byte("{}"), nil
+				},
+				policyFunc: func(token string, payload string) ([]byte, error) {
+					return []byte(payload), nil
+				},
+			}
+			serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			gateway := testGateway(m)
+			if err := gateway.StartCOAPServer(":0", serverKey); err != nil {
+				t.Fatal(err)
+			}
+			defer gateway.ShutdownCOAPServer()
+
+			connection := gatewayConnection(t, gateway)
+			ephemeral, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			request := testOSCORERequest(t, subtest.signer, subtest.confirmation, ephemeral)
+			err := client.EstablishOSCORE(connection, request, ephemeral, subtest.confirmation)
+			if !subtest.successful {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			mutex.Lock()
+			verified := len(payloads) == 1 && payloads[0] == request
+			mutex.Unlock()
+			if !verified {
+				t.Fatal("expected the request to be verified by AM")
+			}
+
+			// protected requests and responses, including those transferred in blocks, reach their destination
+			reply, err := connection.PolicyDecision("token", client.ApplicationJSON, large)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(reply) != large {
+				t.Error("incomplete reply")
+			}
+			if _, err = connection.AMInfo(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// check that a thing receives an error if the gateway does not have its security context
+func TestGatewayServer_OSCORE_ContextNotFound(t *testing.T) {
+	thingKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	gateway := testGateway(&mockClient{})
+	if err := gateway.StartCOAPServer(":0", serverKey); err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.ShutdownCOAPServer()
+
+	connection := gatewayConnection(t, gateway)
+	ephemeral, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	request := testOSCORERequest(t, thingKey, thingKey.Public(), ephemeral)
+	if err := client.EstablishOSCORE(connection, request, ephemeral, thingKey.Public()); err != nil {
+		t.Fatal(err)
+	}
+	// simulate a gateway restart
+	gateway.oscore.flush()
+	if _, err := connection.AMInfo(); !errors.Is(err, client.ErrUnauthorised) {
+		t.Errorf("expected %v, got %v", client.ErrUnauthorised, err)
+	}
+}
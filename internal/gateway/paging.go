@@ -0,0 +1,237 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+	"github.com/patrickmn/go-cache"
+)
+
+// Attribute pages
+// AM returns all the requested attributes of a thing in a single document, which a constrained thing with a large
+// number of attributes may not be able to hold in memory. The gateway reads the document from AM once and serves it
+// to the thing in pages of at most the requested number of attributes, each of which is transferred block-wise if
+// needed. The gateway keeps a snapshot of the document so that all the pages are consistent and AM is not read again.
+// The reply to each request contains the continuation token of the next page, which identifies the snapshot and the
+// offset of the page. A snapshot is bound to the session that requested it, expires if the next page is not requested
+// in time and is removed once the last page has been served. Attributes whose names start with an underscore, such
+// as the ID of the thing, are included in every page.
+
+const (
+	// RouteAttributePage is the route at which things request pages of attributes
+	RouteAttributePage = "/attributepage"
+
+	defaultAttributePageSize = 20
+	// attributeSnapshotLife is the time for which a snapshot is kept after a page has been served
+	attributeSnapshotLife = time.Minute
+)
+
+var errContinuation = errors.New("invalid or expired continuation token")
+
+// attributeSnapshot holds the attributes of a thing that are served in pages
+type attributeSnapshot struct {
+	session string
+	// meta attributes are included in every page
+	meta   map[string]json.RawMessage
+	names  []string
+	values map[string]json.RawMessage
+}
+
+// attributePages holds the snapshots of the attributes that are being served in pages
+type attributePages struct {
+	snapshots *cache.Cache
+}
+
+func newAttributePages() *attributePages {
+	return &attributePages{snapshots: cache.New(attributeSnapshotLife, attributeSnapshotLife)}
+}
+
+// forget the snapshots of the session
+func (p *attributePages) forget(session string) {
+	if p == nil {
+		return
+	}
+	for id, item := range p.snapshots.Items() {
+		if item.Object.(*attributeSnapshot).session == session {
+			p.snapshots.Delete(id)
+		}
+	}
+}
+
+// newAttributeSnapshot creates a snapshot of the attributes document returned by AM
+func newAttributeSnapshot(session string, document []byte) (*attributeSnapshot, error) {
+	var attributes map[string]json.RawMessage
+	if err := json.Unmarshal(document, &attributes); err != nil {
+		return nil, err
+	}
+	snapshot := &attributeSnapshot{
+		session: session,
+		meta:    make(map[string]json.RawMessage),
+		values:  attributes,
+	}
+	for name, value := range attributes {
+		if strings.HasPrefix(name, "_") {
+			snapshot.meta[name] = value
+			delete(attributes, name)
+			continue
+		}
+		snapshot.names = append(snapshot.names, name)
+	}
+	sort.Strings(snapshot.names)
+	return snapshot, nil
+}
+
+// page returns the page of attributes that starts at the offset and the offset of the next page, or zero if the page
+// is the last
+func (s *attributeSnapshot) page(offset, size int) (page map[string]json.RawMessage, next int) {
+	page = make(map[string]json.RawMessage, len(s.meta)+size)
+	for name, value := range s.meta {
+		page[name] = value
+	}
+	end := offset + size
+	if end >= len(s.names) {
+		end = len(s.names)
+	} else {
+		next = end
+	}
+	for _, name := range s.names[offset:end] {
+		page[name] = s.values[name]
+	}
+	return page, next
+}
+
+// continuationToken returns the token of the page at the offset of the snapshot
+func continuationToken(id string, offset int) string {
+	return id + "." + strconv.Itoa(offset)
+}
+
+// parseContinuationToken returns the snapshot ID and offset of the page identified by the token
+func parseContinuationToken(token string) (id string, offset int, err error) {
+	i := strings.LastIndex(token, ".")
+	if i < 1 {
+		return "", 0, errContinuation
+	}
+	offset, err = strconv.Atoi(token[i+1:])
+	if err != nil || offset < 0 {
+		return "", 0, errContinuation
+	}
+	return token[:i], offset, nil
+}
+
+// serve returns the page identified by the continuation token, the snapshot is created with the given function if the
+// token is empty
+func (p *attributePages) serve(session, token string, size int, snapshot func() (*attributeSnapshot, error)) (
+	reply []byte, err error) {
+	var id string
+	var offset int
+	var s *attributeSnapshot
+	if token == "" {
+		if s, err = snapshot(); err != nil {
+			return nil, err
+		}
+		id = client.NewTransactionID()
+	} else {
+		if id, offset, err = parseContinuationToken(token); err != nil {
+			return nil, err
+		}
+		item, ok := p.snapshots.Get(id)
+		if !ok {
+			return nil, errContinuation
+		}
+		s = item.(*attributeSnapshot)
+		if s.session != session || offset > len(s.names) {
+			return nil, errContinuation
+		}
+	}
+
+	page, next := s.page(offset, size)
+	attributes, err := json.Marshal(page)
+	if err != nil {
+		return nil, err
+	}
+	payload := client.AttributesPagePayload{Attributes: attributes}
+	if next > 0 {
+		payload.Next = continuationToken(id, next)
+		p.snapshots.SetDefault(id, s)
+	} else {
+		p.snapshots.Delete(id)
+	}
+	return json.Marshal(payload)
+}
+
+// attributePageQuery returns the continuation token, page size and attribute names of a request for a page
+func attributePageQuery(msg coap.Message) (token string, size int, names []string, err error) {
+	size = defaultAttributePageSize
+	for _, q := range msg.Query() {
+		switch {
+		case strings.HasPrefix(q, client.AttributesPageQuery):
+			token = strings.TrimPrefix(q, client.AttributesPageQuery)
+		case strings.HasPrefix(q, client.AttributesPageSizeQuery):
+			size, err = strconv.Atoi(strings.TrimPrefix(q, client.AttributesPageSizeQuery))
+			if err != nil || size < 1 {
+				return "", 0, nil, fmt.Errorf("invalid page size `%s`", q)
+			}
+		default:
+			names = append(names, q)
+		}
+	}
+	return token, size, names, nil
+}
+
+// attributePageHandler handles requests for pages of attributes
+func (c *ThingGateway) attributePageHandler(w coap.ResponseWriter, r *coap.Request) {
+	c.log.Trace("attributePageHandler")
+	page, size, names, err := attributePageQuery(r.Msg)
+	if err != nil {
+		w.SetCode(codes.BadRequest)
+		writeResponse(w, []byte(err.Error()))
+		return
+	}
+	token, format, payload, ok := c.negotiate(w, r)
+	if !ok {
+		return
+	}
+	b, err := c.pages.serve(token, page, size, func() (*attributeSnapshot, error) {
+		document, err := c.transaction(r).Attributes(token, format, payload, names)
+		if err != nil {
+			return nil, err
+		}
+		return newAttributeSnapshot(token, document)
+	})
+	if errors.Is(err, errContinuation) {
+		// the thing must request the attributes again from the first page
+		w.SetCode(codes.NotFound)
+		writeResponse(w, []byte(err.Error()))
+		return
+	} else if err != nil {
+		writeError(w, err, codes.GatewayTimeout)
+		return
+	}
+	w.SetCode(codes.Changed)
+	writeResponse(w, b)
+	c.log.Trace("attributePageHandler: success")
+}
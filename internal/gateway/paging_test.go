@@ -0,0 +1,172 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+)
+
+const testAttributesDocument = `{"_id":"thingOne","_rev":"1","e":[5],"a":[1],"d":[4],"b":[2],"c":[3]}`
+
+// testPageNames returns the sorted names of the attributes in a page
+func testPageNames(t *testing.T, reply []byte) (names []string, next string) {
+	var page client.AttributesPagePayload
+	if err := json.Unmarshal(reply, &page); err != nil {
+		t.Fatal(err)
+	}
+	var attributes map[string]interface{}
+	if err := json.Unmarshal(page.Attributes, &attributes); err != nil {
+		t.Fatal(err)
+	}
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, page.Next
+}
+
+func TestAttributePages_Serve(t *testing.T) {
+	pages := newAttributePages()
+	snapshots := 0
+	snapshot := func() (*attributeSnapshot, error) {
+		snapshots++
+		return newAttributeSnapshot("session-1", []byte(testAttributesDocument))
+	}
+	expected := [][]string{
+		{"_id", "_rev", "a", "b"},
+		{"_id", "_rev", "c", "d"},
+		{"_id", "_rev", "e"},
+	}
+	next := ""
+	for i, names := range expected {
+		reply, err := pages.serve("session-1", next, 2, snapshot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var page []string
+		page, next = testPageNames(t, reply)
+		if !reflect.DeepEqual(page, names) {
+			t.Errorf("expected page %d to contain %v; got %v", i, names, page)
+		}
+		if (next == "") != (i == len(expected)-1) {
+			t.Errorf("unexpected continuation token `%s` for page %d", next, i)
+		}
+	}
+	if snapshots != 1 {
+		t.Errorf("expected a single snapshot; got %d", snapshots)
+	}
+	if pages.snapshots.ItemCount() != 0 {
+		t.Error("expected the snapshot to be removed after the last page")
+	}
+}
+
+func TestAttributePages_Continuation(t *testing.T) {
+	tests := []struct {
+		name    string
+		session string
+		token   func(first string) string
+	}{
+		{name: "other-session", session: "session-2", token: func(first string) string { return first }},
+		{name: "unknown-snapshot", session: "session-1", token: func(string) string { return "unknown.2" }},
+		{name: "malformed", session: "session-1", token: func(string) string { return "unknown" }},
+		{name: "offset-out-of-range", session: "session-1", token: func(first string) string {
+			id, _, _ := parseContinuationToken(first)
+			return continuationToken(id, 100)
+		}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			pages := newAttributePages()
+			reply, err := pages.serve("session-1", "", 2, func() (*attributeSnapshot, error) {
+				return newAttributeSnapshot("session-1", []byte(testAttributesDocument))
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, next := testPageNames(t, reply)
+			_, err = pages.serve(subtest.session, subtest.token(next), 2, nil)
+			if err != errContinuation {
+				t.Errorf("expected a continuation error; got %v", err)
+			}
+		})
+	}
+}
+
+func TestAttributePages_Forget(t *testing.T) {
+	pages := newAttributePages()
+	reply, err := pages.serve("session-1", "", 2, func() (*attributeSnapshot, error) {
+		return newAttributeSnapshot("session-1", []byte(testAttributesDocument))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, next := testPageNames(t, reply)
+	pages.forget("session-1")
+	if _, err = pages.serve("session-1", next, 2, nil); err != errContinuation {
+		t.Errorf("expected a continuation error; got %v", err)
+	}
+}
+
+func TestGatewayServer_AttributePages(t *testing.T) {
+	var requested []string
+	gateway := testGateway(&mockClient{attributesFunc: func(_ string, _ string, names []string) ([]byte, error) {
+		requested = names
+		return []byte(testAttributesDocument), nil
+	}})
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err := gateway.StartCOAPServer(":0", serverKey); err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.ShutdownCOAPServer()
+
+	connection := gatewayConnection(t, gateway)
+	names := []string{"a", "b", "c", "d", "e"}
+	next := ""
+	var visited []string
+	for pages := 0; pages < 10; pages++ {
+		reply, err := client.AttributesPage(connection, "session-1", client.ApplicationJSON, "", names, next, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var page []string
+		page, next = testPageNames(t, reply)
+		visited = append(visited, page...)
+		if next == "" {
+			break
+		}
+	}
+	expected := []string{"_id", "_rev", "a", "b", "c", "_id", "_rev", "d", "e"}
+	if !reflect.DeepEqual(visited, expected) {
+		t.Errorf("expected pages with %v; got %v", expected, visited)
+	}
+	if !reflect.DeepEqual(requested, names) {
+		t.Errorf("expected the names %v to be requested from AM; got %v", names, requested)
+	}
+
+	_, err := client.AttributesPage(connection, "session-1", client.ApplicationJSON, "", nil, "unknown.1", 3)
+	if err == nil {
+		t.Error("expected an error for an unknown continuation token")
+	}
+}
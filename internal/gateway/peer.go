@@ -0,0 +1,52 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"net"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/go-ocf/go-coap"
+)
+
+// peerInfo returns the information about the transport peer of the thing that sent the request, see client.PeerInfo.
+// The identity is only included if the client certificate of the thing has been verified. If the request was sent by a
+// trusted downstream gateway then the peer forwarded by the gateway is returned instead.
+func (c *ThingGateway) peerInfo(r *coap.Request) client.PeerInfo {
+	peer := client.PeerInfo{LinkMetadata: client.LinkMetadata(r.Msg)}
+	if address := r.Client.RemoteAddr(); address != nil {
+		peer.Address = address.String()
+		if host, _, err := net.SplitHostPort(peer.Address); err == nil {
+			peer.Address = host
+		}
+	}
+	if c.clientCAs != nil {
+		if cert, err := c.clientCertificate(r); err == nil {
+			peer.Identity = cert.Subject.String()
+			if matchAny(c.trustedProxies, cert.Subject.CommonName) {
+				return forwardedBy(client.ForwardedPeer(r.Msg), peer)
+			}
+		}
+	}
+	return peer
+}
+
+// forwardPeer returns the connection with which the request is forwarded to AM on behalf of the thing, identifying
+// the thing by its transaction ID and transport peer
+func (c *ThingGateway) forwardPeer(r *coap.Request) client.Connection {
+	return client.WithPeer(c.transaction(r), c.peerInfo(r))
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+)
+
+func TestGatewayServer_PeerInfo(t *testing.T) {
+	var mutex sync.Mutex
+	forwarded := make(map[string]http.Header)
+	record := func(name string, reply string) http.HandlerFunc {
+		return func(writer http.ResponseWriter, request *http.Request) {
+			mutex.Lock()
+			forwarded[name] = request.Header
+			mutex.Unlock()
+			_, _ = writer.Write([]byte(reply))
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/json/serverinfo/*", func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = writer.Write([]byte(`{"cookieName":"iPlanetDirectoryPro"}`))
+	})
+	mux.HandleFunc("/json/authenticate", record("authenticate", `{"tokenId":"12345"}`))
+	mux.HandleFunc("/json/things/*", record("accesstoken", `{}`))
+	am := httptest.NewServer(mux)
+	defer am.Close()
+
+	amURL, _ := url.Parse(am.URL)
+	amConnection, err := client.NewConnection().ConnectTo(amURL).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gateway := testGateway(nil)
+	gateway.amConnection = amConnection
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err := gateway.StartCOAPServer("127.0.0.1:0", serverKey); err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.ShutdownCOAPServer()
+
+	gwURL, _ := url.Parse("coap://" + gateway.Address())
+	connection, err := client.NewConnection().
+		ConnectTo(gwURL).
+		WithKey(clientKey).
+		WithLinkMetadata(func() string {
+			return "rssi=-71;snr=7"
+		}).
+		Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	context := client.AuthContext{Locale: "de-CH", Values: map[string]string{"Channel": "beta"}}
+	if _, err = client.WithAuthContext(connection, context).Authenticate(client.AuthenticatePayload{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = connection.AccessToken("12345", client.ApplicationJSON, "{}"); err != nil {
+		t.Fatal(err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, name := range []string{"authenticate", "accesstoken"} {
+		header, ok := forwarded[name]
+		if !ok {
+			t.Errorf("%s request not forwarded", name)
+			continue
+		}
+		if address := header.Get(client.ForwardedForHeader); address != "127.0.0.1" {
+			t.Errorf("%s: expected the address of the thing; got %s", name, address)
+		}
+		if metadata := header.Get(client.LinkMetadataHeader); metadata != "rssi=-71;snr=7" {
+			t.Errorf("%s: expected the link metadata of the thing; got %s", name, metadata)
+		}
+		if identity := header.Get(client.PeerIdentityHeader); identity != "" {
+			t.Errorf("%s: unverified identity forwarded %s", name, identity)
+		}
+	}
+	if locale := forwarded["authenticate"].Get(client.AcceptLanguageHeader); locale != "de-CH" {
+		t.Errorf("expected the locale of the thing; got %s", locale)
+	}
+	if channel := forwarded["authenticate"].Get(client.AuthContextHeaderPrefix + "Channel"); channel != "beta" {
+		t.Errorf("expected the context of the thing; got %s", channel)
+	}
+}
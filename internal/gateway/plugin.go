@@ -0,0 +1,102 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"errors"
+	"plugin"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/debug"
+	"github.com/JacoJooste/iot-edge/v7/pkg/extension"
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+)
+
+// Plugins
+// Site-specific behaviour is added to the gateway with extensions, see the extension package: request filters that
+// can reject the requests of things, sinks to which events are published and southbound adapters. Extensions are
+// built into Go plugins that register the extensions when they are loaded, so that the gateway binary does not need to
+// be rebuilt. Go plugins can not be unloaded, so a plugin stays loaded for the lifetime of the process.
+
+// LoadPlugin loads the Go plugin in the file, which registers its extensions with the extension and southbound
+// packages. Loading plugins requires a gateway that is built with cgo on a platform that supports plugins.
+func LoadPlugin(file string) error {
+	if _, err := plugin.Open(file); err != nil {
+		return err
+	}
+	debug.Infof("Loaded plugin %s", file)
+	return nil
+}
+
+// AddRequestFilter adds a filter that decides whether the requests of things are served. The filters are applied in
+// the order in which they were added, after the access list, and a request is rejected with Forbidden by the first
+// filter that returns an error.
+// Must be called before the CoAP server is started.
+func (c *ThingGateway) AddRequestFilter(filter extension.Filter) error {
+	if filter == nil {
+		return errors.New("a request filter is required")
+	}
+	c.filters = append(c.filters, filter)
+	return nil
+}
+
+// filterRequests rejects the requests that are not allowed by the request filters
+func (c *ThingGateway) filterRequests(next coap.Handler) coap.Handler {
+	if len(c.filters) == 0 {
+		return next
+	}
+	return coap.HandlerFunc(func(w coap.ResponseWriter, r *coap.Request) {
+		request := extension.Request{
+			Method:        r.Msg.Code().String(),
+			Path:          "/" + r.Msg.PathString(),
+			RemoteAddress: r.Client.RemoteAddr().String(),
+			Payload:       r.Msg.Payload(),
+		}
+		if c.clientCAs != nil {
+			request.ClientCertificate, _ = c.clientCertificate(r)
+		}
+		for _, filter := range c.filters {
+			if err := filter.Filter(request); err != nil {
+				c.log.Infof("Request %s from %s rejected by filter; %s", request.Path, request.RemoteAddress, err)
+				w.SetCode(codes.Forbidden)
+				writeResponse(w, []byte(err.Error()))
+				return
+			}
+		}
+		next.ServeCOAP(w, r)
+	})
+}
+
+// SinkPublisher returns a publisher that publishes the events of the gateway to the sink of an extension
+func SinkPublisher(sink extension.Sink) EventPublisher {
+	return sinkPublisher{sink: sink}
+}
+
+// sinkPublisher converts the events of the gateway to the events of the extension package
+type sinkPublisher struct {
+	sink extension.Sink
+}
+
+func (p sinkPublisher) Publish(event Event) error {
+	return p.sink.Publish(extension.Event{
+		Time:    event.Time,
+		Type:    string(event.Type),
+		Source:  event.Source,
+		ThingID: event.ThingID,
+		Detail:  event.Detail,
+	})
+}
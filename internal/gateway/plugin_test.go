@@ -0,0 +1,97 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/JacoJooste/iot-edge/v7/pkg/extension"
+)
+
+func TestThingGateway_AddRequestFilter(t *testing.T) {
+	var mutex sync.Mutex
+	var filtered []extension.Request
+	gateway := testGateway(&mockClient{})
+	err := gateway.AddRequestFilter(extension.FilterFunc(func(request extension.Request) error {
+		mutex.Lock()
+		filtered = append(filtered, request)
+		mutex.Unlock()
+		if request.Path == RouteAMInfo {
+			return errors.New("AM info is not served at this site")
+		}
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err := gateway.StartCOAPServer(":0", serverKey); err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.ShutdownCOAPServer()
+
+	connection := gatewayConnection(t, gateway)
+	if _, err = connection.AMInfo(); err == nil {
+		t.Error("expected the filter to reject the request")
+	}
+	if err = (&client.Clock{}).Synchronise(connection); err != nil {
+		t.Errorf("expected the filter to allow the request; got %v", err)
+	}
+	mutex.Lock()
+	if len(filtered) != 2 || filtered[0].Method != "GET" || filtered[0].RemoteAddress == "" {
+		t.Errorf("unexpected filtered requests %+v", filtered)
+	}
+	mutex.Unlock()
+	if err = gateway.AddRequestFilter(nil); err == nil {
+		t.Error("expected an error for a missing filter")
+	}
+}
+
+type recordingSink struct {
+	events []extension.Event
+}
+
+func (s *recordingSink) Publish(event extension.Event) error {
+	s.events = append(s.events, event)
+	return nil
+}
+
+func TestSinkPublisher(t *testing.T) {
+	sink := &recordingSink{}
+	now := time.Now()
+	err := SinkPublisher(sink).Publish(Event{Time: now, Type: EventTokenIssued, Source: "site-1", ThingID: "thing-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := extension.Event{Time: now, Type: "token-issued", Source: "site-1", ThingID: "thing-1"}
+	if len(sink.events) != 1 || sink.events[0] != expected {
+		t.Errorf("expected %+v; got %+v", expected, sink.events)
+	}
+}
+
+func TestLoadPlugin_Missing(t *testing.T) {
+	if err := LoadPlugin("testdata/missing.so"); err == nil {
+		t.Error("expected an error for a missing plugin")
+	}
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-ocf/go-coap"
+)
+
+// Probes and graceful shutdown
+// When the gateway runs in an orchestrated environment, such as a sidecar container in a Kubernetes pod, the
+// orchestrator checks the gateway with HTTP probes and stops it with SIGTERM followed by a grace period:
+//    GET /healthz  reports 200 OK while the CoAP server is running
+//    GET /readyz   reports 200 OK while the CoAP server is running and is not draining, and the gateway either has
+//                  contact with AM or can authenticate things offline
+// Unlike the admin API, the probe server accepts connections from any host since the kubelet probes the address of
+// the pod. It only reports the status of the gateway and does not expose any state.
+// DrainCOAPServer makes the gateway unready, waits for the requests in progress to complete, up to the grace period,
+// and then shuts the CoAP server down. Requests received while draining are still served since the things in the same
+// pod can not be routed to another gateway.
+
+// ErrProbeServerAlreadyStarted indicates that the probe server has already been started by the Thing Gateway
+var ErrProbeServerAlreadyStarted = errors.New("probe server has already been started")
+
+// drainInterval is the interval at which the requests in progress are checked while draining
+const drainInterval = 10 * time.Millisecond
+
+var (
+	errNotServing    = errors.New("CoAP server is not running")
+	errDraining      = errors.New("CoAP server is draining")
+	errAMUnreachable = errors.New("AM can not be reached")
+)
+
+// countRequests counts the requests in progress so that they can be drained before the CoAP server shuts down
+func (c *ThingGateway) countRequests(next coap.Handler) coap.HandlerFunc {
+	return func(w coap.ResponseWriter, r *coap.Request) {
+		atomic.AddInt32(&c.requests, 1)
+		defer atomic.AddInt32(&c.requests, -1)
+		next.ServeCOAP(w, r)
+	}
+}
+
+// Ready returns an error describing why the Thing Gateway can not serve things, or nil if it is ready
+func (c *ThingGateway) Ready() error {
+	liveness := c.Liveness()
+	switch {
+	case !liveness.Serving:
+		return errNotServing
+	case atomic.LoadInt32(&c.draining) == 1:
+		return errDraining
+	case liveness.AM.ConsecutiveFailures > 0 && c.offline == nil:
+		return errAMUnreachable
+	}
+	return nil
+}
+
+// DrainCOAPServer gracefully shuts the CoAP server down after the requests in progress have completed or the grace
+// period has passed, whichever comes first. The gateway reports that it is not ready while it drains.
+func (c *ThingGateway) DrainCOAPServer(grace time.Duration) {
+	atomic.StoreInt32(&c.draining, 1)
+	defer atomic.StoreInt32(&c.draining, 0)
+	deadline := time.Now().Add(grace)
+	for atomic.LoadInt32(&c.requests) > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainInterval)
+	}
+	if requests := atomic.LoadInt32(&c.requests); requests > 0 {
+		c.log.Infof("Shutting down with %d requests in progress", requests)
+	}
+	c.ShutdownCOAPServer()
+}
+
+// probeHandler returns the handler of the probe server
+func (c *ThingGateway) probeHandler() http.Handler {
+	probe := func(check func() error) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet {
+				w.Header().Set("Allow", "GET")
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			if err := check(); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			_, _ = w.Write([]byte("ok"))
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", probe(func() error {
+		if !c.Liveness().Serving {
+			return errNotServing
+		}
+		return nil
+	}))
+	mux.HandleFunc("/readyz", probe(c.Ready))
+	return mux
+}
+
+// StartProbeServer starts the probe server on the given address
+func (c *ThingGateway) StartProbeServer(address string) error {
+	if c.probeServer != nil {
+		return ErrProbeServerAlreadyStarted
+	}
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	c.probeServer = &http.Server{Handler: c.probeHandler()}
+	c.probeAddress = l.Addr()
+	go func(server *http.Server) {
+		if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+			c.log.Error(err)
+		}
+	}(c.probeServer)
+	return nil
+}
+
+// ShutdownProbeServer shuts the probe server down
+func (c *ThingGateway) ShutdownProbeServer() {
+	if c.probeServer == nil {
+		return
+	}
+	if err := c.probeServer.Close(); err != nil {
+		c.log.Error(err)
+	}
+	c.probeServer = nil
+	c.probeAddress = nil
+}
+
+// ProbeAddress returns in string form the address that the probe server is listening on
+func (c *ThingGateway) ProbeAddress() string {
+	if c.probeAddress == nil {
+		return ""
+	}
+	return c.probeAddress.String()
+}
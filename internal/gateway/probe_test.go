@@ -0,0 +1,120 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+)
+
+func testProbe(gateway *ThingGateway, path string) int {
+	recorder := httptest.NewRecorder()
+	gateway.probeHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	return recorder.Code
+}
+
+func TestThingGateway_Probes(t *testing.T) {
+	gateway := testGateway(&mockClient{})
+	for _, path := range []string{"/healthz", "/readyz"} {
+		if code := testProbe(gateway, path); code != http.StatusServiceUnavailable {
+			t.Errorf("%s: expected %d before the server starts; got %d", path, http.StatusServiceUnavailable, code)
+		}
+	}
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err := gateway.StartCOAPServer("127.0.0.1:0", serverKey); err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.ShutdownCOAPServer()
+	for _, path := range []string{"/healthz", "/readyz"} {
+		if code := testProbe(gateway, path); code != http.StatusOK {
+			t.Errorf("%s: expected %d; got %d", path, http.StatusOK, code)
+		}
+	}
+
+	atomic.StoreInt32(&gateway.draining, 1)
+	if code := testProbe(gateway, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected the draining gateway not to be ready; got %d", code)
+	}
+	if code := testProbe(gateway, "/healthz"); code != http.StatusOK {
+		t.Errorf("expected the draining gateway to be healthy; got %d", code)
+	}
+}
+
+func TestThingGateway_Ready_AMUnreachable(t *testing.T) {
+	gateway := testGateway(&mockClient{})
+	// an AM connection that has failed to reach AM
+	amURL, _ := url.Parse("http://127.0.0.1:1")
+	connection, err := client.NewConnection().ConnectTo(amURL).TimeoutRequestAfter(time.Second).Create()
+	if err == nil {
+		t.Fatal("expected AM to be unreachable")
+	}
+	gateway.amConnection = connection
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err := gateway.StartCOAPServer("127.0.0.1:0", serverKey); err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.ShutdownCOAPServer()
+	if err := gateway.Ready(); err != errAMUnreachable {
+		t.Errorf("expected %v; got %v", errAMUnreachable, err)
+	}
+	gateway.EnableOfflineAuthentication(time.Minute, nil)
+	if err := gateway.Ready(); err != nil {
+		t.Errorf("expected a gateway that authenticates offline to be ready; got %v", err)
+	}
+}
+
+func TestThingGateway_DrainCOAPServer(t *testing.T) {
+	gateway := testGateway(&mockClient{})
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err := gateway.StartCOAPServer("127.0.0.1:0", serverKey); err != nil {
+		t.Fatal(err)
+	}
+	// a request in progress
+	atomic.AddInt32(&gateway.requests, 1)
+	time.AfterFunc(50*time.Millisecond, func() {
+		atomic.AddInt32(&gateway.requests, -1)
+	})
+	start := time.Now()
+	gateway.DrainCOAPServer(time.Minute)
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > 10*time.Second {
+		t.Errorf("expected to wait for the request in progress; waited %v", elapsed)
+	}
+	if gateway.Liveness().Serving {
+		t.Error("expected the server to be shut down")
+	}
+
+	// the grace period limits the wait
+	gateway = testGateway(&mockClient{})
+	if err := gateway.StartCOAPServer("127.0.0.1:0", serverKey); err != nil {
+		t.Fatal(err)
+	}
+	atomic.AddInt32(&gateway.requests, 1)
+	start = time.Now()
+	gateway.DrainCOAPServer(50 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("expected to stop waiting after the grace period; waited %v", elapsed)
+	}
+}
@@ -0,0 +1,335 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package gateway
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/debug"
+	ithing "github.com/JacoJooste/iot-edge/v7/internal/thing"
+	"github.com/JacoJooste/iot-edge/v7/pkg/callback"
+	"github.com/JacoJooste/iot-edge/v7/pkg/southbound"
+	"github.com/JacoJooste/iot-edge/v7/pkg/thing"
+)
+
+// Proxied things
+// Devices that cannot connect to the gateway themselves, such as Bluetooth, Zigbee, Modbus or serial devices, are
+// reached through southbound adapters (see package southbound). The gateway periodically asks each enabled adapter to
+// discover its devices, asks the adapter to identify the thing that represents every new device and then registers
+// and authenticates that thing with AM through its own AM connection, so that the device appears as a first class
+// identity in AM. The key of a proxied thing is held by the gateway and derived from a master key, the adapter name
+// and the device ID, which means that the identity of a device survives a restart of the gateway without storing
+// keys. If token forwarding is enabled, the gateway acquires access tokens for each device and asks the adapter to
+// forward them to the device before they expire. The tokens are requested with the session of the proxied thing or,
+// if configured, with the session of the gateway and an identity assertion for the proxied thing, see
+// thing.Thing.RequestChildAccessToken, so that AM can record that the gateway acts for the device. If a key store is
+// configured, the keys of proxied things are random instead of derived and are kept encrypted in the key store, see
+// ProxyKeyStore.
+
+// minimumProxyKeySize is the minimum size in bytes of the master key from which the keys of proxied things are derived
+const minimumProxyKeySize = 32
+
+// proxyTokenRefreshMargin is the time before the expiry of an access token at which a new token is forwarded
+const proxyTokenRefreshMargin = time.Minute
+
+// ProxyConfig configures how the gateway proxies the devices of a southbound adapter
+type ProxyConfig struct {
+	// MasterKey is the secret, at least 32 bytes long, from which the keys of the proxied things are derived. Not
+	// required if a key store is provided.
+	MasterKey []byte
+	// KeyStore keeps the keys of the proxied things instead of deriving them from the master key
+	KeyStore *ProxyKeyStore
+	// Audience of the JWTs used to register and authenticate the proxied things
+	Audience string
+	// Interval is the time between discoveries of devices
+	Interval time.Duration
+	// ForwardTokens makes the gateway acquire access tokens for the devices and forward them to the devices
+	ForwardTokens bool
+	// Scopes of the access tokens acquired for the devices
+	Scopes []string
+	// RequestAsGateway acquires the access tokens with the session of the gateway and an identity assertion for the
+	// device instead of the session of the proxied thing. Requires the gateway to be initialised.
+	RequestAsGateway bool
+}
+
+// ProxiedThing is a thing that the gateway proxies on behalf of a device
+type ProxiedThing struct {
+	Adapter  string
+	DeviceID string
+	ThingID  string
+}
+
+// proxiedDevice is a device that is represented by a proxied thing
+type proxiedDevice struct {
+	device  southbound.Device
+	thingID string
+	thing   thing.Thing
+	// tokenDue is the time at which a new access token must be forwarded to the device
+	tokenDue time.Time
+}
+
+// adapterProxy proxies the devices of a southbound adapter
+type adapterProxy struct {
+	adapter southbound.Adapter
+	config  ProxyConfig
+	// create registers or authenticates the thing with the identity and key
+	create func(identity southbound.Identity, key ed25519.PrivateKey) (thing.Thing, error)
+	// childToken requests an access token for the proxied thing as its parent, nil if the tokens are requested by the
+	// proxied things themselves
+	childToken func(thingID string, scopes ...string) (thing.AccessTokenResponse, error)
+	// schedule staggers the refreshes of the access tokens
+	schedule *maintenanceScheduler
+	mutex    sync.Mutex
+	// proxied devices by device ID
+	devices map[string]*proxiedDevice
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// proxyKey derives the key of the thing of the device from the master key
+func proxyKey(masterKey []byte, adapter, deviceID string) ed25519.PrivateKey {
+	mac := hmac.New(sha256.New, masterKey)
+	mac.Write([]byte(adapter + ":" + deviceID))
+	return ed25519.NewKeyFromSeed(mac.Sum(nil))
+}
+
+// key returns the key of the thing of the device from the key store or derived from the master key
+func (p *adapterProxy) key(device southbound.Device) (ed25519.PrivateKey, error) {
+	if p.config.KeyStore != nil {
+		return p.config.KeyStore.key(p.adapter.Name(), device.ID)
+	}
+	return proxyKey(p.config.MasterKey, p.adapter.Name(), device.ID), nil
+}
+
+// proxy the devices discovered by the adapter, creating things for new devices and forwarding access tokens
+func (p *adapterProxy) proxy() {
+	devices, err := p.adapter.Discover()
+	if err != nil {
+		debug.Errorf("Discovery by adapter %s failed; %s", p.adapter.Name(), err)
+		return
+	}
+	for _, device := range devices {
+		proxied, err := p.proxied(device)
+		if err != nil {
+			debug.Errorf("Unable to proxy %s device %s; %s", p.adapter.Name(), device.ID, err)
+			continue
+		}
+		if !p.config.ForwardTokens || time.Now().Before(proxied.tokenDue) {
+			continue
+		}
+		if err = p.forwardToken(proxied); err != nil {
+			debug.Errorf("Unable to forward access token to %s device %s; %s", p.adapter.Name(), device.ID, err)
+		}
+	}
+}
+
+// proxied returns the proxied device, creating its thing if the device has not been proxied before
+func (p *adapterProxy) proxied(device southbound.Device) (*proxiedDevice, error) {
+	p.mutex.Lock()
+	proxied, ok := p.devices[device.ID]
+	p.mutex.Unlock()
+	if ok {
+		return proxied, nil
+	}
+	identity, err := p.adapter.Identify(device)
+	if err != nil {
+		return nil, err
+	}
+	if identity.ThingID == "" {
+		return nil, errors.New("the adapter did not identify a thing ID")
+	}
+	key, err := p.key(device)
+	if err != nil {
+		return nil, err
+	}
+	proxiedThing, err := p.create(identity, key)
+	if err != nil {
+		return nil, err
+	}
+	proxied = &proxiedDevice{device: device, thingID: identity.ThingID, thing: proxiedThing}
+	p.mutex.Lock()
+	p.devices[device.ID] = proxied
+	p.mutex.Unlock()
+	debug.Infof("Proxying %s device %s as thing %s", p.adapter.Name(), device.ID, identity.ThingID)
+	return proxied, nil
+}
+
+// forwardToken acquires an access token for the proxied device and forwards it to the device
+func (p *adapterProxy) forwardToken(proxied *proxiedDevice) error {
+	request := proxied.thing.RequestAccessToken
+	if p.childToken != nil {
+		request = func(scopes ...string) (thing.AccessTokenResponse, error) {
+			return p.childToken(proxied.thingID, scopes...)
+		}
+	}
+	response, err := request(p.config.Scopes...)
+	if err != nil {
+		return err
+	}
+	token, err := response.AccessToken()
+	if err != nil {
+		return err
+	}
+	err = p.adapter.Forward(proxied.device, southbound.Message{
+		Type:    southbound.MessageAccessToken,
+		Payload: []byte(token),
+	})
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	due := now.Add(p.config.Interval)
+	if expiresIn, err := response.ExpiresIn(); err == nil {
+		lifetime := time.Duration(expiresIn) * time.Second
+		due = now.Add(lifetime - proxyTokenRefreshMargin)
+		// the token is refreshed in the second half of its lifetime
+		due = p.schedule.plan(due, now.Add(lifetime/2), due)
+	}
+	p.mutex.Lock()
+	proxied.tokenDue = due
+	p.mutex.Unlock()
+	return nil
+}
+
+// proxiedThings returns the things proxied for the devices of the adapter
+func (p *adapterProxy) proxiedThings() []ProxiedThing {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	things := make([]ProxiedThing, 0, len(p.devices))
+	for id, proxied := range p.devices {
+		things = append(things, ProxiedThing{Adapter: p.adapter.Name(), DeviceID: id, ThingID: proxied.thingID})
+	}
+	return things
+}
+
+// start discovering devices periodically, refreshing the access tokens of the devices according to the schedule
+func (p *adapterProxy) start(schedule *maintenanceScheduler) {
+	p.schedule = schedule
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	go func(stop <-chan struct{}, done chan<- struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(p.config.Interval)
+		defer ticker.Stop()
+		p.proxy()
+		for {
+			select {
+			case <-ticker.C:
+				p.proxy()
+			case <-stop:
+				return
+			}
+		}
+	}(p.stop, p.done)
+}
+
+// shutdown stops discovering devices and logs out the proxied things
+func (p *adapterProxy) shutdown() {
+	if p.stop == nil {
+		return
+	}
+	close(p.stop)
+	<-p.done
+	p.stop = nil
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for id, proxied := range p.devices {
+		if err := proxied.thing.Logout(); err != nil {
+			debug.Errorf("Unable to log out %s device %s; %s", p.adapter.Name(), id, err)
+		}
+	}
+	p.devices = make(map[string]*proxiedDevice)
+}
+
+// createProxiedThing registers or authenticates the proxied thing with AM
+func (c *ThingGateway) createProxiedThing(audience string, identity southbound.Identity,
+	key ed25519.PrivateKey) (thing.Thing, error) {
+	builder := &ithing.BaseBuilder{}
+	switch identity.ThingType {
+	case "", callback.TypeDevice:
+	case callback.TypeService:
+		builder.AsService()
+	default:
+		return nil, fmt.Errorf("unsupported type %s for proxied thing", identity.ThingType)
+	}
+	return builder.
+		WithConnection(c.amConnection).
+		AuthenticateThing(identity.ThingID, audience, "", key, nil).
+		WithThumbprintKeyID().
+		RegisterThing(nil, func() interface{} {
+			return identity.Claims
+		}).
+		Create()
+}
+
+// EnableAdapter makes the Thing Gateway proxy the devices of the southbound adapter as things that it registers and
+// authenticates with AM on behalf of the devices. The gateway discovers the devices of the adapter at the interval in
+// the configuration. Must be called before the CoAP server is started.
+func (c *ThingGateway) EnableAdapter(adapter southbound.Adapter, config ProxyConfig) error {
+	if adapter == nil {
+		return errors.New("a southbound adapter is required")
+	}
+	if config.KeyStore == nil && len(config.MasterKey) < minimumProxyKeySize {
+		return fmt.Errorf("proxy master key must be at least %d bytes", minimumProxyKeySize)
+	}
+	if config.Interval <= 0 {
+		return errors.New("adapter discovery interval must be positive")
+	}
+	for _, p := range c.proxies {
+		if p.adapter.Name() == adapter.Name() {
+			return fmt.Errorf("adapter %s is already enabled", adapter.Name())
+		}
+	}
+	proxy := &adapterProxy{
+		adapter: adapter,
+		config:  config,
+		create: func(identity southbound.Identity, key ed25519.PrivateKey) (thing.Thing, error) {
+			return c.createProxiedThing(config.Audience, identity, key)
+		},
+		devices: make(map[string]*proxiedDevice),
+	}
+	if config.RequestAsGateway {
+		if c.gatewayThing == nil {
+			return errors.New("the gateway must be initialised to request tokens for proxied things")
+		}
+		proxy.childToken = c.gatewayThing.RequestChildAccessToken
+	}
+	c.proxies = append(c.proxies, proxy)
+	return nil
+}
+
+// ProxiedThings returns the things that the gateway proxies for the devices of the enabled adapters, sorted by
+// adapter and device ID
+func (c *ThingGateway) ProxiedThings() []ProxiedThing {
+	var things []ProxiedThing
+	for _, p := range c.proxies {
+		things = append(things, p.proxiedThings()...)
+	}
+	sort.Slice(things, func(i, j int) bool {
+		if things[i].Adapter != things[j].Adapter {
+			return things[i].Adapter < things[j].Adapter
+		}
+		return things[i].DeviceID < things[j].DeviceID
+	})
+	return things
+}
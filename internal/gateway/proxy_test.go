@@ -0,0 +1,211 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package gateway
+
+import (
+	"bytes"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/pkg/callback"
+	"github.com/JacoJooste/iot-edge/v7/pkg/southbound"
+	"github.com/JacoJooste/iot-edge/v7/pkg/thing"
+)
+
+// mockAdapter discovers the same devices every time and records the messages forwarded to them
+type mockAdapter struct {
+	name    string
+	devices []southbound.Device
+	mutex   sync.Mutex
+	// forwarded payloads by device ID
+	forwarded map[string][]string
+}
+
+func (a *mockAdapter) Name() string {
+	return a.name
+}
+
+func (a *mockAdapter) Discover() ([]southbound.Device, error) {
+	return a.devices, nil
+}
+
+func (a *mockAdapter) Identify(device southbound.Device) (southbound.Identity, error) {
+	return southbound.Identity{ThingID: a.name + "-" + device.ID, Claims: map[string]interface{}{"unit": device.ID}},
+		nil
+}
+
+func (a *mockAdapter) Forward(device southbound.Device, message southbound.Message) error {
+	if message.Type != southbound.MessageAccessToken {
+		return southbound.ErrUnsupportedMessage
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.forwarded[device.ID] = append(a.forwarded[device.ID], string(message.Payload))
+	return nil
+}
+
+func testProxyConfig() ProxyConfig {
+	return ProxyConfig{
+		MasterKey:     bytes.Repeat([]byte{1}, 32),
+		Audience:      "/",
+		Interval:      time.Minute,
+		ForwardTokens: true,
+	}
+}
+
+func TestThingGateway_EnableAdapter(t *testing.T) {
+	gateway := testGateway(&mockClient{accessTokenFunc: func(string, string) ([]byte, error) {
+		return []byte(`{"access_token":"proxied-token","expires_in":3600}`), nil
+	}})
+	modbus := &mockAdapter{name: "modbus", devices: []southbound.Device{{ID: "7"}}, forwarded: make(map[string][]string)}
+	zigbee := &mockAdapter{name: "zigbee", devices: []southbound.Device{{ID: "00124b0014d2a1b3"}},
+		forwarded: make(map[string][]string)}
+	for _, adapter := range []southbound.Adapter{zigbee, modbus} {
+		if err := gateway.EnableAdapter(adapter, testProxyConfig()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range gateway.proxies {
+		p.proxy()
+	}
+
+	expected := []ProxiedThing{
+		{Adapter: "modbus", DeviceID: "7", ThingID: "modbus-7"},
+		{Adapter: "zigbee", DeviceID: "00124b0014d2a1b3", ThingID: "zigbee-00124b0014d2a1b3"},
+	}
+	if !reflect.DeepEqual(gateway.ProxiedThings(), expected) {
+		t.Errorf("expected proxied things %v; got %v", expected, gateway.ProxiedThings())
+	}
+	if tokens := modbus.forwarded["7"]; len(tokens) != 1 || tokens[0] != "proxied-token" {
+		t.Errorf("unexpected tokens forwarded to the device %v", tokens)
+	}
+
+	// the token is not forwarded again before it is due
+	for _, p := range gateway.proxies {
+		p.proxy()
+		p.shutdown()
+	}
+	if tokens := modbus.forwarded["7"]; len(tokens) != 1 {
+		t.Errorf("expected a single token to be forwarded, got %d", len(tokens))
+	}
+}
+
+// parentThing issues child access tokens as the gateway thing
+type parentThing struct {
+	thing.Thing
+	children []string
+}
+
+func (p *parentThing) RequestChildAccessToken(childID string, _ ...string) (response thing.AccessTokenResponse,
+	err error) {
+	p.children = append(p.children, childID)
+	response.Content = thing.JSONContent{"access_token": "child-token", "expires_in": 3600.0}
+	return response, nil
+}
+
+func TestThingGateway_EnableAdapter_RequestAsGateway(t *testing.T) {
+	gateway := testGateway(&mockClient{accessTokenFunc: func(string, string) ([]byte, error) {
+		return []byte(`{"access_token":"proxied-token","expires_in":3600}`), nil
+	}})
+	config := testProxyConfig()
+	config.RequestAsGateway = true
+	adapter := &mockAdapter{name: "ble", devices: []southbound.Device{{ID: "C4:7C"}},
+		forwarded: make(map[string][]string)}
+	if err := gateway.EnableAdapter(adapter, config); err == nil {
+		t.Fatal("expected an error before the gateway is initialised")
+	}
+
+	parent := &parentThing{}
+	gateway.gatewayThing = parent
+	if err := gateway.EnableAdapter(adapter, config); err != nil {
+		t.Fatal(err)
+	}
+	gateway.proxies[0].proxy()
+	defer gateway.proxies[0].shutdown()
+	if len(parent.children) != 1 || parent.children[0] != "ble-C4:7C" {
+		t.Errorf("expected a token request for the proxied thing; got %v", parent.children)
+	}
+	if tokens := adapter.forwarded["C4:7C"]; len(tokens) != 1 || tokens[0] != "child-token" {
+		t.Errorf("unexpected tokens forwarded to the device %v", tokens)
+	}
+}
+
+func TestThingGateway_EnableAdapter_Invalid(t *testing.T) {
+	adapter := &mockAdapter{name: "serial"}
+	tests := []struct {
+		name    string
+		adapter southbound.Adapter
+		config  func(*ProxyConfig)
+	}{
+		{name: "no-adapter", config: func(*ProxyConfig) {}},
+		{name: "short-key", adapter: adapter, config: func(c *ProxyConfig) { c.MasterKey = make([]byte, 16) }},
+		{name: "no-interval", adapter: adapter, config: func(c *ProxyConfig) { c.Interval = 0 }},
+		{name: "no-key", adapter: adapter, config: func(c *ProxyConfig) { c.MasterKey = nil }},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			config := testProxyConfig()
+			subtest.config(&config)
+			if err := testGateway(&mockClient{}).EnableAdapter(subtest.adapter, config); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+
+	gateway := testGateway(&mockClient{})
+	if err := gateway.EnableAdapter(adapter, testProxyConfig()); err != nil {
+		t.Fatal(err)
+	}
+	if err := gateway.EnableAdapter(&mockAdapter{name: "serial"}, testProxyConfig()); err == nil {
+		t.Error("expected an error when enabling an adapter twice")
+	}
+}
+
+func TestProxyKey(t *testing.T) {
+	masterKey := bytes.Repeat([]byte{1}, 32)
+	key := proxyKey(masterKey, "ble", "C4:7C:8D:6A:2B:1F")
+	tests := []struct {
+		name      string
+		masterKey []byte
+		adapter   string
+		deviceID  string
+		same      bool
+	}{
+		{name: "same-device", masterKey: masterKey, adapter: "ble", deviceID: "C4:7C:8D:6A:2B:1F", same: true},
+		{name: "other-device", masterKey: masterKey, adapter: "ble", deviceID: "C4:7C:8D:6A:2B:20"},
+		{name: "other-adapter", masterKey: masterKey, adapter: "zigbee", deviceID: "C4:7C:8D:6A:2B:1F"},
+		{name: "other-master-key", masterKey: bytes.Repeat([]byte{2}, 32), adapter: "ble",
+			deviceID: "C4:7C:8D:6A:2B:1F"},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			other := proxyKey(subtest.masterKey, subtest.adapter, subtest.deviceID)
+			if bytes.Equal(key, other) != subtest.same {
+				t.Errorf("expected same key %v", subtest.same)
+			}
+		})
+	}
+}
+
+func TestThingGateway_createProxiedThing_UnsupportedType(t *testing.T) {
+	gateway := testGateway(&mockClient{})
+	identity := southbound.Identity{ThingID: "gateway-1", ThingType: callback.TypeGateway}
+	if _, err := gateway.createProxiedThing("/", identity, proxyKey(make([]byte, 32), "a", "1")); err == nil {
+		t.Error("expected an error for a proxied gateway")
+	}
+}
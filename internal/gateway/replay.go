@@ -0,0 +1,260 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/JacoJooste/iot-edge/v7/internal/debug"
+	"github.com/JacoJooste/iot-edge/v7/internal/storage"
+)
+
+// Recording and replaying AM
+// For integration testing in labs without access to AM, the gateway can record its interactions with AM in a
+// scenario file and later serve the recorded responses instead of connecting to AM. A scenario is a JSON file with the
+// interactions in the order in which they took place, which can be edited to script other flows, for example to make
+// AM reject a thing or respond slowly. A request is served with the first interaction that has not been served with
+// the same method, path and query, ignoring the request body since it contains signatures and nonces that differ
+// from those recorded. Once all the matching interactions have been served, the last one is served again, so that
+// repeated requests, such as token requests, can be replayed. A request without a matching interaction receives a 404
+// response from the replayed AM. Paths are recorded relative to the AM URL so that a scenario can be replayed with
+// any URL. Recorded responses contain the session and access tokens issued by AM, the scenario file is therefore
+// only readable by its owner.
+
+// headersNotRecorded are response headers that are not recorded since they are recreated when the response is served
+var headersNotRecorded = []string{"Date", "Content-Length", "Connection"}
+
+// Interaction is a request made to AM and the response of AM
+type Interaction struct {
+	Method string `json:"method"`
+	// Path of the request relative to the AM URL
+	Path  string `json:"path"`
+	Query string `json:"query,omitempty"`
+	// Request is the body of the request, which is recorded for reference and not used to match requests
+	Request string      `json:"request,omitempty"`
+	Status  int         `json:"status"`
+	Headers http.Header `json:"headers,omitempty"`
+	Body    string      `json:"body,omitempty"`
+	// Delay is the time that AM took to respond, which is added to the replayed response
+	Delay Duration `json:"delay,omitempty"`
+}
+
+// Duration is a time.Duration that is encoded in JSON as a string, for example "250ms"
+type Duration time.Duration
+
+// MarshalJSON encodes the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON decodes the duration from a string
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(s)
+	*d = Duration(duration)
+	return err
+}
+
+// Scenario is a sequence of interactions with AM
+type Scenario struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+// LoadScenario reads a scenario from a JSON file
+func LoadScenario(file string) (scenario Scenario, err error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return scenario, err
+	}
+	if err = json.Unmarshal(b, &scenario); err != nil {
+		return scenario, fmt.Errorf("invalid scenario %s; %w", file, err)
+	}
+	return scenario, nil
+}
+
+// relativePath returns the path of the request relative to the path of the AM URL
+func relativePath(base *url.URL, request *http.Request) string {
+	return "/" + strings.TrimPrefix(strings.TrimPrefix(request.URL.Path, strings.TrimSuffix(base.Path, "/")), "/")
+}
+
+// recordingTransport records the interactions with AM in the scenario file
+type recordingTransport struct {
+	base      *url.URL
+	file      string
+	transport http.RoundTripper
+	mutex     sync.Mutex
+	scenario  Scenario
+}
+
+// RoundTrip makes the request to AM and records the interaction. The scenario file is written after every interaction
+// so that it is complete if the gateway stops unexpectedly.
+func (t *recordingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	interaction := Interaction{Method: request.Method, Path: relativePath(t.base, request),
+		Query: request.URL.RawQuery}
+	if request.Body != nil {
+		b, err := ioutil.ReadAll(request.Body)
+		request.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		interaction.Request = string(b)
+		request.Body = ioutil.NopCloser(bytes.NewReader(b))
+	}
+	start := time.Now()
+	response, err := t.transport.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	response.Body = ioutil.NopCloser(bytes.NewReader(b))
+	interaction.Delay = Duration(time.Since(start).Round(time.Millisecond))
+	interaction.Status = response.StatusCode
+	interaction.Body = string(b)
+	interaction.Headers = response.Header.Clone()
+	for _, name := range headersNotRecorded {
+		interaction.Headers.Del(name)
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.scenario.Interactions = append(t.scenario.Interactions, interaction)
+	scenario, err := json.MarshalIndent(t.scenario, "", "  ")
+	if err == nil {
+		err = storage.WritePrivateFile(t.file, scenario)
+	}
+	if err != nil {
+		debug.Errorf("Unable to record AM interaction %s %s; %s", interaction.Method, interaction.Path, err)
+	}
+	return response, nil
+}
+
+// replayTransport serves the recorded interactions instead of AM
+type replayTransport struct {
+	base     *url.URL
+	mutex    sync.Mutex
+	scenario Scenario
+	served   []bool
+}
+
+// next returns the interaction with which the request is served
+func (t *replayTransport) next(method, path, query string) (Interaction, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	last := -1
+	for i, interaction := range t.scenario.Interactions {
+		if interaction.Method != method || interaction.Path != path || interaction.Query != query {
+			continue
+		}
+		if !t.served[i] {
+			t.served[i] = true
+			return interaction, true
+		}
+		last = i
+	}
+	if last < 0 {
+		return Interaction{}, false
+	}
+	return t.scenario.Interactions[last], true
+}
+
+// RoundTrip serves the request with the next matching interaction
+func (t *replayTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if request.Body != nil {
+		request.Body.Close()
+	}
+	path := relativePath(t.base, request)
+	interaction, ok := t.next(request.Method, path, request.URL.RawQuery)
+	if !ok {
+		debug.Errorf("No recorded AM interaction for %s %s?%s", request.Method, path, request.URL.RawQuery)
+		interaction = Interaction{
+			Status:  http.StatusNotFound,
+			Headers: http.Header{"Content-Type": {string(client.ApplicationJSON)}},
+			Body: fmt.Sprintf(`{"code":404,"reason":"Not Found","message":"No recorded interaction for %s %s"}`,
+				request.Method, path),
+		}
+	}
+	if interaction.Delay > 0 {
+		timer := time.NewTimer(time.Duration(interaction.Delay))
+		select {
+		case <-timer.C:
+		case <-request.Context().Done():
+			timer.Stop()
+			return nil, request.Context().Err()
+		}
+	}
+	headers := interaction.Headers.Clone()
+	if headers == nil {
+		headers = make(http.Header)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", interaction.Status, http.StatusText(interaction.Status)),
+		StatusCode:    interaction.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        headers,
+		Body:          ioutil.NopCloser(strings.NewReader(interaction.Body)),
+		ContentLength: int64(len(interaction.Body)),
+		Request:       request,
+	}, nil
+}
+
+// RecordAM makes the Thing Gateway record its interactions with AM in the scenario file, replacing the content of
+// the file.
+// Must be called before the Thing Gateway is initialised.
+func (c *ThingGateway) RecordAM(file string) error {
+	base, err := url.Parse(c.amURL)
+	if err != nil {
+		return err
+	}
+	if file == "" {
+		return errors.New("a scenario file is required to record AM")
+	}
+	c.amTransport = &recordingTransport{base: base, file: file, transport: http.DefaultTransport}
+	return nil
+}
+
+// ReplayAM makes the Thing Gateway serve the interactions of the scenario instead of connecting to AM.
+// Must be called before the Thing Gateway is initialised.
+func (c *ThingGateway) ReplayAM(scenario Scenario) error {
+	base, err := url.Parse(c.amURL)
+	if err != nil {
+		return err
+	}
+	if len(scenario.Interactions) == 0 {
+		return errors.New("the scenario does not contain any interactions")
+	}
+	c.amTransport = &replayTransport{base: base, scenario: scenario, served: make([]bool, len(scenario.Interactions))}
+	return nil
+}
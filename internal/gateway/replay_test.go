@@ -0,0 +1,135 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/pkg/amtest"
+	"github.com/JacoJooste/iot-edge/v7/pkg/callback"
+	"gopkg.in/square/go-jose.v2"
+)
+
+func TestThingGateway_ReplayAM(t *testing.T) {
+	server := &amtest.Server{
+		Realm: "/edge",
+		Trees: map[string]amtest.Tree{"auth-tree": {amtest.AuthenticateThing{}}},
+	}
+	server.Start()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	server.AddThing(amtest.Thing{ID: "gateway-1", Type: string(callback.TypeGateway), Keys: jose.JSONWebKeySet{
+		Keys: []jose.JSONWebKey{{Key: key.Public(), KeyID: "pop.cnf", Algorithm: string(jose.ES256), Use: "sig"}},
+	}, Attributes: map[string][]string{"site": {"lab"}}})
+	handlers := []callback.Handler{callback.AuthenticateHandler{
+		Audience: "/edge",
+		ThingID:  "gateway-1",
+		KeyID:    "pop.cnf",
+		Key:      key,
+	}}
+	file := filepath.Join(t.TempDir(), "scenario.json")
+	amURL := server.URL().String()
+
+	recorder := NewThingGateway(amURL, "/edge", "auth-tree", 5*time.Second, handlers)
+	if err := recorder.RecordAM(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := recorder.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	recorded, err := recorder.gatewayThing.RequestAttributes("site")
+	if err != nil {
+		t.Fatal(err)
+	} else if recorded.Content["site"] == nil {
+		t.Fatalf("expected the site attribute; got %v", recorded.Content)
+	}
+	server.Close()
+
+	scenario, err := LoadScenario(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scenario.Interactions) == 0 {
+		t.Fatal("expected recorded interactions")
+	}
+	replayer := NewThingGateway(amURL, "/edge", "auth-tree", 5*time.Second, handlers)
+	if err = replayer.ReplayAM(scenario); err != nil {
+		t.Fatal(err)
+	}
+	if err = replayer.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	replayed, err := replayer.gatewayThing.RequestAttributes("site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(replayed.Content["site"], recorded.Content["site"]) {
+		t.Errorf("expected replayed attributes %v; got %v", recorded.Content, replayed.Content)
+	}
+	if _, err = replayer.gatewayThing.RequestAccessToken("publish"); err == nil {
+		t.Error("expected a request that was not recorded to fail")
+	}
+}
+
+func TestReplayTransport_RoundTrip(t *testing.T) {
+	scenario := Scenario{Interactions: []Interaction{
+		{Method: http.MethodGet, Path: "/json/things/a", Status: http.StatusOK, Body: "first"},
+		{Method: http.MethodPost, Path: "/json/things/a", Status: http.StatusOK, Body: "post"},
+		{Method: http.MethodGet, Path: "/json/things/a", Status: http.StatusUnauthorized, Body: "second"},
+		{Method: http.MethodGet, Path: "/json/things/a", Query: "_fields=site", Status: http.StatusOK, Body: "query"},
+	}}
+	thingGateway := NewThingGateway("http://am.example.com/am", "/edge", "auth-tree", time.Second, nil)
+	if err := thingGateway.ReplayAM(scenario); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		method string
+		url    string
+		status int
+		body   string
+	}{
+		{method: http.MethodGet, url: "/am/json/things/a", status: http.StatusOK, body: "first"},
+		{method: http.MethodGet, url: "/am/json/things/a?_fields=site", status: http.StatusOK, body: "query"},
+		{method: http.MethodGet, url: "/am/json/things/a", status: http.StatusUnauthorized, body: "second"},
+		{method: http.MethodGet, url: "/am/json/things/a", status: http.StatusUnauthorized, body: "second"},
+		{method: http.MethodPost, url: "/am/json/things/a", status: http.StatusOK, body: "post"},
+		{method: http.MethodGet, url: "/am/json/things/b", status: http.StatusNotFound},
+	}
+	for _, subtest := range tests {
+		request := httptest.NewRequest(subtest.method, "http://am.example.com"+subtest.url, nil)
+		response, err := thingGateway.amTransport.RoundTrip(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(response.Body)
+		if response.StatusCode != subtest.status {
+			t.Errorf("%s %s: expected status %d; got %d", subtest.method, subtest.url, subtest.status,
+				response.StatusCode)
+		}
+		if subtest.body != "" && string(body) != subtest.body {
+			t.Errorf("%s %s: expected body %s; got %s", subtest.method, subtest.url, subtest.body, body)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/JacoJooste/iot-edge/v7/internal/debug"
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+)
+
+// Resource guards
+// A gateway that runs out of memory or file descriptors is killed, or fails, in the middle of the handshakes and
+// authentications in progress, and all of its things have to start again. Instead, the gateway measures its memory and
+// the number of open file descriptors and, when either crosses its guard, sheds new work until both have fallen back
+// below 90% of their guards:
+//    - TLS handshakes and plain TCP connections are aborted before any cryptographic work is done. DTLS handshakes
+//      are completed since the DTLS listener stops accepting connections after a failed handshake.
+//    - requests that start a new authentication flow are answered with 5.03 Service Unavailable. The Max-Age option
+//      (RFC 7252 section 5.9.3.4) and the retryAfter member of the AM error in the payload tell the thing when to try
+//      again, which the SDK honours as it does for throttling by AM.
+// Sessions and authentication flows in progress are still served so that they can complete and release their
+// resources. The memory is the memory obtained from the operating system by the Go runtime, less the memory returned
+// to it, and the file descriptors are counted on platforms with /proc/self/fd. A guard is not applied if its value is
+// zero. The shedding state is reported by Liveness.
+
+// defaultShedRetryAfter is the delay before a shed thing should try again if none is configured
+const defaultShedRetryAfter = 30 * time.Second
+
+// resourceSampleInterval is the minimum interval between measurements of the resources of the gateway
+const resourceSampleInterval = time.Second
+
+// resumeRatio is the fraction of a guard below which usage must fall before the gateway stops shedding
+const resumeRatio = 0.9
+
+// ResourceGuards are the resource usage levels above which the gateway sheds new handshakes
+type ResourceGuards struct {
+	// MaxMemory is the memory in bytes held by the gateway
+	MaxMemory uint64
+	// MaxFileDescriptors is the number of file descriptors open in the gateway process
+	MaxFileDescriptors int
+	// RetryAfter is the delay after which shed things should try again, defaults to 30 seconds
+	RetryAfter time.Duration
+}
+
+// SetResourceGuards sets the guards that protect the gateway from exhausting its memory and file descriptors.
+// Must be called before the CoAP server is started.
+func (c *ThingGateway) SetResourceGuards(guards ResourceGuards) error {
+	if guards.MaxFileDescriptors < 0 || guards.RetryAfter < 0 {
+		return fmt.Errorf("resource guards must not be negative")
+	}
+	if guards.MaxMemory == 0 && guards.MaxFileDescriptors == 0 {
+		c.guard = nil
+		return nil
+	}
+	c.guard = newResourceGuard(guards, processResources)
+	return nil
+}
+
+// ResourceUsage reports the resources used by the Thing Gateway and whether it is shedding new handshakes
+type ResourceUsage struct {
+	// Memory is the memory in bytes held by the gateway when last measured
+	Memory uint64 `json:"memory"`
+	// FileDescriptors is the number of open file descriptors when last measured, -1 if they can not be counted
+	FileDescriptors int  `json:"fileDescriptors"`
+	Shedding        bool `json:"shedding"`
+	// ShedHandshakes and ShedRequests count the handshakes and new authentication flows that have been shed
+	ShedHandshakes uint64 `json:"shedHandshakes"`
+	ShedRequests   uint64 `json:"shedRequests"`
+}
+
+// processResources measures the memory and open file descriptors of the process
+func processResources() (memory uint64, fds int) {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	memory = stats.Sys - stats.HeapReleased
+	names, err := readDirNames("/proc/self/fd")
+	if err != nil {
+		return memory, -1
+	}
+	return memory, len(names)
+}
+
+// readDirNames returns the names of the entries in the directory
+func readDirNames(name string) ([]string, error) {
+	dir, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	return dir.Readdirnames(-1)
+}
+
+// resourceGuard decides whether new handshakes are shed, a nil guard never sheds
+type resourceGuard struct {
+	guards  ResourceGuards
+	measure func() (memory uint64, fds int)
+	mutex   sync.Mutex
+	sampled time.Time
+	usage   ResourceUsage
+	// counted outside of the mutex
+	shedHandshakes uint64
+	shedRequests   uint64
+}
+
+func newResourceGuard(guards ResourceGuards, measure func() (memory uint64, fds int)) *resourceGuard {
+	if guards.RetryAfter == 0 {
+		guards.RetryAfter = defaultShedRetryAfter
+	}
+	return &resourceGuard{guards: guards, measure: measure}
+}
+
+// exceeds returns true if the usage exceeds the given fraction of a guard
+func (g *resourceGuard) exceeds(memory uint64, fds int, fraction float64) bool {
+	if g.guards.MaxMemory > 0 && float64(memory) > fraction*float64(g.guards.MaxMemory) {
+		return true
+	}
+	return g.guards.MaxFileDescriptors > 0 && float64(fds) > fraction*float64(g.guards.MaxFileDescriptors)
+}
+
+// shedding measures the resources, if the last measurement is out of date, and returns true if new work is shed
+func (g *resourceGuard) shedding() bool {
+	if g == nil {
+		return false
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	now := time.Now()
+	if now.Sub(g.sampled) < resourceSampleInterval {
+		return g.usage.Shedding
+	}
+	g.sampled = now
+	g.usage.Memory, g.usage.FileDescriptors = g.measure()
+	switch {
+	case !g.usage.Shedding && g.exceeds(g.usage.Memory, g.usage.FileDescriptors, 1):
+		debug.Infof("Shedding new handshakes, memory %d bytes, %d file descriptors", g.usage.Memory,
+			g.usage.FileDescriptors)
+		g.usage.Shedding = true
+	case g.usage.Shedding && !g.exceeds(g.usage.Memory, g.usage.FileDescriptors, resumeRatio):
+		debug.Infof("Accepting new handshakes, memory %d bytes, %d file descriptors", g.usage.Memory,
+			g.usage.FileDescriptors)
+		g.usage.Shedding = false
+	}
+	return g.usage.Shedding
+}
+
+// admitHandshake returns false, and counts the handshake as shed, if new handshakes are shed
+func (g *resourceGuard) admitHandshake() bool {
+	if !g.shedding() {
+		return true
+	}
+	atomic.AddUint64(&g.shedHandshakes, 1)
+	return false
+}
+
+// report returns the resource usage, measured again if the last measurement is out of date
+func (g *resourceGuard) report() *ResourceUsage {
+	if g == nil {
+		return nil
+	}
+	g.shedding()
+	g.mutex.Lock()
+	usage := g.usage
+	g.mutex.Unlock()
+	usage.ShedHandshakes = atomic.LoadUint64(&g.shedHandshakes)
+	usage.ShedRequests = atomic.LoadUint64(&g.shedRequests)
+	return &usage
+}
+
+// shedRequest answers a request that starts new work with 5.03 Service Unavailable and the delay after which the thing
+// should try again. Returns false if the request is not shed.
+func (g *resourceGuard) shedRequest(w coap.ResponseWriter) bool {
+	if !g.shedding() {
+		return false
+	}
+	atomic.AddUint64(&g.shedRequests, 1)
+	payload, err := json.Marshal(client.AMError{
+		Code:       http.StatusServiceUnavailable,
+		Reason:     http.StatusText(http.StatusServiceUnavailable),
+		Message:    "Thing Gateway resources exhausted",
+		RetryAfter: g.guards.RetryAfter,
+	})
+	if err != nil {
+		debug.Error(err)
+	}
+	response := w.NewResponse(codes.ServiceUnavailable)
+	response.SetOption(coap.MaxAge, uint32(g.guards.RetryAfter.Round(time.Second)/time.Second))
+	response.SetOption(coap.ContentFormat, coap.AppJSON)
+	response.SetPayload(payload)
+	if err := w.WriteMsg(response); err != nil {
+		debug.Error(err)
+	}
+	return true
+}
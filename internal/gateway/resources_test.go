@@ -0,0 +1,237 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	frcrypto "github.com/JacoJooste/iot-edge/v7/internal/crypto"
+)
+
+// testResources are the resources reported to a resource guard
+type testResources struct {
+	memory uint64
+	fds    int64
+}
+
+func (r *testResources) measure() (uint64, int) {
+	return atomic.LoadUint64(&r.memory), int(atomic.LoadInt64(&r.fds))
+}
+
+func (r *testResources) set(memory uint64, fds int64) {
+	atomic.StoreUint64(&r.memory, memory)
+	atomic.StoreInt64(&r.fds, fds)
+}
+
+// expire forces the guard to measure the resources on the next check
+func (g *resourceGuard) expire() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.sampled = time.Time{}
+}
+
+func TestResourceGuard_Shedding(t *testing.T) {
+	type sample struct {
+		memory   uint64
+		fds      int64
+		shedding bool
+	}
+	tests := []struct {
+		name    string
+		guards  ResourceGuards
+		samples []sample
+	}{
+		{name: "memory", guards: ResourceGuards{MaxMemory: 100}, samples: []sample{
+			{memory: 50}, {memory: 101, shedding: true}, {memory: 95, shedding: true}, {memory: 89},
+		}},
+		{name: "file-descriptors", guards: ResourceGuards{MaxFileDescriptors: 10}, samples: []sample{
+			{fds: 10}, {fds: 11, shedding: true}, {fds: 10, shedding: true}, {fds: 9},
+		}},
+		{name: "either", guards: ResourceGuards{MaxMemory: 100, MaxFileDescriptors: 10}, samples: []sample{
+			{memory: 50, fds: 11, shedding: true}, {memory: 95, fds: 5, shedding: true}, {memory: 50, fds: 5},
+		}},
+		{name: "uncounted-file-descriptors", guards: ResourceGuards{MaxFileDescriptors: 10}, samples: []sample{
+			{fds: -1},
+		}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			resources := &testResources{}
+			guard := newResourceGuard(subtest.guards, resources.measure)
+			for i, s := range subtest.samples {
+				resources.set(s.memory, s.fds)
+				guard.expire()
+				if guard.shedding() != s.shedding {
+					t.Errorf("sample %d: expected shedding %v", i, s.shedding)
+				}
+			}
+		})
+	}
+	var unguarded *resourceGuard
+	if unguarded.shedding() || unguarded.report() != nil {
+		t.Error("expected a nil guard not to shed")
+	}
+}
+
+func TestResourceGuard_Sampling(t *testing.T) {
+	resources := &testResources{}
+	guard := newResourceGuard(ResourceGuards{MaxMemory: 100}, resources.measure)
+	guard.shedding()
+	resources.set(200, 0)
+	if guard.shedding() {
+		t.Error("expected the resources not to be measured again within the sample interval")
+	}
+	if usage := guard.report(); usage.Memory != 0 || usage.Shedding {
+		t.Errorf("unexpected usage %+v", usage)
+	}
+}
+
+func TestThingGateway_SetResourceGuards(t *testing.T) {
+	gateway := testGateway(&mockClient{})
+	if err := gateway.SetResourceGuards(ResourceGuards{MaxFileDescriptors: -1}); err == nil {
+		t.Error("expected negative guards to be rejected")
+	}
+	if err := gateway.SetResourceGuards(ResourceGuards{MaxMemory: 1 << 30}); err != nil {
+		t.Fatal(err)
+	}
+	if gateway.guard == nil || gateway.guard.guards.RetryAfter != defaultShedRetryAfter {
+		t.Error("expected the guard to be set with the default delay")
+	}
+	if usage := gateway.Liveness().Resources; usage == nil || usage.Memory == 0 {
+		t.Errorf("expected the resources to be measured; got %+v", usage)
+	}
+	if err := gateway.SetResourceGuards(ResourceGuards{}); err != nil || gateway.guard != nil {
+		t.Error("expected zero guards to remove the guard")
+	}
+}
+
+func TestGatewayServer_ResourceGuards_DTLS(t *testing.T) {
+	m := &mockClient{AuthenticateFunc: func(payload client.AuthenticatePayload) (client.AuthenticatePayload, error) {
+		return client.AuthenticatePayload{AuthId: "12345"}, nil
+	}}
+	gateway := testGateway(m)
+	resources := &testResources{}
+	gateway.guard = newResourceGuard(ResourceGuards{MaxMemory: 100, RetryAfter: 5 * time.Second}, resources.measure)
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err := gateway.StartCOAPServer("127.0.0.1:0", serverKey); err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.ShutdownCOAPServer()
+
+	gwURL, _ := url.Parse("coaps://" + gateway.Address())
+	connect := func() (client.Connection, error) {
+		return client.NewConnection().
+			ConnectTo(gwURL).
+			WithKey(clientKey).
+			TimeoutRequestAfter(500 * time.Millisecond).
+			Create()
+	}
+	connection, err := connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resources.set(200, 0)
+	gateway.guard.expire()
+
+	// a new authentication flow is shed with the delay after which the thing should try again
+	_, err = connection.Authenticate(client.AuthenticatePayload{})
+	if delay, ok := client.RetryAfter(err); !ok || delay != 5*time.Second {
+		t.Errorf("expected the request to be shed with a delay; got %v", err)
+	}
+	if !errors.Is(err, client.ErrAMUnreachable) {
+		t.Errorf("expected ErrAMUnreachable; got %v", err)
+	}
+	// a flow in progress is completed
+	if _, err = connection.Authenticate(client.AuthenticatePayload{AuthId: "12345"}); err != nil {
+		t.Errorf("expected the flow in progress to be served; got %v", err)
+	}
+	usage := gateway.Liveness().Resources
+	if usage == nil || !usage.Shedding || usage.ShedRequests != 1 {
+		t.Errorf("unexpected usage %+v", usage)
+	}
+
+	resources.set(50, 0)
+	gateway.guard.expire()
+	if _, err = connection.Authenticate(client.AuthenticatePayload{}); err != nil {
+		t.Errorf("expected a new flow to be served once resources are available; got %v", err)
+	}
+}
+
+func TestGatewayServer_ResourceGuards_Handshakes(t *testing.T) {
+	cert, _ := frcrypto.PublicKeyCertificate(clientKey)
+	tests := []struct {
+		name      string
+		transport Transport
+		connect   func(address string) (net.Conn, error)
+	}{
+		{name: "tcp", transport: TransportTCP, connect: func(address string) (net.Conn, error) {
+			conn, err := net.Dial("tcp", address)
+			if err != nil {
+				return nil, err
+			}
+			if !testClosedByServer(conn, time.Second) {
+				return conn, nil
+			}
+			conn.Close()
+			return nil, errors.New("closed by server")
+		}},
+		{name: "tls", transport: TransportTLS, connect: func(address string) (net.Conn, error) {
+			return tls.Dial("tcp", address, &tls.Config{Certificates: []tls.Certificate{cert},
+				InsecureSkipVerify: true})
+		}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			gateway := testGateway(&mockClient{})
+			if err := gateway.SetTransport(subtest.transport); err != nil {
+				t.Fatal(err)
+			}
+			resources := &testResources{memory: 200}
+			gateway.guard = newResourceGuard(ResourceGuards{MaxMemory: 100}, resources.measure)
+			serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			if err := gateway.StartCOAPServer("127.0.0.1:0", serverKey); err != nil {
+				t.Fatal(err)
+			}
+			defer gateway.ShutdownCOAPServer()
+
+			if conn, err := subtest.connect(gateway.Address()); err == nil {
+				conn.Close()
+				t.Error("expected the connection to be shed")
+			}
+			if usage := gateway.Liveness().Resources; usage.ShedHandshakes != 1 {
+				t.Errorf("unexpected usage %+v", usage)
+			}
+			resources.set(50, 0)
+			gateway.guard.expire()
+			conn, err := subtest.connect(gateway.Address())
+			if err != nil {
+				t.Fatalf("expected the connection to be accepted once resources are available; got %v", err)
+			}
+			conn.Close()
+		})
+	}
+}
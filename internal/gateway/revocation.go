@@ -0,0 +1,184 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/JacoJooste/iot-edge/v7/internal/jws"
+	"github.com/JacoJooste/iot-edge/v7/pkg/callback"
+)
+
+// Session revocation
+// The gateway holds state for a thing that outlives the AM session with which it was created: OSCORE security
+// contexts and the knowledge used to authenticate the thing offline. To stop a thing whose session has been revoked in
+// AM from using this state, the gateway tracks the sessions created through it and periodically validates them with
+// AM. When AM reports that a session is no longer valid, the thing's OSCORE contexts and offline sessions are removed
+// and the thing must authenticate with AM before it can be authenticated offline again. Sessions that have expired
+// are treated in the same way as revoked sessions.
+
+// sessionRevocation tracks the sessions of things authenticated through the gateway
+type sessionRevocation struct {
+	interval time.Duration
+	mutex    sync.Mutex
+	// thing ID by session token
+	sessions map[string]string
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func newSessionRevocation(interval time.Duration) *sessionRevocation {
+	return &sessionRevocation{
+		interval: interval,
+		sessions: make(map[string]string),
+	}
+}
+
+// track the session of the thing
+func (r *sessionRevocation) track(token, thingID string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.sessions[token] = thingID
+}
+
+// untrack the session, returning the ID of the thing that the session belonged to
+func (r *sessionRevocation) untrack(token string) (string, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	thingID, ok := r.sessions[token]
+	delete(r.sessions, token)
+	return thingID, ok
+}
+
+// tracked returns a copy of the tracked sessions
+func (r *sessionRevocation) tracked() map[string]string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	sessions := make(map[string]string, len(r.sessions))
+	for token, thingID := range r.sessions {
+		sessions[token] = thingID
+	}
+	return sessions
+}
+
+// thingID returns the subject of the JWT PoP responses in the callbacks
+func thingID(callbacks []callback.Callback) string {
+	for _, token := range popResponses(callbacks) {
+		var claims popClaims
+		if err := jws.ExtractClaims(token, &claims); err == nil && claims.Sub != "" {
+			return claims.Sub
+		}
+	}
+	return ""
+}
+
+// trackSession records the session created by a successful authentication
+func (c *ThingGateway) trackSession(auth client.AuthenticatePayload, reply client.AuthenticatePayload) {
+	if c.revocation == nil {
+		return
+	}
+	if id := thingID(auth.Callbacks); id != "" {
+		c.revocation.track(reply.TokenID, id)
+	}
+}
+
+// sessionInvalid removes the state held for the thing whose session is no longer valid
+func (c *ThingGateway) sessionInvalid(token string) {
+	c.cache.evictSession(token)
+	c.pages.forget(token)
+	c.lifetimes.forget(token)
+	c.access.forget(token)
+	if c.issuer != nil {
+		c.issuer.forget(token)
+	}
+	if c.revocation == nil {
+		return
+	}
+	id, ok := c.revocation.untrack(token)
+	if !ok {
+		return
+	}
+	c.log.Infof("Session of thing %s is no longer valid, removing cached state", id)
+	c.oscore.evict(id)
+	if c.offline != nil {
+		c.offline.revoke(id)
+	}
+	if c.subscriptions != nil {
+		c.subscriptions.evict(id)
+	}
+}
+
+// validateSessions validates the tracked sessions with AM and removes the state of things with invalid sessions
+func (c *ThingGateway) validateSessions() {
+	for token := range c.revocation.tracked() {
+		valid, err := c.amConnection.ValidateSession(token)
+		if errors.Is(err, client.ErrAMUnreachable) {
+			// try again in the next round
+			return
+		}
+		if err != nil {
+			c.log.Errorf("Unable to validate session; %s", err)
+			continue
+		}
+		if !valid {
+			c.sessionInvalid(token)
+		}
+	}
+}
+
+// startSessionValidation starts validating the tracked sessions periodically
+func (c *ThingGateway) startSessionValidation() {
+	if c.revocation == nil {
+		return
+	}
+	c.revocation.stop = make(chan struct{})
+	c.revocation.done = make(chan struct{})
+	go func(stop <-chan struct{}, done chan<- struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(c.revocation.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.validateSessions()
+			case <-stop:
+				return
+			}
+		}
+	}(c.revocation.stop, c.revocation.done)
+}
+
+// stopSessionValidation stops the periodic validation of sessions
+func (c *ThingGateway) stopSessionValidation() {
+	if c.revocation == nil || c.revocation.stop == nil {
+		return
+	}
+	close(c.revocation.stop)
+	<-c.revocation.done
+	c.revocation.stop = nil
+}
+
+// EnableSessionRevocation makes the Thing Gateway validate the sessions of things authenticated through it with AM at
+// the given interval. The OSCORE security contexts and offline sessions of a thing are removed as soon as its session
+// is found to be revoked, so that the thing must authenticate with AM again.
+// Must be called before the CoAP server is started.
+func (c *ThingGateway) EnableSessionRevocation(interval time.Duration) {
+	c.revocation = newSessionRevocation(interval)
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/JacoJooste/iot-edge/v7/pkg/callback"
+)
+
+func TestThingGateway_SessionRevocation(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	handler := callback.AuthenticateHandler{Audience: "/", ThingID: "Bob", KeyID: "pop.cnf", Key: key}
+	tests := []struct {
+		name    string
+		valid   bool
+		err     error
+		revoked bool
+	}{
+		{name: "revoked", revoked: true},
+		{name: "valid", valid: true},
+		{name: "am-unreachable", err: errTestAMUnreachable},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			var events []AuditEvent
+			gateway, reachable := testOfflineGateway(t, handler, &events)
+			// the session created while learning the thing was not tracked, authenticate again to track it
+			gateway.EnableSessionRevocation(time.Hour)
+			cb := callback.Callback{
+				Type:   callback.TypeHiddenValueCallback,
+				Output: []callback.Entry{{Name: "id", Value: authenticationCBID}, {Name: "value", Value: "1"}},
+				Input:  make([]callback.Entry, 1),
+			}
+			if _, err := handler.Handle(cb); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := gateway.authenticate(gateway.amConnection, client.AuthenticatePayload{Callbacks: []callback.Callback{cb}}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := gateway.oscore.add([]byte("secret"), []byte("salt"), []byte("Bob"), "Bob"); err != nil {
+				t.Fatal(err)
+			}
+			gateway.amConnection.(*mockClient).validateFunc = func(string) (bool, error) {
+				return subtest.valid, subtest.err
+			}
+
+			gateway.validateSessions()
+			things := gateway.CachedSessions().Things
+			if len(things) != 1 || (things[0].OSCOREContexts == 0) != subtest.revoked {
+				t.Errorf("unexpected cached state %v", things)
+			}
+			*reachable = false
+			_, err := testOfflineAuthenticate(gateway, handler)
+			if subtest.revoked && err == nil {
+				t.Error("expected offline authentication to fail after revocation")
+			}
+			if !subtest.revoked && err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// check that a thing logging out does not cause its state to be removed
+func TestThingGateway_SessionRevocation_Logout(t *testing.T) {
+	gateway := testGateway(&mockClient{})
+	gateway.EnableSessionRevocation(time.Hour)
+	gateway.revocation.track("12345", "Bob")
+	if _, err := gateway.oscore.add([]byte("secret"), []byte("salt"), []byte("Bob"), "Bob"); err != nil {
+		t.Fatal(err)
+	}
+	gateway.revocation.untrack("12345")
+	gateway.amConnection.(*mockClient).validateFunc = func(string) (bool, error) {
+		return false, nil
+	}
+	gateway.validateSessions()
+	if len(gateway.CachedSessions().Things) != 1 {
+		t.Error("state removed after log out")
+	}
+	if _, ok := gateway.revocation.tracked()["12345"]; ok {
+		t.Error("session still tracked")
+	}
+}
+
+// check that the state of a thing is kept when the validation of its session is dropped and removed once AM is
+// reachable again
+func TestThingGateway_SessionRevocation_Dropped(t *testing.T) {
+	m := &mockClient{
+		faults: faultScript{"validate": {{drop: true}}},
+		validateFunc: func(string) (bool, error) {
+			return false, nil
+		},
+	}
+	gateway := testGateway(m)
+	gateway.EnableSessionRevocation(time.Hour)
+	gateway.revocation.track("12345", "Bob")
+	if _, err := gateway.oscore.add([]byte("secret"), []byte("salt"), []byte("Bob"), "Bob"); err != nil {
+		t.Fatal(err)
+	}
+	gateway.validateSessions()
+	if len(gateway.CachedSessions().Things) != 1 {
+		t.Fatal("state removed while AM was unreachable")
+	}
+	gateway.validateSessions()
+	if things := gateway.CachedSessions().Things; len(things) != 0 {
+		t.Errorf("state not removed after revocation %v", things)
+	}
+}
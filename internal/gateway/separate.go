@@ -0,0 +1,221 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/debug"
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+	"github.com/patrickmn/go-cache"
+)
+
+// Separate responses
+// A thing retransmits a confirmable request that has not been acknowledged within the CoAP retransmission timeout,
+// which is shorter than a slow AM round trip. Without an acknowledgement the thing sends the same request several
+// times and the gateway forwards each copy to AM. When separate responses are enabled, a confirmable request that
+// has not been answered within the delay is acknowledged with an empty message and the response is sent in a
+// non-confirmable message of its own once it is ready (RFC 7252 section 5.2.2).
+// Requests are deduplicated by the address of the thing and the token of the request: a copy that arrives while the
+// request is in progress is acknowledged again, if the original has been acknowledged, or ignored, and a copy that
+// arrives after the response has been sent is answered with the same response without serving the request again.
+// Separate responses only apply to the DTLS transport since reliable transports do not acknowledge messages.
+
+// exchangeLifetime is the time during which a thing may retransmit a confirmable request, see RFC 7252 section 4.8.2
+const exchangeLifetime = 247 * time.Second
+
+var errSeparateResponseDelay = errors.New("separate response delay must be positive")
+
+// separateResponses holds the exchanges with things that are deduplicated
+type separateResponses struct {
+	delay     time.Duration
+	exchanges *cache.Cache
+}
+
+// exchange is a confirmable request from a thing and the response to it
+type exchange struct {
+	mutex        sync.Mutex
+	acknowledged bool
+	response     coap.Message
+	timer        *time.Timer
+}
+
+// EnableSeparateResponses acknowledges confirmable requests that have not been answered within the delay and sends
+// the response separately once it is ready. Retransmitted requests are deduplicated by token.
+// Must be called before the CoAP server is started.
+func (c *ThingGateway) EnableSeparateResponses(delay time.Duration) error {
+	if delay <= 0 {
+		return errSeparateResponseDelay
+	}
+	c.separate = &separateResponses{
+		delay:     delay,
+		exchanges: cache.New(exchangeLifetime, exchangeLifetime),
+	}
+	return nil
+}
+
+// exchangeKey identifies the exchange of a request by the address of the thing and the token of the request
+// Things that do not use tokens send every request with an empty token so the message ID identifies the exchange.
+func exchangeKey(r *coap.Request) string {
+	key := r.Client.RemoteAddr().String() + "|" + string(r.Msg.Token())
+	if len(r.Msg.Token()) == 0 {
+		key += "|" + strconv.Itoa(int(r.Msg.MessageID()))
+	}
+	return key
+}
+
+// isRequest returns true if the code is a request method
+func isRequest(code codes.Code) bool {
+	return code >= codes.GET && code <= codes.DELETE
+}
+
+// acknowledge sends an empty acknowledgement of the request if the response has not been sent yet
+func (e *exchange) acknowledge(r *coap.Request) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.response != nil {
+		return
+	}
+	debug.Tracef("Acknowledging request %d before the response is ready", r.Msg.MessageID())
+	if err := writeEmptyAcknowledgement(r); err != nil {
+		debug.Error(err)
+		return
+	}
+	e.acknowledged = true
+}
+
+// respond sends the response, piggybacked on the acknowledgement of the request or separately if the request has
+// already been acknowledged
+func (e *exchange) respond(w coap.ResponseWriter, response coap.Message) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.response != nil {
+		return errors.New("response has already been sent")
+	}
+	e.timer.Stop()
+	e.response = response
+	if e.acknowledged {
+		response.SetType(coap.NonConfirmable)
+		response.SetMessageID(coap.GenerateMessageID())
+	}
+	return w.WriteMsg(response)
+}
+
+// duplicate answers a retransmission of the request
+func (e *exchange) duplicate(r *coap.Request) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	var err error
+	switch {
+	case e.response != nil:
+		debug.Tracef("Replaying the response to duplicate request %d", r.Msg.MessageID())
+		e.response.SetType(coap.Acknowledgement)
+		e.response.SetMessageID(r.Msg.MessageID())
+		err = r.Client.WriteMsg(e.response)
+	case e.acknowledged:
+		err = writeEmptyAcknowledgement(r)
+	default:
+		debug.Tracef("Ignoring duplicate request %d while the request is in progress", r.Msg.MessageID())
+	}
+	if err != nil {
+		debug.Error(err)
+	}
+}
+
+func writeEmptyAcknowledgement(r *coap.Request) error {
+	return r.Client.WriteMsg(r.Client.NewMessage(coap.MessageParams{
+		Type:      coap.Acknowledgement,
+		Code:      codes.Empty,
+		MessageID: r.Msg.MessageID(),
+	}))
+}
+
+// separateResponseWriter sends the response written by a handler through the exchange of the request
+type separateResponseWriter struct {
+	protectedResponseWriter
+	exchange *exchange
+	request  codes.Code
+}
+
+func (w *separateResponseWriter) Write(p []byte) (n int, err error) {
+	response := w.NewResponse(w.responseCode(w.request))
+	if w.contentFormat != nil {
+		response.SetOption(coap.ContentFormat, *w.contentFormat)
+	}
+	if p != nil {
+		response.SetPayload(p)
+	}
+	return len(p), w.WriteMsg(response)
+}
+
+func (w *separateResponseWriter) WriteWithContext(_ context.Context, p []byte) (n int, err error) {
+	return w.Write(p)
+}
+
+func (w *separateResponseWriter) WriteMsg(msg coap.Message) error {
+	return w.exchange.respond(w.ResponseWriter, msg)
+}
+
+func (w *separateResponseWriter) WriteMsgWithContext(_ context.Context, msg coap.Message) error {
+	return w.WriteMsg(msg)
+}
+
+// separateSlowResponses returns a handler that deduplicates confirmable requests and acknowledges them if the given
+// handler does not respond within the separate response delay.
+func (c *ThingGateway) separateSlowResponses(next coap.Handler) coap.Handler {
+	if c.separate == nil || (c.transport != "" && c.transport != TransportDTLS) {
+		return next
+	}
+	separate := c.separate
+	return coap.HandlerFunc(func(w coap.ResponseWriter, r *coap.Request) {
+		if !isRequest(r.Msg.Code()) {
+			// responses and acknowledgements that are not expected by the gateway are not answered
+			return
+		}
+		if r.Msg.Type() != coap.Confirmable || r.Msg.Option(coap.Observe) != nil {
+			next.ServeCOAP(w, r)
+			return
+		}
+		key := exchangeKey(r)
+		e := &exchange{}
+		e.mutex.Lock()
+		if err := separate.exchanges.Add(key, e, cache.DefaultExpiration); err != nil {
+			e.mutex.Unlock()
+			if existing, ok := separate.exchanges.Get(key); ok {
+				existing.(*exchange).duplicate(r)
+			}
+			return
+		}
+		e.timer = time.AfterFunc(separate.delay, func() {
+			e.acknowledge(r)
+		})
+		e.mutex.Unlock()
+		next.ServeCOAP(&separateResponseWriter{
+			protectedResponseWriter: protectedResponseWriter{ResponseWriter: w},
+			exchange:                e,
+			request:                 r.Msg.Code(),
+		}, r)
+		e.mutex.Lock()
+		e.timer.Stop()
+		e.mutex.Unlock()
+	})
+}
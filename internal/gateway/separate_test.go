@@ -0,0 +1,153 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	frcrypto "github.com/JacoJooste/iot-edge/v7/internal/crypto"
+	"github.com/JacoJooste/iot-edge/v7/pkg/callback"
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+)
+
+func TestGatewayServer_SeparateResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		latency time.Duration
+		value   string
+	}{
+		{name: "piggybacked", value: "12345"},
+		{name: "separate", latency: 200 * time.Millisecond, value: "12345"},
+		{name: "separate-block-wise", latency: 200 * time.Millisecond, value: strings.Repeat("a", 2*client.DefaultBlockSize)},
+	}
+	for _, subtest := range tests {
+		// the handlers of the gateway may still be running when the next subtest starts
+		subtest := subtest
+		t.Run(subtest.name, func(t *testing.T) {
+			var calls int32
+			m := &mockClient{AuthenticateFunc: func(payload client.AuthenticatePayload) (client.AuthenticatePayload, error) {
+				atomic.AddInt32(&calls, 1)
+				time.Sleep(subtest.latency)
+				return client.AuthenticatePayload{AuthId: "12345", Callbacks: payload.Callbacks}, nil
+			}}
+			serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			gateway := testGateway(m)
+			if err := gateway.EnableSeparateResponses(50 * time.Millisecond); err != nil {
+				t.Fatal(err)
+			}
+			if err := gateway.StartCOAPServer(":0", serverKey); err != nil {
+				t.Fatal(err)
+			}
+			defer gateway.ShutdownCOAPServer()
+
+			reply, err := gatewayConnection(t, gateway).Authenticate(client.AuthenticatePayload{
+				Callbacks: []callback.Callback{{Input: []callback.Entry{{Name: "IDToken1", Value: subtest.value}}}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(reply.Callbacks) != 1 || reply.Callbacks[0].Input[0].Value != subtest.value {
+				t.Error("incomplete reply")
+			}
+			if n := atomic.LoadInt32(&calls); n != 1 {
+				t.Errorf("expected a single request to AM; got %d", n)
+			}
+		})
+	}
+}
+
+// check that retransmitted requests are not forwarded to AM
+func TestGatewayServer_DuplicateRequest(t *testing.T) {
+	var calls int32
+	m := &mockClient{accessTokenFunc: func(string, string) ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(100 * time.Millisecond)
+		return []byte(`{"access_token":"12345"}`), nil
+	}}
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	gateway := testGateway(m)
+	if err := gateway.EnableSeparateResponses(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := gateway.StartCOAPServer(":0", serverKey); err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.ShutdownCOAPServer()
+
+	// block-wise transfer is disabled so that the client sends the same message each time
+	cert, _ := frcrypto.PublicKeyCertificate(clientKey)
+	blockWise := false
+	coapClient := &coap.Client{Net: "udp-dtls", DTLSConfig: dtlsClientConfig(cert), BlockWiseTransfer: &blockWise}
+	conn, err := coapClient.Dial(gateway.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	request, err := conn.NewPostRequest("/accesstoken", client.AppJOSE, strings.NewReader(".eyJjc3JmIjoiMTIzNDUifQ."))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	responses := make(chan coap.Message, 1)
+	go func() {
+		response, err := conn.ExchangeWithContext(context.Background(), request)
+		if err != nil {
+			t.Error(err)
+		}
+		responses <- response
+	}()
+	// retransmit the request while it is in progress
+	time.Sleep(20 * time.Millisecond)
+	if err := conn.WriteMsg(request); err != nil {
+		t.Fatal(err)
+	}
+	original := <-responses
+	if original == nil || original.Code() != codes.Changed {
+		t.Fatalf("unexpected response %v", original)
+	}
+
+	// retransmit the request after the response has been sent
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	replayed, err := conn.ExchangeWithContext(ctx, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed.Code() != original.Code() || !bytes.Equal(replayed.Payload(), original.Payload()) {
+		t.Errorf("expected the response to be replayed; got %v", replayed)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("expected a single request to AM; got %d", n)
+	}
+}
+
+func TestGateway_EnableSeparateResponses(t *testing.T) {
+	gateway := testGateway(&mockClient{})
+	if err := gateway.EnableSeparateResponses(0); err == nil {
+		t.Error("expected a zero delay to be rejected")
+	}
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/debug"
+)
+
+// Startup gates
+// Things that connect to a gateway that is not ready fail in ways that are hard to explain, for example a gateway
+// whose clock has not been synchronised after a cold boot signs JWTs that AM rejects as expired or not yet valid.
+// Startup gates hold back the initialisation of the gateway, and so the start of the CoAP server, until the conditions
+// on which the gateway depends are met. The gates are waited for in the order in which they are added, so that, for
+// example, AM is only contacted once the clock is synchronised. A gate with a timeout fails the start of the gateway
+// if its condition is not met in time, which lets a supervisor restart it.
+
+// StartupGate is a condition that must be met before the Thing Gateway is initialised
+type StartupGate struct {
+	// Name identifies the gate in logs and errors
+	Name string
+	// Check returns an error that describes why the condition is not met, or nil once it is met
+	Check func() error
+	// Timeout is the maximum time to wait for the condition, the gate waits indefinitely if zero
+	Timeout time.Duration
+}
+
+// startupGateInterval is the time between checks of a startup gate
+var startupGateInterval = time.Second
+
+// Wait blocks until the condition of the gate is met and returns an error if it is not met before the timeout
+func (g StartupGate) Wait() error {
+	start := time.Now()
+	for logged := false; ; logged = true {
+		err := g.Check()
+		if err == nil {
+			if logged {
+				debug.Infof("Startup gate %s passed after %v", g.Name, time.Since(start).Round(time.Millisecond))
+			}
+			return nil
+		}
+		if g.Timeout > 0 && time.Since(start)+startupGateInterval > g.Timeout {
+			return fmt.Errorf("startup gate %s not passed after %v; %w", g.Name, g.Timeout, err)
+		}
+		if !logged {
+			debug.Infof("Waiting for startup gate %s; %s", g.Name, err)
+		}
+		time.Sleep(startupGateInterval)
+	}
+}
+
+// AddStartupGate adds a gate that must be passed before the Thing Gateway is initialised.
+// Must be called before the Thing Gateway is initialised.
+func (c *ThingGateway) AddStartupGate(gate StartupGate) error {
+	if gate.Name == "" || gate.Check == nil {
+		return errors.New("a startup gate requires a name and a check")
+	}
+	c.startupGates = append(c.startupGates, gate)
+	return nil
+}
+
+// waitForStartupGates waits for each startup gate in turn
+func (c *ThingGateway) waitForStartupGates() error {
+	for _, gate := range c.startupGates {
+		if err := gate.Wait(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// KeysGate returns a gate that is passed once the gateway can sign with its keys, for example once the hardware that
+// holds the keys is available
+func (c *ThingGateway) KeysGate(timeout time.Duration) StartupGate {
+	return StartupGate{Name: "keys", Timeout: timeout, Check: func() error {
+		_, err := c.checkKeys()
+		return err
+	}}
+}
+
+// AMReachableGate returns a gate that is passed once AM responds to a request for its URL. Any response counts, since
+// it shows that AM can be reached, and the TLS certificate of AM is verified, which requires a valid clock.
+func (c *ThingGateway) AMReachableGate(timeout time.Duration) StartupGate {
+	return StartupGate{Name: "am", Timeout: timeout, Check: func() error {
+		// the transport is nil, and the default transport is used, unless AM is recorded or replayed
+		client := http.Client{Transport: c.amTransport, Timeout: c.timeout}
+		response, err := client.Get(c.amURL)
+		if err != nil {
+			return err
+		}
+		return response.Body.Close()
+	}}
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStartupGate_Wait(t *testing.T) {
+	defer func(interval time.Duration) {
+		startupGateInterval = interval
+	}(startupGateInterval)
+	startupGateInterval = time.Millisecond
+	notReady := errors.New("not ready")
+
+	tests := []struct {
+		name    string
+		passAt  int
+		timeout time.Duration
+		passed  bool
+	}{
+		{name: "passed", passAt: 1, timeout: time.Second, passed: true},
+		{name: "passed-later", passAt: 5, timeout: time.Second, passed: true},
+		{name: "no-timeout", passAt: 5, passed: true},
+		{name: "timed-out", passAt: 1000000, timeout: 20 * time.Millisecond},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			checks := 0
+			gate := StartupGate{Name: subtest.name, Timeout: subtest.timeout, Check: func() error {
+				checks++
+				if checks < subtest.passAt {
+					return notReady
+				}
+				return nil
+			}}
+			err := gate.Wait()
+			if subtest.passed && err != nil {
+				t.Errorf("expected the gate to pass; got %v", err)
+			} else if !subtest.passed && !errors.Is(err, notReady) {
+				t.Errorf("expected %v; got %v", notReady, err)
+			}
+		})
+	}
+}
+
+func TestThingGateway_StartupGates(t *testing.T) {
+	defer func(interval time.Duration) {
+		startupGateInterval = interval
+	}(startupGateInterval)
+	startupGateInterval = time.Millisecond
+
+	notReady := errors.New("not ready")
+	var order []string
+	gate := func(name string, err error) StartupGate {
+		return StartupGate{Name: name, Timeout: 10 * time.Millisecond, Check: func() error {
+			order = append(order, name)
+			return err
+		}}
+	}
+	thingGateway := NewThingGateway("http://127.0.0.1:1/am", "/edge", "auth-tree", time.Second, nil)
+	for _, g := range []StartupGate{gate("first", nil), gate("second", notReady)} {
+		if err := thingGateway.AddStartupGate(g); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := thingGateway.AddStartupGate(StartupGate{Name: "no-check"}); err == nil {
+		t.Error("expected a gate without a check to be rejected")
+	}
+	if err := thingGateway.Initialise(); !errors.Is(err, notReady) {
+		t.Fatalf("expected the initialisation to fail at the second gate; got %v", err)
+	}
+	if len(order) < 2 || order[0] != "first" || order[1] != "second" {
+		t.Errorf("expected the gates to be waited for in order; got %v", order)
+	}
+}
+
+func TestThingGateway_AMReachableGate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	thingGateway := NewThingGateway(server.URL+"/am", "/edge", "auth-tree", time.Second, nil)
+	gate := thingGateway.AMReachableGate(time.Second)
+	if err := gate.Check(); err != nil {
+		t.Errorf("expected any response from AM to pass the gate; got %v", err)
+	}
+	server.Close()
+	if err := gate.Check(); err == nil {
+		t.Error("expected an unreachable AM to fail the gate")
+	}
+}
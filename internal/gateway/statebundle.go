@@ -0,0 +1,153 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/storage"
+)
+
+// State bundles
+// When the gateway hardware fails, the replacement gateway must take over the identity of the failed gateway and the
+// keys of its proxied things, otherwise every attached thing has to be provisioned again. The state of a gateway is
+// exported to a bundle that contains its state files, such as its key, certificates, OAuth 2.0 client registration,
+// access list and AM information cache, together with the keys of its proxied thing key store. The bundle is
+// encrypted with a key derived from a passphrase. The keys of proxied things stay wrapped in the bundle, see
+// ProxyKeyStore.Export, and are re-wrapped with the KEK of the replacement gateway on import.
+
+var errStateBundleFormat = errors.New("unsupported state bundle format")
+
+// stateBundleFile is the encrypted content of a state bundle
+type stateBundleFile struct {
+	Version int    `json:"version"`
+	Salt    []byte `json:"salt"`
+	State   []byte `json:"state"`
+}
+
+// gatewayState is the state of a gateway that is encrypted in a bundle
+type gatewayState struct {
+	Created time.Time `json:"created"`
+	// Files by their role, for example "key"
+	Files map[string][]byte `json:"files"`
+	// ProxyKeys are the keys exported from the proxied thing key store, if the gateway has one
+	ProxyKeys json.RawMessage `json:"proxy_keys,omitempty"`
+}
+
+// ExportState exports the state files, given by their role, and the keys in the proxied thing key store to a bundle
+// that is encrypted with a key derived from the passphrase. Files that do not exist are left out. The store is optional.
+func ExportState(files map[string]string, store *ProxyKeyStore, passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("an export passphrase is required")
+	}
+	state := gatewayState{Created: time.Now().UTC(), Files: make(map[string][]byte)}
+	for role, name := range files {
+		if name == "" {
+			continue
+		}
+		b, err := ioutil.ReadFile(name)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		state.Files[role] = b
+	}
+	var err error
+	if store != nil {
+		if state.ProxyKeys, err = store.Export(passphrase); err != nil {
+			return nil, err
+		}
+	}
+	plaintext, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err = io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	kek, err := exportKeyEncryptionKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	bundle := stateBundleFile{Version: 1, Salt: salt}
+	if bundle.State, err = kek.Wrap(plaintext); err != nil {
+		return nil, err
+	}
+	return json.Marshal(bundle)
+}
+
+// ImportState writes the state files in the bundle to the files given for their roles and imports the keys of
+// proxied things into the store. A state file is not imported if no file is given for its role and the import fails
+// if a file already exists, so that the state of a working gateway is not overwritten. Returns the sorted roles of
+// the imported files.
+func ImportState(data, passphrase []byte, files map[string]string, store *ProxyKeyStore) ([]string, error) {
+	var bundle stateBundleFile
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return nil, err
+	}
+	if bundle.Version != 1 || len(bundle.Salt) == 0 {
+		return nil, errStateBundleFormat
+	}
+	kek, err := exportKeyEncryptionKey(passphrase, bundle.Salt)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := kek.Unwrap(bundle.State)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt state bundle, check the passphrase; %w", err)
+	}
+	var state gatewayState
+	if err = json.Unmarshal(plaintext, &state); err != nil {
+		return nil, err
+	}
+	if len(state.ProxyKeys) > 0 && store == nil {
+		return nil, errors.New("the bundle contains the keys of proxied things but no key store was given")
+	}
+	roles := make([]string, 0, len(state.Files))
+	for role := range state.Files {
+		name := files[role]
+		if name == "" {
+			continue
+		}
+		if _, err := os.Stat(name); err == nil {
+			return nil, fmt.Errorf("the %s file %s already exists", role, name)
+		}
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	for _, role := range roles {
+		if err = storage.WritePrivateFile(files[role], state.Files[role]); err != nil {
+			return nil, err
+		}
+	}
+	if len(state.ProxyKeys) > 0 {
+		if _, err = store.Import(state.ProxyKeys, passphrase); err != nil {
+			return nil, err
+		}
+	}
+	return roles, nil
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestExportImportState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	old := map[string]string{
+		"key":           filepath.Join(dir, "old", "gateway.key"),
+		"oauth2-client": filepath.Join(dir, "old", "client.json"),
+		"access-list":   filepath.Join(dir, "old", "access.json"),
+	}
+	if err = os.Mkdir(filepath.Join(dir, "old"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for role, name := range old {
+		// the access list does not exist on the failed gateway
+		if role == "access-list" {
+			continue
+		}
+		if err = ioutil.WriteFile(name, []byte(role+" content"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store, err := OpenProxyKeyStore(filepath.Join(dir, "old", "proxy.keys"), testKeyEncryptionKey(t, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := store.key("modbus", "7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle, err := ExportState(old, store, []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(bundle, []byte("key content")) {
+		t.Error("expected the state files to be encrypted in the bundle")
+	}
+	if _, err = ExportState(old, store, nil); err == nil {
+		t.Error("expected an export without a passphrase to fail")
+	}
+
+	// the replacement gateway has a different KEK and does not use the OAuth 2.0 client file
+	replacement := map[string]string{
+		"key":         filepath.Join(dir, "new", "gateway.key"),
+		"access-list": filepath.Join(dir, "new", "access.json"),
+	}
+	replacementStore, err := OpenProxyKeyStore(filepath.Join(dir, "new", "proxy.keys"), testKeyEncryptionKey(t, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ImportState(bundle, []byte("battery staple"), replacement, replacementStore); err == nil {
+		t.Fatal("expected an import with the wrong passphrase to fail")
+	}
+	if _, err = ImportState(bundle, []byte("correct horse"), replacement, nil); err == nil {
+		t.Fatal("expected an import of proxy keys without a key store to fail")
+	}
+	roles, err := ImportState(bundle, []byte("correct horse"), replacement, replacementStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(roles, []string{"key"}) {
+		t.Errorf("expected the key to be imported; got %v", roles)
+	}
+	b, err := ioutil.ReadFile(replacement["key"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "key content" {
+		t.Errorf("unexpected imported key file %q", b)
+	}
+	reopened, err := OpenProxyKeyStore(filepath.Join(dir, "new", "proxy.keys"), testKeyEncryptionKey(t, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err := reopened.key("modbus", "7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, imported) {
+		t.Error("expected the imported proxy key to equal the exported key")
+	}
+
+	// the state of a working gateway is not overwritten
+	if _, err = ImportState(bundle, []byte("correct horse"), replacement, replacementStore); err == nil {
+		t.Error("expected an import over existing files to fail")
+	}
+}
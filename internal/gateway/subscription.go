@@ -0,0 +1,296 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/JacoJooste/iot-edge/v7/internal/debug"
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+)
+
+// Attribute subscriptions
+// A thing subscribes to changes of its identity attributes by observing (RFC 7641) the attributes resource of the
+// gateway with the same request that it uses to read the attributes. The gateway forwards the request to AM to check
+// that the thing is allowed to read the attributes and returns the current values in the first notification. AM does
+// not notify clients when an identity changes, so the gateway polls AM for the subscribed attributes of all things
+// at a fixed interval and notifies a thing when the values change. The gateway reads the attributes with its own
+// identity, which must be allowed to read the identities of the things in the realm. Polling centrally means that the
+// firmware of the thing does not have to poll AM and that a thing that is asleep does not cost a request to AM.
+
+// identityIDAttribute is the attribute in which AM returns the ID of the identity
+const identityIDAttribute = "_id"
+
+// attributeSubscription is the subscription of a thing to changes of its attributes
+type attributeSubscription struct {
+	thingID  string
+	names    []string
+	values   map[string]json.RawMessage
+	writer   coap.ResponseWriter
+	sequence uint32
+}
+
+// notify the thing of the values of the subscribed attributes
+func (s *attributeSubscription) notify(values map[string]json.RawMessage) error {
+	payload, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	s.values = values
+	s.sequence++
+	response := s.writer.NewResponse(codes.Content)
+	response.SetObserve(s.sequence)
+	response.SetOption(coap.ContentFormat, coap.AppJSON)
+	response.SetPayload(payload)
+	return s.writer.WriteMsg(response)
+}
+
+// attributeSubscriptions holds the attribute subscriptions of things and polls AM for changes
+type attributeSubscriptions struct {
+	interval time.Duration
+	// fetch reads the attributes with the given names of the thing from AM
+	fetch func(thingID string, names []string) ([]byte, error)
+	mutex sync.Mutex
+	// subscriptions by remote address and observation token
+	subscriptions map[string]*attributeSubscription
+	stop          chan struct{}
+	done          chan struct{}
+}
+
+func newAttributeSubscriptions(interval time.Duration, fetch func(string, []string) ([]byte, error)) *attributeSubscriptions {
+	return &attributeSubscriptions{
+		interval:      interval,
+		fetch:         fetch,
+		subscriptions: make(map[string]*attributeSubscription),
+	}
+}
+
+// observationKey identifies the observation made with the request
+func observationKey(r *coap.Request) string {
+	return fmt.Sprintf("%s/%x", r.Client.RemoteAddr(), r.Msg.Token())
+}
+
+// subscribedValues returns the values of the named attributes, and the ID of the identity, found in the AM reply
+func subscribedValues(reply []byte, names []string) (map[string]json.RawMessage, error) {
+	var attributes map[string]json.RawMessage
+	if err := json.Unmarshal(reply, &attributes); err != nil {
+		return nil, err
+	}
+	values := make(map[string]json.RawMessage, len(names)+1)
+	for _, name := range names {
+		if value, ok := attributes[name]; ok {
+			values[name] = value
+		}
+	}
+	if id, ok := attributes[identityIDAttribute]; ok {
+		values[identityIDAttribute] = id
+	}
+	return values, nil
+}
+
+// changed returns true if the values differ from the values that the thing was last notified of
+func (s *attributeSubscription) changed(values map[string]json.RawMessage) bool {
+	if len(values) != len(s.values) {
+		return true
+	}
+	for name, value := range values {
+		if !bytes.Equal(value, s.values[name]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *attributeSubscriptions) add(key string, subscription *attributeSubscription) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.subscriptions[key] = subscription
+}
+
+func (a *attributeSubscriptions) remove(key string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	delete(a.subscriptions, key)
+}
+
+// evict removes the subscriptions of the thing, returning false if the thing had no subscriptions
+func (a *attributeSubscriptions) evict(thingID string) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	found := false
+	for key, subscription := range a.subscriptions {
+		if subscription.thingID == thingID {
+			delete(a.subscriptions, key)
+			found = true
+		}
+	}
+	return found
+}
+
+// snapshot returns a copy of the subscriptions
+func (a *attributeSubscriptions) snapshot() map[string]*attributeSubscription {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	subscriptions := make(map[string]*attributeSubscription, len(a.subscriptions))
+	for key, subscription := range a.subscriptions {
+		subscriptions[key] = subscription
+	}
+	return subscriptions
+}
+
+// poll AM for the subscribed attributes and notify the things whose attributes have changed
+func (a *attributeSubscriptions) poll() {
+	for key, subscription := range a.snapshot() {
+		reply, err := a.fetch(subscription.thingID, subscription.names)
+		if errors.Is(err, client.ErrAMUnreachable) {
+			// try again in the next round
+			return
+		}
+		if err != nil {
+			debug.Errorf("Unable to read the attributes of thing %s; %s", subscription.thingID, err)
+			continue
+		}
+		values, err := subscribedValues(reply, subscription.names)
+		if err != nil {
+			debug.Errorf("Unable to read the attributes of thing %s; %s", subscription.thingID, err)
+			continue
+		}
+		if !subscription.changed(values) {
+			continue
+		}
+		if err = subscription.notify(values); err != nil {
+			debug.Errorf("Unable to notify thing %s, removing subscription; %s", subscription.thingID, err)
+			a.remove(key)
+		}
+	}
+}
+
+// start polling AM for the subscribed attributes
+func (a *attributeSubscriptions) start() {
+	a.stop = make(chan struct{})
+	a.done = make(chan struct{})
+	go func(stop <-chan struct{}, done chan<- struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(a.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				a.poll()
+			case <-stop:
+				return
+			}
+		}
+	}(a.stop, a.done)
+}
+
+// shutdown stops polling and removes all subscriptions
+func (a *attributeSubscriptions) shutdown() {
+	if a.stop == nil {
+		return
+	}
+	close(a.stop)
+	<-a.done
+	a.stop = nil
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.subscriptions = make(map[string]*attributeSubscription)
+}
+
+// identityPath returns the path, relative to the AM URL, of the identity of the thing in the realm
+func identityPath(realm string, thingID string, names []string) string {
+	path := "/json/realms/root"
+	for _, r := range strings.Split(strings.Trim(realm, "/"), "/") {
+		if r != "" {
+			path += "/realms/" + r
+		}
+	}
+	return path + "/users/" + thingID + "?_fields=" + strings.Join(names, ",")
+}
+
+// fetchAttributes reads the attributes of the thing from AM with the identity of the gateway
+func (c *ThingGateway) fetchAttributes(thingID string, names []string) ([]byte, error) {
+	return c.gatewayThing.SignedRequest(http.MethodGet, identityPath(c.realm, thingID, names), nil)
+}
+
+// observeAttributes handles the registration and cancellation of attribute subscriptions
+func (c *ThingGateway) observeAttributes(w coap.ResponseWriter, r *coap.Request, observe uint32) {
+	c.log.Trace("observeAttributes")
+	key := observationKey(r)
+	if observe != 0 {
+		c.subscriptions.remove(key)
+		w.SetCode(codes.Content)
+		writeResponse(w, nil)
+		return
+	}
+	if _, ok := w.(*protectedResponseWriter); ok {
+		w.SetCode(codes.BadRequest)
+		writeResponse(w, []byte("attribute subscriptions are not supported over OSCORE"))
+		return
+	}
+	names := r.Msg.Query()
+	if len(names) == 0 {
+		w.SetCode(codes.BadRequest)
+		writeResponse(w, []byte("no attributes to subscribe to"))
+		return
+	}
+	token, format, payload, ok := c.negotiate(w, r)
+	if !ok {
+		return
+	}
+	// check with AM that the thing is allowed to read the attributes
+	b, err := c.transaction(r).Attributes(token, format, payload, names)
+	if err != nil {
+		writeError(w, err, codes.GatewayTimeout)
+		return
+	}
+	values, err := subscribedValues(b, names)
+	if err != nil {
+		w.SetCode(codes.BadGateway)
+		writeResponse(w, []byte(err.Error()))
+		return
+	}
+	var thingID string
+	if err = json.Unmarshal(values[identityIDAttribute], &thingID); err != nil || thingID == "" {
+		w.SetCode(codes.BadGateway)
+		writeResponse(w, []byte("the thing's ID is missing from the attributes"))
+		return
+	}
+	subscription := &attributeSubscription{thingID: thingID, names: names, writer: w}
+	if err = subscription.notify(values); err != nil {
+		c.log.Error(err)
+		return
+	}
+	c.subscriptions.add(key, subscription)
+	c.log.Infof("observeAttributes: thing %s subscribed to %v", thingID, names)
+}
+
+// EnableAttributeSubscriptions allows things to subscribe to changes of their identity attributes. The gateway polls
+// AM for the subscribed attributes at the given interval, using its own identity, and notifies the things of changes.
+// Must be called before the CoAP server is started.
+func (c *ThingGateway) EnableAttributeSubscriptions(interval time.Duration) {
+	c.subscriptions = newAttributeSubscriptions(interval, c.fetchAttributes)
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+)
+
+func TestIdentityPath(t *testing.T) {
+	tests := []struct {
+		realm string
+		path  string
+	}{
+		{realm: "", path: "/json/realms/root/users/thing?_fields=a,b"},
+		{realm: "/", path: "/json/realms/root/users/thing?_fields=a,b"},
+		{realm: "/alfheim/svartalfheim", path: "/json/realms/root/realms/alfheim/realms/svartalfheim/users/thing?_fields=a,b"},
+	}
+	for _, subtest := range tests {
+		if path := identityPath(subtest.realm, "thing", []string{"a", "b"}); path != subtest.path {
+			t.Errorf("expected %s, got %s", subtest.path, path)
+		}
+	}
+}
+
+func TestThingGateway_SubscribeAttributes(t *testing.T) {
+	var mutex sync.Mutex
+	current := `{"_id":"thing","colour":["red"],"size":["small"]}`
+	m := &mockClient{attributesFunc: func(_ string, _ string, names []string) ([]byte, error) {
+		if len(names) != 1 || names[0] != "colour" {
+			t.Errorf("unexpected names %v", names)
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		return []byte(current), nil
+	}}
+	gateway := testGateway(m)
+	gateway.EnableAttributeSubscriptions(10 * time.Millisecond)
+	gateway.subscriptions.fetch = func(thingID string, names []string) ([]byte, error) {
+		if thingID != "thing" {
+			t.Errorf("unexpected thing %s", thingID)
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		return []byte(current), nil
+	}
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err := gateway.StartCOAPServer(":0", serverKey); err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.ShutdownCOAPServer()
+
+	notifications := make(chan map[string]interface{}, 10)
+	cancel, err := client.SubscribeAttributes(gatewayConnection(t, gateway), "", client.ApplicationJOSE,
+		".eyJjc3JmIjoiMTIzNDUifQ.", []string{"colour"}, func(reply []byte) {
+			var values map[string]interface{}
+			if err := json.Unmarshal(reply, &values); err != nil {
+				t.Error(err)
+			}
+			notifications <- values
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	if values := <-notifications; len(values) != 2 || values["_id"] != "thing" {
+		t.Fatalf("unexpected initial values %v", values)
+	}
+
+	// a change to an attribute that was not subscribed to does not cause a notification
+	mutex.Lock()
+	current = `{"_id":"thing","colour":["red"],"size":["large"]}`
+	mutex.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case values := <-notifications:
+		t.Fatalf("unexpected notification %v", values)
+	default:
+	}
+
+	mutex.Lock()
+	current = `{"_id":"thing","colour":["blue"],"size":["large"]}`
+	mutex.Unlock()
+	select {
+	case values := <-notifications:
+		if colour := values["colour"].([]interface{}); colour[0] != "blue" {
+			t.Errorf("unexpected notification %v", values)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no notification received")
+	}
+
+	if !gateway.EvictThing("thing") || len(gateway.subscriptions.snapshot()) != 0 {
+		t.Error("subscription not evicted")
+	}
+}
+
+func TestThingGateway_SubscribeAttributes_Disabled(t *testing.T) {
+	gateway := testGateway(&mockClient{})
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err := gateway.StartCOAPServer(":0", serverKey); err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.ShutdownCOAPServer()
+	_, err := client.SubscribeAttributes(gatewayConnection(t, gateway), "", client.ApplicationJOSE,
+		".eyJjc3JmIjoiMTIzNDUifQ.", []string{"colour"}, func([]byte) {})
+	if err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -0,0 +1,271 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+	"github.com/patrickmn/go-cache"
+)
+
+// Usage statistics
+// The gateway can count the activity of every thing so that operators can spot devices with abnormal credential churn,
+// for example a thing that authenticates before every request or requests a new access token every few seconds. A
+// thing is identified by the subject of the JWT PoP of its authentication requests and by the thing for which the
+// gateway created the session of its other requests. Requests that do not identify a thing, such as the first request
+// of an authentication flow, are not counted. Payload sizes are counted after OSCORE has been removed. The statistics
+// are held in memory and forgotten when a thing has not been seen for a day. They are listed through the admin API
+// and exported in the Prometheus text format, see WriteUsageMetrics.
+
+// usageIdleLife is the time after which the statistics of a thing that has not been seen are forgotten
+const usageIdleLife = 24 * time.Hour
+
+// usageErrorSize is the maximum size of the error message recorded for a thing
+const usageErrorSize = 256
+
+// ThingUsage contains the usage statistics of a thing
+type ThingUsage struct {
+	ID string `json:"id"`
+	// Authentications counts the sessions created for the thing, with AM or offline
+	Authentications uint64 `json:"authentications"`
+	// TokensIssued counts the access tokens issued to the thing, by AM or by the local issuer
+	TokensIssued  uint64    `json:"tokensIssued"`
+	Requests      uint64    `json:"requests"`
+	BytesReceived uint64    `json:"bytesReceived"`
+	BytesSent     uint64    `json:"bytesSent"`
+	LastSeen      time.Time `json:"lastSeen"`
+	// LastError describes the last error response sent to the thing
+	LastError     string    `json:"lastError,omitempty"`
+	LastErrorTime time.Time `json:"lastErrorTime,omitempty"`
+}
+
+// usageTracker holds the usage statistics of things
+type usageTracker struct {
+	mutex sync.Mutex
+	// *ThingUsage by thing ID
+	things *cache.Cache
+}
+
+func newUsageTracker() *usageTracker {
+	return &usageTracker{things: cache.New(usageIdleLife, time.Hour)}
+}
+
+// update the usage statistics of the thing
+func (u *usageTracker) update(thingID string, f func(usage *ThingUsage)) {
+	if u == nil || thingID == "" {
+		return
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	usage := &ThingUsage{ID: thingID}
+	if cached, ok := u.things.Get(thingID); ok {
+		usage = cached.(*ThingUsage)
+	}
+	f(usage)
+	usage.LastSeen = time.Now()
+	u.things.SetDefault(thingID, usage)
+}
+
+// authenticated counts a session created for the thing
+func (u *usageTracker) authenticated(thingID string) {
+	u.update(thingID, func(usage *ThingUsage) {
+		usage.Authentications++
+	})
+}
+
+// tokenIssued counts an access token issued to the thing
+func (u *usageTracker) tokenIssued(thingID string) {
+	u.update(thingID, func(usage *ThingUsage) {
+		usage.TokensIssued++
+	})
+}
+
+// request counts a request of the thing and records the response if it is an error
+func (u *usageTracker) request(thingID string, received int, response *usageResponseWriter) {
+	u.update(thingID, func(usage *ThingUsage) {
+		usage.Requests++
+		usage.BytesReceived += uint64(received)
+		usage.BytesSent += uint64(response.size)
+		if response.code >= codes.BadRequest {
+			detail := string(response.errorPayload)
+			if len(detail) > usageErrorSize {
+				detail = detail[:usageErrorSize]
+			}
+			usage.LastError = strings.TrimSpace(response.code.String() + " " + detail)
+			usage.LastErrorTime = time.Now()
+		}
+	})
+}
+
+// list returns the usage statistics of all things, sorted by ID
+func (u *usageTracker) list() []ThingUsage {
+	things := []ThingUsage{}
+	if u == nil {
+		return things
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	for _, item := range u.things.Items() {
+		things = append(things, *item.Object.(*ThingUsage))
+	}
+	sort.Slice(things, func(i, j int) bool {
+		return things[i].ID < things[j].ID
+	})
+	return things
+}
+
+// usageResponseWriter counts the payload written in response to a request of a thing
+type usageResponseWriter struct {
+	coap.ResponseWriter
+	code         codes.Code
+	size         int
+	errorPayload []byte
+}
+
+func (w *usageResponseWriter) SetCode(code codes.Code) {
+	w.code = code
+	w.ResponseWriter.SetCode(code)
+}
+
+func (w *usageResponseWriter) record(code codes.Code, payload []byte) {
+	if code != 0 {
+		w.code = code
+	}
+	w.size += len(payload)
+	if w.code >= codes.BadRequest {
+		w.errorPayload = payload
+	}
+}
+
+func (w *usageResponseWriter) Write(p []byte) (n int, err error) {
+	w.record(0, p)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *usageResponseWriter) WriteWithContext(ctx context.Context, p []byte) (n int, err error) {
+	w.record(0, p)
+	return w.ResponseWriter.WriteWithContext(ctx, p)
+}
+
+func (w *usageResponseWriter) WriteMsg(msg coap.Message) error {
+	w.record(msg.Code(), msg.Payload())
+	return w.ResponseWriter.WriteMsg(msg)
+}
+
+func (w *usageResponseWriter) WriteMsgWithContext(ctx context.Context, msg coap.Message) error {
+	w.record(msg.Code(), msg.Payload())
+	return w.ResponseWriter.WriteMsgWithContext(ctx, msg)
+}
+
+// requestingThing returns the ID of the thing that sent the request, if the request identifies the thing
+func (c *ThingGateway) requestingThing(r *coap.Request) string {
+	if "/"+r.Msg.PathString() == "/authenticate" {
+		codec, err := requestCodec(r.Msg)
+		if err != nil {
+			return ""
+		}
+		var auth client.AuthenticatePayload
+		if err = codec.Unmarshal(r.Msg.Payload(), &auth); err != nil {
+			return ""
+		}
+		return thingID(auth.Callbacks)
+	}
+	token, _, _, err := decodeThingEndpointRequest(r.Msg)
+	if err != nil {
+		return ""
+	}
+	return c.access.thingOf(token)
+}
+
+// meterUsage counts the requests of things and the size of their payloads if usage statistics are enabled
+func (c *ThingGateway) meterUsage(next coap.Handler) coap.Handler {
+	if c.usage == nil {
+		return next
+	}
+	return coap.HandlerFunc(func(w coap.ResponseWriter, r *coap.Request) {
+		writer := &usageResponseWriter{ResponseWriter: w}
+		next.ServeCOAP(writer, r)
+		c.usage.request(c.requestingThing(r), len(r.Msg.Payload()), writer)
+	})
+}
+
+// EnableUsageStatistics makes the Thing Gateway count the authentications, issued tokens, requests and payload sizes
+// of every thing, see ThingUsage.
+// Must be called before the CoAP server is started.
+func (c *ThingGateway) EnableUsageStatistics() {
+	c.usage = newUsageTracker()
+}
+
+// Usage returns the usage statistics of the things, sorted by ID. No statistics are returned if usage statistics
+// are not enabled.
+func (c *ThingGateway) Usage() []ThingUsage {
+	return c.usage.list()
+}
+
+// usageMetrics describes the metrics that are exported for every thing
+var usageMetrics = []struct {
+	name  string
+	kind  string
+	help  string
+	value func(usage ThingUsage) float64
+}{
+	{"iot_gateway_thing_authentications_total", "counter", "Sessions created for the thing.",
+		func(u ThingUsage) float64 { return float64(u.Authentications) }},
+	{"iot_gateway_thing_tokens_issued_total", "counter", "Access tokens issued to the thing.",
+		func(u ThingUsage) float64 { return float64(u.TokensIssued) }},
+	{"iot_gateway_thing_requests_total", "counter", "Requests sent by the thing.",
+		func(u ThingUsage) float64 { return float64(u.Requests) }},
+	{"iot_gateway_thing_received_bytes_total", "counter", "Payload bytes received from the thing.",
+		func(u ThingUsage) float64 { return float64(u.BytesReceived) }},
+	{"iot_gateway_thing_sent_bytes_total", "counter", "Payload bytes sent to the thing.",
+		func(u ThingUsage) float64 { return float64(u.BytesSent) }},
+	{"iot_gateway_thing_last_seen_seconds", "gauge", "Time at which the thing was last seen.",
+		func(u ThingUsage) float64 { return float64(u.LastSeen.UnixNano()) / float64(time.Second) }},
+}
+
+// escapeLabel escapes a Prometheus label value
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// WriteUsageMetrics writes the usage statistics of the things in the Prometheus text exposition format, with the ID of
+// the thing in the `thing` label
+func (c *ThingGateway) WriteUsageMetrics(w io.Writer) error {
+	things := c.Usage()
+	for _, metric := range usageMetrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name,
+			metric.kind); err != nil {
+			return err
+		}
+		for _, usage := range things {
+			if _, err := fmt.Fprintf(w, "%s{thing=\"%s\"} %g\n", metric.name, escapeLabel(usage.ID),
+				metric.value(usage)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+)
+
+func TestThingGateway_UsageStatistics(t *testing.T) {
+	m := &mockClient{
+		accessTokenFunc: func(string, string) ([]byte, error) {
+			return []byte(`{"access_token":"token"}`), nil
+		},
+		attributesFunc: func(token string, _ string, _ []string) ([]byte, error) {
+			if token == "session-2" {
+				return nil, fmt.Errorf("%w: not allowed", client.ErrForbidden)
+			}
+			return []byte(`{"_id":"thing-1"}`), nil
+		},
+	}
+	gateway := testGateway(m)
+	gateway.EnableUsageStatistics()
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err := gateway.StartCOAPServer(":0", serverKey); err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.ShutdownCOAPServer()
+	gateway.access.track("session-1", "thing-1")
+	gateway.access.track("session-2", "thing-2")
+	gateway.usage.authenticated("thing-1")
+
+	connection := gatewayConnection(t, gateway)
+	if _, err := connection.AccessToken("session-1", client.ApplicationJSON, `{"scope":["publish"]}`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := connection.Attributes("session-1", client.ApplicationJSON, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := connection.Attributes("session-2", client.ApplicationJSON, "", nil); err == nil {
+		t.Fatal("expected the attributes request to fail")
+	}
+	// requests of unknown sessions are not counted
+	if _, err := connection.Attributes("session-3", client.ApplicationJSON, "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	usage := gateway.Usage()
+	if len(usage) != 2 {
+		t.Fatalf("expected the usage of two things; got %+v", usage)
+	}
+	thingOne, thingTwo := usage[0], usage[1]
+	if thingOne.ID != "thing-1" || thingOne.Authentications != 1 || thingOne.TokensIssued != 1 ||
+		thingOne.Requests != 2 || thingOne.BytesReceived == 0 || thingOne.BytesSent == 0 || thingOne.LastError != "" {
+		t.Errorf("unexpected usage %+v", thingOne)
+	}
+	if thingTwo.ID != "thing-2" || thingTwo.Requests != 1 || !strings.Contains(thingTwo.LastError, "not allowed") ||
+		thingTwo.LastErrorTime.IsZero() {
+		t.Errorf("unexpected usage %+v", thingTwo)
+	}
+
+	response := testAdminRequest(gateway, http.MethodGet, "/usage")
+	var listed []ThingUsage
+	if err := json.Unmarshal(response.Body.Bytes(), &listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 2 {
+		t.Errorf("expected the usage of two things; got %s", response.Body)
+	}
+	response = testAdminRequest(gateway, http.MethodGet, "/metrics")
+	for _, line := range []string{
+		"# TYPE iot_gateway_thing_tokens_issued_total counter",
+		`iot_gateway_thing_tokens_issued_total{thing="thing-1"} 1`,
+		`iot_gateway_thing_requests_total{thing="thing-2"} 1`,
+	} {
+		if !strings.Contains(response.Body.String(), line+"\n") {
+			t.Errorf("expected the metrics to contain %s; got\n%s", line, response.Body)
+		}
+	}
+}
+
+func TestThingGateway_UsageStatistics_Disabled(t *testing.T) {
+	gateway := testGateway(&mockClient{})
+	gateway.usage.authenticated("thing-1")
+	if usage := gateway.Usage(); len(usage) != 0 {
+		t.Errorf("expected no usage; got %+v", usage)
+	}
+}
+
+func TestEscapeLabel(t *testing.T) {
+	if escaped := escapeLabel("a\"b\\c\nd"); escaped != `a\"b\\c\nd` {
+		t.Errorf("unexpected escaped label %s", escaped)
+	}
+}
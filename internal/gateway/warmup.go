@@ -0,0 +1,238 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/JacoJooste/iot-edge/v7/internal/debug"
+	isession "github.com/JacoJooste/iot-edge/v7/internal/session"
+	"github.com/JacoJooste/iot-edge/v7/pkg/callback"
+	"github.com/JacoJooste/iot-edge/v7/pkg/thing"
+	"github.com/go-ocf/go-coap"
+)
+
+// Warm-up of known things
+// The authentication of a thing takes several round trips to AM, which delays the first application request of the
+// thing after it connects to the gateway. For high priority things whose keys are stored with the gateway, the gateway
+// can authenticate the things with AM when it starts and keep their sessions warm. A thing receives its warm session
+// in reply to the first request of its authentication flow if the key with which it completed the DTLS or TLS
+// handshake is the stored key of the thing, since the handshake proves that the thing holds that key. A warm session
+// is only handed out once and sessions older than the maximum age or past the lifetime reported by AM are discarded, in
+// both cases the thing falls back to the normal authentication flow. Things present their own key during the handshake when they are created with a
+// client certificate.
+
+// WarmThing is a thing that the gateway authenticates with AM when it starts
+type WarmThing struct {
+	ThingID  string
+	Audience string
+	// KeyID of the key, the JWK thumbprint of the key is used if empty
+	KeyID string
+	Key   crypto.Signer
+}
+
+// warmSession is a session created by the gateway for a thing before the thing connected
+type warmSession struct {
+	thingID string
+	token   string
+	created time.Time
+	// expires is the zero time if the lifetime of the session is not known
+	expires time.Time
+}
+
+// warmSessions holds the warm sessions, indexed by the public key of the thing
+type warmSessions struct {
+	things   []WarmThing
+	maxAge   time.Duration
+	mutex    sync.Mutex
+	sessions map[string]warmSession
+	schedule *maintenanceScheduler
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// publicKeyID returns the index of the public key in the warm sessions
+func publicKeyID(key crypto.PublicKey) (string, error) {
+	b, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// take removes and returns the warm session of the thing with the public key
+func (w *warmSessions) take(key crypto.PublicKey) (warmSession, bool) {
+	id, err := publicKeyID(key)
+	if err != nil {
+		return warmSession{}, false
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	session, ok := w.sessions[id]
+	if !ok {
+		return warmSession{}, false
+	}
+	delete(w.sessions, id)
+	if time.Since(session.created) > w.maxAge || (!session.expires.IsZero() && time.Now().After(session.expires)) {
+		debug.Infof("Warm session of thing %s has expired", session.thingID)
+		return warmSession{}, false
+	}
+	return session, true
+}
+
+// warmUp authenticates the things with AM, each after a random delay if there is a schedule, and stores their sessions
+func (w *warmSessions) warmUp(connection client.Connection, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	type delayed struct {
+		thing WarmThing
+		delay time.Duration
+	}
+	things := make([]delayed, len(w.things))
+	for i, t := range w.things {
+		things[i] = delayed{thing: t, delay: w.schedule.delay()}
+	}
+	sort.SliceStable(things, func(i, j int) bool {
+		return things[i].delay < things[j].delay
+	})
+	started := time.Now()
+	for _, d := range things {
+		t := d.thing
+		if wait := time.Until(started.Add(d.delay)); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-stop:
+				timer.Stop()
+				return
+			}
+		}
+		if err := w.authenticate(connection, t); err != nil {
+			debug.Errorf("Unable to warm up thing %s; %s", t.ThingID, err)
+			continue
+		}
+		debug.Infof("Warmed up thing %s", t.ThingID)
+	}
+}
+
+// authenticate the thing with AM and store its session
+func (w *warmSessions) authenticate(connection client.Connection, t WarmThing) error {
+	id, err := publicKeyID(t.Key.Public())
+	if err != nil {
+		return err
+	}
+	keyID := t.KeyID
+	if keyID == "" {
+		if keyID, err = thing.JWKThumbprint(t.Key); err != nil {
+			return err
+		}
+	}
+	session, err := (&isession.Builder{}).
+		WithConnection(connection).
+		AuthenticateWith(callback.AuthenticateHandler{
+			Audience: t.Audience,
+			ThingID:  t.ThingID,
+			KeyID:    keyID,
+			Key:      t.Key,
+		}).
+		Create()
+	if err != nil {
+		return err
+	}
+	warm := warmSession{thingID: t.ThingID, token: session.Token(), created: time.Now()}
+	if lifetime, err := readSessionLifetime(connection, warm.token); err == nil {
+		warm.expires = lifetime.expiry()
+	} else {
+		debug.Errorf("Unable to read the lifetime of the warm session of thing %s; %s", t.ThingID, err)
+	}
+	w.mutex.Lock()
+	w.sessions[id] = warm
+	w.mutex.Unlock()
+	return nil
+}
+
+// start warming up the things in the background so that the gateway can serve other things in the meantime
+func (w *warmSessions) start(connection client.Connection, schedule *maintenanceScheduler) {
+	w.schedule = schedule
+	w.stop = make(chan struct{})
+	w.done = make(chan struct{})
+	go w.warmUp(connection, w.stop, w.done)
+}
+
+// shutdown stops the warm-up, waiting for the authentication in progress to complete, and discards the warm sessions
+func (w *warmSessions) shutdown() {
+	if w.done == nil {
+		return
+	}
+	close(w.stop)
+	<-w.done
+	w.done = nil
+	w.mutex.Lock()
+	w.sessions = make(map[string]warmSession)
+	w.mutex.Unlock()
+}
+
+// warmSession returns the warm session of the thing that sent the request if the request is the first of an
+// authentication flow
+func (c *ThingGateway) warmSession(r *coap.Request, auth client.AuthenticatePayload) (reply client.AuthenticatePayload,
+	ok bool) {
+	if c.warm == nil || auth.AuthIDKey != "" || len(auth.Callbacks) > 0 {
+		return reply, false
+	}
+	cert, err := c.clientCertificate(r)
+	if err != nil {
+		return reply, false
+	}
+	session, ok := c.warm.take(cert.PublicKey)
+	if !ok || c.access.checkThing(session.thingID) != nil {
+		return reply, false
+	}
+	c.access.track(session.token, session.thingID)
+	c.log.Infof("Authenticated thing %s with its warm session", session.thingID)
+	if c.revocation != nil {
+		c.revocation.track(session.token, session.thingID)
+	}
+	reply.TokenID = session.token
+	return reply, true
+}
+
+// EnableWarmUp makes the Thing Gateway authenticate the things with AM when the CoAP server is started so that each
+// thing receives a session without waiting on AM when it authenticates for the first time. Warm sessions that are
+// not handed out within the maximum age are discarded.
+// Must be called before the CoAP server is started.
+func (c *ThingGateway) EnableWarmUp(things []WarmThing, maxAge time.Duration) error {
+	if maxAge <= 0 {
+		return errors.New("maximum age of warm sessions must be positive")
+	}
+	for _, t := range things {
+		if t.ThingID == "" || t.Key == nil {
+			return fmt.Errorf("warm thing `%s` requires an ID and a key", t.ThingID)
+		}
+	}
+	c.warm = &warmSessions{
+		things:   things,
+		maxAge:   maxAge,
+		sessions: make(map[string]warmSession),
+	}
+	return nil
+}
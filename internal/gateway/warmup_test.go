@@ -0,0 +1,126 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+)
+
+// testWarmGateway starts a gateway that has warmed up a thing with the key and returns the number of authentications
+// made with AM
+func testWarmGateway(t *testing.T, key crypto.Signer, maxAge time.Duration) (*ThingGateway, *int32) {
+	var calls int32
+	gateway := testGateway(&mockClient{AuthenticateFunc: func(client.AuthenticatePayload) (
+		reply client.AuthenticatePayload, err error) {
+		reply.TokenID = "am-token"
+		if atomic.AddInt32(&calls, 1) == 1 {
+			reply.TokenID = "warm-token"
+		}
+		return reply, nil
+	}})
+	if err := gateway.EnableWarmUp([]WarmThing{{ThingID: "thing-1", Audience: "/things", Key: key}}, maxAge); err != nil {
+		t.Fatal(err)
+	}
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err := gateway.StartCOAPServer(":0", serverKey); err != nil {
+		t.Fatal(err)
+	}
+	// wait for the warm-up to complete
+	<-gateway.warm.done
+	return gateway, &calls
+}
+
+func testWarmAuthenticate(t *testing.T, gateway *ThingGateway, key crypto.Signer) string {
+	gwURL, _ := url.Parse("coap://" + gateway.Address())
+	connection, err := client.NewConnection().ConnectTo(gwURL).WithKey(key).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := connection.Authenticate(client.AuthenticatePayload{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply.TokenID
+}
+
+func TestGatewayServer_WarmUp(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	gateway, calls := testWarmGateway(t, key, time.Minute)
+	defer gateway.ShutdownCOAPServer()
+
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tests := []struct {
+		name  string
+		key   crypto.Signer
+		token string
+		calls int32
+	}{
+		{name: "other-thing", key: other, token: "am-token", calls: 2},
+		{name: "warm-thing", key: key, token: "warm-token", calls: 2},
+		{name: "warm-session-used", key: key, token: "am-token", calls: 3},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			if token := testWarmAuthenticate(t, gateway, subtest.key); token != subtest.token {
+				t.Errorf("expected token %s; got %s", subtest.token, token)
+			}
+			if n := atomic.LoadInt32(calls); n != subtest.calls {
+				t.Errorf("expected %d authentications with AM; got %d", subtest.calls, n)
+			}
+		})
+	}
+}
+
+func TestGatewayServer_WarmUp_Expired(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	gateway, _ := testWarmGateway(t, key, time.Millisecond)
+	defer gateway.ShutdownCOAPServer()
+
+	time.Sleep(10 * time.Millisecond)
+	if token := testWarmAuthenticate(t, gateway, key); token != "am-token" {
+		t.Errorf("expected the expired warm session to be discarded; got %s", token)
+	}
+}
+
+func TestThingGateway_EnableWarmUp_Invalid(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tests := []struct {
+		name   string
+		things []WarmThing
+		maxAge time.Duration
+	}{
+		{name: "no-max-age", things: []WarmThing{{ThingID: "thing-1", Key: key}}},
+		{name: "no-id", things: []WarmThing{{Key: key}}, maxAge: time.Minute},
+		{name: "no-key", things: []WarmThing{{ThingID: "thing-1"}}, maxAge: time.Minute},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			if err := testGateway(&mockClient{}).EnableWarmUp(subtest.things, subtest.maxAge); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
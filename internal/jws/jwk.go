@@ -0,0 +1,124 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jws
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/secp256k1"
+	"github.com/cloudflare/circl/sign/ed448"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// Ed448Curve is the JWK curve name of Ed448 keys (RFC 8037)
+const Ed448Curve = "Ed448"
+
+// JSONWebKey is a jose.JSONWebKey that can also marshal secp256k1 public keys (RFC 8812) and Ed448 public keys
+// (RFC 8037), which go-jose rejects
+type JSONWebKey struct {
+	jose.JSONWebKey
+	// CompressPoint marshals a P-256 public key with its point in the compressed form of SEC 1, section 2.3.3, which
+	// is not part of the JWK standard. The x member holds the compressed point and the y member is omitted, which
+	// reduces the size of the key by about a third. Only use it with servers that are known to accept the form.
+	CompressPoint bool `json:"-"`
+}
+
+// rawJWK is the JSON representation of the public keys that go-jose can not marshal
+type rawJWK struct {
+	Use string   `json:"use,omitempty"`
+	Kty string   `json:"kty"`
+	Kid string   `json:"kid,omitempty"`
+	Crv string   `json:"crv"`
+	Alg string   `json:"alg,omitempty"`
+	X   string   `json:"x"`
+	Y   string   `json:"y,omitempty"`
+	X5c []string `json:"x5c,omitempty"`
+}
+
+// secp256k1PublicKey returns the key if it is a secp256k1 public key
+func secp256k1PublicKey(key interface{}) (*ecdsa.PublicKey, bool) {
+	pub, ok := key.(*ecdsa.PublicKey)
+	if !ok || !secp256k1.IsCurve(pub.Curve) {
+		return nil, false
+	}
+	return pub, true
+}
+
+// coordinate encodes an elliptic curve coordinate as a base64url encoded, 32 byte value
+func coordinate(v *big.Int) string {
+	b := make([]byte, 32)
+	raw := v.Bytes()
+	copy(b[len(b)-len(raw):], raw)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// compressedPoint encodes the P-256 public key as a base64url encoded, compressed point
+func compressedPoint(pub *ecdsa.PublicKey) string {
+	b := make([]byte, 33)
+	b[0] = 2 | byte(pub.Y.Bit(0))
+	raw := pub.X.Bytes()
+	copy(b[len(b)-len(raw):], raw)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (k JSONWebKey) MarshalJSON() ([]byte, error) {
+	raw := rawJWK{
+		Use: k.Use,
+		Kid: k.KeyID,
+		Alg: k.Algorithm,
+	}
+	if pub, ok := secp256k1PublicKey(k.Key); ok {
+		raw.Kty, raw.Crv = "EC", secp256k1.Name
+		raw.X, raw.Y = coordinate(pub.X), coordinate(pub.Y)
+	} else if pub, ok := k.Key.(ed448.PublicKey); ok {
+		raw.Kty, raw.Crv = "OKP", Ed448Curve
+		raw.X = base64.RawURLEncoding.EncodeToString(pub)
+	} else if pub, ok := k.Key.(*ecdsa.PublicKey); ok && k.CompressPoint && pub.Curve == elliptic.P256() {
+		raw.Kty, raw.Crv = "EC", pub.Curve.Params().Name
+		raw.X = compressedPoint(pub)
+	} else {
+		return k.JSONWebKey.MarshalJSON()
+	}
+	for _, c := range k.Certificates {
+		raw.X5c = append(raw.X5c, base64.StdEncoding.EncodeToString(c.Raw))
+	}
+	return json.Marshal(raw)
+}
+
+// Thumbprint calculates the SHA-256 JWK thumbprint (RFC 7638) of the public key
+// The thumbprint of a P-256 key is always calculated from its uncompressed point.
+func Thumbprint(key crypto.PublicKey) ([]byte, error) {
+	var input string
+	if pub, ok := secp256k1PublicKey(key); ok {
+		input = fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, secp256k1.Name, coordinate(pub.X),
+			coordinate(pub.Y))
+	} else if pub, ok := key.(ed448.PublicKey); ok {
+		input = fmt.Sprintf(`{"crv":"%s","kty":"OKP","x":"%s"}`, Ed448Curve,
+			base64.RawURLEncoding.EncodeToString(pub))
+	} else {
+		return (&jose.JSONWebKey{Key: key}).Thumbprint(crypto.SHA256)
+	}
+	thumbprint := sha256.Sum256([]byte(input))
+	return thumbprint[:], nil
+}
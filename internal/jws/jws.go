@@ -22,17 +22,24 @@ import (
 	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
-	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math/big"
 	"strings"
 
+	"github.com/JacoJooste/iot-edge/v7/internal/secp256k1"
+	"github.com/cloudflare/circl/sign/ed448"
 	"gopkg.in/square/go-jose.v2"
 	"gopkg.in/square/go-jose.v2/cryptosigner"
 )
 
+// ES256K is the JWS algorithm for ECDSA using secp256k1 and SHA-256 (RFC 8812), which is not supported by go-jose
+const ES256K = jose.SignatureAlgorithm("ES256K")
+
 var (
 	ErrMissingSigner        = errors.New("missing signer")
 	ErrUnsupportedAlgorithm = errors.New("unsupported algorithm")
@@ -53,61 +60,95 @@ func JWAFromKey(s crypto.Signer) (alg jose.SignatureAlgorithm, err error) {
 		case elliptic.P521():
 			return jose.ES512, nil
 		}
-	case ed25519.PublicKey:
+		if secp256k1.IsCurve(k.Curve) {
+			return ES256K, nil
+		}
+	case ed25519.PublicKey, ed448.PublicKey:
 		return jose.EdDSA, nil
-	case *rsa.PublicKey:
-		switch k.N.BitLen() / 8 {
-		case 256:
-			return jose.PS256, nil
-		case 384:
-			return jose.PS384, nil
-		case 512:
-			return jose.PS512, nil
+	default:
+		if alg, ok := rsaAlgorithm(k); ok {
+			return alg, nil
 		}
 	}
 	return alg, ErrUnsupportedAlgorithm
 }
 
-// pssOpaqueSigner implements the jose.OpaqueSigner interface for PSS signature keys
-// Similar to the crytosigner.Opaque implementation for PSS keys except different salt lengths are used
-type pssOpaqueSigner struct {
-	alg    jose.SignatureAlgorithm
+// Algorithms returns the JWS algorithms with which the SDK can sign, RSA algorithms are excluded from tiny builds
+func Algorithms() []jose.SignatureAlgorithm {
+	return append([]jose.SignatureAlgorithm{jose.ES256, jose.ES384, jose.ES512, ES256K, jose.EdDSA},
+		rsaAlgorithms()...)
+}
+
+// Curves returns the names of the curves of the elliptic curve keys with which the SDK can sign
+func Curves() []string {
+	return []string{"P-256", "P-384", "P-521", secp256k1.Name, "Ed25519", Ed448Curve}
+}
+
+// es256kOpaqueSigner implements the jose.OpaqueSigner interface for secp256k1 keys
+type es256kOpaqueSigner struct {
 	signer crypto.Signer
 }
 
-func (r pssOpaqueSigner) Public() *jose.JSONWebKey {
+func (r es256kOpaqueSigner) Public() *jose.JSONWebKey {
 	return &jose.JSONWebKey{Key: r.signer.Public()}
 }
 
-func (r pssOpaqueSigner) Algs() []jose.SignatureAlgorithm {
-	return []jose.SignatureAlgorithm{r.alg}
+func (r es256kOpaqueSigner) Algs() []jose.SignatureAlgorithm {
+	return []jose.SignatureAlgorithm{ES256K}
 }
 
-func (r pssOpaqueSigner) SignPayload(payload []byte, alg jose.SignatureAlgorithm) ([]byte, error) {
-	var hash crypto.Hash
-	switch alg {
-	case jose.PS256:
-		hash = crypto.SHA256
-	case jose.PS384:
-		hash = crypto.SHA384
-	case jose.PS512:
-		hash = crypto.SHA512
-	default:
+func (r es256kOpaqueSigner) SignPayload(payload []byte, alg jose.SignatureAlgorithm) ([]byte, error) {
+	if alg != ES256K {
 		return nil, jose.ErrUnsupportedAlgorithm
 	}
+	digest := sha256.Sum256(payload)
+	var der []byte
+	var err error
+	if key, ok := r.signer.(*ecdsa.PrivateKey); ok {
+		// the generic ECDSA signing of the standard library is not constant time for secp256k1
+		der, err = secp256k1.Sign(key, digest[:])
+	} else {
+		der, err = r.signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// convert the ASN.1 signature into the fixed length R || S format used by JWS
+	var sig struct {
+		R, S *big.Int
+	}
+	if _, err = asn1.Unmarshal(der, &sig); err != nil {
+		return nil, err
+	}
+	rBytes, sBytes := sig.R.Bytes(), sig.S.Bytes()
+	if len(rBytes) > 32 || len(sBytes) > 32 {
+		return nil, errors.New("invalid ES256K signature")
+	}
+	out := make([]byte, 64)
+	copy(out[32-len(rBytes):32], rBytes)
+	copy(out[64-len(sBytes):], sBytes)
+	return out, nil
+}
 
-	var hashed []byte
-	if hash != crypto.Hash(0) {
-		hasher := hash.New()
-		if _, err := hasher.Write(payload); err != nil {
-			return nil, err
-		}
-		hashed = hasher.Sum(nil)
+// ed448OpaqueSigner implements the jose.OpaqueSigner interface for Ed448 keys, which are not supported by go-jose
+type ed448OpaqueSigner struct {
+	signer crypto.Signer
+}
+
+func (r ed448OpaqueSigner) Public() *jose.JSONWebKey {
+	return &jose.JSONWebKey{Key: r.signer.Public()}
+}
+
+func (r ed448OpaqueSigner) Algs() []jose.SignatureAlgorithm {
+	return []jose.SignatureAlgorithm{jose.EdDSA}
+}
+
+func (r ed448OpaqueSigner) SignPayload(payload []byte, alg jose.SignatureAlgorithm) ([]byte, error) {
+	if alg != jose.EdDSA {
+		return nil, jose.ErrUnsupportedAlgorithm
 	}
-	return r.signer.Sign(rand.Reader, hashed, &rsa.PSSOptions{
-		SaltLength: rsa.PSSSaltLengthEqualsHash,
-		Hash:       hash,
-	})
+	// EdDSA signs the payload itself rather than a digest
+	return r.signer.Sign(rand.Reader, payload, crypto.Hash(0))
 }
 
 // NewSigner creates a new JOSE signer from the crypto signer
@@ -120,10 +161,19 @@ func NewSigner(key crypto.Signer, opts *jose.SignerOptions) (jose.Signer, error)
 
 	var opaque jose.OpaqueSigner
 	switch alg {
-	case jose.PS256, jose.PS384, jose.PS512:
-		opaque = pssOpaqueSigner{alg: alg, signer: key}
+	case ES256K:
+		opaque = es256kOpaqueSigner{signer: key}
+	case jose.EdDSA:
+		if _, ok := key.Public().(ed448.PublicKey); ok {
+			opaque = ed448OpaqueSigner{signer: key}
+		} else {
+			opaque = cryptosigner.Opaque(key)
+		}
 	default:
-		opaque = cryptosigner.Opaque(key)
+		var ok bool
+		if opaque, ok = rsaOpaqueSigner(alg, key); !ok {
+			opaque = cryptosigner.Opaque(key)
+		}
 	}
 	return jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: opaque}, opts)
 }
@@ -143,3 +193,35 @@ func ExtractClaims(token string, claims interface{}) error {
 	}
 	return json.Unmarshal(payload, claims)
 }
+
+// ErrInvalidDetached is returned when a JWS with a detached payload is malformed
+var ErrInvalidDetached = errors.New("invalid detached JWS")
+
+// DetachPayload converts a JWS in compact serialisation into a JWS with a detached payload (RFC 7515, Appendix F)
+// followed by a new line and the payload itself, which is shorter than the compact serialisation since the payload is
+// not base64url encoded. The signature is unchanged, so AttachPayload restores the original JWS.
+func DetachPayload(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("unexpected serialisation")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+	return parts[0] + ".." + parts[2] + "\n" + string(payload), nil
+}
+
+// AttachPayload converts a JWS with a detached payload, as created by DetachPayload, into a JWS in compact
+// serialisation
+func AttachPayload(detached string) (string, error) {
+	jws, payload := detached, ""
+	if i := strings.IndexByte(detached, '\n'); i >= 0 {
+		jws, payload = detached[:i], detached[i+1:]
+	}
+	parts := strings.Split(jws, ".")
+	if len(parts) != 3 || parts[1] != "" {
+		return "", ErrInvalidDetached
+	}
+	return parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + parts[2], nil
+}
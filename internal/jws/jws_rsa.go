@@ -0,0 +1,100 @@
+// +build !tiny
+
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jws
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+// rsaAlgorithm returns the PSS signing algorithm for an RSA public key. RSA support is excluded from tiny builds.
+func rsaAlgorithm(key crypto.PublicKey) (alg jose.SignatureAlgorithm, ok bool) {
+	k, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return alg, false
+	}
+	switch k.N.BitLen() / 8 {
+	case 256:
+		return jose.PS256, true
+	case 384:
+		return jose.PS384, true
+	case 512:
+		return jose.PS512, true
+	}
+	return alg, false
+}
+
+// rsaAlgorithms returns the RSA signing algorithms supported by rsaAlgorithm
+func rsaAlgorithms() []jose.SignatureAlgorithm {
+	return []jose.SignatureAlgorithm{jose.PS256, jose.PS384, jose.PS512}
+}
+
+// rsaOpaqueSigner returns an opaque signer for the key if the algorithm is a PSS signing algorithm
+func rsaOpaqueSigner(alg jose.SignatureAlgorithm, key crypto.Signer) (jose.OpaqueSigner, bool) {
+	switch alg {
+	case jose.PS256, jose.PS384, jose.PS512:
+		return pssOpaqueSigner{alg: alg, signer: key}, true
+	}
+	return nil, false
+}
+
+// pssOpaqueSigner implements the jose.OpaqueSigner interface for PSS signature keys
+// Similar to the crytosigner.Opaque implementation for PSS keys except different salt lengths are used
+type pssOpaqueSigner struct {
+	alg    jose.SignatureAlgorithm
+	signer crypto.Signer
+}
+
+func (r pssOpaqueSigner) Public() *jose.JSONWebKey {
+	return &jose.JSONWebKey{Key: r.signer.Public()}
+}
+
+func (r pssOpaqueSigner) Algs() []jose.SignatureAlgorithm {
+	return []jose.SignatureAlgorithm{r.alg}
+}
+
+func (r pssOpaqueSigner) SignPayload(payload []byte, alg jose.SignatureAlgorithm) ([]byte, error) {
+	var hash crypto.Hash
+	switch alg {
+	case jose.PS256:
+		hash = crypto.SHA256
+	case jose.PS384:
+		hash = crypto.SHA384
+	case jose.PS512:
+		hash = crypto.SHA512
+	default:
+		return nil, jose.ErrUnsupportedAlgorithm
+	}
+
+	var hashed []byte
+	if hash != crypto.Hash(0) {
+		hasher := hash.New()
+		if _, err := hasher.Write(payload); err != nil {
+			return nil, err
+		}
+		hashed = hasher.Sum(nil)
+	}
+	return r.signer.Sign(rand.Reader, hashed, &rsa.PSSOptions{
+		SaltLength: rsa.PSSSaltLengthEqualsHash,
+		Hash:       hash,
+	})
+}
@@ -17,16 +17,25 @@
 package jws
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"math/big"
+	"strings"
 	"testing"
 
+	"github.com/JacoJooste/iot-edge/v7/internal/secp256k1"
+	"github.com/cloudflare/circl/sign/ed448"
 	"gopkg.in/square/go-jose.v2"
 )
 
@@ -34,7 +43,9 @@ var (
 	es256Key, _    = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	es384Key, _    = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
 	es512Key, _    = ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	es256kKey, _   = secp256k1.GenerateKey()
 	_, eddsaKey, _ = ed25519.GenerateKey(rand.Reader)
+	_, ed448Key, _ = ed448.GenerateKey(rand.Reader)
 	rsa256Key, _   = rsa.GenerateKey(rand.Reader, 2048)
 	rsa384Key, _   = rsa.GenerateKey(rand.Reader, 3072)
 	rsa512Key, _   = rsa.GenerateKey(rand.Reader, 4096)
@@ -63,7 +74,9 @@ func TestSigningJWKAlgorithmFromKey(t *testing.T) {
 		{name: "es256-key", signer: es256Key, alg: jose.ES256},
 		{name: "es384-key", signer: es384Key, alg: jose.ES384},
 		{name: "es521-key", signer: es512Key, alg: jose.ES512},
+		{name: "es256k-key", signer: es256kKey, alg: ES256K},
 		{name: "eddsa-key", signer: eddsaKey, alg: jose.EdDSA},
+		{name: "ed448-key", signer: ed448Key, alg: jose.EdDSA},
 		{name: "rsa256-key", signer: rsa256Key, alg: jose.PS256},
 		{name: "rsa384-key", signer: rsa384Key, alg: jose.PS384},
 		{name: "rsa512-key", signer: rsa512Key, alg: jose.PS512},
@@ -78,6 +91,174 @@ func TestSigningJWKAlgorithmFromKey(t *testing.T) {
 	}
 }
 
+func TestNewSigner_ES256K(t *testing.T) {
+	sig, err := NewSigner(es256kKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := sig.Sign([]byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compact, err := signed.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := jose.ParseSigned(compact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alg := parsed.Signatures[0].Header.Algorithm; alg != string(ES256K) {
+		t.Errorf("expected %s algorithm, got %s", ES256K, alg)
+	}
+	// go-jose can not verify ES256K signatures so the R || S signature is verified over the signing input
+	signature := parsed.Signatures[0].Signature
+	if len(signature) != 64 {
+		t.Fatalf("unexpected signature length %d", len(signature))
+	}
+	digest := sha256.Sum256([]byte(compact[:strings.LastIndex(compact, ".")]))
+	r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(&es256kKey.PublicKey, digest[:], r, s) {
+		t.Error("signature not verified")
+	}
+}
+
+func TestJSONWebKey_MarshalJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		key  crypto.PublicKey
+		crv  string
+	}{
+		{name: "p256", key: es256Key.Public(), crv: "P-256"},
+		{name: "secp256k1", key: es256kKey.Public(), crv: "secp256k1"},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			b, err := json.Marshal(JSONWebKey{JSONWebKey: jose.JSONWebKey{Key: subtest.key, KeyID: "kid", Use: "sig"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var jwk map[string]string
+			if err = json.Unmarshal(b, &jwk); err != nil {
+				t.Fatal(err)
+			}
+			if jwk["kty"] != "EC" || jwk["crv"] != subtest.crv || jwk["kid"] != "kid" || jwk["use"] != "sig" ||
+				len(jwk["x"]) != 43 || len(jwk["y"]) != 43 {
+				t.Errorf("unexpected JWK %s", b)
+			}
+			thumbprint, err := Thumbprint(subtest.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			input := fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, jwk["crv"], jwk["x"], jwk["y"])
+			if expected := sha256.Sum256([]byte(input)); !bytes.Equal(thumbprint, expected[:]) {
+				t.Error("unexpected thumbprint")
+			}
+		})
+	}
+}
+
+func TestNewSigner_Ed448(t *testing.T) {
+	sig, err := NewSigner(ed448Key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := sig.Sign([]byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compact, err := signed.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := jose.ParseSigned(compact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alg := parsed.Signatures[0].Header.Algorithm; alg != string(jose.EdDSA) {
+		t.Errorf("expected %s algorithm, got %s", jose.EdDSA, alg)
+	}
+	// go-jose can not verify Ed448 signatures so the signature is verified over the signing input
+	signingInput := []byte(compact[:strings.LastIndex(compact, ".")])
+	if !ed448.Verify(ed448Key.Public().(ed448.PublicKey), signingInput, parsed.Signatures[0].Signature, "") {
+		t.Error("signature not verified")
+	}
+}
+
+func TestJSONWebKey_MarshalJSON_Ed448(t *testing.T) {
+	b, err := json.Marshal(JSONWebKey{JSONWebKey: jose.JSONWebKey{Key: ed448Key.Public(), KeyID: "kid", Use: "sig"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jwk map[string]string
+	if err = json.Unmarshal(b, &jwk); err != nil {
+		t.Fatal(err)
+	}
+	x := base64.RawURLEncoding.EncodeToString(ed448Key.Public().(ed448.PublicKey))
+	if jwk["kty"] != "OKP" || jwk["crv"] != "Ed448" || jwk["kid"] != "kid" || jwk["x"] != x || jwk["y"] != "" {
+		t.Errorf("unexpected JWK %s", b)
+	}
+	thumbprint, err := Thumbprint(ed448Key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := fmt.Sprintf(`{"crv":"Ed448","kty":"OKP","x":"%s"}`, x)
+	if expected := sha256.Sum256([]byte(input)); !bytes.Equal(thumbprint, expected[:]) {
+		t.Error("unexpected thumbprint")
+	}
+}
+
+func TestJSONWebKey_MarshalJSON_CompressPoint(t *testing.T) {
+	tests := []struct {
+		name       string
+		key        *ecdsa.PublicKey
+		compressed bool
+	}{
+		{name: "p256", key: &es256Key.PublicKey, compressed: true},
+		{name: "p384", key: &es384Key.PublicKey},
+		{name: "secp256k1", key: &es256kKey.PublicKey},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			b, err := json.Marshal(JSONWebKey{JSONWebKey: jose.JSONWebKey{Key: subtest.key}, CompressPoint: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var jwk map[string]string
+			if err = json.Unmarshal(b, &jwk); err != nil {
+				t.Fatal(err)
+			}
+			if !subtest.compressed {
+				if jwk["y"] == "" {
+					t.Errorf("expected an uncompressed point, got %s", b)
+				}
+				return
+			}
+			if jwk["y"] != "" {
+				t.Fatalf("expected a compressed point, got %s", b)
+			}
+			// recover y from y² = x³ - 3x + b and the parity in the prefix
+			point, err := base64.RawURLEncoding.DecodeString(jwk["x"])
+			if err != nil || len(point) != 33 {
+				t.Fatalf("unexpected point %s", jwk["x"])
+			}
+			params := elliptic.P256().Params()
+			x := new(big.Int).SetBytes(point[1:])
+			y2 := new(big.Int).Exp(x, big.NewInt(3), params.P)
+			y2.Sub(y2, new(big.Int).Mul(x, big.NewInt(3)))
+			y2.Add(y2, params.B)
+			y2.Mod(y2, params.P)
+			y := new(big.Int).ModSqrt(y2, params.P)
+			if y.Bit(0) != uint(point[0]&1) {
+				y.Sub(params.P, y)
+			}
+			if x.Cmp(subtest.key.X) != 0 || y.Cmp(subtest.key.Y) != 0 {
+				t.Error("compressed point does not match the key")
+			}
+		})
+	}
+}
+
 type dummyClaims struct {
 	Command string `json:"command"`
 }
@@ -121,3 +302,56 @@ func TestExtractPayload_Success(t *testing.T) {
 		})
 	}
 }
+
+func TestDetachPayload(t *testing.T) {
+	signer, err := NewSigner(es256Key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	object, err := signer.Sign([]byte(`{"csrf":"token","scope":["publish"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := object.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	detached, err := DetachPayload(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(detached, "\n"+`{"csrf":"token","scope":["publish"]}`) || len(detached) >= len(token) {
+		t.Errorf("expected the payload to be detached; got %s", detached)
+	}
+	attached, err := AttachPayload(detached)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attached != token {
+		t.Errorf("expected %s; got %s", token, attached)
+	}
+	parsed, err := jose.ParseSigned(attached)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = parsed.Verify(es256Key.Public()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAttachPayload_Failure(t *testing.T) {
+	tests := []struct {
+		name     string
+		detached string
+	}{
+		{name: "not-detached", detached: "aaa.bbb.ccc\n{}"},
+		{name: "not-compact-serialisation", detached: "aaa.ccc\n{}"},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			if _, err := AttachPayload(subtest.detached); !errors.Is(err, ErrInvalidDetached) {
+				t.Errorf("expected %v; got %v", ErrInvalidDetached, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+// +build tiny
+
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jws
+
+import (
+	"crypto"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+// rsaAlgorithm does not support any keys since RSA support is excluded from tiny builds
+func rsaAlgorithm(crypto.PublicKey) (alg jose.SignatureAlgorithm, ok bool) {
+	return alg, false
+}
+
+// rsaAlgorithms returns no algorithms since RSA support is excluded from tiny builds
+func rsaAlgorithms() []jose.SignatureAlgorithm {
+	return nil
+}
+
+// rsaOpaqueSigner does not support any algorithms since RSA support is excluded from tiny builds
+func rsaOpaqueSigner(jose.SignatureAlgorithm, crypto.Signer) (jose.OpaqueSigner, bool) {
+	return nil, false
+}
@@ -0,0 +1,364 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oscore
+
+import (
+	"fmt"
+
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+)
+
+// Option is the number of the CoAP option that indicates an OSCORE protected message
+const Option coap.OptionID = 9
+
+// MediaType is the content format of an OSCORE protected payload
+const MediaType coap.MediaType = 10001
+
+const (
+	flagKID        = 0x08
+	flagKIDContext = 0x10
+	flagReserved   = 0xe0
+	payloadMarker  = 0xff
+)
+
+// innerOptions are the Class E options that are encrypted and integrity protected, in ascending order
+var innerOptions = []coap.OptionID{
+	coap.IfMatch,
+	coap.ETag,
+	coap.IfNoneMatch,
+	coap.LocationPath,
+	coap.URIPath,
+	coap.ContentFormat,
+	coap.MaxAge,
+	coap.URIQuery,
+	coap.Accept,
+	coap.LocationQuery,
+}
+
+// Exchange identifies a protected request so that the response can be bound to it
+type Exchange struct {
+	kid       []byte
+	partialIV []byte
+}
+
+// optionValue is the decoded value of the OSCORE option, see RFC 8613 section 6.1
+type optionValue struct {
+	partialIV  []byte
+	kid        []byte
+	kidContext []byte
+}
+
+func (v optionValue) marshal() []byte {
+	b := []byte{byte(len(v.partialIV))}
+	b = append(b, v.partialIV...)
+	if v.kidContext != nil {
+		b[0] |= flagKIDContext
+		b = append(b, byte(len(v.kidContext)))
+		b = append(b, v.kidContext...)
+	}
+	if v.kid != nil {
+		b[0] |= flagKID
+		b = append(b, v.kid...)
+	}
+	return b
+}
+
+func unmarshalOptionValue(b []byte) (v optionValue, err error) {
+	if len(b) == 0 {
+		return v, nil
+	}
+	flags := b[0]
+	n := int(flags & 0x07)
+	if flags&flagReserved != 0 || n > 5 || len(b) < 1+n {
+		return v, ErrInvalidMessage
+	}
+	b = b[1:]
+	if n > 0 {
+		v.partialIV, b = b[:n], b[n:]
+	}
+	if flags&flagKIDContext != 0 {
+		if len(b) < 1 || len(b) < 1+int(b[0]) {
+			return v, ErrInvalidMessage
+		}
+		s := int(b[0])
+		v.kidContext, b = b[1:1+s], b[1+s:]
+	}
+	if flags&flagKID != 0 {
+		v.kid = b
+	} else if len(b) > 0 {
+		return v, ErrInvalidMessage
+	}
+	return v, nil
+}
+
+// KeyID returns the key ID in the OSCORE option of a protected request.
+// Returns false if the message is not protected with OSCORE.
+func KeyID(msg coap.Message) ([]byte, bool) {
+	b, ok := msg.Option(Option).([]byte)
+	if !ok {
+		return nil, false
+	}
+	v, err := unmarshalOptionValue(b)
+	if err != nil || v.kid == nil {
+		return nil, false
+	}
+	return v.kid, true
+}
+
+// IsProtected returns true if the message contains the OSCORE option
+func IsProtected(msg coap.Message) bool {
+	return msg.Option(Option) != nil
+}
+
+// ProtectRequest encrypts the code, Class E options and payload of the request, replacing them with the OSCORE
+// option and the ciphertext. The returned exchange is used to verify the response.
+func (c *Context) ProtectRequest(msg coap.Message) (Exchange, error) {
+	piv, err := c.nextPartialIV()
+	if err != nil {
+		return Exchange{}, err
+	}
+	plaintext, err := encodeInner(msg)
+	if err != nil {
+		return Exchange{}, err
+	}
+	request := Exchange{kid: c.senderID, partialIV: piv}
+	protect(msg, codes.POST, optionValue{partialIV: piv, kid: c.senderID}, c.seal(piv, plaintext, request))
+	return request, nil
+}
+
+// UnprotectRequest decrypts and verifies the request, restoring the original code, options and payload
+func (c *Context) UnprotectRequest(msg coap.Message) (Exchange, error) {
+	b, _ := msg.Option(Option).([]byte)
+	v, err := unmarshalOptionValue(b)
+	if err != nil {
+		return Exchange{}, err
+	}
+	if v.partialIV == nil || v.kid == nil {
+		return Exchange{}, ErrInvalidMessage
+	}
+	request := Exchange{kid: v.kid, partialIV: v.partialIV}
+	plaintext, err := c.open(c.recipientID, v.partialIV, msg.Payload(), request)
+	if err != nil {
+		return Exchange{}, err
+	}
+	// only record the sequence number once the request has been verified
+	if err = c.acceptSequence(v.partialIV); err != nil {
+		return Exchange{}, err
+	}
+	return request, unprotect(msg, plaintext)
+}
+
+// ProtectResponse encrypts the code, Class E options and payload of the response to the given request
+func (c *Context) ProtectResponse(request Exchange, msg coap.Message) error {
+	piv, err := c.nextPartialIV()
+	if err != nil {
+		return err
+	}
+	plaintext, err := encodeInner(msg)
+	if err != nil {
+		return err
+	}
+	protect(msg, codes.Changed, optionValue{partialIV: piv}, c.seal(piv, plaintext, request))
+	return nil
+}
+
+// UnprotectResponse decrypts and verifies the response to the given request
+func (c *Context) UnprotectResponse(request Exchange, msg coap.Message) error {
+	b, ok := msg.Option(Option).([]byte)
+	if !ok {
+		return fmt.Errorf("%w: response is not protected", ErrInvalidMessage)
+	}
+	v, err := unmarshalOptionValue(b)
+	if err != nil {
+		return err
+	}
+	var plaintext []byte
+	if v.partialIV == nil {
+		// the response reuses the nonce of the request
+		plaintext, err = c.open(request.kid, request.partialIV, msg.Payload(), request)
+	} else {
+		plaintext, err = c.open(c.recipientID, v.partialIV, msg.Payload(), request)
+	}
+	if err != nil {
+		return err
+	}
+	return unprotect(msg, plaintext)
+}
+
+// protect replaces the protected content of the message with the outer code, the OSCORE option and the ciphertext
+func protect(msg coap.Message, code codes.Code, value optionValue, ciphertext []byte) {
+	for _, id := range innerOptions {
+		msg.RemoveOption(id)
+	}
+	msg.SetCode(code)
+	msg.SetOption(Option, value.marshal())
+	// the content format is set on the outer message since the CoAP library refuses a payload without one
+	msg.SetOption(coap.ContentFormat, MediaType)
+	msg.SetPayload(ciphertext)
+}
+
+// unprotect restores the code, options and payload of the message from the decrypted plaintext
+func unprotect(msg coap.Message, plaintext []byte) error {
+	if len(plaintext) == 0 {
+		return ErrInvalidMessage
+	}
+	msg.SetCode(codes.Code(plaintext[0]))
+	msg.RemoveOption(Option)
+	for _, id := range innerOptions {
+		msg.RemoveOption(id)
+	}
+	b := plaintext[1:]
+	var number coap.OptionID
+	for len(b) > 0 && b[0] != payloadMarker {
+		delta, value, rest, err := readOption(b)
+		if err != nil {
+			return err
+		}
+		number += coap.OptionID(delta)
+		msg.AddOption(number, optionFromBytes(number, value))
+		b = rest
+	}
+	var payload []byte
+	if len(b) > 0 {
+		payload = b[1:]
+	}
+	msg.SetPayload(payload)
+	return nil
+}
+
+// encodeInner encodes the code, Class E options and payload of the message as the OSCORE plaintext,
+// see RFC 8613 section 5.3
+func encodeInner(msg coap.Message) ([]byte, error) {
+	b := []byte{byte(msg.Code())}
+	var previous coap.OptionID
+	for _, id := range innerOptions {
+		for _, o := range msg.Options(id) {
+			value, err := optionToBytes(o)
+			if err != nil {
+				return nil, err
+			}
+			b = appendOption(b, int(id-previous), value)
+			previous = id
+		}
+	}
+	if payload := msg.Payload(); len(payload) > 0 {
+		b = append(b, payloadMarker)
+		b = append(b, payload...)
+	}
+	return b, nil
+}
+
+// extendedOption returns the 4 bit nibble and the extended bytes of a CoAP option delta or length
+func extendedOption(n int) (nibble byte, ext []byte) {
+	switch {
+	case n < 13:
+		return byte(n), nil
+	case n < 269:
+		return 13, []byte{byte(n - 13)}
+	default:
+		n -= 269
+		return 14, []byte{byte(n >> 8), byte(n)}
+	}
+}
+
+func appendOption(b []byte, delta int, value []byte) []byte {
+	d, dx := extendedOption(delta)
+	l, lx := extendedOption(len(value))
+	b = append(b, d<<4|l)
+	b = append(b, dx...)
+	b = append(b, lx...)
+	return append(b, value...)
+}
+
+func readExtended(nibble byte, b []byte) (int, []byte, error) {
+	switch nibble {
+	case 13:
+		if len(b) < 1 {
+			return 0, nil, ErrInvalidMessage
+		}
+		return int(b[0]) + 13, b[1:], nil
+	case 14:
+		if len(b) < 2 {
+			return 0, nil, ErrInvalidMessage
+		}
+		return int(b[0])<<8 | int(b[1]) + 269, b[2:], nil
+	case 15:
+		return 0, nil, ErrInvalidMessage
+	}
+	return int(nibble), b, nil
+}
+
+func readOption(b []byte) (delta int, value []byte, rest []byte, err error) {
+	header := b[0]
+	b = b[1:]
+	if delta, b, err = readExtended(header>>4, b); err != nil {
+		return
+	}
+	var length int
+	if length, b, err = readExtended(header&0x0f, b); err != nil {
+		return
+	}
+	if len(b) < length {
+		return 0, nil, nil, ErrInvalidMessage
+	}
+	return delta, b[:length], b[length:], nil
+}
+
+// optionToBytes returns the encoded value of a CoAP option
+func optionToBytes(value interface{}) ([]byte, error) {
+	var n uint32
+	switch v := value.(type) {
+	case string:
+		return []byte(v), nil
+	case []byte:
+		return v, nil
+	case coap.MediaType:
+		n = uint32(v)
+	case uint32:
+		n = v
+	case uint:
+		n = uint32(v)
+	case int:
+		n = uint32(v)
+	default:
+		return nil, fmt.Errorf("unsupported option value type %T", value)
+	}
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return b, nil
+}
+
+// optionFromBytes returns the value of a CoAP option in the type expected by the go-coap library
+func optionFromBytes(id coap.OptionID, b []byte) interface{} {
+	switch id {
+	case coap.URIPath, coap.URIQuery, coap.LocationPath, coap.LocationQuery:
+		return string(b)
+	case coap.ContentFormat, coap.Accept, coap.MaxAge:
+		var n uint32
+		for _, v := range b {
+			n = n<<8 | uint32(v)
+		}
+		if id == coap.MaxAge {
+			return n
+		}
+		return coap.MediaType(n)
+	}
+	return b
+}
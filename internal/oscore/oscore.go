@@ -0,0 +1,289 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package oscore implements Object Security for Constrained RESTful Environments (OSCORE) as defined in RFC 8613.
+// OSCORE protects CoAP messages end-to-end at the application layer so that the protection survives CoAP proxies.
+package oscore
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/cbor"
+	"golang.org/x/crypto/hkdf"
+	"gopkg.in/square/go-jose.v2"
+)
+
+const (
+	// algorithm is the COSE identifier of the AEAD algorithm, AES-GCM mode w/ 128-bit key, 128-bit tag.
+	// The Go standard library does not provide the mandatory AES-CCM-16-64-128 algorithm.
+	algorithm   = 1
+	keyLength   = 16
+	nonceLength = 12
+	// maxIDLength is the maximum length of a sender ID for the nonce length of the algorithm
+	maxIDLength = nonceLength - 6
+	// maxSequenceNumber is the largest sequence number that can be encoded in a Partial IV
+	maxSequenceNumber = 1<<40 - 1
+	// replayWindowSize is the number of sequence numbers below the highest received that are still accepted
+	replayWindowSize = 32
+)
+
+var (
+	// ErrContextNotFound is returned when no security context matches the key ID of a protected message
+	ErrContextNotFound = errors.New("security context not found")
+	// ErrReplay is returned when a protected request has already been received
+	ErrReplay = errors.New("replayed message")
+	// ErrDecryption is returned when a protected message can not be decrypted and verified
+	ErrDecryption = errors.New("decryption failed")
+	// ErrSequenceExhausted is returned when the sender sequence number has wrapped and a new context is required
+	ErrSequenceExhausted = errors.New("sender sequence number exhausted")
+	// ErrInvalidMessage is returned when the OSCORE option or the protected content is malformed
+	ErrInvalidMessage = errors.New("invalid OSCORE message")
+)
+
+// Context is an OSCORE security context shared by two endpoints
+type Context struct {
+	senderID    []byte
+	recipientID []byte
+	idContext   []byte
+	commonIV    []byte
+	sender      cipher.AEAD
+	recipient   cipher.AEAD
+
+	mu       sync.Mutex
+	sequence uint64
+	replay   replayWindow
+}
+
+// NewContext derives a security context from the master secret and salt shared by the two endpoints.
+// The ID context, which may be nil, binds the context to the identity of the endpoints.
+func NewContext(masterSecret, masterSalt, senderID, recipientID, idContext []byte) (*Context, error) {
+	if len(senderID) > maxIDLength || len(recipientID) > maxIDLength {
+		return nil, fmt.Errorf("sender and recipient ID must not be longer than %d bytes", maxIDLength)
+	}
+	senderKey, err := derive(masterSecret, masterSalt, senderID, idContext, algorithm, "Key", keyLength)
+	if err != nil {
+		return nil, err
+	}
+	recipientKey, err := derive(masterSecret, masterSalt, recipientID, idContext, algorithm, "Key", keyLength)
+	if err != nil {
+		return nil, err
+	}
+	commonIV, err := derive(masterSecret, masterSalt, []byte{}, idContext, algorithm, "IV", nonceLength)
+	if err != nil {
+		return nil, err
+	}
+	c := &Context{
+		senderID:    senderID,
+		recipientID: recipientID,
+		idContext:   idContext,
+		commonIV:    commonIV,
+	}
+	if c.sender, err = newAEAD(senderKey); err != nil {
+		return nil, err
+	}
+	if c.recipient, err = newAEAD(recipientKey); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// SenderID returns the ID used by this endpoint to identify the messages that it protects
+func (c *Context) SenderID() []byte {
+	return c.senderID
+}
+
+// RecipientID returns the ID used by the other endpoint to identify the messages that it protects
+func (c *Context) RecipientID() []byte {
+	return c.recipientID
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// derive a key or IV from the master secret, see RFC 8613 section 3.2.1
+func derive(secret, salt, id, idContext []byte, alg uint64, typ string, length int) ([]byte, error) {
+	var info []byte
+	info = cbor.AppendArray(info, 5)
+	info = cbor.AppendBytes(info, id)
+	if idContext == nil {
+		info = cbor.AppendNull(info)
+	} else {
+		info = cbor.AppendBytes(info, idContext)
+	}
+	info = cbor.AppendUint(info, alg)
+	info = cbor.AppendText(info, typ)
+	info = cbor.AppendUint(info, uint64(length))
+
+	out := make([]byte, length)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, info), out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// nextPartialIV returns the Partial IV for the next message protected by this endpoint
+func (c *Context) nextPartialIV() ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sequence > maxSequenceNumber {
+		return nil, ErrSequenceExhausted
+	}
+	piv := encodePartialIV(c.sequence)
+	c.sequence++
+	return piv, nil
+}
+
+// encodePartialIV encodes a sequence number as a Partial IV in the fewest bytes possible
+func encodePartialIV(sequence uint64) []byte {
+	piv := []byte{byte(sequence)}
+	for sequence >>= 8; sequence > 0; sequence >>= 8 {
+		piv = append([]byte{byte(sequence)}, piv...)
+	}
+	return piv
+}
+
+func decodePartialIV(piv []byte) uint64 {
+	var sequence uint64
+	for _, b := range piv {
+		sequence = sequence<<8 | uint64(b)
+	}
+	return sequence
+}
+
+// nonce constructs the AEAD nonce from the ID of the endpoint that protected the message and its Partial IV,
+// see RFC 8613 section 5.2
+func (c *Context) nonce(id, piv []byte) []byte {
+	nonce := make([]byte, nonceLength)
+	nonce[0] = byte(len(id))
+	copy(nonce[nonceLength-5-len(id):nonceLength-5], id)
+	copy(nonce[nonceLength-len(piv):], piv)
+	for i := range nonce {
+		nonce[i] ^= c.commonIV[i]
+	}
+	return nonce
+}
+
+// additionalData constructs the AEAD additional authenticated data that binds a response to its request,
+// see RFC 8613 section 5.4
+func additionalData(requestKID, requestPIV []byte) []byte {
+	var external []byte
+	external = cbor.AppendArray(external, 5)
+	external = cbor.AppendUint(external, 1)
+	external = cbor.AppendArray(external, 1)
+	external = cbor.AppendUint(external, algorithm)
+	external = cbor.AppendBytes(external, requestKID)
+	external = cbor.AppendBytes(external, requestPIV)
+	external = cbor.AppendBytes(external, []byte{})
+
+	var aad []byte
+	aad = cbor.AppendArray(aad, 3)
+	aad = cbor.AppendText(aad, "Encrypt0")
+	aad = cbor.AppendBytes(aad, []byte{})
+	aad = cbor.AppendBytes(aad, external)
+	return aad
+}
+
+// seal encrypts the plaintext with the sender key using the Partial IV of this endpoint
+func (c *Context) seal(piv, plaintext []byte, request Exchange) []byte {
+	return c.sender.Seal(nil, c.nonce(c.senderID, piv), plaintext, additionalData(request.kid, request.partialIV))
+}
+
+// open decrypts the ciphertext with the recipient key using the nonce constructed from the ID and Partial IV
+func (c *Context) open(id, piv, ciphertext []byte, request Exchange) ([]byte, error) {
+	plaintext, err := c.recipient.Open(nil, c.nonce(id, piv), ciphertext,
+		additionalData(request.kid, request.partialIV))
+	if err != nil {
+		return nil, ErrDecryption
+	}
+	return plaintext, nil
+}
+
+// replayWindow keeps track of the sequence numbers received from the other endpoint
+type replayWindow struct {
+	received bool
+	highest  uint64
+	// bitmap of the sequence numbers received below the highest, bit n represents highest - n - 1
+	window uint32
+}
+
+// accept returns true and records the sequence number if it has not been received before
+func (w *replayWindow) accept(sequence uint64) bool {
+	switch {
+	case !w.received || sequence > w.highest:
+		if w.received {
+			shift := sequence - w.highest
+			if shift > replayWindowSize {
+				w.window = 0
+			} else {
+				w.window = w.window<<shift | 1<<(shift-1)
+			}
+		}
+		w.received = true
+		w.highest = sequence
+		return true
+	case sequence == w.highest || w.highest-sequence > replayWindowSize:
+		return false
+	default:
+		bit := uint32(1) << (w.highest - sequence - 1)
+		if w.window&bit != 0 {
+			return false
+		}
+		w.window |= bit
+		return true
+	}
+}
+
+// acceptSequence checks the sequence number of a request against the replay window
+func (c *Context) acceptSequence(piv []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.replay.accept(decodePartialIV(piv)) {
+		return ErrReplay
+	}
+	return nil
+}
+
+// SharedSecret returns the master secret agreed with ECDH between the private key of this endpoint and the public key
+// of the other endpoint. Both keys must be on the same curve.
+func SharedSecret(key *ecdsa.PrivateKey, public *ecdsa.PublicKey) ([]byte, error) {
+	if public == nil || public.Curve != key.Curve || !key.Curve.IsOnCurve(public.X, public.Y) {
+		return nil, errors.New("public key is not on the curve of the private key")
+	}
+	x, _ := key.Curve.ScalarMult(public.X, public.Y, key.D.Bytes())
+	secret := make([]byte, (key.Curve.Params().BitSize+7)/8)
+	b := x.Bytes()
+	copy(secret[len(secret)-len(b):], b)
+	return secret, nil
+}
+
+// IDContext returns the ID context that binds a security context to the confirmation key of a thing.
+// The ID context is the JWK thumbprint (RFC 7638) of the key.
+func IDContext(key crypto.PublicKey) ([]byte, error) {
+	return (&jose.JSONWebKey{Key: key}).Thumbprint(crypto.SHA256)
+}
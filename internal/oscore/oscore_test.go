@@ -0,0 +1,253 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oscore
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/go-ocf/go-coap"
+	"github.com/go-ocf/go-coap/codes"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// test vectors from RFC 8613 Appendix C.1.1, which uses AES-CCM-16-64-128 (10)
+func TestDerive(t *testing.T) {
+	secret := unhex(t, "0102030405060708090a0b0c0d0e0f10")
+	salt := unhex(t, "9e7ca92223786340")
+	tests := []struct {
+		name     string
+		id       []byte
+		typ      string
+		length   int
+		expected string
+	}{
+		{name: "sender key", id: []byte{}, typ: "Key", length: 16, expected: "f0910ed7295e6ad4b54fc793154302ff"},
+		{name: "recipient key", id: []byte{0x01}, typ: "Key", length: 16, expected: "ffb14e093c94c9cac9471648b4f98710"},
+		{name: "common IV", id: []byte{}, typ: "IV", length: 13, expected: "4622d4dd6d944168eefb54987c"},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			b, err := derive(secret, salt, subtest.id, nil, 10, subtest.typ, subtest.length)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hex.EncodeToString(b) != subtest.expected {
+				t.Errorf("expected %s, got %x", subtest.expected, b)
+			}
+		})
+	}
+}
+
+func testContexts(t *testing.T) (client, server *Context) {
+	secret := []byte("0123456789abcdef")
+	salt := []byte("salt")
+	idContext := []byte("thing")
+	client, err := NewContext(secret, salt, []byte{0x01}, []byte{}, idContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewContext(secret, salt, []byte{}, []byte{0x01}, idContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func testRequest() coap.Message {
+	msg := coap.NewDgramMessage(coap.MessageParams{
+		Type:      coap.Confirmable,
+		Code:      codes.GET,
+		MessageID: 1,
+		Token:     []byte{0x01},
+		Payload:   []byte("hello"),
+	})
+	msg.SetPathString("/attributes")
+	msg.SetQuery([]string{"name", "serial"})
+	msg.SetOption(coap.ContentFormat, coap.AppJSON)
+	return msg
+}
+
+func TestContext_ProtectRequest(t *testing.T) {
+	client, server := testContexts(t)
+	msg := testRequest()
+	if _, err := client.ProtectRequest(msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Code() != codes.POST || msg.PathString() != "" || msg.Option(coap.ContentFormat) != MediaType {
+		t.Fatalf("protected content visible in the outer message: %v", msg)
+	}
+	if bytes.Contains(msg.Payload(), []byte("hello")) {
+		t.Fatal("payload not encrypted")
+	}
+	kid, ok := KeyID(msg)
+	if !ok || !bytes.Equal(kid, []byte{0x01}) {
+		t.Fatalf("unexpected key ID %v", kid)
+	}
+	if _, err := server.UnprotectRequest(msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Code() != codes.GET || msg.PathString() != "attributes" || msg.QueryString() != "name&serial" ||
+		msg.Option(coap.ContentFormat) != coap.AppJSON || string(msg.Payload()) != "hello" || IsProtected(msg) {
+		t.Errorf("unexpected unprotected message: %v", msg)
+	}
+}
+
+func TestContext_ProtectResponse(t *testing.T) {
+	client, server := testContexts(t)
+	request := testRequest()
+	exchange, err := client.ProtectRequest(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, err := server.UnprotectRequest(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := coap.NewDgramMessage(coap.MessageParams{
+		Type:    coap.Acknowledgement,
+		Code:    codes.Content,
+		Payload: []byte("world"),
+	})
+	if err = server.ProtectResponse(received, response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Code() != codes.Changed {
+		t.Errorf("expected outer code %v, got %v", codes.Changed, response.Code())
+	}
+	if err = client.UnprotectResponse(exchange, response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Code() != codes.Content || string(response.Payload()) != "world" {
+		t.Errorf("unexpected unprotected response: %v", response)
+	}
+}
+
+// check that a response can not be used to answer a different request
+func TestContext_UnprotectResponse_WrongRequest(t *testing.T) {
+	client, server := testContexts(t)
+	first := testRequest()
+	exchange, err := client.ProtectRequest(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := testRequest()
+	if _, err = client.ProtectRequest(second); err != nil {
+		t.Fatal(err)
+	}
+	received, err := server.UnprotectRequest(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := coap.NewDgramMessage(coap.MessageParams{Code: codes.Content, Payload: []byte("world")})
+	if err = server.ProtectResponse(received, response); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.UnprotectResponse(exchange, response); !errors.Is(err, ErrDecryption) {
+		t.Errorf("expected %v, got %v", ErrDecryption, err)
+	}
+}
+
+func TestContext_UnprotectRequest_Replay(t *testing.T) {
+	client, server := testContexts(t)
+	msg := testRequest()
+	if _, err := client.ProtectRequest(msg); err != nil {
+		t.Fatal(err)
+	}
+	option := msg.Option(Option)
+	payload := msg.Payload()
+	if _, err := server.UnprotectRequest(msg); err != nil {
+		t.Fatal(err)
+	}
+	replayed := coap.NewDgramMessage(coap.MessageParams{Code: codes.POST, Payload: payload})
+	replayed.SetOption(Option, option)
+	if _, err := server.UnprotectRequest(replayed); !errors.Is(err, ErrReplay) {
+		t.Errorf("expected %v, got %v", ErrReplay, err)
+	}
+}
+
+func TestContext_UnprotectRequest_Tampered(t *testing.T) {
+	client, server := testContexts(t)
+	msg := testRequest()
+	if _, err := client.ProtectRequest(msg); err != nil {
+		t.Fatal(err)
+	}
+	payload := msg.Payload()
+	payload[0] ^= 0xff
+	msg.SetPayload(payload)
+	if _, err := server.UnprotectRequest(msg); !errors.Is(err, ErrDecryption) {
+		t.Errorf("expected %v, got %v", ErrDecryption, err)
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+	sequence := []struct {
+		number   uint64
+		accepted bool
+	}{
+		{0, true},
+		{0, false},
+		{2, true},
+		{1, true},
+		{1, false},
+		{40, true},
+		{7, false},
+		{8, true},
+		{8, false},
+		{41, true},
+		{40, false},
+	}
+	for _, s := range sequence {
+		if w.accept(s.number) != s.accepted {
+			t.Errorf("sequence number %d: expected accepted to be %v", s.number, s.accepted)
+		}
+	}
+}
+
+func TestOptionValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		value optionValue
+	}{
+		{name: "request", value: optionValue{partialIV: []byte{0x14}, kid: []byte{0x01}}},
+		{name: "empty kid", value: optionValue{partialIV: []byte{0x00}, kid: []byte{}}},
+		{name: "kid context", value: optionValue{partialIV: []byte{0x01, 0x02}, kid: []byte{0x01}, kidContext: []byte("ctx")}},
+		{name: "response", value: optionValue{partialIV: []byte{0x05}}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			v, err := unmarshalOptionValue(subtest.value.marshal())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(v.partialIV, subtest.value.partialIV) || !bytes.Equal(v.kid, subtest.value.kid) ||
+				!bytes.Equal(v.kidContext, subtest.value.kidContext) || (v.kid == nil) != (subtest.value.kid == nil) {
+				t.Errorf("expected %v, got %v", subtest.value, v)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package secp256k1 adapts the secp256k1 elliptic curve (SEC 2, section 2.4.1), which is not provided by the
+// standard library, so that existing secp256k1 device keys can be used with the crypto/ecdsa package.
+//
+// The curve arithmetic is provided by github.com/decred/dcrd/dcrec/secp256k1. The generic crypto/ecdsa functions
+// are not constant time for curves outside of the standard library, so private keys should be generated with
+// GenerateKey and used for signing with Sign.
+package secp256k1
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"errors"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	decredecdsa "github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+)
+
+// Name is the name of the curve as returned by elliptic.CurveParams
+const Name = "secp256k1"
+
+// S256 returns the secp256k1 curve
+func S256() elliptic.Curve {
+	return secp256k1.S256()
+}
+
+// IsCurve returns true if the curve is secp256k1. Curves from other implementations are recognised by name.
+func IsCurve(c elliptic.Curve) bool {
+	return c != nil && c.Params() != nil && c.Params().Name == Name
+}
+
+// GenerateKey generates a secp256k1 private key
+func GenerateKey() (*ecdsa.PrivateKey, error) {
+	key, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	return key.ToECDSA(), nil
+}
+
+// Sign signs the digest with the secp256k1 private key and returns the ASN.1 encoded signature.
+// The deterministic nonce of RFC 6979 is used and the signing is constant time.
+func Sign(key *ecdsa.PrivateKey, digest []byte) ([]byte, error) {
+	if !IsCurve(key.Curve) {
+		return nil, errors.New("not a secp256k1 key")
+	}
+	d := key.D.Bytes()
+	if len(d) > 32 {
+		return nil, errors.New("invalid secp256k1 private key")
+	}
+	padded := make([]byte, 32)
+	copy(padded[32-len(d):], d)
+	private := secp256k1.PrivKeyFromBytes(padded)
+	defer private.Zero()
+	for i := range padded {
+		padded[i] = 0
+	}
+	return decredecdsa.Sign(private, digest).Serialize(), nil
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package secp256k1
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+)
+
+func TestS256_KnownMultiples(t *testing.T) {
+	c := S256()
+	// multiples of the generator from the secp256k1 test vectors
+	tests := []struct {
+		k    int64
+		x, y string
+	}{
+		{k: 1, x: "79BE667EF9DCBBAC55A06295CE870B07029BFCDB2DCE28D959F2815B16F81798",
+			y: "483ADA7726A3C4655DA4FBFC0E1108A8FD17B448A68554199C47D08FFB10D4B8"},
+		{k: 2, x: "C6047F9441ED7D6D3045406E95C07CD85C778E4B8CEF3CA7ABAC09B95C709EE5",
+			y: "1AE168FEA63DC339A3C58419466CEAEEF7F632653266D0E1236431A950CFE52A"},
+		{k: 3, x: "F9308A019258C31049344F85F89D5229B531C845836F99B08601F113BCE036F9",
+			y: "388F7B0F632DE8140FE337E62A37F3566500A99934C2231B6CB9FD7584B8E672"},
+	}
+	for _, test := range tests {
+		x, y := c.ScalarBaseMult(big.NewInt(test.k).Bytes())
+		expectedX, _ := new(big.Int).SetString(test.x, 16)
+		expectedY, _ := new(big.Int).SetString(test.y, 16)
+		if x.Cmp(expectedX) != 0 || y.Cmp(expectedY) != 0 {
+			t.Errorf("%dG = (%x, %x)", test.k, x, y)
+		}
+		if !c.IsOnCurve(x, y) {
+			t.Errorf("%dG is not on the curve", test.k)
+		}
+	}
+	x, y := c.Add(c.Params().Gx, c.Params().Gy, c.Params().Gx, c.Params().Gy)
+	dx, dy := c.Double(c.Params().Gx, c.Params().Gy)
+	if x.Cmp(dx) != 0 || y.Cmp(dy) != 0 {
+		t.Error("G + G != 2G")
+	}
+	x, y = c.ScalarBaseMult(c.Params().N.Bytes())
+	if x.Sign() != 0 || y.Sign() != 0 {
+		t.Error("nG is not the point at infinity")
+	}
+}
+
+func TestSign(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsCurve(key.Curve) {
+		t.Fatal("expected secp256k1 key")
+	}
+	digest := sha256.Sum256([]byte("payload"))
+	der, err := Sign(key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sig struct {
+		R, S *big.Int
+	}
+	if _, err = asn1.Unmarshal(der, &sig); err != nil {
+		t.Fatal(err)
+	}
+	if !ecdsa.Verify(&key.PublicKey, digest[:], sig.R, sig.S) {
+		t.Error("signature not verified")
+	}
+	other := sha256.Sum256([]byte("other"))
+	if ecdsa.Verify(&key.PublicKey, other[:], sig.R, sig.S) {
+		t.Error("signature verified for a different digest")
+	}
+	// RFC 6979 signatures are deterministic
+	again, err := Sign(key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(der, again) {
+		t.Error("expected the same signature")
+	}
+}
+
+func TestSign_OtherCurve(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte("payload"))
+	if _, err := Sign(key, digest[:]); err == nil {
+		t.Error("expected an error for a P-256 key")
+	}
+}
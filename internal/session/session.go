@@ -44,16 +44,50 @@ func (s *DefaultSession) Logout() error {
 	return s.connection.LogoutSession(s.token)
 }
 
+// Transfer moves the session to the connection if the session is valid over the connection, which is checked with the
+// server at the other end of the connection. Returns false, and leaves the session unchanged, if the server does not
+// accept the session, for example because the Thing Gateway created the session offline.
+func Transfer(s session.Session, connection client.Connection) (bool, error) {
+	var transferred *DefaultSession
+	switch s := s.(type) {
+	case *DefaultSession:
+		transferred = s
+	case *PoPSession:
+		transferred = &s.DefaultSession
+	default:
+		return false, errors.New("the session was not created by the SDK")
+	}
+	valid, err := connection.ValidateSession(transferred.token)
+	if err != nil || !valid {
+		return false, err
+	}
+	transferred.connection = connection
+	return true, nil
+}
+
 type PoPSession struct {
 	DefaultSession
 	nonce int
 	key   crypto.Signer
+	// keyID identifies the signing key in signed requests, it is empty unless a signing key was selected
+	keyID string
 }
 
 func (s *PoPSession) SigningKey() crypto.Signer {
 	return s.key
 }
 
+// KeyID returns the ID of the signing key if one was selected with UseSigningKey
+func (s *PoPSession) KeyID() string {
+	return s.keyID
+}
+
+// UseSigningKey signs subsequent requests with the given confirmation key of the thing, which is identified by its key
+// ID in the requests
+func (s *PoPSession) UseSigningKey(keyID string, key crypto.Signer) {
+	s.keyID, s.key = keyID, key
+}
+
 func (s *PoPSession) Nonce() int {
 	return s.nonce
 }
@@ -69,6 +103,23 @@ type Builder struct {
 	timeout    time.Duration
 	connection client.Connection
 	handlers   []callback.Handler
+	// resume is the suspended authentication that is resumed instead of starting a new authentication
+	resume *callback.SuspendedError
+	// onCallbacks is called with the callbacks of every round trip before they are handled
+	onCallbacks func(callbacks []callback.Callback)
+}
+
+// OnCallbacks sets a function that is called with the callbacks of every round trip of the authentication tree
+// before they are handled, for example to report the progress of the authentication
+func (b *Builder) OnCallbacks(f func(callbacks []callback.Callback)) *Builder {
+	b.onCallbacks = f
+	return b
+}
+
+// ResumeFrom resumes the suspended authentication instead of starting the authentication tree from the beginning
+func (b *Builder) ResumeFrom(suspended callback.SuspendedError) *Builder {
+	b.resume = &suspended
+	return b
 }
 
 func (b *Builder) AuthenticateWith(handlers ...callback.Handler) session.Builder {
@@ -118,6 +169,15 @@ func (b *Builder) Create() (session.Session, error) {
 	}
 	auth := client.AuthenticatePayload{}
 	var signer crypto.Signer
+	if b.resume != nil {
+		auth.AuthId, auth.Callbacks = b.resume.AuthID, b.resume.Callbacks
+		// the proof of possession was given before the authentication was suspended
+		for _, h := range b.handlers {
+			if signer = handlerSigningKey(h); signer != nil {
+				break
+			}
+		}
+	}
 	for {
 		if auth, err = b.connection.Authenticate(auth); err != nil {
 			return nil, err
@@ -136,9 +196,21 @@ func (b *Builder) Create() (session.Session, error) {
 			}
 			return &defaultSession, nil
 		}
-		if signer, err = processCallbacks(b.handlers, auth.Callbacks); err != nil {
+		if b.onCallbacks != nil {
+			b.onCallbacks(auth.Callbacks)
+		}
+		handledBy, err := processCallbacks(b.handlers, auth.Callbacks)
+		var suspended callback.SuspendedError
+		if errors.As(err, &suspended) {
+			suspended.AuthID, suspended.Callbacks = auth.AuthId, auth.Callbacks
+			return nil, suspended
+		} else if err != nil {
 			return nil, err
 		}
+		// the signer is kept for steps of the tree that do not require a proof of possession, such as polling steps
+		if handledBy != nil {
+			signer = handledBy
+		}
 	}
 }
 
@@ -163,11 +235,18 @@ func processCallbacks(handlers []callback.Handler, callbacks []callback.Callback
 }
 
 func handlerSigningKey(handler callback.Handler) crypto.Signer {
+	// handlers that decorate other handlers expose the decorated handler
+	if wrapper, ok := handler.(interface{ Unwrap() callback.Handler }); ok {
+		return handlerSigningKey(wrapper.Unwrap())
+	}
 	if handler, ok := handler.(callback.AuthenticateHandler); ok {
 		return handler.Key
 	}
 	if handler, ok := handler.(callback.RegisterHandler); ok {
 		return handler.Key
 	}
+	if handler, ok := handler.(callback.OnboardHandler); ok {
+		return handler.Key
+	}
 	return nil
 }
@@ -21,12 +21,23 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/x509"
+	"errors"
 	"math/big"
 	"testing"
 
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
 	"github.com/JacoJooste/iot-edge/v7/pkg/callback"
 )
 
+// testWrappedHandler decorates a callback handler
+type testWrappedHandler struct {
+	callback.Handler
+}
+
+func (h testWrappedHandler) Unwrap() callback.Handler {
+	return h.Handler
+}
+
 func Test_processCallbacks(t *testing.T) {
 	var signingKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	template := x509.Certificate{
@@ -79,6 +90,7 @@ func Test_processCallbacks(t *testing.T) {
 		{name: "Name", handlers: []callback.Handler{nameHL}, pop: false},
 		{name: "Auth", handlers: []callback.Handler{authHL}, pop: true},
 		{name: "Reg", handlers: []callback.Handler{regHL}, pop: true},
+		{name: "WrappedReg", handlers: []callback.Handler{testWrappedHandler{regHL}}, pop: true},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
@@ -92,3 +104,85 @@ func Test_processCallbacks(t *testing.T) {
 		})
 	}
 }
+
+// pollingConnection authenticates a thing with a tree that polls until the thing is approved
+type pollingConnection struct {
+	client.Connection
+	// polls before the thing is approved
+	polls    int
+	requests []client.AuthenticatePayload
+}
+
+func (m *pollingConnection) Authenticate(payload client.AuthenticatePayload) (reply client.AuthenticatePayload,
+	err error) {
+	m.requests = append(m.requests, payload)
+	switch {
+	case payload.AuthId == "":
+		reply.AuthId = "auth-1"
+		reply.Callbacks = []callback.Callback{{
+			Type:   callback.TypeHiddenValueCallback,
+			Output: []callback.Entry{{Name: "id", Value: "jwt-pop-authentication"}, {Name: "value", Value: "1"}},
+			Input:  make([]callback.Entry, 1),
+		}}
+	case m.polls > 0:
+		m.polls--
+		reply.AuthId = "auth-2"
+		reply.Callbacks = []callback.Callback{{
+			Type: callback.TypePollingWaitCallback,
+			Output: []callback.Entry{{Name: "waitTime", Value: "1"},
+				{Name: "message", Value: "Waiting for approval"}},
+		}}
+	default:
+		reply.TokenID = "12345"
+	}
+	return reply, nil
+}
+
+func TestBuilder_Create_Polling(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	authHL := callback.AuthenticateHandler{Audience: "/", ThingID: "Bob", KeyID: "1", Key: key}
+
+	// the tree is polled until the thing is approved
+	connection := &pollingConnection{polls: 2}
+	s, err := (&Builder{}).
+		WithConnection(connection).
+		AuthenticateWith(authHL, callback.PollingWaitHandler{}).
+		Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.(*PoPSession); !ok {
+		t.Error("expected a proof of possession session after polling")
+	}
+	if len(connection.requests) != 4 {
+		t.Errorf("expected 4 requests; got %d", len(connection.requests))
+	}
+
+	// the authentication is suspended and resumed where it was suspended
+	connection = &pollingConnection{polls: 1}
+	_, err = (&Builder{}).
+		WithConnection(connection).
+		AuthenticateWith(authHL, callback.PollingWaitHandler{Suspend: true}).
+		Create()
+	var suspended callback.SuspendedError
+	if !errors.As(err, &suspended) {
+		t.Fatalf("expected a suspended authentication; got %v", err)
+	}
+	if suspended.AuthID != "auth-2" || suspended.Message != "Waiting for approval" {
+		t.Errorf("unexpected suspended authentication %+v", suspended)
+	}
+	s, err = (&Builder{}).
+		ResumeFrom(suspended).
+		WithConnection(connection).
+		AuthenticateWith(authHL, callback.PollingWaitHandler{Suspend: true}).
+		Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.(*PoPSession); !ok {
+		t.Error("expected a proof of possession session after resuming")
+	}
+	if resumed := connection.requests[len(connection.requests)-1]; resumed.AuthId != "auth-2" {
+		t.Errorf("expected the suspended authentication to be resumed; got %+v", resumed)
+	}
+}
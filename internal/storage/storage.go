@@ -0,0 +1,83 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package storage locates and protects the files that the SDK and the Thing Gateway keep on the host, such as keys,
+// client credentials and audit logs, on Linux, macOS and Windows.
+//
+// Files that hold secrets are only accessible to the current user. On Unix systems this is achieved with the file
+// mode 0600, which Windows ignores, so on Windows the file is given a protected access control list that only grants
+// access to the current user instead of inheriting the access control list of its directory.
+package storage
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// appDir is the directory below the user configuration directory in which the applications store their files
+const appDir = "iot-edge"
+
+// DefaultDir returns the per-user directory in which the application stores its files:
+//    Linux    $XDG_CONFIG_HOME/iot-edge/{app}, or ~/.config/iot-edge/{app}
+//    macOS    ~/Library/Application Support/iot-edge/{app}
+//    Windows  %AppData%\iot-edge\{app}
+func DefaultDir(app string) (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, appDir, app), nil
+}
+
+// Resolve returns the name joined to the directory if the name is a relative path. Absolute names, empty names and
+// names relative to an empty directory are returned unchanged.
+func Resolve(dir, name string) string {
+	if dir == "" || name == "" || filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(dir, name)
+}
+
+// WritePrivateFile writes the data to a file that only the current user can access, creating the directory of the
+// file if it does not exist
+func WritePrivateFile(name string, data []byte) error {
+	f, err := OpenPrivateFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// OpenPrivateFile opens a file with the given flags, see os.OpenFile, and restricts access to the file to the current
+// user. The directory of the file is created if it does not exist.
+func OpenPrivateFile(name string, flag int) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(name, flag, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err = RestrictToOwner(name); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	dir := filepath.Join("data", "gateway")
+	abs, err := filepath.Abs("key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		dir      string
+		file     string
+		expected string
+	}{
+		{name: "relative", dir: dir, file: "key.pem", expected: filepath.Join(dir, "key.pem")},
+		{name: "absolute", dir: dir, file: abs, expected: abs},
+		{name: "empty-file", dir: dir, file: "", expected: ""},
+		{name: "empty-dir", dir: "", file: "key.pem", expected: "key.pem"},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			if got := Resolve(subtest.dir, subtest.file); got != subtest.expected {
+				t.Errorf("expected %s, got %s", subtest.expected, got)
+			}
+		})
+	}
+}
+
+func TestWritePrivateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "client", "oauth2.json")
+	if err = WritePrivateFile(name, []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "secret" {
+		t.Errorf("unexpected content %s", b)
+	}
+	if runtime.GOOS == "windows" {
+		return
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600, got %v", info.Mode().Perm())
+	}
+}
+
+func TestRestrictToOwner(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes are not used on Windows")
+	}
+	f, err := ioutil.TempFile("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	if err = os.Chmod(f.Name(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = RestrictToOwner(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600, got %v", info.Mode().Perm())
+	}
+}
@@ -0,0 +1,222 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package thing
+
+import (
+	"path"
+	"strings"
+
+	"github.com/JacoJooste/iot-edge/v7/pkg/thing"
+)
+
+// Attribute selection design
+// Attributes are selected with paths in which nested fields are separated by '/', as in the _fields query of AM, and
+// a segment may contain the wildcards supported by path.Match, for example "location/*" or "sensor-*". AM only
+// filters on literal field names so a wildcard selector is expanded with the attribute schema of the thing before it
+// is sent to AM. Without a schema, the literal part of the selector in front of the first wildcard is sent instead,
+// or no filter at all if the selector starts with a wildcard, and the response is filtered by the SDK.
+// AM ignores unknown fields in the filter, which makes a misspelt attribute look like an empty one. When the thing
+// has a schema, selectors that do not match any attribute in the schema are rejected before a request is made.
+
+// idAttribute is always returned by AM and is never filtered out
+const idAttribute = "_id"
+
+// attributeSelection contains the requested selectors and the fields that are sent to AM
+type attributeSelection struct {
+	selectors []string
+	// fields is nil if all the attributes must be requested from AM
+	fields []string
+}
+
+// hasWildcard returns true if the pattern contains a wildcard
+func hasWildcard(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
+
+// validSelector returns true if the selector is a well formed path pattern without empty segments
+func validSelector(selector string) bool {
+	if _, err := path.Match(selector, ""); err != nil {
+		return false
+	}
+	for _, segment := range strings.Split(selector, "/") {
+		if segment == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// schemaPaths returns the paths of the attributes in the schema and of all the objects that contain them
+func schemaPaths(schema []string) []string {
+	var paths []string
+	for _, field := range schema {
+		segments := strings.Split(field, "/")
+		for i := range segments {
+			paths = append(paths, strings.Join(segments[:i+1], "/"))
+		}
+	}
+	return paths
+}
+
+// matches returns true if the selector selects the schema path or if the schema path, which may contain wildcards for
+// fields with dynamic names, describes the selected field
+func matches(selector, schemaPath string) bool {
+	if ok, _ := path.Match(selector, schemaPath); ok {
+		return true
+	}
+	ok, _ := path.Match(schemaPath, selector)
+	return ok
+}
+
+// literalPrefix returns the segments of the selector in front of the first segment with a wildcard
+func literalPrefix(selector string) string {
+	segments := strings.Split(selector, "/")
+	for i, segment := range segments {
+		if hasWildcard(segment) {
+			return strings.Join(segments[:i], "/")
+		}
+	}
+	return selector
+}
+
+// checkAttributeSchema returns an error if a field in the schema is malformed
+func checkAttributeSchema(schema []string) error {
+	var err thing.AttributeError
+	for _, field := range schema {
+		if !validSelector(field) {
+			err.Invalid = append(err.Invalid, field)
+		}
+	}
+	if len(err.Invalid) > 0 {
+		return err
+	}
+	return nil
+}
+
+// selectAttributes validates the selectors against the schema and determines the fields to request from AM.
+// All the attributes are selected if no selectors are given.
+func selectAttributes(schema []string, selectors []string) (selection attributeSelection, err error) {
+	selection.selectors = selectors
+	if len(selectors) == 0 {
+		return selection, nil
+	}
+	var paths []string
+	if len(schema) > 0 {
+		paths = schemaPaths(schema)
+	}
+	var attributeErr thing.AttributeError
+	seen := make(map[string]bool)
+	add := func(field string) {
+		if !seen[field] {
+			seen[field] = true
+			selection.fields = append(selection.fields, field)
+		}
+	}
+	all := false
+	for _, selector := range selectors {
+		if !validSelector(selector) {
+			attributeErr.Invalid = append(attributeErr.Invalid, selector)
+			continue
+		}
+		if !hasWildcard(selector) {
+			if !known(paths, selector) {
+				attributeErr.Unknown = append(attributeErr.Unknown, selector)
+			}
+			add(selector)
+			continue
+		}
+		if paths != nil && !known(paths, selector) {
+			attributeErr.Unknown = append(attributeErr.Unknown, selector)
+			continue
+		}
+		expanded := false
+		for _, p := range paths {
+			if ok, _ := path.Match(selector, p); ok && !hasWildcard(p) {
+				add(p)
+				expanded = true
+			}
+		}
+		if expanded {
+			continue
+		}
+		if prefix := literalPrefix(selector); prefix != "" {
+			add(prefix)
+		} else {
+			all = true
+		}
+	}
+	if len(attributeErr.Unknown) > 0 || len(attributeErr.Invalid) > 0 {
+		return attributeSelection{}, attributeErr
+	}
+	if all {
+		selection.fields = nil
+	}
+	return selection, nil
+}
+
+// known returns true if the selector matches one of the schema paths or if there is no schema
+func known(paths []string, selector string) bool {
+	if paths == nil {
+		return true
+	}
+	for _, p := range paths {
+		if matches(selector, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// filter returns the attributes in the content that are selected
+func (s attributeSelection) filter(content thing.JSONContent) thing.JSONContent {
+	if len(s.selectors) == 0 || content == nil {
+		return content
+	}
+	selected := make(thing.JSONContent)
+	if id, ok := content[idAttribute]; ok {
+		selected[idAttribute] = id
+	}
+	for _, selector := range s.selectors {
+		selectFields(selected, content, strings.Split(selector, "/"))
+	}
+	return selected
+}
+
+// selectFields copies the fields in src that match the segments of a selector to dst
+func selectFields(dst, src map[string]interface{}, segments []string) {
+	for name, value := range src {
+		if ok, _ := path.Match(segments[0], name); !ok {
+			continue
+		}
+		if len(segments) == 1 {
+			dst[name] = value
+			continue
+		}
+		nested, ok := value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		into, ok := dst[name].(map[string]interface{})
+		if !ok {
+			into = make(map[string]interface{})
+		}
+		selectFields(into, nested, segments[1:])
+		if len(into) > 0 {
+			dst[name] = into
+		}
+	}
+}
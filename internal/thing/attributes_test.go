@@ -0,0 +1,169 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package thing
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/JacoJooste/iot-edge/v7/pkg/thing"
+)
+
+func TestSelectAttributes(t *testing.T) {
+	schema := []string{"colour", "location/building", "location/floor", "sensors/*"}
+	tests := []struct {
+		name      string
+		schema    []string
+		selectors []string
+		fields    []string
+		unknown   []string
+		invalid   []string
+	}{
+		{name: "all", schema: schema},
+		{name: "literal", schema: schema, selectors: []string{"colour", "location/floor"},
+			fields: []string{"colour", "location/floor"}},
+		{name: "object", schema: schema, selectors: []string{"location"}, fields: []string{"location"}},
+		{name: "wildcard", schema: schema, selectors: []string{"location/*"},
+			fields: []string{"location/building", "location/floor"}},
+		{name: "top-level-wildcard", schema: schema, selectors: []string{"*"},
+			fields: []string{"colour", "location", "sensors"}},
+		{name: "dynamic-field", schema: schema, selectors: []string{"sensors/temperature"},
+			fields: []string{"sensors/temperature"}},
+		{name: "dynamic-wildcard", schema: schema, selectors: []string{"sensors/temp*"}, fields: []string{"sensors"}},
+		{name: "unknown", schema: schema, selectors: []string{"color", "location/room", "colour"},
+			unknown: []string{"color", "location/room"}},
+		{name: "unknown-wildcard", schema: schema, selectors: []string{"size*"}, unknown: []string{"size*"}},
+		{name: "invalid", schema: schema, selectors: []string{"location//floor", "[colour"},
+			invalid: []string{"location//floor", "[colour"}},
+		{name: "no-schema", selectors: []string{"color", "location/*/name"}, fields: []string{"color", "location"}},
+		{name: "no-schema-wildcard", selectors: []string{"colour", "*"}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			selection, err := selectAttributes(subtest.schema, subtest.selectors)
+			if subtest.unknown != nil || subtest.invalid != nil {
+				var attributeErr thing.AttributeError
+				if !errors.As(err, &attributeErr) || !errors.Is(err, thing.ErrPayloadInvalid) {
+					t.Fatalf("expected an attribute error; got %v", err)
+				}
+				if !reflect.DeepEqual(attributeErr.Unknown, subtest.unknown) ||
+					!reflect.DeepEqual(attributeErr.Invalid, subtest.invalid) {
+					t.Errorf("expected unknown %v and invalid %v; got %v", subtest.unknown, subtest.invalid, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(selection.fields, subtest.fields) {
+				t.Errorf("expected fields %v; got %v", subtest.fields, selection.fields)
+			}
+		})
+	}
+}
+
+func TestAttributeSelection_Filter(t *testing.T) {
+	content := thing.JSONContent{
+		"_id":    "thing-1",
+		"colour": []interface{}{"blue"},
+		"size":   []interface{}{"large"},
+		"location": map[string]interface{}{
+			"building": "north",
+			"floor":    "2",
+		},
+		"sensors": map[string]interface{}{
+			"temperature": map[string]interface{}{"unit": "C", "value": 21.0},
+			"humidity":    map[string]interface{}{"unit": "%", "value": 40.0},
+		},
+	}
+	tests := []struct {
+		name      string
+		selectors []string
+		expected  thing.JSONContent
+	}{
+		{name: "all", expected: content},
+		{name: "literal", selectors: []string{"colour"},
+			expected: thing.JSONContent{"_id": "thing-1", "colour": []interface{}{"blue"}}},
+		{name: "nested", selectors: []string{"location/floor"},
+			expected: thing.JSONContent{"_id": "thing-1", "location": map[string]interface{}{"floor": "2"}}},
+		{name: "wildcard", selectors: []string{"sensors/*/unit", "location/building"},
+			expected: thing.JSONContent{"_id": "thing-1",
+				"location": map[string]interface{}{"building": "north"},
+				"sensors": map[string]interface{}{
+					"temperature": map[string]interface{}{"unit": "C"},
+					"humidity":    map[string]interface{}{"unit": "%"},
+				}}},
+		{name: "missing", selectors: []string{"weight", "location/room"},
+			expected: thing.JSONContent{"_id": "thing-1"}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			filtered := attributeSelection{selectors: subtest.selectors}.filter(content)
+			if !reflect.DeepEqual(filtered, subtest.expected) {
+				t.Errorf("expected %v; got %v", subtest.expected, filtered)
+			}
+		})
+	}
+}
+
+// attributesConnection returns all the attributes at once, like a connection to AM
+type attributesConnection struct {
+	childConnection
+	requests int
+}
+
+func (m *attributesConnection) Attributes(string, client.ContentType, string, []string) ([]byte, error) {
+	m.requests++
+	return []byte(`{"_id":"thingOne","colour":["red"],"size":["large"]}`), nil
+}
+
+func TestDefaultThing_IterateAttributes_SinglePage(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	connection := &attributesConnection{}
+	device, err := (&BaseBuilder{}).
+		WithConnection(connection).
+		AuthenticateThing("thingOne", "/", "kid", key, nil).
+		Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = device.IterateAttributes(0, nil); err == nil {
+		t.Error("expected an error for an invalid page size")
+	}
+
+	var pages []thing.AttributesResponse
+	err = device.IterateAttributes(1, func(page thing.AttributesResponse) error {
+		pages = append(pages, page)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != 1 || len(pages[0].Content) != 3 || connection.requests != 1 {
+		t.Errorf("expected all the attributes in a single page; got %v", pages)
+	}
+
+	stop := errors.New("stop")
+	if err = device.IterateAttributes(1, func(thing.AttributesResponse) error { return stop }); err != stop {
+		t.Errorf("expected the error of the visit function; got %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package thing
+
+import (
+	"errors"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/JacoJooste/iot-edge/v7/internal/jws"
+	"github.com/JacoJooste/iot-edge/v7/pkg/callback"
+	"github.com/JacoJooste/iot-edge/v7/pkg/thing"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// Child access tokens
+// A thing that acts for other things, such as a gateway for the devices that it proxies, can request access tokens
+// whose subject is one of its children. The request is made with the session of the parent and carries an identity
+// assertion for the child, a short-lived JWT signed with the key of the parent in which the parent is the issuer and
+// the child the subject. It is sent as the subject token of an OAuth 2.0 token exchange (rfc8693), which AM must be
+// configured to honour, for example with an access token modification script that checks that the parent may act
+// for the child.
+
+// childAssertionLifetime is the time for which a child identity assertion is valid
+const childAssertionLifetime = 5 * time.Minute
+
+// childAssertionType is the token type of a child identity assertion
+const childAssertionType = "urn:ietf:params:oauth:token-type:jwt"
+
+var errNoAssertionKey = errors.New("asserting the identity of another thing requires a thing authenticated with a key")
+
+// authenticateHandler returns the handler used to authenticate the thing with its key
+func (t *DefaultThing) authenticateHandler() (callback.AuthenticateHandler, bool) {
+	for _, h := range t.handlers {
+		if auth, ok := h.(callback.AuthenticateHandler); ok {
+			return auth, true
+		}
+	}
+	return callback.AuthenticateHandler{}, false
+}
+
+// identityAssertion creates an identity assertion for the child with the given ID, signed with the key of the thing
+func (t *DefaultThing) identityAssertion(subject string, audience string) (string, error) {
+	auth, ok := t.authenticateHandler()
+	if !ok || auth.Key == nil {
+		return "", errNoAssertionKey
+	}
+	opts := &jose.SignerOptions{}
+	opts.WithHeader("typ", "JWT")
+	opts.WithHeader("kid", auth.KeyID)
+	sig, err := jws.NewSigner(auth.Key, opts)
+	if err != nil {
+		return "", err
+	}
+	now := t.clock.Now()
+	return jwt.Signed(sig).Claims(jwt.Claims{
+		Issuer:   auth.ThingID,
+		Subject:  subject,
+		Audience: jwt.Audience{audience},
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(childAssertionLifetime)),
+		ID:       client.NewTransactionID(),
+	}).CompactSerialize()
+}
+
+func (t *DefaultThing) RequestChildAccessToken(childID string, scopes ...string) (response thing.AccessTokenResponse,
+	err error) {
+	if childID == "" {
+		return response, errors.New("a child thing ID is required")
+	}
+	info, err := t.connection.AMInfo()
+	if err != nil {
+		return response, err
+	}
+	assertion, err := t.identityAssertion(childID, info.AccessTokenURL)
+	if err != nil {
+		return response, err
+	}
+	return t.requestAccessToken("", client.GetAccessTokenPayload{
+		Scope:            scopes,
+		SubjectToken:     assertion,
+		SubjectTokenType: childAssertionType,
+	})
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package thing
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// childConnection authenticates the thing without callbacks and records the access token requests
+type childConnection struct {
+	client.Connection
+	payloads []client.GetAccessTokenPayload
+}
+
+func (m *childConnection) Authenticate(client.AuthenticatePayload) (reply client.AuthenticatePayload, err error) {
+	reply.TokenID = "parentToken"
+	return reply, nil
+}
+
+func (m *childConnection) AMInfo() (info client.AMInfoResponse, err error) {
+	return client.AMInfoResponse{AccessTokenURL: "https://am.example.com/things", ThingsVersion: "1"}, nil
+}
+
+func (m *childConnection) AccessToken(tokenID string, _ client.ContentType, payload string) ([]byte, error) {
+	var request client.GetAccessTokenPayload
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return nil, err
+	}
+	m.payloads = append(m.payloads, request)
+	return []byte(`{"access_token":"childAccessToken"}`), nil
+}
+
+func TestDefaultThing_RequestChildAccessToken(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	connection := &childConnection{}
+	gateway, err := (&BaseBuilder{}).
+		WithConnection(connection).
+		AuthenticateThing("gateway", "/", "gateway-kid", key, nil).
+		Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := gateway.RequestChildAccessToken("sensor-1", "publish")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token, _ := response.AccessToken(); token != "childAccessToken" {
+		t.Errorf("unexpected access token %s", token)
+	}
+	if len(connection.payloads) != 1 {
+		t.Fatalf("expected a single access token request; got %d", len(connection.payloads))
+	}
+	request := connection.payloads[0]
+	if len(request.Scope) != 1 || request.Scope[0] != "publish" || request.SubjectTokenType != childAssertionType {
+		t.Errorf("unexpected request %+v", request)
+	}
+
+	assertion, err := jwt.ParseSigned(request.SubjectToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid := assertion.Headers[0].KeyID; kid != "gateway-kid" {
+		t.Errorf("expected the key ID of the gateway; got %s", kid)
+	}
+	var claims jwt.Claims
+	if err = assertion.Claims(key.Public(), &claims); err != nil {
+		t.Fatal(err)
+	}
+	err = claims.Validate(jwt.Expected{
+		Issuer:   "gateway",
+		Subject:  "sensor-1",
+		Audience: jwt.Audience{"https://am.example.com/things"},
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if _, err = gateway.RequestChildAccessToken(""); err == nil {
+		t.Error("expected an error without a child ID")
+	}
+}
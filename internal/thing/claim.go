@@ -0,0 +1,125 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package thing
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/pkg/thing"
+)
+
+// Claiming things
+// A consumer device is paired with the account of its user by a claim, in the manner of the OAuth 2.0 device
+// authorization grant (RFC 8628). The thing starts a claim at the AM things endpoint, which returns a short-lived claim
+// code and the URI at which the user approves the claim, for example with an AM journey that binds the thing to the
+// account of the user. The thing shows the code to the user and polls the status of the claim until the user approves
+// or rejects it, or the code expires. Once the claim is approved, the thing stores the ID of its owner in its owner
+// attribute so that policies and applications can find the things of a user.
+
+// actions of the AM things endpoint used to claim a thing
+const (
+	claimAction       = "claim"
+	claimStatusAction = "claim_status"
+	updateAction      = "update"
+)
+
+// statuses of a claim returned by the AM things endpoint
+const (
+	claimPending  = "pending"
+	claimSlowDown = "slow_down"
+	claimClaimed  = "claimed"
+	claimDenied   = "denied"
+	claimExpired  = "expired"
+)
+
+// claimSlowDownIncrement is added to the polling interval each time AM asks the thing to slow down
+const claimSlowDownIncrement = 5 * time.Second
+
+// thingsActionPath returns the path of the action of the AM things endpoint, relative to the AM URL
+func thingsActionPath(realm, action string) string {
+	p := "/json/things/*?_action=" + action
+	if realm != "" {
+		p += "&realm=" + realm
+	}
+	return p
+}
+
+func (t *DefaultThing) Claim(display func(claim thing.ClaimResponse) error) (owner string, err error) {
+	info, err := t.connection.AMInfo()
+	if err != nil {
+		return "", err
+	}
+	reply, err := t.SignedRequest(http.MethodPost, thingsActionPath(info.Realm, claimAction), nil)
+	if err != nil {
+		return "", err
+	}
+	var claim thing.ClaimResponse
+	if err = json.Unmarshal(reply, &claim.Content); err != nil {
+		return "", fmt.Errorf("%w: %s", thing.ErrPayloadInvalid, err)
+	}
+	code, err := claim.Code()
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", thing.ErrPayloadInvalid, err)
+	}
+	var expiry time.Time
+	if expiresIn, err := claim.ExpiresIn(); err == nil {
+		expiry = time.Now().Add(time.Duration(expiresIn * float64(time.Second)))
+	}
+	if err = display(claim); err != nil {
+		return "", err
+	}
+
+	interval := claim.Interval()
+	for {
+		time.Sleep(interval)
+		if !expiry.IsZero() && time.Now().After(expiry) {
+			return "", thing.ErrClaimExpired
+		}
+		reply, err = t.SignedRequest(http.MethodPost, thingsActionPath(info.Realm, claimStatusAction),
+			map[string]interface{}{"claim_code": code})
+		if err != nil {
+			return "", err
+		}
+		var status thing.JSONContent
+		if err = json.Unmarshal(reply, &status); err != nil {
+			return "", fmt.Errorf("%w: %s", thing.ErrPayloadInvalid, err)
+		}
+		s, _ := status.GetString("status")
+		switch s {
+		case claimPending:
+		case claimSlowDown:
+			interval += claimSlowDownIncrement
+		case claimClaimed:
+			if owner, err = status.GetString("owner"); err != nil {
+				return "", fmt.Errorf("%w: %s", thing.ErrPayloadInvalid, err)
+			}
+			t.log.Infof("Thing claimed by %s", owner)
+			_, err = t.SignedRequest(http.MethodPut, thingsActionPath(info.Realm, updateAction),
+				map[string]interface{}{thing.OwnerAttribute: owner})
+			return owner, err
+		case claimDenied:
+			return "", thing.ErrClaimDenied
+		case claimExpired:
+			return "", thing.ErrClaimExpired
+		default:
+			return "", fmt.Errorf("%w: unknown claim status `%s`", thing.ErrPayloadInvalid, s)
+		}
+	}
+}
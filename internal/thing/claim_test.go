@@ -0,0 +1,131 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package thing
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/JacoJooste/iot-edge/v7/pkg/thing"
+)
+
+// claimConnection starts a claim and replies to polls of its status with the statuses in turn
+type claimConnection struct {
+	childConnection
+	statuses []string
+	requests []string
+	payloads []string
+}
+
+func (m *claimConnection) SignedRequest(_ string, method string, path string, _ client.ContentType,
+	payload string) ([]byte, error) {
+	m.requests = append(m.requests, method+" "+path)
+	m.payloads = append(m.payloads, payload)
+	switch {
+	case strings.Contains(path, "_action=claim_status"):
+		status := m.statuses[0]
+		m.statuses = m.statuses[1:]
+		return []byte(status), nil
+	case strings.Contains(path, "_action=claim"):
+		return []byte(`{"claim_code":"WDJB-MJHT","verification_uri":"https://am.example.com/claim","expires_in":600,
+			"interval":0.001}`), nil
+	}
+	return []byte(`{}`), nil
+}
+
+func TestDefaultThing_Claim(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []string
+		owner    string
+		err      error
+	}{
+		{name: "claimed", statuses: []string{`{"status":"pending"}`, `{"status":"claimed","owner":"bjensen"}`},
+			owner: "bjensen"},
+		{name: "denied", statuses: []string{`{"status":"pending"}`, `{"status":"denied"}`},
+			err: thing.ErrClaimDenied},
+		{name: "expired", statuses: []string{`{"status":"expired"}`}, err: thing.ErrClaimExpired},
+		{name: "unknown-status", statuses: []string{`{"status":"lost"}`}, err: thing.ErrPayloadInvalid},
+		{name: "no-owner", statuses: []string{`{"status":"claimed"}`}, err: thing.ErrPayloadInvalid},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			connection := &claimConnection{statuses: subtest.statuses}
+			device, err := (&BaseBuilder{}).
+				WithConnection(connection).
+				AuthenticateThing("speaker-1", "/", "kid", key, nil).
+				Create()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var code string
+			owner, err := device.Claim(func(claim thing.ClaimResponse) error {
+				code, _ = claim.Code()
+				return nil
+			})
+			if !errors.Is(err, subtest.err) || (subtest.err == nil && err != nil) {
+				t.Fatalf("expected error %v; got %v", subtest.err, err)
+			}
+			if code != "WDJB-MJHT" {
+				t.Errorf("expected the claim code to be displayed; got %s", code)
+			}
+			if owner != subtest.owner {
+				t.Errorf("expected owner %s; got %s", subtest.owner, owner)
+			}
+			last := len(connection.requests) - 1
+			updated := connection.requests[last] == http.MethodPut+" /json/things/*?_action=update"
+			if updated != (subtest.owner != "") {
+				t.Errorf("unexpected requests %v", connection.requests)
+			}
+			if updated && connection.payloads[last] != `{"thingOwner":"bjensen"}` {
+				t.Errorf("unexpected attribute update %s", connection.payloads[last])
+			}
+		})
+	}
+}
+
+func TestDefaultThing_Claim_DisplayError(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	connection := &claimConnection{}
+	device, err := (&BaseBuilder{}).
+		WithConnection(connection).
+		AuthenticateThing("speaker-1", "/", "kid", key, nil).
+		Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	displayErr := errors.New("no display")
+	if _, err = device.Claim(func(thing.ClaimResponse) error { return displayErr }); err != displayErr {
+		t.Errorf("expected the display error; got %v", err)
+	}
+	if len(connection.requests) != 1 {
+		t.Errorf("expected no polls after the display failed; got %v", connection.requests)
+	}
+}
+
+func TestThingsActionPath(t *testing.T) {
+	if p := thingsActionPath("/alfheim", claimAction); p != "/json/things/*?_action=claim&realm=/alfheim" {
+		t.Errorf("unexpected path %s", p)
+	}
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package thing
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/JacoJooste/iot-edge/v7/pkg/thing"
+)
+
+// Thing groups
+// Things are added to AM groups when they are registered, see InGroups, so that policies and OAuth 2.0 scripts can be
+// written for a fleet of things instead of for every thing. A thing can request an access token for one of its groups,
+// which AM must be configured to issue with the group claims after checking that the thing is a member, and can read
+// the attributes that are shared by the group from the AM groups endpoint.
+
+var errNoGroup = errors.New("a group ID is required")
+
+// groupPath returns the path of the AM endpoint of the group, relative to the AM URL
+func groupPath(realm, group string, names []string) string {
+	return identityPath(realm, "groups", group, names)
+}
+
+// identityPath returns the path of the AM endpoint of the identity in the collection, such as "groups" or "users",
+// relative to the AM URL
+func identityPath(realm, collection, id string, names []string) string {
+	q := make([]string, 0)
+	if realm != "" {
+		q = append(q, "realm="+realm)
+	}
+	if len(names) > 0 {
+		q = append(q, "_fields="+strings.Join(names, ","))
+	}
+	p := "/json/" + collection + "/" + url.PathEscape(id)
+	if len(q) == 0 {
+		return p
+	}
+	return p + "?" + strings.Join(q, "&")
+}
+
+func (t *DefaultThing) RequestGroupAccessToken(group string, scopes ...string) (response thing.AccessTokenResponse,
+	err error) {
+	if group == "" {
+		return response, errNoGroup
+	}
+	return t.requestAccessToken("", client.GetAccessTokenPayload{Scope: scopes, Group: group})
+}
+
+func (t *DefaultThing) RequestGroupAttributes(group string, names ...string) (response thing.AttributesResponse,
+	err error) {
+	if group == "" {
+		return response, errNoGroup
+	}
+	info, err := t.connection.AMInfo()
+	if err != nil {
+		return response, err
+	}
+	reply, err := t.SignedRequest(http.MethodGet, groupPath(info.Realm, group, names), nil)
+	if err != nil {
+		return response, err
+	}
+	err = json.Unmarshal(reply, &response.Content)
+	return response, err
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package thing
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"testing"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+)
+
+func TestGroupPath(t *testing.T) {
+	tests := []struct {
+		name     string
+		realm    string
+		group    string
+		names    []string
+		expected string
+	}{
+		{name: "root", group: "pumps", expected: "/json/groups/pumps"},
+		{name: "realm", realm: "/alfheim", group: "pumps", expected: "/json/groups/pumps?realm=/alfheim"},
+		{name: "fields", realm: "/alfheim", group: "north site", names: []string{"firmware", "interval"},
+			expected: "/json/groups/north%20site?realm=/alfheim&_fields=firmware,interval"},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			if p := groupPath(subtest.realm, subtest.group, subtest.names); p != subtest.expected {
+				t.Errorf("expected %s; got %s", subtest.expected, p)
+			}
+		})
+	}
+}
+
+// groupConnection serves the attributes of a group in addition to the requests served by childConnection
+type groupConnection struct {
+	childConnection
+	method, path string
+}
+
+func (m *groupConnection) SignedRequest(_ string, method string, path string, _ client.ContentType,
+	_ string) ([]byte, error) {
+	m.method, m.path = method, path
+	return []byte(`{"_id":"pumps","firmware":["2.1"]}`), nil
+}
+
+func TestDefaultThing_Groups(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	connection := &groupConnection{}
+	device, err := (&BaseBuilder{}).
+		WithConnection(connection).
+		AuthenticateThing("pump-1", "/", "kid", key, nil).
+		InGroups("pumps").
+		Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = device.RequestGroupAccessToken("pumps", "publish"); err != nil {
+		t.Fatal(err)
+	}
+	if len(connection.payloads) != 1 || connection.payloads[0].Group != "pumps" {
+		t.Errorf("expected a token request for the group; got %+v", connection.payloads)
+	}
+
+	attributes, err := device.RequestGroupAttributes("pumps", "firmware")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connection.method != http.MethodGet || connection.path != "/json/groups/pumps?_fields=firmware" {
+		t.Errorf("unexpected request %s %s", connection.method, connection.path)
+	}
+	if firmware, _ := attributes.GetFirst("firmware"); firmware != "2.1" {
+		t.Errorf("unexpected group attributes %v", attributes.Content)
+	}
+
+	if _, err = device.RequestGroupAccessToken(""); err == nil {
+		t.Error("expected an error without a group")
+	}
+	if _, err = device.RequestGroupAttributes(""); err == nil {
+		t.Error("expected an error without a group")
+	}
+}
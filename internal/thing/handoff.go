@@ -0,0 +1,66 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package thing
+
+import (
+	"errors"
+	"net/url"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	isession "github.com/JacoJooste/iot-edge/v7/internal/session"
+)
+
+// Session handoff
+// A mobile thing may move between a network path to the Thing Gateway and a direct path to AM. The sessions that the
+// gateway creates for things are AM sessions, so a thing does not have to authenticate again when it moves, as long as
+// the server on the new path accepts the session. The session is checked with a validation request over the new
+// connection. Sessions that the gateway created offline are unknown to AM and are replaced by a new session. The
+// restriction of a proof of possession session to the confirmation key of the thing does not depend on the path, since
+// every request is signed by the thing for the URL of the server on the path. An OSCORE context is bound to a gateway
+// and is established again when the thing moves to a gateway.
+
+var errHandoffUnsupported = errors.New("a handoff requires a thing whose connection was created by the builder")
+
+func (t *DefaultThing) Handoff(u *url.URL) error {
+	if t.connect == nil {
+		return errHandoffUnsupported
+	}
+	connection, err := t.connect(u)
+	if err != nil {
+		return err
+	}
+	previousConnection, previousSession := t.connection, t.session
+	t.connection = connection
+	kept := false
+	if t.session != nil {
+		if kept, err = isession.Transfer(t.session, connection); err != nil {
+			t.log.Infof("Unable to validate the session after the handoff to %s; %s", u, err)
+		}
+	}
+	if !kept {
+		t.beginProgress()
+		if err = t.authenticate(); err != nil {
+			t.connection, t.session = previousConnection, previousSession
+			return err
+		}
+	}
+	t.log.Infof("Handed off to %s, session kept: %v", u, kept)
+	if t.oscore && !client.IsAMScheme(u.Scheme) {
+		return t.protectWithOSCORE()
+	}
+	return nil
+}
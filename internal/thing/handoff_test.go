@@ -0,0 +1,132 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package thing
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"net/url"
+	"testing"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	isession "github.com/JacoJooste/iot-edge/v7/internal/session"
+)
+
+// handoffConnection accepts or rejects the sessions of things and counts their authentications
+type handoffConnection struct {
+	mockConnection
+	accepts         bool
+	unreachable     bool
+	authentications int
+}
+
+func (m *handoffConnection) Authenticate(payload client.AuthenticatePayload) (client.AuthenticatePayload, error) {
+	if m.unreachable {
+		return client.AuthenticatePayload{}, client.ErrAMUnreachable
+	}
+	reply, err := m.mockConnection.Authenticate(payload)
+	if reply.HasSessionToken() {
+		m.authentications++
+	}
+	return reply, err
+}
+
+func (m *handoffConnection) ValidateSession(string) (bool, error) {
+	if m.unreachable {
+		return false, client.ErrAMUnreachable
+	}
+	return m.accepts, nil
+}
+
+func TestDefaultThing_Handoff(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	u, _ := url.Parse("coap://127.0.0.1:5688")
+	tests := []struct {
+		name            string
+		next            *handoffConnection
+		kept            bool
+		authentications int
+		fails           bool
+	}{
+		{name: "session-accepted", next: &handoffConnection{accepts: true}, kept: true},
+		{name: "session-rejected", next: &handoffConnection{}, authentications: 1},
+		{name: "unreachable", next: &handoffConnection{unreachable: true}, fails: true},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			previous := &handoffConnection{}
+			device, err := (&BaseBuilder{}).
+				WithConnection(previous).
+				AuthenticateThing("thing", "/", "kid", key, nil).
+				Create()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defaultThing := device.(*DefaultThing)
+			session := defaultThing.session
+			defaultThing.connect = func(*url.URL) (client.Connection, error) {
+				return subtest.next, nil
+			}
+			err = device.Handoff(u)
+			if subtest.fails {
+				if err == nil {
+					t.Fatal("expected the handoff to fail")
+				}
+				if defaultThing.connection != previous || defaultThing.session != session {
+					t.Error("expected the thing to stay connected to the previous server")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if defaultThing.connection != subtest.next || subtest.next.authentications != subtest.authentications {
+				t.Errorf("expected %d authentications over the new connection; got %d",
+					subtest.authentications, subtest.next.authentications)
+			}
+			if kept := defaultThing.session == session; kept != subtest.kept {
+				t.Errorf("expected the session to be kept: %v", subtest.kept)
+			}
+			if valid, _ := defaultThing.session.Valid(); subtest.kept && !valid {
+				t.Error("expected the session to be validated over the new connection")
+			}
+		})
+	}
+}
+
+func TestDefaultThing_Handoff_GivenConnection(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	device, err := (&BaseBuilder{}).
+		WithConnection(&handoffConnection{}).
+		AuthenticateThing("thing", "/", "kid", key, nil).
+		Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse("https://am.example.com/am")
+	if err = device.Handoff(u); !errors.Is(err, errHandoffUnsupported) {
+		t.Errorf("expected %v; got %v", errHandoffUnsupported, err)
+	}
+}
+
+func TestTransfer_ForeignSession(t *testing.T) {
+	if _, err := isession.Transfer(nil, &handoffConnection{accepts: true}); err == nil {
+		t.Error("expected a session that was not created by the SDK to be rejected")
+	}
+}
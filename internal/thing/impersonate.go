@@ -0,0 +1,107 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package thing
+
+import (
+	"errors"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/JacoJooste/iot-edge/v7/pkg/callback"
+	"github.com/JacoJooste/iot-edge/v7/pkg/thing"
+)
+
+// Impersonation
+// A backend service with a service identity can act on behalf of a thing, for example to read its attributes or to
+// issue it a command, without holding the key of the thing. The key of the service is registered for every thing that
+// the service may impersonate, so that AM decides which things a service can act for. The service authenticates as the
+// thing with its own key and names itself as the actor in the act claim of the JWT (RFC 8693, section 4.1). The
+// session belongs to the thing, so AM authorises the requests as it would for the thing itself. The impersonation
+// script that follows the Authenticate Thing node checks that the actor is a service that owns the key and records the
+// actor in the AM audit log, see "Impersonating things" in docs/develop-a-client-application.md.
+
+var errNotService = errors.New("only a thing created as a service can impersonate another thing")
+
+// actor identifies the service that acts on behalf of the impersonated thing
+type actor struct {
+	Sub string `json:"sub"`
+}
+
+// actorClaims returns the claims that name the service as the actor of an impersonation
+func actorClaims(serviceID string) func() interface{} {
+	return func() interface{} {
+		return struct {
+			Act actor `json:"act"`
+		}{Act: actor{Sub: serviceID}}
+	}
+}
+
+// impersonation performs requests with the session of the impersonated thing
+type impersonation struct {
+	subject string
+	thing   *DefaultThing
+}
+
+func (t *DefaultThing) Impersonate(thingID string) (thing.Impersonation, error) {
+	if thingID == "" {
+		return nil, errors.New("the ID of the impersonated thing is required")
+	}
+	if !t.service {
+		return nil, errNotService
+	}
+	auth, ok := t.authenticateHandler()
+	if !ok || auth.Key == nil {
+		return nil, errNoAssertionKey
+	}
+	subject := &DefaultThing{
+		connection:    client.ShareConnection(t.connection),
+		throttleLimit: t.throttleLimit,
+		keys:          []confirmationKey{{keyID: auth.KeyID, key: auth.Key}},
+		clock:         t.clock,
+		log:           t.log,
+		handlers: []callback.Handler{
+			callback.AuthenticateHandler{
+				Audience: auth.Audience,
+				ThingID:  thingID,
+				KeyID:    auth.KeyID,
+				Key:      auth.Key,
+				Claims:   actorClaims(auth.ThingID),
+				Now:      t.clock.Now,
+			},
+			callback.PollingWaitHandler{},
+		},
+	}
+	if err := subject.authenticate(); err != nil {
+		return nil, err
+	}
+	return &impersonation{subject: thingID, thing: subject}, nil
+}
+
+func (i *impersonation) Subject() string {
+	return i.subject
+}
+
+func (i *impersonation) RequestAttributes(names ...string) (response thing.AttributesResponse, err error) {
+	return i.thing.RequestAttributes(names...)
+}
+
+func (i *impersonation) SignedRequest(method string, path string, body interface{}) (reply []byte, err error) {
+	return i.thing.SignedRequest(method, path, body)
+}
+
+func (i *impersonation) Logout() error {
+	return i.thing.Logout()
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package thing
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/JacoJooste/iot-edge/v7/pkg/callback"
+	"github.com/JacoJooste/iot-edge/v7/pkg/thing"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// testImpersonationServer returns a fake AM that authenticates any thing with a proof of possession JWT and records
+// the JWTs that it receives
+func testImpersonationServer(jwts *[]string) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/json/serverinfo/*", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"cookieName":"iPlanetDirectoryPro"}`))
+	})
+	mux.HandleFunc("/json/authenticate", func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			AuthID    string              `json:"authId"`
+			Callbacks []callback.Callback `json:"callbacks"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if request.AuthID == "" {
+			_, _ = w.Write([]byte(`{"authId":"auth-1","callbacks":[{"type":"HiddenValueCallback",` +
+				`"output":[{"name":"value","value":"challenge"},{"name":"id","value":"jwt-pop-authentication"}],` +
+				`"input":[{"name":"IDToken1","value":"jwt-pop-authentication"}]}]}`))
+			return
+		}
+		for _, cb := range request.Callbacks {
+			*jwts = append(*jwts, cb.Input[0].Value)
+		}
+		_, _ = w.Write([]byte(`{"tokenId":"token"}`))
+	})
+	return httptest.NewServer(mux)
+}
+
+func testService(t *testing.T, u string, service bool) (thing.Thing, *ecdsa.PrivateKey) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	amURL, err := url.Parse(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connection, err := client.NewConnection().ConnectTo(amURL).WithTree("service-tree").Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	builder := (&BaseBuilder{}).WithConnection(connection)
+	if service {
+		builder = builder.AsService()
+	}
+	device, err := builder.AuthenticateThing("fleet-manager", "/", "key-1", key, nil).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return device, key
+}
+
+func TestDefaultThing_Impersonate(t *testing.T) {
+	var jwts []string
+	server := testImpersonationServer(&jwts)
+	defer server.Close()
+
+	device, _ := testService(t, server.URL, false)
+	if _, err := device.Impersonate("thing-1"); !errors.Is(err, errNotService) {
+		t.Errorf("expected %v; got %v", errNotService, err)
+	}
+	service, _ := testService(t, server.URL, true)
+	if _, err := service.Impersonate(""); err == nil {
+		t.Error("expected an error for an empty thing ID")
+	}
+	impersonation, err := service.Impersonate("thing-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if impersonation.Subject() != "thing-1" {
+		t.Errorf("unexpected subject %s", impersonation.Subject())
+	}
+	// a thing that authenticates without a key can not prove possession of a key for the impersonated thing
+	keyless, err := (&BaseBuilder{}).WithConnection(&childConnection{}).AsService().Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = keyless.Impersonate("thing-1"); !errors.Is(err, errNoAssertionKey) {
+		t.Errorf("expected %v; got %v", errNoAssertionKey, err)
+	}
+}
+
+func TestDefaultThing_Impersonate_ActorClaim(t *testing.T) {
+	var jwts []string
+	server := testImpersonationServer(&jwts)
+	defer server.Close()
+
+	service, key := testService(t, server.URL, true)
+	if _, err := service.Impersonate("thing-1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(jwts) != 2 {
+		t.Fatalf("expected the service and the impersonation to authenticate; got %d JWTs", len(jwts))
+	}
+	token, err := jwt.ParseSigned(jwts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims struct {
+		Sub string `json:"sub"`
+		Act struct {
+			Sub string `json:"sub"`
+		} `json:"act"`
+		CNF struct {
+			KID string `json:"kid"`
+		} `json:"cnf"`
+	}
+	// the impersonation proves possession of the key of the service
+	if err = token.Claims(key.Public(), &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Sub != "thing-1" || claims.Act.Sub != "fleet-manager" || claims.CNF.KID != "key-1" {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+}
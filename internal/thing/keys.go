@@ -0,0 +1,148 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package thing
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"github.com/JacoJooste/iot-edge/v7/pkg/callback"
+	"github.com/JacoJooste/iot-edge/v7/pkg/thing"
+)
+
+// Backup keys
+// A thing that is given backup keys registers them as confirmation keys together with the key provided to
+// AuthenticateThing, see callback.ConfirmationKey. The thing authenticates, and signs its requests, with one key at a
+// time. If the active key fails to sign, for example because its hardware slot has failed, the thing switches to the
+// next key in the order in which they were given and authenticates again. The application can also select a key with
+// UseKey. The handlers of the thing are rewritten with the selected key so that all JWTs are signed with it.
+// A key selector can select a different key for each operation, see thing.KeySelector, in which case the active key
+// only signs for the operations for which the selector does not select a key.
+
+// confirmationKey is a key with which the thing can prove possession
+type confirmationKey struct {
+	keyID string
+	key   crypto.Signer
+	// certificates issued for the key, if any, which are sent during registration
+	certificates []*x509.Certificate
+}
+
+// errUnknownKey indicates that the thing does not have a key with the given ID
+var errUnknownKey = errors.New("unknown confirmation key")
+
+// additionalKeys returns the public keys of all the keys except the selected key
+func additionalKeys(keys []confirmationKey, selected int) []callback.ConfirmationKey {
+	var additional []callback.ConfirmationKey
+	for i, k := range keys {
+		if i != selected {
+			additional = append(additional, callback.ConfirmationKey{KeyID: k.keyID, Key: k.key.Public()})
+		}
+	}
+	return additional
+}
+
+// withKey returns the handler with the keys selected for authentication and registration
+func withKey(h callback.Handler, keys []confirmationKey, authenticate, register int) callback.Handler {
+	switch handler := h.(type) {
+	case callback.AuthenticateHandler:
+		key := keys[authenticate]
+		handler.KeyID, handler.Key = key.keyID, key.key
+		return handler
+	case callback.RegisterHandler:
+		key := keys[register]
+		handler.KeyID, handler.Key, handler.Certificates = key.keyID, key.key, key.certificates
+		handler.AdditionalKeys = additionalKeys(keys, register)
+		return handler
+	case callback.OnboardHandler:
+		key := keys[register]
+		handler.KeyID, handler.Key, handler.Certificates = key.keyID, key.key, key.certificates
+		handler.AdditionalKeys = additionalKeys(keys, register)
+		return handler
+	case registrationHandler:
+		handler.Handler = withKey(handler.Handler, keys, authenticate, register)
+		return handler
+	}
+	return h
+}
+
+// keyIndex returns the index of the key with the given ID
+func keyIndex(keys []confirmationKey, keyID string) (int, bool) {
+	for i, k := range keys {
+		if k.keyID == keyID {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// checkKeySelector checks that the selector only selects keys of the thing
+func checkKeySelector(keys []confirmationKey, selector thing.KeySelector) error {
+	operations := []thing.Operation{thing.OperationAuthenticate, thing.OperationRegister, thing.OperationRequest}
+	for _, operation := range operations {
+		keyID := selector(operation)
+		if _, ok := keyIndex(keys, keyID); keyID != "" && !ok {
+			return fmt.Errorf("%w selected for %s: %s", errUnknownKey, operation, keyID)
+		}
+	}
+	return nil
+}
+
+// operationKey returns the index of the key with which the thing signs for the operation, which is the active key
+// unless the key selector selects a key
+func (t *DefaultThing) operationKey(operation thing.Operation) int {
+	if t.keySelector == nil {
+		return t.activeKey
+	}
+	if i, ok := keyIndex(t.keys, t.keySelector(operation)); ok {
+		return i
+	}
+	return t.activeKey
+}
+
+// selectKey makes the key with the given index the key with which the thing proves possession
+func (t *DefaultThing) selectKey(selected int) {
+	t.activeKey = selected
+	authenticate, register := t.operationKey(thing.OperationAuthenticate), t.operationKey(thing.OperationRegister)
+	for i, h := range t.handlers {
+		t.handlers[i] = withKey(h, t.keys, authenticate, register)
+	}
+}
+
+// failOver selects the next key, returns false if there is no other key
+func (t *DefaultThing) failOver() bool {
+	next := t.activeKey + 1
+	if next >= len(t.keys) {
+		return false
+	}
+	t.log.Infof("Unable to sign with key %s, switching to key %s", t.keys[t.activeKey].keyID, t.keys[next].keyID)
+	t.selectKey(next)
+	return true
+}
+
+func (t *DefaultThing) UseKey(keyID string) error {
+	i, ok := keyIndex(t.keys, keyID)
+	if !ok {
+		return fmt.Errorf("%w: %s", errUnknownKey, keyID)
+	}
+	if i == t.activeKey {
+		return nil
+	}
+	t.selectKey(i)
+	return t.authenticate()
+}
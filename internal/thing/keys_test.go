@@ -0,0 +1,326 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package thing
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"testing"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/JacoJooste/iot-edge/v7/internal/jws"
+	isession "github.com/JacoJooste/iot-edge/v7/internal/session"
+	"github.com/JacoJooste/iot-edge/v7/pkg/thing"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// failingSigner is a key whose hardware has failed
+type failingSigner struct {
+	crypto.Signer
+}
+
+func (failingSigner) Sign(io.Reader, []byte, crypto.SignerOpts) ([]byte, error) {
+	return nil, errors.New("hardware slot failed")
+}
+
+// keysConnection records the registration JWTs sent by the thing
+type keysConnection struct {
+	mockConnection
+	registrations []string
+}
+
+func (m *keysConnection) Authenticate(payload client.AuthenticatePayload) (reply client.AuthenticatePayload, err error) {
+	if len(payload.Callbacks) > 0 {
+		m.registrations = append(m.registrations, payload.Callbacks[0].Input[0].Value)
+	}
+	return m.mockConnection.Authenticate(payload)
+}
+
+// lastRegistration returns the confirmation claims of the last registration
+func (m *keysConnection) lastRegistration(t *testing.T) (kid string, keys []string) {
+	var claims struct {
+		CNF struct {
+			JWK  jose.JSONWebKey    `json:"jwk"`
+			JWKS jose.JSONWebKeySet `json:"jwks"`
+		} `json:"cnf"`
+	}
+	if err := jws.ExtractClaims(m.registrations[len(m.registrations)-1], &claims); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range claims.CNF.JWKS.Keys {
+		if !key.IsPublic() {
+			t.Errorf("private key %s registered", key.KeyID)
+		}
+		keys = append(keys, key.KeyID)
+	}
+	return claims.CNF.JWK.KeyID, keys
+}
+
+func TestDefaultThing_BackupKey(t *testing.T) {
+	primary, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	backup, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tests := []struct {
+		name    string
+		primary crypto.Signer
+		kid     string
+	}{
+		{name: "primary", primary: primary, kid: "primary"},
+		{name: "failed-primary", primary: failingSigner{primary}, kid: "backup"},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			connection := &keysConnection{}
+			builder := &BaseBuilder{}
+			_, err := builder.
+				WithConnection(connection).
+				AuthenticateThing("thing", "/", "primary", subtest.primary, nil).
+				WithBackupKey("backup", backup).
+				RegisterThing(nil, nil).
+				Create()
+			if err != nil {
+				t.Fatal(err)
+			}
+			kid, keys := connection.lastRegistration(t)
+			if kid != subtest.kid {
+				t.Errorf("expected to register with key %s; got %s", subtest.kid, kid)
+			}
+			if len(keys) != 2 || keys[0] != subtest.kid {
+				t.Errorf("expected both keys to be registered; got %v", keys)
+			}
+		})
+	}
+}
+
+func TestDefaultThing_UseKey(t *testing.T) {
+	primary, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	backup, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	connection := &keysConnection{}
+	builder := &BaseBuilder{}
+	device, err := builder.
+		WithConnection(connection).
+		AuthenticateThing("thing", "/", "primary", primary, nil).
+		WithBackupKey("backup", backup).
+		RegisterThing(nil, nil).
+		Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = device.UseKey("backup"); err != nil {
+		t.Fatal(err)
+	}
+	if kid, _ := connection.lastRegistration(t); kid != "backup" {
+		t.Errorf("expected to authenticate with the backup key; got %s", kid)
+	}
+	if auth, _ := device.(*DefaultThing).authenticateHandler(); auth.Key != backup {
+		t.Error("expected requests to be signed with the backup key")
+	}
+	if err = device.UseKey("unknown"); !errors.Is(err, errUnknownKey) {
+		t.Errorf("expected %v; got %v", errUnknownKey, err)
+	}
+}
+
+// rfc7638Thumbprint computes the JWK Thumbprint of an EC P-256 key from the lexicographically ordered required members
+func rfc7638Thumbprint(key *ecdsa.PublicKey) string {
+	coordinate := func(n *big.Int) string {
+		b := n.Bytes()
+		padded := make([]byte, 32)
+		copy(padded[32-len(b):], b)
+		return base64.RawURLEncoding.EncodeToString(padded)
+	}
+	member := fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`, coordinate(key.X), coordinate(key.Y))
+	digest := sha256.Sum256([]byte(member))
+	return base64.URLEncoding.EncodeToString(digest[:])
+}
+
+func TestBaseBuilder_WithThumbprintKeyID(t *testing.T) {
+	primary, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	backup, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	connection := &keysConnection{}
+	builder := &BaseBuilder{}
+	_, err := builder.
+		WithConnection(connection).
+		AuthenticateThing("thing", "/", "", primary, nil).
+		WithBackupKey("", backup).
+		WithThumbprintKeyID().
+		RegisterThing(nil, nil).
+		Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kid, keys := connection.lastRegistration(t)
+	if expected := rfc7638Thumbprint(&primary.PublicKey); kid != expected {
+		t.Errorf("expected the key ID to be the thumbprint %s; got %s", expected, kid)
+	}
+	if len(keys) != 2 || keys[0] != kid || keys[1] != rfc7638Thumbprint(&backup.PublicKey) {
+		t.Errorf("expected the key IDs of both keys to be their thumbprints; got %v", keys)
+	}
+}
+
+func TestBaseBuilder_BackupKey_Invalid(t *testing.T) {
+	primary, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tests := []struct {
+		name  string
+		keyID string
+		key   crypto.Signer
+	}{
+		{name: "missing-key", keyID: "backup"},
+		{name: "missing-key-id", key: primary},
+		{name: "duplicate-key-id", keyID: "primary", key: primary},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			builder := &BaseBuilder{}
+			_, err := builder.
+				WithConnection(&keysConnection{}).
+				AuthenticateThing("thing", "/", "primary", primary, nil).
+				WithBackupKey(subtest.keyID, subtest.key).
+				Create()
+			if err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestBaseBuilder_WithCompressedKey(t *testing.T) {
+	p256Key, _ := thing.GenerateConfirmationKey("ES256")
+	ed448Key, _ := thing.GenerateConfirmationKey(string(thing.Ed448))
+	tests := []struct {
+		name string
+		key  crypto.Signer
+		crv  string
+		// the length of the encoded x member, which holds the compressed point of a P-256 key
+		x int
+	}{
+		{name: "p256", key: p256Key, crv: "P-256", x: 44},
+		{name: "ed448", key: ed448Key, crv: "Ed448", x: 76},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			connection := &keysConnection{}
+			builder := &BaseBuilder{}
+			_, err := builder.
+				WithConnection(connection).
+				AuthenticateThing("thing", "/", "key", subtest.key, nil).
+				WithCompressedKey(true).
+				RegisterThing(nil, nil).
+				Create()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var claims struct {
+				CNF struct {
+					JWK map[string]string `json:"jwk"`
+				} `json:"cnf"`
+			}
+			if err := jws.ExtractClaims(connection.registrations[0], &claims); err != nil {
+				t.Fatal(err)
+			}
+			jwk := claims.CNF.JWK
+			if jwk["crv"] != subtest.crv || jwk["kid"] != "key" || len(jwk["x"]) != subtest.x || jwk["y"] != "" {
+				t.Errorf("unexpected confirmation key %v", jwk)
+			}
+		})
+	}
+}
+
+func TestBaseBuilder_WithConstrainedMode_CompressedKey(t *testing.T) {
+	p256Key, _ := thing.GenerateConfirmationKey("ES256")
+	tests := []struct {
+		name       string
+		configure  func(b thing.Builder) thing.Builder
+		compressed bool
+	}{
+		{name: "default", configure: func(b thing.Builder) thing.Builder { return b }, compressed: true},
+		{name: "disabled", configure: func(b thing.Builder) thing.Builder { return b.WithCompressedKey(false) }},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			connection := &keysConnection{}
+			builder := &BaseBuilder{}
+			_, err := subtest.configure(builder.
+				WithConnection(connection).
+				AuthenticateThing("thing", "/", "key", p256Key, nil).
+				WithConstrainedMode()).
+				RegisterThing(nil, nil).
+				Create()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var claims struct {
+				CNF struct {
+					JWK map[string]string `json:"jwk"`
+				} `json:"cnf"`
+			}
+			if err := jws.ExtractClaims(connection.registrations[0], &claims); err != nil {
+				t.Fatal(err)
+			}
+			if compressed := claims.CNF.JWK["y"] == ""; compressed != subtest.compressed {
+				t.Errorf("expected compressed %v; got key %v", subtest.compressed, claims.CNF.JWK)
+			}
+		})
+	}
+}
+
+func TestDefaultThing_KeySelector(t *testing.T) {
+	ed25519Key, _ := thing.GenerateConfirmationKey(string(jose.EdDSA))
+	p256Key, _ := thing.GenerateConfirmationKey(string(jose.ES256))
+	connection := &keysConnection{}
+	builder := &BaseBuilder{}
+	device, err := builder.
+		WithConnection(connection).
+		AuthenticateThing("thing", "/", "p256", p256Key, nil).
+		WithBackupKey("ed25519", ed25519Key).
+		WithKeySelector(func(operation thing.Operation) string {
+			if operation == thing.OperationRegister {
+				return ""
+			}
+			return "ed25519"
+		}).
+		RegisterThing(nil, nil).
+		Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid, keys := connection.lastRegistration(t); kid != "p256" || len(keys) != 2 {
+		t.Errorf("expected to register both keys with the active key; got %s %v", kid, keys)
+	}
+	if auth, _ := device.(*DefaultThing).authenticateHandler(); auth.KeyID != "ed25519" {
+		t.Errorf("expected to authenticate with the selected key; got %s", auth.KeyID)
+	}
+	session := device.(*DefaultThing).session.(*isession.PoPSession)
+	if session.KeyID() != "ed25519" {
+		t.Errorf("expected requests to be signed with the selected key; got %s", session.KeyID())
+	}
+
+	_, err = (&BaseBuilder{}).
+		WithConnection(&keysConnection{}).
+		AuthenticateThing("thing", "/", "p256", p256Key, nil).
+		WithKeySelector(func(thing.Operation) string { return "unknown" }).
+		Create()
+	if !errors.Is(err, errUnknownKey) {
+		t.Errorf("expected %v; got %v", errUnknownKey, err)
+	}
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package thing
+
+import (
+	"sync"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/pkg/callback"
+	"github.com/JacoJooste/iot-edge/v7/pkg/thing"
+)
+
+// Progress
+// A thing reports the steps of its flows to the OnProgress hook. A flow starts when the thing is created and with
+// every request that the thing makes, and includes the authentications that the request causes when the session of
+// the thing has expired. The attempts of every step are counted per flow.
+
+// progress counts the steps of the current flow of a thing
+type progress struct {
+	mutex    sync.Mutex
+	start    time.Time
+	attempts map[string]int
+}
+
+// beginProgress starts a new flow
+func (t *DefaultThing) beginProgress() {
+	if t.hooks.OnProgress == nil {
+		return
+	}
+	t.progress.mutex.Lock()
+	defer t.progress.mutex.Unlock()
+	t.progress.start = time.Now()
+	t.progress.attempts = make(map[string]int)
+}
+
+// reportProgress reports the step of the current flow to the OnProgress hook
+func (t *DefaultThing) reportProgress(step string) {
+	if t.hooks.OnProgress == nil {
+		return
+	}
+	t.progress.mutex.Lock()
+	if t.progress.attempts == nil {
+		t.progress.start = time.Now()
+		t.progress.attempts = make(map[string]int)
+	}
+	t.progress.attempts[step]++
+	report := thing.Progress{Step: step, Attempt: t.progress.attempts[step], Elapsed: time.Since(t.progress.start)}
+	t.progress.mutex.Unlock()
+	t.hooks.OnProgress(report)
+}
+
+// callbackStep returns the step of the authentication tree round trip that returned the callbacks
+func callbackStep(callbacks []callback.Callback) string {
+	step := thing.StepAuthenticating
+	for _, cb := range callbacks {
+		switch {
+		case cb.Type == callback.TypePollingWaitCallback, cb.Type == callback.TypeSuspendedTextOutputCallback:
+			return thing.StepWaitingForApproval
+		case cb.ID() == "jwt-pop-registration":
+			step = thing.StepRegistering
+		}
+	}
+	return step
+}
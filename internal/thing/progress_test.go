@@ -0,0 +1,92 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package thing
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"fmt"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/JacoJooste/iot-edge/v7/pkg/callback"
+	"github.com/JacoJooste/iot-edge/v7/pkg/thing"
+)
+
+func TestDefaultThing_Progress(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := x509.Certificate{SerialNumber: big.NewInt(1)}
+	certBytes, _ := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	cert, _ := x509.ParseCertificate(certBytes)
+
+	var steps []string
+	device, err := (&BaseBuilder{}).
+		WithConnection(&mockConnection{}).
+		AuthenticateThing("thing", "/", "kid", key, nil).
+		RegisterThing([]*x509.Certificate{cert}, nil).
+		WithHooks(thing.Hooks{
+			OnProgress: func(progress thing.Progress) {
+				if progress.Elapsed < 0 {
+					t.Errorf("negative elapsed time %v", progress.Elapsed)
+				}
+				steps = append(steps, fmt.Sprintf("%s %d", progress.Step, progress.Attempt))
+			},
+		}).
+		Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"registering 1", "authenticated 1"}
+	if !reflect.DeepEqual(steps, expected) {
+		t.Errorf("expected steps %v, got %v", expected, steps)
+	}
+
+	// the first token request is rejected, the thing registers again and repeats the request
+	steps = nil
+	if _, err = device.RequestAccessToken(); err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"requesting_access_token 1", "registering 1", "authenticated 1", "requesting_access_token 2"}
+	if !reflect.DeepEqual(steps, expected) {
+		t.Errorf("expected steps %v, got %v", expected, steps)
+	}
+}
+
+func TestCallbackStep(t *testing.T) {
+	tests := []struct {
+		name      string
+		callbacks []callback.Callback
+		step      string
+	}{
+		{name: "name", callbacks: []callback.Callback{{Type: callback.TypeNameCallback}},
+			step: thing.StepAuthenticating},
+		{name: "registration", callbacks: []callback.Callback{{Type: callback.TypeHiddenValueCallback,
+			Output: []callback.Entry{{Name: "id", Value: "jwt-pop-registration"}}}}, step: thing.StepRegistering},
+		{name: "polling", callbacks: []callback.Callback{{Type: callback.TypePollingWaitCallback}},
+			step: thing.StepWaitingForApproval},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			if step := callbackStep(subtest.callbacks); step != subtest.step {
+				t.Errorf("expected %s; got %s", subtest.step, step)
+			}
+		})
+	}
+}
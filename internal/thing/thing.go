@@ -18,10 +18,14 @@ package thing
 
 import (
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
 	"net/url"
 	"strings"
 	"time"
@@ -38,37 +42,182 @@ import (
 )
 
 type DefaultThing struct {
-	connection client.Connection
-	handlers   []callback.Handler
-	session    session.Session
+	connection    client.Connection
+	handlers      []callback.Handler
+	session       session.Session
+	throttleLimit time.Duration
+	hooks         thing.Hooks
+	registered    bool
+	// attributeSchema is nil if the attributes of the thing are not known
+	attributeSchema []string
+	// keys with which the thing can prove possession, the first key is the key provided to AuthenticateThing
+	keys      []confirmationKey
+	activeKey int
+	// keySelector selects the key for each operation, the active key is used for all operations if nil
+	keySelector thing.KeySelector
+	// clock is synchronised before each authentication, the time of the device is used if nil
+	clock *client.Clock
+	// service is true if the thing has a service identity, see AsService
+	service bool
+	// idempotencyKey identifies the attempts of the first authentication, it is cleared once the thing is authenticated
+	idempotencyKey string
+	// resume is the suspended authentication that the first authentication resumes, it is cleared once the thing is
+	// authenticated
+	resume *callback.SuspendedError
+	// progress of the current flow, reported to the OnProgress hook
+	progress progress
+	// connect creates a connection with the settings of the builder for a handoff, nil if the connection was given
+	connect func(u *url.URL) (client.Connection, error)
+	// oscore is true if requests to the Thing Gateway are protected with OSCORE
+	oscore bool
+	// quiet is true if the responses received by the thing are not written to the debug log, see WithConstrainedMode
+	quiet bool
+	// log writes the debug information of the thing
+	log debug.Log
+}
+
+// trace writes the response to the debug log unless the thing is quiet
+func (t *DefaultThing) trace(name string, reply []byte) {
+	if !t.quiet {
+		t.log.Trace(name+" response: ", string(reply))
+	}
+}
+
+// registrationHandler records that a registration callback was handled during an authentication
+type registrationHandler struct {
+	callback.Handler
+	registered *bool
+}
+
+func (h registrationHandler) Handle(cb callback.Callback) (bool, error) {
+	handled, err := h.Handler.Handle(cb)
+	if handled && err == nil {
+		*h.registered = true
+	}
+	return handled, err
+}
+
+func (h registrationHandler) Unwrap() callback.Handler {
+	return h.Handler
+}
+
+// authenticate the thing with AM, switching to the next key if the active key is unable to sign
+func (t *DefaultThing) authenticate() (err error) {
+	if t.clock != nil {
+		if err := t.clock.Synchronise(t.connection); err != nil {
+			t.log.Infof("Unable to synchronise the clock; %s", err)
+		}
+	}
+	for {
+		err = t.createSession()
+		if err == nil || !errors.Is(err, callback.ErrSigningFailed) || !t.failOver() {
+			return err
+		}
+	}
+}
+
+// createSession authenticates the thing with AM and creates a new session, calling the hooks for the transition
+func (t *DefaultThing) createSession() (err error) {
+	t.registered = false
+	builder := &isession.Builder{}
+	if t.resume != nil {
+		builder.ResumeFrom(*t.resume)
+	}
+	builder.OnCallbacks(func(callbacks []callback.Callback) {
+		t.reportProgress(callbackStep(callbacks))
+	})
+	t.session, err = builder.
+		WithConnection(client.WithIdempotencyKey(t.connection, t.idempotencyKey)).
+		AuthenticateWith(t.handlers...).
+		Create()
+	if err != nil {
+		return err
+	}
+	if popSession, ok := t.session.(*isession.PoPSession); ok && t.keySelector != nil {
+		key := t.keys[t.operationKey(thing.OperationRequest)]
+		popSession.UseSigningKey(key.keyID, key.key)
+	}
+	t.idempotencyKey = ""
+	t.resume = nil
+	t.reportProgress(thing.StepAuthenticated)
+	if t.registered && t.hooks.OnRegistration != nil {
+		t.hooks.OnRegistration()
+	}
+	if t.hooks.OnAuthenticated != nil {
+		t.hooks.OnAuthenticated()
+	}
+	return nil
 }
 
 func (t *DefaultThing) Logout() error {
 	return t.session.Logout()
 }
 
-// makeAuthorisedRequest makes a request that requires a session token
-// if the session has expired, the session is renewed and the request is repeated
-func (t *DefaultThing) makeAuthorisedRequest(f func(session session.Session) error) (err error) {
-	for i := 0; i < 2; i++ {
-		err = f(t.session)
-		if err == nil || !errors.Is(err, client.ErrUnauthorised) {
+func (t *DefaultThing) Liveness() thing.Liveness {
+	return client.ConnectionLiveness(t.connection)
+}
+
+// Budgets of the repeated attempts of an authorised request, which are counted separately for each reason
+const (
+	maxThrottledRetries = 3
+	maxVersionRetries   = 1
+	maxSessionRenewals  = 1
+)
+
+// makeAuthorisedRequest makes a request that requires a session token. The request is repeated if it was throttled,
+// if the version of the things endpoint must be renegotiated or, once the session is renewed, if the session has
+// expired. The request only succeeds if one of the attempts succeeds.
+func (t *DefaultThing) makeAuthorisedRequest(f func(session session.Session) error) error {
+	t.beginProgress()
+	var throttled, versions, renewals int
+	for {
+		err := f(t.session)
+		if err == nil {
+			return nil
+		}
+		if _, ok := client.RetryAfter(err); ok {
+			if throttled == maxThrottledRetries || !t.waitWhenThrottled(err) {
+				return err
+			}
+			throttled++
+			continue
+		}
+		if errors.Is(err, client.ErrUnsupportedVersion) {
+			// repeat the request with the version of the things endpoint that was negotiated with AM
+			if versions == maxVersionRetries {
+				return err
+			}
+			versions++
+			continue
+		}
+		if !errors.Is(err, client.ErrUnauthorised) || renewals == maxSessionRenewals {
 			return err
 		}
 		valid, validateErr := t.session.Valid()
 		if validateErr != nil || valid {
 			return err
 		}
-		builder := &isession.Builder{}
-		t.session, err = builder.
-			WithConnection(t.connection).
-			AuthenticateWith(t.handlers...).
-			Create()
-		if err != nil {
+		if t.hooks.OnSessionExpired != nil {
+			t.hooks.OnSessionExpired()
+		}
+		if err = t.authenticate(); err != nil {
 			return err
 		}
+		renewals++
+	}
+}
+
+// waitWhenThrottled blocks for the delay requested by AM if the request was throttled and the delay is within the
+// configured limit. Returns true if the request should be repeated.
+func (t *DefaultThing) waitWhenThrottled(err error) bool {
+	delay, ok := client.RetryAfter(err)
+	if !ok || delay > t.throttleLimit {
+		return false
 	}
-	return err
+	t.log.Infof("Request throttled by AM, retrying after %v", delay)
+	t.reportProgress(thing.StepThrottled)
+	time.Sleep(delay)
+	return true
 }
 
 // signedRequestClaims defines the claims expected in the signed JWT provided with a signed request
@@ -81,6 +230,9 @@ func signedJWTBody(session *isession.PoPSession, url string, version string, bod
 	opts.WithHeader("aud", url)
 	opts.WithHeader("api", version)
 	opts.WithHeader("nonce", session.Nonce())
+	if keyID := session.KeyID(); keyID != "" {
+		opts.WithHeader("kid", keyID)
+	}
 	// increment the nonce so that the token can be used in a subsequent request
 	session.IncrementNonce()
 
@@ -95,33 +247,92 @@ func signedJWTBody(session *isession.PoPSession, url string, version string, bod
 	return builder.CompactSerialize()
 }
 
+// requestBody returns the body and content type of a request containing the payload.
+// A PoP session requires the payload to be sent in a JWT signed for the endpoint URL selected from the AM info,
+// otherwise the payload is sent as JSON.
+func (t *DefaultThing) requestBody(session session.Session, endpoint func(info client.AMInfoResponse) string,
+	payload interface{}) (requestBody string, content client.ContentType, err error) {
+	if popSession, ok := session.(*isession.PoPSession); ok {
+		info, err := t.connection.AMInfo()
+		if err != nil {
+			return requestBody, content, err
+		}
+		requestBody, err = signedJWTBody(popSession, endpoint(info), info.ThingsVersion, payload)
+		return requestBody, client.ApplicationJOSE, err
+	}
+	if payload == nil {
+		return "", client.ApplicationJSON, nil
+	}
+	b, err := json.Marshal(payload)
+	return string(b), client.ApplicationJSON, err
+}
+
 func (t *DefaultThing) RequestAccessToken(scopes ...string) (response thing.AccessTokenResponse, err error) {
-	payload := client.GetAccessTokenPayload{Scope: scopes}
-	var requestBody string
-	var content client.ContentType
+	return t.RequestIdempotentAccessToken("", scopes...)
+}
+
+func (t *DefaultThing) RequestIdempotentAccessToken(key string, scopes ...string) (response thing.AccessTokenResponse,
+	err error) {
+	response, err = t.requestAccessToken(key, client.GetAccessTokenPayload{Scope: scopes})
+	if err == nil && t.hooks.OnTokenIssued != nil {
+		t.hooks.OnTokenIssued(response)
+	}
+	return response, err
+}
 
+// requestAccessToken requests an access token with the session of the thing, identified by the idempotency key if it
+// is not empty
+func (t *DefaultThing) requestAccessToken(key string, payload client.GetAccessTokenPayload) (
+	response thing.AccessTokenResponse, err error) {
+	connection := client.WithIdempotencyKey(t.connection, key)
 	err = t.makeAuthorisedRequest(func(session session.Session) error {
+		t.reportProgress(thing.StepRequestingAccessToken)
+		requestBody, content, err := t.requestBody(session, func(info client.AMInfoResponse) string {
+			return info.AccessTokenURL
+		}, payload)
+		if err != nil {
+			return err
+		}
+		reply, err := connection.AccessToken(session.Token(), content, requestBody)
+		if reply != nil {
+			t.trace("RequestAccessToken", reply)
+		}
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(reply, &response.Content)
+	})
+	return response, err
+}
+
+// localTokenRequestLifetime is the time for which a request for a token issued by the Thing Gateway is valid
+const localTokenRequestLifetime = time.Minute
+
+func (t *DefaultThing) RequestLocalAccessToken(audience string, scopes ...string) (response thing.AccessTokenResponse,
+	err error) {
+	err = t.makeAuthorisedRequest(func(session session.Session) error {
+		now := t.clock.Now()
+		payload := client.LocalTokenPayload{
+			Audience: audience,
+			Scope:    scopes,
+			IssuedAt: now.Unix(),
+			Expiry:   now.Add(localTokenRequestLifetime).Unix(),
+			ID:       client.NewTransactionID(),
+		}
+		// the gateway checks that the request is signed with the key with which the thing authenticated
 		if popSession, ok := session.(*isession.PoPSession); ok {
-			info, err := t.connection.AMInfo()
-			if err != nil {
-				return err
-			}
-			requestBody, err = signedJWTBody(popSession, info.AccessTokenURL, info.ThingsVersion, payload)
-			if err != nil {
-				return err
-			}
-			content = client.ApplicationJOSE
-		} else {
-			b, err := json.Marshal(payload)
-			if err != nil {
-				return err
-			}
-			requestBody = string(b)
-			content = client.ApplicationJSON
+			payload.Confirmation = &client.ConfirmationClaim{JWK: jose.JSONWebKey{Key: popSession.SigningKey().Public()}}
 		}
-		reply, err := t.connection.AccessToken(session.Token(), content, requestBody)
+		// the gateway is not known to AM so the request is signed for the AM base URL
+		requestBody, content, err := t.requestBody(session, func(info client.AMInfoResponse) string {
+			return info.BaseURL
+		}, payload)
+		if err != nil {
+			return err
+		}
+		reply, err := client.LocalAccessToken(t.connection, session.Token(), content, requestBody)
 		if reply != nil {
-			debug.Logger.Println("RequestAccessToken response: ", string(reply))
+			t.trace("RequestLocalAccessToken", reply)
 		}
 		if err != nil {
 			return err
@@ -131,56 +342,321 @@ func (t *DefaultThing) RequestAccessToken(scopes ...string) (response thing.Acce
 	return response, err
 }
 
+// RequestPolicyDecision sends the evaluation request as JSON, since the AM policies endpoint does not accept signed
+// requests, with the session of the thing as the subject
+func (t *DefaultThing) RequestPolicyDecision(resource string, actions ...string) (response thing.PolicyDecisionResponse, err error) {
+	response.RequestedActions = actions
+	err = t.makeAuthorisedRequest(func(session session.Session) error {
+		requestBody, err := json.Marshal(client.PolicyDecisionPayload{
+			Resources: []string{resource},
+			Subject:   &client.PolicySubject{SSOToken: session.Token()},
+			Actions:   actions,
+		})
+		if err != nil {
+			return err
+		}
+		reply, err := t.connection.PolicyDecision(session.Token(), client.ApplicationJSON, string(requestBody))
+		if reply != nil {
+			t.trace("RequestPolicyDecision", reply)
+		}
+		if err != nil {
+			return err
+		}
+		var decisions []thing.JSONContent
+		if err = json.Unmarshal(reply, &decisions); err != nil {
+			return err
+		}
+		for _, decision := range decisions {
+			if r, _ := decision.GetString("resource"); r == resource {
+				response.Content = filterActions(decision, actions)
+				return nil
+			}
+		}
+		return fmt.Errorf("no policy decision for resource `%s`", resource)
+	})
+	return response, err
+}
+
+// filterActions removes the actions that were not requested from the policy decision. The decision is returned
+// unchanged if no actions were requested.
+func filterActions(decision thing.JSONContent, actions []string) thing.JSONContent {
+	evaluated, ok := decision["actions"].(map[string]interface{})
+	if !ok || len(actions) == 0 {
+		return decision
+	}
+	requested := make(map[string]interface{}, len(actions))
+	for _, action := range actions {
+		if allowed, ok := evaluated[action]; ok {
+			requested[action] = allowed
+		}
+	}
+	decision["actions"] = requested
+	return decision
+}
+
+func (t *DefaultThing) SignedRequest(method string, path string, body interface{}) (reply []byte, err error) {
+	return t.signedRequest(t.connection, method, path, body)
+}
+
+// signedRequest makes a signed request with the session of the thing over the connection
+func (t *DefaultThing) signedRequest(connection client.Connection, method string, path string,
+	body interface{}) (reply []byte, err error) {
+	err = t.makeAuthorisedRequest(func(session session.Session) error {
+		requestBody, content, err := t.requestBody(session, func(info client.AMInfoResponse) string {
+			return info.BaseURL + path
+		}, body)
+		if err != nil {
+			return err
+		}
+		reply, err = connection.SignedRequest(session.Token(), method, path, content, requestBody)
+		if reply != nil {
+			t.trace("SignedRequest", reply)
+		}
+		return err
+	})
+	return reply, err
+}
+
+func (t *DefaultThing) Session() (info thing.SessionInfo, err error) {
+	err = t.makeAuthorisedRequest(func(session session.Session) error {
+		reply, err := t.connection.SessionInfo(session.Token())
+		if err != nil {
+			return err
+		}
+		t.trace("Session", reply)
+		info, err = sessionInfo(session, reply)
+		return err
+	})
+	return info, err
+}
+
+// sessionInfo combines the state of the session with the session information received from AM
+func sessionInfo(s session.Session, reply []byte) (info thing.SessionInfo, err error) {
+	var content struct {
+		MaxIdleExpirationTime    string `json:"maxIdleExpirationTime"`
+		MaxSessionExpirationTime string `json:"maxSessionExpirationTime"`
+		Realm                    string `json:"realm"`
+	}
+	if err = json.Unmarshal(reply, &content); err != nil {
+		return info, fmt.Errorf("%w: %s", thing.ErrPayloadInvalid, err)
+	}
+	info.Token = s.Token()
+	_, info.Restricted = s.(*isession.PoPSession)
+	info.Realm = content.Realm
+	if info.MaxIdleExpiration, err = parseSessionTime(content.MaxIdleExpirationTime); err != nil {
+		return info, err
+	}
+	if info.MaxSessionExpiration, err = parseSessionTime(content.MaxSessionExpirationTime); err != nil {
+		return info, err
+	}
+	return info, nil
+}
+
+// parseSessionTime parses an expiry time of a session, returning the zero time if the value is empty
+func parseSessionTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, fmt.Errorf("%w: %s", thing.ErrPayloadInvalid, err)
+	}
+	return t, nil
+}
+
 func (t *DefaultThing) IntrospectAccessToken(token string) (introspection thing.IntrospectionResponse, err error) {
 	b, err := t.connection.IntrospectAccessToken(token)
 	if err != nil {
-		debug.Logger.Println("Introspection error", err)
+		t.log.Error("Introspection error", err)
 		return introspection, err
 	}
 	err = json.Unmarshal(b, &introspection.Content)
 	return introspection, err
 }
 
+// attributesRequestBody returns the body and content type of a request for the named attributes.
+// A PoP session requires a JWT signed for the attributes URL, otherwise the request has no body.
+func (t *DefaultThing) attributesRequestBody(session session.Session, names []string) (requestBody string,
+	content client.ContentType, err error) {
+	popSession, ok := session.(*isession.PoPSession)
+	if !ok {
+		return requestBody, client.ApplicationJSON, nil
+	}
+	info, err := t.connection.AMInfo()
+	if err != nil {
+		return requestBody, content, err
+	}
+	urlString := info.AttributesURL
+	if len(names) > 0 {
+		// Add the names as a '_field' query to the url but the url may have queries already
+		// The url.Values Encode method would have been ideal but the encoding of '/' breaks the audience check
+		// in AM
+		u, err := url.ParseRequestURI(urlString)
+		if err != nil {
+			return requestBody, content, err
+		}
+		prefix := "?"
+		if len(u.Query()) > 0 {
+			prefix = "&"
+		}
+		urlString += prefix + "_fields=" + strings.Join(names, ",")
+	}
+	requestBody, err = signedJWTBody(popSession, urlString, info.ThingsVersion, nil)
+	return requestBody, client.ApplicationJOSE, err
+}
+
 func (t *DefaultThing) RequestAttributes(names ...string) (response thing.AttributesResponse, err error) {
+	selection, err := selectAttributes(t.attributeSchema, names)
+	if err != nil {
+		return response, err
+	}
 	err = t.makeAuthorisedRequest(func(session session.Session) error {
-		var requestBody string
-		var content client.ContentType
-		if popSession, ok := session.(*isession.PoPSession); ok {
-			info, err := t.connection.AMInfo()
+		requestBody, content, err := t.attributesRequestBody(session, selection.fields)
+		if err != nil {
+			return err
+		}
+		reply, err := t.connection.Attributes(session.Token(), content, requestBody, selection.fields)
+		if err != nil {
+			t.trace("RequestAttributes", reply)
+			return err
+		}
+		return json.Unmarshal(reply, &response.Content)
+	})
+	response.Content = selection.filter(response.Content)
+	return response, err
+}
+
+func (t *DefaultThing) RequestAttributesIfChanged(revision string, names ...string) (response thing.AttributesResponse,
+	changed bool, err error) {
+	selection, err := selectAttributes(t.attributeSchema, names)
+	if err != nil {
+		return response, false, err
+	}
+	err = t.makeAuthorisedRequest(func(session session.Session) error {
+		requestBody, content, err := t.attributesRequestBody(session, selection.fields)
+		if err != nil {
+			return err
+		}
+		reply, next, err := client.ConditionalAttributes(t.connection, session.Token(), content, requestBody,
+			selection.fields, revision)
+		if err != nil {
+			t.trace("RequestAttributesIfChanged", reply)
+			return err
+		}
+		response.Revision = next
+		return json.Unmarshal(reply, &response.Content)
+	})
+	if errors.Is(err, client.ErrNotModified) {
+		return thing.AttributesResponse{Revision: revision}, false, nil
+	} else if err != nil {
+		return response, false, err
+	}
+	response.Content = selection.filter(response.Content)
+	return response, true, nil
+}
+
+func (t *DefaultThing) IterateAttributes(pageSize int, visit func(page thing.AttributesResponse) error,
+	names ...string) error {
+	if pageSize < 1 {
+		return errors.New("page size must be at least one")
+	}
+	selection, err := selectAttributes(t.attributeSchema, names)
+	if err != nil {
+		return err
+	}
+	next := ""
+	for {
+		var page client.AttributesPagePayload
+		err = t.makeAuthorisedRequest(func(session session.Session) error {
+			requestBody, content, err := t.attributesRequestBody(session, selection.fields)
 			if err != nil {
 				return err
 			}
-			urlString := info.AttributesURL
-			if len(names) > 0 {
-				// Add the names as a '_field' query to the url but the url may have queries already
-				// The url.Values Encode method would have been ideal but the encoding of '/' breaks the audience check
-				// in AM
-				u, err := url.ParseRequestURI(urlString)
-				if err != nil {
-					return err
-				}
-				prefix := "?"
-				if len(u.Query()) > 0 {
-					prefix = "&"
-				}
-				urlString += prefix + "_fields=" + strings.Join(names, ",")
+			reply, err := client.AttributesPage(t.connection, session.Token(), content, requestBody,
+				selection.fields, next, pageSize)
+			if err != nil {
+				return err
 			}
-			requestBody, err = signedJWTBody(popSession, urlString, info.ThingsVersion, nil)
+			return json.Unmarshal(reply, &page)
+		})
+		if next == "" && errors.Is(err, client.ErrAttributePagesUnsupported) {
+			response, err := t.RequestAttributes(names...)
 			if err != nil {
 				return err
 			}
-			content = client.ApplicationJOSE
-		} else {
-			content = client.ApplicationJSON
+			return visit(response)
+		} else if err != nil {
+			return err
+		}
+		var response thing.AttributesResponse
+		if err = json.Unmarshal(page.Attributes, &response.Content); err != nil {
+			return err
+		}
+		response.Content = selection.filter(response.Content)
+		if err = visit(response); err != nil {
+			return err
 		}
-		reply, err := t.connection.Attributes(session.Token(), content, requestBody, names)
+		if page.Next == "" {
+			return nil
+		}
+		next = page.Next
+	}
+}
+
+func (t *DefaultThing) SubscribeAttributes(notify func(response thing.AttributesResponse), names ...string) (cancel func() error, err error) {
+	if len(names) == 0 {
+		return nil, errors.New("no attributes to subscribe to")
+	}
+	selection, err := selectAttributes(t.attributeSchema, names)
+	if err != nil {
+		return nil, err
+	}
+	if len(selection.fields) == 0 {
+		return nil, errors.New("subscriptions require the attributes to be selected by name")
+	}
+	err = t.makeAuthorisedRequest(func(session session.Session) error {
+		requestBody, content, err := t.attributesRequestBody(session, selection.fields)
 		if err != nil {
-			debug.Logger.Println("RequestAttributes response: ", string(reply))
 			return err
 		}
-		return json.Unmarshal(reply, &response.Content)
+		cancel, err = client.SubscribeAttributes(t.connection, session.Token(), content, requestBody, selection.fields, func(reply []byte) {
+			var response thing.AttributesResponse
+			if err := json.Unmarshal(reply, &response.Content); err != nil {
+				t.log.Error("SubscribeAttributes notification: ", err)
+				return
+			}
+			response.Content = selection.filter(response.Content)
+			notify(response)
+		})
+		return err
 	})
-	return response, err
+	return cancel, err
+}
+
+// protectWithOSCORE establishes an OSCORE security context with the Thing Gateway.
+// The ephemeral key used to agree the master secret is sent in a JWT signed with the confirmation key of the thing.
+// The gateway forwards the JWT to AM to verify that the key is registered for the thing.
+func (t *DefaultThing) protectWithOSCORE() error {
+	popSession, ok := t.session.(*isession.PoPSession)
+	if !ok {
+		return errors.New("OSCORE requires a thing authenticated with a registered key")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	info, err := t.connection.AMInfo()
+	if err != nil {
+		return err
+	}
+	var claims client.OSCOREClaims
+	claims.Confirmation.JWK = jose.JSONWebKey{Key: popSession.SigningKey().Public()}
+	claims.EphemeralKey = jose.JSONWebKey{Key: key.Public()}
+	request, err := signedJWTBody(popSession, info.AttributesURL, info.ThingsVersion, claims)
+	if err != nil {
+		return err
+	}
+	return client.EstablishOSCORE(t.connection, request, key, popSession.SigningKey().Public())
 }
 
 type authHandlerBuilder struct {
@@ -196,16 +672,98 @@ type regHandlerBuilder struct {
 	claims       func() interface{}
 }
 
+type onboardHandlerBuilder struct {
+	idevid        callback.IDevID
+	verifyVoucher callback.VoucherVerifier
+}
+
 type BaseBuilder struct {
-	u           *url.URL
-	realm       string
-	tree        string
-	thingType   callback.ThingType
-	timeout     time.Duration
-	handlers    []callback.Handler
-	authHandler *authHandlerBuilder
-	regHandler  *regHandlerBuilder
-	connection  client.Connection
+	u                  *url.URL
+	realm              string
+	tree               string
+	thingType          callback.ThingType
+	timeout            time.Duration
+	throttleLimit      time.Duration
+	blockSize          int
+	maxPayload         int
+	codec              thing.Codec
+	keepAlive          time.Duration
+	backupKeys         []confirmationKey
+	keySelector        thing.KeySelector
+	clock              *client.Clock
+	linkMetadata       func() string
+	clientCertificates []*x509.Certificate
+	sessionCookie      string
+	sessionHeader      string
+	userAgent          string
+	headers            http.Header
+	oscore             bool
+	handlers           []callback.Handler
+	authHandler        *authHandlerBuilder
+	regHandler         *regHandlerBuilder
+	onboarding         *onboardHandlerBuilder
+	evidence           callback.EvidenceFunc
+	psk                *callback.PreSharedKey
+	oauth2Client       string
+	groups             []string
+	thumbprintKID      bool
+	compressPoint      *bool
+	hooks              thing.Hooks
+	attributeSchema    []string
+	attributeMapping   thing.AttributeMapping
+	connection         client.Connection
+	shareWith          thing.Thing
+	amInfo             *thing.AMInfo
+	tlsProfile         thing.TLSProfile
+	gatewayTrust       thing.GatewayTrust
+	detachedPayload    *bool
+	idempotencyKey     string
+	authContext        client.AuthContext
+	suspend            bool
+	resume             *callback.SuspendedError
+	constrained        bool
+	log                debug.Log
+}
+
+// Constrained mode
+// A thing in constrained mode is tuned for a Thing Gateway that is backhauled over a low-bandwidth link, such as NB-IoT
+// or LoRa. The mode only replaces the connection settings that were not set explicitly on the builder, so that a
+// single setting can still be tuned, and the payload settings are only used for connections with the Thing Gateway so
+// that a handoff to AM is unaffected.
+
+const (
+	constrainedTimeout    = time.Minute
+	constrainedBlockSize  = 256
+	constrainedMinBackoff = 10 * time.Second
+	constrainedMaxBackoff = 10 * time.Minute
+)
+
+// optionEnabled returns the value of a boolean option of the builder, or the default if the option was not set
+func optionEnabled(option *bool, byDefault bool) bool {
+	if option == nil {
+		return byDefault
+	}
+	return *option
+}
+
+// checkSigningAlgorithm rejects a key that signs with ES256K if AM does not support the algorithm, since AM would
+// otherwise fail the authentication without giving a reason. The check is skipped if AM does not advertise its
+// algorithms. Other algorithms are supported by all versions of AM.
+func checkSigningAlgorithm(connection client.Connection, key crypto.Signer) error {
+	alg, err := jws.JWAFromKey(key)
+	if err != nil || alg != jws.ES256K {
+		return err
+	}
+	info, err := connection.AMInfo()
+	if err != nil || len(info.SigningAlgorithms) == 0 {
+		return err
+	}
+	for _, supported := range info.SigningAlgorithms {
+		if supported == string(alg) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: AM does not support %s", jws.ErrUnsupportedAlgorithm, alg)
 }
 
 func (b *BaseBuilder) AsService() thing.Builder {
@@ -224,6 +782,51 @@ func (b *BaseBuilder) AuthenticateThing(thingID string, audience string, keyID s
 	return b
 }
 
+func (b *BaseBuilder) WithBackupKey(keyID string, key crypto.Signer) thing.Builder {
+	b.backupKeys = append(b.backupKeys, confirmationKey{keyID: keyID, key: key})
+	return b
+}
+
+func (b *BaseBuilder) WithKeySelector(selector thing.KeySelector) thing.Builder {
+	b.keySelector = selector
+	return b
+}
+
+func (b *BaseBuilder) WithClock(clock *thing.Clock) thing.Builder {
+	b.clock = clock
+	return b
+}
+
+// confirmationKeys returns the key provided to AuthenticateThing followed by the backup keys
+func (b *BaseBuilder) confirmationKeys() ([]confirmationKey, error) {
+	keys := []confirmationKey{{keyID: b.authHandler.keyID, key: b.authHandler.key}}
+	if b.regHandler != nil {
+		keys[0].certificates = b.regHandler.certificates
+	}
+	ids := map[string]bool{b.authHandler.keyID: true}
+	for _, backup := range b.backupKeys {
+		if backup.key == nil {
+			return nil, fmt.Errorf("backup key %s requires Key", backup.keyID)
+		}
+		if b.thumbprintKID {
+			keyID, err := thing.JWKThumbprint(backup.key)
+			if err != nil {
+				return nil, err
+			}
+			backup.keyID = keyID
+		}
+		if backup.keyID == "" || ids[backup.keyID] {
+			return nil, fmt.Errorf("backup key requires a unique Key ID, got `%s`", backup.keyID)
+		}
+		if err := checkSigningAlgorithm(b.connection, backup.key); err != nil {
+			return nil, err
+		}
+		ids[backup.keyID] = true
+		keys = append(keys, backup)
+	}
+	return keys, nil
+}
+
 func (b *BaseBuilder) RegisterThing(certificates []*x509.Certificate, claims func() interface{}) thing.Builder {
 	b.regHandler = &regHandlerBuilder{
 		certificates: certificates,
@@ -232,6 +835,49 @@ func (b *BaseBuilder) RegisterThing(certificates []*x509.Certificate, claims fun
 	return b
 }
 
+func (b *BaseBuilder) OnboardThing(idevid callback.IDevID, verifyVoucher callback.VoucherVerifier) thing.Builder {
+	b.onboarding = &onboardHandlerBuilder{
+		idevid:        idevid,
+		verifyVoucher: verifyVoucher,
+	}
+	return b
+}
+
+func (b *BaseBuilder) WithEvidence(evidence callback.EvidenceFunc) thing.Builder {
+	b.evidence = evidence
+	return b
+}
+
+func (b *BaseBuilder) WithPreSharedKey(id string, key []byte) thing.Builder {
+	b.psk = &callback.PreSharedKey{ID: id, Key: key}
+	return b
+}
+
+func (b *BaseBuilder) WithOAuth2Client(clientID string) thing.Builder {
+	b.oauth2Client = clientID
+	return b
+}
+
+func (b *BaseBuilder) InGroups(groups ...string) thing.Builder {
+	b.groups = groups
+	return b
+}
+
+func (b *BaseBuilder) WithThumbprintKeyID() thing.Builder {
+	b.thumbprintKID = true
+	return b
+}
+
+func (b *BaseBuilder) WithCompressedKey(enabled bool) thing.Builder {
+	b.compressPoint = &enabled
+	return b
+}
+
+func (b *BaseBuilder) WithHooks(hooks thing.Hooks) thing.Builder {
+	b.hooks = hooks
+	return b
+}
+
 func (b *BaseBuilder) ConnectTo(u *url.URL) thing.Builder {
 	b.u = u
 	return b
@@ -257,68 +903,430 @@ func (b *BaseBuilder) TimeoutRequestAfter(d time.Duration) thing.Builder {
 	return b
 }
 
+func (b *BaseBuilder) WithBlockSize(size int) thing.Builder {
+	b.blockSize = size
+	return b
+}
+
+func (b *BaseBuilder) WithMaxPayloadSize(size int) thing.Builder {
+	b.maxPayload = size
+	return b
+}
+
+func (b *BaseBuilder) WithCodec(codec thing.Codec) thing.Builder {
+	b.codec = codec
+	return b
+}
+
+func (b *BaseBuilder) WithKeepAlive(interval time.Duration) thing.Builder {
+	b.keepAlive = interval
+	return b
+}
+
+func (b *BaseBuilder) WithLinkMetadata(metadata func() string) thing.Builder {
+	b.linkMetadata = metadata
+	return b
+}
+
+func (b *BaseBuilder) WithClientCertificate(certificates []*x509.Certificate) thing.Builder {
+	b.clientCertificates = certificates
+	return b
+}
+
+func (b *BaseBuilder) WithSessionCookieName(name string) thing.Builder {
+	b.sessionCookie = name
+	return b
+}
+
+func (b *BaseBuilder) WithSessionTokenHeader(header string) thing.Builder {
+	b.sessionHeader = header
+	return b
+}
+
+func (b *BaseBuilder) WithUserAgent(userAgent string) thing.Builder {
+	b.userAgent = userAgent
+	return b
+}
+
+func (b *BaseBuilder) WithHeader(name, value string) thing.Builder {
+	if b.headers == nil {
+		b.headers = make(http.Header)
+	}
+	b.headers.Add(name, value)
+	return b
+}
+
+func (b *BaseBuilder) WaitWhenThrottled(limit time.Duration) thing.Builder {
+	b.throttleLimit = limit
+	return b
+}
+
+func (b *BaseBuilder) WithAttributeSchema(fields ...string) thing.Builder {
+	b.attributeSchema = fields
+	return b
+}
+
+func (b *BaseBuilder) MapClaimsToAttributes(mapping thing.AttributeMapping) thing.Builder {
+	b.attributeMapping = mapping
+	return b
+}
+
+func (b *BaseBuilder) ProtectWithOSCORE() thing.Builder {
+	b.oscore = true
+	return b
+}
+
+func (b *BaseBuilder) ShareConnectionWith(t thing.Thing) thing.Builder {
+	b.shareWith = t
+	return b
+}
+
+func (b *BaseBuilder) WithAMInfo(info thing.AMInfo) thing.Builder {
+	b.amInfo = &info
+	return b
+}
+
+func (b *BaseBuilder) WithTLSProfile(profile thing.TLSProfile) thing.Builder {
+	b.tlsProfile = profile
+	return b
+}
+
+func (b *BaseBuilder) WithGatewayTrust(trust thing.GatewayTrust) thing.Builder {
+	b.gatewayTrust = trust
+	return b
+}
+
+func (b *BaseBuilder) WithDetachedPayload(enabled bool) thing.Builder {
+	b.detachedPayload = &enabled
+	return b
+}
+
+func (b *BaseBuilder) WithConstrainedMode() thing.Builder {
+	b.constrained = true
+	return b
+}
+
+func (b *BaseBuilder) WithDebugLevel(level thing.DebugLevel) thing.Builder {
+	b.log.SetLevel(level)
+	return b
+}
+
+func (b *BaseBuilder) WithDebugRedaction(enabled bool) thing.Builder {
+	b.log.SetRedaction(enabled)
+	return b
+}
+
+// UseLog sets the log with which the thing writes its debug information, for things created by other components of
+// the SDK, such as the thing of the Thing Gateway
+func (b *BaseBuilder) UseLog(log debug.Log) {
+	b.log = log
+}
+
+func (b *BaseBuilder) WithIdempotencyKey(key string) thing.Builder {
+	b.idempotencyKey = key
+	return b
+}
+
+func (b *BaseBuilder) SuspendAuthentication() thing.Builder {
+	b.suspend = true
+	return b
+}
+
+func (b *BaseBuilder) ResumeAuthentication(suspended callback.SuspendedError) thing.Builder {
+	b.resume = &suspended
+	return b
+}
+
+func (b *BaseBuilder) WithLocale(locale string) thing.Builder {
+	b.authContext.Locale = locale
+	return b
+}
+
+func (b *BaseBuilder) WithAuthContext(name, value string) thing.Builder {
+	if b.authContext.Values == nil {
+		b.authContext.Values = make(map[string]string)
+	}
+	b.authContext.Values[name] = value
+	return b
+}
+
 func (b *BaseBuilder) WithConnection(connection client.Connection) thing.Builder {
 	b.connection = connection
 	return b
 }
 
-func (b *BaseBuilder) Create() (thing.Thing, error) {
-	if b.connection == nil {
+// validateKey checks that the SDK can sign with the key
+func validateKey(name string, key crypto.Signer) error {
+	if key == nil {
+		return fmt.Errorf("%s requires Key", name)
+	}
+	if _, err := jws.JWAFromKey(key); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+func (b *BaseBuilder) Validate() error {
+	var problems []error
+	if b.connection == nil && b.shareWith == nil {
 		if b.u == nil {
-			return nil, errors.New("URL must be provided via ConnectTo")
+			problems = append(problems, errors.New("URL must be provided via ConnectTo"))
+		} else {
+			problems = append(problems, client.ValidateURL(b.u))
+			if client.IsAMScheme(b.u.Scheme) && b.tree == "" {
+				problems = append(problems, errors.New("authentication tree must be provided via WithTree"))
+			}
+			if client.IsAMScheme(b.u.Scheme) && b.amInfo != nil && b.amInfo.CookieName == "" &&
+				b.sessionCookie == "" && b.sessionHeader == "" {
+				problems = append(problems, errors.New("AM info requires the session cookie name"))
+			}
+			problems = append(problems, b.tlsProfile.ValidateScheme(b.u.Scheme),
+				b.gatewayTrust.ValidateScheme(b.u.Scheme))
+		}
+		problems = append(problems, client.ValidateRealm(b.realm), client.ValidateTree(b.tree))
+	}
+	if b.authHandler != nil {
+		problems = append(problems, validateKey("authenticate thing", b.authHandler.key))
+		if b.authHandler.keyID == "" && !b.thumbprintKID {
+			problems = append(problems, errors.New("authenticate thing requires Key ID"))
+		}
+		if b.connection == nil && b.shareWith == nil {
+			problems = append(problems, client.ValidateCertificateKey(b.clientCertificates, b.authHandler.key))
+		}
+		for _, backup := range b.backupKeys {
+			problems = append(problems, validateKey("backup key "+backup.keyID, backup.key))
+		}
+	} else {
+		if b.regHandler != nil {
+			problems = append(problems, errors.New("RegisterThing requires AuthenticateThing"))
+		}
+		if b.onboarding != nil {
+			problems = append(problems, errors.New("OnboardThing requires AuthenticateThing"))
+		}
+		if len(b.backupKeys) > 0 {
+			problems = append(problems, errors.New("WithBackupKey requires AuthenticateThing"))
 		}
+		if b.keySelector != nil {
+			problems = append(problems, errors.New("WithKeySelector requires AuthenticateThing"))
+		}
+	}
+	if b.attributeMapping != nil {
+		if b.regHandler == nil || b.regHandler.claims == nil {
+			problems = append(problems, errors.New("MapClaimsToAttributes requires RegisterThing with claims"))
+		}
+		problems = append(problems, b.attributeMapping.Validate())
+	}
+	problems = append(problems, checkAttributeSchema(b.attributeSchema), client.ValidateAuthContext(b.authContext))
+	return client.NewConfigError(problems...)
+}
+
+// newConnection creates a connection to the server at the URL with the connection settings of the builder
+func (b *BaseBuilder) newConnection(u *url.URL) (client.Connection, error) {
+	timeout, blockSize, codec := b.timeout, b.blockSize, b.codec
+	if b.constrained {
+		if timeout == 0 {
+			timeout = constrainedTimeout
+		}
+		if blockSize == 0 {
+			blockSize = constrainedBlockSize
+		}
+		if codec == nil && !client.IsAMScheme(u.Scheme) {
+			codec = client.CBORCodec
+		}
+	}
+	connectionBuilder := client.NewConnection().
+		ConnectTo(u).
+		InRealm(b.realm).
+		WithTree(b.tree).
+		TimeoutRequestAfter(timeout).
+		WithBlockSize(blockSize).
+		WithMaxPayloadSize(b.maxPayload).
+		WithCodec(codec).
+		WithKeepAlive(b.keepAlive).
+		WithLinkMetadata(b.linkMetadata).
+		WithCertificate(b.clientCertificates).
+		WithSessionCookieName(b.sessionCookie).
+		WithSessionTokenHeader(b.sessionHeader).
+		WithUserAgent(b.userAgent).
+		WithTLSProfile(b.tlsProfile).
+		WithGatewayTrust(b.gatewayTrust)
+	if optionEnabled(b.detachedPayload, b.constrained) {
+		connectionBuilder.WithDetachedPayload()
+	}
+	if b.constrained {
+		connectionBuilder.WithReconnectBackoff(constrainedMinBackoff, constrainedMaxBackoff)
+	}
+	for name, values := range b.headers {
+		for _, value := range values {
+			connectionBuilder.WithHeader(name, value)
+		}
+	}
+	if b.amInfo != nil {
+		connectionBuilder.WithAMInfo(*b.amInfo)
+	}
+	// the client certificate is issued for the key of the thing
+	if len(b.clientCertificates) > 0 && b.authHandler != nil {
+		connectionBuilder.WithKey(b.authHandler.key)
+	}
+	return connectionBuilder.Create()
+}
+
+func (b *BaseBuilder) Create() (thing.Thing, error) {
+	if err := b.Validate(); err != nil {
+		return nil, err
+	}
+	if b.shareWith != nil {
+		shared, ok := b.shareWith.(*DefaultThing)
+		if !ok {
+			return nil, errors.New("connection can only be shared with a thing created by the SDK")
+		}
+		b.connection = client.ShareConnection(shared.connection)
+	}
+	// the thing can only hand off to another server if the builder created its connection
+	var connect func(u *url.URL) (client.Connection, error)
+	if b.connection == nil {
 		var err error
-		b.connection, err = client.NewConnection().
-			ConnectTo(b.u).
-			InRealm(b.realm).
-			WithTree(b.tree).
-			TimeoutRequestAfter(b.timeout).
-			Create()
-		if err != nil {
+		if b.connection, err = b.newConnection(b.u); err != nil {
 			return nil, err
 		}
+		connect = func(u *url.URL) (client.Connection, error) {
+			if client.IsAMScheme(u.Scheme) && b.tree == "" {
+				return nil, errors.New("a handoff to AM requires the authentication tree, see WithTree")
+			}
+			connection, err := b.newConnection(u)
+			if err != nil {
+				return nil, err
+			}
+			return client.WithAuthContext(connection, b.authContext), nil
+		}
 	}
+	b.connection = client.WithAuthContext(b.connection, b.authContext)
+	var keys []confirmationKey
+	var additional []callback.ConfirmationKey
 	if b.authHandler != nil {
-		// check we have a signer and key ID
-		if b.authHandler.key == nil {
-			return nil, fmt.Errorf("authenticate thing requires Key")
+		if b.thumbprintKID {
+			keyID, err := thing.JWKThumbprint(b.authHandler.key)
+			if err != nil {
+				return nil, err
+			}
+			b.authHandler.keyID = keyID
 		}
-		if b.authHandler.keyID == "" {
-			return nil, fmt.Errorf("authenticate thing requires Key ID")
+		if err := checkSigningAlgorithm(b.connection, b.authHandler.key); err != nil {
+			return nil, err
 		}
+		var err error
+		if keys, err = b.confirmationKeys(); err != nil {
+			return nil, err
+		}
+		additional = additionalKeys(keys, 0)
 		b.handlers = append(b.handlers, callback.AuthenticateHandler{
 			Audience: b.authHandler.audience,
 			ThingID:  b.authHandler.thingID,
 			KeyID:    b.authHandler.keyID,
 			Key:      b.authHandler.key,
 			Claims:   b.authHandler.claims,
+			Now:      b.clock.Now,
 		})
-		if b.regHandler != nil {
-			if b.thingType == "" {
-				b.thingType = callback.TypeDevice
+		if b.thingType == "" {
+			b.thingType = callback.TypeDevice
+		}
+		if b.onboarding != nil {
+			var certificates []*x509.Certificate
+			var claims func() interface{}
+			if b.regHandler != nil {
+				certificates = b.regHandler.certificates
+				claims = b.regHandler.claims
 			}
+			// the voucher must be bound to the challenge signed in the IDevID proof
+			challenge := new(string)
+			b.handlers = append(b.handlers, callback.OnboardHandler{
+				Audience:       b.authHandler.audience,
+				ThingID:        b.authHandler.thingID,
+				ThingType:      b.thingType,
+				KeyID:          b.authHandler.keyID,
+				Key:            b.authHandler.key,
+				Certificates:   certificates,
+				IDevID:         b.onboarding.idevid,
+				Claims:         claims,
+				Evidence:       b.evidence,
+				OAuth2Client:   b.oauth2Client,
+				Groups:         b.groups,
+				AdditionalKeys: additional,
+				CompressPoint:  optionEnabled(b.compressPoint, b.constrained),
+				Now:            b.clock.Now,
+				Challenge:      challenge,
+			})
+			if b.onboarding.verifyVoucher != nil {
+				b.handlers = append(b.handlers, callback.VoucherHandler{
+					Verify: b.onboarding.verifyVoucher,
+					Nonce:  challenge,
+					Now:    b.clock.Now,
+				})
+			}
+		} else if b.regHandler != nil {
 			b.handlers = append(b.handlers, callback.RegisterHandler{
-				Audience:     b.authHandler.audience,
-				ThingID:      b.authHandler.thingID,
-				ThingType:    b.thingType,
-				KeyID:        b.authHandler.keyID,
-				Key:          b.authHandler.key,
-				Certificates: b.regHandler.certificates,
-				Claims:       b.regHandler.claims,
+				Audience:       b.authHandler.audience,
+				ThingID:        b.authHandler.thingID,
+				ThingType:      b.thingType,
+				KeyID:          b.authHandler.keyID,
+				Key:            b.authHandler.key,
+				Certificates:   b.regHandler.certificates,
+				Claims:         b.regHandler.claims,
+				Evidence:       b.evidence,
+				OAuth2Client:   b.oauth2Client,
+				Groups:         b.groups,
+				PSK:            b.psk,
+				AdditionalKeys: additional,
+				CompressPoint:  optionEnabled(b.compressPoint, b.constrained),
+				Now:            b.clock.Now,
 			})
 		}
 	}
-	builder := &isession.Builder{}
-	thingSession, err := builder.
-		WithConnection(b.connection).
-		AuthenticateWith(b.handlers...).
-		Create()
-	if err != nil {
+	// trees that wait for an external event are polled unless the thing handles the wait itself
+	b.handlers = append(b.handlers, callback.PollingWaitHandler{Suspend: b.suspend})
+	t := &DefaultThing{
+		connection:      b.connection,
+		throttleLimit:   b.throttleLimit,
+		hooks:           b.hooks,
+		attributeSchema: b.attributeSchema,
+		keys:            keys,
+		keySelector:     b.keySelector,
+		clock:           b.clock,
+		service:         b.thingType == callback.TypeService,
+		idempotencyKey:  b.idempotencyKey,
+		resume:          b.resume,
+		connect:         connect,
+		oscore:          b.oscore,
+		quiet:           b.constrained,
+		log:             b.log,
+	}
+	// wrap the registration handlers so that the thing knows when it has been registered
+	for _, h := range b.handlers {
+		switch h.(type) {
+		case callback.RegisterHandler, callback.OnboardHandler:
+			h = registrationHandler{Handler: h, registered: &t.registered}
+		}
+		t.handlers = append(t.handlers, h)
+	}
+	if t.keySelector != nil && len(keys) > 0 {
+		if err := checkKeySelector(keys, t.keySelector); err != nil {
+			return nil, err
+		}
+		t.selectKey(0)
+	}
+	t.beginProgress()
+	if err := t.authenticate(); err != nil {
 		return nil, err
 	}
-	return &DefaultThing{
-		connection: b.connection,
-		handlers:   b.handlers,
-		session:    thingSession,
-	}, nil
+	if b.oscore {
+		if err := t.protectWithOSCORE(); err != nil {
+			return nil, err
+		}
+	}
+	if t.registered && b.attributeMapping != nil {
+		if err := thing.WriteMappedAttributes(t, b.realm, b.attributeMapping, b.regHandler.claims()); err != nil {
+			return nil, fmt.Errorf("thing registered but unable to write the mapped attributes: %w", err)
+		}
+	}
+	return t, nil
 }
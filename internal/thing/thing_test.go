@@ -0,0 +1,396 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package thing
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/big"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/JacoJooste/iot-edge/v7/internal/debug"
+	"github.com/JacoJooste/iot-edge/v7/internal/jws"
+	"github.com/JacoJooste/iot-edge/v7/pkg/callback"
+	"github.com/JacoJooste/iot-edge/v7/pkg/thing"
+)
+
+// mockConnection registers the thing on every authentication and rejects the first access token request
+type mockConnection struct {
+	client.Connection
+	tokenRequests int
+}
+
+func (m *mockConnection) Authenticate(payload client.AuthenticatePayload) (reply client.AuthenticatePayload, err error) {
+	if len(payload.Callbacks) > 0 {
+		reply.TokenID = "aToken"
+		return reply, nil
+	}
+	reply.Callbacks = []callback.Callback{{
+		Type:   callback.TypeHiddenValueCallback,
+		Output: []callback.Entry{{Name: "id", Value: "jwt-pop-registration"}, {Name: "value", Value: "1"}},
+		Input:  make([]callback.Entry, 1),
+	}}
+	return reply, nil
+}
+
+func (m *mockConnection) AMInfo() (info client.AMInfoResponse, err error) {
+	return client.AMInfoResponse{AccessTokenURL: "/things", ThingsVersion: "1"}, nil
+}
+
+func (m *mockConnection) ValidateSession(tokenID string) (ok bool, err error) {
+	return false, nil
+}
+
+func (m *mockConnection) AccessToken(tokenID string, content client.ContentType, payload string) (reply []byte, err error) {
+	m.tokenRequests++
+	if m.tokenRequests == 1 {
+		return nil, client.AMError{Code: 401}
+	}
+	return []byte(`{"access_token":"anAccessToken"}`), nil
+}
+
+func TestDefaultThing_Hooks(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := x509.Certificate{SerialNumber: big.NewInt(1)}
+	certBytes, _ := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	cert, _ := x509.ParseCertificate(certBytes)
+
+	var events []string
+	builder := &BaseBuilder{}
+	device, err := builder.
+		WithConnection(&mockConnection{}).
+		AuthenticateThing("thing", "/", "kid", key, nil).
+		RegisterThing([]*x509.Certificate{cert}, nil).
+		WithHooks(thing.Hooks{
+			OnAuthenticated: func() {
+				events = append(events, "authenticated")
+			},
+			OnSessionExpired: func() {
+				events = append(events, "expired")
+			},
+			OnTokenIssued: func(response thing.AccessTokenResponse) {
+				token, _ := response.AccessToken()
+				events = append(events, "token "+token)
+			},
+			OnRegistration: func() {
+				events = append(events, "registered")
+			},
+		}).
+		Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = device.RequestAccessToken(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"registered", "authenticated", "expired", "registered", "authenticated", "token anAccessToken"}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected events %v, got %v", expected, events)
+	}
+}
+
+// replyConnection replies to the access token requests in turn and succeeds once the replies are exhausted
+type replyConnection struct {
+	mockConnection
+	replies []error
+}
+
+func (m *replyConnection) AccessToken(tokenID string, content client.ContentType, payload string) ([]byte, error) {
+	m.tokenRequests++
+	if len(m.replies) > 0 {
+		err := m.replies[0]
+		m.replies = m.replies[1:]
+		return nil, err
+	}
+	return []byte(`{"access_token":"anAccessToken"}`), nil
+}
+
+func TestDefaultThing_MakeAuthorisedRequest(t *testing.T) {
+	throttled := client.AMError{Code: 429, RetryAfter: time.Millisecond}
+	expired := client.AMError{Code: 401}
+	tests := []struct {
+		name     string
+		replies  []error
+		requests int
+		success  bool
+	}{
+		{name: "throttled-then-expired", replies: []error{throttled, expired}, requests: 3, success: true},
+		{name: "expired-then-throttled", replies: []error{expired, throttled}, requests: 3, success: true},
+		{name: "expired-twice", replies: []error{expired, expired}, requests: 2},
+		{name: "throttled-too-often", replies: []error{throttled, throttled, throttled, throttled}, requests: 4},
+		{name: "unsupported-version", replies: []error{client.ErrUnsupportedVersion}, requests: 2, success: true},
+		{name: "other-error", replies: []error{errors.New("failed")}, requests: 1},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			connection := &replyConnection{replies: subtest.replies}
+			builder := &BaseBuilder{}
+			device, err := builder.
+				WithConnection(connection).
+				AuthenticateThing("thing", "/", "kid", key, nil).
+				WaitWhenThrottled(time.Second).
+				Create()
+			if err != nil {
+				t.Fatal(err)
+			}
+			response, err := device.RequestAccessToken()
+			if subtest.success {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if token, _ := response.AccessToken(); token != "anAccessToken" {
+					t.Errorf("unexpected access token %s", token)
+				}
+			} else if err == nil {
+				t.Error("expected an error")
+			}
+			if connection.tokenRequests != subtest.requests {
+				t.Errorf("expected %d requests; got %d", subtest.requests, connection.tokenRequests)
+			}
+		})
+	}
+}
+
+// algorithmsConnection advertises the signing algorithms supported by AM
+type algorithmsConnection struct {
+	client.Connection
+	algorithms []string
+}
+
+func (m algorithmsConnection) AMInfo() (info client.AMInfoResponse, err error) {
+	return client.AMInfoResponse{SigningAlgorithms: m.algorithms}, nil
+}
+
+func TestCheckSigningAlgorithm(t *testing.T) {
+	p256Key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	secp256k1Key, _ := thing.GenerateConfirmationKey("ES256K")
+	tests := []struct {
+		name       string
+		key        crypto.Signer
+		algorithms []string
+		supported  bool
+	}{
+		{name: "es256", key: p256Key, algorithms: []string{"RS256"}, supported: true},
+		{name: "es256k-supported", key: secp256k1Key, algorithms: []string{"ES256", "ES256K"}, supported: true},
+		{name: "es256k-not-advertised", key: secp256k1Key, supported: true},
+		{name: "es256k-unsupported", key: secp256k1Key, algorithms: []string{"ES256", "PS256"}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			err := checkSigningAlgorithm(algorithmsConnection{algorithms: subtest.algorithms}, subtest.key)
+			if subtest.supported && err != nil {
+				t.Error(err)
+			}
+			if !subtest.supported && !errors.Is(err, thing.ErrUnsupportedAlgorithm) {
+				t.Errorf("expected ErrUnsupportedAlgorithm, got %v", err)
+			}
+		})
+	}
+}
+
+func TestBaseBuilder_ShareConnectionWith(t *testing.T) {
+	connection := &keysConnection{}
+	tenants := make([]thing.Thing, 2)
+	for i, id := range []string{"tenant-a", "tenant-b"} {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		builder := &BaseBuilder{}
+		if i == 0 {
+			builder.WithConnection(connection)
+		} else {
+			builder.ShareConnectionWith(tenants[0])
+		}
+		var err error
+		tenants[i], err = builder.
+			AuthenticateThing(id, "/", id+"-key", key, nil).
+			RegisterThing(nil, nil).
+			Create()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// each thing registers its own key
+		if kid, _ := connection.lastRegistration(t); kid != id+"-key" {
+			t.Errorf("expected to register key %s-key; got %s", id, kid)
+		}
+	}
+	if tenants[0].(*DefaultThing).connection != tenants[1].(*DefaultThing).connection {
+		t.Error("expected the things to share the connection")
+	}
+	if tenants[0].(*DefaultThing).session == tenants[1].(*DefaultThing).session {
+		t.Error("expected each thing to have its own session")
+	}
+
+	// things that were not created by the SDK do not have a connection to share
+	builder := &BaseBuilder{}
+	_, err := builder.ShareConnectionWith(struct{ thing.Thing }{}).Create()
+	if err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestBaseBuilder_Validate(t *testing.T) {
+	u, _ := url.Parse("https://am.example.com/am")
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	builder := &BaseBuilder{}
+	builder.ConnectTo(u).InRealm("/alfheim").WithTree("reg-tree").AuthenticateThing("thing", "/", "kid", key, nil)
+	if err := builder.Validate(); err != nil {
+		t.Fatalf("expected a valid configuration; got %v", err)
+	}
+
+	// all the problems are reported at once
+	builder = &BaseBuilder{}
+	_, err := builder.ConnectTo(u).InRealm("/alf heim").RegisterThing(nil, nil).Create()
+	var configErr thing.ConfigError
+	if !errors.As(err, &configErr) {
+		t.Fatalf("expected a config error; got %v", err)
+	}
+	if len(configErr.Problems) != 3 {
+		t.Errorf("expected 3 problems; got %v", configErr.Problems)
+	}
+
+	// the SDK can not sign with keys on unsupported curves
+	unsupported, _ := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	builder = &BaseBuilder{}
+	err = builder.WithConnection(&keysConnection{}).AuthenticateThing("thing", "/", "kid", unsupported, nil).Validate()
+	if !errors.Is(err, thing.ErrUnsupportedAlgorithm) {
+		t.Errorf("expected %v; got %v", thing.ErrUnsupportedAlgorithm, err)
+	}
+
+	// context names are sent in HTTP header names
+	builder = &BaseBuilder{}
+	builder.ConnectTo(u).WithTree("reg-tree").WithLocale("de-CH").WithAuthContext("app type", "android")
+	if err = builder.Validate(); err == nil {
+		t.Error("expected an invalid context name to be rejected")
+	}
+}
+
+// policyConnection records the policy decision requests of the thing and allows all actions
+type policyConnection struct {
+	mockConnection
+	content client.ContentType
+	payload string
+}
+
+func (m *policyConnection) PolicyDecision(tokenID string, content client.ContentType, payload string) ([]byte, error) {
+	m.content, m.payload = content, payload
+	return []byte(`[{"resource":"valve-x","actions":{"open":true,"close":true,"service":true}}]`), nil
+}
+
+func TestDefaultThing_RequestPolicyDecision(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	connection := &policyConnection{}
+	device, err := (&BaseBuilder{}).
+		WithConnection(connection).
+		AuthenticateThing("thing", "/", "kid", key, nil).
+		RegisterThing(nil, nil).
+		Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := device.RequestPolicyDecision("valve-x", "open", "close")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connection.content != client.ApplicationJSON {
+		t.Errorf("expected a JSON request; got %s", connection.content)
+	}
+	var payload client.PolicyDecisionPayload
+	if err := json.Unmarshal([]byte(connection.payload), &payload); err != nil {
+		t.Fatal(err)
+	}
+	expected := client.PolicyDecisionPayload{
+		Resources: []string{"valve-x"},
+		Subject:   &client.PolicySubject{SSOToken: "aToken"},
+		Actions:   []string{"open", "close"},
+	}
+	if !reflect.DeepEqual(payload, expected) {
+		t.Errorf("expected payload %v; got %v", expected, payload)
+	}
+	if !response.Allowed() {
+		t.Error("expected the requested actions to be allowed")
+	}
+	if _, err := response.Action("service"); err == nil {
+		t.Error("expected the decision to only contain the requested actions")
+	}
+}
+
+// clockConnection reports a server time that is far ahead of the time of the device
+type clockConnection struct {
+	keysConnection
+	server time.Time
+}
+
+func (m *clockConnection) ServerTime() (time.Time, time.Duration, error) {
+	return m.server, time.Second, nil
+}
+
+func TestDefaultThing_WithClock(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	server := time.Now().Add(24 * time.Hour)
+	connection := &clockConnection{server: server}
+	_, err := (&BaseBuilder{}).
+		WithConnection(connection).
+		AuthenticateThing("thing", "/", "key", key, nil).
+		RegisterThing(nil, nil).
+		WithClock(&thing.Clock{}).
+		Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims struct {
+		Iat int64 `json:"iat"`
+	}
+	if err := jws.ExtractClaims(connection.registrations[0], &claims); err != nil {
+		t.Fatal(err)
+	}
+	if iat := time.Unix(claims.Iat, 0); iat.Before(server.Add(-time.Minute)) || iat.After(server.Add(time.Minute)) {
+		t.Errorf("expected the JWT to be issued at about %v; got %v", server, iat)
+	}
+}
+
+func TestBaseBuilder_WithDebugLevel(t *testing.T) {
+	logger := debug.Logger
+	defer func() { debug.Logger = logger }()
+	var buffer bytes.Buffer
+	debug.Logger = log.New(&buffer, "", 0)
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	device, err := (&BaseBuilder{}).
+		WithConnection(&mockConnection{}).
+		AuthenticateThing("thing", "/", "kid", key, nil).
+		WithDebugLevel(thing.DebugError).
+		Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	device.(*DefaultThing).trace("Request", []byte("{}"))
+	device.(*DefaultThing).log.Error("failure")
+	if output := buffer.String(); output != "failure\n" {
+		t.Errorf("expected only the failure to be written; got %q", output)
+	}
+}
@@ -66,3 +66,28 @@ func (c *Cache) Get(key string) (token string, ok bool) {
 	token, ok = value.(string)
 	return token, ok
 }
+
+// Keys returns the keys of the unexpired tokens in the cache and their expiry times. The expiry time is zero if the
+// token does not expire.
+func (c *Cache) Keys() map[string]time.Time {
+	items := c.store.Items()
+	keys := make(map[string]time.Time, len(items))
+	for k, item := range items {
+		var expiry time.Time
+		if item.Expiration > 0 {
+			expiry = time.Unix(0, item.Expiration)
+		}
+		keys[k] = expiry
+	}
+	return keys
+}
+
+// Delete the token with the given key from the cache
+func (c *Cache) Delete(key string) {
+	c.store.Delete(key)
+}
+
+// Flush removes all tokens from the cache
+func (c *Cache) Flush() {
+	c.store.Flush()
+}
@@ -17,6 +17,7 @@
 package tokencache
 
 import (
+	"strconv"
 	"testing"
 	"time"
 
@@ -54,3 +55,41 @@ func TestTokenCache_Add_Expiry(t *testing.T) {
 	}
 
 }
+
+func benchmarkToken(b *testing.B) string {
+	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: []byte("secret")}, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	token, err := jwt.Signed(sig).Claims(jwt.Claims{Expiry: jwt.NewNumericDate(time.Now().Add(time.Hour))}).
+		CompactSerialize()
+	if err != nil {
+		b.Fatal(err)
+	}
+	return token
+}
+
+func BenchmarkCache_Add(b *testing.B) {
+	token := benchmarkToken(b)
+	cache := New(5*time.Minute, 10*time.Minute)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.Add(strconv.Itoa(i%1000), token)
+	}
+}
+
+func BenchmarkCache_Get(b *testing.B) {
+	token := benchmarkToken(b)
+	cache := New(5*time.Minute, 10*time.Minute)
+	for i := 0; i < 1000; i++ {
+		cache.Add(strconv.Itoa(i), token)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := cache.Get(strconv.Itoa(i % 1000)); !ok {
+			b.Fatal("token not found")
+		}
+	}
+}
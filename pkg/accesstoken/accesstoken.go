@@ -0,0 +1,280 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package accesstoken
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/clock"
+	"github.com/JacoJooste/iot-edge/v7/internal/debug"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// ErrInvalidToken indicates that the access token was not issued by AM or is no longer valid
+var ErrInvalidToken = errors.New("invalid access token")
+
+const (
+	// defaultMaxAge is the default time for which the key set is cached
+	defaultMaxAge = time.Hour
+	// defaultMinRefreshInterval is the default minimum time between refreshes caused by unknown keys
+	defaultMinRefreshInterval = 30 * time.Second
+)
+
+// KeySet retrieves the keys that AM uses to sign access tokens and caches them. The key set is refreshed when it is
+// older than MaxAge or when a token is signed with an unknown key, which happens after AM rotates its keys. A KeySet
+// must not be copied after first use.
+type KeySet struct {
+	// URL of AM
+	URL *url.URL
+	// Realm of the OAuth 2.0 provider that issues the access tokens
+	Realm string
+	// Client is used to make requests to AM. The default HTTP client is used if nil.
+	Client *http.Client
+	// MaxAge is the time for which the keys are cached. Defaults to one hour.
+	MaxAge time.Duration
+	// MinRefreshInterval is the minimum time between attempts to refresh the keys, which stops tokens signed with
+	// unknown keys from flooding AM with key set requests. Defaults to 30 seconds.
+	MinRefreshInterval time.Duration
+
+	mutex     sync.Mutex
+	jwksURI   string
+	keys      jose.JSONWebKeySet
+	fetched   time.Time
+	attempted time.Time
+	err       error
+}
+
+// Keys returns the keys with the given ID, or all the keys if the ID is empty
+func (s *KeySet) Keys(kid string) ([]jose.JSONWebKey, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	maxAge, minRefresh := s.MaxAge, s.MinRefreshInterval
+	if maxAge <= 0 {
+		maxAge = defaultMaxAge
+	}
+	if minRefresh <= 0 {
+		minRefresh = defaultMinRefreshInterval
+	}
+	now := clock.Clock()
+	keys := s.lookup(kid)
+	stale := s.fetched.IsZero() || now.Sub(s.fetched) >= maxAge
+	if !stale && len(keys) > 0 {
+		return keys, nil
+	}
+	if !s.attempted.IsZero() && now.Sub(s.attempted) < minRefresh {
+		if s.fetched.IsZero() {
+			return nil, s.err
+		}
+		return keys, nil
+	}
+	s.attempted = now
+	if s.err = s.refresh(); s.err != nil {
+		if len(keys) > 0 {
+			debug.Infof("using cached access token keys; %s", s.err)
+			return keys, nil
+		}
+		return nil, s.err
+	}
+	return s.lookup(kid), nil
+}
+
+func (s *KeySet) lookup(kid string) []jose.JSONWebKey {
+	if kid == "" {
+		return s.keys.Keys
+	}
+	return s.keys.Key(kid)
+}
+
+// refresh retrieves the key set from AM, discovering the JWKS URI of the realm on first use
+func (s *KeySet) refresh() (err error) {
+	if s.URL == nil {
+		return errors.New("AM URL required")
+	}
+	if s.jwksURI == "" {
+		u := s.URL.String() + "/oauth2/.well-known/openid-configuration"
+		if s.Realm != "" {
+			u += "?realm=" + url.QueryEscape(s.Realm)
+		}
+		var config struct {
+			URI string `json:"jwks_uri"`
+		}
+		if err = s.get(u, &config); err != nil {
+			return err
+		}
+		if config.URI == "" {
+			return errors.New("AM did not provide a JWKS URI")
+		}
+		s.jwksURI = config.URI
+	}
+	var keys jose.JSONWebKeySet
+	if err = s.get(s.jwksURI, &keys); err != nil {
+		return err
+	}
+	debug.Infof("retrieved %d access token keys from %s", len(keys.Keys), s.jwksURI)
+	s.keys = keys
+	s.fetched = clock.Clock()
+	return nil
+}
+
+func (s *KeySet) get(u string, v interface{}) error {
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("request to %s failed with status code %d", u, response.StatusCode)
+	}
+	return json.Unmarshal(body, v)
+}
+
+// Token contains the verified claims of an access token
+type Token struct {
+	Subject  string
+	Issuer   string
+	Audience []string
+	Expiry   time.Time
+	IssuedAt time.Time
+	Scopes   []string
+	ClientID string
+	claims   json.RawMessage
+}
+
+// Claims unmarshals all the claims of the access token into the supplied value
+func (t Token) Claims(v interface{}) error {
+	return json.Unmarshal(t.claims, v)
+}
+
+// HasScope returns true if the access token was issued with the scope
+func (t Token) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// scopes unmarshals a scope claim that is either a space separated string (RFC 9068) or an array of strings (AM)
+type scopes []string
+
+func (s *scopes) UnmarshalJSON(b []byte) error {
+	var list []string
+	if err := json.Unmarshal(b, &list); err == nil {
+		*s = list
+		return nil
+	}
+	var value string
+	if err := json.Unmarshal(b, &value); err != nil {
+		return err
+	}
+	*s = strings.Fields(value)
+	return nil
+}
+
+// accessTokenClaims contains the claims of an access token that are not registered JWT claims
+type accessTokenClaims struct {
+	Scope     scopes `json:"scope"`
+	ClientID  string `json:"client_id"`
+	TokenName string `json:"tokenName"`
+}
+
+// Validator validates access tokens with the keys that AM uses to sign them
+type Validator struct {
+	Keys *KeySet
+	// Audience is optional. If set, the access token must be intended for the audience.
+	Audience string
+	// Issuer is optional. If set, the access token must be issued by the issuer.
+	Issuer string
+	// Leeway is the clock skew allowed when checking the validity period of the access token
+	Leeway time.Duration
+}
+
+// Validate checks that the access token was signed by AM and is currently valid for the audience. Returns the
+// verified claims of the token. The error wraps ErrInvalidToken if the token is not valid.
+func (v Validator) Validate(accessToken string) (token Token, err error) {
+	if v.Keys == nil {
+		return token, errors.New("access token key set required")
+	}
+	parsed, err := jwt.ParseSigned(accessToken)
+	if err != nil {
+		return token, fmt.Errorf("%w: %s", ErrInvalidToken, err)
+	}
+	if len(parsed.Headers) == 0 {
+		return token, fmt.Errorf("%w: expected at least one signature header", ErrInvalidToken)
+	}
+	header := parsed.Headers[0]
+	switch jose.SignatureAlgorithm(header.Algorithm) {
+	case jose.HS256, jose.HS384, jose.HS512:
+		return token, fmt.Errorf("%w: symmetrically signed tokens can not be validated locally", ErrInvalidToken)
+	}
+	keys, err := v.Keys.Keys(header.KeyID)
+	if err != nil {
+		return token, err
+	}
+	var claims jwt.Claims
+	var atClaims accessTokenClaims
+	err = errors.New("no matching key")
+	for _, key := range keys {
+		if err = parsed.Claims(key.Public(), &claims, &atClaims, &token.claims); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return token, fmt.Errorf("%w: %s", ErrInvalidToken, err)
+	}
+	if atClaims.TokenName != "" && atClaims.TokenName != "access_token" {
+		return token, fmt.Errorf("%w: unexpected token type %s", ErrInvalidToken, atClaims.TokenName)
+	}
+	if claims.Expiry == nil {
+		return token, fmt.Errorf("%w: missing expiry", ErrInvalidToken)
+	}
+	expected := jwt.Expected{Issuer: v.Issuer, Time: clock.Clock()}
+	if v.Audience != "" {
+		expected.Audience = jwt.Audience{v.Audience}
+	}
+	if err = claims.ValidateWithLeeway(expected, v.Leeway); err != nil {
+		return token, fmt.Errorf("%w: %s", ErrInvalidToken, err)
+	}
+	token.Subject = claims.Subject
+	token.Issuer = claims.Issuer
+	token.Audience = claims.Audience
+	token.Expiry = claims.Expiry.Time()
+	if claims.IssuedAt != nil {
+		token.IssuedAt = claims.IssuedAt.Time()
+	}
+	token.Scopes = atClaims.Scope
+	token.ClientID = atClaims.ClientID
+	return token, nil
+}
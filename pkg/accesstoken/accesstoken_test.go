@@ -0,0 +1,208 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package accesstoken
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/clock"
+	"github.com/JacoJooste/iot-edge/v7/internal/jws"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+var (
+	testIssuerKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	testOtherKey, _  = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+)
+
+type testClaims struct {
+	jwt.Claims
+	Scope     interface{} `json:"scope,omitempty"`
+	TokenName string      `json:"tokenName,omitempty"`
+	Custom    string      `json:"custom,omitempty"`
+}
+
+// testAccessToken creates an access token signed by the key with the given key ID
+func testAccessToken(t *testing.T, key crypto.Signer, kid string, claims testClaims) string {
+	opts := &jose.SignerOptions{}
+	opts.WithHeader("kid", kid)
+	sig, err := jws.NewSigner(key, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Signed(sig).Claims(claims).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// testAMServer serves the OpenID configuration and the key set of a realm and counts the key set requests
+func testAMServer(t *testing.T, keys *jose.JSONWebKeySet, requests *int) *httptest.Server {
+	mux := http.NewServeMux()
+	var server *httptest.Server
+	mux.HandleFunc("/oauth2/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("realm") != "/things" {
+			t.Errorf("unexpected realm %s", r.URL.Query().Get("realm"))
+		}
+		_, _ = fmt.Fprintf(w, `{"jwks_uri":"%s/oauth2/connect/jwk_uri"}`, server.URL)
+	})
+	mux.HandleFunc("/oauth2/connect/jwk_uri", func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		b, _ := keys.Keys[0].MarshalJSON()
+		_, _ = fmt.Fprintf(w, `{"keys":[%s]}`, b)
+	})
+	server = httptest.NewServer(mux)
+	return server
+}
+
+func testKeySet(t *testing.T, server *httptest.Server) *KeySet {
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &KeySet{URL: u, Realm: "/things"}
+}
+
+func TestValidator_Validate(t *testing.T) {
+	keys := &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: testIssuerKey.Public(), KeyID: "issuer"}}}
+	var requests int
+	server := testAMServer(t, keys, &requests)
+	defer server.Close()
+	validator := Validator{Keys: testKeySet(t, server), Audience: "gateway", Issuer: "am"}
+
+	now := time.Now()
+	valid := testClaims{Claims: jwt.Claims{Subject: "thing", Issuer: "am", Audience: jwt.Audience{"gateway"},
+		Expiry: jwt.NewNumericDate(now.Add(time.Hour)), IssuedAt: jwt.NewNumericDate(now)},
+		Scope: []string{"publish", "subscribe"}, TokenName: "access_token", Custom: "value"}
+	expired := valid
+	expired.Expiry = jwt.NewNumericDate(now.Add(-time.Minute))
+	noExpiry := valid
+	noExpiry.Expiry = nil
+	otherAudience := valid
+	otherAudience.Audience = jwt.Audience{"other"}
+	otherIssuer := valid
+	otherIssuer.Issuer = "other"
+	idToken := valid
+	idToken.TokenName = "id_token"
+	spaceSeparated := valid
+	spaceSeparated.Scope = "publish subscribe"
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{name: "valid", token: testAccessToken(t, testIssuerKey, "issuer", valid), valid: true},
+		{name: "space-separated-scope", token: testAccessToken(t, testIssuerKey, "issuer", spaceSeparated),
+			valid: true},
+		{name: "expired", token: testAccessToken(t, testIssuerKey, "issuer", expired)},
+		{name: "no-expiry", token: testAccessToken(t, testIssuerKey, "issuer", noExpiry)},
+		{name: "other-audience", token: testAccessToken(t, testIssuerKey, "issuer", otherAudience)},
+		{name: "other-issuer", token: testAccessToken(t, testIssuerKey, "issuer", otherIssuer)},
+		{name: "id-token", token: testAccessToken(t, testIssuerKey, "issuer", idToken)},
+		{name: "unknown-signer", token: testAccessToken(t, testOtherKey, "issuer", valid)},
+		{name: "not-a-jwt", token: "not-a-jwt"},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			token, err := validator.Validate(subtest.token)
+			if !subtest.valid {
+				if !errors.Is(err, ErrInvalidToken) {
+					t.Errorf("expected ErrInvalidToken, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token.Subject != "thing" || !token.HasScope("subscribe") || token.HasScope("admin") ||
+				!reflect.DeepEqual(token.Audience, []string{"gateway"}) {
+				t.Errorf("unexpected token %+v", token)
+			}
+			var claims testClaims
+			if err = token.Claims(&claims); err != nil || claims.Custom != "value" {
+				t.Errorf("unexpected claims %+v; %v", claims, err)
+			}
+		})
+	}
+	if requests != 1 {
+		t.Errorf("expected the key set to be requested once, got %d", requests)
+	}
+}
+
+func TestKeySet_Refresh(t *testing.T) {
+	defer func() {
+		clock.Clock = clock.DefaultClock()
+	}()
+	now := time.Now()
+	clock.Clock = func() time.Time {
+		return now
+	}
+	keys := &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: testIssuerKey.Public(), KeyID: "old"}}}
+	var requests int
+	server := testAMServer(t, keys, &requests)
+	defer server.Close()
+	keySet := testKeySet(t, server)
+	keySet.MaxAge = time.Hour
+	keySet.MinRefreshInterval = time.Minute
+
+	lookup := func(kid string, found bool, expectedRequests int) {
+		t.Helper()
+		k, err := keySet.Keys(kid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (len(k) > 0) != found || requests != expectedRequests {
+			t.Errorf("%s: found %d keys after %d requests", kid, len(k), requests)
+		}
+	}
+	lookup("old", true, 1)
+	lookup("old", true, 1)
+
+	// AM rotates its key, the key set is refreshed at most once per refresh interval
+	keys.Keys[0].KeyID = "new"
+	lookup("new", false, 1)
+	now = now.Add(2 * time.Minute)
+	lookup("new", true, 2)
+	lookup("unknown", false, 2)
+
+	// the key set is refreshed when it is older than the maximum age
+	now = now.Add(2 * time.Hour)
+	lookup("new", true, 3)
+
+	// cached keys are used if AM can not be reached
+	server.Close()
+	now = now.Add(2 * time.Hour)
+	lookup("new", true, 3)
+	now = now.Add(2 * time.Minute)
+	if _, err := keySet.Keys("unknown"); err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -0,0 +1,37 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package accesstoken validates JWT access tokens issued by AM locally, without introspecting them. The keys that AM
+// uses to sign access tokens are retrieved from the JWKS URI of the realm and cached. The signature, expiry and
+// audience of a token are checked and its claims are returned, so that a gateway or resource server can authorise the
+// requests of things without calling AM for every request. AM must be configured to issue stateless (JWT) access
+// tokens that are signed with an asymmetric key.
+//
+// This example shows how a gateway validates the access tokens presented by its child devices:
+//
+//    amURL, _ := url.Parse("https://am.example.com:8443/am")
+//    validator := accesstoken.Validator{
+//        Keys:     &accesstoken.KeySet{URL: amURL, Realm: "/all-the-things"},
+//        Audience: "gateway-client",
+//    }
+//
+//    token, err := validator.Validate(accessToken)
+//    if err != nil || !token.HasScope("publish") {
+//        // reject the request
+//    }
+//    log.Printf("request made by %s", token.Subject)
+//
+package accesstoken
@@ -0,0 +1,66 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package amtest provides a mock of the AM endpoints used by the SDK, so that device code built with the SDK can be
+// unit tested without a live AM. The server authenticates and registers things with scripted authentication trees,
+// issues sessions and access tokens, and serves attributes and policy decisions from in-memory state. Failures and
+// latency can be injected to test how the device code handles an unreliable AM.
+//
+// This example shows how to test a thing that registers itself on first use:
+//
+//    server := &amtest.Server{
+//        Realm: "/things",
+//        Trees: map[string]amtest.Tree{
+//            "reg-tree": {amtest.AuthenticateThing{}, amtest.RegisterThing{}},
+//        },
+//    }
+//    server.Start()
+//    defer server.Close()
+//
+//    device, err := builder.Thing().
+//        ConnectTo(server.URL()).
+//        InRealm("/things").
+//        WithTree("reg-tree").
+//        AuthenticateThing("thing-1", "/things", keyID, key, nil).
+//        RegisterThing(certificates, nil).
+//        Create()
+//
+//    if _, ok := server.Thing("thing-1"); !ok {
+//        t.Error("thing not registered")
+//    }
+//
+// Custom tree nodes are scripted with a Scripted step, which sends the given callbacks and verifies the responses of
+// the thing. Requests fail with an AM error when the function passed to SetFail returns a Failure, for example to test
+// throttling:
+//
+//    server.SetFail(func(r *http.Request) *amtest.Failure {
+//        if r.URL.Query().Get("_action") == "get_access_token" {
+//            return &amtest.Failure{Code: http.StatusTooManyRequests, RetryAfter: time.Second}
+//        }
+//        return nil
+//    })
+//
+// A Failure can also drop the connection, return malformed JSON or delay the response. MidAuthentication identifies
+// the requests that continue an authentication, so that a failure can be injected in the middle of a handshake.
+//
+// A thing of type "service" can impersonate another thing for which the key of the service is registered, see
+// Thing.Impersonate. AuthenticateThing checks that the actor named in the act claim is a service that owns the signing
+// key, as the impersonation script does, and the server records the actor in its audit log, see Server.AuditEvents.
+//
+// Attributes are returned with an ETag, and a request with the ETag of the current attributes in its If-None-Match
+// header receives a 304 Not Modified response, see Thing.RequestAttributesIfChanged.
+//
+package amtest
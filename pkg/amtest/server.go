@@ -0,0 +1,790 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package amtest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/jws"
+	"github.com/JacoJooste/iot-edge/v7/pkg/callback"
+	"github.com/dchest/uniuri"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	// DefaultCookieName is the name of the session cookie used if Server.CookieName is empty
+	DefaultCookieName = "iPlanetDirectoryPro"
+	// AccessTokenAudience is the audience of the access tokens issued by the mock server
+	AccessTokenAudience = "forgerock-iot-oauth2-client"
+	// issuerKeyID is the key ID of the key that signs access tokens
+	issuerKeyID = "amtest"
+	// defaultAccessTokenLifetime is the lifetime of access tokens if Server.AccessTokenLifetime is not set
+	defaultAccessTokenLifetime = time.Hour
+	// sessionIdleTimeout and sessionLifetime are the expiry times reported for sessions
+	sessionIdleTimeout = 30 * time.Minute
+	sessionLifetime    = 2 * time.Hour
+)
+
+// Failure is an error that the mock server returns instead of processing a request
+type Failure struct {
+	// Code is the HTTP status code of the response
+	Code    int
+	Message string
+	// RetryAfter is optional and is returned in the Retry-After header
+	RetryAfter time.Duration
+	// Delay is optional and is added before the failure is returned
+	Delay time.Duration
+	// Drop closes the connection without a response, as if the network failed. The code is ignored.
+	Drop bool
+	// Malformed returns a successful response with a body that is not valid JSON. The code is ignored.
+	Malformed bool
+}
+
+// MidAuthentication returns true if the request continues an authentication that is in progress, so that a failure
+// can be injected in the middle of a multi-step authentication
+func MidAuthentication(r *http.Request) bool {
+	if r.URL.Path != "/json/authenticate" || r.Body == nil {
+		return false
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+	var request authenticationRequest
+	return json.Unmarshal(body, &request) == nil && request.AuthID != ""
+}
+
+// Thing is an identity known to the mock server
+type Thing struct {
+	ID   string
+	Type string
+	// Keys are the public keys registered for the thing
+	Keys jose.JSONWebKeySet
+	// Attributes are returned by attribute requests made by the thing and written by its update requests
+	Attributes map[string][]string
+}
+
+// authState is the state of an authentication that is in progress
+type authState struct {
+	tree Tree
+	step int
+	auth *Authentication
+}
+
+// Server is a mock AM server. The exported fields must be set before the server is started.
+type Server struct {
+	// Realm is optional. If set, authentication requests must be made to the realm.
+	Realm string
+	// RealmAliases are optional aliases of the realm. Server information requests resolve an alias, or no realm as
+	// with a DNS alias, to the realm.
+	RealmAliases []string
+	// Trees contains the authentication trees by name
+	Trees map[string]Tree
+	// Policies is optional and returns the actions that a thing is allowed to perform on a resource. All actions are
+	// denied if nil.
+	Policies func(thingID, resource string) map[string]bool
+	// AccessTokenLifetime is the lifetime of issued access tokens. Defaults to one hour.
+	AccessTokenLifetime time.Duration
+	// CookieName is the name of the session cookie. Defaults to DefaultCookieName.
+	CookieName string
+
+	mutex           sync.Mutex
+	server          *httptest.Server
+	key             *ecdsa.PrivateKey
+	fail            func(r *http.Request) *Failure
+	latency         time.Duration
+	things          map[string]Thing
+	authentications map[string]*authState
+	sessions        map[string]sessionState
+	audit           []AuditEvent
+}
+
+// AuditEvent is an entry of the audit log of the server, recorded when a session is created
+type AuditEvent struct {
+	// ThingID is the ID of the authenticated thing
+	ThingID string
+	// ImpersonatedBy is the ID of the service that impersonates the thing, if any
+	ImpersonatedBy string
+}
+
+// sessionState records the owner and creation time of a session
+type sessionState struct {
+	thingID string
+	created time.Time
+}
+
+// Start starts the mock server
+func (s *Server) Start() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.server != nil {
+		return
+	}
+	s.key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if s.things == nil {
+		s.things = make(map[string]Thing)
+	}
+	s.authentications = make(map[string]*authState)
+	s.sessions = make(map[string]sessionState)
+	if s.CookieName == "" {
+		s.CookieName = DefaultCookieName
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/json/serverinfo/", s.serverInfo)
+	mux.HandleFunc("/json/authenticate", s.authenticate)
+	mux.HandleFunc("/json/sessions", s.session)
+	mux.HandleFunc("/json/things/", s.thingRequest)
+	mux.HandleFunc("/json/policies", s.policies)
+	mux.HandleFunc("/oauth2/.well-known/openid-configuration", s.openIDConfiguration)
+	mux.HandleFunc("/oauth2/connect/jwk_uri", s.jwks)
+	s.server = httptest.NewServer(s.inject(mux))
+}
+
+// Close shuts down the mock server
+func (s *Server) Close() {
+	s.mutex.Lock()
+	server := s.server
+	s.mutex.Unlock()
+	if server != nil {
+		server.Close()
+	}
+}
+
+// URL returns the URL of the mock server, to which the thing must connect
+func (s *Server) URL() *url.URL {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.server == nil {
+		return nil
+	}
+	u, _ := url.Parse(s.server.URL)
+	return u
+}
+
+// SetFail sets the function that is called before every request is processed. The request fails with the returned
+// failure unless it is nil. Can be called while the server is running.
+func (s *Server) SetFail(fail func(r *http.Request) *Failure) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.fail = fail
+}
+
+// SetLatency sets the delay that is added before every request is processed. Can be called while the server is
+// running.
+func (s *Server) SetLatency(latency time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.latency = latency
+}
+
+// AddThing adds the thing to the mock server, replacing any thing with the same ID
+func (s *Server) AddThing(thing Thing) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.things == nil {
+		s.things = make(map[string]Thing)
+	}
+	s.things[thing.ID] = thing
+}
+
+// Thing returns the thing with the given ID
+func (s *Server) Thing(id string) (Thing, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	thing, ok := s.things[id]
+	return thing, ok
+}
+
+// AuditEvents returns the audit log of the server in the order in which the events were recorded
+func (s *Server) AuditEvents() []AuditEvent {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]AuditEvent(nil), s.audit...)
+}
+
+// ExpireSessions invalidates all sessions, forcing the things to authenticate again
+func (s *Server) ExpireSessions() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sessions = make(map[string]sessionState)
+}
+
+// register registers the public keys for the thing, creating the thing if it does not exist
+func (s *Server) register(id, thingType string, keys ...jose.JSONWebKey) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	thing, ok := s.things[id]
+	if !ok {
+		thing = Thing{ID: id, Type: thingType}
+	}
+	for _, key := range keys {
+		public := key.Public()
+		public.Use = "sig"
+		thing.Keys.Keys = append(thing.Keys.Keys, public)
+	}
+	s.things[id] = thing
+}
+
+// inject adds the configured latency and failures to the handler
+func (s *Server) inject(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		fail, latency := s.fail, s.latency
+		s.mutex.Unlock()
+		if latency > 0 {
+			time.Sleep(latency)
+		}
+		if fail != nil {
+			if failure := fail(r); failure != nil {
+				writeFailure(w, failure)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// writeFailure writes the response of an injected failure
+func writeFailure(w http.ResponseWriter, failure *Failure) {
+	if failure.Delay > 0 {
+		time.Sleep(failure.Delay)
+	}
+	switch {
+	case failure.Drop:
+		if hijacker, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hijacker.Hijack(); err == nil {
+				_ = conn.Close()
+				return
+			}
+		}
+		panic(http.ErrAbortHandler)
+	case failure.Malformed:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"malformed":`))
+		return
+	}
+	if failure.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(failure.RetryAfter.Seconds()))))
+	}
+	writeError(w, failure.Code, failure.Message)
+}
+
+// writeError writes an error response in the format used by AM
+func writeError(w http.ResponseWriter, code int, message string) {
+	if message == "" {
+		message = http.StatusText(code)
+	}
+	writeJSON(w, code, map[string]interface{}{"code": code, "reason": http.StatusText(code), "message": message})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) serverInfo(w http.ResponseWriter, r *http.Request) {
+	info := map[string]string{"cookieName": s.CookieName}
+	if s.Realm != "" {
+		if realm := r.URL.Query().Get("realm"); realm != "" && realm != s.Realm && !s.isRealmAlias(realm) {
+			writeError(w, http.StatusNotFound, "Realm not found, "+realm)
+			return
+		}
+		info["realm"] = s.Realm
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// isRealmAlias returns true if the name is an alias of the realm
+func (s *Server) isRealmAlias(name string) bool {
+	for _, alias := range s.RealmAliases {
+		if alias == name {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticationRequest is the body of an authentication request
+type authenticationRequest struct {
+	AuthID    string              `json:"authId"`
+	Callbacks []callback.Callback `json:"callbacks"`
+}
+
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "")
+		return
+	}
+	query := r.URL.Query()
+	if s.Realm != "" && query.Get("realm") != s.Realm {
+		writeError(w, http.StatusBadRequest, "Invalid realm, "+query.Get("realm"))
+		return
+	}
+	var request authenticationRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var state *authState
+	if request.AuthID == "" {
+		tree, ok := s.Trees[query.Get("authIndexValue")]
+		if !ok {
+			writeError(w, http.StatusBadRequest, "No configuration found")
+			return
+		}
+		state = &authState{tree: tree, step: -1, auth: &Authentication{Challenge: newChallenge(), server: s}}
+	} else {
+		s.mutex.Lock()
+		state = s.authentications[request.AuthID]
+		delete(s.authentications, request.AuthID)
+		s.mutex.Unlock()
+		if state == nil {
+			writeError(w, http.StatusUnauthorized, "Login failure")
+			return
+		}
+		if err := state.tree[state.step].Verify(state.auth, request.Callbacks); err != nil {
+			writeError(w, http.StatusUnauthorized, "Login failure: "+err.Error())
+			return
+		}
+	}
+
+	// send the callbacks of the next step that is not skipped
+	for state.step++; state.step < len(state.tree); state.step++ {
+		callbacks := state.tree[state.step].Callbacks(state.auth)
+		if len(callbacks) == 0 {
+			continue
+		}
+		authID := uniuri.NewLen(32)
+		s.mutex.Lock()
+		s.authentications[authID] = state
+		s.mutex.Unlock()
+		writeJSON(w, http.StatusOK, authenticationRequest{AuthID: authID, Callbacks: callbacks})
+		return
+	}
+	if state.auth.ThingID == "" {
+		writeError(w, http.StatusUnauthorized, "Login failure")
+		return
+	}
+	token := uniuri.NewLen(32)
+	s.mutex.Lock()
+	s.sessions[token] = sessionState{thingID: state.auth.ThingID, created: time.Now()}
+	s.audit = append(s.audit, AuditEvent{ThingID: state.auth.ThingID, ImpersonatedBy: state.auth.actor})
+	s.mutex.Unlock()
+	writeJSON(w, http.StatusOK, map[string]string{"tokenId": token, "successUrl": "/am/console", "realm": s.Realm})
+}
+
+// sessionToken returns the session token sent in the session cookie or header
+func (s *Server) sessionToken(r *http.Request) string {
+	if cookie, err := r.Cookie(s.CookieName); err == nil {
+		return cookie.Value
+	}
+	return r.Header.Get(s.CookieName)
+}
+
+// sessionThing returns the thing that owns the session of the request
+func (s *Server) sessionThing(r *http.Request) (Thing, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	state, ok := s.sessions[s.sessionToken(r)]
+	if !ok {
+		return Thing{}, false
+	}
+	thing, ok := s.things[state.thingID]
+	if !ok {
+		// authenticated identities that have not been added or registered, such as users
+		thing = Thing{ID: state.thingID}
+	}
+	return thing, true
+}
+
+func (s *Server) session(w http.ResponseWriter, r *http.Request) {
+	token := s.sessionToken(r)
+	s.mutex.Lock()
+	state, valid := s.sessions[token]
+	s.mutex.Unlock()
+	switch r.URL.Query().Get("_action") {
+	case "validate":
+		writeJSON(w, http.StatusOK, map[string]bool{"valid": valid})
+	case "logout":
+		if !valid {
+			writeError(w, http.StatusUnauthorized, "Access Denied")
+			return
+		}
+		s.mutex.Lock()
+		delete(s.sessions, token)
+		s.mutex.Unlock()
+		writeJSON(w, http.StatusOK, map[string]string{"result": "Successfully logged out"})
+	case "getSessionInfo":
+		if !valid {
+			writeError(w, http.StatusUnauthorized, "Access Denied")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{
+			"username":                 state.thingID,
+			"realm":                    s.Realm,
+			"maxIdleExpirationTime":    time.Now().Add(sessionIdleTimeout).UTC().Format(time.RFC3339),
+			"maxSessionExpirationTime": state.created.Add(sessionLifetime).UTC().Format(time.RFC3339),
+		})
+	default:
+		writeError(w, http.StatusBadRequest, "Unknown action")
+	}
+}
+
+// requestPayload returns the JSON payload of a request, which is sent in a JWT signed with the key of the thing when
+// the thing authenticated with its key
+func (s *Server) requestPayload(r *http.Request, thing Thing) ([]byte, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil || len(body) == 0 {
+		return nil, err
+	}
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/jose") {
+		return body, nil
+	}
+	var payload []byte
+	err = errors.New("no registered keys")
+	for _, key := range thing.Keys.Keys {
+		if payload, err = verifyCompact(string(body), key.Key); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	var csrf struct {
+		CSRF string `json:"csrf"`
+	}
+	if err = json.Unmarshal(payload, &csrf); err != nil {
+		return nil, err
+	}
+	if csrf.CSRF != s.sessionToken(r) {
+		return nil, errors.New("incorrect csrf claim")
+	}
+	return payload, nil
+}
+
+// verifyCompact verifies the signature of a JWS in compact serialisation and returns its payload. The JWS is not
+// parsed with go-jose since it rejects the numeric nonce header sent by things in signed requests.
+func verifyCompact(token string, key interface{}) ([]byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed JWS")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(raw, &header); err != nil {
+		return nil, err
+	}
+	if len(header.Alg) < 5 {
+		return nil, fmt.Errorf("unsupported algorithm %s", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	input := []byte(parts[0] + "." + parts[1])
+	var hash crypto.Hash
+	switch header.Alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	}
+	var valid bool
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		valid = header.Alg == string(jose.EdDSA) && ed25519.Verify(k, input, signature)
+	case *ecdsa.PublicKey:
+		if strings.HasPrefix(header.Alg, "ES") && hash.Available() && len(signature)%2 == 0 {
+			h := hash.New()
+			h.Write(input)
+			size := len(signature) / 2
+			valid = ecdsa.Verify(k, h.Sum(nil), new(big.Int).SetBytes(signature[:size]),
+				new(big.Int).SetBytes(signature[size:]))
+		}
+	case *rsa.PublicKey:
+		if hash.Available() {
+			h := hash.New()
+			h.Write(input)
+			switch header.Alg[:2] {
+			case "RS":
+				valid = rsa.VerifyPKCS1v15(k, hash, h.Sum(nil), signature) == nil
+			case "PS":
+				valid = rsa.VerifyPSS(k, hash, h.Sum(nil), signature, nil) == nil
+			}
+		}
+	}
+	if !valid {
+		return nil, errors.New("invalid signature")
+	}
+	return base64.RawURLEncoding.DecodeString(parts[1])
+}
+
+func (s *Server) thingRequest(w http.ResponseWriter, r *http.Request) {
+	thing, ok := s.sessionThing(r)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "Access Denied")
+		return
+	}
+	payload, err := s.requestPayload(r, thing)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	switch {
+	case r.Method == http.MethodPost && r.URL.Query().Get("_action") == "get_access_token":
+		s.accessToken(w, r, thing, payload)
+	case r.Method == http.MethodGet:
+		s.attributes(w, r, thing)
+	case r.Method == http.MethodPut && r.URL.Query().Get("_action") == "update":
+		s.updateAttributes(w, r, thing, payload)
+	default:
+		writeError(w, http.StatusBadRequest, "Unknown action")
+	}
+}
+
+func (s *Server) accessToken(w http.ResponseWriter, r *http.Request, thing Thing, payload []byte) {
+	var request struct {
+		Scope []string `json:"scope"`
+	}
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, &request); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	lifetime := s.AccessTokenLifetime
+	if lifetime <= 0 {
+		lifetime = defaultAccessTokenLifetime
+	}
+	now := time.Now()
+	claims := struct {
+		jwt.Claims
+		Scope     []string `json:"scope,omitempty"`
+		TokenName string   `json:"tokenName"`
+		CNF       *struct {
+			JWK jose.JSONWebKey `json:"jwk"`
+		} `json:"cnf,omitempty"`
+	}{
+		Claims: jwt.Claims{
+			Issuer:   s.URL().String() + "/oauth2",
+			Subject:  thing.ID,
+			Audience: jwt.Audience{AccessTokenAudience},
+			IssuedAt: jwt.NewNumericDate(now),
+			Expiry:   jwt.NewNumericDate(now.Add(lifetime)),
+			ID:       uniuri.New(),
+		},
+		Scope:     request.Scope,
+		TokenName: "access_token",
+	}
+	// bind the token to the key of the thing if it made a signed request
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/jose") && len(thing.Keys.Keys) > 0 {
+		claims.CNF = &struct {
+			JWK jose.JSONWebKey `json:"jwk"`
+		}{JWK: thing.Keys.Keys[0].Public()}
+	}
+	opts := &jose.SignerOptions{}
+	opts.WithHeader("kid", issuerKeyID)
+	sig, err := jws.NewSigner(s.key, opts)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	token, err := jwt.Signed(sig).Claims(claims).CompactSerialize()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": token,
+		"scope":        strings.Join(request.Scope, " "),
+		"token_type":   "Bearer",
+		"expires_in":   int64(lifetime.Seconds()),
+	})
+}
+
+func (s *Server) attributes(w http.ResponseWriter, r *http.Request, thing Thing) {
+	response := map[string]interface{}{"_id": thing.ID}
+	var fields []string
+	if f := r.URL.Query().Get("_fields"); f != "" {
+		fields = strings.Split(f, ",")
+	}
+	for name, values := range thing.Attributes {
+		if len(fields) > 0 && !contains(fields, name) {
+			continue
+		}
+		response[name] = values
+	}
+	// the attributes are tagged with their content so that a thing can read them conditionally
+	b, err := json.Marshal(response)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sum := sha256.Sum256(b)
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(b)
+}
+
+// updateAttributes writes the attributes in the payload that have an array of strings as value. Other claims of a
+// signed request, such as the CSRF claim, are ignored.
+func (s *Server) updateAttributes(w http.ResponseWriter, r *http.Request, thing Thing, payload []byte) {
+	var update map[string]interface{}
+	if err := json.Unmarshal(payload, &update); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.mutex.Lock()
+	if registered, ok := s.things[thing.ID]; ok {
+		thing = registered
+	}
+	attributes := make(map[string][]string, len(thing.Attributes))
+	for name, values := range thing.Attributes {
+		attributes[name] = values
+	}
+	for name, value := range update {
+		array, ok := value.([]interface{})
+		if !ok {
+			continue
+		}
+		values := make([]string, 0, len(array))
+		for _, v := range array {
+			if str, ok := v.(string); ok {
+				values = append(values, str)
+			}
+		}
+		attributes[name] = values
+	}
+	thing.Attributes = attributes
+	s.things[thing.ID] = thing
+	s.mutex.Unlock()
+	s.attributes(w, r, thing)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) policies(w http.ResponseWriter, r *http.Request) {
+	thing, ok := s.sessionThing(r)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "Access Denied")
+		return
+	}
+	if r.URL.Query().Get("_action") != "evaluate" {
+		writeError(w, http.StatusBadRequest, "Unknown action")
+		return
+	}
+	payload, err := s.requestPayload(r, thing)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var request struct {
+		Resources []string `json:"resources"`
+		Subject   *struct {
+			SSOToken string `json:"ssoToken"`
+		} `json:"subject"`
+	}
+	if err = json.Unmarshal(payload, &request); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// things are not privileged to evaluate the policies of other subjects
+	if request.Subject != nil && request.Subject.SSOToken != s.sessionToken(r) {
+		writeError(w, http.StatusForbidden, "Subject does not match the session")
+		return
+	}
+	decisions := make([]map[string]interface{}, 0, len(request.Resources))
+	for _, resource := range request.Resources {
+		actions := map[string]bool{}
+		if s.Policies != nil {
+			if allowed := s.Policies(thing.ID, resource); allowed != nil {
+				actions = allowed
+			}
+		}
+		decisions = append(decisions, map[string]interface{}{
+			"resource":   resource,
+			"actions":    actions,
+			"attributes": map[string]interface{}{},
+			"advices":    map[string]interface{}{},
+			"ttl":        int64(math.MaxInt64),
+		})
+	}
+	writeJSON(w, http.StatusOK, decisions)
+}
+
+func (s *Server) openIDConfiguration(w http.ResponseWriter, r *http.Request) {
+	base := s.URL().String()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":   base + "/oauth2",
+		"jwks_uri": base + "/oauth2/connect/jwk_uri",
+		"request_object_signing_alg_values_supported": []string{"ES256", "ES384", "ES512", "PS256", "PS384", "PS512",
+			"EdDSA"},
+	})
+}
+
+func (s *Server) jwks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: s.key.Public(), KeyID: issuerKeyID, Use: "sig", Algorithm: string(jose.ES256)},
+	}})
+}
@@ -0,0 +1,531 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package amtest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/pkg/accesstoken"
+	"github.com/JacoJooste/iot-edge/v7/pkg/builder"
+	"github.com/JacoJooste/iot-edge/v7/pkg/callback"
+	"github.com/JacoJooste/iot-edge/v7/pkg/thing"
+	"gopkg.in/square/go-jose.v2"
+)
+
+func testServer() *Server {
+	server := &Server{
+		Trees: map[string]Tree{
+			"reg-tree": {AuthenticateThing{}, RegisterThing{}},
+			"scripted-tree": {Scripted{
+				Send: func(auth *Authentication) []callback.Callback {
+					return []callback.Callback{hiddenValue("custom", auth.Challenge)}
+				},
+				Check: func(auth *Authentication, responses []callback.Callback) error {
+					value, err := inputValue(responses, callback.TypeHiddenValueCallback, "custom")
+					if err != nil {
+						return err
+					}
+					if value != "answer:"+auth.Challenge {
+						return errors.New("incorrect answer")
+					}
+					auth.ThingID = "scripted-thing"
+					return nil
+				},
+			}},
+		},
+	}
+	server.Start()
+	return server
+}
+
+func testKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func testThing(t *testing.T, server *Server, id string, key *ecdsa.PrivateKey) thing.Thing {
+	device, err := builder.Thing().
+		ConnectTo(server.URL()).
+		WithTree("reg-tree").
+		AuthenticateThing(id, "", "key-1", key, nil).
+		RegisterThing(nil, nil).
+		Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return device
+}
+
+func TestServer_RegisterThing(t *testing.T) {
+	server := testServer()
+	defer server.Close()
+
+	key := testKey(t)
+	testThing(t, server, "thing-1", key)
+	registered, ok := server.Thing("thing-1")
+	if !ok {
+		t.Fatal("thing not registered")
+	}
+	if len(registered.Keys.Key("key-1")) != 1 || registered.Type != string(callback.TypeDevice) {
+		t.Errorf("unexpected registration %+v", registered)
+	}
+
+	// the registered key authenticates the thing without registering it again
+	testThing(t, server, "thing-1", key)
+	registered, _ = server.Thing("thing-1")
+	if len(registered.Keys.Keys) != 1 {
+		t.Errorf("expected a single key, got %d", len(registered.Keys.Keys))
+	}
+}
+
+func TestServer_RegisterThing_AttributeMapping(t *testing.T) {
+	server := testServer()
+	defer server.Close()
+
+	key := testKey(t)
+	create := func() error {
+		_, err := builder.Thing().
+			ConnectTo(server.URL()).
+			WithTree("reg-tree").
+			AuthenticateThing("thing-1", "", "key-1", key, nil).
+			RegisterThing(nil, func() interface{} {
+				return map[string]interface{}{"serialNumber": "987654321", "sensors": []string{"t", "h"}}
+			}).
+			MapClaimsToAttributes(thing.AttributeMapping{"serialNumber": "employeeNumber", "sensors": "sensorTypes"}).
+			Create()
+		return err
+	}
+	if err := create(); err != nil {
+		t.Fatal(err)
+	}
+	registered, _ := server.Thing("thing-1")
+	if !reflect.DeepEqual(registered.Attributes, map[string][]string{
+		"employeeNumber": {"987654321"}, "sensorTypes": {"t", "h"}}) {
+		t.Errorf("unexpected attributes %v", registered.Attributes)
+	}
+
+	// the attributes are only written when the thing is registered
+	registered.Attributes = map[string][]string{"employeeNumber": {"changed"}}
+	server.AddThing(registered)
+	if err := create(); err != nil {
+		t.Fatal(err)
+	}
+	if registered, _ = server.Thing("thing-1"); registered.Attributes["employeeNumber"][0] != "changed" {
+		t.Errorf("expected the attributes to be kept; got %v", registered.Attributes)
+	}
+}
+
+func TestServer_RegisterThing_PreSharedKey(t *testing.T) {
+	psk := bytes.Repeat([]byte{7}, 32)
+	server := &Server{Trees: map[string]Tree{
+		"psk-tree": {AuthenticateThing{}, RegisterThing{PreSharedKeys: map[string][]byte{"factory-1": psk}}},
+	}}
+	server.Start()
+	defer server.Close()
+
+	tests := []struct {
+		name  string
+		id    string
+		key   []byte
+		valid bool
+	}{
+		{name: "valid", id: "factory-1", key: psk, valid: true},
+		{name: "wrong-key", id: "factory-1", key: bytes.Repeat([]byte{8}, 32)},
+		{name: "unknown-id", id: "factory-2", key: psk},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			_, err := builder.Thing().
+				ConnectTo(server.URL()).
+				WithTree("psk-tree").
+				AuthenticateThing("thing-"+subtest.name, "", "key-1", testKey(t), nil).
+				RegisterThing(nil, nil).
+				WithPreSharedKey(subtest.id, subtest.key).
+				Create()
+			if subtest.valid != (err == nil) {
+				t.Fatalf("expected valid %v; got error %v", subtest.valid, err)
+			}
+			if _, ok := server.Thing("thing-" + subtest.name); ok != subtest.valid {
+				t.Errorf("expected registered %v", subtest.valid)
+			}
+		})
+	}
+}
+
+func TestServer_AccessToken(t *testing.T) {
+	server := testServer()
+	defer server.Close()
+
+	device := testThing(t, server, "thing-1", testKey(t))
+	response, err := device.RequestAccessToken("publish", "subscribe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessToken, err := response.AccessToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	validator := accesstoken.Validator{
+		Keys:     &accesstoken.KeySet{URL: server.URL()},
+		Audience: AccessTokenAudience,
+	}
+	token, err := validator.Validate(accessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Subject != "thing-1" || !token.HasScope("publish") || !token.HasScope("subscribe") {
+		t.Errorf("unexpected token %+v", token)
+	}
+}
+
+func TestServer_Attributes(t *testing.T) {
+	server := testServer()
+	defer server.Close()
+
+	device := testThing(t, server, "thing-1", testKey(t))
+	registered, _ := server.Thing("thing-1")
+	registered.Attributes = map[string][]string{"thingConfig": {"config"}, "serialNumber": {"1234"}}
+	server.AddThing(registered)
+
+	response, err := device.RequestAttributes("thingConfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var attributes struct {
+		ID     string   `attribute:"_id"`
+		Config []string `attribute:"thingConfig"`
+	}
+	if err = response.Unmarshal(&attributes); err != nil {
+		t.Fatal(err)
+	}
+	if attributes.ID != "thing-1" {
+		t.Errorf("unexpected ID %s", attributes.ID)
+	}
+	if len(attributes.Config) != 1 || attributes.Config[0] != "config" {
+		t.Errorf("unexpected config %v", attributes.Config)
+	}
+	if response.Has("serialNumber") {
+		t.Error("expected serial number to be filtered out")
+	}
+}
+
+func TestServer_Impersonation(t *testing.T) {
+	server := testServer()
+	defer server.Close()
+
+	testThing(t, server, "thing-1", testKey(t))
+	key := testKey(t)
+	service, err := builder.Thing().
+		ConnectTo(server.URL()).
+		WithTree("reg-tree").
+		AsService().
+		AuthenticateThing("fleet-manager", "", "service-key", key, nil).
+		RegisterThing(nil, nil).
+		Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the service can not impersonate a thing for which its key is not registered
+	if _, err = service.Impersonate("thing-1"); err == nil {
+		t.Error("expected the impersonation to fail without the key of the service")
+	}
+	registered, _ := server.Thing("thing-1")
+	registered.Attributes = map[string][]string{"thingConfig": {"config"}}
+	registered.Keys.Keys = append(registered.Keys.Keys, jose.JSONWebKey{Key: key.Public(), KeyID: "service-key"})
+	server.AddThing(registered)
+
+	impersonation, err := service.Impersonate("thing-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := impersonation.RequestAttributes("thingConfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := response.ID(); id != "thing-1" || !response.Has("thingConfig") {
+		t.Errorf("unexpected attributes %v", response.Content)
+	}
+	events := server.AuditEvents()
+	if last := events[len(events)-1]; last != (AuditEvent{ThingID: "thing-1", ImpersonatedBy: "fleet-manager"}) {
+		t.Errorf("unexpected audit event %+v", last)
+	}
+
+	// a device can not impersonate another thing, even with a key that is registered for the thing
+	deviceKey := testKey(t)
+	server.register("thing-2", string(callback.TypeDevice), jose.JSONWebKey{Key: deviceKey.Public(), KeyID: "device-key"})
+	registered, _ = server.Thing("thing-1")
+	registered.Keys.Keys = append(registered.Keys.Keys, jose.JSONWebKey{Key: deviceKey.Public(), KeyID: "device-key"})
+	server.AddThing(registered)
+	device, err := builder.Thing().
+		ConnectTo(server.URL()).
+		WithTree("reg-tree").
+		AsService().
+		AuthenticateThing("thing-2", "", "device-key", deviceKey, nil).
+		Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = device.Impersonate("thing-1"); err == nil {
+		t.Error("expected a device to be unable to impersonate a thing")
+	}
+}
+
+func TestServer_SetFail(t *testing.T) {
+	server := testServer()
+	defer server.Close()
+
+	device := testThing(t, server, "thing-1", testKey(t))
+	server.SetFail(func(r *http.Request) *Failure {
+		if r.URL.Query().Get("_action") == "get_access_token" {
+			return &Failure{Code: http.StatusServiceUnavailable}
+		}
+		return nil
+	})
+	if _, err := device.RequestAccessToken("publish"); err == nil {
+		t.Fatal("expected the request to fail")
+	}
+
+	server.SetFail(nil)
+	if _, err := device.RequestAccessToken("publish"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_StaticAMInfo(t *testing.T) {
+	server := testServer()
+	defer server.Close()
+
+	info, err := thing.DiscoverAMInfo(server.URL(), "", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.CookieName != DefaultCookieName || info.ThingsVersion == "" {
+		t.Errorf("unexpected AM info %+v", info)
+	}
+
+	// the thing does not discover the information when it is provided
+	server.SetFail(func(r *http.Request) *Failure {
+		if strings.HasPrefix(r.URL.Path, "/json/serverinfo") {
+			return &Failure{Code: http.StatusServiceUnavailable}
+		}
+		return nil
+	})
+	_, err = builder.Thing().
+		ConnectTo(server.URL()).
+		WithTree("reg-tree").
+		AuthenticateThing("thing-1", "", "key-1", testKey(t), nil).
+		RegisterThing(nil, nil).
+		WithAMInfo(info).
+		Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_ExpireSessions(t *testing.T) {
+	server := testServer()
+	defer server.Close()
+
+	device := testThing(t, server, "thing-1", testKey(t))
+	server.ExpireSessions()
+	// the thing authenticates again when its session is no longer valid
+	if _, err := device.RequestAccessToken("publish"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_Session(t *testing.T) {
+	server := testServer()
+	defer server.Close()
+
+	device := testThing(t, server, "thing-1", testKey(t))
+	info, err := device.Session()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Token == "" || !info.Restricted {
+		t.Errorf("expected a restricted session with a token; got %+v", info)
+	}
+	if !info.MaxIdleExpiration.After(time.Now()) || !info.MaxSessionExpiration.After(info.MaxIdleExpiration) {
+		t.Errorf("unexpected session expiry times; got %+v", info)
+	}
+	server.ExpireSessions()
+	renewed, err := device.Session()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed.Token == info.Token {
+		t.Error("expected the session to be renewed")
+	}
+}
+
+func TestServer_RealmAlias(t *testing.T) {
+	server := &Server{
+		Realm:        "/alfheim/svartalfheim",
+		RealmAliases: []string{"svartalfheim"},
+		Trees:        map[string]Tree{"reg-tree": {AuthenticateThing{}, RegisterThing{}}},
+	}
+	server.Start()
+	defer server.Close()
+
+	// the alias, or no realm as with a DNS alias, is resolved to the realm
+	key := testKey(t)
+	for _, realm := range []string{"svartalfheim", ""} {
+		device, err := builder.Thing().
+			ConnectTo(server.URL()).
+			InRealm(realm).
+			WithTree("reg-tree").
+			AuthenticateThing("thing-1", "", "key-1", key, nil).
+			RegisterThing(nil, nil).
+			Create()
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := device.Session()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Realm != server.Realm {
+			t.Errorf("expected realm %s; got %s", server.Realm, info.Realm)
+		}
+	}
+
+	_, err := builder.Thing().
+		ConnectTo(server.URL()).
+		InRealm("unknown").
+		WithTree("reg-tree").
+		AuthenticateThing("thing-1", "", "key-1", key, nil).
+		Create()
+	if err == nil {
+		t.Error("expected an unknown realm to fail")
+	}
+}
+
+// answerHandler answers the custom callback of the scripted tree
+type answerHandler struct{}
+
+func (h answerHandler) Handle(cb callback.Callback) (bool, error) {
+	if cb.ID() != "custom" {
+		return false, nil
+	}
+	value, ok := cb.OutputEntry("value")
+	if !ok {
+		return true, errors.New("no value")
+	}
+	cb.Input[0].Value = "answer:" + value.Value
+	return true, nil
+}
+
+func TestServer_Scripted(t *testing.T) {
+	server := testServer()
+	defer server.Close()
+
+	_, err := builder.Thing().
+		ConnectTo(server.URL()).
+		WithTree("scripted-tree").
+		HandleCallbacksWith(answerHandler{}).
+		Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_FaultInjection(t *testing.T) {
+	tests := []struct {
+		name    string
+		failure Failure
+	}{
+		{name: "drop", failure: Failure{Drop: true}},
+		{name: "malformed", failure: Failure{Malformed: true}},
+		{name: "delayed-error", failure: Failure{Code: http.StatusBadGateway, Delay: 10 * time.Millisecond}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			server := testServer()
+			defer server.Close()
+
+			key := testKey(t)
+			testThing(t, server, "thing-1", key)
+			// fail the second step of the authentication, after the thing has received the challenge
+			server.SetFail(func(r *http.Request) *Failure {
+				if MidAuthentication(r) {
+					return &subtest.failure
+				}
+				return nil
+			})
+			_, err := builder.Thing().
+				ConnectTo(server.URL()).
+				WithTree("reg-tree").
+				AuthenticateThing("thing-1", "", "key-1", key, nil).
+				Create()
+			if err == nil {
+				t.Fatal("expected the authentication to fail")
+			}
+
+			// the thing can authenticate once the fault has cleared
+			server.SetFail(nil)
+			testThing(t, server, "thing-1", key)
+		})
+	}
+}
+
+func TestServer_ConditionalAttributes(t *testing.T) {
+	server := testServer()
+	defer server.Close()
+
+	device := testThing(t, server, "thing-1", testKey(t))
+	registered, _ := server.Thing("thing-1")
+	registered.Attributes = map[string][]string{"thingConfig": {"config"}}
+	server.AddThing(registered)
+
+	first, changed, err := device.RequestAttributesIfChanged("", "thingConfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed || first.Revision == "" || !first.Has("thingConfig") {
+		t.Fatalf("expected the attributes with a revision; got %v, %v", first, changed)
+	}
+	second, changed, err := device.RequestAttributesIfChanged(first.Revision, "thingConfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed || second.Revision != first.Revision || second.Has("thingConfig") {
+		t.Errorf("expected the attributes to be unchanged; got %v, %v", second, changed)
+	}
+
+	registered.Attributes = map[string][]string{"thingConfig": {"new config"}}
+	server.AddThing(registered)
+	third, changed, err := device.RequestAttributesIfChanged(first.Revision, "thingConfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config, _ := third.GetString("thingConfig"); !changed || third.Revision == first.Revision || config != "new config" {
+		t.Errorf("expected the changed attributes; got %v, %v", third, changed)
+	}
+}
@@ -0,0 +1,310 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package amtest
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/jws"
+	"github.com/JacoJooste/iot-edge/v7/pkg/callback"
+	"github.com/dchest/uniuri"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// Tree is a mock authentication tree, consisting of steps that are processed in order. The authentication succeeds if
+// all the steps succeed and one of them has identified the thing.
+type Tree []Step
+
+// Step is a stage of a mock authentication tree, similar to a page of nodes in an AM tree
+type Step interface {
+	// Callbacks returns the callbacks that are sent to the thing. The step is skipped if there are no callbacks.
+	Callbacks(auth *Authentication) []callback.Callback
+	// Verify processes the callbacks returned by the thing. The authentication fails if an error is returned.
+	Verify(auth *Authentication, responses []callback.Callback) error
+}
+
+// Authentication contains the state of an authentication that is in progress
+type Authentication struct {
+	// ThingID is the ID of the authenticated identity, set by the step that identifies the thing
+	ThingID string
+	// Challenge is a random value created for the authentication that steps can send to the thing
+	Challenge string
+	// claimed is the ID of an unregistered thing that must be registered by a following step
+	claimed string
+	// actor is the ID of the service that impersonates the thing
+	actor  string
+	server *Server
+}
+
+// Server returns the mock server that is processing the authentication
+func (a *Authentication) Server() *Server {
+	return a.server
+}
+
+// hiddenValue returns a hidden value callback with the given ID and value
+func hiddenValue(id, value string) callback.Callback {
+	return callback.Callback{
+		Type:   callback.TypeHiddenValueCallback,
+		Output: []callback.Entry{{Name: "value", Value: value}, {Name: "id", Value: id}},
+		Input:  []callback.Entry{{Name: "IDToken1", Value: id}},
+	}
+}
+
+// inputValue returns the first input value of the callback of the given type and, if not empty, with the given ID
+func inputValue(responses []callback.Callback, cbType, id string) (string, error) {
+	for _, cb := range responses {
+		if cb.Type != cbType || (id != "" && cb.ID() != id) || len(cb.Input) == 0 {
+			continue
+		}
+		return cb.Input[0].Value, nil
+	}
+	return "", fmt.Errorf("no response to the %s callback", cbType)
+}
+
+// popClaims contains the claims of the proof of possession JWTs sent by things during authentication and registration
+type popClaims struct {
+	Sub       string `json:"sub"`
+	Aud       string `json:"aud"`
+	ThingType string `json:"thingType"`
+	Exp       int64  `json:"exp"`
+	Nonce     string `json:"nonce"`
+	Act       *struct {
+		Sub string `json:"sub"`
+	} `json:"act"`
+	CNF struct {
+		KID  string              `json:"kid"`
+		JWK  *jose.JSONWebKey    `json:"jwk"`
+		JWKS *jose.JSONWebKeySet `json:"jwks"`
+	} `json:"cnf"`
+}
+
+// verifyPoP checks the signature and claims of a proof of possession JWT
+func verifyPoP(token *jwt.JSONWebToken, key interface{}, auth *Authentication, audience string) (claims popClaims,
+	err error) {
+	if err = token.Claims(key, &claims); err != nil {
+		return claims, err
+	}
+	switch {
+	case claims.Nonce != auth.Challenge:
+		return claims, errors.New("incorrect challenge")
+	case audience != "" && claims.Aud != audience:
+		return claims, fmt.Errorf("incorrect audience %s", claims.Aud)
+	case claims.Exp != 0 && time.Now().After(time.Unix(claims.Exp, 0)):
+		return claims, errors.New("expired JWT")
+	}
+	return claims, nil
+}
+
+// AuthenticateThing mocks the Authenticate Thing tree node. The thing proves possession of its registered key by
+// signing a JWT that contains the challenge. If the thing is not registered, then a RegisterThing step must follow.
+// If the JWT names an actor in the act claim, then the step also makes the checks of the impersonation script: the
+// actor must be a service that owns the key with which the JWT is signed.
+type AuthenticateThing struct {
+	// Audience is optional. If set, the JWT must be intended for the audience.
+	Audience string
+}
+
+func (s AuthenticateThing) Callbacks(auth *Authentication) []callback.Callback {
+	return []callback.Callback{hiddenValue("jwt-pop-authentication", auth.Challenge)}
+}
+
+func (s AuthenticateThing) Verify(auth *Authentication, responses []callback.Callback) error {
+	value, err := inputValue(responses, callback.TypeHiddenValueCallback, "jwt-pop-authentication")
+	if err != nil {
+		return err
+	}
+	token, err := jwt.ParseSigned(value)
+	if err != nil {
+		return err
+	}
+	var unverified popClaims
+	if err = token.UnsafeClaimsWithoutVerification(&unverified); err != nil {
+		return err
+	}
+	thing, ok := auth.server.Thing(unverified.Sub)
+	if !ok || len(thing.Keys.Keys) == 0 {
+		auth.claimed = unverified.Sub
+		return nil
+	}
+	keys := thing.Keys.Key(unverified.CNF.KID)
+	if len(keys) == 0 {
+		return fmt.Errorf("unknown key %s for thing %s", unverified.CNF.KID, unverified.Sub)
+	}
+	if _, err = verifyPoP(token, keys[0].Public(), auth, s.Audience); err != nil {
+		return err
+	}
+	if unverified.Act != nil {
+		if err = verifyActor(auth.server, unverified.Act.Sub, unverified.CNF.KID); err != nil {
+			return err
+		}
+		auth.actor = unverified.Act.Sub
+	}
+	auth.ThingID = thing.ID
+	return nil
+}
+
+// verifyActor checks that the actor of an impersonation is a service that owns the key with the given ID
+func verifyActor(server *Server, actor, keyID string) error {
+	service, ok := server.Thing(actor)
+	if !ok || service.Type != string(callback.TypeService) {
+		return fmt.Errorf("%s is not a service and can not impersonate a thing", actor)
+	}
+	if len(service.Keys.Key(keyID)) == 0 {
+		return fmt.Errorf("the key %s does not belong to the service %s", keyID, actor)
+	}
+	return nil
+}
+
+// RegisterThing mocks the Register Thing tree node. The step is skipped if the thing has already been authenticated.
+// The thing sends its public key in a JWT that is signed with the same key, which is registered for the thing together
+// with any additional keys in the cnf.jwks claim.
+type RegisterThing struct {
+	// Audience is optional. If set, the JWT must be intended for the audience.
+	Audience string
+	// Accept is optional and is called with all the claims of the registration JWT. The registration is rejected if
+	// an error is returned.
+	Accept func(claims map[string]interface{}) error
+	// PreSharedKeys is optional. If set, the registration JWT must be nested in a JWT that is MACed with one of the
+	// pre-shared keys, which are mapped by their IDs, see callback.PreSharedKey.
+	PreSharedKeys map[string][]byte
+}
+
+func (s RegisterThing) Callbacks(auth *Authentication) []callback.Callback {
+	if auth.ThingID != "" {
+		return nil
+	}
+	return []callback.Callback{hiddenValue("jwt-pop-registration", auth.Challenge)}
+}
+
+func (s RegisterThing) Verify(auth *Authentication, responses []callback.Callback) error {
+	value, err := inputValue(responses, callback.TypeHiddenValueCallback, "jwt-pop-registration")
+	if err != nil {
+		return err
+	}
+	if s.PreSharedKeys != nil {
+		value, err = callback.VerifyPreSharedKeyJWT(value, func(id string) ([]byte, error) {
+			if key, ok := s.PreSharedKeys[id]; ok {
+				return key, nil
+			}
+			return nil, fmt.Errorf("unknown pre-shared key %s", id)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	token, err := jwt.ParseSigned(value)
+	if err != nil {
+		return err
+	}
+	var unverified popClaims
+	if err = jws.ExtractClaims(value, &unverified); err != nil {
+		return err
+	}
+	key := unverified.CNF.JWK
+	if key == nil || !key.Valid() {
+		return errors.New("registration JWT does not contain a valid key")
+	}
+	claims, err := verifyPoP(token, key.Public(), auth, s.Audience)
+	if err != nil {
+		return err
+	}
+	if auth.claimed != "" && claims.Sub != auth.claimed {
+		return fmt.Errorf("registering %s after authenticating as %s", claims.Sub, auth.claimed)
+	}
+	if s.Accept != nil {
+		all := make(map[string]interface{})
+		if err = token.UnsafeClaimsWithoutVerification(&all); err != nil {
+			return err
+		}
+		if err = s.Accept(all); err != nil {
+			return err
+		}
+	}
+	thingType := claims.ThingType
+	if thingType == "" {
+		thingType = string(callback.TypeDevice)
+	}
+	keys := []jose.JSONWebKey{*key}
+	if claims.CNF.JWKS != nil {
+		// the key set contains the signing key together with the additional keys of the thing
+		keys = claims.CNF.JWKS.Keys
+	}
+	auth.server.register(claims.Sub, thingType, keys...)
+	auth.ThingID = claims.Sub
+	return nil
+}
+
+// Password mocks the Username Collector and Password Collector tree nodes, authenticating users or things with a
+// password.
+type Password struct {
+	// Users maps the IDs of the identities to their passwords
+	Users map[string]string
+}
+
+func (s Password) Callbacks(auth *Authentication) []callback.Callback {
+	return []callback.Callback{
+		{Type: callback.TypeNameCallback, Input: []callback.Entry{{Name: "IDToken1"}}},
+		{Type: callback.TypePasswordCallback, Input: []callback.Entry{{Name: "IDToken2"}}},
+	}
+}
+
+func (s Password) Verify(auth *Authentication, responses []callback.Callback) error {
+	name, err := inputValue(responses, callback.TypeNameCallback, "")
+	if err != nil {
+		return err
+	}
+	password, err := inputValue(responses, callback.TypePasswordCallback, "")
+	if err != nil {
+		return err
+	}
+	if expected, ok := s.Users[name]; !ok || expected != password {
+		return errors.New("incorrect username or password")
+	}
+	auth.ThingID = name
+	return nil
+}
+
+// Scripted is a step that sends the given callbacks and verifies the responses with a custom function, which allows
+// custom tree nodes to be mocked.
+type Scripted struct {
+	// Send returns the callbacks that are sent to the thing
+	Send func(auth *Authentication) []callback.Callback
+	// Check is optional and verifies the responses of the thing. It may set the ID of the authenticated thing.
+	Check func(auth *Authentication, responses []callback.Callback) error
+}
+
+func (s Scripted) Callbacks(auth *Authentication) []callback.Callback {
+	if s.Send == nil {
+		return nil
+	}
+	return s.Send(auth)
+}
+
+func (s Scripted) Verify(auth *Authentication, responses []callback.Callback) error {
+	if s.Check == nil {
+		return nil
+	}
+	return s.Check(auth, responses)
+}
+
+// newChallenge returns a random challenge for an authentication
+func newChallenge() string {
+	return uniuri.NewLen(32)
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package callback
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/jws"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// Registration evidence
+// A registration JWT can carry evidence about the software and integrity of the thing so that the registration tree
+// can decide whether the thing may register. A software statement (RFC 7591 section 2.3) is a JWT, issued by the
+// software vendor, that asserts metadata about the software running on the thing. Attestation evidence, such as a TPM
+// quote over the measured boot PCRs, is produced by the thing itself and should be bound to the registration
+// challenge with AttestationNonce to prevent replay.
+
+// Evidence contains the claims that are added to a registration JWT to describe the integrity of the thing
+type Evidence struct {
+	SoftwareStatement string       `json:"software_statement,omitempty"`
+	Attestation       *Attestation `json:"attestation,omitempty"`
+}
+
+// EvidenceFunc returns the evidence for a registration. It is called with the registration challenge so that fresh
+// evidence can be produced for every registration.
+type EvidenceFunc func(challenge string) (Evidence, error)
+
+// Attestation formats
+const (
+	AttestationTPM2 = "tpm2"
+)
+
+// Attestation contains remote attestation evidence
+type Attestation struct {
+	Format string `json:"fmt"`
+	// Quote contains the TPM quote over the PCRs that record the boot measurements
+	Quote *TPMQuote `json:"quote,omitempty"`
+	// Measurements contains the event log entries that were extended into the PCRs
+	Measurements []Measurement `json:"measurements,omitempty"`
+}
+
+// TPMQuote contains a TPM 2.0 quote, signed by the attestation key
+type TPMQuote struct {
+	// Quoted is the TPMS_ATTEST structure and Signature the TPMT_SIGNATURE over it
+	Quoted    []byte `json:"quoted"`
+	Signature []byte `json:"sig"`
+	// PCRs contains the values of the quoted PCRs
+	PCRs []PCR `json:"pcrs,omitempty"`
+	// Certificates contains the attestation key certificate chain, encoded in base64 DER as a JWK x5c parameter
+	Certificates []string `json:"x5c,omitempty"`
+}
+
+// PCR contains the value of a TPM platform configuration register
+type PCR struct {
+	Index int    `json:"index"`
+	Value []byte `json:"value"`
+}
+
+// Measurement is an entry in a measured boot event log
+type Measurement struct {
+	PCR         int    `json:"pcr"`
+	Digest      []byte `json:"digest"`
+	Description string `json:"desc,omitempty"`
+}
+
+// NewTPMQuote creates a quote with the attestation key certificate chain
+func NewTPMQuote(quoted, signature []byte, pcrs []PCR, certificates []*x509.Certificate) *TPMQuote {
+	return &TPMQuote{
+		Quoted:       quoted,
+		Signature:    signature,
+		PCRs:         pcrs,
+		Certificates: encodeCertificates(certificates),
+	}
+}
+
+// AttestationNonce returns the value that should be included as qualifying data in attestation evidence. The nonce
+// binds the evidence to the registration challenge and to the key that is being registered.
+func AttestationNonce(challenge string, key crypto.PublicKey) ([]byte, error) {
+	thumbprint, err := jws.Thumbprint(key)
+	if err != nil {
+		return nil, err
+	}
+	d := sha256.New()
+	d.Write([]byte(challenge))
+	d.Write(thumbprint)
+	return d.Sum(nil), nil
+}
+
+// NewSoftwareStatement creates a software statement signed by the software vendor. The certificates of the vendor's
+// signing key are included in the x5c header so that the statement can be verified against the vendor's CA.
+func NewSoftwareStatement(key crypto.Signer, certificates []*x509.Certificate, claims interface{}) (string, error) {
+	opts := &jose.SignerOptions{}
+	opts.WithType("JWT")
+	if len(certificates) > 0 {
+		opts.WithHeader("x5c", encodeCertificates(certificates))
+	}
+	sig, err := jws.NewSigner(key, opts)
+	if err != nil {
+		return "", err
+	}
+	return jwt.Signed(sig).Claims(claims).CompactSerialize()
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package callback
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"testing"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/jws"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func TestRegisterHandler_Handle_Evidence(t *testing.T) {
+	vendorKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	vendorCert := testCertificate(t, "vendor", vendorKey, nil, nil)
+	statement, err := NewSoftwareStatement(vendorKey, []*x509.Certificate{vendorCert}, struct {
+		SoftwareID string `json:"software_id"`
+	}{SoftwareID: "firmware-1.2.3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var nonce []byte
+	h := RegisterHandler{
+		Audience:  testRealm,
+		ThingID:   "thingOne",
+		ThingType: TypeDevice,
+		KeyID:     testKID,
+		Key:       testKey,
+		Evidence: func(challenge string) (Evidence, error) {
+			nonce, err = AttestationNonce(challenge, testKey.Public())
+			if err != nil {
+				return Evidence{}, err
+			}
+			return Evidence{
+				SoftwareStatement: statement,
+				Attestation: &Attestation{
+					Format:       AttestationTPM2,
+					Quote:        NewTPMQuote(nonce, []byte("signature"), []PCR{{Index: 0, Value: []byte{0x01}}}, nil),
+					Measurements: []Measurement{{PCR: 0, Digest: []byte{0x01}, Description: "bootloader"}},
+				},
+			}, nil
+		},
+	}
+	cb := jwtVerifyCB(true)
+	if _, err = h.Handle(cb); err != nil {
+		t.Fatal(err)
+	}
+	var claims Evidence
+	if err = jws.ExtractClaims(cb.Input[0].Value, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Attestation == nil || claims.Attestation.Quote == nil || !bytes.Equal(claims.Attestation.Quote.Quoted, nonce) {
+		t.Fatalf("missing attestation evidence: %+v", claims)
+	}
+
+	// the software statement can be verified with the vendor certificate
+	token, err := jwt.ParseSigned(claims.SoftwareStatement)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := token.Headers[0].Certificates(x509.VerifyOptions{Roots: testCertPool(vendorCert)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var software struct {
+		SoftwareID string `json:"software_id"`
+	}
+	if err = token.Claims(certs[0][0].PublicKey, &software); err != nil || software.SoftwareID != "firmware-1.2.3" {
+		t.Errorf("invalid software statement; %v", err)
+	}
+}
+
+func TestRegisterHandler_Handle_EvidenceError(t *testing.T) {
+	errNoTPM := errors.New("no TPM")
+	h := RegisterHandler{
+		Audience: testRealm,
+		ThingID:  "thingOne",
+		KeyID:    testKID,
+		Key:      testKey,
+		Evidence: func(string) (Evidence, error) {
+			return Evidence{}, errNoTPM
+		},
+	}
+	if _, err := h.Handle(jwtVerifyCB(true)); !errors.Is(err, errNoTPM) {
+		t.Errorf("expected %v, got %v", errNoTPM, err)
+	}
+}
+
+func TestAttestationNonce(t *testing.T) {
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	first, err := AttestationNonce("challenge", testKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := AttestationNonce("challenge", testKey.Public())
+	otherChallenge, _ := AttestationNonce("other", testKey.Public())
+	otherNonceKey, _ := AttestationNonce("challenge", otherKey.Public())
+	if !bytes.Equal(first, second) {
+		t.Error("nonce is not deterministic")
+	}
+	if bytes.Equal(first, otherChallenge) || bytes.Equal(first, otherNonceKey) {
+		t.Error("nonce is not bound to the challenge and key")
+	}
+}
+
+func testCertPool(certs ...*x509.Certificate) *x509.CertPool {
+	pool := x509.NewCertPool()
+	for _, c := range certs {
+		pool.AddCert(c)
+	}
+	return pool
+}
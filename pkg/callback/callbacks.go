@@ -19,6 +19,7 @@ package callback
 import (
 	"crypto"
 	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"time"
@@ -39,6 +40,7 @@ const (
 	TypePasswordCallback    = "PasswordCallback"
 	TypeTextInputCallback   = "TextInputCallback"
 	TypeHiddenValueCallback = "HiddenValueCallback"
+	TypeChoiceCallback      = "ChoiceCallback"
 	// Thing types used with registration callback
 	TypeDevice  ThingType = "device"
 	TypeService ThingType = "service"
@@ -52,12 +54,79 @@ type ThingType string
 type Entry struct {
 	Name  string `json:"name"`
 	Value string `json:"value"`
+	// RawValue holds the JSON encoded value of the entry if the value is not a string, such as the choices of a
+	// ChoiceCallback. When set, it is sent instead of Value.
+	RawValue json.RawMessage `json:"-"`
 }
 
 func (e Entry) String() string {
+	if e.RawValue != nil {
+		return fmt.Sprintf("{Name:%v Value:%s}", e.Name, e.RawValue)
+	}
 	return fmt.Sprintf("{Name:%v Value:%v}", e.Name, e.Value)
 }
 
+// entryJSON is the JSON representation of an entry with a value of any type
+type entryJSON struct {
+	Name  string      `json:"name"`
+	Value interface{} `json:"value"`
+}
+
+func (e Entry) MarshalJSON() ([]byte, error) {
+	if e.RawValue != nil {
+		return json.Marshal(entryJSON{Name: e.Name, Value: e.RawValue})
+	}
+	return json.Marshal(entryJSON{Name: e.Name, Value: e.Value})
+}
+
+func (e *Entry) UnmarshalJSON(b []byte) error {
+	var entry struct {
+		Name  string          `json:"name"`
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(b, &entry); err != nil {
+		return err
+	}
+	*e = Entry{Name: entry.Name}
+	switch {
+	case len(entry.Value) == 0 || string(entry.Value) == "null":
+		return nil
+	case entry.Value[0] == '"':
+		return json.Unmarshal(entry.Value, &e.Value)
+	default:
+		e.RawValue = entry.Value
+		return nil
+	}
+}
+
+// SetValue sets the value of the entry. Values that are not strings are encoded as JSON.
+func (e *Entry) SetValue(v interface{}) error {
+	if s, ok := v.(string); ok {
+		e.Value = s
+		e.RawValue = nil
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	e.Value = ""
+	e.RawValue = b
+	return nil
+}
+
+// DecodeValue decodes the value of the entry into v, which must be a pointer
+func (e Entry) DecodeValue(v interface{}) error {
+	if e.RawValue != nil {
+		return json.Unmarshal(e.RawValue, v)
+	}
+	b, err := json.Marshal(e.Value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
 // Callback describes an AM callback request and response structure.
 type Callback struct {
 	Type   string  `json:"type,omitempty"`
@@ -69,6 +138,28 @@ func (c Callback) String() string {
 	return fmt.Sprintf("{Callback Type:%v Output:%v Input:%v}", c.Type, c.Output, c.Input)
 }
 
+// OutputEntry returns the output entry with the given name
+func (c Callback) OutputEntry(name string) (Entry, bool) {
+	for _, e := range c.Output {
+		if e.Name == name {
+			return e, true
+		}
+	}
+	return Entry{}, false
+}
+
+// Prompt returns the text that AM shows the user for the callback, such as the prompt of a NameCallback or the
+// message of a TextOutputCallback. AM localises the text for the locale that the thing sends with its authentication
+// requests, see thing.Builder.WithLocale.
+func (c Callback) Prompt() string {
+	for _, name := range []string{"prompt", "message"} {
+		if e, ok := c.OutputEntry(name); ok {
+			return e.Value
+		}
+	}
+	return ""
+}
+
 // ID will verify that the callback is a HiddenValueCallback and return the ID value if one exists.
 func (c Callback) ID() string {
 	if c.Type != TypeHiddenValueCallback {
@@ -88,6 +179,19 @@ type Handler interface {
 	Handle(cb Callback) (bool, error)
 }
 
+// popChallenge returns the challenge sent by a JWT PoP tree node
+func popChallenge(cb Callback) (string, error) {
+	if len(cb.Input) == 0 {
+		return "", errNoInput
+	}
+	for _, e := range cb.Output {
+		if e.Name == "value" && e.Value != "" {
+			return e.Value, nil
+		}
+	}
+	return "", errNoOutput
+}
+
 // NameHandler handles an AM Username Collector callback.
 type NameHandler struct {
 	// Name\Username\ID for the identity
@@ -129,18 +233,23 @@ type AuthenticateHandler struct {
 	KeyID    string
 	Key      crypto.Signer
 	Claims   func() interface{}
+	// Now is optional and returns the time at which the JWT is issued, by default the time of the device
+	Now func() time.Time
 }
 
 type jwtVerifyClaims struct {
-	Sub       string    `json:"sub"`
-	Aud       string    `json:"aud"`
-	ThingType ThingType `json:"thingType"`
-	Iat       int64     `json:"iat"`
-	Exp       int64     `json:"exp"`
-	Nonce     string    `json:"nonce"`
-	CNF       struct {
-		KID string           `json:"kid,omitempty"`
-		JWK *jose.JSONWebKey `json:"jwk,omitempty"`
+	Sub          string    `json:"sub"`
+	Aud          string    `json:"aud"`
+	ThingType    ThingType `json:"thingType"`
+	OAuth2Client string    `json:"thingOAuth2ClientName,omitempty"`
+	Groups       []string  `json:"thingGroups,omitempty"`
+	Iat          int64     `json:"iat"`
+	Exp          int64     `json:"exp"`
+	Nonce        string    `json:"nonce"`
+	CNF          struct {
+		KID  string              `json:"kid,omitempty"`
+		JWK  *jws.JSONWebKey     `json:"jwk,omitempty"`
+		JWKS *jose.JSONWebKeySet `json:"jwks,omitempty"`
 	} `json:"cnf"`
 }
 
@@ -148,12 +257,20 @@ func (c jwtVerifyClaims) String() string {
 	return fmt.Sprintf("{sub:%s, aud:%s, ThingType:%s}", c.Sub, c.Aud, c.ThingType)
 }
 
-func baseJWTClaims(thingID, audience, challenge string) jwtVerifyClaims {
+// issuedAt returns the time given by the optional now function or else the time of the device
+func issuedAt(now func() time.Time) time.Time {
+	if now == nil {
+		return time.Now()
+	}
+	return now()
+}
+
+func baseJWTClaims(thingID, audience, challenge string, now time.Time) jwtVerifyClaims {
 	return jwtVerifyClaims{
 		Sub:   thingID,
 		Aud:   audience,
-		Iat:   time.Now().Unix(),
-		Exp:   time.Now().Add(5 * time.Minute).Unix(),
+		Iat:   now.Unix(),
+		Exp:   now.Add(5 * time.Minute).Unix(),
 		Nonce: challenge,
 	}
 }
@@ -162,18 +279,9 @@ func (h AuthenticateHandler) Handle(cb Callback) (bool, error) {
 	if cb.ID() != "jwt-pop-authentication" {
 		return false, nil
 	}
-	if len(cb.Input) == 0 {
-		return true, errNoInput
-	}
-	var challenge string
-	for _, e := range cb.Output {
-		if e.Name == "value" {
-			challenge = e.Value
-			break
-		}
-	}
-	if challenge == "" {
-		return true, errNoOutput
+	challenge, err := popChallenge(cb)
+	if err != nil {
+		return true, err
 	}
 
 	opts := &jose.SignerOptions{}
@@ -183,13 +291,13 @@ func (h AuthenticateHandler) Handle(cb Callback) (bool, error) {
 	if err != nil {
 		return true, err
 	}
-	claims := baseJWTClaims(h.ThingID, h.Audience, challenge)
+	claims := baseJWTClaims(h.ThingID, h.Audience, challenge, issuedAt(h.Now))
 	claims.CNF.KID = h.KeyID
 	builder := jwt.Signed(sig).Claims(claims)
 	if h.Claims != nil {
 		builder = builder.Claims(h.Claims())
 	}
-	response, err := builder.CompactSerialize()
+	response, err := serialize(builder)
 	if err != nil {
 		return true, err
 	}
@@ -207,50 +315,81 @@ type RegisterHandler struct {
 	Key          crypto.Signer
 	Certificates []*x509.Certificate
 	Claims       func() interface{}
+	// Evidence is optional and provides the software statement and attestation evidence for the registration
+	Evidence EvidenceFunc
+	// OAuth2Client is optional and associates the OAuth 2.0 client with the given ID with the thing's identity
+	OAuth2Client string
+	// Groups is optional and adds the thing to the AM groups with the given IDs
+	Groups []string
+	// PSK is optional and nests the registration JWT in a JWT that proves possession of the pre-shared key
+	PSK *PreSharedKey
+	// AdditionalKeys are optional and are registered as confirmation keys of the thing together with Key
+	AdditionalKeys []ConfirmationKey
+	// CompressPoint is optional and confirms a P-256 Key with its compressed point, which AM must support
+	CompressPoint bool
+	// Now is optional and returns the time at which the JWT is issued, by default the time of the device
+	Now func() time.Time
 }
 
 func (h RegisterHandler) Handle(cb Callback) (bool, error) {
 	if cb.ID() != "jwt-pop-registration" {
 		return false, nil
 	}
-	if len(cb.Input) == 0 {
-		return true, errNoInput
+	challenge, err := popChallenge(cb)
+	if err != nil {
+		return true, err
 	}
-	var challenge string
-	for _, e := range cb.Output {
-		if e.Name == "value" {
-			challenge = e.Value
-			break
-		}
+
+	response, err := h.signedJWT(challenge)
+	if err != nil {
+		return true, err
 	}
-	if challenge == "" {
-		return true, errNoOutput
+	if h.PSK != nil {
+		if response, err = h.PSK.nest(response); err != nil {
+			return true, err
+		}
 	}
 
+	cb.Input[0].Value = response
+	return true, nil
+}
+
+// signedJWT returns the registration JWT for the challenge, including any additional claims
+func (h RegisterHandler) signedJWT(challenge string, additional ...interface{}) (string, error) {
 	opts := &jose.SignerOptions{}
 	opts.WithHeader("typ", "JWT")
 
 	sig, err := jws.NewSigner(h.Key, opts)
 	if err != nil {
-		return true, err
+		return "", err
 	}
-	claims := baseJWTClaims(h.ThingID, h.Audience, challenge)
+	claims := baseJWTClaims(h.ThingID, h.Audience, challenge, issuedAt(h.Now))
 	claims.ThingType = h.ThingType
-	claims.CNF.JWK = &jose.JSONWebKey{
+	claims.OAuth2Client = h.OAuth2Client
+	claims.Groups = h.Groups
+	claims.CNF.JWK = &jws.JSONWebKey{JSONWebKey: jose.JSONWebKey{
 		Key:          h.Key.Public(),
 		Certificates: h.Certificates,
 		KeyID:        h.KeyID,
 		Use:          "sig",
+	}, CompressPoint: h.CompressPoint}
+	if claims.CNF.JWKS, err = confirmationKeySet(jose.JSONWebKey{Key: h.Key.Public(), KeyID: h.KeyID, Use: "sig"},
+		h.AdditionalKeys); err != nil {
+		return "", err
 	}
 	builder := jwt.Signed(sig).Claims(claims)
 	if h.Claims != nil {
 		builder = builder.Claims(h.Claims())
 	}
-	response, err := builder.CompactSerialize()
-	if err != nil {
-		return true, err
+	if h.Evidence != nil {
+		evidence, err := h.Evidence(challenge)
+		if err != nil {
+			return "", err
+		}
+		builder = builder.Claims(evidence)
 	}
-
-	cb.Input[0].Value = response
-	return true, nil
+	for _, c := range additional {
+		builder = builder.Claims(c)
+	}
+	return serialize(builder)
 }
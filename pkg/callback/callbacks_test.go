@@ -17,16 +17,22 @@
 package callback
 
 import (
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"math/big"
+	"reflect"
 	"testing"
 	"time"
 
 	"github.com/JacoJooste/iot-edge/v7/internal/jws"
+	"github.com/JacoJooste/iot-edge/v7/internal/secp256k1"
+	"github.com/cloudflare/circl/sign/ed448"
 	"gopkg.in/square/go-jose.v2"
 )
 
@@ -67,6 +73,28 @@ func jwtVerifyCB(register bool) Callback {
 	}
 }
 
+func TestCallback_Prompt(t *testing.T) {
+	tests := []struct {
+		name     string
+		callback Callback
+		prompt   string
+	}{
+		{name: "prompt", callback: Callback{Type: TypeNameCallback, Output: []Entry{{Name: "prompt", Value: "Benutzername"}}},
+			prompt: "Benutzername"},
+		{name: "message", callback: Callback{Type: "TextOutputCallback",
+			Output: []Entry{{Name: "messageType", Value: "0"}, {Name: "message", Value: "Willkommen"}}},
+			prompt: "Willkommen"},
+		{name: "none", callback: Callback{Type: TypeHiddenValueCallback, Output: []Entry{{Name: "id", Value: "jwt"}}}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			if prompt := subtest.callback.Prompt(); prompt != subtest.prompt {
+				t.Errorf("expected %q; got %q", subtest.prompt, prompt)
+			}
+		})
+	}
+}
+
 func TestCallbackHandler_HandleResult(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -277,3 +305,144 @@ func TestRegisterHandler_Handle(t *testing.T) {
 		t.Fatal("incorrect serial number")
 	}
 }
+
+func TestRegisterHandler_Handle_Groups(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	h := RegisterHandler{Audience: testRealm, ThingID: "thingOne", ThingType: TypeDevice, KeyID: testKID, Key: key,
+		Groups: []string{"pumps", "north-site"}}
+	cb := jwtVerifyCB(true)
+	if _, err := h.Handle(cb); err != nil {
+		t.Fatal(err)
+	}
+	var claims struct {
+		Groups []string `json:"thingGroups"`
+	}
+	if err := jws.ExtractClaims(cb.Input[0].Value, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(claims.Groups, h.Groups) {
+		t.Errorf("expected groups %v; got %v", h.Groups, claims.Groups)
+	}
+}
+
+func TestRegisterHandler_Handle_ES256K(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(secp256k1.S256(), rand.Reader)
+	h := RegisterHandler{Audience: testRealm, ThingID: "thingOne", ThingType: TypeDevice, KeyID: testKID, Key: key}
+	cb := jwtVerifyCB(true)
+	if _, err := h.Handle(cb); err != nil {
+		t.Fatal(err)
+	}
+	response := cb.Input[0].Value
+	signed, err := jose.ParseSigned(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alg := signed.Signatures[0].Header.Algorithm; alg != string(jws.ES256K) {
+		t.Errorf("expected %s algorithm, got %s", jws.ES256K, alg)
+	}
+	claims := struct {
+		CNF struct {
+			JWK map[string]string `json:"jwk"`
+		} `json:"cnf"`
+	}{}
+	if err = jws.ExtractClaims(response, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if jwk := claims.CNF.JWK; jwk["crv"] != "secp256k1" || jwk["kid"] != testKID {
+		t.Errorf("unexpected confirmation key %v", jwk)
+	}
+}
+
+func TestRegisterHandler_Handle_Ed448(t *testing.T) {
+	_, key, _ := ed448.GenerateKey(rand.Reader)
+	h := RegisterHandler{Audience: testRealm, ThingID: "thingOne", ThingType: TypeDevice, KeyID: testKID, Key: key}
+	cb := jwtVerifyCB(true)
+	if _, err := h.Handle(cb); err != nil {
+		t.Fatal(err)
+	}
+	response := cb.Input[0].Value
+	signed, err := jose.ParseSigned(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alg := signed.Signatures[0].Header.Algorithm; alg != string(jose.EdDSA) {
+		t.Errorf("expected %s algorithm, got %s", jose.EdDSA, alg)
+	}
+	claims := struct {
+		CNF struct {
+			JWK map[string]string `json:"jwk"`
+		} `json:"cnf"`
+	}{}
+	if err = jws.ExtractClaims(response, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if jwk := claims.CNF.JWK; jwk["kty"] != "OKP" || jwk["crv"] != "Ed448" || jwk["kid"] != testKID {
+		t.Errorf("unexpected confirmation key %v", jwk)
+	}
+}
+
+func TestRegisterHandler_Handle_CompressPoint(t *testing.T) {
+	h := RegisterHandler{Audience: testRealm, ThingID: "thingOne", ThingType: TypeDevice, KeyID: testKID,
+		Key: testKey}
+	uncompressed := jwtVerifyCB(true)
+	if _, err := h.Handle(uncompressed); err != nil {
+		t.Fatal(err)
+	}
+	h.CompressPoint = true
+	cb := jwtVerifyCB(true)
+	if _, err := h.Handle(cb); err != nil {
+		t.Fatal(err)
+	}
+	claims := struct {
+		CNF struct {
+			JWK map[string]string `json:"jwk"`
+		} `json:"cnf"`
+	}{}
+	if err := jws.ExtractClaims(cb.Input[0].Value, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if jwk := claims.CNF.JWK; jwk["crv"] != "P-256" || jwk["y"] != "" || len(jwk["x"]) != 44 {
+		t.Errorf("unexpected confirmation key %v", jwk)
+	}
+	if len(cb.Input[0].Value) >= len(uncompressed.Input[0].Value) {
+		t.Error("expected the compressed key to reduce the size of the registration JWT")
+	}
+}
+
+// benchmark the signing of the proof of possession JWT for each supported key type
+func BenchmarkAuthenticateHandler_Handle(b *testing.B) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	keys := []struct {
+		alg string
+		key crypto.Signer
+	}{
+		{alg: "ES256", key: testKey},
+		{alg: "ES384", key: mustGenerateECDSA(elliptic.P384())},
+		{alg: "ES512", key: mustGenerateECDSA(elliptic.P521())},
+		{alg: "ES256K", key: mustGenerateECDSA(secp256k1.S256())},
+		{alg: "EdDSA", key: edKey},
+		{alg: "PS256", key: rsaKey},
+	}
+	for _, k := range keys {
+		b.Run(k.alg, func(b *testing.B) {
+			h := AuthenticateHandler{Audience: testRealm, ThingID: "thingOne", KeyID: testKID, Key: k.key}
+			cb := jwtVerifyCB(false)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := h.Handle(cb); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func mustGenerateECDSA(curve elliptic.Curve) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
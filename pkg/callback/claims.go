@@ -0,0 +1,195 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package callback
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Custom claims
+// The authentication and registration trees can check custom claims in the JWT of a thing, for example the version of
+// its firmware. A malformed claim, such as a number sent as a string or a custom claim that overwrites one of the
+// claims set by the SDK, is only rejected by the tree with an unauthorised error that does not say what was wrong.
+// Claims checks the claims on the device against the claims that the tree expects before they are signed.
+
+// ClaimType is the JSON type of the value of a custom claim
+type ClaimType string
+
+const (
+	ClaimString      ClaimType = "string"
+	ClaimNumber      ClaimType = "number"
+	ClaimBoolean     ClaimType = "boolean"
+	ClaimStringArray ClaimType = "string array"
+	ClaimObject      ClaimType = "object"
+)
+
+// ClaimDefinition describes a custom claim that the authentication or registration tree expects
+type ClaimDefinition struct {
+	Name     string
+	Type     ClaimType
+	Required bool
+}
+
+// reservedClaims are the claims that the SDK sets in the JWTs of a thing
+var reservedClaims = map[string]bool{
+	"iss": true, "sub": true, "aud": true, "iat": true, "exp": true, "nbf": true, "jti": true, "nonce": true,
+	"cnf": true, "thingType": true, "thingOAuth2ClientName": true, "thingGroups": true, "software_statement": true,
+	"attestation": true,
+}
+
+var (
+	errReservedClaim   = errors.New("claim is set by the SDK")
+	errUndeclaredClaim = errors.New("claim is not in the schema")
+	errClaimType       = errors.New("claim has the wrong type")
+	errMissingClaim    = errors.New("required claim is missing")
+	errNoClaimName     = errors.New("claim has no name")
+)
+
+// Claims builds a set of custom claims for the JWT of a thing. The claims are checked against an optional schema, in
+// which case only the claims in the schema may be set. The first invalid claim is returned by Build.
+//
+//    claims, err := callback.NewClaims(
+//        callback.ClaimDefinition{Name: "firmware_version", Type: callback.ClaimString, Required: true}).
+//        String("firmware_version", "1.4.2").
+//        Build()
+type Claims struct {
+	schema map[string]ClaimDefinition
+	values map[string]interface{}
+	err    error
+}
+
+// NewClaims returns an empty set of custom claims for the given schema
+func NewClaims(schema ...ClaimDefinition) *Claims {
+	c := &Claims{values: make(map[string]interface{})}
+	if len(schema) > 0 {
+		c.schema = make(map[string]ClaimDefinition, len(schema))
+		for _, d := range schema {
+			c.schema[d.Name] = d
+			if c.err == nil {
+				c.err = checkClaimName(d.Name)
+			}
+		}
+	}
+	return c
+}
+
+// checkClaimName returns an error if the claim can not be set by the application
+func checkClaimName(name string) error {
+	if name == "" {
+		return errNoClaimName
+	}
+	if reservedClaims[name] {
+		return fmt.Errorf("%s: %w", name, errReservedClaim)
+	}
+	return nil
+}
+
+func (c *Claims) set(name string, claimType ClaimType, value interface{}) *Claims {
+	if c.err != nil {
+		return c
+	}
+	if c.err = checkClaimName(name); c.err != nil {
+		return c
+	}
+	if c.schema != nil {
+		d, ok := c.schema[name]
+		if !ok {
+			c.err = fmt.Errorf("%s: %w", name, errUndeclaredClaim)
+			return c
+		}
+		if d.Type != claimType {
+			c.err = fmt.Errorf("%s is a %s, not a %s: %w", name, d.Type, claimType, errClaimType)
+			return c
+		}
+	}
+	c.values[name] = value
+	return c
+}
+
+// String sets a claim with a string value
+func (c *Claims) String(name string, value string) *Claims {
+	return c.set(name, ClaimString, value)
+}
+
+// Number sets a claim with a numeric value
+func (c *Claims) Number(name string, value float64) *Claims {
+	return c.set(name, ClaimNumber, value)
+}
+
+// Integer sets a claim with an integer value
+func (c *Claims) Integer(name string, value int64) *Claims {
+	return c.set(name, ClaimNumber, value)
+}
+
+// Boolean sets a claim with a boolean value
+func (c *Claims) Boolean(name string, value bool) *Claims {
+	return c.set(name, ClaimBoolean, value)
+}
+
+// Strings sets a claim with an array of strings
+func (c *Claims) Strings(name string, values ...string) *Claims {
+	if values == nil {
+		values = []string{}
+	}
+	return c.set(name, ClaimStringArray, values)
+}
+
+// Object sets a claim with a value that must be encoded as a JSON object, such as a struct or a map
+func (c *Claims) Object(name string, value interface{}) *Claims {
+	if c.err != nil {
+		return c
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		c.err = fmt.Errorf("%s: %w", name, err)
+		return c
+	}
+	if !bytes.HasPrefix(b, []byte("{")) {
+		c.err = fmt.Errorf("%s is not a JSON object: %w", name, errClaimType)
+		return c
+	}
+	return c.set(name, ClaimObject, json.RawMessage(b))
+}
+
+// Build checks that all the required claims are set and returns a function that returns the claims, which can be
+// passed to AuthenticateThing and RegisterThing of the thing builder or as the Claims of a callback handler
+func (c *Claims) Build() (func() interface{}, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	var missing []string
+	for name, d := range c.schema {
+		if _, ok := c.values[name]; d.Required && !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, fmt.Errorf("%v: %w", missing, errMissingClaim)
+	}
+	values := make(map[string]interface{}, len(c.values))
+	for name, v := range c.values {
+		values[name] = v
+	}
+	return func() interface{} {
+		return values
+	}, nil
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package callback
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestClaims_Build(t *testing.T) {
+	schema := []ClaimDefinition{
+		{Name: "firmware", Type: ClaimString, Required: true},
+		{Name: "uptime", Type: ClaimNumber},
+		{Name: "sensors", Type: ClaimStringArray},
+		{Name: "location", Type: ClaimObject},
+	}
+	location := struct {
+		Lat float64 `json:"lat"`
+		Lon float64 `json:"lon"`
+	}{Lat: 1.5, Lon: -2}
+	tests := []struct {
+		name   string
+		claims *Claims
+		json   string
+		err    error
+	}{
+		{name: "no-schema", claims: NewClaims().String("a", "1").Integer("b", 2).Boolean("c", true).Strings("d"),
+			json: `{"a":"1","b":2,"c":true,"d":[]}`},
+		{name: "schema", claims: NewClaims(schema...).String("firmware", "1.2").Number("uptime", 1.5).
+			Strings("sensors", "t", "h").Object("location", location),
+			json: `{"firmware":"1.2","location":{"lat":1.5,"lon":-2},"sensors":["t","h"],"uptime":1.5}`},
+		{name: "reserved", claims: NewClaims().String("nonce", "1"), err: errReservedClaim},
+		{name: "reserved-in-schema", claims: NewClaims(ClaimDefinition{Name: "sub", Type: ClaimString}),
+			err: errReservedClaim},
+		{name: "no-name", claims: NewClaims().Boolean("", true), err: errNoClaimName},
+		{name: "undeclared", claims: NewClaims(schema...).String("firmware", "1").String("other", "1"),
+			err: errUndeclaredClaim},
+		{name: "wrong-type", claims: NewClaims(schema...).String("firmware", "1").String("uptime", "1"),
+			err: errClaimType},
+		{name: "not-an-object", claims: NewClaims(schema...).String("firmware", "1").Object("location", 1),
+			err: errClaimType},
+		{name: "missing", claims: NewClaims(schema...).Number("uptime", 1), err: errMissingClaim},
+		{name: "first-error", claims: NewClaims().String("sub", "1").String("", "1"), err: errReservedClaim},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			claims, err := subtest.claims.Build()
+			if subtest.err != nil {
+				if !errors.Is(err, subtest.err) {
+					t.Fatalf("expected %v; got %v", subtest.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := json.Marshal(claims())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != subtest.json {
+				t.Errorf("expected %s; got %s", subtest.json, b)
+			}
+		})
+	}
+}
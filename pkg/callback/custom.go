@@ -0,0 +1,54 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package callback
+
+import "errors"
+
+var errTooManyValues = errors.New("more values than input entries")
+
+// CustomHandler handles the callbacks of custom authentication nodes, for example nodes that verify a SIM card or a
+// LoRaWAN join request. The handler matches callbacks by type and, optionally, by the ID of a HiddenValueCallback and
+// responds with the input values returned by Respond.
+type CustomHandler struct {
+	// Type of the callback to handle, for example TypeTextInputCallback
+	Type string
+	// ID of the HiddenValueCallback to handle. If empty, all callbacks of the given type are handled.
+	ID string
+	// Respond returns the values of the callback's inputs in the order of the input entries. String values are sent
+	// as is while other values, such as the index selected in a ChoiceCallback, are encoded as JSON.
+	// Use Callback.OutputEntry and Entry.DecodeValue to read the output of the node.
+	Respond func(cb Callback) ([]interface{}, error)
+}
+
+func (h CustomHandler) Handle(cb Callback) (bool, error) {
+	if cb.Type != h.Type || (h.ID != "" && cb.ID() != h.ID) {
+		return false, nil
+	}
+	values, err := h.Respond(cb)
+	if err != nil {
+		return true, err
+	}
+	if len(values) > len(cb.Input) {
+		return true, errTooManyValues
+	}
+	for i, v := range values {
+		if err := cb.Input[i].SetValue(v); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
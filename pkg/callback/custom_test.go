@@ -0,0 +1,119 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package callback
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+const testCustomCallbacks = `[
+	{"type":"ChoiceCallback","output":[{"name":"prompt","value":"Network"},{"name":"choices","value":["lte","lora"]},
+		{"name":"defaultChoice","value":0}],"input":[{"name":"IDToken1","value":0}]},
+	{"type":"HiddenValueCallback","output":[{"name":"value","value":"nonce"},{"name":"id","value":"sim-auth"}],
+		"input":[{"name":"IDToken2","value":""}]}
+]`
+
+func TestEntry_JSON(t *testing.T) {
+	var callbacks []Callback
+	if err := json.Unmarshal([]byte(testCustomCallbacks), &callbacks); err != nil {
+		t.Fatal(err)
+	}
+	choices, ok := callbacks[0].OutputEntry("choices")
+	if !ok {
+		t.Fatal("choices not found")
+	}
+	var names []string
+	if err := choices.DecodeValue(&names); err != nil || len(names) != 2 || names[1] != "lora" {
+		t.Errorf("unexpected choices %v; %v", names, err)
+	}
+	if callbacks[1].ID() != "sim-auth" {
+		t.Errorf("unexpected ID %s", callbacks[1].ID())
+	}
+	b, err := json.Marshal(callbacks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var compacted, expected []interface{}
+	_ = json.Unmarshal(b, &compacted)
+	_ = json.Unmarshal([]byte(testCustomCallbacks), &expected)
+	if c, e := toJSON(compacted), toJSON(expected); c != e {
+		t.Errorf("expected %s, got %s", e, c)
+	}
+}
+
+func toJSON(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func TestCustomHandler_Handle(t *testing.T) {
+	errSIM := errors.New("SIM unavailable")
+	choice := CustomHandler{
+		Type: TypeChoiceCallback,
+		Respond: func(cb Callback) ([]interface{}, error) {
+			return []interface{}{1}, nil
+		},
+	}
+	sim := CustomHandler{
+		Type: TypeHiddenValueCallback,
+		ID:   "sim-auth",
+		Respond: func(cb Callback) ([]interface{}, error) {
+			nonce, _ := cb.OutputEntry("value")
+			return []interface{}{"response-" + nonce.Value}, nil
+		},
+	}
+	tests := []struct {
+		name     string
+		handler  CustomHandler
+		index    int
+		handled  bool
+		err      error
+		expected string
+	}{
+		{name: "choice", handler: choice, index: 0, handled: true, expected: `{"name":"IDToken1","value":1}`},
+		{name: "hidden-value", handler: sim, index: 1, handled: true,
+			expected: `{"name":"IDToken2","value":"response-nonce"}`},
+		{name: "wrong-type", handler: choice, index: 1},
+		{name: "wrong-id", handler: CustomHandler{Type: TypeHiddenValueCallback, ID: "lora-join"}, index: 1},
+		{name: "respond-error", handler: CustomHandler{Type: TypeChoiceCallback,
+			Respond: func(Callback) ([]interface{}, error) { return nil, errSIM }}, handled: true, err: errSIM},
+		{name: "too-many-values", handler: CustomHandler{Type: TypeChoiceCallback,
+			Respond: func(Callback) ([]interface{}, error) { return []interface{}{0, 1}, nil }}, handled: true,
+			err: errTooManyValues},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			var callbacks []Callback
+			if err := json.Unmarshal([]byte(testCustomCallbacks), &callbacks); err != nil {
+				t.Fatal(err)
+			}
+			cb := callbacks[subtest.index]
+			handled, err := subtest.handler.Handle(cb)
+			if handled != subtest.handled || !errors.Is(err, subtest.err) {
+				t.Fatalf("unexpected result %v; %v", handled, err)
+			}
+			if subtest.expected == "" {
+				return
+			}
+			if b, _ := json.Marshal(cb.Input[0]); string(b) != subtest.expected {
+				t.Errorf("expected %s, got %s", subtest.expected, b)
+			}
+		})
+	}
+}
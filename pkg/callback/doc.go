@@ -37,4 +37,14 @@
 //
 //    builder.Thing().HandleCallbacksWith(ThingHandler{ThingInput: "value"})
 //
+// Custom authentication nodes that send callbacks with values other than strings, such as a ChoiceCallback, can be
+// handled with a CustomHandler, which sends the values returned by its Respond function:
+//
+//    callback.CustomHandler{
+//        Type: callback.TypeChoiceCallback,
+//        Respond: func(cb callback.Callback) ([]interface{}, error) {
+//            return []interface{}{1}, nil
+//        },
+//    }
+//
 package callback
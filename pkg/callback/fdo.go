@@ -0,0 +1,178 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package callback
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// FIDO Device Onboard
+// Devices that pass through a multi-party supply chain may be claimed with an FDO ownership voucher instead of an
+// RFC 8366 voucher. During manufacturing the device is given a device credential: a GUID, an HMAC secret and the
+// hash of the manufacturer's public key. The manufacturer creates the ownership voucher, of which the header is
+// authenticated with the device's HMAC secret, and every party in the supply chain extends the voucher with an entry,
+// signed by the current owner, that transfers ownership to the public key of the next party. At first boot the
+// registration tree sends the voucher along with a proof signed by the final owner key. The device verifies that the
+// voucher was created for it, that the chain of entries starts at its manufacturer and that the proof was signed by
+// the last owner in the chain, before it continues with the standard onboarding registration.
+// The voucher is exchanged in a JSON profile of the FDO voucher structure, with the entries encoded as JWS, since the
+// rendezvous and CBOR encoded transfer ownership protocols are replaced by the AM registration tree.
+
+// DeviceCredential is the FDO device credential installed during manufacturing
+type DeviceCredential struct {
+	GUID string
+	// Secret is the HMAC secret used to authenticate the ownership voucher header
+	Secret []byte
+	// ManufacturerKeyHash is the SHA-256 hash of the PKIX, ASN.1 DER encoded manufacturer public key
+	ManufacturerKeyHash []byte
+}
+
+// OwnershipVoucherHeader identifies the device and its manufacturer
+type OwnershipVoucherHeader struct {
+	GUID       string `json:"guid"`
+	DeviceInfo string `json:"deviceInfo,omitempty"`
+	// ManufacturerKey is the PKIX, ASN.1 DER encoded public key of the manufacturer
+	ManufacturerKey []byte `json:"manufacturerKey"`
+}
+
+// OwnershipVoucher transfers the ownership of a device from its manufacturer to its final owner
+type OwnershipVoucher struct {
+	// Header is the serialised OwnershipVoucherHeader, kept in its original form since it is authenticated by HMAC
+	Header json.RawMessage `json:"header"`
+	// HMAC is the HMAC-SHA256 of the header, calculated with the device credential secret
+	HMAC []byte `json:"hmac"`
+	// Entries transfer ownership in turn. Each entry is a JWS, signed by the key of the previous owner, that contains
+	// ownershipEntryClaims.
+	Entries []string `json:"entries"`
+}
+
+// ownershipEntryClaims are the contents of an ownership voucher entry
+type ownershipEntryClaims struct {
+	// Prev is the base64url encoded SHA-256 hash of the header or, after the first entry, the previous entry
+	Prev string `json:"prev"`
+	// Owner is the public key of the next owner
+	Owner jose.JSONWebKey `json:"owner"`
+}
+
+// ownerProofClaims are the claims of the JWT, signed with the final owner key, that proves that the registration tree
+// acts on behalf of the owner
+type ownerProofClaims struct {
+	GUID string `json:"guid"`
+	Iat  int64  `json:"iat"`
+	Exp  int64  `json:"exp"`
+}
+
+// fdoVoucher is the value sent by the registration tree in the voucher callback
+type fdoVoucher struct {
+	Voucher    OwnershipVoucher `json:"ownershipVoucher"`
+	OwnerProof string           `json:"ownerProof"`
+}
+
+func fdoHash(b []byte) string {
+	h := sha256.Sum256(b)
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+// VerifyFDOVoucher returns a voucher verifier for FDO ownership vouchers, to be used when onboarding a thing. The
+// voucher must be authenticated with the device credential, must be issued by the device's manufacturer and must be
+// accompanied by a current proof signed with the final owner key. The optional check is called with the final owner
+// key to apply further rules, such as only accepting known owners.
+func VerifyFDOVoucher(credential DeviceCredential, check func(owner crypto.PublicKey) error) VoucherVerifier {
+	return func(serialised, _ string, now func() time.Time) error {
+		var message fdoVoucher
+		if err := json.Unmarshal([]byte(serialised), &message); err != nil {
+			return err
+		}
+		voucher := message.Voucher
+		mac := hmac.New(sha256.New, credential.Secret)
+		mac.Write(voucher.Header)
+		if !hmac.Equal(mac.Sum(nil), voucher.HMAC) {
+			return errors.New("ownership voucher header not authenticated by device")
+		}
+		var header OwnershipVoucherHeader
+		if err := json.Unmarshal(voucher.Header, &header); err != nil {
+			return err
+		}
+		if header.GUID != credential.GUID {
+			return fmt.Errorf("ownership voucher issued for device %s", header.GUID)
+		}
+		manufacturerHash := sha256.Sum256(header.ManufacturerKey)
+		if !hmac.Equal(manufacturerHash[:], credential.ManufacturerKeyHash) {
+			return errors.New("ownership voucher not issued by the device manufacturer")
+		}
+		owner, err := x509.ParsePKIXPublicKey(header.ManufacturerKey)
+		if err != nil {
+			return err
+		}
+		if len(voucher.Entries) == 0 {
+			return errors.New("ownership voucher has no entries")
+		}
+		prev := fdoHash(voucher.Header)
+		for i, entry := range voucher.Entries {
+			signed, err := jose.ParseSigned(entry)
+			if err != nil {
+				return err
+			}
+			payload, err := signed.Verify(owner)
+			if err != nil {
+				return fmt.Errorf("ownership voucher entry %d: %w", i, err)
+			}
+			var claims ownershipEntryClaims
+			if err = json.Unmarshal(payload, &claims); err != nil {
+				return err
+			}
+			if claims.Prev != prev {
+				return fmt.Errorf("ownership voucher entry %d is not chained to its predecessor", i)
+			}
+			if claims.Owner.Key == nil || !claims.Owner.IsPublic() {
+				return fmt.Errorf("ownership voucher entry %d does not contain a public key", i)
+			}
+			owner = claims.Owner.Key
+			prev = fdoHash([]byte(entry))
+		}
+
+		proof, err := jwt.ParseSigned(message.OwnerProof)
+		if err != nil {
+			return err
+		}
+		var claims ownerProofClaims
+		if err = proof.Claims(owner, &claims); err != nil {
+			return fmt.Errorf("owner proof: %w", err)
+		}
+		switch {
+		case claims.GUID != credential.GUID:
+			return fmt.Errorf("owner proof issued for device %s", claims.GUID)
+		case claims.Exp == 0 || now().After(time.Unix(claims.Exp, 0)):
+			return errors.New("owner proof has expired")
+		}
+		if check != nil {
+			return check(owner)
+		}
+		return nil
+	}
+}
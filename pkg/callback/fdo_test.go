@@ -0,0 +1,145 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package callback
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/jws"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// testOwnershipVoucher creates a voucher for the device, issued by the manufacturer and transferred to the owners
+func testOwnershipVoucher(t *testing.T, guid string, secret []byte, manufacturer crypto.Signer,
+	owners ...crypto.Signer) OwnershipVoucher {
+	key, err := x509.MarshalPKIXPublicKey(manufacturer.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, _ := json.Marshal(OwnershipVoucherHeader{GUID: guid, ManufacturerKey: key})
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(header)
+	voucher := OwnershipVoucher{Header: header, HMAC: mac.Sum(nil)}
+	prev, signer := fdoHash(header), manufacturer
+	for _, owner := range owners {
+		sig, err := jws.NewSigner(signer, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload, _ := json.Marshal(ownershipEntryClaims{Prev: prev, Owner: jose.JSONWebKey{Key: owner.Public()}})
+		signed, err := sig.Sign(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry, _ := signed.CompactSerialize()
+		voucher.Entries = append(voucher.Entries, entry)
+		prev, signer = fdoHash([]byte(entry)), owner
+	}
+	return voucher
+}
+
+func testFDOVoucher(t *testing.T, voucher OwnershipVoucher, owner crypto.Signer, claims ownerProofClaims) string {
+	sig, err := jws.NewSigner(owner, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := jwt.Signed(sig).Claims(claims).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serialised, _ := json.Marshal(fdoVoucher{Voucher: voucher, OwnerProof: proof})
+	return string(serialised)
+}
+
+func TestVerifyFDOVoucher(t *testing.T) {
+	const guid = "4b8a2d7e-3c1f-4e59-9a0b-6d2f8c1e7a35"
+	secret := []byte("device-secret")
+	manufacturer, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	reseller, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	owner, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	manufacturerKey, _ := x509.MarshalPKIXPublicKey(manufacturer.Public())
+	manufacturerHash := sha256.Sum256(manufacturerKey)
+	credential := DeviceCredential{GUID: guid, Secret: secret, ManufacturerKeyHash: manufacturerHash[:]}
+	errOwner := errors.New("unknown owner")
+
+	valid := testOwnershipVoucher(t, guid, secret, manufacturer, reseller, owner)
+	proof := ownerProofClaims{GUID: guid, Iat: time.Now().Unix(), Exp: time.Now().Add(time.Minute).Unix()}
+	expired := proof
+	expired.Exp = time.Now().Add(-time.Minute).Unix()
+	otherDevice := proof
+	otherDevice.GUID = "other"
+	broken := testOwnershipVoucher(t, guid, secret, manufacturer, reseller, owner)
+	broken.Entries[0] = testOwnershipVoucher(t, guid, secret, manufacturer, other).Entries[0]
+
+	tests := []struct {
+		name    string
+		voucher string
+		check   func(crypto.PublicKey) error
+		valid   bool
+	}{
+		{name: "valid", voucher: testFDOVoucher(t, valid, owner, proof), valid: true},
+		{name: "direct-owner", voucher: testFDOVoucher(t, testOwnershipVoucher(t, guid, secret, manufacturer, owner),
+			owner, proof), valid: true},
+		{name: "wrong-secret", voucher: testFDOVoucher(t,
+			testOwnershipVoucher(t, guid, []byte("other"), manufacturer, owner), owner, proof)},
+		{name: "other-device", voucher: testFDOVoucher(t,
+			testOwnershipVoucher(t, "other", secret, manufacturer, owner), owner, proof)},
+		{name: "other-manufacturer", voucher: testFDOVoucher(t,
+			testOwnershipVoucher(t, guid, secret, other, owner), owner, proof)},
+		{name: "no-entries", voucher: testFDOVoucher(t, testOwnershipVoucher(t, guid, secret, manufacturer),
+			manufacturer, proof)},
+		{name: "broken-chain", voucher: testFDOVoucher(t, broken, owner, proof)},
+		{name: "not-final-owner", voucher: testFDOVoucher(t, valid, reseller, proof)},
+		{name: "expired-proof", voucher: testFDOVoucher(t, valid, owner, expired)},
+		{name: "proof-for-other-device", voucher: testFDOVoucher(t, valid, owner, otherDevice)},
+		{name: "check-failed", voucher: testFDOVoucher(t, valid, owner, proof), check: func(crypto.PublicKey) error {
+			return errOwner
+		}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			h := VoucherHandler{Verify: VerifyFDOVoucher(credential, subtest.check)}
+			cb := Callback{
+				Type:   TypeHiddenValueCallback,
+				Output: []Entry{{Name: "value", Value: subtest.voucher}, {Name: "id", Value: "voucher"}},
+				Input:  []Entry{{Name: "IDToken1"}},
+			}
+			handled, err := h.Handle(cb)
+			if !handled {
+				t.Fatal("voucher callback not handled")
+			}
+			if subtest.valid && err != nil {
+				t.Error(err)
+			}
+			if !subtest.valid && err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
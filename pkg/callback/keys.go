@@ -0,0 +1,74 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package callback
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// Confirmation keys
+// A thing can register several confirmation keys, for example a primary key and a backup key held in a different
+// hardware slot, or a key per signing algorithm. The registration JWT is signed with the key that the thing uses,
+// which is confirmed in the cnf.jwk claim as before, and all the keys are listed in the cnf.jwks claim so that the
+// registration tree can register them together. The thing then proves possession of any one of the registered keys,
+// identified by its key ID, when it authenticates.
+
+// ErrSigningFailed indicates that the key of a thing was unable to sign a proof of possession, for example because the
+// hardware that holds the key has failed
+var ErrSigningFailed = errors.New("signing failed")
+
+// ConfirmationKey is a public key that is registered for a thing in addition to the key with which it registers
+type ConfirmationKey struct {
+	KeyID string
+	Key   crypto.PublicKey
+}
+
+// confirmationKeySet returns the key set containing the signing key and the additional keys, or nil if there are no
+// additional keys
+func confirmationKeySet(signing jose.JSONWebKey, additional []ConfirmationKey) (*jose.JSONWebKeySet, error) {
+	if len(additional) == 0 {
+		return nil, nil
+	}
+	set := &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{signing}}
+	for _, k := range additional {
+		if k.KeyID == "" || k.KeyID == signing.KeyID {
+			return nil, fmt.Errorf("confirmation key requires a unique key ID, got `%s`", k.KeyID)
+		}
+		// only the public part of the key is registered, even if given a private key
+		key := jose.JSONWebKey{Key: k.Key, KeyID: k.KeyID, Use: "sig"}
+		key = key.Public()
+		if !key.Valid() {
+			return nil, fmt.Errorf("confirmation key %s is not a valid public key", k.KeyID)
+		}
+		set.Keys = append(set.Keys, key)
+	}
+	return set, nil
+}
+
+// serialize signs the JWT, failures of the signer are returned as ErrSigningFailed
+func serialize(builder jwt.Builder) (string, error) {
+	response, err := builder.CompactSerialize()
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrSigningFailed, err)
+	}
+	return response, nil
+}
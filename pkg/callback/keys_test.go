@@ -0,0 +1,108 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package callback
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/jws"
+	"gopkg.in/square/go-jose.v2"
+)
+
+func TestRegisterHandler_Handle_AdditionalKeys(t *testing.T) {
+	backup, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tests := []struct {
+		name       string
+		additional []ConfirmationKey
+		keys       []string
+		successful bool
+	}{
+		{name: "none", successful: true},
+		{name: "backup", additional: []ConfirmationKey{{KeyID: "backup", Key: backup.Public()}},
+			keys: []string{testKID, "backup"}, successful: true},
+		// only the public part of a private key is registered
+		{name: "private", additional: []ConfirmationKey{{KeyID: "backup", Key: backup}},
+			keys: []string{testKID, "backup"}, successful: true},
+		{name: "duplicate-key-id", additional: []ConfirmationKey{{KeyID: testKID, Key: backup.Public()}}},
+		{name: "missing-key-id", additional: []ConfirmationKey{{Key: backup.Public()}}},
+		{name: "missing-key", additional: []ConfirmationKey{{KeyID: "backup"}}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			h := RegisterHandler{Audience: testRealm, ThingID: "thingOne", ThingType: TypeDevice, KeyID: testKID,
+				Key: testKey, AdditionalKeys: subtest.additional}
+			cb := jwtVerifyCB(true)
+			_, err := h.Handle(cb)
+			if !subtest.successful {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var claims struct {
+				CNF struct {
+					JWK  jose.JSONWebKey     `json:"jwk"`
+					JWKS *jose.JSONWebKeySet `json:"jwks"`
+				} `json:"cnf"`
+			}
+			if err = jws.ExtractClaims(cb.Input[0].Value, &claims); err != nil {
+				t.Fatal(err)
+			}
+			if claims.CNF.JWK.KeyID != testKID {
+				t.Errorf("expected the signing key in the jwk claim; got %s", claims.CNF.JWK.KeyID)
+			}
+			var keys []string
+			if claims.CNF.JWKS != nil {
+				for _, key := range claims.CNF.JWKS.Keys {
+					if !key.IsPublic() {
+						t.Errorf("private key %s registered", key.KeyID)
+					}
+					keys = append(keys, key.KeyID)
+				}
+			}
+			if !reflect.DeepEqual(keys, subtest.keys) {
+				t.Errorf("expected keys %v; got %v", subtest.keys, keys)
+			}
+		})
+	}
+}
+
+// failingSigner is a key whose hardware has failed
+type failingSigner struct {
+	crypto.Signer
+}
+
+func (failingSigner) Sign(io.Reader, []byte, crypto.SignerOpts) ([]byte, error) {
+	return nil, errors.New("hardware slot failed")
+}
+
+func TestAuthenticateHandler_Handle_SigningFailed(t *testing.T) {
+	h := AuthenticateHandler{Audience: testRealm, ThingID: "thingOne", KeyID: testKID, Key: failingSigner{testKey}}
+	if _, err := h.Handle(jwtVerifyCB(false)); !errors.Is(err, ErrSigningFailed) {
+		t.Errorf("expected %v; got %v", ErrSigningFailed, err)
+	}
+}
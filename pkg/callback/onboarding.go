@@ -0,0 +1,303 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package callback
+
+import (
+	"crypto"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/jws"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// Zero-touch onboarding
+// A device leaves the factory with an initial device identity (IDevID, IEEE 802.1AR): a key and a certificate chain
+// issued by the manufacturer. During onboarding the device registers a locally generated operational key (LDevID)
+// with the registration tree and proves with the IDevID that it is a genuine device. The registration tree may send
+// a voucher (RFC 8366) that allows the device to verify that it is being onboarded by the intended owner.
+
+// IDevID is the initial device identity installed by the manufacturer
+type IDevID struct {
+	Key crypto.Signer
+	// Certificates contains the IDevID certificate followed by the manufacturer's intermediate certificates
+	Certificates []*x509.Certificate
+}
+
+// idevidProofClaims are the claims of the JWT, signed with the IDevID key, that binds the operational key to the
+// registration challenge
+type idevidProofClaims struct {
+	Sub   string `json:"sub"`
+	Aud   string `json:"aud"`
+	Iat   int64  `json:"iat"`
+	Exp   int64  `json:"exp"`
+	Nonce string `json:"nonce"`
+	// JKT is the JWK thumbprint of the operational key
+	JKT string `json:"jkt"`
+}
+
+// idevidClaims are added to the registration JWT to prove possession of the IDevID
+type idevidClaims struct {
+	IDevID struct {
+		Proof string `json:"proof"`
+	} `json:"idevid"`
+}
+
+// OnboardHandler handles the callback received from the Register Thing tree node when a device is onboarded with its
+// IDevID. The operational key and certificates are registered for the thing, while the IDevID certificate chain is
+// included in a proof that is signed with the IDevID key, binding the operational key to the registration challenge.
+type OnboardHandler struct {
+	Audience  string
+	ThingID   string
+	ThingType ThingType
+	// KeyID, Key and Certificates describe the operational key. The certificates are optional.
+	KeyID        string
+	Key          crypto.Signer
+	Certificates []*x509.Certificate
+	IDevID       IDevID
+	Claims       func() interface{}
+	Evidence     EvidenceFunc
+	OAuth2Client string
+	Groups       []string
+	// AdditionalKeys are optional and are registered as confirmation keys of the thing together with Key
+	AdditionalKeys []ConfirmationKey
+	// CompressPoint is optional and confirms a P-256 Key with its compressed point, which AM must support
+	CompressPoint bool
+	// Now is optional and returns the time at which the JWTs are issued, by default the time of the device
+	Now func() time.Time
+	// Challenge is optional and is set to the registration challenge signed in the IDevID proof, which a voucher sent
+	// by the registration tree must be bound to, see VoucherHandler
+	Challenge *string
+}
+
+func (h OnboardHandler) Handle(cb Callback) (bool, error) {
+	if cb.ID() != "jwt-pop-registration" {
+		return false, nil
+	}
+	challenge, err := popChallenge(cb)
+	if err != nil {
+		return true, err
+	}
+	if h.IDevID.Key == nil || len(h.IDevID.Certificates) == 0 {
+		return true, errors.New("onboarding requires the IDevID key and certificate")
+	}
+
+	proof, err := h.idevidProof(challenge)
+	if err != nil {
+		return true, err
+	}
+	if h.Challenge != nil {
+		*h.Challenge = challenge
+	}
+	var claims idevidClaims
+	claims.IDevID.Proof = proof
+	register := RegisterHandler{
+		Audience:       h.Audience,
+		ThingID:        h.ThingID,
+		ThingType:      h.ThingType,
+		KeyID:          h.KeyID,
+		Key:            h.Key,
+		Certificates:   h.Certificates,
+		Claims:         h.Claims,
+		Evidence:       h.Evidence,
+		OAuth2Client:   h.OAuth2Client,
+		Groups:         h.Groups,
+		AdditionalKeys: h.AdditionalKeys,
+		CompressPoint:  h.CompressPoint,
+		Now:            h.Now,
+	}
+	response, err := register.signedJWT(challenge, claims)
+	if err != nil {
+		return true, err
+	}
+
+	cb.Input[0].Value = response
+	return true, nil
+}
+
+// idevidProof returns a JWT signed with the IDevID key that contains the thumbprint of the operational key
+func (h OnboardHandler) idevidProof(challenge string) (string, error) {
+	thumbprint, err := jws.Thumbprint(h.Key.Public())
+	if err != nil {
+		return "", err
+	}
+	opts := &jose.SignerOptions{}
+	opts.WithType("JWT")
+	opts.WithHeader("x5c", encodeCertificates(h.IDevID.Certificates))
+	sig, err := jws.NewSigner(h.IDevID.Key, opts)
+	if err != nil {
+		return "", err
+	}
+	now := issuedAt(h.Now)
+	return jwt.Signed(sig).Claims(idevidProofClaims{
+		Sub:   h.ThingID,
+		Aud:   h.Audience,
+		Iat:   now.Unix(),
+		Exp:   now.Add(5 * time.Minute).Unix(),
+		Nonce: challenge,
+		JKT:   base64.RawURLEncoding.EncodeToString(thumbprint),
+	}).CompactSerialize()
+}
+
+// encodeCertificates encodes the certificates for an x5c header
+func encodeCertificates(certificates []*x509.Certificate) []string {
+	encoded := make([]string, len(certificates))
+	for i, c := range certificates {
+		encoded[i] = base64.StdEncoding.EncodeToString(c.Raw)
+	}
+	return encoded
+}
+
+// VoucherVerifier verifies the serialised voucher sent by the registration tree and must return an error if the
+// voucher is not acceptable. The nonce is the registration challenge that the thing signed in its IDevID proof, which
+// is empty if the thing has not signed a proof yet, and now returns the current time of the thing.
+type VoucherVerifier func(voucher, nonce string, now func() time.Time) error
+
+// VoucherHandler handles the voucher sent by the registration tree during onboarding. The thing verifies the voucher
+// before it continues with the registration.
+type VoucherHandler struct {
+	Verify VoucherVerifier
+	// Nonce is optional and refers to the registration challenge recorded by OnboardHandler.Challenge
+	Nonce *string
+	// Now is optional and returns the time used to check the validity of the voucher, by default the time of the device
+	Now func() time.Time
+}
+
+func (h VoucherHandler) Handle(cb Callback) (bool, error) {
+	if cb.ID() != "voucher" {
+		return false, nil
+	}
+	if len(cb.Input) == 0 {
+		return true, errNoInput
+	}
+	var voucher string
+	for _, e := range cb.Output {
+		if e.Name == "value" {
+			voucher = e.Value
+		}
+	}
+	if voucher == "" {
+		return true, errNoOutput
+	}
+	if h.Verify == nil {
+		return true, errors.New("no voucher verifier provided")
+	}
+	var nonce string
+	if h.Nonce != nil {
+		nonce = *h.Nonce
+	}
+	now := h.Now
+	if now == nil {
+		now = time.Now
+	}
+	if err := h.Verify(voucher, nonce, now); err != nil {
+		return true, fmt.Errorf("voucher rejected: %w", err)
+	}
+	cb.Input[0].Value = "accepted"
+	return true, nil
+}
+
+// Voucher contains the voucher artifact as defined by RFC 8366
+type Voucher struct {
+	CreatedOn        time.Time `json:"created-on"`
+	ExpiresOn        time.Time `json:"expires-on,omitempty"`
+	Assertion        string    `json:"assertion"`
+	SerialNumber     string    `json:"serial-number"`
+	IDevIDIssuer     []byte    `json:"idevid-issuer,omitempty"`
+	PinnedDomainCert []byte    `json:"pinned-domain-cert"`
+	Nonce            string    `json:"nonce,omitempty"`
+}
+
+type voucherClaims struct {
+	Voucher *Voucher `json:"ietf-voucher:voucher"`
+}
+
+// pinnedDomain checks that the pinned domain certificate of the voucher is one of the domain certificates or issued
+// one of them
+func pinnedDomain(voucher *Voucher, domain []*x509.Certificate) error {
+	if len(voucher.PinnedDomainCert) == 0 {
+		return errors.New("voucher does not contain a pinned domain certificate")
+	}
+	pinned, err := x509.ParseCertificate(voucher.PinnedDomainCert)
+	if err != nil {
+		return fmt.Errorf("invalid pinned domain certificate: %w", err)
+	}
+	for _, c := range domain {
+		if c.Equal(pinned) || c.CheckSignatureFrom(pinned) == nil {
+			return nil
+		}
+	}
+	return errors.New("voucher not issued for this domain")
+}
+
+// VerifyJWSVoucher returns a voucher verifier for vouchers signed as JWS, with the signing certificate chain in the
+// x5c header. The chain must lead to one of the manufacturer's roots and the voucher must be issued for the device
+// with the given serial number. The voucher must contain the registration challenge signed by the thing as its nonce,
+// so that it can not be replayed in another registration, and its pinned domain certificate must be one of the domain
+// certificates, such as the server certificate of AM or of the Thing Gateway, or the certificate of a CA that issued
+// one of them. The optional check is called with the verified voucher to apply further rules.
+func VerifyJWSVoucher(roots *x509.CertPool, serialNumber string, domain []*x509.Certificate,
+	check func(voucher Voucher) error) VoucherVerifier {
+	return func(serialised, nonce string, now func() time.Time) error {
+		if len(domain) == 0 {
+			return errors.New("no domain certificates to verify the voucher against")
+		}
+		token, err := jwt.ParseSigned(serialised)
+		if err != nil {
+			return err
+		}
+		if len(token.Headers) != 1 {
+			return errors.New("voucher must have a single signature")
+		}
+		chains, err := token.Headers[0].Certificates(x509.VerifyOptions{
+			Roots:     roots,
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err != nil {
+			return err
+		}
+		var claims voucherClaims
+		if err = token.Claims(chains[0][0].PublicKey, &claims); err != nil {
+			return err
+		}
+		voucher := claims.Voucher
+		switch {
+		case voucher == nil:
+			return errors.New("missing voucher")
+		case voucher.SerialNumber != serialNumber:
+			return fmt.Errorf("voucher issued for serial number %s", voucher.SerialNumber)
+		case nonce == "" || voucher.Nonce == "":
+			return errors.New("voucher is not bound to a registration challenge")
+		case subtle.ConstantTimeCompare([]byte(voucher.Nonce), []byte(nonce)) != 1:
+			return errors.New("voucher not issued for this registration")
+		case !voucher.ExpiresOn.IsZero() && now().After(voucher.ExpiresOn):
+			return errors.New("voucher has expired")
+		}
+		if err = pinnedDomain(voucher, domain); err != nil {
+			return err
+		}
+		if check != nil {
+			return check(*voucher)
+		}
+		return nil
+	}
+}
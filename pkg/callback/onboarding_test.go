@@ -0,0 +1,247 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package callback
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/jws"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// testCertificate creates a certificate for the key, signed by the issuer or self-signed if the issuer is nil
+func testCertificate(t *testing.T, name string, key crypto.Signer, issuer *x509.Certificate, issuerKey crypto.Signer) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  issuer == nil,
+		BasicConstraintsValid: true,
+	}
+	if issuer == nil {
+		issuer, issuerKey = template, key
+	}
+	b, err := x509.CreateCertificate(rand.Reader, template, issuer, key.Public(), issuerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestOnboardHandler_Handle(t *testing.T) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca := testCertificate(t, "manufacturer", caKey, nil, nil)
+	idevidKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	idevidCert := testCertificate(t, "SN-12345", idevidKey, ca, caKey)
+	operationalKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	h := OnboardHandler{
+		Audience:  testRealm,
+		ThingID:   "thingOne",
+		ThingType: TypeDevice,
+		KeyID:     testKID,
+		Key:       operationalKey,
+		IDevID:    IDevID{Key: idevidKey, Certificates: []*x509.Certificate{idevidCert}},
+	}
+	var challenge string
+	h.Challenge = &challenge
+	cb := jwtVerifyCB(true)
+	if _, err := h.Handle(cb); err != nil {
+		t.Fatal(err)
+	}
+	if challenge != "12345" {
+		t.Error("challenge not recorded")
+	}
+
+	var claims struct {
+		CNF struct {
+			JWK *jose.JSONWebKey `json:"jwk,omitempty"`
+		} `json:"cnf"`
+		IDevID struct {
+			Proof string `json:"proof"`
+		} `json:"idevid"`
+	}
+	if err := jws.ExtractClaims(cb.Input[0].Value, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.CNF.JWK == nil || claims.CNF.JWK.KeyID != testKID {
+		t.Fatal("operational key not registered")
+	}
+
+	// the proof is signed by the IDevID, which chains to the manufacturer CA, and binds the operational key
+	proof, err := jwt.ParseSigned(claims.IDevID.Proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	chains, err := proof.Headers[0].Certificates(x509.VerifyOptions{Roots: roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var proofClaims idevidProofClaims
+	if err = proof.Claims(chains[0][0].PublicKey, &proofClaims); err != nil {
+		t.Fatal(err)
+	}
+	thumbprint, _ := claims.CNF.JWK.Thumbprint(crypto.SHA256)
+	if proofClaims.JKT != base64.RawURLEncoding.EncodeToString(thumbprint) {
+		t.Error("proof does not contain the thumbprint of the operational key")
+	}
+	if proofClaims.Nonce != "12345" {
+		t.Error("proof does not contain the challenge")
+	}
+}
+
+func TestOnboardHandler_Handle_MissingIDevID(t *testing.T) {
+	h := OnboardHandler{Audience: testRealm, ThingID: "thingOne", KeyID: testKID, Key: testKey}
+	if _, err := h.Handle(jwtVerifyCB(true)); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func testVoucher(t *testing.T, key crypto.Signer, cert *x509.Certificate, voucher Voucher) string {
+	opts := &jose.SignerOptions{}
+	opts.WithHeader("x5c", encodeCertificates([]*x509.Certificate{cert}))
+	sig, err := jws.NewSigner(key, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serialised, err := jwt.Signed(sig).Claims(voucherClaims{Voucher: &voucher}).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serialised
+}
+
+func TestVerifyJWSVoucher(t *testing.T) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca := testCertificate(t, "manufacturer", caKey, nil, nil)
+	masaKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	masa := testCertificate(t, "masa", masaKey, ca, caKey)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	other := testCertificate(t, "other", otherKey, nil, nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	domainCAKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	domainCA := testCertificate(t, "owner", domainCAKey, nil, nil)
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	server := testCertificate(t, "am.example.com", serverKey, domainCA, domainCAKey)
+	domain := []*x509.Certificate{server}
+	errDomain := errors.New("unexpected domain")
+
+	valid := Voucher{
+		CreatedOn:        time.Now(),
+		ExpiresOn:        time.Now().Add(time.Hour),
+		Assertion:        "verified",
+		SerialNumber:     "SN-12345",
+		PinnedDomainCert: domainCA.Raw,
+		Nonce:            "12345",
+	}
+	expired := valid
+	expired.ExpiresOn = time.Now().Add(-time.Minute)
+	otherDevice := valid
+	otherDevice.SerialNumber = "SN-54321"
+	noExpiry := valid
+	noExpiry.ExpiresOn = time.Time{}
+	otherRegistration := valid
+	otherRegistration.Nonce = "54321"
+	unbound := valid
+	unbound.Nonce = ""
+	pinnedServer := valid
+	pinnedServer.PinnedDomainCert = server.Raw
+	otherDomain := valid
+	otherDomain.PinnedDomainCert = other.Raw
+	unpinned := valid
+	unpinned.PinnedDomainCert = nil
+
+	tests := []struct {
+		name        string
+		voucher     string
+		noChallenge bool
+		domain      []*x509.Certificate
+		check       func(Voucher) error
+		now         func() time.Time
+		valid       bool
+	}{
+		{name: "valid", voucher: testVoucher(t, masaKey, masa, valid), valid: true},
+		{name: "untrusted-signer", voucher: testVoucher(t, otherKey, other, valid)},
+		{name: "expired", voucher: testVoucher(t, masaKey, masa, expired)},
+		{name: "expired-device-time", voucher: testVoucher(t, masaKey, masa, valid), now: func() time.Time {
+			return time.Now().Add(2 * time.Hour)
+		}},
+		{name: "no-expiry", voucher: testVoucher(t, masaKey, masa, noExpiry), valid: true},
+		{name: "other-registration", voucher: testVoucher(t, masaKey, masa, otherRegistration)},
+		{name: "no-nonce", voucher: testVoucher(t, masaKey, masa, unbound)},
+		{name: "no-challenge", voucher: testVoucher(t, masaKey, masa, valid), noChallenge: true},
+		{name: "other-device", voucher: testVoucher(t, masaKey, masa, otherDevice)},
+		{name: "pinned-server", voucher: testVoucher(t, masaKey, masa, pinnedServer), valid: true},
+		{name: "other-domain", voucher: testVoucher(t, masaKey, masa, otherDomain)},
+		{name: "no-pinned-domain", voucher: testVoucher(t, masaKey, masa, unpinned)},
+		{name: "no-domain", voucher: testVoucher(t, masaKey, masa, valid), domain: []*x509.Certificate{}},
+		{name: "check-failed", voucher: testVoucher(t, masaKey, masa, valid), check: func(Voucher) error {
+			return errDomain
+		}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			challenge := "12345"
+			if subtest.noChallenge {
+				challenge = ""
+			}
+			verifyDomain := domain
+			if subtest.domain != nil {
+				verifyDomain = subtest.domain
+			}
+			h := VoucherHandler{
+				Verify: VerifyJWSVoucher(roots, "SN-12345", verifyDomain, subtest.check),
+				Nonce:  &challenge,
+				Now:    subtest.now,
+			}
+			cb := Callback{
+				Type:   TypeHiddenValueCallback,
+				Output: []Entry{{Name: "value", Value: subtest.voucher}, {Name: "id", Value: "voucher"}},
+				Input:  []Entry{{Name: "IDToken1"}},
+			}
+			handled, err := h.Handle(cb)
+			if !handled {
+				t.Fatal("voucher callback not handled")
+			}
+			if subtest.valid && err != nil {
+				t.Error(err)
+			}
+			if !subtest.valid && err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
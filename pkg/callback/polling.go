@@ -0,0 +1,94 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package callback
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Suspended authentication
+// An authentication tree can pause while it waits for an external event, for example an operator approving a new
+// device in a console. A polling node, such as a polling wait node, returns a PollingWaitCallback that asks the thing
+// to wait before it sends the callback back to continue the tree, while a suspend node returns a
+// SuspendedTextOutputCallback and resumes the tree when it is notified. The PollingWaitHandler waits as asked or, so
+// that a thing does not have to stay awake while it waits for an approval, suspends the authentication. A suspended
+// authentication is reported with a SuspendedError, which holds the state that the thing must persist to resume the
+// authentication later without restarting the tree, see thing.Builder.ResumeAuthentication.
+
+const (
+	TypePollingWaitCallback         = "PollingWaitCallback"
+	TypeSuspendedTextOutputCallback = "SuspendedTextOutputCallback"
+)
+
+// SuspendedError is returned when an authentication tree is suspended. Persist the error, which can be encoded as
+// JSON, and provide it to thing.Builder.ResumeAuthentication to resume the authentication. AM limits the time for
+// which a suspended authentication can be resumed.
+type SuspendedError struct {
+	// AuthID identifies the state of the authentication in AM
+	AuthID string `json:"authId"`
+	// Callbacks are sent back to AM when the authentication is resumed
+	Callbacks []Callback `json:"callbacks"`
+	// Message is the text of the callback that suspended the authentication, for example "Waiting for approval"
+	Message string `json:"message,omitempty"`
+	// WaitTime is the time that AM asked the thing to wait before it resumes the authentication, zero if the thing
+	// must wait for the tree to be resumed externally
+	WaitTime time.Duration `json:"waitTime,omitempty"`
+}
+
+func (e SuspendedError) Error() string {
+	if e.Message == "" {
+		return "authentication suspended"
+	}
+	return "authentication suspended: " + e.Message
+}
+
+// PollingWaitHandler handles the callbacks of authentication tree nodes that wait for an external event
+type PollingWaitHandler struct {
+	// Suspend the authentication with a SuspendedError instead of waiting for the time requested by a
+	// PollingWaitCallback
+	Suspend bool
+	// MaxWait limits the time waited per callback, no limit if zero
+	MaxWait time.Duration
+}
+
+func (h PollingWaitHandler) Handle(cb Callback) (bool, error) {
+	switch cb.Type {
+	case TypePollingWaitCallback:
+		entry, ok := cb.OutputEntry("waitTime")
+		if !ok {
+			return true, errNoOutput
+		}
+		milliseconds, err := strconv.Atoi(entry.Value)
+		if err != nil {
+			return true, fmt.Errorf("invalid wait time %s", entry.Value)
+		}
+		wait := time.Duration(milliseconds) * time.Millisecond
+		if h.Suspend {
+			return true, SuspendedError{Message: cb.Prompt(), WaitTime: wait}
+		}
+		if h.MaxWait > 0 && wait > h.MaxWait {
+			wait = h.MaxWait
+		}
+		time.Sleep(wait)
+		return true, nil
+	case TypeSuspendedTextOutputCallback:
+		return true, SuspendedError{Message: cb.Prompt()}
+	}
+	return false, nil
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package callback
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPollingWaitHandler_Handle(t *testing.T) {
+	polling := Callback{Type: TypePollingWaitCallback,
+		Output: []Entry{{Name: "waitTime", Value: "8000"}, {Name: "message", Value: "Waiting for approval"}}}
+	suspended := Callback{Type: TypeSuspendedTextOutputCallback,
+		Output: []Entry{{Name: "message", Value: "Approval requested"}}}
+	tests := []struct {
+		name      string
+		handler   PollingWaitHandler
+		callback  Callback
+		handled   bool
+		suspended *SuspendedError
+		fail      bool
+	}{
+		{name: "wait", handler: PollingWaitHandler{MaxWait: time.Millisecond}, callback: polling, handled: true},
+		{name: "suspend", handler: PollingWaitHandler{Suspend: true}, callback: polling, handled: true,
+			suspended: &SuspendedError{Message: "Waiting for approval", WaitTime: 8 * time.Second}},
+		{name: "suspended-node", callback: suspended, handled: true,
+			suspended: &SuspendedError{Message: "Approval requested"}},
+		{name: "invalid-wait-time", callback: Callback{Type: TypePollingWaitCallback,
+			Output: []Entry{{Name: "waitTime", Value: "soon"}}}, handled: true, fail: true},
+		{name: "other-callback", callback: Callback{Type: TypeNameCallback}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			handled, err := subtest.handler.Handle(subtest.callback)
+			if handled != subtest.handled {
+				t.Errorf("expected handled %v", subtest.handled)
+			}
+			var s SuspendedError
+			switch {
+			case subtest.suspended != nil:
+				if !errors.As(err, &s) || s.Message != subtest.suspended.Message ||
+					s.WaitTime != subtest.suspended.WaitTime {
+					t.Errorf("expected %v; got %v", subtest.suspended, err)
+				}
+			case (err != nil) != subtest.fail:
+				t.Errorf("unexpected error %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package callback
+
+import (
+	"errors"
+	"fmt"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+// Pre-shared key registration
+// Fleets whose manufacturing line cannot issue a certificate for every device can instead provision each device with
+// a pre-shared key (PSK) that is also known to the registration tree. The registration JWT, which is signed by the key
+// that is being registered, is nested (RFC 7519 section 5.2) in a JWT that is MACed with the PSK using HS256. The
+// identity of the PSK is sent in the kid header of the outer JWT so that the tree can look up the key, verify the MAC
+// and then process the registration JWT as usual.
+
+// minimumPSKSize is the minimum size in bytes of a pre-shared key, as required by RFC 7518 section 3.2 for HS256
+const minimumPSKSize = 32
+
+// PreSharedKey is a secret key, provisioned in the factory, that is shared between a thing and the registration tree
+type PreSharedKey struct {
+	// ID identifies the key to the registration tree
+	ID string
+	// Key is the secret key and must be at least 32 bytes long
+	Key []byte
+}
+
+// nest returns the token nested in a JWT that is MACed with the pre-shared key
+func (k PreSharedKey) nest(token string) (string, error) {
+	if len(k.Key) < minimumPSKSize {
+		return "", fmt.Errorf("pre-shared key must be at least %d bytes", minimumPSKSize)
+	}
+	opts := &jose.SignerOptions{}
+	opts.WithType("JWT")
+	opts.WithContentType("JWT")
+	opts.WithHeader("kid", k.ID)
+	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: k.Key}, opts)
+	if err != nil {
+		return "", err
+	}
+	object, err := sig.Sign([]byte(token))
+	if err != nil {
+		return "", err
+	}
+	return object.CompactSerialize()
+}
+
+// VerifyPreSharedKeyJWT verifies the MAC of a JWT that was nested by a thing registering with a pre-shared key and
+// returns the nested registration JWT. The lookup function is called with the identity of the pre-shared key and
+// should return an error if the key is unknown.
+func VerifyPreSharedKeyJWT(token string, lookup func(id string) ([]byte, error)) (string, error) {
+	object, err := jose.ParseSigned(token)
+	if err != nil {
+		return "", err
+	}
+	if len(object.Signatures) != 1 {
+		return "", errors.New("pre-shared key JWT must have a single signature")
+	}
+	header := object.Signatures[0].Header
+	if header.Algorithm != string(jose.HS256) {
+		return "", fmt.Errorf("unexpected pre-shared key JWT algorithm %s", header.Algorithm)
+	}
+	key, err := lookup(header.KeyID)
+	if err != nil {
+		return "", err
+	}
+	payload, err := object.Verify(key)
+	if err != nil {
+		return "", err
+	}
+	return string(payload), nil
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package callback
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/jws"
+)
+
+func testPSKLookup(id string) ([]byte, error) {
+	if id != "psk-1" {
+		return nil, errors.New("unknown key")
+	}
+	return bytes.Repeat([]byte{1}, 32), nil
+}
+
+func TestRegisterHandler_Handle_PreSharedKey(t *testing.T) {
+	tests := []struct {
+		name  string
+		psk   PreSharedKey
+		valid bool
+	}{
+		{name: "valid", psk: PreSharedKey{ID: "psk-1", Key: bytes.Repeat([]byte{1}, 32)}, valid: true},
+		{name: "wrong-key", psk: PreSharedKey{ID: "psk-1", Key: bytes.Repeat([]byte{2}, 32)}},
+		{name: "unknown-id", psk: PreSharedKey{ID: "psk-2", Key: bytes.Repeat([]byte{1}, 32)}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			psk := subtest.psk
+			h := RegisterHandler{Audience: testRealm, ThingID: "thingOne", KeyID: testKID, Key: testKey, PSK: &psk}
+			cb := jwtVerifyCB(true)
+			if _, err := h.Handle(cb); err != nil {
+				t.Fatal(err)
+			}
+			nested, err := VerifyPreSharedKeyJWT(cb.Input[0].Value, testPSKLookup)
+			if !subtest.valid {
+				if err == nil {
+					t.Error("expected the verification to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var claims jwtVerifyClaims
+			if err = jws.ExtractClaims(nested, &claims); err != nil {
+				t.Fatal(err)
+			}
+			if claims.Sub != "thingOne" || claims.CNF.JWK == nil {
+				t.Errorf("unexpected registration claims %v", claims)
+			}
+		})
+	}
+}
+
+func TestRegisterHandler_Handle_ShortPreSharedKey(t *testing.T) {
+	h := RegisterHandler{Audience: testRealm, ThingID: "thingOne", KeyID: testKID, Key: testKey,
+		PSK: &PreSharedKey{ID: "psk-1", Key: []byte("short")}}
+	if _, err := h.Handle(jwtVerifyCB(true)); err == nil {
+		t.Error("expected an error for a short key")
+	}
+}
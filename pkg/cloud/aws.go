@@ -0,0 +1,236 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cloud
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/clock"
+	"github.com/JacoJooste/iot-edge/v7/pkg/thing"
+)
+
+const (
+	// defaultSTSEndpoint is the global endpoint of AWS STS
+	defaultSTSEndpoint = "https://sts.amazonaws.com/"
+	// defaultSessionName is the name of the role session if the configuration does not set one
+	defaultSessionName = "iot-thing"
+	// refreshBefore is the time before expiry at which cached credentials are renewed
+	refreshBefore = time.Minute
+	// maxResponseSize is the maximum size of a response from a cloud provider
+	maxResponseSize = 64 * 1024
+)
+
+// ErrRejected indicates that the cloud provider rejected the identity of the thing
+var ErrRejected = errors.New("cloud provider rejected the request")
+
+// AWSCredentials are temporary AWS credentials with which a thing signs its requests
+type AWSCredentials struct {
+	AccessKeyID     string    `json:"accessKeyId"`
+	SecretAccessKey string    `json:"secretAccessKey"`
+	SessionToken    string    `json:"sessionToken"`
+	Expiry          time.Time `json:"expiration"`
+}
+
+// AWS obtains temporary AWS credentials for a thing, either from AWS STS with the access token of the thing or from
+// the AWS IoT Core credentials provider with the certificate of the thing. The credentials are cached until shortly
+// before they expire. An AWS bridge must not be copied after first use.
+type AWS struct {
+	Thing thing.Thing
+	// RoleARN of the IAM role that trusts AM as an OpenID Connect identity provider, used if RoleAlias is empty
+	RoleARN string
+	// SessionName identifies the role session in AWS CloudTrail, defaults to iot-thing
+	SessionName string
+	// Scopes are requested for the access token that is exchanged with AWS STS
+	Scopes []string
+	// Duration of the role session, the default of the role is used if zero
+	Duration time.Duration
+	// STSEndpoint is the AWS STS endpoint, defaults to the global endpoint
+	STSEndpoint *url.URL
+
+	// RoleAlias of the role in the AWS IoT Core credentials provider, which is used instead of AWS STS if set
+	RoleAlias string
+	// CredentialsEndpoint is the host of the AWS IoT Core credentials provider of the AWS account
+	CredentialsEndpoint string
+	// ThingName is optional and sent to the credentials provider as the name of the thing in AWS IoT Core
+	ThingName string
+	// TLS configures the connection to the credentials provider and must contain the certificate of the thing
+	TLS *tls.Config
+
+	// Client makes requests to AWS STS, the default HTTP client is used if nil
+	Client *http.Client
+
+	mutex   sync.Mutex
+	current AWSCredentials
+}
+
+// Credentials returns the AWS credentials of the thing, renewing them if they are about to expire
+func (a *AWS) Credentials() (AWSCredentials, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.current.AccessKeyID != "" && clock.Clock().Before(a.current.Expiry.Add(-refreshBefore)) {
+		return a.current, nil
+	}
+	var c AWSCredentials
+	var err error
+	if a.RoleAlias != "" {
+		c, err = a.credentialsProvider()
+	} else {
+		c, err = a.assumeRole()
+	}
+	if err != nil {
+		return AWSCredentials{}, err
+	}
+	a.current = c
+	return c, nil
+}
+
+// stsResponse is the response of AWS STS to an AssumeRoleWithWebIdentity request or an error response
+type stsResponse struct {
+	Result struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"Credentials"`
+	} `xml:"AssumeRoleWithWebIdentityResult"`
+	Error struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	} `xml:"Error"`
+}
+
+// assumeRole exchanges an access token of the thing with AWS STS for the credentials of the role
+func (a *AWS) assumeRole() (c AWSCredentials, err error) {
+	if a.Thing == nil || a.RoleARN == "" {
+		return c, errors.New("thing and role ARN required")
+	}
+	response, err := a.Thing.RequestAccessToken(a.Scopes...)
+	if err != nil {
+		return c, err
+	}
+	token, err := response.AccessToken()
+	if err != nil {
+		return c, err
+	}
+	sessionName := a.SessionName
+	if sessionName == "" {
+		sessionName = defaultSessionName
+	}
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {a.RoleARN},
+		"RoleSessionName":  {sessionName},
+		"WebIdentityToken": {token},
+	}
+	if a.Duration > 0 {
+		form.Set("DurationSeconds", strconv.Itoa(int(a.Duration/time.Second)))
+	}
+	endpoint := defaultSTSEndpoint
+	if a.STSEndpoint != nil {
+		endpoint = a.STSEndpoint.String()
+	}
+	request, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return c, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	status, body, err := do(a.Client, request)
+	if err != nil {
+		return c, err
+	}
+	var sts stsResponse
+	if err = xml.Unmarshal(body, &sts); err != nil {
+		return c, fmt.Errorf("invalid AWS STS response; %w", err)
+	}
+	if status != http.StatusOK {
+		return c, fmt.Errorf("%w: AWS STS responded with status %d %s %s", ErrRejected, status, sts.Error.Code,
+			sts.Error.Message)
+	}
+	result := sts.Result.Credentials
+	if result.AccessKeyID == "" {
+		return c, fmt.Errorf("%w: AWS STS response does not contain credentials", ErrRejected)
+	}
+	return AWSCredentials{
+		AccessKeyID:     result.AccessKeyID,
+		SecretAccessKey: result.SecretAccessKey,
+		SessionToken:    result.SessionToken,
+		Expiry:          result.Expiration,
+	}, nil
+}
+
+// credentialsProvider requests the credentials of the role alias from the AWS IoT Core credentials provider
+func (a *AWS) credentialsProvider() (c AWSCredentials, err error) {
+	if a.CredentialsEndpoint == "" || a.TLS == nil {
+		return c, errors.New("credentials endpoint and TLS configuration required")
+	}
+	endpoint := url.URL{Scheme: "https", Host: a.CredentialsEndpoint,
+		Path: "/role-aliases/" + url.PathEscape(a.RoleAlias) + "/credentials"}
+	request, err := http.NewRequest(http.MethodGet, endpoint.String(), nil)
+	if err != nil {
+		return c, err
+	}
+	if a.ThingName != "" {
+		request.Header.Set("x-amzn-iot-thingname", a.ThingName)
+	}
+	client := &http.Client{Timeout: 10 * time.Second, Transport: &http.Transport{TLSClientConfig: a.TLS}}
+	status, body, err := do(client, request)
+	if err != nil {
+		return c, err
+	}
+	if status != http.StatusOK {
+		return c, fmt.Errorf("%w: AWS IoT credentials provider responded with status %d %s", ErrRejected, status,
+			body)
+	}
+	var response struct {
+		Credentials AWSCredentials `json:"credentials"`
+	}
+	if err = json.Unmarshal(body, &response); err != nil {
+		return c, fmt.Errorf("invalid AWS IoT credentials provider response; %w", err)
+	}
+	if response.Credentials.AccessKeyID == "" {
+		return c, fmt.Errorf("%w: AWS IoT credentials provider response does not contain credentials", ErrRejected)
+	}
+	return response.Credentials, nil
+}
+
+// do sends the request and returns the status and the limited body of the response
+func do(client *http.Client, request *http.Request) (status int, body []byte, err error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer response.Body.Close()
+	body, err = ioutil.ReadAll(io.LimitReader(response.Body, maxResponseSize))
+	return response.StatusCode, body, err
+}
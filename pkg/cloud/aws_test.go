@@ -0,0 +1,172 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cloud
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/pkg/amtest"
+	"github.com/JacoJooste/iot-edge/v7/pkg/builder"
+	"github.com/JacoJooste/iot-edge/v7/pkg/thing"
+)
+
+// testThing registers a thing with a mock AM that stores the attributes of the thing
+func testThing(t *testing.T, attributes map[string][]string) (thing.Thing, func()) {
+	server := &amtest.Server{Trees: map[string]amtest.Tree{
+		"reg-tree": {amtest.AuthenticateThing{}, amtest.RegisterThing{}},
+	}}
+	server.Start()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	device, err := builder.Thing().
+		ConnectTo(server.URL()).
+		WithTree("reg-tree").
+		AuthenticateThing("thing-1", "", "key-1", key, nil).
+		RegisterThing(nil, nil).
+		Create()
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	registered, _ := server.Thing("thing-1")
+	registered.Attributes = attributes
+	server.AddThing(registered)
+	return device, server.Close
+}
+
+// testClientCertificate returns a self-signed certificate for the thing
+func testClientCertificate(t *testing.T) tls.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "thing-1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestAWS_AssumeRole(t *testing.T) {
+	device, stop := testThing(t, nil)
+	defer stop()
+
+	expiry := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	requests := 0
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.FormValue("Action") != "AssumeRoleWithWebIdentity" ||
+			strings.Count(r.FormValue("WebIdentityToken"), ".") != 2 || r.FormValue("RoleSessionName") != "iot-thing" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.FormValue("RoleArn") != "arn:aws:iam::123456789012:role/things" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `<ErrorResponse><Error><Code>AccessDenied</Code><Message>Not authorized</Message></Error>`+
+				`</ErrorResponse>`)
+			return
+		}
+		fmt.Fprintf(w, `<AssumeRoleWithWebIdentityResponse><AssumeRoleWithWebIdentityResult><Credentials>`+
+			`<AccessKeyId>ASIA1</AccessKeyId><SecretAccessKey>secret</SecretAccessKey><SessionToken>session`+
+			`</SessionToken><Expiration>%s</Expiration></Credentials></AssumeRoleWithWebIdentityResult>`+
+			`</AssumeRoleWithWebIdentityResponse>`, expiry.Format(time.RFC3339))
+	}))
+	defer sts.Close()
+	endpoint, _ := url.Parse(sts.URL)
+
+	bridge := &AWS{Thing: device, RoleARN: "arn:aws:iam::123456789012:role/things", STSEndpoint: endpoint}
+	c, err := bridge.Credentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := AWSCredentials{AccessKeyID: "ASIA1", SecretAccessKey: "secret", SessionToken: "session", Expiry: expiry}
+	if c != expected {
+		t.Errorf("expected %+v; got %+v", expected, c)
+	}
+	if _, err = bridge.Credentials(); err != nil || requests != 1 {
+		t.Errorf("expected the credentials to be cached; got %d requests, %v", requests, err)
+	}
+
+	_, err = (&AWS{Thing: device, RoleARN: "arn:aws:iam::123456789012:role/other", STSEndpoint: endpoint}).Credentials()
+	if !errors.Is(err, ErrRejected) || !strings.Contains(err.Error(), "AccessDenied") {
+		t.Errorf("expected the role to be rejected; got %v", err)
+	}
+}
+
+func TestAWS_CredentialsProvider(t *testing.T) {
+	provider := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 || r.URL.Path != "/role-aliases/things/credentials" ||
+			r.Header.Get("x-amzn-iot-thingname") != "thing-1" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, `{"credentials":{"accessKeyId":"ASIA2","secretAccessKey":"secret","sessionToken":"session",`+
+			`"expiration":"2030-01-01T00:00:00Z"}}`)
+	}))
+	provider.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	provider.StartTLS()
+	defer provider.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(provider.Certificate())
+	endpoint := provider.Listener.Addr().String()
+
+	tests := []struct {
+		name   string
+		bridge *AWS
+		err    error
+	}{
+		{name: "certificate", bridge: &AWS{RoleAlias: "things", CredentialsEndpoint: endpoint, ThingName: "thing-1",
+			TLS: &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{testClientCertificate(t)}}}},
+		{name: "alias", err: ErrRejected, bridge: &AWS{RoleAlias: "other", CredentialsEndpoint: endpoint,
+			ThingName: "thing-1", TLS: &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{
+				testClientCertificate(t)}}}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			c, err := subtest.bridge.Credentials()
+			if subtest.err != nil {
+				if !errors.Is(err, subtest.err) {
+					t.Errorf("expected %v; got %v", subtest.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.AccessKeyID != "ASIA2" || c.SessionToken != "session" || c.Expiry.Year() != 2030 {
+				t.Errorf("unexpected credentials %+v", c)
+			}
+		})
+	}
+}
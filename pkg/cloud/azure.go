@@ -0,0 +1,240 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/clock"
+	"github.com/JacoJooste/iot-edge/v7/pkg/mqtt"
+	"github.com/JacoJooste/iot-edge/v7/pkg/thing"
+)
+
+const (
+	// defaultDPSEndpoint is the global endpoint of the Azure IoT Hub Device Provisioning Service
+	defaultDPSEndpoint = "https://global.azure-devices-provisioning.net"
+	// dpsAPIVersion is the version of the DPS device API
+	dpsAPIVersion = "2019-03-31"
+	// hubAPIVersion is the version of the IoT Hub MQTT API
+	hubAPIVersion = "2021-04-12"
+	// defaultPollInterval is the time between the status requests of a registration if DPS does not specify one
+	defaultPollInterval = 2 * time.Second
+	// defaultTokenLifetime is the lifetime of shared access signatures if the configuration does not set one
+	defaultTokenLifetime = time.Hour
+)
+
+// AzureRegistration is the IoT hub and device to which DPS assigned a thing
+type AzureRegistration struct {
+	RegistrationID string `json:"registrationId"`
+	AssignedHub    string `json:"assignedHub"`
+	DeviceID       string `json:"deviceId"`
+}
+
+// Azure registers a thing with the Azure IoT Hub Device Provisioning Service and provides the credentials with which
+// the thing connects to its IoT hub. The thing attests with the symmetric key in an attribute of its identity in AM
+// or, if KeyAttribute is empty, with the X.509 certificate in the TLS configuration.
+type Azure struct {
+	Thing thing.Thing
+	// IDScope of the DPS instance
+	IDScope string
+	// RegistrationID of the thing in DPS, defaults to the ID of the thing in AM with a symmetric key. Required with an
+	// X.509 certificate, as the common name of the certificate.
+	RegistrationID string
+	// KeyAttribute is the name of the attribute in AM that contains the base64 encoded symmetric key of the thing. AM
+	// must allow the thing to read the attribute.
+	KeyAttribute string
+	// TLS configures the connections to DPS and must contain the certificate of the thing if KeyAttribute is empty
+	TLS *tls.Config
+	// Endpoint of DPS, defaults to the global endpoint
+	Endpoint *url.URL
+	// PollInterval is the time between the status requests of a registration if DPS does not specify one. Defaults to
+	// 2 seconds.
+	PollInterval time.Duration
+	// TokenLifetime is the lifetime of the shared access signatures created with the symmetric key. Defaults to an hour.
+	TokenLifetime time.Duration
+}
+
+// dpsStatus is the status of a registration operation
+type dpsStatus struct {
+	OperationID       string `json:"operationId"`
+	Status            string `json:"status"`
+	RegistrationState struct {
+		AzureRegistration
+		ErrorMessage string `json:"errorMessage"`
+	} `json:"registrationState"`
+}
+
+// sasToken returns a shared access signature for the resource, signed with the key
+func sasToken(resource string, key []byte, expiry time.Time, keyName string) string {
+	resource = url.QueryEscape(resource)
+	se := strconv.FormatInt(expiry.Unix(), 10)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(resource + "\n" + se))
+	token := "SharedAccessSignature sr=" + resource +
+		"&sig=" + url.QueryEscape(base64.StdEncoding.EncodeToString(mac.Sum(nil))) + "&se=" + se
+	if keyName != "" {
+		token += "&skn=" + keyName
+	}
+	return token
+}
+
+func (a *Azure) tokenLifetime() time.Duration {
+	if a.TokenLifetime <= 0 {
+		return defaultTokenLifetime
+	}
+	return a.TokenLifetime
+}
+
+// symmetricKey reads the symmetric key of the thing from AM and returns it with the registration ID of the thing
+func (a *Azure) symmetricKey() (registrationID string, key []byte, err error) {
+	if a.Thing == nil {
+		return "", nil, errors.New("thing required")
+	}
+	response, err := a.Thing.RequestAttributes(a.KeyAttribute)
+	if err != nil {
+		return "", nil, err
+	}
+	encoded, ok := response.GetString(a.KeyAttribute)
+	if !ok || encoded == "" {
+		return "", nil, fmt.Errorf("thing does not have the attribute %s", a.KeyAttribute)
+	}
+	if key, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+		return "", nil, fmt.Errorf("invalid symmetric key in attribute %s; %w", a.KeyAttribute, err)
+	}
+	registrationID = a.RegistrationID
+	if registrationID == "" {
+		if registrationID, err = response.ID(); err != nil {
+			return "", nil, err
+		}
+	}
+	return registrationID, key, nil
+}
+
+// dpsRequest sends a request to DPS and decodes the status of the registration
+func (a *Azure) dpsRequest(ctx context.Context, method, path, authorization string, body []byte) (s dpsStatus,
+	retryAfter time.Duration, err error) {
+	endpoint := defaultDPSEndpoint
+	if a.Endpoint != nil {
+		endpoint = a.Endpoint.String()
+	}
+	request, err := http.NewRequest(method, endpoint+path+"?api-version="+dpsAPIVersion, bytes.NewReader(body))
+	if err != nil {
+		return s, 0, err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", "application/json")
+	if authorization != "" {
+		request.Header.Set("Authorization", authorization)
+	}
+	client := &http.Client{Timeout: 10 * time.Second, Transport: &http.Transport{TLSClientConfig: a.TLS}}
+	response, err := client.Do(request)
+	if err != nil {
+		return s, 0, err
+	}
+	defer response.Body.Close()
+	if seconds, err := strconv.Atoi(response.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		retryAfter = time.Duration(seconds) * time.Second
+	}
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusAccepted {
+		return s, 0, fmt.Errorf("%w: DPS responded with status %d", ErrRejected, response.StatusCode)
+	}
+	if err = json.NewDecoder(io.LimitReader(response.Body, maxResponseSize)).Decode(&s); err != nil {
+		return s, 0, fmt.Errorf("invalid DPS response; %w", err)
+	}
+	return s, retryAfter, nil
+}
+
+// Register the thing with DPS and wait until it has been assigned to an IoT hub or the context is done
+func (a *Azure) Register(ctx context.Context) (r AzureRegistration, err error) {
+	if a.IDScope == "" {
+		return r, errors.New("ID scope required")
+	}
+	registrationID := a.RegistrationID
+	var authorization string
+	if a.KeyAttribute != "" {
+		var key []byte
+		if registrationID, key, err = a.symmetricKey(); err != nil {
+			return r, err
+		}
+		authorization = sasToken(a.IDScope+"/registrations/"+registrationID, key,
+			clock.Clock().Add(a.tokenLifetime()), "registration")
+	} else if registrationID == "" || a.TLS == nil {
+		return r, errors.New("registration ID and TLS configuration required without a symmetric key")
+	}
+	path := "/" + url.PathEscape(a.IDScope) + "/registrations/" + url.PathEscape(registrationID)
+	body, err := json.Marshal(map[string]string{"registrationId": registrationID})
+	if err != nil {
+		return r, err
+	}
+	status, retryAfter, err := a.dpsRequest(ctx, http.MethodPut, path+"/register", authorization, body)
+	for err == nil {
+		switch status.Status {
+		case "assigned":
+			return status.RegistrationState.AzureRegistration, nil
+		case "unassigned", "assigning":
+		default:
+			return r, fmt.Errorf("%w: DPS registration %s %s", ErrRejected, status.Status,
+				status.RegistrationState.ErrorMessage)
+		}
+		if retryAfter == 0 {
+			retryAfter = a.PollInterval
+		}
+		if retryAfter <= 0 {
+			retryAfter = defaultPollInterval
+		}
+		timer := time.NewTimer(retryAfter)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return r, ctx.Err()
+		case <-timer.C:
+		}
+		status, retryAfter, err = a.dpsRequest(ctx, http.MethodGet,
+			path+"/operations/"+url.PathEscape(status.OperationID), authorization, nil)
+	}
+	return r, err
+}
+
+// HubCredentials returns the MQTT credentials with which the thing connects to the IoT hub of the registration. The
+// password is a shared access signature created with the symmetric key of the thing, or empty if the thing
+// authenticates with its X.509 certificate.
+func (a *Azure) HubCredentials(r AzureRegistration) (c mqtt.Credentials, err error) {
+	c.Username = r.AssignedHub + "/" + r.DeviceID + "/?api-version=" + hubAPIVersion
+	if a.KeyAttribute == "" {
+		return c, nil
+	}
+	_, key, err := a.symmetricKey()
+	if err != nil {
+		return mqtt.Credentials{}, err
+	}
+	c.Expiry = clock.Clock().Add(a.tokenLifetime())
+	c.Password = sasToken(r.AssignedHub+"/devices/"+r.DeviceID, key, c.Expiry, "")
+	return c, nil
+}
@@ -0,0 +1,167 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cloud
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testEnrollmentKey = []byte("enrollment key of thing-1")
+
+// validSAS returns true if the shared access signature for the resource is signed with the key
+func validSAS(token, resource string, key []byte) bool {
+	values, err := url.ParseQuery(strings.TrimPrefix(token, "SharedAccessSignature "))
+	if err != nil || values.Get("sr") != resource {
+		return false
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(url.QueryEscape(resource) + "\n" + values.Get("se")))
+	return values.Get("sig") == base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// testDPS starts a mock DPS that assigns registrations after one status request, or fails them with the status
+func testDPS(t *testing.T, status string) (*httptest.Server, *tls.Config) {
+	dps := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("api-version") != dpsAPIVersion {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		authorised := len(r.TLS.PeerCertificates) > 0 ||
+			validSAS(r.Header.Get("Authorization"), "0ne0001/registrations/thing-1", testEnrollmentKey)
+		switch {
+		case !authorised:
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.Method == http.MethodPut && r.URL.Path == "/0ne0001/registrations/thing-1/register":
+			w.WriteHeader(http.StatusAccepted)
+			_, _ = w.Write([]byte(`{"operationId":"op-1","status":"assigning"}`))
+		case r.Method == http.MethodGet && r.URL.Path == "/0ne0001/registrations/thing-1/operations/op-1":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"operationId": "op-1",
+				"status":      status,
+				"registrationState": map[string]string{
+					"registrationId": "thing-1",
+					"assignedHub":    "hub-1.azure-devices.net",
+					"deviceId":       "thing-1",
+					"errorMessage":   "enrollment disabled",
+				},
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	dps.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	dps.StartTLS()
+	roots := x509.NewCertPool()
+	roots.AddCert(dps.Certificate())
+	return dps, &tls.Config{RootCAs: roots}
+}
+
+func TestAzure_Register(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(testEnrollmentKey)
+	device, stop := testThing(t, map[string][]string{"azureKey": {key}, "otherKey": {"b3RoZXI="}})
+	defer stop()
+
+	assigned := AzureRegistration{RegistrationID: "thing-1", AssignedHub: "hub-1.azure-devices.net",
+		DeviceID: "thing-1"}
+	tests := []struct {
+		name         string
+		status       string
+		attribute    string
+		certificate  bool
+		registration AzureRegistration
+		err          error
+	}{
+		{name: "symmetric-key", status: "assigned", attribute: "azureKey", registration: assigned},
+		{name: "certificate", status: "assigned", certificate: true, registration: assigned},
+		{name: "wrong-key", status: "assigned", attribute: "otherKey", err: ErrRejected},
+		{name: "disabled", status: "disabled", attribute: "azureKey", err: ErrRejected},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			dps, config := testDPS(t, subtest.status)
+			defer dps.Close()
+			endpoint, _ := url.Parse(dps.URL)
+			bridge := &Azure{Thing: device, IDScope: "0ne0001", KeyAttribute: subtest.attribute, TLS: config,
+				Endpoint: endpoint, PollInterval: 10 * time.Millisecond}
+			if subtest.certificate {
+				bridge.RegistrationID = "thing-1"
+				config.Certificates = []tls.Certificate{testClientCertificate(t)}
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			registration, err := bridge.Register(ctx)
+			if subtest.err != nil {
+				if !errors.Is(err, subtest.err) {
+					t.Errorf("expected %v; got %v", subtest.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if registration != subtest.registration {
+				t.Errorf("expected %+v; got %+v", subtest.registration, registration)
+			}
+		})
+	}
+
+	// a registration ID is required to attest with a certificate
+	bridge := &Azure{Thing: device, IDScope: "0ne0001", TLS: &tls.Config{}}
+	if _, err := bridge.Register(context.Background()); err == nil {
+		t.Error("expected an error without a registration ID")
+	}
+}
+
+func TestAzure_HubCredentials(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(testEnrollmentKey)
+	device, stop := testThing(t, map[string][]string{"azureKey": {key}})
+	defer stop()
+	registration := AzureRegistration{AssignedHub: "hub-1.azure-devices.net", DeviceID: "thing-1"}
+
+	c, err := (&Azure{Thing: device, KeyAttribute: "azureKey"}).HubCredentials(registration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Username != "hub-1.azure-devices.net/thing-1/?api-version="+hubAPIVersion ||
+		!validSAS(c.Password, "hub-1.azure-devices.net/devices/thing-1", testEnrollmentKey) {
+		t.Errorf("unexpected credentials %+v", c)
+	}
+	if lifetime := time.Until(c.Expiry); lifetime < 59*time.Minute || lifetime > time.Hour {
+		t.Errorf("unexpected expiry %v", c.Expiry)
+	}
+
+	c, err = (&Azure{Thing: device}).HubCredentials(registration)
+	if err != nil || c.Password != "" {
+		t.Errorf("expected no password with a certificate; got %+v, %v", c, err)
+	}
+	if _, err = (&Azure{Thing: device, KeyAttribute: "missing"}).HubCredentials(registration); err == nil {
+		t.Error("expected an error if the thing does not have the key attribute")
+	}
+}
@@ -0,0 +1,47 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package cloud bridges the identity of a thing in AM to the credentials of cloud IoT platforms, so that AM remains the
+// single root of identity of a device that talks to cloud brokers:
+//    - AWS obtains temporary AWS credentials for the thing. With a role ARN, the access token that AM issues to the
+//      thing is exchanged with AWS STS for the credentials of an IAM role that trusts AM as an OpenID Connect identity
+//      provider. AM must issue stateless (JWT) access tokens. With a role alias, the credentials are requested from the
+//      AWS IoT Core credentials provider with the certificate that the thing registered with AM.
+//    - Azure registers the thing with the Azure IoT Hub Device Provisioning Service (DPS) and provides the credentials
+//      with which it connects to its assigned IoT hub. The thing attests with the certificate that it registered with
+//      AM, or with a symmetric enrollment key that is stored in an attribute of the thing in AM, so that the key is
+//      not kept on the device.
+//
+// This example obtains the credentials of an IAM role with which a thing signs its requests to AWS IoT Core:
+//
+//    bridge := &cloud.AWS{Thing: device, RoleARN: "arn:aws:iam::123456789012:role/things", Scopes: []string{"aws"}}
+//    credentials, err := bridge.Credentials()
+//
+// This example provisions a thing in Azure and connects it to its IoT hub with the Eclipse Paho client:
+//
+//    bridge := &cloud.Azure{Thing: device, IDScope: "0ne00000000", KeyAttribute: "azureEnrollmentKey"}
+//    registration, err := bridge.Register(ctx)
+//    if err != nil {
+//        return err
+//    }
+//    credentials, err := bridge.HubCredentials(registration)
+//    options := paho.NewClientOptions().
+//        AddBroker("ssl://" + registration.AssignedHub + ":8883").
+//        SetClientID(registration.DeviceID).
+//        SetUsername(credentials.Username).
+//        SetPassword(credentials.Password)
+//
+package cloud
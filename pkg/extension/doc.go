@@ -0,0 +1,50 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package extension defines the request filters and event sinks with which the behaviour of the Thing Gateway can be
+// changed at a site without rebuilding the gateway. Extensions are built as Go plugins whose init functions register
+// factories for filters and sinks, and for southbound adapters with southbound.Register. The gateway loads the plugins
+// given with the --plugin option and creates the registered extensions named with the --filter, --sink and --adapter
+// options.
+//
+// A plugin must be built with the same version of Go and of this module as the gateway that loads it, for example:
+//
+//    go build -buildmode=plugin -o site.so ./site
+//
+// This example shows a plugin that rejects the requests of things outside a range of addresses:
+//
+//    package main
+//
+//    func init() {
+//        extension.RegisterFilter("subnet", func(options map[string]string) (extension.Filter, error) {
+//            _, subnet, err := net.ParseCIDR(options["cidr"])
+//            if err != nil {
+//                return nil, err
+//            }
+//            return extension.FilterFunc(func(request extension.Request) error {
+//                host, _, _ := net.SplitHostPort(request.RemoteAddress)
+//                if !subnet.Contains(net.ParseIP(host)) {
+//                    return errors.New("address not allowed")
+//                }
+//                return nil
+//            }), nil
+//        })
+//    }
+//
+// The filter is then enabled with:
+//
+//    ./gateway ... --plugin site.so --filter subnet:cidr=10.0.0.0/8
+package extension
@@ -0,0 +1,165 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package extension
+
+import (
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Request is a request made by a thing to the Thing Gateway
+type Request struct {
+	// Method of the CoAP request, for example "POST"
+	Method string
+	// Path of the CoAP request, for example "/accesstoken"
+	Path string
+	// RemoteAddress is the address of the thing in the form host:port
+	RemoteAddress string
+	// ClientCertificate is the verified client certificate of the thing, nil if the gateway does not verify client
+	// certificates
+	ClientCertificate *x509.Certificate
+	// Payload of the request, which must not be modified
+	Payload []byte
+}
+
+// Filter decides whether the Thing Gateway serves a request
+type Filter interface {
+	// Filter returns an error to reject the request, the thing receives the message of the error
+	Filter(request Request) error
+}
+
+// FilterFunc is a function that is used as a Filter
+type FilterFunc func(request Request) error
+
+// Filter calls the function
+func (f FilterFunc) Filter(request Request) error {
+	return f(request)
+}
+
+// Event describes a change in the state of the Thing Gateway or of a thing
+type Event struct {
+	Time time.Time
+	// Type of the event, for example "thing-authenticated"
+	Type string
+	// Source identifies the gateway that published the event
+	Source  string
+	ThingID string
+	Detail  string
+}
+
+// Sink delivers the events of the Thing Gateway to a system outside the gateway
+type Sink interface {
+	// Publish the event, returning an error if it could not be delivered
+	Publish(event Event) error
+}
+
+// FilterFactory creates a filter with the options provided when the filter is enabled
+type FilterFactory func(options map[string]string) (Filter, error)
+
+// SinkFactory creates a sink with the options provided when the sink is enabled
+type SinkFactory func(options map[string]string) (Sink, error)
+
+// registry holds the factories of a kind of extension by name
+type registry struct {
+	kind      string
+	mutex     sync.Mutex
+	factories map[string]interface{}
+}
+
+func (r *registry) register(name string, factory interface{}) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.factories[name]; ok {
+		panic("extension: Register called twice for " + r.kind + " " + name)
+	}
+	r.factories[name] = factory
+}
+
+func (r *registry) factory(name string) (interface{}, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	factory, ok := r.factories[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown %s %s", r.kind, name)
+	}
+	return factory, nil
+}
+
+func (r *registry) registered() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	names := make([]string, 0, len(r.factories))
+	for name := range r.factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var (
+	filters = &registry{kind: "filter", factories: make(map[string]interface{})}
+	sinks   = &registry{kind: "sink", factories: make(map[string]interface{})}
+)
+
+// RegisterFilter makes the filter factory available by the given name. Panics if a factory is registered twice under
+// the same name or if the factory is nil.
+func RegisterFilter(name string, factory FilterFactory) {
+	if factory == nil {
+		panic("extension: RegisterFilter factory is nil")
+	}
+	filters.register(name, factory)
+}
+
+// NewFilter creates the filter registered by the given name
+func NewFilter(name string, options map[string]string) (Filter, error) {
+	factory, err := filters.factory(name)
+	if err != nil {
+		return nil, err
+	}
+	return factory.(FilterFactory)(options)
+}
+
+// RegisteredFilters returns the sorted names of the registered filters
+func RegisteredFilters() []string {
+	return filters.registered()
+}
+
+// RegisterSink makes the sink factory available by the given name. Panics if a factory is registered twice under the
+// same name or if the factory is nil.
+func RegisterSink(name string, factory SinkFactory) {
+	if factory == nil {
+		panic("extension: RegisterSink factory is nil")
+	}
+	sinks.register(name, factory)
+}
+
+// NewSink creates the sink registered by the given name
+func NewSink(name string, options map[string]string) (Sink, error) {
+	factory, err := sinks.factory(name)
+	if err != nil {
+		return nil, err
+	}
+	return factory.(SinkFactory)(options)
+}
+
+// RegisteredSinks returns the sorted names of the registered sinks
+func RegisteredSinks() []string {
+	return sinks.registered()
+}
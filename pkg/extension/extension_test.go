@@ -0,0 +1,87 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package extension
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type testSink struct {
+	url string
+}
+
+func (s testSink) Publish(Event) error {
+	return nil
+}
+
+func TestRegisterFilter(t *testing.T) {
+	errDenied := errors.New("denied")
+	RegisterFilter("test-deny", func(options map[string]string) (Filter, error) {
+		return FilterFunc(func(request Request) error {
+			if request.Path == options["path"] {
+				return errDenied
+			}
+			return nil
+		}), nil
+	})
+	if !reflect.DeepEqual(RegisteredFilters(), []string{"test-deny"}) {
+		t.Errorf("unexpected registered filters %v", RegisteredFilters())
+	}
+	filter, err := NewFilter("test-deny", map[string]string{"path": "/attributes"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = filter.Filter(Request{Path: "/attributes"}); err != errDenied {
+		t.Errorf("expected %v; got %v", errDenied, err)
+	}
+	if err = filter.Filter(Request{Path: "/accesstoken"}); err != nil {
+		t.Errorf("expected the request to be allowed; got %v", err)
+	}
+	if _, err = NewFilter("test-allow", nil); err == nil {
+		t.Error("expected an error for an unknown filter")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic when registering twice")
+		}
+	}()
+	RegisterFilter("test-deny", func(map[string]string) (Filter, error) { return nil, nil })
+}
+
+func TestRegisterSink(t *testing.T) {
+	RegisterSink("test-sink", func(options map[string]string) (Sink, error) {
+		if options["url"] == "" {
+			return nil, errors.New("url required")
+		}
+		return testSink{url: options["url"]}, nil
+	})
+	if !reflect.DeepEqual(RegisteredSinks(), []string{"test-sink"}) {
+		t.Errorf("unexpected registered sinks %v", RegisteredSinks())
+	}
+	sink, err := NewSink("test-sink", map[string]string{"url": "udp://collector:514"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sink.(testSink).url != "udp://collector:514" {
+		t.Errorf("options not passed to the factory")
+	}
+	if _, err = NewSink("test-sink", nil); err == nil {
+		t.Error("expected the factory error")
+	}
+}
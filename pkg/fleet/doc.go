@@ -0,0 +1,41 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package fleet registers many things at once, for example to pre-provision the identities of devices in the factory.
+// The things are described by a manifest containing their IDs, keys and certificates and are registered in parallel
+// with the Register Thing tree node. The rate at which registrations are started can be limited to protect AM.
+//
+// This example shows how to register the things in a manifest file:
+//
+//    b, _ := ioutil.ReadFile("manifest.json")
+//    manifest, _ := fleet.ParseManifest(b)
+//
+//    amURL, _ := url.Parse("https://am.example.com:8443/am")
+//    registrar := fleet.Registrar{
+//        URL:         amURL,
+//        Realm:       "/all-the-things",
+//        Audience:    "/all-the-things",
+//        Tree:        "reg-tree",
+//        Concurrency: 10,
+//        Rate:        50,
+//    }
+//    for _, result := range registrar.Register(context.Background(), manifest) {
+//        if result.Err != nil {
+//            log.Printf("failed to register %s: %v", result.ThingID, result.Err)
+//        }
+//    }
+//
+package fleet
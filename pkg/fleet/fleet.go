@@ -0,0 +1,150 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fleet
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/pkg/builder"
+)
+
+// Result is the outcome of the registration of a single thing
+type Result struct {
+	ThingID string
+	// Err is nil if the thing was registered successfully
+	Err error
+	// Duration is the time taken to register the thing
+	Duration time.Duration
+}
+
+// Registrar registers fleets of things with AM or the Thing Gateway
+type Registrar struct {
+	// URL of AM or the Thing Gateway
+	URL      *url.URL
+	Realm    string
+	Audience string
+	// Tree is the authentication tree that contains the Register Thing node
+	Tree    string
+	Timeout time.Duration
+	// Concurrency is the maximum number of registrations in progress at the same time, defaults to 1
+	Concurrency int
+	// Rate is the maximum number of registrations started per second, unlimited if zero
+	Rate float64
+	// ThrottleLimit is the longest delay that a registration will wait for when it is throttled by AM, throttled
+	// registrations fail if zero
+	ThrottleLimit time.Duration
+
+	// register is replaced in tests
+	register func(entry Entry) error
+}
+
+// registerThing registers the thing and ends the session that was created for it
+func (r *Registrar) registerThing(entry Entry) error {
+	var claims func() interface{}
+	if entry.Claims != nil {
+		claims = func() interface{} {
+			return entry.Claims
+		}
+	}
+	thing, err := builder.Thing().
+		ConnectTo(r.URL).
+		InRealm(r.Realm).
+		WithTree(r.Tree).
+		TimeoutRequestAfter(r.Timeout).
+		WaitWhenThrottled(r.ThrottleLimit).
+		AuthenticateThing(entry.ThingID, r.Audience, entry.KeyID, entry.Key, nil).
+		RegisterThing(entry.Certificates, claims).
+		Create()
+	if err != nil {
+		return err
+	}
+	return thing.Logout()
+}
+
+// Register the things in parallel, returning a result for every entry in the same order as the entries. If the
+// context is cancelled, registrations that have not started fail with the context error.
+func (r *Registrar) Register(ctx context.Context, entries []Entry) []Result {
+	register := r.register
+	if register == nil {
+		register = r.registerThing
+	}
+	concurrency := r.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var limiter <-chan time.Time
+	if r.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / r.Rate))
+		defer ticker.Stop()
+		limiter = ticker.C
+	}
+
+	results := make([]Result, len(entries))
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				if err := ctx.Err(); err != nil {
+					results[i] = Result{ThingID: entries[i].ThingID, Err: err}
+					continue
+				}
+				start := time.Now()
+				err := register(entries[i])
+				results[i] = Result{ThingID: entries[i].ThingID, Err: err, Duration: time.Since(start)}
+			}
+		}()
+	}
+
+	for i, entry := range entries {
+		if err := wait(ctx, limiter); err != nil {
+			for ; i < len(entries); i++ {
+				results[i] = Result{ThingID: entries[i].ThingID, Err: err}
+			}
+			break
+		}
+		select {
+		case indices <- i:
+		case <-ctx.Done():
+			results[i] = Result{ThingID: entry.ThingID, Err: ctx.Err()}
+		}
+	}
+	close(indices)
+	wg.Wait()
+	return results
+}
+
+// wait until the limiter allows the next registration to start
+func wait(ctx context.Context, limiter <-chan time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if limiter == nil {
+		return nil
+	}
+	select {
+	case <-limiter:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,190 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fleet
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testManifestEntry(t *testing.T, id string) manifestEntry {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: id},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manifestEntry{
+		ThingID:      id,
+		Key:          string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes})),
+		Certificates: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes})),
+		Claims:       map[string]interface{}{"serialNumber": id},
+	}
+}
+
+func TestParseManifest(t *testing.T) {
+	valid := testManifestEntry(t, "thing-1")
+	noKey := testManifestEntry(t, "thing-2")
+	noKey.Key = ""
+	noCerts := testManifestEntry(t, "thing-3")
+	noCerts.Certificates = ""
+	noID := testManifestEntry(t, "")
+
+	tests := []struct {
+		name       string
+		things     []manifestEntry
+		successful bool
+	}{
+		{name: "valid", things: []manifestEntry{valid, testManifestEntry(t, "thing-4")}, successful: true},
+		{name: "missing-key", things: []manifestEntry{noKey}},
+		{name: "missing-certificates", things: []manifestEntry{noCerts}},
+		{name: "missing-id", things: []manifestEntry{noID}},
+		{name: "duplicate-id", things: []manifestEntry{valid, valid}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			b, _ := json.Marshal(subtest.things)
+			entries, err := ParseManifest(b)
+			if !subtest.successful {
+				if err == nil {
+					t.Error("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != len(subtest.things) {
+				t.Fatalf("expected %d entries, got %d", len(subtest.things), len(entries))
+			}
+			for i, e := range entries {
+				if e.ThingID != subtest.things[i].ThingID || e.Key == nil || len(e.Certificates) != 1 ||
+					e.KeyID == "" || e.ThingType != "device" || e.Claims["serialNumber"] != e.ThingID {
+					t.Errorf("unexpected entry %+v", e)
+				}
+			}
+		})
+	}
+}
+
+func testEntries(n int) []Entry {
+	entries := make([]Entry, n)
+	for i := range entries {
+		entries[i].ThingID = fmt.Sprintf("thing-%d", i)
+	}
+	return entries
+}
+
+func TestRegistrar_Register(t *testing.T) {
+	errRejected := errors.New("rejected")
+	var mutex sync.Mutex
+	inProgress, maxInProgress := 0, 0
+	r := Registrar{
+		Concurrency: 3,
+		register: func(entry Entry) error {
+			mutex.Lock()
+			inProgress++
+			if inProgress > maxInProgress {
+				maxInProgress = inProgress
+			}
+			mutex.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mutex.Lock()
+			inProgress--
+			mutex.Unlock()
+			if entry.ThingID == "thing-4" {
+				return errRejected
+			}
+			return nil
+		},
+	}
+	entries := testEntries(10)
+	results := r.Register(context.Background(), entries)
+	if len(results) != len(entries) {
+		t.Fatalf("expected %d results, got %d", len(entries), len(results))
+	}
+	for i, result := range results {
+		if result.ThingID != entries[i].ThingID {
+			t.Errorf("result %d is for %s", i, result.ThingID)
+		}
+		if (result.ThingID == "thing-4") != errors.Is(result.Err, errRejected) {
+			t.Errorf("unexpected result %+v", result)
+		}
+	}
+	if maxInProgress > r.Concurrency {
+		t.Errorf("expected at most %d concurrent registrations, got %d", r.Concurrency, maxInProgress)
+	}
+}
+
+func TestRegistrar_Register_Rate(t *testing.T) {
+	r := Registrar{
+		Concurrency: 10,
+		Rate:        100,
+		register: func(Entry) error {
+			return nil
+		},
+	}
+	start := time.Now()
+	r.Register(context.Background(), testEntries(10))
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("registrations were not rate limited, took %v", elapsed)
+	}
+}
+
+func TestRegistrar_Register_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	registered := 0
+	r := Registrar{
+		register: func(Entry) error {
+			registered++
+			if registered == 2 {
+				cancel()
+			}
+			return nil
+		},
+	}
+	results := r.Register(ctx, testEntries(5))
+	for i, result := range results {
+		if i < 2 && result.Err != nil {
+			t.Errorf("expected thing %d to be registered, got %v", i, result.Err)
+		}
+		if i >= 2 && !errors.Is(result.Err, context.Canceled) {
+			t.Errorf("expected thing %d to be cancelled, got %v", i, result.Err)
+		}
+	}
+}
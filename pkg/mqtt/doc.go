@@ -0,0 +1,40 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package mqtt provides the credentials with which a thing connects to an MQTT broker. The credentials are derived from
+// an OAuth 2.0 access token that AM issues to the thing and are renewed before the token expires, so that a thing that
+// is registered with AM does not need separate broker credentials. Two methods of authentication are supported:
+//    - AuthJWT presents the access token as the password, for brokers that validate JWTs, for example with the
+//      accesstoken package or a JWT authentication plugin. AM must issue stateless (JWT) access tokens.
+//    - AuthPassword exchanges the access token for a username and password at an endpoint of the broker, for brokers
+//      that only support password authentication.
+//
+// This example connects a thing to a broker with the Eclipse Paho client, which asks for the credentials whenever it
+// connects, and reconnects when the credentials are renewed:
+//
+//    source := &mqtt.Source{Thing: device, Auth: mqtt.AuthJWT, Scopes: []string{"publish"}}
+//    options := paho.NewClientOptions().
+//        AddBroker("ssl://broker.example.com:8883").
+//        SetCredentialsProvider(source.Provide)
+//    client := paho.NewClient(options)
+//    client.Connect().Wait()
+//
+//    go source.Refresh(ctx, func(mqtt.Credentials) {
+//        client.Disconnect(250)
+//        client.Connect().Wait()
+//    })
+//
+package mqtt
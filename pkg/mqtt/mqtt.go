@@ -0,0 +1,274 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/clock"
+	"github.com/JacoJooste/iot-edge/v7/internal/debug"
+	"github.com/JacoJooste/iot-edge/v7/internal/jws"
+	"github.com/JacoJooste/iot-edge/v7/pkg/thing"
+)
+
+// AuthMethod is the method with which a thing authenticates with the broker
+type AuthMethod string
+
+// The supported methods of authentication
+const (
+	// AuthJWT presents the subject of the access token as the username and the token as the password
+	AuthJWT AuthMethod = "jwt"
+	// AuthPassword exchanges the access token for a username and password
+	AuthPassword AuthMethod = "password"
+)
+
+const (
+	// defaultRefreshBefore is the default time before expiry at which credentials are renewed
+	defaultRefreshBefore = time.Minute
+	// defaultRetryInterval is the default time between attempts to renew credentials after a failure
+	defaultRetryInterval = 30 * time.Second
+	// maxExchangeResponseSize is the maximum size of a response from the exchange endpoint
+	maxExchangeResponseSize = 64 * 1024
+)
+
+// ErrExchangeFailed indicates that the exchange endpoint rejected the access token or returned invalid credentials
+var ErrExchangeFailed = errors.New("credential exchange failed")
+
+// Credentials with which a thing connects to the broker
+type Credentials struct {
+	Username string
+	Password string
+	// Expiry is the time at which the credentials expire, zero if they do not expire
+	Expiry time.Time
+}
+
+// Source provides the broker credentials of a thing and renews them before they expire. A Source must not be copied
+// after first use.
+type Source struct {
+	Thing thing.Thing
+	// Auth is the method of authentication, defaults to AuthJWT
+	Auth AuthMethod
+	// Scopes are requested for the access token
+	Scopes []string
+	// Username is optional and replaces the subject of the access token as the username with AuthJWT
+	Username string
+	// ExchangeURL is the endpoint that exchanges the access token for credentials, required for AuthPassword. The
+	// token is sent as a bearer token in a POST request and the endpoint responds with a JSON object with the
+	// members username, password and, optionally, expires_in in seconds.
+	ExchangeURL *url.URL
+	// Client makes requests to the exchange endpoint, the default HTTP client is used if nil
+	Client *http.Client
+	// RefreshBefore is the time before expiry at which the credentials are renewed. Defaults to one minute.
+	RefreshBefore time.Duration
+	// RetryInterval is the time between attempts to renew the credentials after a failure. Defaults to 30 seconds.
+	RetryInterval time.Duration
+
+	mutex   sync.Mutex
+	current Credentials
+	renewAt time.Time
+}
+
+func (s *Source) refreshBefore() time.Duration {
+	if s.RefreshBefore <= 0 {
+		return defaultRefreshBefore
+	}
+	return s.RefreshBefore
+}
+
+func (s *Source) retryInterval() time.Duration {
+	if s.RetryInterval <= 0 {
+		return defaultRetryInterval
+	}
+	return s.RetryInterval
+}
+
+// due returns true if the current credentials must be renewed
+func (s *Source) due() bool {
+	if s.current.Password == "" {
+		return true
+	}
+	return !s.current.Expiry.IsZero() && !clock.Clock().Before(s.renewAt)
+}
+
+// renewal returns the time at which the credentials are renewed. Credentials with a lifetime shorter than twice the
+// refresh period are renewed half way through their lifetime.
+func (s *Source) renewal(c Credentials) time.Time {
+	now := clock.Clock()
+	renewAt := c.Expiry.Add(-s.refreshBefore())
+	if halfway := now.Add(c.Expiry.Sub(now) / 2); renewAt.Before(halfway) {
+		return halfway
+	}
+	return renewAt
+}
+
+// Credentials returns the current credentials of the thing, renewing them if they are about to expire
+func (s *Source) Credentials() (Credentials, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.due() {
+		return s.current, nil
+	}
+	c, err := s.renew()
+	if err != nil {
+		return Credentials{}, err
+	}
+	s.current, s.renewAt = c, s.renewal(c)
+	return c, nil
+}
+
+// Provide returns the username and password of the thing, it can be used as the credentials provider of an MQTT
+// client. Empty credentials are returned if they can not be renewed, so that the connection attempt fails.
+func (s *Source) Provide() (username string, password string) {
+	c, err := s.Credentials()
+	if err != nil {
+		debug.Errorf("unable to provide MQTT credentials; %s", err)
+		return "", ""
+	}
+	return c.Username, c.Password
+}
+
+// Refresh renews the credentials before they expire, and calls renewed with the new credentials, until the context
+// is cancelled. Failed attempts are repeated after the retry interval. Returns the error of the context.
+func (s *Source) Refresh(ctx context.Context, renewed func(Credentials)) error {
+	current, err := s.Credentials()
+	for {
+		wait := s.retryInterval()
+		if err != nil {
+			debug.Errorf("unable to renew MQTT credentials; %s", err)
+		} else if current.Expiry.IsZero() {
+			// the credentials do not expire so there is nothing to refresh
+			<-ctx.Done()
+			return ctx.Err()
+		} else {
+			s.mutex.Lock()
+			wait = s.renewAt.Sub(clock.Clock())
+			s.mutex.Unlock()
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		var next Credentials
+		if next, err = s.Credentials(); err == nil && next != current {
+			current = next
+			if renewed != nil {
+				renewed(current)
+			}
+		}
+	}
+}
+
+// renew requests a new access token and derives the credentials from it
+func (s *Source) renew() (c Credentials, err error) {
+	if s.Thing == nil {
+		return c, errors.New("thing required")
+	}
+	response, err := s.Thing.RequestAccessToken(s.Scopes...)
+	if err != nil {
+		return c, err
+	}
+	token, err := response.AccessToken()
+	if err != nil {
+		return c, err
+	}
+	if expiresIn, err := response.ExpiresIn(); err == nil && expiresIn > 0 {
+		c.Expiry = clock.Clock().Add(time.Duration(expiresIn * float64(time.Second)))
+	}
+	switch s.Auth {
+	case AuthJWT, "":
+		return s.jwtCredentials(token, c.Expiry)
+	case AuthPassword:
+		return s.exchange(token, c.Expiry)
+	}
+	return c, fmt.Errorf("unsupported authentication method %s", s.Auth)
+}
+
+// jwtCredentials presents the access token as the password
+func (s *Source) jwtCredentials(token string, expiry time.Time) (c Credentials, err error) {
+	var claims struct {
+		Subject string `json:"sub"`
+		Expiry  int64  `json:"exp"`
+	}
+	if err = jws.ExtractClaims(token, &claims); err != nil {
+		return c, fmt.Errorf("access token is not a JWT: %w", err)
+	}
+	c = Credentials{Username: s.Username, Password: token, Expiry: expiry}
+	if c.Username == "" {
+		c.Username = claims.Subject
+	}
+	if c.Expiry.IsZero() && claims.Expiry > 0 {
+		c.Expiry = time.Unix(claims.Expiry, 0)
+	}
+	return c, nil
+}
+
+// exchange requests a username and password from the exchange endpoint with the access token
+func (s *Source) exchange(token string, expiry time.Time) (c Credentials, err error) {
+	if s.ExchangeURL == nil {
+		return c, errors.New("exchange URL required")
+	}
+	request, err := http.NewRequest(http.MethodPost, s.ExchangeURL.String(), nil)
+	if err != nil {
+		return c, err
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+	request.Header.Set("Accept", "application/json")
+	httpClient := s.Client
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return c, err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, response.Body, maxExchangeResponseSize))
+	if err != nil {
+		return c, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return c, fmt.Errorf("%w: request failed with status code %d", ErrExchangeFailed, response.StatusCode)
+	}
+	var exchanged struct {
+		Username  string  `json:"username"`
+		Password  string  `json:"password"`
+		ExpiresIn float64 `json:"expires_in"`
+	}
+	if err = json.Unmarshal(body, &exchanged); err != nil {
+		return c, fmt.Errorf("%w: %s", ErrExchangeFailed, err)
+	}
+	if exchanged.Password == "" {
+		return c, fmt.Errorf("%w: no password returned", ErrExchangeFailed)
+	}
+	c = Credentials{Username: exchanged.Username, Password: exchanged.Password, Expiry: expiry}
+	// the credentials can outlive the token that they were exchanged for
+	if exchanged.ExpiresIn > 0 {
+		c.Expiry = clock.Clock().Add(time.Duration(exchanged.ExpiresIn * float64(time.Second)))
+	}
+	return c, nil
+}
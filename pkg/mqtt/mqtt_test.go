@@ -0,0 +1,173 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqtt
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/pkg/amtest"
+	"github.com/JacoJooste/iot-edge/v7/pkg/builder"
+	"github.com/JacoJooste/iot-edge/v7/pkg/thing"
+)
+
+// testThing registers a thing with a mock AM that issues access tokens with the given lifetime
+func testThing(t *testing.T, lifetime time.Duration) (thing.Thing, func()) {
+	server := &amtest.Server{
+		Trees: map[string]amtest.Tree{
+			"reg-tree": {amtest.AuthenticateThing{}, amtest.RegisterThing{}},
+		},
+		AccessTokenLifetime: lifetime,
+	}
+	server.Start()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	device, err := builder.Thing().
+		ConnectTo(server.URL()).
+		WithTree("reg-tree").
+		AuthenticateThing("thing-1", "", "key-1", key, nil).
+		RegisterThing(nil, nil).
+		Create()
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return device, server.Close
+}
+
+func TestSource_JWT(t *testing.T) {
+	device, stop := testThing(t, time.Hour)
+	defer stop()
+
+	tests := []struct {
+		name     string
+		source   *Source
+		username string
+	}{
+		{name: "subject", source: &Source{Thing: device, Scopes: []string{"publish"}}, username: "thing-1"},
+		{name: "username", source: &Source{Thing: device, Auth: AuthJWT, Username: "device"}, username: "device"},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			c, err := subtest.source.Credentials()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Username != subtest.username || strings.Count(c.Password, ".") != 2 {
+				t.Errorf("unexpected credentials %+v", c)
+			}
+			if lifetime := time.Until(c.Expiry); lifetime < 59*time.Minute || lifetime > time.Hour {
+				t.Errorf("unexpected expiry %v", c.Expiry)
+			}
+			// the credentials are reused until they are due to be renewed
+			if cached, _ := subtest.source.Credentials(); cached != c {
+				t.Error("expected the credentials to be reused")
+			}
+			if username, password := subtest.source.Provide(); username != c.Username || password != c.Password {
+				t.Error("expected the credentials to be provided")
+			}
+		})
+	}
+}
+
+func TestSource_Password(t *testing.T) {
+	device, stop := testThing(t, time.Hour)
+	defer stop()
+
+	var authorization string
+	fail := false
+	exchange := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		if fail || r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"username":   "broker-user",
+			"password":   "broker-password",
+			"expires_in": 600,
+		})
+	}))
+	defer exchange.Close()
+	exchangeURL, _ := url.Parse(exchange.URL)
+
+	source := &Source{Thing: device, Auth: AuthPassword, ExchangeURL: exchangeURL}
+	c, err := source.Credentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Username != "broker-user" || c.Password != "broker-password" {
+		t.Errorf("unexpected credentials %+v", c)
+	}
+	if lifetime := time.Until(c.Expiry); lifetime < 9*time.Minute || lifetime > 10*time.Minute {
+		t.Errorf("expected the expiry of the exchanged credentials; got %v", c.Expiry)
+	}
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		t.Errorf("expected the access token as a bearer token; got %s", authorization)
+	}
+
+	fail = true
+	if _, err = (&Source{Thing: device, Auth: AuthPassword, ExchangeURL: exchangeURL}).Credentials(); !errors.Is(err,
+		ErrExchangeFailed) {
+		t.Errorf("expected ErrExchangeFailed; got %v", err)
+	}
+	if _, err = (&Source{Thing: device, Auth: AuthPassword}).Credentials(); err == nil {
+		t.Error("expected an error without an exchange URL")
+	}
+	if username, password := (&Source{Thing: device, Auth: "unknown"}).Provide(); username != "" || password != "" {
+		t.Error("expected empty credentials when they can not be provided")
+	}
+}
+
+func TestSource_Refresh(t *testing.T) {
+	device, stop := testThing(t, 2*time.Second)
+	defer stop()
+
+	source := &Source{Thing: device}
+	first, err := source.Credentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mutex sync.Mutex
+	var renewed []Credentials
+	ctx, cancel := context.WithTimeout(context.Background(), 2500*time.Millisecond)
+	defer cancel()
+	err = source.Refresh(ctx, func(c Credentials) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		renewed = append(renewed, c)
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the context error; got %v", err)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	// the short lived credentials are renewed half way through their lifetime
+	if len(renewed) < 1 || renewed[0].Password == first.Password || !renewed[0].Expiry.After(first.Expiry) {
+		t.Errorf("expected the credentials to be renewed before they expire; got %+v", renewed)
+	}
+}
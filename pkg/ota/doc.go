@@ -0,0 +1,47 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package ota coordinates over-the-air firmware updates of things with the attributes of their identities in AM. An
+// operator describes a firmware update in a descriptor, signs it with the update key and stores the signed descriptor
+// in an attribute of the thing. The thing reads the descriptor, verifies its signature with the public update key that
+// is built into the firmware, downloads and verifies the image and reports the status of the update in another
+// attribute, so that the progress of a fleet update can be followed in AM.
+//
+// AM must allow the thing to read the descriptor attribute and to write the status attribute.
+//
+// This example shows how a thing checks for and installs an update:
+//
+//    updater := ota.Updater{Thing: device, UpdateKey: updateKey, Realm: "/all-the-things"}
+//    descriptor, ok, err := updater.Check(currentVersion)
+//    if err != nil || !ok {
+//        return err
+//    }
+//    _ = updater.Report(ota.Status{Version: descriptor.Version, State: ota.StateDownloading})
+//    image, err := download(descriptor.URL)
+//    if err == nil {
+//        err = descriptor.VerifyImage(bytes.NewReader(image))
+//    }
+//    if err != nil {
+//        return updater.Report(ota.Status{Version: descriptor.Version, State: ota.StateFailed, Message: err.Error()})
+//    }
+//    install(image)
+//    return updater.Report(ota.Status{Version: descriptor.Version, State: ota.StateInstalled})
+//
+// The operator signs a descriptor with:
+//
+//    signed, err := ota.Descriptor{Version: "2.1.0", URL: imageURL, SHA256: digest, Size: size}.Sign(updateKey)
+//
+package ota
@@ -0,0 +1,195 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ota
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/jws"
+	"github.com/JacoJooste/iot-edge/v7/pkg/thing"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// The attributes that are used if the Updater does not specify them
+const (
+	DefaultDescriptorAttribute = "firmwareUpdate"
+	DefaultStatusAttribute     = "firmwareStatus"
+)
+
+var (
+	// ErrInvalidDescriptor indicates that the descriptor is malformed or that its signature is not valid for the update
+	// key. The descriptor must not be used.
+	ErrInvalidDescriptor = errors.New("invalid firmware update descriptor")
+
+	// ErrInvalidImage indicates that the firmware image does not match the size or digest in its descriptor.
+	ErrInvalidImage = errors.New("firmware image does not match the descriptor")
+)
+
+// Descriptor describes a firmware update
+type Descriptor struct {
+	// Version of the firmware
+	Version string `json:"version"`
+	// URL from which the firmware image is downloaded
+	URL string `json:"url"`
+	// SHA256 is the hex encoded SHA-256 digest of the firmware image
+	SHA256 string `json:"sha256"`
+	// Size of the firmware image in bytes, the size is not checked if zero
+	Size int64 `json:"size,omitempty"`
+}
+
+// Sign returns the descriptor as a JWS in compact serialisation, signed with the update key. The JWS is the value of
+// the descriptor attribute of the things that should be updated.
+func (d Descriptor) Sign(key crypto.Signer) (string, error) {
+	payload, err := json.Marshal(d)
+	if err != nil {
+		return "", err
+	}
+	signer, err := jws.NewSigner(key, nil)
+	if err != nil {
+		return "", err
+	}
+	object, err := signer.Sign(payload)
+	if err != nil {
+		return "", err
+	}
+	return object.CompactSerialize()
+}
+
+// ParseDescriptor verifies the signature of a signed descriptor with the public update key and returns the descriptor
+func ParseDescriptor(signed string, updateKey crypto.PublicKey) (d Descriptor, err error) {
+	object, err := jose.ParseSigned(signed)
+	if err != nil {
+		return d, fmt.Errorf("%w: %s", ErrInvalidDescriptor, err)
+	}
+	payload, err := object.Verify(updateKey)
+	if err != nil {
+		return d, fmt.Errorf("%w: %s", ErrInvalidDescriptor, err)
+	}
+	if err = json.Unmarshal(payload, &d); err != nil {
+		return d, fmt.Errorf("%w: %s", ErrInvalidDescriptor, err)
+	}
+	if d.Version == "" || d.URL == "" || d.SHA256 == "" {
+		return d, fmt.Errorf("%w: version, url and sha256 are required", ErrInvalidDescriptor)
+	}
+	return d, nil
+}
+
+// VerifyImage reads the firmware image and checks that its size and digest match the descriptor
+func (d Descriptor) VerifyImage(image io.Reader) error {
+	h := sha256.New()
+	n, err := io.Copy(h, image)
+	if err != nil {
+		return err
+	}
+	if d.Size > 0 && n != d.Size {
+		return fmt.Errorf("%w: expected %d bytes; got %d", ErrInvalidImage, d.Size, n)
+	}
+	if digest := hex.EncodeToString(h.Sum(nil)); digest != d.SHA256 {
+		return fmt.Errorf("%w: expected digest %s; got %s", ErrInvalidImage, d.SHA256, digest)
+	}
+	return nil
+}
+
+// State of a firmware update
+type State string
+
+// The states that a thing reports while it updates its firmware
+const (
+	StateDownloading State = "downloading"
+	StateInstalling  State = "installing"
+	StateInstalled   State = "installed"
+	StateFailed      State = "failed"
+)
+
+// Status of a firmware update, reported by the thing
+type Status struct {
+	// Version of the firmware that is being installed
+	Version string `json:"version"`
+	State   State  `json:"state"`
+	// Message is optional and describes the state, for example the reason for a failure
+	Message string `json:"message,omitempty"`
+	// Time at which the state was reached, the time of the report is used if zero
+	Time time.Time `json:"time"`
+}
+
+// Updater coordinates the firmware updates of a thing
+type Updater struct {
+	Thing thing.Thing
+	// UpdateKey is the public key that verifies the signature of descriptors
+	UpdateKey crypto.PublicKey
+	// Realm of the thing in AM, in which the status is reported
+	Realm string
+	// DescriptorAttribute is the attribute that contains the signed descriptor, DefaultDescriptorAttribute if empty
+	DescriptorAttribute string
+	// StatusAttribute is the attribute to which the status is written, DefaultStatusAttribute if empty
+	StatusAttribute string
+}
+
+func (u Updater) descriptorAttribute() string {
+	if u.DescriptorAttribute == "" {
+		return DefaultDescriptorAttribute
+	}
+	return u.DescriptorAttribute
+}
+
+func (u Updater) statusAttribute() string {
+	if u.StatusAttribute == "" {
+		return DefaultStatusAttribute
+	}
+	return u.StatusAttribute
+}
+
+// Check reads the signed descriptor from the attributes of the thing and verifies it with the update key. Returns false
+// if the thing does not have a descriptor or if the descriptor is for the current version of the firmware.
+func (u Updater) Check(currentVersion string) (d Descriptor, ok bool, err error) {
+	name := u.descriptorAttribute()
+	response, err := u.Thing.RequestAttributes(name)
+	if err != nil {
+		return d, false, err
+	}
+	signed, present := response.GetString(name)
+	if !present || signed == "" {
+		return d, false, nil
+	}
+	if d, err = ParseDescriptor(signed, u.UpdateKey); err != nil {
+		return d, false, err
+	}
+	return d, d.Version != currentVersion, nil
+}
+
+// Report writes the status as JSON to the status attribute of the thing with a signed update request to the things
+// endpoint, which AM must allow for the thing
+func (u Updater) Report(status Status) error {
+	if status.Time.IsZero() {
+		status.Time = time.Now().UTC()
+	}
+	value, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	_, err = thing.UpdateAttributes(u.Thing, u.Realm, map[string]interface{}{
+		u.statusAttribute(): []string{string(value)},
+	})
+	return err
+}
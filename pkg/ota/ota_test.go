@@ -0,0 +1,167 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ota
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/JacoJooste/iot-edge/v7/pkg/amtest"
+	"github.com/JacoJooste/iot-edge/v7/pkg/builder"
+)
+
+func testKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func testDescriptor(image []byte) Descriptor {
+	digest := sha256.Sum256(image)
+	return Descriptor{
+		Version: "2.0.0",
+		URL:     "https://updates.example.com/firmware-2.0.0.bin",
+		SHA256:  hex.EncodeToString(digest[:]),
+		Size:    int64(len(image)),
+	}
+}
+
+func TestParseDescriptor(t *testing.T) {
+	updateKey := testKey(t)
+	descriptor := testDescriptor([]byte("firmware"))
+	signed, err := descriptor.Sign(updateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned, err := Descriptor{Version: "2.0.0"}.Sign(updateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		signed string
+		key    *ecdsa.PrivateKey
+		err    error
+	}{
+		{name: "valid", signed: signed, key: updateKey},
+		{name: "wrong-key", signed: signed, key: testKey(t), err: ErrInvalidDescriptor},
+		{name: "tampered", signed: signed[:len(signed)-4] + "AAAA", key: updateKey, err: ErrInvalidDescriptor},
+		{name: "not-jws", signed: "firmware", key: updateKey, err: ErrInvalidDescriptor},
+		{name: "missing-fields", signed: unsigned, key: updateKey, err: ErrInvalidDescriptor},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			d, err := ParseDescriptor(subtest.signed, subtest.key.Public())
+			if !errors.Is(err, subtest.err) {
+				t.Fatalf("expected error %v; got %v", subtest.err, err)
+			}
+			if err == nil && d != descriptor {
+				t.Errorf("expected %+v; got %+v", descriptor, d)
+			}
+		})
+	}
+}
+
+func TestDescriptor_VerifyImage(t *testing.T) {
+	image := []byte("firmware")
+	descriptor := testDescriptor(image)
+	if err := descriptor.VerifyImage(bytes.NewReader(image)); err != nil {
+		t.Error(err)
+	}
+	if err := descriptor.VerifyImage(bytes.NewReader([]byte("firmwar3"))); !errors.Is(err, ErrInvalidImage) {
+		t.Errorf("expected digest mismatch; got %v", err)
+	}
+	if err := descriptor.VerifyImage(bytes.NewReader(image[1:])); !errors.Is(err, ErrInvalidImage) {
+		t.Errorf("expected size mismatch; got %v", err)
+	}
+}
+
+func TestUpdater(t *testing.T) {
+	server := &amtest.Server{Trees: map[string]amtest.Tree{
+		"reg-tree": {amtest.AuthenticateThing{}, amtest.RegisterThing{}},
+	}}
+	server.Start()
+	defer server.Close()
+
+	device, err := builder.Thing().
+		ConnectTo(server.URL()).
+		WithTree("reg-tree").
+		AuthenticateThing("thing-1", "", "key-1", testKey(t), nil).
+		RegisterThing(nil, nil).
+		Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	updateKey := testKey(t)
+	updater := Updater{Thing: device, UpdateKey: updateKey.Public()}
+
+	// no descriptor
+	if _, ok, err := updater.Check("1.0.0"); err != nil || ok {
+		t.Fatalf("expected no update; got %v, %v", ok, err)
+	}
+
+	descriptor := testDescriptor([]byte("firmware"))
+	signed, err := descriptor.Sign(updateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registered, _ := server.Thing("thing-1")
+	registered.Attributes = map[string][]string{DefaultDescriptorAttribute: {signed}}
+	server.AddThing(registered)
+
+	d, ok, err := updater.Check("1.0.0")
+	if err != nil || !ok || d != descriptor {
+		t.Fatalf("expected update %+v; got %+v, %v, %v", descriptor, d, ok, err)
+	}
+	if _, ok, err = updater.Check(descriptor.Version); err != nil || ok {
+		t.Errorf("expected no update for the current version; got %v, %v", ok, err)
+	}
+	if _, _, err = (Updater{Thing: device, UpdateKey: testKey(t).Public()}).Check("1.0.0"); !errors.Is(err,
+		ErrInvalidDescriptor) {
+		t.Errorf("expected invalid descriptor; got %v", err)
+	}
+
+	err = updater.Report(Status{Version: d.Version, State: StateInstalled})
+	if err != nil {
+		t.Fatal(err)
+	}
+	registered, _ = server.Thing("thing-1")
+	values := registered.Attributes[DefaultStatusAttribute]
+	if len(values) != 1 {
+		t.Fatalf("expected status attribute; got %v", registered.Attributes)
+	}
+	var status Status
+	if err = json.Unmarshal([]byte(values[0]), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Version != d.Version || status.State != StateInstalled || status.Time.IsZero() {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if registered.Attributes[DefaultDescriptorAttribute][0] != signed {
+		t.Error("expected the descriptor to be kept")
+	}
+}
@@ -0,0 +1,46 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package pop helps resource servers verify the proof-of-possession (PoP) bound access tokens presented by things.
+// An access token issued by AM to a thing contains a confirmation (cnf) claim with the public key of the thing. A
+// resource server validates the access token as described in package accesstoken and then challenges the thing to
+// prove that it holds the private key by signing the challenge.
+//
+// This example shows how a resource server verifies the access token and proof presented by a thing:
+//
+//    verifier := pop.Verifier{Validator: validator}
+//
+//    // Issue a challenge to the thing and receive the access token and proof in return
+//    challenge := pop.NewChallenge()
+//    token, err := verifier.Verify(accessToken, proof, challenge)
+//    if err != nil {
+//        // reject the request
+//    }
+//    log.Printf("request made by %s", token.Subject)
+//
+// The thing creates the proof by signing the challenge with its confirmation key:
+//
+//    proof, _ := pop.Prove(thingKey, challenge)
+//
+// Third-party resource servers that require sender-constrained access tokens (DPoP, RFC 9449) expect a proof for every
+// request instead of a challenge. The thing creates the proof with ProveRequest and sends it in the DPoP header:
+//
+//    proof, _ := pop.ProveRequest(thingKey, http.MethodGet, "https://rs.example.com/data", accessToken, "")
+//    request, _ := http.NewRequest(http.MethodGet, "https://rs.example.com/data", nil)
+//    request.Header.Set("Authorization", "DPoP "+accessToken)
+//    request.Header.Set(pop.DPoPHeader, proof)
+//
+package pop
@@ -0,0 +1,194 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pop
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/clock"
+	"github.com/JacoJooste/iot-edge/v7/internal/jws"
+	"github.com/JacoJooste/iot-edge/v7/pkg/accesstoken"
+	"github.com/dchest/uniuri"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+var (
+	// ErrInvalidToken indicates that the access token was not issued by AM or is no longer valid, it is the same error
+	// as accesstoken.ErrInvalidToken
+	ErrInvalidToken = accesstoken.ErrInvalidToken
+	// ErrInvalidProof indicates that the thing failed to prove possession of the key that the access token is bound to
+	ErrInvalidProof = errors.New("invalid proof of possession")
+)
+
+// proofLife is the lifetime of a proof created by Prove
+const proofLife = 5 * time.Minute
+
+// Token contains the verified claims of a PoP bound access token
+type Token struct {
+	accesstoken.Token
+	// ConfirmationKey is the public key of the thing that the token is bound to
+	ConfirmationKey jose.JSONWebKey
+}
+
+// Verifier verifies PoP bound access tokens and the proofs presented with them. The access token is validated by the
+// embedded accesstoken.Validator, of which the leeway also applies to the validity period of the proof.
+type Verifier struct {
+	accesstoken.Validator
+}
+
+// confirmationClaims contains the claims used to bind an access token to the key of a thing
+type confirmationClaims struct {
+	CNF struct {
+		JWK *jose.JSONWebKey `json:"jwk,omitempty"`
+	} `json:"cnf"`
+}
+
+// proofClaims contains the claims of a proof created by a thing
+type proofClaims struct {
+	Nonce string `json:"nonce"`
+}
+
+// verifyAccessToken checks that the access token was signed by AM, is valid and is bound to a key
+func (v Verifier) verifyAccessToken(accessToken string) (token Token, err error) {
+	token.Token, err = v.Validate(accessToken)
+	if err != nil {
+		return token, err
+	}
+	var confirmation confirmationClaims
+	if err = token.Claims(&confirmation); err != nil {
+		return token, fmt.Errorf("%w: %s", ErrInvalidToken, err)
+	}
+	key := confirmation.CNF.JWK
+	if key == nil || !key.Valid() {
+		return token, fmt.Errorf("%w: missing confirmation key", ErrInvalidToken)
+	}
+	token.ConfirmationKey = key.Public()
+	return token, nil
+}
+
+// Verify checks that the access token was issued by AM and that the proof is a signature over the challenge made with
+// the key that the access token is bound to. The proof must expire within the lifetime of a proof created by Prove.
+// Returns the verified access token.
+func (v Verifier) Verify(accessToken, proof, challenge string) (token Token, err error) {
+	token, err = v.verifyAccessToken(accessToken)
+	if err != nil {
+		return token, err
+	}
+	parsed, err := jwt.ParseSigned(proof)
+	if err != nil {
+		return token, fmt.Errorf("%w: %s", ErrInvalidProof, err)
+	}
+	var claims jwt.Claims
+	var popClaims proofClaims
+	if err = parsed.Claims(token.ConfirmationKey.Key, &claims, &popClaims); err != nil {
+		return token, fmt.Errorf("%w: %s", ErrInvalidProof, err)
+	}
+	if challenge == "" || popClaims.Nonce != challenge {
+		return token, fmt.Errorf("%w: incorrect challenge", ErrInvalidProof)
+	}
+	// a proof must expire soon so that a captured proof can only be replayed for a short time
+	now := clock.Clock()
+	if claims.Expiry == nil {
+		return token, fmt.Errorf("%w: missing expiry", ErrInvalidProof)
+	}
+	if claims.Expiry.Time().After(now.Add(proofLife + v.Leeway)) {
+		return token, fmt.Errorf("%w: the proof is valid for longer than %v", ErrInvalidProof, proofLife)
+	}
+	if err = claims.ValidateWithLeeway(jwt.Expected{Time: now}, v.Leeway); err != nil {
+		return token, fmt.Errorf("%w: %s", ErrInvalidProof, err)
+	}
+	return token, nil
+}
+
+// NewChallenge returns a random challenge that a resource server sends to a thing
+func NewChallenge() string {
+	return uniuri.NewLen(32)
+}
+
+// Prove creates the proof that the thing possesses the signing key by signing the challenge
+func Prove(key crypto.Signer, challenge string) (string, error) {
+	opts := &jose.SignerOptions{}
+	opts.WithHeader("typ", "JWT")
+	sig, err := jws.NewSigner(key, opts)
+	if err != nil {
+		return "", err
+	}
+	now := clock.Clock()
+	return jwt.Signed(sig).
+		Claims(jwt.Claims{
+			IssuedAt: jwt.NewNumericDate(now),
+			Expiry:   jwt.NewNumericDate(now.Add(proofLife)),
+		}).
+		Claims(proofClaims{Nonce: challenge}).
+		CompactSerialize()
+}
+
+// DPoPHeader is the name of the HTTP header that carries the proof created by ProveRequest
+const DPoPHeader = "DPoP"
+
+// dpopProofClaims contains the claims of a DPoP proof as defined by RFC 9449
+type dpopProofClaims struct {
+	JTI   string `json:"jti"`
+	HTM   string `json:"htm"`
+	HTU   string `json:"htu"`
+	IAT   int64  `json:"iat"`
+	ATH   string `json:"ath,omitempty"`
+	Nonce string `json:"nonce,omitempty"`
+}
+
+// ProveRequest creates a DPoP proof (RFC 9449) for a request to a third-party resource server that requires
+// sender-constrained access tokens. The proof is signed with the confirmation key of the thing, contains its public
+// key and is bound to the method and URL of the request. If the access token is not empty, the proof is also bound to
+// the token. The nonce is optional and must be set to the value of the DPoP-Nonce header when the resource server
+// provides one. A new proof must be created for every request and sent in the DPoP header.
+func ProveRequest(key crypto.Signer, method, target, accessToken, nonce string) (string, error) {
+	if key == nil {
+		return "", jws.ErrMissingSigner
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+	// the htu claim excludes the query and fragment of the target URL
+	u.RawQuery, u.Fragment = "", ""
+	opts := &jose.SignerOptions{}
+	opts.WithType("dpop+jwt")
+	opts.WithHeader("jwk", jws.JSONWebKey{JSONWebKey: jose.JSONWebKey{Key: key.Public()}})
+	sig, err := jws.NewSigner(key, opts)
+	if err != nil {
+		return "", err
+	}
+	claims := dpopProofClaims{
+		JTI:   uniuri.NewLen(32),
+		HTM:   method,
+		HTU:   u.String(),
+		IAT:   clock.Clock().Unix(),
+		Nonce: nonce,
+	}
+	if accessToken != "" {
+		hash := sha256.Sum256([]byte(accessToken))
+		claims.ATH = base64.RawURLEncoding.EncodeToString(hash[:])
+	}
+	return jwt.Signed(sig).Claims(claims).CompactSerialize()
+}
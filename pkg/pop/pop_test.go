@@ -0,0 +1,222 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pop
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/clock"
+	"github.com/JacoJooste/iot-edge/v7/internal/jws"
+	"github.com/JacoJooste/iot-edge/v7/pkg/accesstoken"
+	"github.com/JacoJooste/iot-edge/v7/pkg/amtest"
+	"github.com/JacoJooste/iot-edge/v7/pkg/builder"
+	"github.com/JacoJooste/iot-edge/v7/pkg/callback"
+	"github.com/JacoJooste/iot-edge/v7/pkg/thing"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+var (
+	testThingKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	testOtherKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+)
+
+// testAMServer starts a mock AM server that registers things with a key and authenticates things with a password
+func testAMServer() *amtest.Server {
+	server := &amtest.Server{
+		Trees: map[string]amtest.Tree{
+			"reg-tree":      {amtest.AuthenticateThing{}, amtest.RegisterThing{}},
+			"password-tree": {amtest.Password{Users: map[string]string{"unbound": "password"}}},
+		},
+	}
+	server.Start()
+	server.AddThing(amtest.Thing{ID: "unbound", Type: "device"})
+	return server
+}
+
+// requestAccessToken requests an access token for the thing, which is bound to its key if it was registered with one
+func requestAccessToken(t *testing.T, server *amtest.Server, b thing.Builder) string {
+	device, err := b.ConnectTo(server.URL()).Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := device.RequestAccessToken("publish")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessToken, err := response.AccessToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return accessToken
+}
+
+// testProof signs a proof of the challenge with the given registered claims
+func testProof(t *testing.T, claims jwt.Claims, challenge string) string {
+	sig, err := jws.NewSigner(testThingKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := jwt.Signed(sig).Claims(claims).Claims(proofClaims{Nonce: challenge}).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proof
+}
+
+func TestVerifier_Verify(t *testing.T) {
+	server := testAMServer()
+	defer server.Close()
+	other := testAMServer()
+	defer other.Close()
+
+	verifier := Verifier{Validator: accesstoken.Validator{Keys: &accesstoken.KeySet{URL: server.URL()}}}
+	challenge := NewChallenge()
+	registered := func() thing.Builder {
+		return builder.Thing().
+			WithTree("reg-tree").
+			AuthenticateThing("thing", "", "key-1", testThingKey, nil).
+			RegisterThing(nil, nil)
+	}
+	valid := requestAccessToken(t, server, registered())
+	unknownIssuer := requestAccessToken(t, other, registered())
+	unbound := requestAccessToken(t, server, builder.Thing().
+		WithTree("password-tree").
+		AuthenticateThing("unbound", "", "key-1", testOtherKey, nil).
+		HandleCallbacksWith(callback.NameHandler{Name: "unbound"}, callback.PasswordHandler{Password: "password"}))
+	proof, err := Prove(testThingKey, challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherProof, err := Prove(testOtherKey, challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	noExpiry := testProof(t, jwt.Claims{IssuedAt: jwt.NewNumericDate(now)}, challenge)
+	longLived := testProof(t, jwt.Claims{IssuedAt: jwt.NewNumericDate(now),
+		Expiry: jwt.NewNumericDate(now.Add(time.Hour))}, challenge)
+	expired := testProof(t, jwt.Claims{IssuedAt: jwt.NewNumericDate(now.Add(-10 * time.Minute)),
+		Expiry: jwt.NewNumericDate(now.Add(-5 * time.Minute))}, challenge)
+
+	tests := []struct {
+		name        string
+		accessToken string
+		proof       string
+		challenge   string
+		audience    string
+		time        time.Time
+		err         error
+	}{
+		{name: "valid", accessToken: valid, proof: proof, challenge: challenge, audience: amtest.AccessTokenAudience},
+		{name: "unknown-issuer", accessToken: unknownIssuer, proof: proof, challenge: challenge,
+			err: ErrInvalidToken},
+		{name: "expired-token", accessToken: valid, proof: proof, challenge: challenge,
+			time: time.Now().Add(2 * time.Hour), err: ErrInvalidToken},
+		{name: "wrong-audience", accessToken: valid, proof: proof, challenge: challenge, audience: "other",
+			err: ErrInvalidToken},
+		{name: "unbound-token", accessToken: unbound, proof: proof, challenge: challenge, err: ErrInvalidToken},
+		{name: "wrong-key", accessToken: valid, proof: otherProof, challenge: challenge, err: ErrInvalidProof},
+		{name: "wrong-challenge", accessToken: valid, proof: proof, challenge: NewChallenge(), err: ErrInvalidProof},
+		{name: "malformed-proof", accessToken: valid, proof: "proof", challenge: challenge, err: ErrInvalidProof},
+		{name: "proof-without-expiry", accessToken: valid, proof: noExpiry, challenge: challenge, err: ErrInvalidProof},
+		{name: "long-lived-proof", accessToken: valid, proof: longLived, challenge: challenge, err: ErrInvalidProof},
+		{name: "expired-proof", accessToken: valid, proof: expired, challenge: challenge, err: ErrInvalidProof},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			if !subtest.time.IsZero() {
+				clock.Clock = func() time.Time { return subtest.time }
+				defer func() { clock.Clock = clock.DefaultClock() }()
+			}
+			verifier.Audience = subtest.audience
+			token, err := verifier.Verify(subtest.accessToken, subtest.proof, subtest.challenge)
+			if subtest.err != nil {
+				if !errors.Is(err, subtest.err) {
+					t.Errorf("expected %v, got %v", subtest.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token.Subject != "thing" || !token.HasScope("publish") || token.Expiry.Before(time.Now()) {
+				t.Errorf("unexpected token %+v", token)
+			}
+			thumbprint, _ := token.ConfirmationKey.Thumbprint(crypto.SHA256)
+			expected, _ := jws.Thumbprint(testThingKey.Public())
+			if !bytes.Equal(thumbprint, expected) {
+				t.Error("unexpected confirmation key")
+			}
+		})
+	}
+}
+
+func TestProveRequest(t *testing.T) {
+	accessToken := "anAccessToken"
+	first, err := ProveRequest(testThingKey, http.MethodPost, "https://rs.example.com/data?page=2#top", accessToken,
+		"aNonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := ProveRequest(testThingKey, http.MethodPost, "https://rs.example.com/data", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := jwt.ParseSigned(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := parsed.Headers[0]
+	if header.ExtraHeaders["typ"] != "dpop+jwt" || header.JSONWebKey == nil || !header.JSONWebKey.IsPublic() {
+		t.Fatalf("unexpected header %+v", header)
+	}
+	var claims dpopProofClaims
+	if err = parsed.Claims(header.JSONWebKey.Key, &claims); err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256([]byte(accessToken))
+	expected := dpopProofClaims{JTI: claims.JTI, HTM: http.MethodPost, HTU: "https://rs.example.com/data",
+		IAT: claims.IAT, ATH: base64.RawURLEncoding.EncodeToString(hash[:]), Nonce: "aNonce"}
+	if claims != expected || claims.JTI == "" || time.Since(time.Unix(claims.IAT, 0)) > time.Minute {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+	thumbprint, _ := header.JSONWebKey.Thumbprint(crypto.SHA256)
+	expectedThumbprint, _ := jws.Thumbprint(testThingKey.Public())
+	if !bytes.Equal(thumbprint, expectedThumbprint) {
+		t.Error("proof does not contain the confirmation key")
+	}
+
+	var secondClaims dpopProofClaims
+	if err = jws.ExtractClaims(second, &secondClaims); err != nil {
+		t.Fatal(err)
+	}
+	if secondClaims.JTI == claims.JTI || secondClaims.ATH != "" {
+		t.Errorf("unexpected claims %+v", secondClaims)
+	}
+}
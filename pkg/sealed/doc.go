@@ -0,0 +1,36 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package sealed encrypts selected attribute values of a thing on the device before they are written to AM, so that
+// sensitive telemetry, such as the location of the device, is stored in AM as ciphertext that AM administrators can
+// not read. Each value is sealed in a compact JWE for the public key of the fleet and is bound to the name of its
+// attribute, so that a sealed value can not be moved to another attribute. Only holders of the private key of the
+// fleet, such as a backend service or things that are provisioned with the key, can open the values.
+//
+// AM must allow the thing to write the sealed attributes, and the attributes must be able to hold the JWE, which is
+// considerably longer than the value that it contains.
+//
+// This example shows how a thing writes sealed attributes and how the attributes are opened after they are read:
+//
+//    sealer := sealed.Sealer{Key: fleetPublicKey, KeyID: "fleet-2020", Attributes: []string{"location"}}
+//    err := sealer.Write(device, "/all-the-things", map[string][]string{
+//        "location": {"51.4779,-0.0015"},
+//        "model":    {"sensor-v2"},
+//    })
+//
+//    response, err := device.RequestAttributes("location", "model")
+//    response, err = sealed.Opener{Key: fleetPrivateKey}.Open(response)
+package sealed
@@ -0,0 +1,193 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sealed
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/JacoJooste/iot-edge/v7/pkg/thing"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// attributeHeader is the protected JWE header that binds a sealed value to the name of its attribute
+const attributeHeader = jose.HeaderKey("attr")
+
+var (
+	// ErrUnsupportedKey indicates that values can not be sealed for, or opened with, the type of the key. RSA and EC
+	// keys are supported.
+	ErrUnsupportedKey = errors.New("unsupported fleet key")
+
+	// ErrOpenFailed indicates that a sealed value could not be opened with the key or that it was sealed for another
+	// attribute
+	ErrOpenFailed = errors.New("unable to open sealed value")
+)
+
+// keyAlgorithm returns the JWE key management algorithm for the public key of the fleet
+func keyAlgorithm(key crypto.PublicKey) (jose.KeyAlgorithm, error) {
+	switch key.(type) {
+	case *rsa.PublicKey:
+		return jose.RSA_OAEP_256, nil
+	case *ecdsa.PublicKey:
+		return jose.ECDH_ES_A256KW, nil
+	}
+	return "", fmt.Errorf("%w: %T", ErrUnsupportedKey, key)
+}
+
+// Sealer seals the values of the designated attributes for the public key of the fleet
+type Sealer struct {
+	// Key is the public key of the fleet, an *rsa.PublicKey or an *ecdsa.PublicKey
+	Key crypto.PublicKey
+	// KeyID is optional and identifies the fleet key in the JWE header, so that the key can be rotated
+	KeyID string
+	// Attributes are the names of the attributes whose values are sealed, other attributes are written in the clear
+	Attributes []string
+}
+
+// designated returns true if the values of the attribute are sealed
+func (s Sealer) designated(name string) bool {
+	for _, attribute := range s.Attributes {
+		if attribute == name {
+			return true
+		}
+	}
+	return false
+}
+
+// SealValue seals the value of the named attribute
+func (s Sealer) SealValue(name string, value string) (string, error) {
+	alg, err := keyAlgorithm(s.Key)
+	if err != nil {
+		return "", err
+	}
+	opts := (&jose.EncrypterOptions{}).WithHeader(attributeHeader, name)
+	encrypter, err := jose.NewEncrypter(jose.A256GCM, jose.Recipient{Algorithm: alg, Key: s.Key, KeyID: s.KeyID},
+		opts)
+	if err != nil {
+		return "", err
+	}
+	object, err := encrypter.Encrypt([]byte(value))
+	if err != nil {
+		return "", err
+	}
+	return object.CompactSerialize()
+}
+
+// Seal returns a copy of the attributes in which the values of the designated attributes are sealed
+func (s Sealer) Seal(attributes map[string][]string) (map[string][]string, error) {
+	result := make(map[string][]string, len(attributes))
+	for name, values := range attributes {
+		if !s.designated(name) {
+			result[name] = values
+			continue
+		}
+		sealedValues := make([]string, 0, len(values))
+		for _, value := range values {
+			sealedValue, err := s.SealValue(name, value)
+			if err != nil {
+				return nil, err
+			}
+			sealedValues = append(sealedValues, sealedValue)
+		}
+		result[name] = sealedValues
+	}
+	return result, nil
+}
+
+// Write seals the designated attributes and writes all the attributes to the identity of the thing with a signed
+// update request to the things endpoint, which AM must allow for the thing. The realm is optional and is the realm of
+// the thing in AM.
+func (s Sealer) Write(device thing.Thing, realm string, attributes map[string][]string) error {
+	update, err := s.Seal(attributes)
+	if err != nil {
+		return err
+	}
+	body := make(map[string]interface{}, len(update))
+	for name, values := range update {
+		body[name] = values
+	}
+	_, err = thing.UpdateAttributes(device, realm, body)
+	return err
+}
+
+// IsSealed returns true if the value has the form of a sealed value, a compact JWE
+func IsSealed(value string) bool {
+	return strings.Count(value, ".") == 4 && strings.HasPrefix(value, "ey")
+}
+
+// Opener opens sealed values with the private key of the fleet
+type Opener struct {
+	// Key is the private key of the fleet, an *rsa.PrivateKey or an *ecdsa.PrivateKey
+	Key crypto.PrivateKey
+}
+
+// OpenValue opens the sealed value of the named attribute
+func (o Opener) OpenValue(name string, value string) (string, error) {
+	switch o.Key.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey:
+	default:
+		return "", fmt.Errorf("%w: %T", ErrUnsupportedKey, o.Key)
+	}
+	object, err := jose.ParseEncrypted(value)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrOpenFailed, err)
+	}
+	if attribute, _ := object.Header.ExtraHeaders[attributeHeader].(string); attribute != name {
+		return "", fmt.Errorf("%w: sealed for attribute %q", ErrOpenFailed, attribute)
+	}
+	plaintext, err := object.Decrypt(o.Key)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrOpenFailed, err)
+	}
+	return string(plaintext), nil
+}
+
+// Open returns a copy of the attributes response in which the sealed values are opened. Values that are not sealed are
+// returned unchanged.
+func (o Opener) Open(response thing.AttributesResponse) (opened thing.AttributesResponse, err error) {
+	opened.Content = make(map[string]interface{}, len(response.Content))
+	for name, value := range response.Content {
+		if opened.Content[name], err = o.open(name, value); err != nil {
+			return opened, err
+		}
+	}
+	return opened, nil
+}
+
+// open opens the value of the attribute, a string or an array of strings, if it is sealed
+func (o Opener) open(name string, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		if IsSealed(v) {
+			return o.OpenValue(name, v)
+		}
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for i, element := range v {
+			var err error
+			if values[i], err = o.open(name, element); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return value, nil
+}
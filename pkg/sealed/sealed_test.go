@@ -0,0 +1,131 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sealed
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"testing"
+
+	"github.com/JacoJooste/iot-edge/v7/pkg/amtest"
+	"github.com/JacoJooste/iot-edge/v7/pkg/builder"
+	"github.com/JacoJooste/iot-edge/v7/pkg/thing"
+)
+
+func TestSealer_SealValue(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	tests := []struct {
+		name    string
+		public  crypto.PublicKey
+		private crypto.PrivateKey
+		err     error
+	}{
+		{name: "ec", public: ecKey.Public(), private: ecKey},
+		{name: "rsa", public: rsaKey.Public(), private: rsaKey},
+		{name: "ed25519", public: edKey.Public(), private: edKey, err: ErrUnsupportedKey},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			value, err := Sealer{Key: subtest.public, KeyID: "fleet"}.SealValue("location", "51.4779,-0.0015")
+			if !errors.Is(err, subtest.err) {
+				t.Fatalf("expected error %v; got %v", subtest.err, err)
+			}
+			if subtest.err != nil {
+				return
+			}
+			if !IsSealed(value) {
+				t.Errorf("expected a sealed value; got %s", value)
+			}
+			opener := Opener{Key: subtest.private}
+			if opened, err := opener.OpenValue("location", value); err != nil || opened != "51.4779,-0.0015" {
+				t.Errorf("unexpected opened value %s, %v", opened, err)
+			}
+			// the value is bound to its attribute
+			if _, err := opener.OpenValue("model", value); !errors.Is(err, ErrOpenFailed) {
+				t.Errorf("expected %v; got %v", ErrOpenFailed, err)
+			}
+		})
+	}
+}
+
+func TestSealer_Write(t *testing.T) {
+	server := &amtest.Server{Trees: map[string]amtest.Tree{
+		"reg-tree": {amtest.AuthenticateThing{}, amtest.RegisterThing{}},
+	}}
+	server.Start()
+	defer server.Close()
+
+	thingKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	device, err := builder.Thing().
+		ConnectTo(server.URL()).
+		WithTree("reg-tree").
+		AuthenticateThing("thing-1", "", "key-1", thingKey, nil).
+		RegisterThing(nil, nil).
+		Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fleetKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	sealer := Sealer{Key: fleetKey.Public(), Attributes: []string{"location"}}
+	err = sealer.Write(device, "", map[string][]string{
+		"location": {"51.4779,-0.0015"},
+		"model":    {"sensor-v2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// AM only holds the ciphertext of the sealed attribute
+	stored, _ := server.Thing("thing-1")
+	if location := stored.Attributes["location"]; len(location) != 1 || !IsSealed(location[0]) {
+		t.Errorf("expected a sealed location; got %v", location)
+	}
+	if model := stored.Attributes["model"]; len(model) != 1 || model[0] != "sensor-v2" {
+		t.Errorf("expected the model in the clear; got %v", model)
+	}
+
+	response, err := device.RequestAttributes("location", "model")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err := Opener{Key: fleetKey}.Open(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var attributes struct {
+		Location []string `attribute:"location"`
+		Model    []string `attribute:"model"`
+	}
+	if err = opened.Unmarshal(&attributes); err != nil {
+		t.Fatal(err)
+	}
+	if len(attributes.Location) != 1 || attributes.Location[0] != "51.4779,-0.0015" ||
+		len(attributes.Model) != 1 || attributes.Model[0] != "sensor-v2" {
+		t.Errorf("unexpected attributes %+v", attributes)
+	}
+
+	if _, err = (Opener{Key: thingKey}).Open(thing.AttributesResponse{Content: response.Content}); err == nil {
+		t.Error("expected the thing key to be unable to open the location")
+	}
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package signagent
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/debug"
+	"github.com/JacoJooste/iot-edge/v7/internal/storage"
+)
+
+// Agent signs digests with the keys that it holds on behalf of the processes that connect to it
+type Agent struct {
+	// Keys held by the agent, indexed by key ID
+	Keys map[string]crypto.Signer
+}
+
+// Listen creates a Unix socket at the given path that can only be used by the owner of the process. A socket left
+// behind by a previous agent is replaced.
+func Listen(socket string) (net.Listener, error) {
+	if info, err := os.Lstat(socket); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err = os.Remove(socket); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	if err = storage.RestrictToOwner(socket); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Serve accepts connections on the listener and answers their requests until the listener is closed
+func (a *Agent) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go a.serveConn(conn)
+	}
+}
+
+// serveConn answers the requests on the connection until it is closed
+func (a *Agent) serveConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		request, err := readMessage(conn)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				debug.Errorf("signing agent: %s", err)
+			}
+			return
+		}
+		reply, err := a.handle(request)
+		if err != nil {
+			debug.Infof("signing agent: request refused; %s", err)
+			reply = newMessage(msgFailure).putBytes([]byte(err.Error()))
+		}
+		if err = reply.write(conn); err != nil {
+			debug.Errorf("signing agent: %s", err)
+			return
+		}
+	}
+}
+
+// handle the request and return the reply
+func (a *Agent) handle(request *message) (*message, error) {
+	keyID, err := request.bytes()
+	if err != nil {
+		return nil, err
+	}
+	key, ok := a.Keys[string(keyID)]
+	if !ok {
+		return nil, fmt.Errorf("unknown key `%s`", keyID)
+	}
+	switch request.kind {
+	case msgPublicKeyRequest:
+		der, err := x509.MarshalPKIXPublicKey(key.Public())
+		if err != nil {
+			return nil, err
+		}
+		return newMessage(msgPublicKeyReply).putBytes(der), nil
+	case msgSignRequest:
+		hash, err := request.uint32()
+		if err != nil {
+			return nil, err
+		}
+		salt, err := request.uint32()
+		if err != nil {
+			return nil, err
+		}
+		digest, err := request.bytes()
+		if err != nil {
+			return nil, err
+		}
+		// hashes that are not linked into the agent are refused since signers panic on unknown hashes
+		if hash != 0 && !crypto.Hash(hash).Available() {
+			return nil, fmt.Errorf("unsupported hash %d", hash)
+		}
+		var opts crypto.SignerOpts = crypto.Hash(hash)
+		if salt != 0 {
+			opts = &rsa.PSSOptions{SaltLength: int(salt) - 2, Hash: crypto.Hash(hash)}
+		}
+		signature, err := key.Sign(rand.Reader, digest, opts)
+		if err != nil {
+			return nil, err
+		}
+		return newMessage(msgSignReply).putBytes(signature), nil
+	default:
+		return nil, fmt.Errorf("unknown request %d", request.kind)
+	}
+}
@@ -0,0 +1,41 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package signagent delegates the signing operations of a thing to a separate process, in the style of ssh-agent, so
+// that the private key of the thing can live in a hardened process or container that the application can not read.
+// The agent listens on a Unix socket and holds keys by key ID. The SDK side connects to the socket with a Signer,
+// which implements crypto.Signer by sending the digests to be signed to the agent. The private key never leaves the
+// agent.
+//
+// This example shows how an agent process serves a key:
+//
+//    listener, _ := signagent.Listen("/run/things/agent.sock")
+//    agent := signagent.Agent{Keys: map[string]crypto.Signer{"thing-1": key}}
+//    log.Fatal(agent.Serve(listener))
+//
+// And how the application uses the key held by the agent to authenticate the thing:
+//
+//    signer, _ := signagent.Dial("/run/things/agent.sock", "thing-1")
+//    device, _ := builder.Thing().
+//        ConnectTo(amURL).
+//        ...
+//        AuthenticateThing("thing-1", "/all-the-things", keyID, signer, nil).
+//        Create()
+//
+// The protocol is a sequence of requests and replies over the socket, each framed with a 4 byte big endian length.
+// Access to the agent is controlled with the file permissions of the socket, which Listen restricts to the owner.
+//
+package signagent
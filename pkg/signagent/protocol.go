@@ -0,0 +1,124 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package signagent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Protocol
+// Every message is framed with a 4 byte big endian length followed by a message type byte and the fields of the
+// message. Byte strings are encoded with a 4 byte big endian length and numbers as 4 byte big endian integers:
+//    public key request:  keyID
+//    public key reply:    PKIX encoded public key
+//    sign request:        keyID, hash, PSS salt length + 2 (0 if not PSS), digest
+//    sign reply:          signature
+//    failure:             reason
+// A connection may carry any number of requests, each request is answered before the next one is read.
+
+// message types
+const (
+	msgPublicKeyRequest byte = iota + 1
+	msgPublicKeyReply
+	msgSignRequest
+	msgSignReply
+	msgFailure
+)
+
+// maxMessageSize is the maximum size of a message, which is plenty for digests and signatures
+const maxMessageSize = 64 * 1024
+
+var errMessageTooLarge = errors.New("message too large")
+
+// message is a protocol message under construction or being parsed
+type message struct {
+	kind byte
+	body *bytes.Buffer
+}
+
+func newMessage(kind byte) *message {
+	return &message{kind: kind, body: new(bytes.Buffer)}
+}
+
+func (m *message) putBytes(b []byte) *message {
+	m.putUint32(uint32(len(b)))
+	m.body.Write(b)
+	return m
+}
+
+func (m *message) putUint32(v uint32) *message {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	m.body.Write(b[:])
+	return m
+}
+
+func (m *message) uint32() (uint32, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(m.body, b[:]); err != nil {
+		return 0, fmt.Errorf("truncated message")
+	}
+	return binary.BigEndian.Uint32(b[:]), nil
+}
+
+func (m *message) bytes() ([]byte, error) {
+	n, err := m.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if int(n) > m.body.Len() {
+		return nil, fmt.Errorf("truncated message")
+	}
+	return m.body.Next(int(n)), nil
+}
+
+// write the framed message to the writer
+func (m *message) write(w io.Writer) error {
+	size := 1 + m.body.Len()
+	if size > maxMessageSize {
+		return errMessageTooLarge
+	}
+	frame := make([]byte, 5, 4+size)
+	binary.BigEndian.PutUint32(frame, uint32(size))
+	frame[4] = m.kind
+	_, err := w.Write(append(frame, m.body.Bytes()...))
+	return err
+}
+
+// readMessage reads a framed message from the reader
+func readMessage(r io.Reader) (*message, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size == 0 {
+		return nil, fmt.Errorf("empty message")
+	}
+	if size > maxMessageSize {
+		return nil, errMessageTooLarge
+	}
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return &message{kind: frame[0], body: bytes.NewBuffer(frame[1:])}, nil
+}
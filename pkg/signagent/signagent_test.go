@@ -0,0 +1,139 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package signagent
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testAgent starts an agent holding the keys and returns the path of its socket
+func testAgent(t *testing.T, keys map[string]crypto.Signer) (string, func()) {
+	dir, err := ioutil.TempDir("", "signagent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "agent.sock")
+	listener, err := Listen(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent := &Agent{Keys: keys}
+	go agent.Serve(listener)
+	return socket, func() {
+		listener.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSigner_Sign(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	socket, stop := testAgent(t, map[string]crypto.Signer{"ec": ecKey, "rsa": rsaKey})
+	defer stop()
+
+	digest := sha256.Sum256([]byte("payload"))
+	tests := []struct {
+		name   string
+		keyID  string
+		opts   crypto.SignerOpts
+		verify func(signature []byte) bool
+	}{
+		{name: "ecdsa", keyID: "ec", opts: crypto.SHA256, verify: func(signature []byte) bool {
+			var sig struct{ R, S *big.Int }
+			if _, err := asn1.Unmarshal(signature, &sig); err != nil {
+				return false
+			}
+			return ecdsa.Verify(&ecKey.PublicKey, digest[:], sig.R, sig.S)
+		}},
+		{name: "rsa-pkcs1v15", keyID: "rsa", opts: crypto.SHA256, verify: func(signature []byte) bool {
+			return rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA256, digest[:], signature) == nil
+		}},
+		{name: "rsa-pss", keyID: "rsa",
+			opts: &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256},
+			verify: func(signature []byte) bool {
+				return rsa.VerifyPSS(&rsaKey.PublicKey, crypto.SHA256, digest[:], signature,
+					&rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+			}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			signer, err := Dial(socket, subtest.keyID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := map[string]crypto.PublicKey{"ec": &ecKey.PublicKey, "rsa": &rsaKey.PublicKey}[subtest.keyID]
+			if !reflect.DeepEqual(signer.Public(), expected) {
+				t.Error("public key does not match the key held by the agent")
+			}
+			signature, err := signer.Sign(rand.Reader, digest[:], subtest.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !subtest.verify(signature) {
+				t.Error("signature verification failed")
+			}
+		})
+	}
+}
+
+func TestSigner_Refused(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	socket, stop := testAgent(t, map[string]crypto.Signer{"ec": ecKey})
+	defer stop()
+
+	if _, err := Dial(socket, "other"); !errors.Is(err, ErrRefused) {
+		t.Errorf("expected %v; got %v", ErrRefused, err)
+	}
+	signer, err := Dial(socket, "ec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = signer.Sign(rand.Reader, []byte("digest"), crypto.Hash(999)); !errors.Is(err, ErrRefused) {
+		t.Errorf("expected %v; got %v", ErrRefused, err)
+	}
+}
+
+func TestDial_NoAgent(t *testing.T) {
+	if _, err := Dial(filepath.Join(os.TempDir(), "no-such-agent.sock"), "ec"); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestListen_Permissions(t *testing.T) {
+	socket, stop := testAgent(t, nil)
+	defer stop()
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected the socket to be restricted to the owner; got %v", info.Mode().Perm())
+	}
+}
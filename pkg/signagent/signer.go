@@ -0,0 +1,115 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package signagent
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// ErrRefused indicates that the agent refused to sign, for example because it does not hold the requested key
+var ErrRefused = errors.New("signing agent refused the request")
+
+// DefaultTimeout is the time allowed for a request to the agent
+const DefaultTimeout = 5 * time.Second
+
+// Signer signs digests with a key held by a signing agent
+type Signer struct {
+	socket string
+	keyID  string
+	public crypto.PublicKey
+	// Timeout of each request to the agent, DefaultTimeout is used if zero
+	Timeout time.Duration
+}
+
+// Dial returns a signer for the key with the given ID held by the agent listening on the Unix socket. The public key
+// is read from the agent, which must be running.
+func Dial(socket, keyID string) (*Signer, error) {
+	s := &Signer{socket: socket, keyID: keyID}
+	reply, err := s.request(newMessage(msgPublicKeyRequest).putBytes([]byte(keyID)), msgPublicKeyReply)
+	if err != nil {
+		return nil, err
+	}
+	der, err := reply.bytes()
+	if err != nil {
+		return nil, err
+	}
+	if s.public, err = x509.ParsePKIXPublicKey(der); err != nil {
+		return nil, fmt.Errorf("invalid public key from signing agent; %w", err)
+	}
+	return s, nil
+}
+
+// Public returns the public key of the key held by the agent
+func (s *Signer) Public() crypto.PublicKey {
+	return s.public
+}
+
+// Sign sends the digest to the agent and returns the signature created by the agent. The random source is not used,
+// the agent provides its own.
+func (s *Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	request := newMessage(msgSignRequest).putBytes([]byte(s.keyID)).putUint32(uint32(opts.HashFunc()))
+	if pss, ok := opts.(*rsa.PSSOptions); ok {
+		// salt lengths are offset so that rsa.PSSSaltLengthEqualsHash (-1) can be distinguished from PKCS #1 v1.5
+		request.putUint32(uint32(pss.SaltLength + 2))
+	} else {
+		request.putUint32(0)
+	}
+	reply, err := s.request(request.putBytes(digest), msgSignReply)
+	if err != nil {
+		return nil, err
+	}
+	return reply.bytes()
+}
+
+// request sends the request to the agent and returns the reply of the expected type
+func (s *Signer) request(request *message, expected byte) (*message, error) {
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	conn, err := net.DialTimeout("unix", s.socket, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	if err = request.write(conn); err != nil {
+		return nil, err
+	}
+	reply, err := readMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	switch reply.kind {
+	case expected:
+		return reply, nil
+	case msgFailure:
+		reason, _ := reply.bytes()
+		return nil, fmt.Errorf("%w: %s", ErrRefused, reason)
+	default:
+		return nil, fmt.Errorf("unexpected reply %d from signing agent", reply.kind)
+	}
+}
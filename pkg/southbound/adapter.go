@@ -0,0 +1,123 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package southbound
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/JacoJooste/iot-edge/v7/pkg/callback"
+)
+
+// ErrUnsupportedMessage is returned by an adapter that can not forward a type of message to its devices
+var ErrUnsupportedMessage = errors.New("message type not supported by the adapter")
+
+// Device is a device found by an adapter
+type Device struct {
+	// ID identifies the device within the adapter, for example its Bluetooth address or Modbus unit ID
+	ID string
+	// Name is an optional human readable name of the device
+	Name string
+}
+
+// Identity describes the thing that represents a device in AM
+type Identity struct {
+	// ThingID is the ID of the thing, which must be unique in the realm
+	ThingID string
+	// ThingType is the type of the thing, either callback.TypeDevice or callback.TypeService. Defaults to a device.
+	ThingType callback.ThingType
+	// Claims are optional and are added to the registration JWT of the thing
+	Claims map[string]interface{}
+}
+
+// MessageType identifies the type of a message forwarded to a device
+type MessageType string
+
+// Message types
+const (
+	// MessageAccessToken contains an access token issued to the thing that represents the device
+	MessageAccessToken MessageType = "access_token"
+)
+
+// Message is forwarded from the platform to a device
+type Message struct {
+	Type    MessageType
+	Payload []byte
+}
+
+// Adapter connects the gateway to devices that can not connect to the gateway themselves
+type Adapter interface {
+	// Name of the adapter, which is used to derive the keys of the things that represent its devices and must therefore
+	// not change
+	Name() string
+
+	// Discover returns the devices that the adapter can currently reach
+	Discover() ([]Device, error)
+
+	// Identify returns the identity of the thing that represents the device
+	Identify(device Device) (Identity, error)
+
+	// Forward the message to the device. Returns ErrUnsupportedMessage if the adapter does not support the type of
+	// message.
+	Forward(device Device, message Message) error
+}
+
+// Factory creates an adapter with the options provided when the adapter is enabled
+type Factory func(options map[string]string) (Adapter, error)
+
+var (
+	factoriesMutex sync.Mutex
+	factories      = make(map[string]Factory)
+)
+
+// Register makes the adapter factory available by the given name. Panics if a factory is registered twice under the
+// same name or if the factory is nil.
+func Register(name string, factory Factory) {
+	factoriesMutex.Lock()
+	defer factoriesMutex.Unlock()
+	if factory == nil {
+		panic("southbound: Register factory is nil")
+	}
+	if _, ok := factories[name]; ok {
+		panic("southbound: Register called twice for adapter " + name)
+	}
+	factories[name] = factory
+}
+
+// New creates the adapter registered by the given name
+func New(name string, options map[string]string) (Adapter, error) {
+	factoriesMutex.Lock()
+	factory, ok := factories[name]
+	factoriesMutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown southbound adapter %s", name)
+	}
+	return factory(options)
+}
+
+// Registered returns the sorted names of the registered adapters
+func Registered() []string {
+	factoriesMutex.Lock()
+	defer factoriesMutex.Unlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package southbound
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type testAdapter struct {
+	Adapter
+	port string
+}
+
+func TestRegister(t *testing.T) {
+	Register("test-serial", func(options map[string]string) (Adapter, error) {
+		if options["port"] == "" {
+			return nil, errors.New("port required")
+		}
+		return testAdapter{port: options["port"]}, nil
+	})
+	if !reflect.DeepEqual(Registered(), []string{"test-serial"}) {
+		t.Errorf("unexpected registered adapters %v", Registered())
+	}
+	adapter, err := New("test-serial", map[string]string{"port": "/dev/ttyUSB0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if adapter.(testAdapter).port != "/dev/ttyUSB0" {
+		t.Errorf("options not passed to the factory")
+	}
+	if _, err = New("test-serial", nil); err == nil {
+		t.Error("expected the factory error")
+	}
+	if _, err = New("test-zigbee", nil); err == nil {
+		t.Error("expected an error for an unknown adapter")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic when registering twice")
+		}
+	}()
+	Register("test-serial", func(map[string]string) (Adapter, error) { return nil, nil })
+}
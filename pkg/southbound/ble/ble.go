@@ -0,0 +1,129 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ble
+
+import (
+	"strings"
+
+	"github.com/JacoJooste/iot-edge/v7/pkg/southbound"
+)
+
+// Name of the BLE adapter
+const Name = "ble"
+
+// Peripheral is a BLE device found during a scan
+type Peripheral struct {
+	// Address is the Bluetooth device address, for example "C4:7C:8D:6A:2B:1F"
+	Address string
+	// Name is the advertised local name of the device
+	Name string
+	// ServiceUUIDs are the UUIDs of the GATT services advertised by the device
+	ServiceUUIDs []string
+}
+
+// advertises returns true if the peripheral advertises the service
+func (p Peripheral) advertises(uuid string) bool {
+	for _, s := range p.ServiceUUIDs {
+		if strings.EqualFold(s, uuid) {
+			return true
+		}
+	}
+	return false
+}
+
+// GATTConnection is a connection to the GATT server of a BLE device
+type GATTConnection interface {
+	// Write the value to the characteristic with the given UUID
+	Write(characteristic string, value []byte) error
+	// Close the connection
+	Close() error
+}
+
+// Stack provides access to the Bluetooth stack of the platform
+type Stack interface {
+	// Scan for BLE devices and return the devices that were found
+	Scan() ([]Peripheral, error)
+	// Connect to the GATT server of the device with the given address
+	Connect(address string) (GATTConnection, error)
+}
+
+// Config configures the BLE adapter
+type Config struct {
+	// IDPrefix is prepended to the device address to create the ID of a thing. Defaults to "ble-".
+	IDPrefix string
+	// ServiceUUID is optional. If set, only devices that advertise the service are proxied.
+	ServiceUUID string
+	// TokenCharacteristic is optional. If set, access tokens are written to the characteristic with this UUID,
+	// otherwise the adapter does not support access tokens.
+	TokenCharacteristic string
+}
+
+// Adapter proxies BLE devices as things
+type Adapter struct {
+	stack  Stack
+	config Config
+}
+
+// New creates a BLE adapter that uses the given stack
+func New(stack Stack, config Config) *Adapter {
+	if config.IDPrefix == "" {
+		config.IDPrefix = "ble-"
+	}
+	return &Adapter{stack: stack, config: config}
+}
+
+func (a *Adapter) Name() string {
+	return Name
+}
+
+func (a *Adapter) Discover() ([]southbound.Device, error) {
+	peripherals, err := a.stack.Scan()
+	if err != nil {
+		return nil, err
+	}
+	var devices []southbound.Device
+	for _, p := range peripherals {
+		if a.config.ServiceUUID != "" && !p.advertises(a.config.ServiceUUID) {
+			continue
+		}
+		devices = append(devices, southbound.Device{ID: strings.ToUpper(p.Address), Name: p.Name})
+	}
+	return devices, nil
+}
+
+func (a *Adapter) Identify(device southbound.Device) (southbound.Identity, error) {
+	claims := map[string]interface{}{"bleAddress": device.ID}
+	if device.Name != "" {
+		claims["bleName"] = device.Name
+	}
+	return southbound.Identity{
+		ThingID: a.config.IDPrefix + strings.ToLower(strings.ReplaceAll(device.ID, ":", "")),
+		Claims:  claims,
+	}, nil
+}
+
+func (a *Adapter) Forward(device southbound.Device, message southbound.Message) error {
+	if message.Type != southbound.MessageAccessToken || a.config.TokenCharacteristic == "" {
+		return southbound.ErrUnsupportedMessage
+	}
+	conn, err := a.stack.Connect(device.ID)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Write(a.config.TokenCharacteristic, message.Payload)
+}
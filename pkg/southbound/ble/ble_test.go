@@ -0,0 +1,96 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package ble
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/JacoJooste/iot-edge/v7/pkg/southbound"
+)
+
+// mockStack returns the same peripherals on every scan and records the values written to them
+type mockStack struct {
+	peripherals []Peripheral
+	// written values by device address and characteristic
+	written map[string]string
+}
+
+func (s *mockStack) Scan() ([]Peripheral, error) {
+	return s.peripherals, nil
+}
+
+func (s *mockStack) Connect(address string) (GATTConnection, error) {
+	return mockConnection{stack: s, address: address}, nil
+}
+
+type mockConnection struct {
+	stack   *mockStack
+	address string
+}
+
+func (c mockConnection) Write(characteristic string, value []byte) error {
+	c.stack.written[c.address+"/"+characteristic] = string(value)
+	return nil
+}
+
+func (c mockConnection) Close() error {
+	return nil
+}
+
+func TestAdapter(t *testing.T) {
+	stack := &mockStack{
+		peripherals: []Peripheral{
+			{Address: "c4:7c:8d:6a:2b:1f", Name: "sensor", ServiceUUIDs: []string{"181a"}},
+			{Address: "C4:7C:8D:6A:2B:20", Name: "headphones", ServiceUUIDs: []string{"110B"}},
+		},
+		written: make(map[string]string),
+	}
+	adapter := New(stack, Config{ServiceUUID: "181A", TokenCharacteristic: "2B3C"})
+	devices, err := adapter.Discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []southbound.Device{{ID: "C4:7C:8D:6A:2B:1F", Name: "sensor"}}
+	if !reflect.DeepEqual(devices, expected) {
+		t.Fatalf("expected devices %v; got %v", expected, devices)
+	}
+	identity, err := adapter.Identify(devices[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.ThingID != "ble-c47c8d6a2b1f" || identity.Claims["bleName"] != "sensor" {
+		t.Errorf("unexpected identity %+v", identity)
+	}
+	err = adapter.Forward(devices[0], southbound.Message{Type: southbound.MessageAccessToken, Payload: []byte("token")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stack.written["C4:7C:8D:6A:2B:1F/2B3C"] != "token" {
+		t.Errorf("token not written to the device; %v", stack.written)
+	}
+}
+
+func TestAdapter_Forward_Unsupported(t *testing.T) {
+	adapter := New(&mockStack{}, Config{})
+	err := adapter.Forward(southbound.Device{ID: "C4:7C:8D:6A:2B:1F"}, southbound.Message{
+		Type: southbound.MessageAccessToken,
+	})
+	if !errors.Is(err, southbound.ErrUnsupportedMessage) {
+		t.Errorf("expected ErrUnsupportedMessage; got %v", err)
+	}
+}
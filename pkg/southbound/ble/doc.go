@@ -0,0 +1,27 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package ble is a southbound adapter that proxies Bluetooth Low Energy (BLE) devices as things. The adapter uses the
+// Bluetooth stack of the platform, provided as a Stack, to scan for devices and writes the access tokens of the
+// proxied things to a GATT characteristic of the devices.
+//
+//    adapter := ble.New(stack, ble.Config{
+//        ServiceUUID:         "181A",
+//        TokenCharacteristic: "2B3C",
+//    })
+//    err := thingGateway.EnableAdapter(adapter, gateway.ProxyConfig{...})
+//
+package ble
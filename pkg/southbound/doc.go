@@ -0,0 +1,33 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+// Package southbound defines the interface between the Thing Gateway and adapters for devices that cannot connect to
+// the gateway themselves, such as Bluetooth, Zigbee, Modbus or serial devices. The gateway proxies every device found
+// by an adapter as a thing, registering and authenticating the thing with AM on behalf of the device.
+//
+// An adapter discovers the devices that it can reach, identifies the thing that represents each device and forwards
+// messages from the platform, such as access tokens, to the devices. Adapters register a factory under a unique name
+// when their package is initialised so that they can be enabled in the gateway by name:
+//
+//    func init() {
+//        southbound.Register("modbus", func(options map[string]string) (southbound.Adapter, error) {
+//            return newModbusAdapter(options["port"])
+//        })
+//    }
+//
+// Add an adapter to the gateway by importing its package for its side effects in cmd/gateway/adapters.go and enable
+// it with the --adapter option, for example --adapter "modbus:port=/dev/ttyUSB0".
+//
+package southbound
@@ -0,0 +1,118 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package thing
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+)
+
+// AttributeMapping maps the names of claims in the registration JWT of a thing to the names of the attributes of its
+// identity in AM, for example {"serialNumber": "employeeNumber"}. Unlike the fixed mapping of the registration node,
+// the mapping is configured on the device, so deployments with custom identity schemas can be onboarded without
+// changing the tree or scripting in AM. See Builder.MapClaimsToAttributes.
+type AttributeMapping map[string]string
+
+// LoadAttributeMapping reads an attribute mapping from a JSON file containing an object of claim names to attribute
+// names
+func LoadAttributeMapping(file string) (AttributeMapping, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var mapping AttributeMapping
+	if err = json.Unmarshal(b, &mapping); err != nil {
+		return nil, fmt.Errorf("attribute mapping %s: %w", file, err)
+	}
+	return mapping, mapping.Validate()
+}
+
+// Validate returns an error if a claim or attribute name is empty
+func (m AttributeMapping) Validate() error {
+	for claim, attribute := range m {
+		if claim == "" || attribute == "" {
+			return errors.New("attribute mapping requires claim and attribute names")
+		}
+	}
+	return nil
+}
+
+// attributeValues returns the values of a claim as identity attribute values. Strings are used as they are, other
+// values are encoded as JSON and arrays have a value per element.
+func attributeValues(claim interface{}) []string {
+	switch v := claim.(type) {
+	case nil:
+		return nil
+	case string:
+		return []string{v}
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, element := range v {
+			values = append(values, attributeValues(element)...)
+		}
+		return values
+	}
+	b, _ := json.Marshal(claim)
+	return []string{string(b)}
+}
+
+// Attributes returns the identity attributes to which the claims are mapped. Claims that are not in the mapping and
+// mapped claims that are missing or null are left out.
+func (m AttributeMapping) Attributes(claims interface{}) (map[string][]string, error) {
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(claims)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]interface{}
+	if err = json.Unmarshal(b, &values); err != nil {
+		return nil, fmt.Errorf("claims must be a JSON object: %w", err)
+	}
+	claimNames := make([]string, 0, len(m))
+	for claim := range m {
+		claimNames = append(claimNames, claim)
+	}
+	// claims that are mapped to the same attribute are added in the order of their names
+	sort.Strings(claimNames)
+	attributes := make(map[string][]string)
+	for _, claim := range claimNames {
+		if v := attributeValues(values[claim]); len(v) > 0 {
+			attributes[m[claim]] = append(attributes[m[claim]], v...)
+		}
+	}
+	return attributes, nil
+}
+
+// WriteMappedAttributes writes the identity attributes to which the claims are mapped with a signed update request to
+// the things endpoint, which AM must allow for the thing. The realm is optional and is the realm of the thing in AM.
+func WriteMappedAttributes(thing Thing, realm string, mapping AttributeMapping, claims interface{}) error {
+	attributes, err := mapping.Attributes(claims)
+	if err != nil || len(attributes) == 0 {
+		return err
+	}
+	update := make(map[string]interface{}, len(attributes))
+	for name, values := range attributes {
+		update[name] = values
+	}
+	_, err = UpdateAttributes(thing, realm, update)
+	return err
+}
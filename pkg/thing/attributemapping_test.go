@@ -0,0 +1,80 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package thing
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAttributeMapping_Attributes(t *testing.T) {
+	mapping := AttributeMapping{"serialNumber": "employeeNumber", "sensors": "sensorTypes", "model": "description",
+		"revision": "description", "location": "postalAddress", "secure": "secure"}
+	tests := []struct {
+		name       string
+		claims     interface{}
+		attributes map[string][]string
+		fails      bool
+	}{
+		{name: "struct", claims: struct {
+			SerialNumber string   `json:"serialNumber"`
+			Sensors      []string `json:"sensors"`
+			Unmapped     string   `json:"unmapped"`
+		}{"123", []string{"t", "h"}, "x"},
+			attributes: map[string][]string{"employeeNumber": {"123"}, "sensorTypes": {"t", "h"}}},
+		{name: "values", claims: map[string]interface{}{"model": "m1", "revision": 2, "secure": true,
+			"location": map[string]string{"site": "7"}, "serialNumber": nil},
+			attributes: map[string][]string{"description": {"m1", "2"}, "secure": {"true"},
+				"postalAddress": {`{"site":"7"}`}}},
+		{name: "not-an-object", claims: []string{"a"}, fails: true},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			attributes, err := mapping.Attributes(subtest.claims)
+			if subtest.fails {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(attributes, subtest.attributes) {
+				t.Errorf("expected %v; got %v", subtest.attributes, attributes)
+			}
+		})
+	}
+	if _, err := (AttributeMapping{"claim": ""}).Attributes(nil); err == nil {
+		t.Error("expected a mapping without an attribute name to be rejected")
+	}
+}
+
+func TestWriteMappedAttributes(t *testing.T) {
+	device := &signedRequestThing{}
+	err := WriteMappedAttributes(device, "/edge", AttributeMapping{"serialNumber": "employeeNumber"},
+		map[string]string{"serialNumber": "123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.path != "/json/things/*?_action=update&realm=%2Fedge" {
+		t.Errorf("unexpected path %s", device.path)
+	}
+	if !reflect.DeepEqual(device.body, map[string]interface{}{"employeeNumber": []string{"123"}}) {
+		t.Errorf("unexpected body %v", device.body)
+	}
+}
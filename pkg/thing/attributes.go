@@ -0,0 +1,186 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package thing
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// attributeTimeLayouts are the formats in which time attributes are parsed: RFC 3339 and the LDAP generalized time
+// used by AM for operational attributes such as createTimestamp
+var attributeTimeLayouts = []string{time.RFC3339Nano, "20060102150405Z0700"}
+
+// values returns the values of the attribute, the thing ID is returned by AM as a single value instead of an array
+func (a AttributesResponse) values(name string) ([]string, bool) {
+	switch value := a.Content[name].(type) {
+	case string:
+		return []string{value}, true
+	case []interface{}:
+		values, err := a.Content.GetStringArray(name)
+		return values, err == nil
+	default:
+		return nil, false
+	}
+}
+
+// Has returns true if the AttributesResponse contains the attribute.
+func (a AttributesResponse) Has(name string) bool {
+	_, ok := a.values(name)
+	return ok
+}
+
+// GetString returns the first value of the attribute. Returns false if the attribute is not present or has no values.
+func (a AttributesResponse) GetString(name string) (string, bool) {
+	values, ok := a.values(name)
+	if !ok || len(values) == 0 {
+		return "", false
+	}
+	return values[0], true
+}
+
+// GetStringSlice returns all the values of the attribute. Returns false if the attribute is not present.
+func (a AttributesResponse) GetStringSlice(name string) ([]string, bool) {
+	return a.values(name)
+}
+
+// GetTime returns the first value of the attribute as a time, the value must be in RFC 3339 or LDAP generalized time
+// format. Returns false if the attribute is not present or has no values and an error if the value is not a time.
+func (a AttributesResponse) GetTime(name string) (time.Time, bool, error) {
+	value, ok := a.GetString(name)
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	t, err := parseAttributeTime(value)
+	if err != nil {
+		return time.Time{}, true, fmt.Errorf("attribute `%s`: %w", name, err)
+	}
+	return t, true, nil
+}
+
+func parseAttributeTime(value string) (t time.Time, err error) {
+	for _, layout := range attributeTimeLayouts {
+		if t, err = time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return t, fmt.Errorf("`%s` is not an RFC 3339 or generalized time", value)
+}
+
+// Unmarshal stores the attributes in the struct pointed to by v. A field is mapped to the attribute named in its
+// attribute tag, or to the attribute with the name of the field if it has no tag, and is skipped if the tag is "-".
+// Fields of type []string receive all the values of the attribute while fields of type string, bool, time.Time and
+// the numeric types receive the first value. Fields of attributes that are not in the response are left unchanged.
+// For example:
+//
+//    var device struct {
+//        ID       string    `attribute:"_id"`
+//        Config   string    `attribute:"thingConfig"`
+//        Groups   []string  `attribute:"groups"`
+//        Created  time.Time `attribute:"createTimestamp"`
+//        Interval int       `attribute:"reportInterval"`
+//    }
+//    err := response.Unmarshal(&device)
+func (a AttributesResponse) Unmarshal(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return errors.New("attributes can only be unmarshalled into a pointer to a struct")
+	}
+	rv = rv.Elem()
+	for i := 0; i < rv.NumField(); i++ {
+		field := rv.Type().Field(i)
+		name := field.Name
+		if tag, ok := field.Tag.Lookup("attribute"); ok {
+			name = tag
+		}
+		if name == "-" || field.PkgPath != "" {
+			continue
+		}
+		values, ok := a.values(name)
+		if !ok {
+			continue
+		}
+		if err := setAttributeField(rv.Field(i), values); err != nil {
+			return fmt.Errorf("attribute `%s`: %w", name, err)
+		}
+	}
+	return nil
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// setAttributeField sets the field to the values of the attribute
+func setAttributeField(field reflect.Value, values []string) (err error) {
+	if field.Type() == reflect.TypeOf([]string{}) {
+		field.Set(reflect.ValueOf(values))
+		return nil
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	value := values[0]
+	if field.Type() == timeType {
+		t, err := parseAttributeTime(value)
+		if err == nil {
+			field.Set(reflect.ValueOf(t))
+		}
+		return err
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		var b bool
+		if b, err = strconv.ParseBool(value); err == nil {
+			field.SetBool(b)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var n int64
+		if n, err = strconv.ParseInt(value, 10, field.Type().Bits()); err == nil {
+			field.SetInt(n)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var n uint64
+		if n, err = strconv.ParseUint(value, 10, field.Type().Bits()); err == nil {
+			field.SetUint(n)
+		}
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		if f, err = strconv.ParseFloat(value, field.Type().Bits()); err == nil {
+			field.SetFloat(f)
+		}
+	default:
+		err = fmt.Errorf("unsupported field type %s", field.Type())
+	}
+	return err
+}
+
+// UpdateAttributes writes the attributes, usually with []string values, to the identity of the thing with a signed
+// update request to the things endpoint, which AM must allow for the thing. The realm is optional and is the realm of
+// the thing in AM. The reply of AM is returned unchanged.
+func UpdateAttributes(thing Thing, realm string, attributes map[string]interface{}) (reply []byte, err error) {
+	path := "/json/things/*?_action=update"
+	if realm != "" {
+		path += "&realm=" + url.QueryEscape(realm)
+	}
+	return thing.SignedRequest(http.MethodPut, path, attributes)
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package thing
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testAttributes() AttributesResponse {
+	return AttributesResponse{Content: JSONContent{
+		"_id":             "pump-1",
+		"thingConfig":     []interface{}{"host=localhost"},
+		"groups":          []interface{}{"pumps", "site-7"},
+		"empty":           []interface{}{},
+		"createTimestamp": []interface{}{"20200630120000Z"},
+		"lastSeen":        []interface{}{"2020-07-01T08:30:00.5+02:00"},
+		"reportInterval":  []interface{}{"60"},
+		"enabled":         []interface{}{"true"},
+		"malformed":       []interface{}{"yesterday"},
+	}}
+}
+
+func TestAttributesResponse_GetString(t *testing.T) {
+	attributes := testAttributes()
+	tests := []struct {
+		name     string
+		expected string
+		ok       bool
+	}{
+		{name: "_id", expected: "pump-1", ok: true},
+		{name: "thingConfig", expected: "host=localhost", ok: true},
+		{name: "groups", expected: "pumps", ok: true},
+		{name: "empty"},
+		{name: "missing"},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			value, ok := attributes.GetString(subtest.name)
+			if value != subtest.expected || ok != subtest.ok {
+				t.Errorf("expected %s, %v; got %s, %v", subtest.expected, subtest.ok, value, ok)
+			}
+		})
+	}
+	if !attributes.Has("empty") || attributes.Has("missing") {
+		t.Error("expected only the empty attribute to be present")
+	}
+	if groups, ok := attributes.GetStringSlice("groups"); !ok || !reflect.DeepEqual(groups, []string{"pumps", "site-7"}) {
+		t.Errorf("unexpected groups %v", groups)
+	}
+}
+
+func TestAttributesResponse_GetTime(t *testing.T) {
+	attributes := testAttributes()
+	tests := []struct {
+		name     string
+		expected time.Time
+		ok       bool
+		err      bool
+	}{
+		{name: "createTimestamp", expected: time.Date(2020, 6, 30, 12, 0, 0, 0, time.UTC), ok: true},
+		{name: "lastSeen", expected: time.Date(2020, 7, 1, 6, 30, 0, 5e8, time.UTC), ok: true},
+		{name: "malformed", ok: true, err: true},
+		{name: "missing"},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			value, ok, err := attributes.GetTime(subtest.name)
+			if (err != nil) != subtest.err || ok != subtest.ok {
+				t.Fatalf("expected ok %v and error %v; got %v, %v", subtest.ok, subtest.err, ok, err)
+			}
+			if !value.Equal(subtest.expected) {
+				t.Errorf("expected %v; got %v", subtest.expected, value)
+			}
+		})
+	}
+}
+
+func TestAttributesResponse_Unmarshal(t *testing.T) {
+	var device struct {
+		ID       string    `attribute:"_id"`
+		Config   string    `attribute:"thingConfig"`
+		Groups   []string  `attribute:"groups"`
+		Created  time.Time `attribute:"createTimestamp"`
+		Interval uint16    `attribute:"reportInterval"`
+		Enabled  bool      `attribute:"enabled"`
+		Missing  string    `attribute:"missing"`
+		Ignored  string    `attribute:"-"`
+		empty    []string
+	}
+	device.Missing = "default"
+	if err := testAttributes().Unmarshal(&device); err != nil {
+		t.Fatal(err)
+	}
+	if device.ID != "pump-1" || device.Config != "host=localhost" || len(device.Groups) != 2 ||
+		device.Created.Year() != 2020 || device.Interval != 60 || !device.Enabled || device.Missing != "default" ||
+		device.Ignored != "" || device.empty != nil {
+		t.Errorf("unexpected device %+v", device)
+	}
+
+	var malformed struct {
+		Interval int `attribute:"malformed"`
+	}
+	if err := testAttributes().Unmarshal(&malformed); err == nil {
+		t.Error("expected an error for a malformed number")
+	}
+	if err := testAttributes().Unmarshal(device); err == nil {
+		t.Error("expected an error for a struct value")
+	}
+}
+
+func TestUpdateAttributes(t *testing.T) {
+	device := &signedRequestThing{}
+	attributes := map[string]interface{}{"thingConfig": []string{"host=localhost"}}
+	if _, err := UpdateAttributes(device, "/iot&edge", attributes); err != nil {
+		t.Fatal(err)
+	}
+	if device.path != "/json/things/*?_action=update&realm=%2Fiot%26edge" {
+		t.Errorf("unexpected path %s", device.path)
+	}
+	if !reflect.DeepEqual(device.body, attributes) {
+		t.Errorf("unexpected body %v", device.body)
+	}
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package thing
+
+import (
+	"encoding/json"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/JacoJooste/iot-edge/v7/internal/jws"
+)
+
+// sdkModule is the path of the SDK module, used to find its version in the build information of the binary
+const sdkModule = "github.com/JacoJooste/iot-edge/v7"
+
+// DefaultCapabilitiesAttribute is the attribute of the thing to which Capabilities.Publish writes the capabilities if
+// no attribute is given
+const DefaultCapabilitiesAttribute = "thingCapabilities"
+
+// Capabilities is a structured self-description of the build of the SDK in which a thing runs, so that fleet operators
+// can query what each deployed firmware build is capable of.
+type Capabilities struct {
+	// SDKVersion is the version of the SDK module, empty if the binary was built without module information
+	SDKVersion string `json:"sdkVersion,omitempty"`
+	// GoVersion is the version of Go with which the binary was built
+	GoVersion string `json:"goVersion"`
+	// Platform is the operating system and architecture of the binary, for example linux/arm
+	Platform string `json:"platform"`
+	// Profile is the build profile, tiny or standard
+	Profile string `json:"profile"`
+	// Schemes are the URL schemes with which the thing can connect, including those of registered transports
+	Schemes []string `json:"schemes"`
+	// Algorithms are the JWS algorithms with which the thing can sign
+	Algorithms []string `json:"algorithms"`
+	// Curves are the curves of the elliptic curve keys with which the thing can sign
+	Curves []string `json:"curves"`
+	// ContentTypes are the content types of the registered payload codecs
+	ContentTypes []string `json:"contentTypes"`
+	// APIVersions are the versions of the AM endpoints that the SDK supports by endpoint, empty if the build can not
+	// connect to AM directly
+	APIVersions map[string][]string `json:"apiVersions,omitempty"`
+}
+
+// ReportCapabilities describes the capabilities of the build of the SDK in which the thing runs
+func ReportCapabilities() Capabilities {
+	c := Capabilities{
+		GoVersion:    runtime.Version(),
+		Platform:     runtime.GOOS + "/" + runtime.GOARCH,
+		Profile:      buildProfile,
+		Schemes:      client.Schemes(),
+		Curves:       jws.Curves(),
+		ContentTypes: client.ContentTypes(),
+		APIVersions:  client.APIVersions(),
+	}
+	for _, alg := range jws.Algorithms() {
+		c.Algorithms = append(c.Algorithms, string(alg))
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if info.Main.Path == sdkModule {
+			c.SDKVersion = info.Main.Version
+		}
+		for _, dep := range info.Deps {
+			if dep.Path == sdkModule {
+				c.SDKVersion = dep.Version
+			}
+		}
+	}
+	return c
+}
+
+// Publish writes the capabilities as JSON to the attribute of the thing with a signed update request to the things
+// endpoint, which AM must allow for the thing. The realm is optional and is the realm of the thing in AM.
+func (c Capabilities) Publish(thing Thing, realm string, attribute string) error {
+	if attribute == "" {
+		attribute = DefaultCapabilitiesAttribute
+	}
+	value, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	_, err = UpdateAttributes(thing, realm, map[string]interface{}{
+		attribute: []string{string(value)},
+	})
+	return err
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package thing
+
+import (
+	"encoding/json"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+// signedRequestThing records the signed requests of a thing
+type signedRequestThing struct {
+	Thing
+	path string
+	body interface{}
+}
+
+func (t *signedRequestThing) SignedRequest(method string, path string, body interface{}) ([]byte, error) {
+	t.path, t.body = path, body
+	return nil, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func TestReportCapabilities(t *testing.T) {
+	c := ReportCapabilities()
+	if c.Profile != "standard" || c.GoVersion != runtime.Version() || c.Platform != runtime.GOOS+"/"+runtime.GOARCH {
+		t.Errorf("unexpected build %+v", c)
+	}
+	for _, scheme := range []string{"http", "https", "coap", "coaps", "coap+tcp", "coaps+tcp"} {
+		if !contains(c.Schemes, scheme) {
+			t.Errorf("expected scheme %s in %v", scheme, c.Schemes)
+		}
+	}
+	for _, alg := range []string{"ES256", "ES256K", "EdDSA", "PS256"} {
+		if !contains(c.Algorithms, alg) {
+			t.Errorf("expected algorithm %s in %v", alg, c.Algorithms)
+		}
+	}
+	if !contains(c.Curves, "Ed448") || !contains(c.Curves, "secp256k1") {
+		t.Errorf("unexpected curves %v", c.Curves)
+	}
+	if !contains(c.ContentTypes, "application/json") {
+		t.Errorf("expected the JSON codec in %v", c.ContentTypes)
+	}
+	if len(c.APIVersions["things"]) == 0 || len(c.APIVersions["authenticate"]) == 0 {
+		t.Errorf("expected the versions of the AM endpoints; got %v", c.APIVersions)
+	}
+}
+
+func TestCapabilities_Publish(t *testing.T) {
+	tests := []struct {
+		name      string
+		realm     string
+		attribute string
+		path      string
+		published string
+	}{
+		{name: "default", path: "/json/things/*?_action=update", published: DefaultCapabilitiesAttribute},
+		{name: "realm", realm: "/things", attribute: "firmware", published: "firmware",
+			path: "/json/things/*?_action=update&realm=%2Fthings"},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			c := ReportCapabilities()
+			device := &signedRequestThing{}
+			if err := c.Publish(device, subtest.realm, subtest.attribute); err != nil {
+				t.Fatal(err)
+			}
+			if device.path != subtest.path {
+				t.Errorf("expected path %s; got %s", subtest.path, device.path)
+			}
+			values, _ := device.body.(map[string]interface{})[subtest.published].([]string)
+			var published Capabilities
+			if len(values) != 1 || json.Unmarshal([]byte(values[0]), &published) != nil ||
+				!reflect.DeepEqual(published, c) {
+				t.Errorf("expected the capabilities in %s; got %v", subtest.published, device.body)
+			}
+		})
+	}
+}
@@ -59,4 +59,10 @@
 //        }
 //    })
 //
+// Things that are not issued a certificate during manufacturing can instead prove possession of a pre-shared key
+// that was provisioned in the factory and is known to the registration tree:
+//
+//    RegisterThing(nil, nil).
+//    WithPreSharedKey("factory-line-7", presharedKey)
+//
 package thing
@@ -0,0 +1,123 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package thing
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+	"github.com/JacoJooste/iot-edge/v7/internal/jws"
+	"github.com/JacoJooste/iot-edge/v7/pkg/callback"
+)
+
+// Errors returned by a Thing belong to one of the following classes. Use errors.Is to determine the class of an
+// error, for example:
+//
+//    if errors.Is(err, thing.ErrAMUnreachable) {
+//        // retry later
+//    }
+var (
+	// ErrUnauthorised indicates that AM rejected the credentials or the session of the thing.
+	ErrUnauthorised = client.ErrUnauthorised
+
+	// ErrForbidden indicates that the thing is authenticated but is not allowed to perform the request.
+	ErrForbidden = client.ErrForbidden
+
+	// ErrAMUnreachable indicates that AM, or the Thing Gateway, could not be reached or did not respond in time.
+	ErrAMUnreachable = client.ErrAMUnreachable
+
+	// ErrPayloadInvalid indicates that the request or the response payload was malformed.
+	ErrPayloadInvalid = client.ErrPayloadInvalid
+
+	// ErrThrottled indicates that AM rejected the request because the thing has made too many requests.
+	ErrThrottled = client.ErrThrottled
+
+	// ErrUnsupportedVersion indicates that AM does not support any version of the endpoint that the SDK supports.
+	ErrUnsupportedVersion = client.ErrUnsupportedVersion
+
+	// ErrUnsupportedContent indicates that the Thing Gateway does not accept the format of the request. A gateway may
+	// require requests to be signed, which is only possible with a proof-of-possession session.
+	ErrUnsupportedContent = client.ErrUnsupportedContent
+
+	// ErrPayloadTooLarge indicates that a request or response payload exceeded the size limit of the thing or of the
+	// Thing Gateway, see Builder.WithMaxPayloadSize.
+	ErrPayloadTooLarge = client.ErrPayloadTooLarge
+
+	// ErrUnsupportedAlgorithm indicates that the key of the thing signs with an algorithm that is not supported by the
+	// SDK or by AM.
+	ErrUnsupportedAlgorithm = jws.ErrUnsupportedAlgorithm
+
+	// ErrClaimDenied indicates that the user rejected the claim of the thing, see Thing.Claim.
+	ErrClaimDenied = errors.New("claim denied")
+
+	// ErrClaimExpired indicates that the claim code expired before a user approved the claim of the thing.
+	ErrClaimExpired = errors.New("claim code expired")
+)
+
+// SuspendedError is returned by Builder.Create when the authentication tree is suspended while it waits for an
+// external event, see Builder.SuspendAuthentication. Use errors.As to retrieve it from an error.
+type SuspendedError = callback.SuspendedError
+
+// AMError contains the error code, reason, message and detail returned by AM, together with the language of the message
+// if AM localised it for the locale of the thing, see Builder.WithLocale. Use errors.As to retrieve it from an error
+// returned by a Thing.
+type AMError = client.AMError
+
+// ConfigError is returned by Builder.Validate and Builder.Create when the configuration of the thing is invalid. It
+// contains all the problems that were found. Use errors.As to retrieve it from an error. errors.Is and errors.As also
+// match any of the problems, for example ErrUnsupportedAlgorithm or an AttributeError.
+type ConfigError = client.ConfigError
+
+// AttributeError is returned when attributes are requested with selectors that are malformed or that do not match
+// any attribute in the attribute schema of the thing, see Builder.WithAttributeSchema. The request is not sent to AM.
+// The error belongs to the ErrPayloadInvalid class and can be retrieved with errors.As, for example:
+//
+//    var attributeErr thing.AttributeError
+//    if errors.As(err, &attributeErr) {
+//        // correct attributeErr.Unknown
+//    }
+type AttributeError struct {
+	// Unknown contains the selectors that do not match any attribute in the schema
+	Unknown []string
+	// Invalid contains the selectors that are malformed
+	Invalid []string
+}
+
+func (e AttributeError) Error() string {
+	var reasons []string
+	if len(e.Unknown) > 0 {
+		reasons = append(reasons, fmt.Sprintf("unknown attributes %v", e.Unknown))
+	}
+	if len(e.Invalid) > 0 {
+		reasons = append(reasons, fmt.Sprintf("invalid selectors %v", e.Invalid))
+	}
+	return strings.Join(reasons, ", ")
+}
+
+// Unwrap returns the class of the error
+func (e AttributeError) Unwrap() error {
+	return ErrPayloadInvalid
+}
+
+// RetryAfter returns the delay requested by AM before a throttled or rejected request may be repeated. Returns false
+// if the error was not caused by throttling or if AM did not specify a delay.
+func RetryAfter(err error) (time.Duration, bool) {
+	return client.RetryAfter(err)
+}
@@ -19,6 +19,7 @@ package thing
 import (
 	"fmt"
 	"strings"
+	"time"
 )
 
 // JSONContent holds dynamic JSON data
@@ -85,7 +86,125 @@ func (a AccessTokenResponse) Scope() ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
-	return strings.Split(scope, " "), nil
+	return strings.Fields(scope), nil
+}
+
+// ScopeMatch describes how the scopes granted in an AccessTokenResponse compare to the scopes that were requested.
+type ScopeMatch int
+
+const (
+	// ScopeExact indicates that AM granted exactly the requested scopes.
+	ScopeExact ScopeMatch = iota
+	// ScopeDowngraded indicates that AM granted only some of the requested scopes.
+	ScopeDowngraded
+	// ScopeExtended indicates that AM granted all the requested scopes as well as additional scopes, for example the
+	// default scopes granted when no scopes are requested.
+	ScopeExtended
+	// ScopeDifferent indicates that AM did not grant some of the requested scopes and granted other scopes instead.
+	ScopeDifferent
+)
+
+func (m ScopeMatch) String() string {
+	switch m {
+	case ScopeExact:
+		return "exact"
+	case ScopeDowngraded:
+		return "downgraded"
+	case ScopeExtended:
+		return "extended"
+	case ScopeDifferent:
+		return "different"
+	default:
+		return fmt.Sprintf("ScopeMatch(%d)", int(m))
+	}
+}
+
+// HasScope returns true if the access token contained in an AccessTokenResponse was granted the scope.
+func (a AccessTokenResponse) HasScope(scope string) bool {
+	granted, err := a.Scope()
+	if err != nil {
+		return false
+	}
+	for _, s := range granted {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// MissingScopes returns the requested scopes that were not granted to the access token contained in an
+// AccessTokenResponse.
+func (a AccessTokenResponse) MissingScopes(requested ...string) ([]string, error) {
+	granted, err := a.Scope()
+	if err != nil {
+		return nil, err
+	}
+	return scopeDifference(requested, granted), nil
+}
+
+// CompareScopes compares the scopes granted to the access token contained in an AccessTokenResponse with the
+// requested scopes. The order and repetition of scopes are ignored. Use it to detect when AM downgrades a grant:
+//
+//    match, err := response.CompareScopes("publish", "subscribe")
+//    if err == nil && match == thing.ScopeDowngraded {
+//        // disable the features that require the missing scopes
+//    }
+func (a AccessTokenResponse) CompareScopes(requested ...string) (ScopeMatch, error) {
+	granted, err := a.Scope()
+	if err != nil {
+		return ScopeDifferent, err
+	}
+	missing := len(scopeDifference(requested, granted)) > 0
+	extra := len(scopeDifference(granted, requested)) > 0
+	switch {
+	case missing && extra:
+		return ScopeDifferent, nil
+	case missing:
+		return ScopeDowngraded, nil
+	case extra:
+		return ScopeExtended, nil
+	default:
+		return ScopeExact, nil
+	}
+}
+
+// scopeDifference returns the scopes in a that are not in b, without duplicates.
+func scopeDifference(a, b []string) []string {
+	exclude := make(map[string]bool, len(b))
+	for _, s := range b {
+		exclude[s] = true
+	}
+	var difference []string
+	for _, s := range a {
+		if !exclude[s] {
+			difference = append(difference, s)
+			exclude[s] = true
+		}
+	}
+	return difference
+}
+
+// SessionInfo describes the session of a thing with AM.
+type SessionInfo struct {
+	// Token is the SSO session token. It grants access to AM on behalf of the thing and must be kept secret.
+	Token string
+
+	// Restricted is true if the session is a restricted proof of possession session, in which case AM only accepts
+	// requests that are signed with the thing's key.
+	Restricted bool
+
+	// MaxIdleExpiration is the time at which the session will expire if it is not used.
+	// The time is zero if AM did not provide it.
+	MaxIdleExpiration time.Time
+
+	// MaxSessionExpiration is the time at which the session will expire regardless of use.
+	// The time is zero if AM did not provide it.
+	MaxSessionExpiration time.Time
+
+	// Realm is the fully qualified path of the realm of the session, as resolved by AM from the realm alias or the DNS
+	// alias used to connect. The realm is empty if AM did not provide it.
+	Realm string
 }
 
 // AttributesResponse contains the response received from AM after a successful request for thing attributes.
@@ -99,6 +218,8 @@ func (a AccessTokenResponse) Scope() ([]string, error) {
 //    }
 type AttributesResponse struct {
 	Content JSONContent
+	// Revision identifies the version of the attributes returned by Thing.RequestAttributesIfChanged
+	Revision string
 }
 
 // ID returns the thing's ID contained in an AttributesResponse.
@@ -127,6 +248,92 @@ func (i IntrospectionResponse) Active() bool {
 	return active
 }
 
+// PolicyDecisionResponse contains the decision received from AM after a policy evaluation request for a resource,
+// for example:
+//
+//    {
+//        "resource": "valve-x",
+//        "actions": {"open": true, "close": false},
+//        "attributes": {},
+//        "advices": {},
+//        "ttl": 9223372036854775807
+//    }
+type PolicyDecisionResponse struct {
+	Content JSONContent
+	// RequestedActions holds the actions that were specified in the policy decision request
+	RequestedActions []string
+}
+
+// Resource returns the resource that the decision applies to.
+func (p PolicyDecisionResponse) Resource() (string, error) {
+	return p.Content.GetString("resource")
+}
+
+// Action returns true if the policy decision allows the action on the resource.
+func (p PolicyDecisionResponse) Action(name string) (bool, error) {
+	actions, ok := p.Content["actions"].(map[string]interface{})
+	if !ok {
+		return false, readError{key: "actions"}
+	}
+	return JSONContent(actions).GetBool(name)
+}
+
+// Allowed returns true if the policy decision allows all the requested actions on the resource.
+// An action that is missing from the decision is not allowed and false is returned if no actions were requested.
+func (p PolicyDecisionResponse) Allowed() bool {
+	if len(p.RequestedActions) == 0 {
+		return false
+	}
+	for _, action := range p.RequestedActions {
+		if allowed, err := p.Action(action); err != nil || !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// OwnerAttribute is the attribute of a thing in which the ID of the user that claimed the thing is stored
+const OwnerAttribute = "thingOwner"
+
+// defaultClaimInterval is the time between polls of the status of a claim if AM does not provide an interval
+const defaultClaimInterval = 5 * time.Second
+
+// ClaimResponse contains the claim code of a thing and how to use it, for example:
+//
+//    {
+//        "claim_code": "WDJB-MJHT",
+//        "verification_uri": "https://am.example.com/am/XUI/?realm=/&authIndexType=service&authIndexValue=claim",
+//        "expires_in": 600,
+//        "interval": 5
+//    }
+type ClaimResponse struct {
+	Content JSONContent
+}
+
+// Code returns the code that the user enters to approve the claim.
+func (c ClaimResponse) Code() (string, error) {
+	return c.Content.GetString("claim_code")
+}
+
+// VerificationURI returns the URI at which the user approves the claim.
+func (c ClaimResponse) VerificationURI() (string, error) {
+	return c.Content.GetString("verification_uri")
+}
+
+// ExpiresIn returns the lifetime in seconds of the claim code.
+func (c ClaimResponse) ExpiresIn() (float64, error) {
+	return c.Content.GetNumber("expires_in")
+}
+
+// Interval returns the time between polls of the status of the claim, five seconds if AM does not provide one.
+func (c ClaimResponse) Interval() time.Duration {
+	interval, err := c.Content.GetNumber("interval")
+	if err != nil || interval <= 0 {
+		return defaultClaimInterval
+	}
+	return time.Duration(interval * float64(time.Second))
+}
+
 type readError struct {
 	key string
 }
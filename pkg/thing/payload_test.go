@@ -149,3 +149,90 @@ func TestJSONContent_GetStringArray(t *testing.T) {
 		})
 	}
 }
+
+func TestPolicyDecisionResponse_Allowed(t *testing.T) {
+	content := JSONContent{
+		"resource": "valve-x",
+		"actions":  map[string]interface{}{"open": true, "close": false},
+	}
+	tests := []struct {
+		name     string
+		content  JSONContent
+		actions  []string
+		expected bool
+	}{
+		{name: "allowed", content: content, actions: []string{"open"}, expected: true},
+		{name: "denied", content: content, actions: []string{"close"}},
+		{name: "partially-denied", content: content, actions: []string{"open", "close"}},
+		{name: "missing-action", content: content, actions: []string{"drain"}},
+		{name: "no-actions-requested", content: content},
+		{name: "no-actions-in-decision", content: JSONContent{"resource": "valve-x"}, actions: []string{"open"}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			response := PolicyDecisionResponse{Content: subtest.content, RequestedActions: subtest.actions}
+			if response.Allowed() != subtest.expected {
+				t.Errorf("expected %v; got %v", subtest.expected, response.Allowed())
+			}
+		})
+	}
+}
+
+func TestAccessTokenResponse_CompareScopes(t *testing.T) {
+	tests := []struct {
+		name      string
+		granted   string
+		requested []string
+		expected  ScopeMatch
+		missing   []string
+	}{
+		{name: "exact", granted: "publish subscribe", requested: []string{"subscribe", "publish"}, expected: ScopeExact},
+		{name: "subset", granted: "publish", requested: []string{"publish"}, expected: ScopeExact},
+		{name: "duplicates", granted: "publish", requested: []string{"publish", "publish"}, expected: ScopeExact},
+		{name: "downgraded", granted: "publish", requested: []string{"publish", "subscribe"},
+			expected: ScopeDowngraded, missing: []string{"subscribe"}},
+		{name: "defaults", granted: "publish subscribe", expected: ScopeExtended},
+		{name: "different", granted: "publish", requested: []string{"delete"},
+			expected: ScopeDifferent, missing: []string{"delete"}},
+		{name: "none-granted", granted: "", requested: []string{"publish"},
+			expected: ScopeDowngraded, missing: []string{"publish"}},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			response := AccessTokenResponse{Content: JSONContent{"scope": subtest.granted}}
+			match, err := response.CompareScopes(subtest.requested...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if match != subtest.expected {
+				t.Errorf("expected %v; got %v", subtest.expected, match)
+			}
+			missing, err := response.MissingScopes(subtest.requested...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(missing, subtest.missing) {
+				t.Errorf("expected missing %v; got %v", subtest.missing, missing)
+			}
+			isMissing := make(map[string]bool)
+			for _, s := range missing {
+				isMissing[s] = true
+			}
+			for _, s := range subtest.requested {
+				if response.HasScope(s) == isMissing[s] {
+					t.Errorf("expected HasScope(%s) to be %v", s, !isMissing[s])
+				}
+			}
+		})
+	}
+}
+
+func TestAccessTokenResponse_CompareScopes_NoScope(t *testing.T) {
+	response := AccessTokenResponse{Content: JSONContent{}}
+	if _, err := response.CompareScopes("publish"); err == nil {
+		t.Error("expected an error")
+	}
+	if response.HasScope("publish") {
+		t.Error("expected scope to be missing")
+	}
+}
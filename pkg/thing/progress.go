@@ -0,0 +1,46 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package thing
+
+import "time"
+
+// Steps of the flows of a thing that are reported to Hooks.OnProgress
+const (
+	// StepAuthenticating is reported for every round trip of the authentication tree that authenticates the thing
+	StepAuthenticating = "authenticating"
+	// StepRegistering is reported for a round trip of the authentication tree that registers the thing
+	StepRegistering = "registering"
+	// StepWaitingForApproval is reported when the authentication tree waits for an external event, for example an
+	// operator approving the thing
+	StepWaitingForApproval = "waiting_for_approval"
+	// StepAuthenticated is reported when the thing has authenticated and a session has been created
+	StepAuthenticated = "authenticated"
+	// StepRequestingAccessToken is reported for every attempt to request an access token
+	StepRequestingAccessToken = "requesting_access_token"
+	// StepThrottled is reported when the thing waits before it repeats a request that AM throttled
+	StepThrottled = "throttled"
+)
+
+// Progress describes a step of a long-running flow of a thing, such as its creation or a token request
+type Progress struct {
+	// Step is the name of the step, for example StepRegistering
+	Step string
+	// Attempt counts the times that the step has been reported during the flow, starting at 1
+	Attempt int
+	// Elapsed is the time since the flow started
+	Elapsed time.Duration
+}
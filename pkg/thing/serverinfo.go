@@ -0,0 +1,92 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package thing
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
+)
+
+// GatewayProtocolVersion is the version of the protocol between things and the Thing Gateway that the SDK speaks
+const GatewayProtocolVersion = client.GatewayProtocolVersion
+
+var (
+	// ErrClockSkew indicates that the clock of the device is too far from the clock of the server for the JWTs signed
+	// by the thing to be accepted, see Builder.WithClock.
+	ErrClockSkew = errors.New("device clock is out of sync with the server")
+
+	// ErrIncompatibleProtocol indicates that the Thing Gateway speaks a version of the protocol that the SDK does not.
+	ErrIncompatibleProtocol = errors.New("incompatible Thing Gateway protocol version")
+)
+
+// ServerInfo contains the information that the Thing Gateway reports about itself, see DiscoverServerInfo
+type ServerInfo struct {
+	// Time of the gateway when it handled the request
+	Time time.Time
+	// ClockOffset is the estimated offset of the gateway clock from the device clock
+	ClockOffset time.Duration
+	// Realm in which the gateway authenticates things
+	Realm string
+	// ContentTypes are the content types of the payloads that the gateway accepts, see Builder.WithCodec
+	ContentTypes []string
+	// ProtocolVersion is the version of the protocol between things and the gateway, see GatewayProtocolVersion
+	ProtocolVersion int
+	// ThingsVersion is the version of the AM things endpoint that the gateway uses
+	ThingsVersion string
+}
+
+// Check returns ErrClockSkew if the clock offset exceeds the maximum, if the maximum is positive, and
+// ErrIncompatibleProtocol if the gateway speaks a different version of the protocol
+func (i ServerInfo) Check(maxClockOffset time.Duration) error {
+	if i.ProtocolVersion != GatewayProtocolVersion {
+		return fmt.Errorf("%w: gateway %d, SDK %d", ErrIncompatibleProtocol, i.ProtocolVersion,
+			GatewayProtocolVersion)
+	}
+	if offset := i.ClockOffset; maxClockOffset > 0 && (offset > maxClockOffset || -offset > maxClockOffset) {
+		return fmt.Errorf("%w by %v", ErrClockSkew, offset)
+	}
+	return nil
+}
+
+// DiscoverServerInfo requests information about the Thing Gateway at the URL without authenticating, so that a thing
+// can check its clock and the compatibility of the gateway before it signs anything. AM does not report server
+// information.
+func DiscoverServerInfo(baseURL *url.URL, timeout time.Duration) (ServerInfo, error) {
+	connection, err := client.NewConnection().
+		ConnectTo(baseURL).
+		TimeoutRequestAfter(timeout).
+		Create()
+	if err != nil {
+		return ServerInfo{}, err
+	}
+	payload, offset, err := client.RequestServerInfo(connection)
+	if err != nil {
+		return ServerInfo{}, err
+	}
+	return ServerInfo{
+		Time:            time.Unix(0, payload.Time*int64(time.Millisecond)),
+		ClockOffset:     offset,
+		Realm:           payload.Realm,
+		ContentTypes:    payload.ContentTypes,
+		ProtocolVersion: payload.ProtocolVersion,
+		ThingsVersion:   payload.ThingsVersion,
+	}, nil
+}
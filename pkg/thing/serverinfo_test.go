@@ -0,0 +1,49 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package thing
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestServerInfo_Check(t *testing.T) {
+	tests := []struct {
+		name      string
+		info      ServerInfo
+		maxOffset time.Duration
+		err       error
+	}{
+		{name: "compatible", info: ServerInfo{ProtocolVersion: GatewayProtocolVersion, ClockOffset: time.Second},
+			maxOffset: time.Minute},
+		{name: "ahead", info: ServerInfo{ProtocolVersion: GatewayProtocolVersion, ClockOffset: time.Hour},
+			maxOffset: time.Minute, err: ErrClockSkew},
+		{name: "behind", info: ServerInfo{ProtocolVersion: GatewayProtocolVersion, ClockOffset: -time.Hour},
+			maxOffset: time.Minute, err: ErrClockSkew},
+		{name: "unchecked-clock", info: ServerInfo{ProtocolVersion: GatewayProtocolVersion, ClockOffset: time.Hour}},
+		{name: "incompatible", info: ServerInfo{ProtocolVersion: GatewayProtocolVersion + 1},
+			err: ErrIncompatibleProtocol},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			if err := subtest.info.Check(subtest.maxOffset); !errors.Is(err, subtest.err) {
+				t.Errorf("expected %v; got %v", subtest.err, err)
+			}
+		})
+	}
+}
@@ -18,15 +18,23 @@ package thing
 
 import (
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/x509"
 	"encoding/base64"
+	"fmt"
 	"log"
 	"net/url"
 	"time"
 
+	"github.com/JacoJooste/iot-edge/v7/internal/client"
 	"github.com/JacoJooste/iot-edge/v7/internal/debug"
 	"github.com/JacoJooste/iot-edge/v7/internal/jws"
+	"github.com/JacoJooste/iot-edge/v7/internal/secp256k1"
 	"github.com/JacoJooste/iot-edge/v7/pkg/callback"
+	"github.com/cloudflare/circl/sign/ed448"
 	"gopkg.in/square/go-jose.v2"
 )
 
@@ -45,6 +53,57 @@ func SetDebugLogger(logger *log.Logger) {
 	}
 }
 
+// DebugLevel is the level of detail of the SDK debug information
+type DebugLevel = debug.Level
+
+const (
+	// DebugError only writes failures
+	DebugError = debug.LevelError
+	// DebugInfo writes failures and changes in state
+	DebugInfo = debug.LevelInfo
+	// DebugTrace writes all debug information, including the messages exchanged with AM and the Thing Gateway. This is
+	// the default level.
+	DebugTrace = debug.LevelTrace
+)
+
+// SetDebugLevel sets the default level of detail of the SDK debug information, see Builder.WithDebugLevel to set the
+// level of a single thing
+func SetDebugLevel(level DebugLevel) {
+	debug.SetLevel(level)
+}
+
+// SetDebugRedaction switches the redaction of session tokens, access tokens and signed JWT payloads in the SDK debug
+// information on or off. Redaction is on by default and should only be switched off while debugging in a secure
+// environment. See Builder.WithDebugRedaction to set the redaction of a single thing.
+func SetDebugRedaction(enabled bool) {
+	debug.SetRedaction(enabled)
+}
+
+// Hooks are called by the Thing on state transitions so that the application can, for example, persist state, update
+// indicators or emit telemetry without polling the Thing. Any of the hooks may be nil. The hooks are called
+// synchronously on the goroutine that caused the transition and should therefore not block or call the Thing.
+type Hooks struct {
+	// OnAuthenticated is called when the thing has authenticated with AM and a new session has been created, including
+	// when a session is renewed.
+	OnAuthenticated func()
+
+	// OnSessionExpired is called when the session of the thing is found to be no longer valid, before the thing
+	// authenticates again.
+	OnSessionExpired func()
+
+	// OnTokenIssued is called when an access token has been issued to the thing.
+	OnTokenIssued func(response AccessTokenResponse)
+
+	// OnRegistration is called when the thing has been registered by the registration tree, before OnAuthenticated is
+	// called for the session created by the registration.
+	OnRegistration func()
+
+	// OnProgress is called at every step of a long-running flow, such as the creation of the thing, which can take
+	// many round trips to register and authenticate, or an access token request, so that a device UI or a
+	// commissioning tool can show the status of the flow.
+	OnProgress func(progress Progress)
+}
+
 // Thing represents a device or a service with a digital identity in the ForgeRock Identity Platform.
 type Thing interface {
 
@@ -53,25 +112,155 @@ type Thing interface {
 	// will include the default scopes configured in the OAuth 2.0 Client.
 	RequestAccessToken(scopes ...string) (response AccessTokenResponse, err error)
 
+	// RequestIdempotentAccessToken requests an access token in the same way as RequestAccessToken but identifies the
+	// request with the idempotency key. If the request is repeated with the same key, for example after a timeout, the
+	// Thing Gateway returns the token issued to the attempt that completed instead of requesting another token from AM.
+	// The key must be unique to the request, see NewIdempotencyKey. The key is ignored by connections to AM.
+	RequestIdempotentAccessToken(key string, scopes ...string) (response AccessTokenResponse, err error)
+
+	// RequestChildAccessToken requests an OAuth 2.0 access token whose subject is a child thing, such as a device that
+	// is proxied by a gateway, so that services receiving the token see the identity of the child. The request is made
+	// with the session of this thing and contains an identity assertion for the child, signed with the key provided to
+	// AuthenticateThing. AM must be configured to issue tokens for the subject of the assertion, see the
+	// documentation for details.
+	RequestChildAccessToken(childID string, scopes ...string) (response AccessTokenResponse, err error)
+
+	// Impersonate returns the operations that a service, see Builder.AsService, can perform on behalf of the thing with
+	// the given ID, such as reading its attributes, so that a backend service does not need the keys of every thing.
+	// The service authenticates as the thing with the key provided to AuthenticateThing and names itself as the actor
+	// in the act claim of the authentication JWT. The key of the service must be registered for the thing and the
+	// tree of the connection must run the impersonation script, which checks the actor and records it in the AM audit
+	// log, see the documentation for details.
+	Impersonate(thingID string) (impersonation Impersonation, err error)
+
+	// RequestGroupAccessToken requests an OAuth 2.0 access token for the AM group with the given ID, of which the thing
+	// must be a member, so that resource servers can authorise a fleet of things with the group claims in the token.
+	// AM must be configured to add the group claims to the token, see the documentation for details.
+	RequestGroupAccessToken(group string, scopes ...string) (response AccessTokenResponse, err error)
+
+	// RequestLocalAccessToken requests an access token for a site-local service from the Thing Gateway instead of AM,
+	// so that the service can authorise the thing while the gateway is unable to reach AM. The token is signed by the
+	// gateway and the audience must be one of the services configured on the gateway. If the audience is empty then the
+	// gateway selects its only configured service. Only supported by connections to a Thing Gateway that issues local
+	// tokens.
+	RequestLocalAccessToken(audience string, scopes ...string) (response AccessTokenResponse, err error)
+
 	// IntrospectAccessToken introspects an OAuth 2.0 access token for a thing as defined by rfc7662.
 	// Supports only client-based OAuth 2.0 tokens signed with an asymmetric key.
 	IntrospectAccessToken(token string) (introspection IntrospectionResponse, err error)
 
 	// RequestAttributes requests the attributes with the specified names associated with the thing's identity.
-	// If no names are specified then all the allowed attributes will be returned.
+	// If no names are specified then all the allowed attributes will be returned. Nested attributes are selected with
+	// paths separated by '/', for example "location/building", and path segments may contain the wildcards supported
+	// by path.Match, for example "location/*". Only the selected attributes, and the thing ID, are returned.
+	// Names are validated against the attribute schema of the thing, if provided, and an AttributeError is returned
+	// for unknown attributes.
 	RequestAttributes(names ...string) (response AttributesResponse, err error)
 
+	// RequestAttributesIfChanged requests the attributes with the specified names, as RequestAttributes does, unless
+	// they have not changed since the given revision, which is the Revision of a previous response. If the attributes
+	// have not changed then changed is false and the response is empty, which saves the bandwidth of things that poll
+	// their configuration. An empty revision always returns the attributes. AM and the Thing Gateway reply without the
+	// attributes if they have not changed, while other connections compare the revision of the attributes they read.
+	RequestAttributesIfChanged(revision string, names ...string) (response AttributesResponse, changed bool,
+		err error)
+
+	// RequestGroupAttributes requests the attributes with the specified names of the AM group with the given ID, such
+	// as configuration shared by a fleet of things. If no names are specified then all the attributes that the thing
+	// is allowed to read will be returned. The thing must be allowed to read the group in AM.
+	RequestGroupAttributes(group string, names ...string) (response AttributesResponse, err error)
+
+	// IterateAttributes requests the attributes with the specified names in pages of at most pageSize attributes and
+	// calls visit with each page in turn, so that a thing with a large number of attributes never holds all of them in
+	// memory. Iteration stops when visit returns an error, which is then returned. Attributes whose names start with
+	// an underscore, such as the ID of the thing, are included in every page. Pages are served by the Thing Gateway
+	// from a snapshot of the attributes, a connection to AM visits all the attributes in a single page.
+	IterateAttributes(pageSize int, visit func(page AttributesResponse) error, names ...string) error
+
+	// SubscribeAttributes subscribes to changes of the attributes with the specified names associated with the thing's
+	// identity, removing the need to poll for changes with RequestAttributes. The notify function is called with the
+	// current values of the attributes before the function returns and again whenever an operator changes any of the
+	// attributes in AM. The notify function should not block. The subscription ends when the returned cancel function
+	// is called or the connection with the Thing Gateway is lost.
+	// Subscriptions are only supported by connections to the Thing Gateway without OSCORE and the gateway must have
+	// attribute subscriptions enabled.
+	SubscribeAttributes(notify func(response AttributesResponse), names ...string) (cancel func() error, err error)
+
+	// RequestPolicyDecision requests a decision from the AM policy engine on whether the thing is allowed to perform
+	// the specified actions on the resource. The policies that apply to the thing's identity and realm are evaluated by
+	// AM, so that the thing does not need to contain any authorization logic. The decision only contains the requested
+	// actions, or all the actions evaluated by AM if none are requested.
+	RequestPolicyDecision(resource string, actions ...string) (response PolicyDecisionResponse, err error)
+
+	// SignedRequest makes a request to an AM endpoint that is not wrapped by the SDK. The path is relative to the URL of
+	// AM, including any query, for example "/json/realms/root/realms/alfheim/things/*?_action=example". If the thing
+	// has a restricted proof of possession session then the body is sent in a JWT signed for the endpoint, as with the
+	// other requests made by the thing, otherwise the body is sent as JSON. The body may be nil. Returns the response
+	// body of the endpoint.
+	SignedRequest(method string, path string, body interface{}) (reply []byte, err error)
+
+	// Session returns information about the thing's current session with AM, including the expiry times held by AM,
+	// so that applications can make custom AM calls or diagnose session problems. A new session is created if the
+	// thing does not have a valid session.
+	Session() (info SessionInfo, err error)
+
 	// Logout will invalidate the thing's session with AM. It is good practice to log out if the thing will not make
 	// new requests for a prolonged period. Once logged out the thing will automatically create a new session when a
 	// new request is made.
 	Logout() error
+
+	// Handoff moves the thing to the server at the URL, AM or the Thing Gateway, for example when a mobile thing moves
+	// between network paths. The connection to the server is created with the settings of the builder, so a handoff to
+	// AM requires the realm and tree of the thing. The thing keeps its session if the server accepts it, which it checks
+	// with the server, otherwise the thing authenticates again over the new connection. The thing stays connected to
+	// the previous server if it can not authenticate. Handoff must not be called concurrently with the other requests
+	// of the thing and is not supported by a thing whose connection is shared, see Builder.ShareConnectionWith.
+	Handoff(url *url.URL) error
+
+	// Liveness reports the time of the last contact with AM or the Thing Gateway and counts the requests that failed
+	// because neither could be reached, without making a request. A firmware watchdog can poll it to decide when to
+	// reset the network stack or reboot the device. Any response counts as contact, including a rejected request.
+	Liveness() Liveness
+
+	// UseKey authenticates the thing again with the registered confirmation key with the given ID, see
+	// Builder.WithBackupKey, so that the thing proves possession of the key in all subsequent requests. The key ID of
+	// the key provided to AuthenticateThing selects the original key.
+	UseKey(keyID string) error
+
+	// Claim pairs the thing with a user account. The thing asks AM for a claim code, which display must show to the
+	// user, for example on the screen of the device or in a companion app, together with the URI at which the user
+	// approves the claim. The thing then polls AM until the claim is approved, stores the owner in its OwnerAttribute
+	// and returns the ID of the owner. Returns ErrClaimDenied if the user rejects the claim and ErrClaimExpired if the
+	// code expires first. An error returned by display stops the claim.
+	Claim(display func(claim ClaimResponse) error) (owner string, err error)
+}
+
+// Liveness reports the health of the contact of a thing with AM or the Thing Gateway, see Thing.Liveness
+type Liveness = client.Liveness
+
+// Codec encodes and decodes the structured payloads that a thing exchanges with the Thing Gateway, see
+// Builder.WithCodec
+type Codec = client.Codec
+
+// JSONCodec encodes payloads as JSON. It is the default codec and the only codec accepted by AM.
+var JSONCodec = client.JSONCodec
+
+// CBORCodec encodes payloads as CBOR, which is more compact than JSON on constrained links. The Thing Gateway accepts
+// it without registration.
+var CBORCodec = client.CBORCodec
+
+// RegisterCodec makes the codec available to things and to the Thing Gateway, which decodes requests with the codec
+// registered for their CoAP Content-Format. Only one codec can be registered for each Content-Format.
+func RegisterCodec(codec Codec) error {
+	return client.RegisterCodec(codec)
 }
 
 // Builder interface provides methods to setup and initialise a Thing.
 type Builder interface {
 
 	// ConnectTo the server at the given URL.
-	// Supports http(s) for connecting to AM and coap(s) for connecting to the Thing Gateway.
+	// Supports http(s) for connecting to AM and coap(s) for connecting to the Thing Gateway. CoAP over DTLS is used for
+	// coap(s) while coaps+tcp and coap+tcp connect to the Thing Gateway with CoAP over TLS and TCP respectively.
 	// When connecting to AM, the URL should be either the top level realm in AM or the DNS alias of a sub realm.
 	ConnectTo(url *url.URL) Builder
 
@@ -81,7 +270,8 @@ type Builder interface {
 	//  - a sub-realm of root called "alfheim": "/alfheim"
 	//  - a sub-realm of alfheim called "svartalfheim": "/alfheim/svartalfheim"
 	//
-	// The realm should not be set if a DNS alias is being used to connect to AM.
+	// The realm should not be set if a DNS alias is being used to connect to AM. A realm alias, or the realm of the DNS
+	// alias, is resolved by AM to the fully qualified realm path when the thing connects, see SessionInfo.Realm.
 	// The realm is not required if the thing is connecting to the Thing Gateway. If provided it will be ignored.
 	InRealm(realm string) Builder
 
@@ -96,8 +286,41 @@ type Builder interface {
 	// signed with the key that was registered for the thing. The JWT must contain the key ID provided for the
 	// registered key. In addition, the JWT may include custom claims about the thing. The claims will be available for
 	// processing by the proceeding nodes in the tree.
+	// The key may be an ECDSA (P-256, P-384, P-521 or secp256k1), Ed25519, Ed448 or RSA key. Creating the thing fails
+	// with ErrUnsupportedAlgorithm if the key is a secp256k1 key and AM does not advertise support for ES256K.
 	AuthenticateThing(thingID string, audience string, keyID string, key crypto.Signer, claims func() interface{}) Builder
 
+	// WithBackupKey adds a confirmation key that is registered together with the key provided to AuthenticateThing,
+	// for example a key held in a different hardware slot or a key for a different signing algorithm. The thing
+	// switches to the backup keys, in the order in which they were added, if the active key fails to sign, and the
+	// application can select a key with Thing.UseKey. May be called more than once. The registration tree must
+	// register the keys in the cnf.jwks claim of the registration JWT.
+	WithBackupKey(keyID string, key crypto.Signer) Builder
+
+	// WithKeySelector selects the confirmation key with which the thing signs for each operation, so that a thing can,
+	// for example, authenticate with an Ed25519 key and register with a P-256 key for which a certificate was issued.
+	// The selector must return the ID of the key provided to AuthenticateThing or of a backup key, see WithBackupKey,
+	// or an empty ID to sign with the active key. Keys selected by ID are not replaced when the active key fails
+	// over. Creating the thing fails if the selector returns an unknown key ID.
+	WithKeySelector(selector KeySelector) Builder
+
+	// WithClock issues the JWTs signed by the thing at the time of the clock instead of the time of the device, for
+	// devices without a battery backed real-time clock that boot with their clock at the epoch. The clock is
+	// synchronised with AM, or the Thing Gateway, before the thing authenticates. A failure to synchronise the clock is
+	// logged and the thing authenticates with the previous estimate of the clock offset.
+	WithClock(clock *Clock) Builder
+
+	// WithThumbprintKeyID derives the key ID of the key provided to AuthenticateThing from its JWK Thumbprint, see
+	// JWKThumbprint, so that the key ID does not have to be managed separately from the key. The key IDs provided to
+	// AuthenticateThing and WithBackupKey are ignored and may be empty.
+	WithThumbprintKeyID() Builder
+
+	// WithCompressedKey registers a P-256 key provided to AuthenticateThing with its point in compressed form, which
+	// reduces the size of the registration JWT for constrained networks. The compressed form is not part of the JWK
+	// standard, so only use it if the registration tree accepts it. Keys on other curves are registered as usual.
+	// Disabled by default unless WithConstrainedMode is used.
+	WithCompressedKey(enabled bool) Builder
+
 	// RegisterThing with the ForgeRock Register Thing tree node. This node uses JWT PoP and requires a signed JWT
 	// containing the thing's public key and key ID, along with a CA signed certificate that contains the same public
 	// key. This method must be used along with the AuthenticateThing method as they share the same thing ID,
@@ -105,6 +328,36 @@ type Builder interface {
 	// be added to the thing's identity on successful registration.
 	RegisterThing(certificates []*x509.Certificate, claims func() interface{}) Builder
 
+	// OnboardThing registers the thing with its operational key, provided by the AuthenticateThing method, using the
+	// initial device identity (IDevID) installed by the manufacturer to prove that it is a genuine device. This allows
+	// a device to be provisioned without installing credentials for the thing in advance. The certificates provided by
+	// RegisterThing are optional when onboarding but, if provided, are registered along with the operational key.
+	// If the registration tree sends a voucher then it is verified with verifyVoucher, along with the challenge signed
+	// in the IDevID proof and the time of the thing. The verifier may be nil if the tree does not send vouchers.
+	// See callback.VerifyJWSVoucher and, for FDO ownership vouchers, callback.VerifyFDOVoucher.
+	OnboardThing(idevid callback.IDevID, verifyVoucher callback.VoucherVerifier) Builder
+
+	// WithEvidence adds a software statement and attestation evidence to the registration JWT, allowing the
+	// registration tree to decide whether to register the thing based on its integrity. The evidence function is
+	// called with the registration challenge, see callback.AttestationNonce. Applies to RegisterThing and OnboardThing.
+	WithEvidence(evidence callback.EvidenceFunc) Builder
+
+	// WithPreSharedKey proves possession of a pre-shared key, provisioned in the factory, when registering the thing
+	// with RegisterThing, for fleets that cannot issue a certificate for every device. The certificates provided to
+	// RegisterThing may be nil. The registration JWT is nested in a JWT that is MACed with the key, which must be at
+	// least 32 bytes long, and the ID identifies the key to the registration tree.
+	WithPreSharedKey(id string, key []byte) Builder
+
+	// InGroups adds the thing to the AM groups with the given IDs during registration, so that policies can be written
+	// per group of things. The registration tree must add the thing to the groups in the thingGroups claim of the
+	// registration JWT. Applies to RegisterThing and OnboardThing.
+	InGroups(groups ...string) Builder
+
+	// WithOAuth2Client associates the OAuth 2.0 client with the given ID with the thing's identity during registration,
+	// so that AM issues the thing's access tokens with this client instead of the default IoT client. The client can
+	// be created on first boot with RegisterOAuth2Client. Applies to RegisterThing and OnboardThing.
+	WithOAuth2Client(clientID string) Builder
+
 	// HandleCallbacksWith the supplied callback handlers when the thing is authenticated. The provided handlers must
 	// match those configured in the AM authentication tree.
 	HandleCallbacksWith(handlers ...callback.Handler) Builder
@@ -112,12 +365,284 @@ type Builder interface {
 	// TimeoutRequestAfter sets the timeout on the communications between the Thing and AM or the Thing Gateway.
 	TimeoutRequestAfter(time.Duration) Builder
 
+	// WithBlockSize sets the size in bytes of the blocks used to transfer payloads that do not fit into a single
+	// CoAP message, such as registration JWTs containing certificate chains. The size must be a power of two between
+	// 16 and 1024 and defaults to 1024. A smaller size may be required on networks with a small MTU.
+	// Applies to connections with the Thing Gateway only.
+	WithBlockSize(size int) Builder
+
+	// WithMaxPayloadSize sets the maximum size in bytes of a response payload that the thing reads from AM or the
+	// Thing Gateway, so that a misconfigured or hostile server can not exhaust the memory of the device. A larger
+	// response fails with an error of class ErrPayloadTooLarge. The size defaults to 1 MiB.
+	WithMaxPayloadSize(size int) Builder
+
+	// WithCodec encodes the structured payloads sent to the Thing Gateway, such as authentication payloads, with the
+	// codec instead of JSON. The codec must be registered with the gateway. Responses that the gateway forwards from AM
+	// remain JSON. Connections with AM only accept JSONCodec.
+	WithCodec(codec Codec) Builder
+
+	// WithKeepAlive checks the connection with the Thing Gateway with a CoAP ping at the given interval. If the gateway
+	// stops responding, for example after a network change, the connection is re-established in the background with
+	// backoff so that the next request does not fail. Applies to connections with the Thing Gateway only.
+	WithKeepAlive(interval time.Duration) Builder
+
+	// WithLinkMetadata sets a function that describes the link of the thing, for example "rssi=-71;snr=7". The
+	// metadata is sent with every request to the Thing Gateway, which forwards it to AM with authentication and access
+	// token requests so that it appears in the AM audit logs. Applies to connections with the Thing Gateway only.
+	WithLinkMetadata(metadata func() string) Builder
+
+	// WithClientCertificate presents the certificate chain to the Thing Gateway during the DTLS or TLS handshake
+	// instead of a self-signed certificate, for gateways that require client certificates issued by a trusted CA. The
+	// first certificate must contain the public key of the key provided to AuthenticateThing.
+	// Applies to connections with the Thing Gateway only.
+	WithClientCertificate(certificates []*x509.Certificate) Builder
+
+	// WithTLSProfile restricts the cipher suites, curves and protocol version negotiated in the DTLS or TLS handshake
+	// with the Thing Gateway so that the connection meets a compliance profile. Applies to secure connections with the
+	// Thing Gateway only.
+	WithTLSProfile(profile TLSProfile) Builder
+
+	// WithGatewayTrust decides which certificates presented by the Thing Gateway in the DTLS or TLS handshake are
+	// trusted. Over TLS, the certificate chain of the gateway is verified against the root CAs of the system unless
+	// trust is given. Applies to secure connections with the Thing Gateway only.
+	WithGatewayTrust(trust GatewayTrust) Builder
+
+	// WithDetachedPayload sends signed requests, such as access token requests, to the Thing Gateway as a JWS with a
+	// detached payload followed by the payload itself, which avoids base64url encoding payloads that are already
+	// encoded, such as certificates and tokens, a second time on constrained links. The gateway attaches the payload
+	// again before forwarding the request to AM, so the gateway must support detached payloads. Applies to
+	// connections with the Thing Gateway only. Disabled by default unless WithConstrainedMode is used.
+	WithDetachedPayload(enabled bool) Builder
+
+	// WithConstrainedMode tunes the thing for a Thing Gateway that is backhauled over a low-bandwidth link, such as
+	// NB-IoT or LoRa, instead of setting each option. Payloads are encoded with CBORCodec, signed requests are sent
+	// with a detached payload and P-256 keys are registered in compressed form, see WithCompressedKey, so the gateway
+	// and the registration tree must accept them. Requests time out after a minute, CoAP blocks are 256 bytes and, if
+	// keep-alive is enabled, the connection is re-established with fewer attempts, starting 10 seconds apart and backing
+	// off to 10 minutes. The responses received by the thing are not written to the debug log, see WithDebugLevel to
+	// reduce the other debug information of the thing. Options that are set explicitly, such as WithCodec,
+	// TimeoutRequestAfter and WithCompressedKey(false), take precedence. The payload settings are not used for
+	// connections with AM.
+	WithConstrainedMode() Builder
+
+	// WithDebugLevel sets the level of detail of the debug information written by the thing, overriding the level set
+	// with SetDebugLevel.
+	WithDebugLevel(level DebugLevel) Builder
+
+	// WithDebugRedaction switches the redaction of the debug information written by the thing on or off, overriding
+	// the redaction set with SetDebugRedaction.
+	WithDebugRedaction(enabled bool) Builder
+
+	// WithIdempotencyKey identifies the registration or authentication made by Create with the idempotency key, so
+	// that a thing that repeats Create with the same key after a timeout is given the session of the attempt that
+	// completed instead of registering again. The key is only used by Create and not when the session is renewed.
+	// The gateway rejects keys that are shorter than those returned by NewIdempotencyKey.
+	// Applies to connections with the Thing Gateway only.
+	WithIdempotencyKey(key string) Builder
+
+	// WithLocale sets the locale, for example "de-CH", that is sent with the authentication requests of the thing so
+	// that the nodes of the authentication tree can localise the prompts of their callbacks, see callback.Prompt.
+	// Applies to connections with AM and with the Thing Gateway only.
+	WithLocale(locale string) Builder
+
+	// WithAuthContext adds a named context value, for example the firmware channel of the thing, that is sent with
+	// the authentication requests of the thing so that the authentication tree can branch on the context of the
+	// device. AM receives the value in the X-Thing-Context-{name} header. The name may only contain letters, digits
+	// and hyphens. May be called more than once. Applies to connections with AM and with the Thing Gateway only.
+	WithAuthContext(name, value string) Builder
+
+	// SuspendAuthentication makes Create return a SuspendedError when the authentication tree waits for an external
+	// event, for example an operator approving the thing, instead of waiting and polling AM until the tree continues.
+	// The thing can then persist the error, sleep and resume the authentication later with ResumeAuthentication.
+	SuspendAuthentication() Builder
+
+	// ResumeAuthentication makes Create resume the suspended authentication instead of starting the authentication
+	// tree from the beginning. The thing must be configured with the same key and callback handlers as when the
+	// authentication was suspended.
+	ResumeAuthentication(suspended SuspendedError) Builder
+
+	// WithAMInfo provides the information about AM that the thing otherwise discovers when it connects, so that a
+	// device that wakes for a short time on a constrained link does not spend a round trip on discovery. The
+	// information is obtained once, for example during commissioning, with DiscoverAMInfo and must be discovered again
+	// when AM is reconfigured or upgraded.
+	WithAMInfo(info AMInfo) Builder
+
+	// WithSessionCookieName overrides the name of the session cookie that is discovered from AM, for deployments where
+	// a proxy in front of AM renames cookies. Applies to connections with AM only.
+	WithSessionCookieName(name string) Builder
+
+	// WithSessionTokenHeader sends the session token to AM in the given header instead of a cookie, for deployments
+	// where a proxy in front of AM rewrites or strips cookies. Applies to connections with AM only.
+	WithSessionTokenHeader(header string) Builder
+
+	// WithUserAgent sets the User-Agent header sent with all requests to AM so that the product can be identified in
+	// AM and proxy logs. Applies to connections with AM only.
+	WithUserAgent(userAgent string) Builder
+
+	// WithHeader adds a static header, such as a tenant ID, to all requests to AM. May be called more than once to add
+	// several headers. Headers set by the SDK are not replaced. Applies to connections with AM only.
+	WithHeader(name, value string) Builder
+
+	// WaitWhenThrottled allows the Thing to repeat a request that was throttled by AM once the delay requested by AM,
+	// via the Retry-After header, has passed. The Thing will block for the delay only if it does not exceed the given
+	// limit. By default, throttled requests are not repeated and the delay can be retrieved from the returned error
+	// with RetryAfter.
+	WaitWhenThrottled(limit time.Duration) Builder
+
+	// WithAttributeSchema sets the paths of the attributes that are defined for the thing in AM, for example "colour"
+	// and "location/building". Attributes with dynamic names may be described with wildcards, for example
+	// "sensors/*". Requested attributes are validated against the schema and wildcards are expanded with the schema
+	// so that AM filters the attributes. Without a schema, attribute names are not validated.
+	WithAttributeSchema(fields ...string) Builder
+
+	// MapClaimsToAttributes writes the claims of the registration JWT, given to RegisterThing, to the identity
+	// attributes of the thing named by the mapping once the thing has been registered. The attributes are written with
+	// a signed update request, which AM must allow for the thing. Create returns an error if the attributes can not be
+	// written, in which case the thing has been registered and WriteMappedAttributes can be used to write them later.
+	MapClaimsToAttributes(mapping AttributeMapping) Builder
+
+	// ProtectWithOSCORE protects the requests made to the Thing Gateway end-to-end with OSCORE (RFC 8613) so that the
+	// protection survives CoAP proxies between the thing and the gateway. The security context is derived from an
+	// ephemeral key agreement signed with the key provided to AuthenticateThing, which must be registered for the
+	// thing. Applies to connections with the Thing Gateway only.
+	ProtectWithOSCORE() Builder
+
+	// ShareConnectionWith creates the Thing with a connection that uses the transport of the given Thing instead of
+	// opening a new one, for devices that host several logical things, such as one thing per tenant application. The
+	// Thing authenticates with its own key and has its own session and OSCORE context. The connection options of this
+	// builder, such as ConnectTo and WithClientCertificate, are ignored. The given Thing must have been created by
+	// this SDK and should not be closed while it shares its connection.
+	ShareConnectionWith(t Thing) Builder
+
+	// WithHooks registers the hooks that are called on state transitions of the Thing, including the authentication
+	// made by Create.
+	WithHooks(hooks Hooks) Builder
+
+	// Validate checks the configuration of the thing without connecting to AM or the Thing Gateway, for example the
+	// scheme of the URL, the format of the realm and tree names and whether the SDK can sign with the keys. All the
+	// problems that are found are returned in a ConfigError. Create validates the configuration before connecting.
+	Validate() error
+
 	// Create a Thing instance and make an authentication request to AM. The callback handlers and information provided
 	// in the AuthenticateThing and RegisterThing methods will be used to satisfy the callbacks received from the AM
 	// authentication process.
 	Create() (Thing, error)
 }
 
+// OAuth2ClientMetadata contains the metadata of an OAuth 2.0 client that is registered dynamically, see rfc7591.
+type OAuth2ClientMetadata = client.OAuth2ClientMetadata
+
+// OAuth2ClientInformation contains the credentials and metadata of a dynamically registered OAuth 2.0 client. The
+// information should be stored by the caller since the client is only registered once.
+type OAuth2ClientInformation = client.OAuth2ClientInformation
+
+// RegisterOAuth2Client registers an OAuth 2.0 client in the AM realm with dynamic client registration, as defined by
+// rfc7591. This allows a thing, such as a gateway, to create its own OAuth 2.0 client on first boot instead of relying
+// on a client provisioned in advance. The initial access token is required if AM only allows protected registration.
+// The client ID of the returned information can be passed to Builder.WithOAuth2Client when the thing is registered.
+func RegisterOAuth2Client(baseURL *url.URL, realm string, timeout time.Duration, initialAccessToken string,
+	metadata OAuth2ClientMetadata) (OAuth2ClientInformation, error) {
+	connection, err := client.NewConnection().
+		ConnectTo(baseURL).
+		InRealm(realm).
+		TimeoutRequestAfter(timeout).
+		Create()
+	if err != nil {
+		return OAuth2ClientInformation{}, err
+	}
+	return client.RegisterOAuth2Client(connection, initialAccessToken, metadata)
+}
+
+// TLSProfile restricts the security parameters negotiated with the Thing Gateway, see Builder.WithTLSProfile.
+type TLSProfile = client.TLSProfile
+
+// GatewayTrust decides which certificates of the Thing Gateway are trusted, see Builder.WithGatewayTrust.
+type GatewayTrust = client.GatewayTrust
+
+// AMInfo contains the information about AM that a thing discovers when it connects, such as its endpoints, session
+// cookie name and the version of the things endpoint. It can be stored as JSON, see Builder.WithAMInfo.
+type AMInfo = client.AMInfo
+
+// DiscoverAMInfo discovers the information about AM that a thing connecting to the URL in the realm needs, so that it
+// can be stored on the device and provided with Builder.WithAMInfo. The URL may be that of AM or the Thing Gateway.
+func DiscoverAMInfo(baseURL *url.URL, realm string, timeout time.Duration) (AMInfo, error) {
+	connection, err := client.NewConnection().
+		ConnectTo(baseURL).
+		InRealm(realm).
+		TimeoutRequestAfter(timeout).
+		Create()
+	if err != nil {
+		return AMInfo{}, err
+	}
+	return client.DiscoverAMInfo(connection)
+}
+
+// Clock estimates the offset of the device clock from the clock of AM, or of the Thing Gateway, see Builder.WithClock.
+// The zero value is a clock that has not been synchronised and reports the time of the device.
+type Clock = client.Clock
+
+// Impersonation performs operations on behalf of a thing, see Thing.Impersonate
+type Impersonation interface {
+	// Subject returns the ID of the impersonated thing
+	Subject() string
+
+	// RequestAttributes requests the attributes with the specified names of the impersonated thing, in the same way as
+	// Thing.RequestAttributes.
+	RequestAttributes(names ...string) (response AttributesResponse, err error)
+
+	// SignedRequest makes a request to an AM endpoint on behalf of the impersonated thing, for example to issue a
+	// command to the thing, in the same way as Thing.SignedRequest.
+	SignedRequest(method string, path string, body interface{}) (reply []byte, err error)
+
+	// Logout ends the session of the impersonation.
+	Logout() error
+}
+
+// Operation is an operation for which the thing signs a JWT with one of its confirmation keys
+type Operation string
+
+// Operations for which a KeySelector selects a key
+const (
+	// OperationAuthenticate signs the proof of possession JWT of the Authenticate Thing tree node
+	OperationAuthenticate Operation = "authenticate"
+	// OperationRegister signs the registration JWT of the Register Thing tree node or of onboarding
+	OperationRegister Operation = "register"
+	// OperationRequest signs the requests made with the session of the thing, such as access token requests
+	OperationRequest Operation = "request"
+)
+
+// KeySelector returns the ID of the confirmation key with which the thing signs for the operation, or an empty ID to
+// sign with the active key. See Builder.WithKeySelector.
+type KeySelector func(operation Operation) string
+
+// Ed448 selects an Ed448 key in GenerateConfirmationKey, the JWS algorithm of the key is EdDSA
+const Ed448 = jose.SignatureAlgorithm(jws.Ed448Curve)
+
+// GenerateConfirmationKey generates a new key for the thing that signs with the given JWS algorithm, which must be
+// one of ES256, ES384, ES512, ES256K or EdDSA, or Ed448 for an EdDSA key on the Ed448 curve instead of Ed25519. The
+// key can be provided to Builder.AuthenticateThing and is registered with AM as the confirmation key of the thing,
+// Ed448 keys require that AM supports the curve. The private key is held in memory, use a hardware backed
+// crypto.Signer where the key must be protected.
+func GenerateConfirmationKey(alg string) (crypto.Signer, error) {
+	switch jose.SignatureAlgorithm(alg) {
+	case jose.ES256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case jose.ES384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case jose.ES512:
+		return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case jws.ES256K:
+		return secp256k1.GenerateKey()
+	case jose.EdDSA:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	case Ed448:
+		_, key, err := ed448.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedAlgorithm, alg)
+}
+
 // JWKThumbprint calculates the base64url-encoded JWK Thumbprint value for the given key.
 // The thumbprint can be used for identifying or selecting the key.
 // See https://tools.ietf.org/html/rfc7638.
@@ -125,9 +650,15 @@ func JWKThumbprint(key crypto.Signer) (string, error) {
 	if key == nil {
 		return "", jws.ErrMissingSigner
 	}
-	thumbprint, err := (&jose.JSONWebKey{Key: key.Public()}).Thumbprint(crypto.SHA256)
+	thumbprint, err := jws.Thumbprint(key.Public())
 	if err != nil {
 		return "", err
 	}
 	return base64.URLEncoding.EncodeToString(thumbprint), nil
 }
+
+// NewIdempotencyKey returns a new random key with which the attempts of a request are identified, see
+// RequestIdempotentAccessToken and Builder.WithIdempotencyKey.
+func NewIdempotencyKey() string {
+	return client.NewIdempotencyKey()
+}
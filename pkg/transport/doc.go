@@ -0,0 +1,48 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+// Package transport lets third parties add transports, such as a LoRaWAN application server or NB-IoT NIDD, over
+// which things make their requests to the ForgeRock platform. AM over HTTP(S) and the Thing Gateway over CoAP are
+// built in and are selected by the http(s), coap(s) and coap(s)+tcp URL schemes. A transport registers a factory for
+// its URL scheme when its package is initialised:
+//
+//    func init() {
+//        transport.Register("lorawan", func(config transport.Config) (transport.Transport, error) {
+//            return newLoRaWANTransport(config.URL.Host, config.Timeout)
+//        })
+//    }
+//
+// A thing uses the transport when it is built with a URL of that scheme after the package of the transport has been
+// imported:
+//
+//    u, _ := url.Parse("lorawan://app-server.example.com/things")
+//    device, err := builder.Thing().
+//        ConnectTo(u).
+//        ...
+//        Create()
+//
+// Every request is passed to the transport with the operation that it represents. The payloads of the requests and
+// replies are the same as those exchanged with the Thing Gateway:
+//    - authenticate: the JSON authentication payload, containing the authId, callbacks and tokenId
+//    - aminfo: a JSON object with the BaseURL, Realm, AccessTokenURL, AttributesURL, PolicyURL, ThingsVersion and
+//      SigningAlgorithms fields that describe AM
+//    - validate: a JSON object with a boolean "valid" field
+//    - logout: the reply is ignored
+//    - all other operations: the reply of AM, which the thing decodes
+//
+// A transport signals the class of a failed request by returning an error that wraps one of the error classes of
+// package thing, such as thing.ErrUnauthorised, so that the thing can react to the failure.
+//
+package transport
@@ -0,0 +1,135 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package transport
+
+import (
+	"crypto"
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Operation identifies the request made by a thing
+type Operation string
+
+// Operations
+const (
+	OperationAuthenticate    Operation = "authenticate"
+	OperationAMInfo          Operation = "aminfo"
+	OperationValidateSession Operation = "validate"
+	OperationLogoutSession   Operation = "logout"
+	OperationSessionInfo     Operation = "sessioninfo"
+	OperationAccessToken     Operation = "accesstoken"
+	OperationIntrospect      Operation = "introspect"
+	OperationAttributes      Operation = "attributes"
+	OperationPolicyDecision  Operation = "policy"
+	OperationSignedRequest   Operation = "amrequest"
+)
+
+// Request is a request made by a thing
+type Request struct {
+	Operation Operation
+	// Token is the session token of the thing, or the access token to introspect. Empty for authentication and AM info
+	// requests.
+	Token string
+	// ContentType of the payload, either application/json or application/jose
+	ContentType string
+	Payload     []byte
+	// Names of the attributes requested by an attributes request, all attributes are requested if empty
+	Names []string
+	// Method and Path, relative to the AM base URL, of a signed request
+	Method string
+	Path   string
+}
+
+// Config contains the configuration of the thing that uses the transport
+type Config struct {
+	// URL that the thing connects to, the scheme of the URL selects the transport
+	URL   *url.URL
+	Realm string
+	Tree  string
+	// Key of the thing, which the transport may use to secure the connection
+	Key     crypto.Signer
+	Timeout time.Duration
+}
+
+// Transport carries the requests of a thing to the ForgeRock platform
+type Transport interface {
+	// Initialise the transport. Called once before the thing makes any requests.
+	Initialise() error
+
+	// Request sends the request to the platform and returns the reply
+	Request(request Request) (reply []byte, err error)
+}
+
+// Factory creates a transport for the thing with the configuration
+type Factory func(config Config) (Transport, error)
+
+// builtIn contains the URL schemes of the transports provided by the SDK
+var builtIn = map[string]bool{
+	"http": true, "https": true, "coap": true, "coaps": true, "coap+tcp": true, "coaps+tcp": true,
+}
+
+var (
+	factoriesMutex sync.Mutex
+	factories      = make(map[string]Factory)
+)
+
+// Register makes the transport factory available for the URL scheme. Panics if a factory is registered twice for the
+// same scheme, if the scheme belongs to a built-in transport or if the factory is nil.
+func Register(scheme string, factory Factory) {
+	factoriesMutex.Lock()
+	defer factoriesMutex.Unlock()
+	if factory == nil {
+		panic("transport: Register factory is nil")
+	}
+	if builtIn[scheme] {
+		panic("transport: Register called for built-in scheme " + scheme)
+	}
+	if _, ok := factories[scheme]; ok {
+		panic("transport: Register called twice for scheme " + scheme)
+	}
+	factories[scheme] = factory
+}
+
+// New creates the transport registered for the scheme of the URL in the configuration
+func New(config Config) (Transport, error) {
+	if config.URL == nil {
+		return nil, fmt.Errorf("transport requires a URL")
+	}
+	factoriesMutex.Lock()
+	factory, ok := factories[config.URL.Scheme]
+	factoriesMutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no transport registered for scheme `%s`", config.URL.Scheme)
+	}
+	return factory(config)
+}
+
+// Registered returns the sorted URL schemes of the registered transports
+func Registered() []string {
+	factoriesMutex.Lock()
+	defer factoriesMutex.Unlock()
+	schemes := make([]string, 0, len(factories))
+	for scheme := range factories {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package transport
+
+import (
+	"errors"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+type testTransport struct {
+	Transport
+	host string
+}
+
+func TestRegister(t *testing.T) {
+	Register("test-nidd", func(config Config) (Transport, error) {
+		if config.URL.Host == "" {
+			return nil, errors.New("host required")
+		}
+		return testTransport{host: config.URL.Host}, nil
+	})
+	if !reflect.DeepEqual(Registered(), []string{"test-nidd"}) {
+		t.Errorf("unexpected registered transports %v", Registered())
+	}
+	transport, err := New(Config{URL: &url.URL{Scheme: "test-nidd", Host: "scef.example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transport.(testTransport).host != "scef.example.com" {
+		t.Errorf("configuration not passed to the factory")
+	}
+	tests := []struct {
+		name   string
+		config Config
+	}{
+		{name: "factory-error", config: Config{URL: &url.URL{Scheme: "test-nidd"}}},
+		{name: "unknown-scheme", config: Config{URL: &url.URL{Scheme: "test-lorawan", Host: "example.com"}}},
+		{name: "no-url"},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			if _, err := New(subtest.config); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestRegister_Panics(t *testing.T) {
+	factory := func(Config) (Transport, error) { return nil, nil }
+	Register("test-panics", factory)
+	tests := []struct {
+		name    string
+		scheme  string
+		factory Factory
+	}{
+		{name: "twice", scheme: "test-panics", factory: factory},
+		{name: "built-in", scheme: "coaps", factory: factory},
+		{name: "nil-factory", scheme: "test-nil"},
+	}
+	for _, subtest := range tests {
+		t.Run(subtest.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("expected a panic")
+				}
+			}()
+			Register(subtest.scheme, subtest.factory)
+		})
+	}
+}
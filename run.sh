@@ -26,8 +26,9 @@ export GO111MODULE=on
 
 case "$1" in
 anvil)
-  # Run the Thing SDK tests
-  go run github.com/JacoJooste/iot-edge/tests/thingsdk
+  # Run the Thing SDK tests, e.g. ./run.sh anvil -run AccessToken -client am
+  # or against several AM servers with ./run.sh anvil -matrix tests/thingsdk/matrix.json
+  go run github.com/JacoJooste/iot-edge/tests/thingsdk "${@:2}"
 	;;
 test)
   # Run the IoT unit tests
@@ -32,6 +32,9 @@ import (
 	"gopkg.in/square/go-jose.v2"
 )
 
+// Domain of the AM server, including the port. Sub-domains of the domain must resolve to the server.
+var Domain = "localtest.me:8080"
+
 // Base AM URL
 var AMURL = URL("am")
 
@@ -57,7 +60,28 @@ var httpClient = http.Client{
 }
 
 func URL(subDomain string) string {
-	return fmt.Sprintf("http://%s.localtest.me:8080/am", subDomain)
+	return fmt.Sprintf("http://%s.%s/am", subDomain, Domain)
+}
+
+// SetDomain changes the AM server that is used, see Domain
+func SetDomain(domain string) {
+	Domain = domain
+	AMURL = URL("am")
+}
+
+// GetVersion returns the version of AM, for example "7.0.1"
+func GetVersion() (version string, err error) {
+	reply, err := get(AMURL+"/json/serverinfo/version", "resource=1.0")
+	if err != nil {
+		return version, err
+	}
+	var info struct {
+		Version string `json:"version"`
+	}
+	if err = json.Unmarshal(reply, &info); err != nil {
+		return version, err
+	}
+	return info.Version, nil
 }
 
 // crestAction makes an HTTP POST request with the action appended to the given endpoint.
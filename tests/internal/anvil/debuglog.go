@@ -0,0 +1,143 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package anvil
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/JacoJooste/iot-edge/v7/internal/debug"
+)
+
+// Rolling debug logs
+// Soak runs repeat the test set for hours and the debug of a single test can grow without bound, for example when a
+// thing keeps polling a failing endpoint. A RollingLog limits the size of a debug log by renaming it once it is full,
+// keeping a number of backups as {name}.1 to {name}.{n}, the most recent first, and deleting older ones. A log.Logger
+// writes every entry with a single call to Write, so an entry is never split between files, and the writes of
+// concurrent tests are serialised so that their entries are not interleaved.
+// The logs are kept as test artefacts and contain the HTTP round trips of the AM client, so the credentials and
+// session of the AM administrator, as well as the tokens of the things, are redacted from every entry.
+
+var (
+	// DebugLogMaxSize is the size in bytes at which a debug log is rolled over, zero or less for no limit
+	DebugLogMaxSize int64 = 64 << 20
+	// DebugLogBackups is the number of rolled over debug logs that are kept
+	DebugLogBackups = 3
+)
+
+func init() {
+	// the AM client authenticates the administrator with these headers
+	debug.RedactHeader("X-OpenAM-Password")
+	debug.RedactHeader("iPlanetDirectoryPro")
+}
+
+// RollingLog is a size-bounded log file that is safe for concurrent writers
+type RollingLog struct {
+	mutex   sync.Mutex
+	path    string
+	maxSize int64
+	backups int
+	file    *os.File
+	size    int64
+}
+
+// NewRollingLog opens the log file at the path, appending to it if it exists. The file is rolled over when a write
+// would make it larger than maxSize bytes, if maxSize is positive, and the given number of backups are kept.
+func NewRollingLog(path string, maxSize int64, backups int) (*RollingLog, error) {
+	l := &RollingLog{path: path, maxSize: maxSize, backups: backups}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the log file and records its current size
+func (l *RollingLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+// backup returns the path of the nth backup
+func (l *RollingLog) backup(n int) string {
+	return fmt.Sprintf("%s.%d", l.path, n)
+}
+
+// roll renames the log file to the first backup, shifting the existing backups, and opens a new log file
+func (l *RollingLog) roll() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	l.file = nil
+	if l.backups <= 0 {
+		if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return l.open()
+	}
+	for n := l.backups - 1; n > 0; n-- {
+		if err := os.Rename(l.backup(n), l.backup(n+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(l.path, l.backup(1)); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// Write redacts the entry and appends it to the log file, rolling the file over first if the entry does not fit
+func (l *RollingLog) Write(p []byte) (int, error) {
+	entry := []byte(debug.Redact(string(p)))
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file == nil {
+		return 0, os.ErrClosed
+	}
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(entry)) > l.maxSize {
+		if err := l.roll(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := l.file.Write(entry)
+	l.size += int64(n)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close closes the log file. Entries written after the log has been closed are discarded with an error.
+func (l *RollingLog) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
@@ -25,6 +25,7 @@ import (
 	"crypto/x509/pkix"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math/big"
@@ -45,6 +46,7 @@ import (
 const (
 	PassString = "\033[1;32mPASS\033[0m"
 	FailString = "\033[1;31mFAIL\033[0m"
+	SkipString = "\033[1;33mSKIP\033[0m"
 
 	// Standard timeout used in SDK calls in tests
 	StdTimeOut = 10 * time.Second
@@ -449,6 +451,16 @@ type TestState interface {
 	URL() *url.URL
 	// SetGatewayTree sets the auth tree used by the test Thing Gateway
 	SetGatewayTree(tree string)
+	// Progress returns the logger to which the progress of tests is written
+	Progress() *log.Logger
+}
+
+// progressOrDefault returns the logger if it is set, otherwise the ProgressLogger
+func progressOrDefault(logger *log.Logger) *log.Logger {
+	if logger == nil {
+		return ProgressLogger
+	}
+	return logger
 }
 
 // AMTestState contains data and methods for testing the AM client
@@ -457,6 +469,12 @@ type AMTestState struct {
 	TestAudience  string
 	TestURL       *url.URL
 	DNSConfigured bool
+	// ProgressLogger is optional, progress is written to the package ProgressLogger if nil
+	ProgressLogger *log.Logger
+}
+
+func (a *AMTestState) Progress() *log.Logger {
+	return progressOrDefault(a.ProgressLogger)
 }
 
 func (a *AMTestState) SetGatewayTree(tree string) {
@@ -490,6 +508,12 @@ type ThingGatewayTestState struct {
 	ThingGateway *gateway.ThingGateway
 	Realm        string
 	TestAudience string
+	// ProgressLogger is optional, progress is written to the package ProgressLogger if nil
+	ProgressLogger *log.Logger
+}
+
+func (i *ThingGatewayTestState) Progress() *log.Logger {
+	return progressOrDefault(i.ProgressLogger)
 }
 
 func (i *ThingGatewayTestState) SetGatewayTree(tree string) {
@@ -595,37 +619,58 @@ func TestName(t SDKTest) string {
 	return TypeName(t) + t.NameSuffix()
 }
 
-// NewFileDebugger creates a new Anvil logger that logs to file with the given test name
-func NewFileDebugger(directory, testName string) (*log.Logger, *os.File) {
-	err := os.MkdirAll(directory, 0777)
-	if err != nil {
-		log.Fatal(err)
+// NewFileDebugger creates a new Anvil logger that logs to a rolling file with the given test name, limited by
+// DebugLogMaxSize and DebugLogBackups. The caller must close the returned log.
+func NewFileDebugger(directory, testName string) (*log.Logger, io.Closer, error) {
+	if err := os.MkdirAll(directory, 0777); err != nil {
+		return nil, nil, err
 	}
-	file, err := os.OpenFile(filepath.Join(directory, testName+".log"), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	file, err := NewRollingLog(filepath.Join(directory, testName+".log"), DebugLogMaxSize, DebugLogBackups)
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, err
 	}
 	DebugLogger = log.New(file, "", log.Ltime|log.Lmicroseconds|log.Lshortfile)
-	return DebugLogger, file
+	return DebugLogger, file, nil
 }
 
-// RunTest runs the given SDKTest
+// RunTest runs the given SDKTest and records its result with the Reporters
 func RunTest(state TestState, t SDKTest) (pass bool) {
 	name := TestName(t)
-	ProgressLogger.Printf("=== RUN   %s\n", name)
-	start := time.Now()
+	progress := state.Progress()
+	progress.Printf("=== RUN   %s\n", name)
+	result := TestResult{Name: name, Suite: suiteName(state), Start: time.Now()}
+	if reason := skipReason(t); reason != "" {
+		progress.Printf("--- %s: %s (%s)\n", SkipString, name, reason)
+		result.Pass, result.Skipped, result.SkipReason = true, true, reason
+		record(result)
+		return true
+	}
 	defer func() {
-		ProgressLogger.Print(resultSprint(pass, name, start))
+		progress.Print(resultSprint(pass, name, result.Start))
+		result.Pass = pass
+		result.Duration = time.Since(result.Start)
+		record(result)
 	}()
 	var data ThingData
 	if data, pass = t.Setup(state); !pass {
+		result.FailedStage = "setup"
+		result.SetupDuration = time.Since(result.Start)
 		return false
 	}
+	result.SetupDuration = time.Since(result.Start)
 	DebugLogger.Printf("*** STARTING TEST RUN in realm %s\n", state.RealmForConfiguration())
+	runStart := time.Now()
 	pass = t.Run(state, data)
+	result.RunDuration = time.Since(runStart)
+	if !pass {
+		result.FailedStage = "run"
+	}
 	DebugLogger.Printf("*** RUN RESULT: %v\n\n\n", pass)
+	cleanupStart := time.Now()
 	if err := t.Cleanup(state, data); err != nil {
 		DebugLogger.Printf("clean up error; %v", err)
+		result.CleanupError = err.Error()
 	}
+	result.CleanupDuration = time.Since(cleanupStart)
 	return
 }
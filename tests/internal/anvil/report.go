@@ -0,0 +1,297 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package anvil
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reporters receive the result of every test run by RunTest, in addition to the progress written to ProgressLogger.
+// The reporters must be closed after the test set has finished to write their reports.
+var Reporters []Reporter
+
+// Reporter records test results, for example to write them in a format understood by result dashboards
+type Reporter interface {
+	// Record is called with the result of each test when it has finished
+	Record(result TestResult)
+	// Close writes the report
+	Close() error
+}
+
+// TestResult describes the outcome of a test
+type TestResult struct {
+	Name string
+	// Suite identifies the client type and realm in which the test ran
+	Suite string
+	Pass  bool
+	// Skipped is true if the test was not run, for example because the AM version does not support the feature
+	Skipped    bool
+	SkipReason string
+	// FailedStage is "setup" or "run" if the test failed
+	FailedStage string
+	Start       time.Time
+	// per stage timings, the total duration includes all the stages
+	Duration        time.Duration
+	SetupDuration   time.Duration
+	RunDuration     time.Duration
+	CleanupDuration time.Duration
+	// CleanupError is not empty if the cleanup failed, which does not fail the test
+	CleanupError string
+}
+
+// suiteName returns the name of the suite of the tests run with the given state
+func suiteName(state TestState) string {
+	name := fmt.Sprintf("%s client in %s", state.ClientType(), state.RealmForConfiguration())
+	if serverVersion.Known() {
+		name = fmt.Sprintf("AM %s %s", serverVersion, name)
+	}
+	return name
+}
+
+// record sends the result to all the reporters
+func record(result TestResult) {
+	for _, r := range Reporters {
+		r.Record(result)
+	}
+}
+
+// resultCollector collects the results of tests in the order that they were recorded
+type resultCollector struct {
+	mutex   sync.Mutex
+	results []TestResult
+}
+
+func (c *resultCollector) Record(result TestResult) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.results = append(c.results, result)
+}
+
+// collected returns the results grouped by suite, with the suites in the order that they were first recorded
+func (c *resultCollector) collected() (suites []string, results map[string][]TestResult) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	results = make(map[string][]TestResult)
+	for _, r := range c.results {
+		if _, ok := results[r.Suite]; !ok {
+			suites = append(suites, r.Suite)
+		}
+		results[r.Suite] = append(results[r.Suite], r)
+	}
+	return suites, results
+}
+
+// writeFile writes the data to the named file, creating or truncating it
+func writeFile(filename string, write func(f *os.File) error) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err = write(f); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// JUnitReporter writes the test results to a file in the JUnit XML format
+type JUnitReporter struct {
+	resultCollector
+	Filename string
+}
+
+// NewJUnitReporter returns a reporter that writes a JUnit XML report to the named file
+func NewJUnitReporter(filename string) *JUnitReporter {
+	return &JUnitReporter{Filename: filename}
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestSuites struct {
+	XMLName    xml.Name         `xml:"testsuites"`
+	Tests      int              `xml:"tests,attr"`
+	Failures   int              `xml:"failures,attr"`
+	Time       string           `xml:"time,attr"`
+	TestSuites []junitTestSuite `xml:"testsuite"`
+}
+
+// seconds formats the duration in seconds, as expected by JUnit
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+func (r *JUnitReporter) Close() error {
+	suites, results := r.collected()
+	var report junitTestSuites
+	var total time.Duration
+	for _, name := range suites {
+		suite := junitTestSuite{Name: name, Timestamp: results[name][0].Start.Format("2006-01-02T15:04:05")}
+		var suiteTime time.Duration
+		for _, result := range results[name] {
+			testCase := junitTestCase{
+				Name:      result.Name,
+				ClassName: name,
+				Time:      seconds(result.Duration),
+				SystemOut: fmt.Sprintf("setup %s, run %s, cleanup %s", seconds(result.SetupDuration),
+					seconds(result.RunDuration), seconds(result.CleanupDuration)),
+			}
+			if result.Skipped {
+				testCase.Skipped = &junitSkipped{Message: result.SkipReason}
+				testCase.SystemOut = ""
+				suite.Skipped++
+			}
+			if result.CleanupError != "" {
+				testCase.SystemOut += "\ncleanup error: " + result.CleanupError
+			}
+			if !result.Pass {
+				testCase.Failure = &junitFailure{
+					Message: fmt.Sprintf("test failed during %s", result.FailedStage),
+					Type:    result.FailedStage,
+				}
+				suite.Failures++
+			}
+			suite.TestCases = append(suite.TestCases, testCase)
+			suiteTime += result.Duration
+		}
+		suite.Tests = len(suite.TestCases)
+		suite.Time = seconds(suiteTime)
+		report.TestSuites = append(report.TestSuites, suite)
+		report.Tests += suite.Tests
+		report.Failures += suite.Failures
+		total += suiteTime
+	}
+	report.Time = seconds(total)
+	return writeFile(r.Filename, func(f *os.File) error {
+		if _, err := f.WriteString(xml.Header); err != nil {
+			return err
+		}
+		encoder := xml.NewEncoder(f)
+		encoder.Indent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			return err
+		}
+		_, err := f.WriteString("\n")
+		return err
+	})
+}
+
+// JSONReporter writes a summary of the test results to a file in JSON
+type JSONReporter struct {
+	resultCollector
+	Filename string
+}
+
+// NewJSONReporter returns a reporter that writes a JSON summary to the named file
+func NewJSONReporter(filename string) *JSONReporter {
+	return &JSONReporter{Filename: filename}
+}
+
+// jsonResult is the JSON representation of a TestResult, with durations in seconds
+type jsonResult struct {
+	Name            string    `json:"name"`
+	Suite           string    `json:"suite"`
+	Pass            bool      `json:"pass"`
+	Skipped         bool      `json:"skipped,omitempty"`
+	SkipReason      string    `json:"skipReason,omitempty"`
+	FailedStage     string    `json:"failedStage,omitempty"`
+	Start           time.Time `json:"start"`
+	Duration        float64   `json:"duration"`
+	SetupDuration   float64   `json:"setupDuration"`
+	RunDuration     float64   `json:"runDuration"`
+	CleanupDuration float64   `json:"cleanupDuration"`
+	CleanupError    string    `json:"cleanupError,omitempty"`
+}
+
+type jsonSummary struct {
+	Tests    int     `json:"tests"`
+	Passed   int     `json:"passed"`
+	Failed   int     `json:"failed"`
+	Skipped  int     `json:"skipped"`
+	Duration float64 `json:"duration"`
+	// Failures contains the names of the failed tests prefixed by their suite
+	Failures []string     `json:"failures"`
+	Results  []jsonResult `json:"results"`
+}
+
+func (r *JSONReporter) Close() error {
+	suites, results := r.collected()
+	summary := jsonSummary{Failures: []string{}, Results: []jsonResult{}}
+	for _, name := range suites {
+		for _, result := range results[name] {
+			summary.Tests++
+			if result.Skipped {
+				summary.Skipped++
+			} else if result.Pass {
+				summary.Passed++
+			} else {
+				summary.Failed++
+				summary.Failures = append(summary.Failures, name+": "+result.Name)
+			}
+			summary.Duration += result.Duration.Seconds()
+			summary.Results = append(summary.Results, jsonResult{
+				Name:            result.Name,
+				Suite:           result.Suite,
+				Pass:            result.Pass,
+				Skipped:         result.Skipped,
+				SkipReason:      result.SkipReason,
+				FailedStage:     result.FailedStage,
+				Start:           result.Start,
+				Duration:        result.Duration.Seconds(),
+				SetupDuration:   result.SetupDuration.Seconds(),
+				RunDuration:     result.RunDuration.Seconds(),
+				CleanupDuration: result.CleanupDuration.Seconds(),
+				CleanupError:    result.CleanupError,
+			})
+		}
+	}
+	return writeFile(r.Filename, func(f *os.File) error {
+		encoder := json.NewEncoder(f)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(summary)
+	})
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package anvil
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/JacoJooste/iot-edge/v7/tests/internal/anvil/am"
+)
+
+// AMVersion is the version of an AM server
+type AMVersion struct {
+	Major, Minor, Patch int
+}
+
+// ParseAMVersion parses a version of the form major.minor.patch, ignoring any suffix such as "-SNAPSHOT"
+func ParseAMVersion(version string) (v AMVersion, err error) {
+	if i := strings.IndexAny(version, "-+ "); i >= 0 {
+		version = version[:i]
+	}
+	parts := strings.Split(version, ".")
+	if len(parts) > 3 {
+		return v, fmt.Errorf("invalid AM version %s", version)
+	}
+	numbers := make([]int, 3)
+	for i, p := range parts {
+		if numbers[i], err = strconv.Atoi(p); err != nil {
+			return v, fmt.Errorf("invalid AM version %s", version)
+		}
+	}
+	return AMVersion{Major: numbers[0], Minor: numbers[1], Patch: numbers[2]}, nil
+}
+
+// AtLeast returns true if the version is the same as or later than the other version
+func (v AMVersion) AtLeast(other AMVersion) bool {
+	if v.Major != other.Major {
+		return v.Major > other.Major
+	}
+	if v.Minor != other.Minor {
+		return v.Minor > other.Minor
+	}
+	return v.Patch >= other.Patch
+}
+
+// Known returns true if the version has been detected
+func (v AMVersion) Known() bool {
+	return v != AMVersion{}
+}
+
+func (v AMVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// serverVersion is the version of the AM server under test, unknown until detected
+var serverVersion AMVersion
+
+// DetectAMVersion retrieves the version of the AM server under test, which is used to skip tests that require a later
+// version. All tests are run if the version is not detected.
+func DetectAMVersion() (AMVersion, error) {
+	serverVersion = AMVersion{}
+	version, err := am.GetVersion()
+	if err != nil {
+		return serverVersion, err
+	}
+	serverVersion, err = ParseAMVersion(version)
+	return serverVersion, err
+}
+
+// ServerVersion returns the detected version of the AM server under test
+func ServerVersion() AMVersion {
+	return serverVersion
+}
+
+// AMVersionAtLeast returns true if the AM server under test is the given version or later, so that tests can adapt to
+// the features of the server. Returns true if the version has not been detected.
+func AMVersionAtLeast(version string) bool {
+	v, err := ParseAMVersion(version)
+	if err != nil || !serverVersion.Known() {
+		return true
+	}
+	return serverVersion.AtLeast(v)
+}
+
+// VersionedTest is implemented by tests of features that are not present in all versions of AM
+type VersionedTest interface {
+	// MinimumAMVersion returns the earliest version of AM that supports the tested feature
+	MinimumAMVersion() string
+}
+
+// skipReason returns the reason for skipping the test, or the empty string if the test should run
+func skipReason(t SDKTest) string {
+	versioned, ok := t.(VersionedTest)
+	if !ok || AMVersionAtLeast(versioned.MinimumAMVersion()) {
+		return ""
+	}
+	return fmt.Sprintf("requires AM %s, server is %s", versioned.MinimumAMVersion(), serverVersion)
+}
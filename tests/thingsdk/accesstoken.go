@@ -17,8 +17,6 @@
 package main
 
 import (
-	"reflect"
-	"sort"
 	"strings"
 
 	"github.com/JacoJooste/iot-edge/v7/pkg/builder"
@@ -216,15 +214,15 @@ func verifyAccessTokenResponse(response thing.AccessTokenResponse, subject strin
 		anvil.DebugLogger.Printf("access token subject, %s, not equal to thing ID, %s\n", claims.Subject, subject)
 		return false
 	}
-	receivedScopes, err := response.Scope()
+	match, err := response.CompareScopes(requestedScopes...)
 	if err != nil {
 		anvil.DebugLogger.Println(err)
 		return false
 	}
-	sort.Strings(receivedScopes)
-	sort.Strings(requestedScopes)
-	if !reflect.DeepEqual(requestedScopes, receivedScopes) {
-		anvil.DebugLogger.Printf("received scopes %s not equal to requested scopes %s\n", receivedScopes, requestedScopes)
+	if match != thing.ScopeExact {
+		receivedScopes, _ := response.Scope()
+		anvil.DebugLogger.Printf("received scopes %s %s from requested scopes %s\n", receivedScopes, match,
+			requestedScopes)
 		return false
 	}
 	return true
@@ -23,6 +23,13 @@ import (
 	"gopkg.in/square/go-jose.v2"
 )
 
+// thingAttributes are the attributes that the IoT Service allows the thing to read
+type thingAttributes struct {
+	ID          string `attribute:"_id"`
+	ThingConfig string `attribute:"thingConfig"`
+	ThingType   string `attribute:"thingType"`
+}
+
 // AttributesWithNoFilter requests all the thing's allowed attributes, which is configured in the IoT Service as
 // `thingConfig` and `thingType`
 type AttributesWithNoFilter struct {
@@ -45,22 +52,13 @@ func (t *AttributesWithNoFilter) Run(state anvil.TestState, data anvil.ThingData
 		anvil.DebugLogger.Println("attributes request failed: ", err)
 		return false
 	}
-	id, err := response.ID()
-	if err != nil {
-		anvil.DebugLogger.Println(err)
-		return false
-	}
-	thingConfig, err := response.GetFirst("thingConfig")
-	if err != nil {
-		anvil.DebugLogger.Println(err)
-		return false
-	}
-	thingType, err := response.GetFirst("thingType")
-	if err != nil {
+	var attributes thingAttributes
+	if err = response.Unmarshal(&attributes); err != nil {
 		anvil.DebugLogger.Println(err)
 		return false
 	}
-	return id == data.Id.Name && thingConfig == data.Id.ThingConfig && thingType == string(data.Id.ThingType)
+	return attributes.ID == data.Id.Name && attributes.ThingConfig == data.Id.ThingConfig &&
+		attributes.ThingType == string(data.Id.ThingType)
 }
 
 // AttributesWithFilter requests a filtered list of the thing's allowed attributes, which is configured in the
@@ -85,22 +83,16 @@ func (t *AttributesWithFilter) Run(state anvil.TestState, data anvil.ThingData)
 		anvil.DebugLogger.Println("attributes request failed: ", err)
 		return false
 	}
-	id, err := response.ID()
-	if err != nil {
-		anvil.DebugLogger.Println(err)
+	if response.Has("thingType") {
+		anvil.DebugLogger.Println("expected thingType to be filtered out")
 		return false
 	}
-	thingConfig, err := response.GetFirst("thingConfig")
-	if err != nil {
+	var attributes thingAttributes
+	if err = response.Unmarshal(&attributes); err != nil {
 		anvil.DebugLogger.Println(err)
 		return false
 	}
-	_, err = response.GetFirst("thingType")
-	if err == nil {
-		anvil.DebugLogger.Println("expected thingType to be filtered out")
-		return false
-	}
-	return id == data.Id.Name && thingConfig == data.Id.ThingConfig
+	return attributes.ID == data.Id.Name && attributes.ThingConfig == data.Id.ThingConfig
 }
 
 func doSetup(state anvil.TestState) (data anvil.ThingData, ok bool) {
@@ -143,22 +135,13 @@ func (t *AttributesWithNonRestrictedToken) Run(state anvil.TestState, data anvil
 		anvil.DebugLogger.Println("attributes request failed: ", err)
 		return false
 	}
-	id, err := response.ID()
-	if err != nil {
-		anvil.DebugLogger.Println(err)
-		return false
-	}
-	thingConfig, err := response.GetFirst("thingConfig")
-	if err != nil {
-		anvil.DebugLogger.Println(err)
-		return false
-	}
-	thingType, err := response.GetFirst("thingType")
-	if err != nil {
+	var attributes thingAttributes
+	if err = response.Unmarshal(&attributes); err != nil {
 		anvil.DebugLogger.Println(err)
 		return false
 	}
-	return id == data.Id.Name && thingConfig == data.Id.ThingConfig && thingType == string(data.Id.ThingType)
+	return attributes.ID == data.Id.Name && attributes.ThingConfig == data.Id.ThingConfig &&
+		attributes.ThingType == string(data.Id.ThingType)
 }
 
 // AttributesExpiredSession requests a thing's attributes after the current session has been 'expired'
@@ -80,6 +80,30 @@ func (t *AuthenticateThingJWTNonDefaultKID) Run(state anvil.TestState, data anvi
 	return err == nil
 }
 
+// AuthenticateThingJWTThumbprintKID tests the authentication of a pre-registered device with a key ID derived from
+// the JWK thumbprint of its key by the SDK
+type AuthenticateThingJWTThumbprintKID struct {
+	anvil.NopSetupCleanup
+}
+
+func (t *AuthenticateThingJWTThumbprintKID) Setup(state anvil.TestState) (data anvil.ThingData, ok bool) {
+	var err error
+	data.Id.ThingKeys, data.Signer, err = anvil.ConfirmationKey(jose.ES256)
+	if err != nil {
+		anvil.DebugLogger.Println("failed to generate confirmation key", err)
+		return data, false
+	}
+	data.Id.ThingType = callback.TypeDevice
+	return anvil.CreateIdentity(state.RealmForConfiguration(), data)
+}
+
+func (t *AuthenticateThingJWTThumbprintKID) Run(state anvil.TestState, data anvil.ThingData) bool {
+	// the key ID is not provided to the SDK
+	data.Signer.KID = ""
+	_, err := thingJWTAuth(state, data).WithThumbprintKeyID().Create()
+	return err == nil
+}
+
 // AuthenticateWithoutConfirmationKey tests the authentication of a pre-registered device that has no confirmation key
 // configured, which is expected to fail.
 type AuthenticateWithoutConfirmationKey struct {
@@ -126,17 +150,21 @@ func (t *AuthenticateWithCustomClaims) Setup(state anvil.TestState) (data anvil.
 
 func (t *AuthenticateWithCustomClaims) Run(state anvil.TestState, data anvil.ThingData) bool {
 	state.SetGatewayTree(jwtPopAuthTreeCustomClaims)
+	claims, err := callback.NewClaims(
+		callback.ClaimDefinition{Name: "life_universe_everything", Type: callback.ClaimString, Required: true}).
+		String("life_universe_everything", "42").
+		Build()
+	if err != nil {
+		anvil.DebugLogger.Println(err)
+		return false
+	}
 	builder := builder.Thing().
 		ConnectTo(state.URL()).
 		InRealm(state.TestRealm()).
 		WithTree(jwtPopAuthTreeCustomClaims).
-		AuthenticateThing(data.Id.Name, state.Audience(), data.Signer.KID, data.Signer.Signer, func() interface{} {
-			return struct {
-				LifeUniverseEverything string `json:"life_universe_everything"`
-			}{"42"}
-		})
+		AuthenticateThing(data.Id.Name, state.Audience(), data.Signer.KID, data.Signer.Signer, claims)
 
-	_, err := builder.Create()
+	_, err = builder.Create()
 	return err == nil
 }
 
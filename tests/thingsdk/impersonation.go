@@ -0,0 +1,134 @@
+/*
+ * Copyright 2020 ForgeRock AS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"github.com/JacoJooste/iot-edge/v7/pkg/builder"
+	"github.com/JacoJooste/iot-edge/v7/pkg/callback"
+	"github.com/JacoJooste/iot-edge/v7/tests/internal/anvil"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// ImpersonateThing checks that a service can read the attributes of a device for which the key of the service is
+// registered, through the tree that runs the impersonation script
+type ImpersonateThing struct {
+	anvil.NopSetupCleanup
+	service anvil.ThingData
+}
+
+func (t *ImpersonateThing) Setup(state anvil.TestState) (data anvil.ThingData, ok bool) {
+	var err error
+	// the keys are shared between tests by algorithm, so the service and the device use different algorithms
+	t.service.Id.ThingKeys, t.service.Signer, err = anvil.ConfirmationKey(jose.ES384)
+	if err != nil {
+		anvil.DebugLogger.Println("failed to generate confirmation key", err)
+		return data, false
+	}
+	t.service.Id.ThingType = callback.TypeService
+	if t.service, ok = anvil.CreateIdentity(state.RealmForConfiguration(), t.service); !ok {
+		return data, false
+	}
+	data.Id.ThingKeys, data.Signer, err = anvil.ConfirmationKey(jose.ES256)
+	if err != nil {
+		anvil.DebugLogger.Println("failed to generate confirmation key", err)
+		return data, false
+	}
+	// register the key of the service for the device so that the service can authenticate as the device
+	data.Id.ThingKeys.Keys = append(data.Id.ThingKeys.Keys, t.service.Id.ThingKeys.Keys...)
+	data.Id.ThingType = callback.TypeDevice
+	data.Id.ThingConfig = "host=localhost;port=80"
+	return anvil.CreateIdentity(state.RealmForConfiguration(), data)
+}
+
+func (t *ImpersonateThing) Run(state anvil.TestState, data anvil.ThingData) bool {
+	state.SetGatewayTree(jwtPopAuthTreeImpersonation)
+	service, err := builder.Thing().
+		ConnectTo(state.URL()).
+		InRealm(state.TestRealm()).
+		WithTree(jwtPopAuthTreeImpersonation).
+		AsService().
+		AuthenticateThing(t.service.Id.Name, state.Audience(), t.service.Signer.KID, t.service.Signer.Signer, nil).
+		Create()
+	if err != nil {
+		anvil.DebugLogger.Println(err)
+		return false
+	}
+	impersonation, err := service.Impersonate(data.Id.Name)
+	if err != nil {
+		anvil.DebugLogger.Println("impersonation failed: ", err)
+		return false
+	}
+	response, err := impersonation.RequestAttributes("thingConfig")
+	if err != nil {
+		anvil.DebugLogger.Println("attributes request failed: ", err)
+		return false
+	}
+	var attributes thingAttributes
+	if err = response.Unmarshal(&attributes); err != nil {
+		anvil.DebugLogger.Println(err)
+		return false
+	}
+	return attributes.ID == data.Id.Name && attributes.ThingConfig == data.Id.ThingConfig
+}
+
+// ImpersonateThingAsDevice checks that the impersonation script rejects an actor that is not a service, even if its
+// key is registered for the impersonated thing
+type ImpersonateThingAsDevice struct {
+	ImpersonateThing
+}
+
+func (t *ImpersonateThingAsDevice) Setup(state anvil.TestState) (data anvil.ThingData, ok bool) {
+	var err error
+	t.service.Id.ThingKeys, t.service.Signer, err = anvil.ConfirmationKey(jose.ES384)
+	if err != nil {
+		anvil.DebugLogger.Println("failed to generate confirmation key", err)
+		return data, false
+	}
+	t.service.Id.ThingType = callback.TypeDevice
+	if t.service, ok = anvil.CreateIdentity(state.RealmForConfiguration(), t.service); !ok {
+		return data, false
+	}
+	data.Id.ThingKeys, data.Signer, err = anvil.ConfirmationKey(jose.ES256)
+	if err != nil {
+		anvil.DebugLogger.Println("failed to generate confirmation key", err)
+		return data, false
+	}
+	data.Id.ThingKeys.Keys = append(data.Id.ThingKeys.Keys, t.service.Id.ThingKeys.Keys...)
+	data.Id.ThingType = callback.TypeDevice
+	return anvil.CreateIdentity(state.RealmForConfiguration(), data)
+}
+
+func (t *ImpersonateThingAsDevice) Run(state anvil.TestState, data anvil.ThingData) bool {
+	state.SetGatewayTree(jwtPopAuthTreeImpersonation)
+	// the SDK only lets services impersonate, so the device claims to be a service
+	device, err := builder.Thing().
+		ConnectTo(state.URL()).
+		InRealm(state.TestRealm()).
+		WithTree(jwtPopAuthTreeImpersonation).
+		AsService().
+		AuthenticateThing(t.service.Id.Name, state.Audience(), t.service.Signer.KID, t.service.Signer.Signer, nil).
+		Create()
+	if err != nil {
+		anvil.DebugLogger.Println(err)
+		return false
+	}
+	if _, err = device.Impersonate(data.Id.Name); err == nil {
+		anvil.DebugLogger.Println("expected the impersonation by a device to be rejected")
+		return false
+	}
+	return true
+}
@@ -17,13 +17,21 @@
 package main
 
 import (
+	"bytes"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
 	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sync"
 
 	"github.com/JacoJooste/iot-edge/v7/internal/debug"
 	"github.com/JacoJooste/iot-edge/v7/tests/internal/anvil"
@@ -34,19 +42,35 @@ import (
 const (
 	execDir     = "./tests/thingsdk"
 	testdataDir = execDir + "/testdata"
-	debugDir    = execDir + "/debug"
+	// the debug of each AM server in a matrix run is written to its own subdirectory
+	baseDebugDir = execDir + "/debug"
 
 	// Auth trees
-	jwtPopAuthTree             = "Anvil-JWT-Auth"
-	jwtPopAuthTreeCustomClaims = "Anvil-JWT-Auth-Custom-Claims"
-	jwtPopRegCertTree          = "Anvil-JWT-Reg-Cert"
-	userPwdAuthTree            = "Anvil-User-Pwd"
+	jwtPopAuthTree              = "Anvil-JWT-Auth"
+	jwtPopAuthTreeCustomClaims  = "Anvil-JWT-Auth-Custom-Claims"
+	jwtPopAuthTreeImpersonation = "Anvil-JWT-Auth-Impersonation"
+	jwtPopRegCertTree           = "Anvil-JWT-Reg-Cert"
+	userPwdAuthTree             = "Anvil-User-Pwd"
+)
+
+// debugDir is the directory to which the debug of the current test run is written
+var debugDir = baseDebugDir
+
+// runLogger writes to the debug log of the current test run
+var runLogger *log.Logger
+
+// debug log flags, so that soak runs do not fill the disk
+var (
+	debugMaxSize = flag.Int64("debug-max-size", anvil.DebugLogMaxSize>>20,
+		"size in MiB at which a debug log is rolled over, 0 for no limit")
+	debugBackups = flag.Int("debug-backups", anvil.DebugLogBackups, "number of rolled over debug logs kept per log")
 )
 
 // define the full test set
 var tests = []anvil.SDKTest{
 	&AuthenticateThingJWT{},
 	&AuthenticateThingJWTNonDefaultKID{},
+	&AuthenticateThingJWTThumbprintKID{},
 	&AuthenticateWithoutConfirmationKey{},
 	&AuthenticateWithCustomClaims{},
 	&AuthenticateWithIncorrectCustomClaim{},
@@ -98,6 +122,8 @@ var tests = []anvil.SDKTest{
 	&AttributesWithFilter{},
 	&AttributesWithNonRestrictedToken{},
 	&AttributesExpiredSession{},
+	&ImpersonateThing{},
+	&ImpersonateThingAsDevice{},
 	&SessionValid{},
 	&SessionInvalid{},
 	&SessionLogout{},
@@ -109,13 +135,25 @@ func runAllTestsForContext(testCtx anvil.TestState) (result bool) {
 	subDir := filepath.Join(debugDir, fmt.Sprintf("%sClient", testCtx.ClientType()))
 
 	result = true
-	var logfile *os.File
 	for _, test := range tests {
-		debug.Logger, logfile = anvil.NewFileDebugger(subDir, anvil.TestName(test))
+		// the debug loggers are global so the debug of tests that run in parallel is written to the run log instead
+		var logfile io.Closer
+		if *parallel <= 1 {
+			logger, file, err := anvil.NewFileDebugger(subDir, anvil.TestName(test))
+			if err != nil {
+				fmt.Printf("Unable to create the debug log of %s, writing to the run log; %v\n", anvil.TestName(test), err)
+			} else {
+				debug.Logger, logfile = logger, file
+			}
+		}
 		if !anvil.RunTest(testCtx, test) {
 			result = false
 		}
-		_ = logfile.Close()
+		if logfile != nil {
+			_ = logfile.Close()
+			// the debug of work that outlives the test, such as a background refresh, is written to the run log
+			debug.Logger, anvil.DebugLogger = runLogger, runLogger
+		}
 	}
 	return result
 }
@@ -139,7 +177,7 @@ func (i realmInfo) String() string {
 	return fmt.Sprintf("%s (%s)", s, extra)
 }
 
-func runAllTestsForRealm(realm realmInfo) (result bool, err error) {
+func runAllTestsForRealm(realm realmInfo, progress *log.Logger) (result bool, err error) {
 	err = anvil.ConfigureTestRealm(realm.name, testdataDir)
 	if err != nil {
 		return false, err
@@ -148,17 +186,24 @@ func runAllTestsForRealm(realm realmInfo) (result bool, err error) {
 		err = anvil.RestoreTestRealm(realm.name, testdataDir)
 	}()
 
-	fmt.Printf("\n\n-- Running Tests in %s --\n\n", realm)
+	progress.Printf("\n\n-- Running Tests in %s --\n\n", realm)
 
-	fmt.Printf("-- Running AM Connection Tests --\n\n")
-	result = runAllTestsForContext(&anvil.AMTestState{
-		TestAudience:  realm.audience,
-		TestURL:       realm.u,
-		Realm:         realm.name,
-		DNSConfigured: realm.dnsConfigured,
-	})
+	result = true
+	if testClient(anvil.AMClientType) {
+		progress.Printf("-- Running AM Connection Tests --\n\n")
+		result = runAllTestsForContext(&anvil.AMTestState{
+			TestAudience:   realm.audience,
+			TestURL:        realm.u,
+			Realm:          realm.name,
+			DNSConfigured:  realm.dnsConfigured,
+			ProgressLogger: progress,
+		})
+	}
+	if !testClient(anvil.GatewayClientType) {
+		return result, nil
+	}
 
-	fmt.Printf("\n-- Running Thing Gateway COAP Connection Tests --\n\n")
+	progress.Printf("\n-- Running Thing Gateway COAP Connection Tests --\n\n")
 
 	// run the Thing Gateway
 	gateway, err := anvil.TestThingGateway(realm.u, realm.name, realm.audience, jwtPopAuthTree, realm.dnsConfigured)
@@ -178,32 +223,90 @@ func runAllTestsForRealm(realm realmInfo) (result bool, err error) {
 
 	result = runAllTestsForContext(
 		&anvil.ThingGatewayTestState{
-			ThingGateway: gateway,
-			Realm:        realm.name,
-			TestAudience: realm.audience,
+			ThingGateway:   gateway,
+			Realm:          realm.name,
+			TestAudience:   realm.audience,
+			ProgressLogger: progress,
 		}) && result
 
 	return result, nil
 }
 
+// runAllRealms runs the full test set in each realm. The realms are independent of each other so up to the parallel
+// flag number of realms are tested at the same time. The progress of a realm is buffered while the realms run in
+// parallel and written once the realm has finished, so that the output of the realms is not interleaved. The tests
+// within a realm always run sequentially since they modify the configuration of the realm and its test gateway.
+func runAllRealms(realms []realmInfo) (allPass bool, err error) {
+	if *parallel <= 1 {
+		allPass = true
+		for _, r := range realms {
+			pass, err := runAllTestsForRealm(r, anvil.ProgressLogger)
+			allPass = allPass && pass
+			if err != nil {
+				return allPass, err
+			}
+		}
+		return allPass, nil
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mutex    sync.Mutex
+		firstErr error
+	)
+	allPass = true
+	limit := make(chan struct{}, *parallel)
+	for _, r := range realms {
+		wg.Add(1)
+		go func(r realmInfo) {
+			defer wg.Done()
+			limit <- struct{}{}
+			defer func() { <-limit }()
+
+			var buffer bytes.Buffer
+			pass, err := runAllTestsForRealm(r, log.New(&buffer, "", 0))
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			anvil.ProgressLogger.Print(buffer.String())
+			allPass = allPass && pass
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}(r)
+	}
+	wg.Wait()
+	return allPass, firstErr
+}
+
 func runTests() (err error) {
 	fmt.Println()
 	fmt.Println("=====================")
 	fmt.Println("-- Thing SDK Tests --")
 	fmt.Println("=====================")
 
-	var logfile *os.File
 	// delete old debug files by removing the debug directory
 	err = os.RemoveAll(debugDir)
 	if err != nil {
 		return err
 	}
-	thingsdkLogger, logfile := anvil.NewFileDebugger(debugDir, "thingsdk")
+	thingsdkLogger, logfile, err := anvil.NewFileDebugger(debugDir, "thingsdk")
+	if err != nil {
+		return err
+	}
+	runLogger = thingsdkLogger
 	am.DebugLogger, debug.Logger = thingsdkLogger, thingsdkLogger
 	defer func() {
 		_ = logfile.Close()
 	}()
 
+	version, err := anvil.DetectAMVersion()
+	if err != nil {
+		fmt.Printf("Unable to detect the AM version, running all tests; %v\n", err)
+	} else {
+		fmt.Printf("-- AM %s --\n", version)
+	}
+
 	err = anvil.CreateCertVerificationMapping()
 	if err != nil {
 		return err
@@ -251,19 +354,15 @@ func runTests() (err error) {
 		}
 	}()
 
-	allPass := true
-	for _, r := range []realmInfo{
+	allPass, err := runAllRealms([]realmInfo{
 		{description: "root", name: anvil.RootRealm, audience: anvil.RootRealm, u: anvil.BaseURL()},
 		{description: "sub-realm", name: subRealm, audience: subRealm, u: anvil.BaseURL()},
 		{description: "sub-sub-realm", name: subSubRealm, audience: subSubRealm, u: anvil.BaseURL()},
 		{description: "realm with alias", name: alias, audience: anvil.RootRealm + aliasRealm, u: anvil.BaseURL()},
 		{description: "realm with DNS alias", name: dnsRealm, audience: anvil.RootRealm + dnsRealm, u: dnsURL, dnsConfigured: true},
-	} {
-		pass, err := runAllTestsForRealm(r)
-		allPass = allPass && pass
-		if err != nil {
-			return err
-		}
+	})
+	if err != nil {
+		return err
 	}
 
 	if !allPass {
@@ -272,8 +371,138 @@ func runTests() (err error) {
 	return nil
 }
 
+// report flags, a report is only written if its file is given
+var (
+	junitFile = flag.String("junit", "", "write a JUnit XML report of the test results to the file")
+	jsonFile  = flag.String("json", "", "write a JSON summary of the test results to the file")
+)
+
+// parallel is the maximum number of realms that are tested at the same time
+var parallel = flag.Int("parallel", 1, "maximum number of realms tested in parallel")
+
+// selection flags, so that a single scenario can be run without running the full test set
+var (
+	runPattern  = flag.String("run", "", "run only the tests with names that match the regular expression")
+	skipPattern = flag.String("skip", "", "skip the tests with names that match the regular expression")
+	clientType  = flag.String("client", "all", "client type to test: am, gateway or all")
+)
+
+// selectTests removes the tests that do not match the selection flags from the test set
+func selectTests() error {
+	var run, skip *regexp.Regexp
+	var err error
+	if *runPattern != "" {
+		if run, err = regexp.Compile(*runPattern); err != nil {
+			return fmt.Errorf("invalid -run pattern; %w", err)
+		}
+	}
+	if *skipPattern != "" {
+		if skip, err = regexp.Compile(*skipPattern); err != nil {
+			return fmt.Errorf("invalid -skip pattern; %w", err)
+		}
+	}
+	switch *clientType {
+	case "all", anvil.AMClientType, anvil.GatewayClientType:
+	default:
+		return fmt.Errorf("unknown client type %s", *clientType)
+	}
+	var selected []anvil.SDKTest
+	for _, test := range tests {
+		name := anvil.TestName(test)
+		if (run == nil || run.MatchString(name)) && (skip == nil || !skip.MatchString(name)) {
+			selected = append(selected, test)
+		}
+	}
+	if len(selected) == 0 {
+		return fmt.Errorf("no tests match the selection")
+	}
+	tests = selected
+	return nil
+}
+
+// testClient returns true if the tests should be run with the given client type
+func testClient(client string) bool {
+	return *clientType == "all" || *clientType == client
+}
+
+// matrixFile contains the AM servers to test, the server at the default domain is tested if not set
+var matrixFile = flag.String("matrix", "", "JSON file listing the AM servers to run the tests against")
+
+// matrixEntry describes an AM server in the test matrix
+type matrixEntry struct {
+	// Name identifies the server in the output, for example "am-7.0"
+	Name string `json:"name"`
+	// Domain of the server, including the port, see am.Domain
+	Domain string `json:"domain"`
+}
+
+// loadMatrix reads the AM servers in the matrix file
+func loadMatrix(filename string) (entries []matrixEntry, err error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, &entries); err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.Name == "" || e.Domain == "" {
+			return nil, fmt.Errorf("matrix entries require a name and domain")
+		}
+	}
+	return entries, nil
+}
+
+// runMatrix runs the tests against each AM server in the matrix, continuing with the next server if one fails
+func runMatrix(entries []matrixEntry) (err error) {
+	var failed []string
+	for _, e := range entries {
+		fmt.Printf("\n\n==== AM server %s (%s) ====\n", e.Name, e.Domain)
+		am.SetDomain(e.Domain)
+		debugDir = filepath.Join(baseDebugDir, e.Name)
+		if err := runTests(); err != nil {
+			anvil.ProgressLogger.Printf("\n%s %s: %s", anvil.FailString, e.Name, err)
+			failed = append(failed, e.Name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("test FAILURE for AM servers %v", failed)
+	}
+	return nil
+}
+
+// closeReporters writes the reports of all the reporters
+func closeReporters() {
+	for _, r := range anvil.Reporters {
+		if err := r.Close(); err != nil {
+			anvil.ProgressLogger.Printf("failed to write test report; %v", err)
+		}
+	}
+}
+
 func main() {
-	if err := runTests(); err != nil {
+	flag.Parse()
+	anvil.DebugLogMaxSize, anvil.DebugLogBackups = *debugMaxSize<<20, *debugBackups
+	if err := selectTests(); err != nil {
+		anvil.ProgressLogger.Fatalf("%s %s", anvil.FailString, err)
+	}
+	if *junitFile != "" {
+		anvil.Reporters = append(anvil.Reporters, anvil.NewJUnitReporter(*junitFile))
+	}
+	if *jsonFile != "" {
+		anvil.Reporters = append(anvil.Reporters, anvil.NewJSONReporter(*jsonFile))
+	}
+	var err error
+	if *matrixFile != "" {
+		var entries []matrixEntry
+		if entries, err = loadMatrix(*matrixFile); err == nil {
+			err = runMatrix(entries)
+		}
+	} else {
+		err = runTests()
+	}
+	closeReporters()
+	if err != nil {
 		anvil.ProgressLogger.Fatalf("\n%s %s", anvil.FailString, err)
 	}
 	anvil.ProgressLogger.Println("\n", anvil.PassString)